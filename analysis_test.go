@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// TestParseAnalysis feeds parseAnalysis replies of the kind local models
+// give for the retrieval decision.
+func TestParseAnalysis(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	cases := []struct {
+		name, out string
+		ok        bool
+		want      questionAnalysis
+	}{
+		{"plain", `{"action":"RETRIEVE_MORE","k":10,"threshold":0.6,"query":"Ettling"}`, true, questionAnalysis{Action: "RETRIEVE_MORE", K: 10, Threshold: f(0.6), Query: "Ettling"}},
+		{"lowercase", `{"action":"answer_direct"}`, true, questionAnalysis{Action: "ANSWER_DIRECT"}},
+		{"preamble braces", "Sure! The set {a, b} is small. {\"action\":\"ANSWER_DIRECT\"}", true, questionAnalysis{Action: "ANSWER_DIRECT"}},
+		{"fenced", "```json\n{\"action\": \"RETRIEVE_MORE\", \"k\": 3}\n```", true, questionAnalysis{Action: "RETRIEVE_MORE", K: 3}},
+		{"think tags", "<think>{maybe}</think>\n{\"action\":\"RETRIEVE_MORE\",\"k\":null}", true, questionAnalysis{Action: "RETRIEVE_MORE"}},
+		{"array", `[{"action":"ANSWER_DIRECT"}]`, true, questionAnalysis{Action: "ANSWER_DIRECT"}},
+		{"k huge", `{"action":"RETRIEVE_MORE","k":5000}`, true, questionAnalysis{Action: "RETRIEVE_MORE", K: maxAnalysisK}},
+		{"k negative", `{"action":"RETRIEVE_MORE","k":-3}`, true, questionAnalysis{Action: "RETRIEVE_MORE", K: 1}},
+		{"threshold percent", `{"action":"RETRIEVE_MORE","threshold":60}`, true, questionAnalysis{Action: "RETRIEVE_MORE", Threshold: f(1)}},
+		{"threshold negative", `{"action":"RETRIEVE_MORE","threshold":-0.2}`, true, questionAnalysis{Action: "RETRIEVE_MORE", Threshold: f(0)}},
+		{"k string", `{"action":"RETRIEVE_MORE","k":"ten"}`, false, questionAnalysis{}},
+		{"k fraction", `{"action":"RETRIEVE_MORE","k":2.5}`, false, questionAnalysis{}},
+		{"threshold string", `{"action":"RETRIEVE_MORE","threshold":"0.6"}`, false, questionAnalysis{}},
+		{"query number", `{"action":"RETRIEVE_MORE","query":42}`, false, questionAnalysis{}},
+		{"unknown action", `{"action":"SEARCH_WEB"}`, false, questionAnalysis{}},
+		{"no json", `I think we should RETRIEVE_MORE.`, false, questionAnalysis{}},
+		{"truncated", `{"action":"RETRIEVE_MORE","k":1`, false, questionAnalysis{}},
+		{"empty", ``, false, questionAnalysis{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseAnalysis(c.out)
+			if (err == nil) != c.ok {
+				t.Fatalf("err %v", err)
+			}
+			if !c.ok {
+				return
+			}
+			if got.Action != c.want.Action || got.K != c.want.K || got.Query != c.want.Query || (got.Threshold == nil) != (c.want.Threshold == nil) || (got.Threshold != nil && *got.Threshold != *c.want.Threshold) {
+				t.Fatalf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestHeuristicAnalysis(t *testing.T) {
+	if a := heuristicAnalysis("ANSWER_DIRECT or RETRIEVE_MORE?", 5); a.Action != "RETRIEVE_MORE" || a.K != 5 || a.Threshold == nil || *a.Threshold != 0.6 {
+		t.Errorf("both actions: %+v", a)
+	}
+	if a := heuristicAnalysis("I'd say answer_direct.", 5); a.Action != "ANSWER_DIRECT" {
+		t.Errorf("answer direct: %+v", a)
+	}
+	if a := heuristicAnalysis("", 7); a.Action != "RETRIEVE_MORE" || a.K != 7 {
+		t.Errorf("empty: %+v", a)
+	}
+}
+
+func TestChatJSONWithoutResponseFormat(t *testing.T) {
+	var mu sync.Mutex
+	var formats []bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatReq
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		formats = append(formats, req.ResponseFormat != nil)
+		mu.Unlock()
+		if req.ResponseFormat != nil {
+			http.Error(w, `{"error":"response_format is not supported"}`, 400)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": map[string]any{"content": `{"action":"ANSWER_DIRECT"}`}}}})
+	}))
+	defer srv.Close()
+	lm := newLMClient(srv.URL, "embed", "chat", "")
+	for range 2 {
+		if out, err := lm.chatJSON(t.Context(), "system", []chatMsg{{Role: "user", Content: "?"}}, nil); err != nil || out != `{"action":"ANSWER_DIRECT"}` {
+			t.Fatalf("reply %q, %v", out, err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(formats) != 3 || !formats[0] || formats[1] || formats[2] {
+		t.Fatalf("response_format sent: %v, want only on the first request", formats)
+	}
+}
+
+func TestAnalysisFallbackInDebug(t *testing.T) {
+	e := newTestEnv(t, "Antwort.")
+	e.llm.aux = func(chatReq) string { return `{"action":"RETRIEVE_MORE","k":"ten"}` }
+	e.add(t, "Kaffee", "Kaffee wird vor dem Mahlen geröstet.")
+	dbg := sseEvents(e.ask(t, map[string]any{"question": "Wie hoch ist die Zugspitze?", "debug": true}), "debug")
+	if len(dbg) == 0 {
+		t.Fatal("no debug event")
+	}
+	var d struct {
+		Retrieval debugInfo `json:"retrieval"`
+	}
+	if err := json.Unmarshal([]byte(dbg[0]), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Retrieval.AnalysisFallback != "k is not a whole number: ten" || d.Retrieval.Decision != "lm_requested_retrieval" {
+		t.Fatalf("retrieval %+v", d.Retrieval)
+	}
+}
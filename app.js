@@ -51,6 +51,39 @@ function renderBubbleContent(el, content){
   // If marked.js isn't loaded, use pre-wrap for plain text fallback
   el.classList.toggle('plain', !window.marked);
   renderMermaidIn(el);
+  if(el._citations) linkCitations(el, el._citations);
+}
+
+// linkCitations turns [n] markers into superscripts showing the cited
+// chunk on hover.
+function linkCitations(el, cites){
+  const byN = {};
+  (cites||[]).forEach(c => { byN[c.n] = c; });
+  const walker = document.createTreeWalker(el, NodeFilter.SHOW_TEXT);
+  const nodes = [];
+  while(walker.nextNode()){
+    const n = walker.currentNode;
+    if(!n.parentElement.closest('pre, code, .cite') && /\[\d+\]/.test(n.nodeValue)) nodes.push(n);
+  }
+  nodes.forEach(node => {
+    const frag = document.createDocumentFragment();
+    let last = 0;
+    node.nodeValue.replace(/\[(\d+)\]/g, (m, num, off) => {
+      const c = byN[num];
+      if(!c) return m;
+      frag.appendChild(document.createTextNode(node.nodeValue.slice(last, off)));
+      const sup = document.createElement('sup');
+      sup.className = 'cite';
+      sup.textContent = m;
+      sup.title = `${c.article} #${c.chunk_idx}${c.score >= 0 ? ' · Score '+Number(c.score).toFixed(3) : ''}\n${c.snippet||''}`;
+      frag.appendChild(sup);
+      last = off + m.length;
+      return m;
+    });
+    if(last === 0) return;
+    frag.appendChild(document.createTextNode(node.nodeValue.slice(last)));
+    node.replaceWith(frag);
+  });
 }
 
 function timeShort(iso){
@@ -90,6 +123,14 @@ function setStatus(el, msg, cls){
   el.className = 'tool-status' + (cls ? ' '+cls : '');
 }
 
+// okStatus shows a success message, downgraded to a warning when the
+// server could not save the database afterwards.
+function okStatus(el, r, msg){
+  if(r && r.duplicate) setStatus(el, t('duplicate_source', r.existing_source), 'warn');
+  else if(r && r.warning) setStatus(el, msg + ' · ' + r.warning, 'warn');
+  else setStatus(el, msg, 'ok');
+}
+
 function setLoading(selectorOrEl, on){
   let el = (typeof selectorOrEl === 'string') ? document.querySelector(selectorOrEl) : selectorOrEl;
   if(!el) return;
@@ -111,9 +152,35 @@ const _translations = {
     importing: 'Importiere…',
     uploading: 'Upload…',
     ok_chunks: (chunks, total) => `OK: ${chunks} Chunks hinzugefügt. Total: ${total}`,
+    duplicate_source: name => `Bereits vorhanden als „${name}“, nichts hinzugefügt.`,
+    skipped_binary: n => `${n} Binärdatei(en) übersprungen`,
+    upload_conflict: name => `Es gibt bereits eine Quelle „${name}“ mit anderem Inhalt. Ersetzen?`,
+    upload_keep_both: 'Stattdessen beide behalten (die neue Datei bekommt einen anderen Namen)?',
     not_found_intro: 'Nicht gefunden. Meintest du:',
     error_prefix: 'Fehler: ',
     assistant_typing: 'Assistent denkt nach',
+    stage_embedding_query: 'Frage wird eingebettet',
+    stage_searching: 'Durchsuche Wissensbasis',
+    stage_planning: 'Wähle Kontext aus',
+    stage_generating: 'Antwort wird erzeugt',
+    stage_executing_tool: name => `Tool ${name} läuft`,
+    stage_continuing: 'Antwort wird fortgesetzt',
+    stage_rewriting_query: 'Folgefrage wird umformuliert',
+    planning_thinking: 'denkt nach…',
+    stage_deep_planning: 'Recherche wird geplant',
+    stage_deep_plan: (_, d) => `Plan: ${d.plan.join(' · ')}`,
+    stage_deep_step: (q, d) => `Teilfrage ${d.step}/${d.steps}: ${q}`,
+    similar_asked: title => `Das hast du schon einmal gefragt${title ? ` (in „${title}“)` : ''}:`,
+    similar_open: 'Chat öffnen',
+    empty_kb_note: 'Die Wissensbasis ist leer, die Antwort stützt sich auf keine Dokumente.',
+    empty_kb_add: 'Quellen hinzufügen',
+    empty_tags_note: 'Keine Quelle trägt diese Tags, die Antwort stützt sich auf keine Dokumente.',
+    refused_no_context: 'Strenger Modus: Die Suche hat nichts gefunden, daher keine Antwort des Modells.',
+    refused_low_score: 'Strenger Modus: Kein Treffer war relevant genug, daher keine Antwort des Modells.',
+    tag_filter: (tags, n) => `Nur Quellen mit ${tags} (${n})`,
+    preview_meta: (chunks, chars, created, updated) => `${chunks} Chunks · ${chars} Zeichen · erstellt ${created} · aktualisiert ${updated}`,
+    preview_more: (shown, total) => `Vorschau: ${shown} von ${total} Chunks.`,
+    preview_provenance: p => `Von ${p.tool} für „${p.query}“ am ${timeShort(p.at)}${p.chat_id ? ` · Chat ${p.chat_id}` : ''}${p.request_id ? ` · Anfrage ${p.request_id}` : ''}`,
     // New translations for UI elements
     skip_to_main: 'Zum Hauptinhalt springen',
     chunks_in_knowledge_base: 'Chunks in der Wissensbasis',
@@ -124,6 +191,8 @@ const _translations = {
     search: 'Suche',
     ingest: 'Daten hinzufügen',
     persona: 'Persona',
+    collection: 'Sammlung',
+    api_key: 'API-Key (optional)',
     debug: 'Debug',
     debug_description: 'Zeigt die RAG-Kontextdaten an, die das System für die Antwort verwendet',
     settings: 'Einstellungen',
@@ -154,7 +223,7 @@ const _translations = {
     upload_label: 'Textdatei hochladen',
     drop_zone_text: 'Datei hierher ziehen oder klicken',
     folder_label: 'Ordner importieren (alle Textdateien)',
-    folder_hint: 'Absoluter Pfad zum Ordner auf dem Server. Unterstützte Dateien: .txt, .md, .csv, .json, .xml, .html, .log u.a.',
+    folder_hint: 'Absoluter Pfad zum Ordner auf dem Server (innerhalb von -allowed-import-roots, standardmäßig das Arbeitsverzeichnis). Unterstützte Dateien: .txt, .md, .csv, .json, .xml, .html, .log u.a.',
     folder_placeholder: '/pfad/zum/ordner',
     recursive: 'Rekursiv',
     import: 'Importieren',
@@ -182,12 +251,25 @@ const _translations = {
     api_template_placeholder: 'https://example.com/search?q=$q',
     api_description: 'Beschreibung (optional)',
     api_desc_placeholder: 'Wofür ist die Quelle gut?',
+    api_method: 'Methode',
+    api_headers: 'Header (optional, einer pro Zeile)',
+    api_body: 'Body-Template (optional, mit $q)',
+    api_response_type: 'Antwort-Typ',
+    api_extract: 'JSON-Pfad (optional)',
+    api_test_query: 'Test-Anfrage',
+    api_test: 'Testen',
     add: 'Hinzufügen',
     new_persona: 'Neue Persona',
     persona_name: 'Name',
     persona_name_placeholder: 'z.B. Sachlicher Modus',
     persona_prompt: 'Pre-Prompt',
-    persona_prompt_placeholder: 'Instruktionen, Tonalität, Stil…'
+    persona_prompt_placeholder: 'Instruktionen, Tonalität, Stil…',
+    persona_tools: 'Erlaubte Tools',
+    persona_tools_placeholder: 'leer = alle Tools, z.B. wikipedia, rag_search',
+    persona_install_defaults: 'Standard-Personas',
+    export: 'Exportieren',
+    llm_unreachable: (url, err)=>`LLM-Endpoint ${url} nicht erreichbar – Fragen, Suche und Import sind deaktiviert, bis ein funktionierender Endpoint gespeichert ist. (${err})`,
+    llm_configure: 'Einstellungen öffnen'
   },
   en: {
     loading: 'Loading…',
@@ -196,9 +278,35 @@ const _translations = {
     importing: 'Importing…',
     uploading: 'Uploading…',
     ok_chunks: (chunks, total) => `OK: ${chunks} chunks added. Total: ${total}`,
+    duplicate_source: name => `Already stored as “${name}”, nothing added.`,
+    skipped_binary: n => `${n} binary file(s) skipped`,
+    upload_conflict: name => `A source “${name}” with different content already exists. Replace it?`,
+    upload_keep_both: 'Keep both instead (the new file gets another name)?',
     not_found_intro: 'Not found. Did you mean:',
     error_prefix: 'Error: ',
     assistant_typing: 'Assistant is thinking',
+    stage_embedding_query: 'Embedding the question',
+    stage_searching: 'Searching the knowledge base',
+    stage_planning: 'Choosing context',
+    stage_generating: 'Generating the answer',
+    stage_executing_tool: name => `Running tool ${name}`,
+    stage_continuing: 'Continuing the answer',
+    stage_rewriting_query: 'Rewriting the follow-up question',
+    planning_thinking: 'thinking…',
+    stage_deep_planning: 'Planning the research',
+    stage_deep_plan: (_, d) => `Plan: ${d.plan.join(' · ')}`,
+    stage_deep_step: (q, d) => `Sub-question ${d.step}/${d.steps}: ${q}`,
+    similar_asked: title => `You asked this before${title ? ` (in “${title}”)` : ''}:`,
+    similar_open: 'Open chat',
+    empty_kb_note: 'The knowledge base is empty, the answer is not based on any documents.',
+    empty_kb_add: 'Add sources',
+    empty_tags_note: 'No source carries these tags, the answer is not based on any documents.',
+    refused_no_context: 'Strict mode: the search found nothing, so the model was not asked.',
+    refused_low_score: 'Strict mode: no hit was relevant enough, so the model was not asked.',
+    tag_filter: (tags, n) => `Only sources tagged ${tags} (${n})`,
+    preview_meta: (chunks, chars, created, updated) => `${chunks} chunks · ${chars} characters · created ${created} · updated ${updated}`,
+    preview_more: (shown, total) => `Preview: ${shown} of ${total} chunks.`,
+    preview_provenance: p => `From ${p.tool} for “${p.query}” on ${timeShort(p.at)}${p.chat_id ? ` · chat ${p.chat_id}` : ''}${p.request_id ? ` · request ${p.request_id}` : ''}`,
     // New translations for UI elements
     skip_to_main: 'Skip to main content',
     chunks_in_knowledge_base: 'Chunks in knowledge base',
@@ -209,6 +317,8 @@ const _translations = {
     search: 'Search',
     ingest: 'Add Data',
     persona: 'Persona',
+    collection: 'Collection',
+    api_key: 'API key (optional)',
     debug: 'Debug',
     debug_description: 'Shows RAG context data that the system uses for the response',
     settings: 'Settings',
@@ -239,7 +349,7 @@ const _translations = {
     upload_label: 'Upload text file',
     drop_zone_text: 'Drag file here or click',
     folder_label: 'Import folder (all text files)',
-    folder_hint: 'Absolute path to folder on server. Supported files: .txt, .md, .csv, .json, .xml, .html, .log, etc.',
+    folder_hint: 'Absolute path to folder on server (inside -allowed-import-roots, by default the working directory). Supported files: .txt, .md, .csv, .json, .xml, .html, .log, etc.',
     folder_placeholder: '/path/to/folder',
     recursive: 'Recursive',
     import: 'Import',
@@ -267,12 +377,25 @@ const _translations = {
     api_template_placeholder: 'https://example.com/search?q=$q',
     api_description: 'Description (optional)',
     api_desc_placeholder: 'What is the source good for?',
+    api_method: 'Method',
+    api_headers: 'Headers (optional, one per line)',
+    api_body: 'Body template (optional, with $q)',
+    api_response_type: 'Response type',
+    api_extract: 'JSON path (optional)',
+    api_test_query: 'Test query',
+    api_test: 'Test',
     add: 'Add',
     new_persona: 'New Persona',
     persona_name: 'Name',
     persona_name_placeholder: 'e.g., Formal Mode',
     persona_prompt: 'Pre-Prompt',
-    persona_prompt_placeholder: 'Instructions, tone, style…'
+    persona_prompt_placeholder: 'Instructions, tone, style…',
+    persona_tools: 'Allowed tools',
+    persona_tools_placeholder: 'empty = all tools, e.g. wikipedia, rag_search',
+    persona_install_defaults: 'Default personas',
+    export: 'Export',
+    llm_unreachable: (url, err)=>`LLM endpoint ${url} unreachable – asking, searching and adding data are disabled until a working endpoint is saved. (${err})`,
+    llm_configure: 'Open settings'
   }
 };
 
@@ -320,6 +443,15 @@ function autosize(el){
   el.style.height = Math.min(el.scrollHeight, 200) + 'px';
 }
 
+// Ask the server to load the models while the user types (keep_warm);
+// at most once a minute, failures are only logged by the server.
+let lastWarmup = 0;
+function warmUp(){
+  if(Date.now() - lastWarmup < 60000) return;
+  lastWarmup = Date.now();
+  apiPost('/api/warmup').catch(()=>{});
+}
+
 // ═══════ Theme system ═══════
 const THEMES = ['dark','light','nord','solarized','monokai','dracula'];
 let currentTheme = 'dark';
@@ -433,6 +565,7 @@ function handleTabKeydown(e, selector, group){
 
 let currentChatId = '';
 let currentPersonaId = '';
+let currentCollection = '';
 let debugMode = false;
 let typingBubble = null;
 let lastDebugData = null;
@@ -499,11 +632,15 @@ function renderDebugPanel(data){
     <div class="debug-section-title">📊 RAG-Retrieval</div>
     <div class="debug-grid">
       <div class="debug-kv"><span class="debug-k">Top-K</span><span class="debug-v">${data.used_k||'?'} (Basis: ${data.base_k||'?'})</span></div>
+      <div class="debug-kv"><span class="debug-k">Suchanfrage</span><span class="debug-v">${escHtml(data.search_query||'–')}</span></div>
+      ${data.retrieval_query ? `<div class="debug-kv"><span class="debug-k">Folgefrage als</span><span class="debug-v">${escHtml(data.retrieval_query)}</span></div>` : ''}
+      ${data.focus ? `<div class="debug-kv"><span class="debug-k">Fokus</span><span class="debug-v">${escHtml(data.focus.tool)}: ${escHtml(data.focus.query)} · ${escHtml((data.focus.sources||[]).join(', '))} (+${ret.focus_boosted||0} Treffer bevorzugt)</span></div>` : ''}
+      <div class="debug-kv"><span class="debug-k">Schwellen</span><span class="debug-v">${ret.thresholds ? `hoch ${ret.thresholds.high} · locker ${ret.thresholds.relaxed} (${ret.thresholds.source === 'calibrated' ? 'kalibriert' : 'Standard'})` : '–'}</span></div>
       <div class="debug-kv"><span class="debug-k">Chunk-Größe</span><span class="debug-v">${data.chunk_size||'?'} Zeichen</span></div>
       <div class="debug-kv"><span class="debug-k">Chunks gesamt</span><span class="debug-v">${data.total_chunks||0}</span></div>
-      <div class="debug-kv"><span class="debug-k">Kontext</span><span class="debug-v">${data.context_chars||0} Zeichen</span></div>
+      <div class="debug-kv"><span class="debug-k">Kontext</span><span class="debug-v">${data.context_chars||0} Zeichen${ret.omitted_chunks||ret.omitted_neighbors ? ` · ${ret.omitted_chunks||0} Chunks, ${ret.omitted_neighbors||0} Nachbarn über Budget ausgelassen` : ''}</span></div>
       <div class="debug-kv"><span class="debug-k">System-Prompt</span><span class="debug-v">${data.system_prompt_chars||0} Zeichen</span></div>
-      <div class="debug-kv"><span class="debug-k">History</span><span class="debug-v">${data.history_messages||0} Nachrichten</span></div>
+      <div class="debug-kv"><span class="debug-k">History</span><span class="debug-v">${data.history_messages||0} Nachrichten · ~${data.history_tokens||0} Tokens</span></div>
       <div class="debug-kv"><span class="debug-k">Embedding</span><span class="debug-v">${ret.embed_ms!=null ? ret.embed_ms+'ms' : '?'}</span></div>
       <div class="debug-kv"><span class="debug-k">Vektor-Suche</span><span class="debug-v">${ret.search_ms!=null ? ret.search_ms+'ms' : '?'}</span></div>
       <div class="debug-kv"><span class="debug-k">Storage</span><span class="debug-v">${escHtml(data.storage_mode||'?')} · <code>${escHtml(data.db_path||'')}</code></span></div>
@@ -528,6 +665,19 @@ function renderDebugPanel(data){
     body.innerHTML += chunksHtml;
   }
 
+  // ── Rejected candidates ──
+  const rejected = (ret.rejected_chunks || []);
+  if(rejected.length){
+    const reasons = {below_threshold: 'unter Schwelle', k_limit: 'über k', budget: 'Kontext-Budget', answer_direct: 'Direktantwort'};
+    let html = `<div class="debug-section"><div class="debug-section-title">🚫 Verworfene Kandidaten (${rejected.length})</div><div class="debug-chunks">`;
+    rejected.forEach(c => {
+      const score = c.score < 0 ? '' : `<span class="debug-badge score">Score: ${Number(c.score).toFixed(4)}</span>`;
+      html += `<div class="debug-chunk rejected"><span class="debug-chunk-meta">${escHtml(c.article||'?')} [${c.chunk_idx}] ${score}<span class="debug-badge reason">${escHtml(reasons[c.reason]||c.reason)}</span></span></div>`;
+    });
+    html += '</div></div>';
+    body.innerHTML += html;
+  }
+
   panel.appendChild(body);
 
   // Toggle collapse
@@ -543,24 +693,99 @@ function renderDebugPanel(data){
   return panel;
 }
 
-function msgElement(role, content, timeIso){
+// confidenceBadge renders the answer confidence shown next to the time.
+function confidenceBadge(conf){
+  const span = document.createElement('span');
+  span.className = 'confidence ' + conf.level;
+  span.textContent = ' · Konfidenz: ' + ({high:'hoch', medium:'mittel', low:'niedrig'}[conf.level] || conf.level);
+  span.title = (conf.reasons||[]).join('\n');
+  return span;
+}
+
+// errorNote renders a failure reported by /api/ask.
+function errorNote(err){
+  const div = document.createElement('div');
+  div.className = 'msg-error';
+  div.textContent = '⚠️ ' + (err.message || err.code);
+  div.title = [err.phase, err.request_id].filter(Boolean).join(' · ');
+  return div;
+}
+
+function similarNote(sim){
+  const div = document.createElement('div');
+  div.className = 'msg-similar';
+  const head = document.createElement('div');
+  head.textContent = '💡 ' + t('similar_asked', sim.title) + ' ' + sim.question;
+  div.appendChild(head);
+  if(sim.answer){
+    const ans = document.createElement('div');
+    ans.className = 'msg-similar-answer';
+    ans.textContent = sim.answer;
+    div.appendChild(ans);
+  }
+  const btn = document.createElement('button');
+  btn.className = 'tool-btn';
+  btn.textContent = t('similar_open');
+  btn.onclick = () => loadChat(sim.chat_id);
+  div.appendChild(btn);
+  return div;
+}
+
+// tagFilterPill shows the tag filter of an answer.
+function tagFilterPill(tags, n){
+  const span = document.createElement('span');
+  span.className = 'filter-pill';
+  span.textContent = '🏷️ ' + t('tag_filter', tags.join(', '), n);
+  return span;
+}
+
+// refusedNote explains a strict-mode refusal for `reason`.
+function refusedNote(reason){
+  const div = emptyKBNote();
+  div.firstChild.textContent = '🛑 ' + t('refused_'+reason);
+  return div;
+}
+
+// emptyKBNote explains an answer without documents: `key` is the
+// message, empty_kb_note by default.
+function emptyKBNote(key){
+  const div = document.createElement('div');
+  div.className = 'msg-similar';
+  const head = document.createElement('div');
+  head.textContent = '📭 ' + t(key || 'empty_kb_note');
+  div.appendChild(head);
+  const btn = document.createElement('button');
+  btn.className = 'tool-btn';
+  btn.textContent = t('empty_kb_add');
+  btn.onclick = () => showTab('main', 'ingest');
+  div.appendChild(btn);
+  return div;
+}
+
+function msgElement(role, content, timeIso, citations, conf, err){
   const msg = document.createElement('div');
   msg.className = `msg ${role}`;
   const bubble = document.createElement('div');
   bubble.className = 'bubble';
+  bubble._citations = citations || null;
   renderBubbleContent(bubble, content);
   const meta = document.createElement('div');
   meta.className = 'meta';
   meta.textContent = `${role === 'user' ? 'Du' : 'Assistant'} · ${timeShort(timeIso)}`;
+  if(conf) meta.appendChild(confidenceBadge(conf));
   msg.appendChild(bubble);
+  if(err){
+    bubble.hidden = !content;
+    msg.appendChild(errorNote(err));
+  }
   msg.appendChild(meta);
   return msg;
 }
 
-function addMessage(role, content, timeIso){
+function addMessage(role, content, timeIso, citations, conf, err){
   const wrap = $('#chatMessages');
   $('#chatEmpty').style.display = 'none';
-  wrap.appendChild(msgElement(role, content, timeIso || new Date().toISOString()));
+  wrap.appendChild(msgElement(role, content, timeIso || new Date().toISOString(), citations, conf, err));
   wrap.scrollTop = wrap.scrollHeight;
 }
 
@@ -576,7 +801,7 @@ function replaceAssistantLast(text){
 
 async function refreshStats(){
   try{
-    const stats = await apiGet('/api/stats');
+    const stats = await apiGet('/api/stats?collection='+encodeURIComponent(currentCollection));
     $('#chunkCount').textContent = stats.chunks ?? '-';
     // Also refresh sources list when open
     await refreshSources(stats.sources || []);
@@ -628,11 +853,16 @@ async function loadChat(id){
     currentPersonaId = c.persona_id;
     const sel = $('#personaSelect'); if(sel) sel.value = currentPersonaId;
   }
+  if((c.collection || '') !== currentCollection){
+    currentCollection = c.collection || '';
+    const sel = $('#collectionSelect'); if(sel) sel.value = currentCollection || 'default';
+    await refreshStats();
+  }
   $('#chatMessages').innerHTML = `<div class="empty-state" id="chatEmpty" style="display:none"></div>`;
   if(!c.messages || !c.messages.length){
     $('#chatEmpty').style.display = '';
   }else{
-    c.messages.forEach(m => addMessage(m.role, m.content, m.time));
+    c.messages.forEach(m => addMessage(m.role, m.content, m.time, m.citations, m.confidence, m.error));
   }
   await refreshChats();
   showTab('sidebar','chats');
@@ -640,7 +870,7 @@ async function loadChat(id){
 }
 
 async function newChat(){
-  const c = await apiPost('/api/chats/new', {persona_id: currentPersonaId});
+  const c = await apiPost('/api/chats/new', {persona_id: currentPersonaId, collection: currentCollection});
   currentChatId = c.id;
   $('#chatMessages').innerHTML = `<div class="empty-state" id="chatEmpty"><div class="icon">💬</div><p>Stelle eine Frage an deine Wissensbasis.<br>Die Antwort basiert auf den gespeicherten Dokumenten.</p></div>`;
   await refreshChats();
@@ -654,13 +884,25 @@ async function refreshSources(src){
     return;
   }
   box.innerHTML = '';
+  const ephemeral = src.filter(s => /^(ddg|web|calc):/.test(s.article));
+  if(ephemeral.length){
+    const btn = document.createElement('button');
+    btn.className = 'tool-btn danger';
+    btn.textContent = `🧹 ${ephemeral.length} Einmal-Suchergebnisse entfernen`;
+    btn.addEventListener('click', async () => {
+      if(!confirm('Alle Quellen mit ddg:, web: und calc: löschen?')) return;
+      await apiPost('/api/sources/cleanup-ephemeral?collection='+encodeURIComponent(currentCollection), {});
+      await refreshStats();
+    });
+    box.appendChild(btn);
+  }
   src.forEach(s => {
     const div = document.createElement('div');
     div.className = 'item';
     div.innerHTML = `
       <div>
         <div class="title">${escHtml(s.article)}</div>
-        <div class="meta">${s.chunks} Chunks</div>
+        <div class="meta" title="${escHtml(s.provenance ? t('preview_provenance', s.provenance) : s.origin_ref||'')}">${s.chunks} Chunks${s.origin_type ? ' · '+escHtml(s.origin_type) : ''}${s.updated_at ? ' · '+timeShort(s.updated_at) : ''}</div>
       </div>
       <div class="right">
         <button class="icon-btn danger" title="Quelle löschen">🗑</button>
@@ -669,19 +911,51 @@ async function refreshSources(src){
       if(ev.target && ev.target.classList.contains('danger')){
         ev.stopPropagation();
         if(!confirm('Diese Quelle komplett löschen?\n\n'+s.article)) return;
-        await apiPost('/api/sources/delete', {article: s.article});
+        await apiPost('/api/sources/delete', {article: s.article, collection: currentCollection});
         await refreshStats();
+        return;
       }
+      await openPreview(s.article);
     });
     box.appendChild(div);
   });
 }
 
+// Shows the beginning of a source's text in the preview dialog.
+async function openPreview(article){
+  let p;
+  try{
+    p = await apiGet('/api/sources/preview?article='+encodeURIComponent(article)+'&collection='+encodeURIComponent(currentCollection));
+  }catch(e){
+    alert(t('error_prefix') + e.message);
+    return;
+  }
+  $('#preview-title').textContent = p.article;
+  const origin = p.origin_type ? p.origin_type + (p.origin_ref ? ': ' + p.origin_ref : '') + ' · ' : '';
+  $('#previewMeta').textContent = origin + t('preview_meta', p.chunks, p.chars, timeShort(p.created_at), timeShort(p.updated_at));
+  $('#previewProvenance').textContent = p.provenance ? t('preview_provenance', p.provenance) : '';
+  $('#previewText').textContent = p.text;
+  $('#previewMore').textContent = p.truncated ? t('preview_more', p.chunks_shown, p.chunks) : '';
+  const modal = $('#previewModal');
+  modal.classList.add('open');
+  modal.setAttribute('aria-hidden','false');
+  $('#previewClose').focus();
+}
+
+function closePreview(){
+  const modal = $('#previewModal');
+  modal.classList.remove('open');
+  modal.setAttribute('aria-hidden','true');
+}
+
 async function initSettingsUI(){
   // Load persisted settings
   const s = await apiGet('/api/settings');
   $('#wikiLang').value = s.lang || 'de';
   $('#setBaseUrl').value = s.base_url || 'http://localhost:1234';
+  // The key itself is never sent back; show the masked value instead
+  $('#setApiKey').value = '';
+  $('#setApiKey').placeholder = s.api_key || 'nicht gesetzt';
   // nanoGo toggle
   const nanoChk = $('#allowNanoGo');
   if(nanoChk) nanoChk.checked = !!s.allow_nanogo;
@@ -697,6 +971,14 @@ async function initSettingsUI(){
   $('#chatHint').textContent = '';
   $('#embedHint').textContent = '';
   $('#endpointStatus').textContent = '';
+  // Fields pinned by environment variables cannot be edited here
+  const pinned = s.pinned || {};
+  [['base_url', '#setBaseUrl'], ['chat_model', '#setChatModel'], ['embed_model', '#setEmbedModel'], ['api_key', '#setApiKey']].forEach(([key, sel])=>{
+    const el = $(sel);
+    if(!el) return;
+    el.disabled = !!pinned[key];
+    el.title = pinned[key] ? `Festgelegt über ${pinned[key]}` : '';
+  });
 
   await loadCustomApis();
   await loadPersonas();
@@ -781,7 +1063,7 @@ async function discoverEndpoints(){
       div.innerHTML = `
         <div class="left">
           <div class="title">${escHtml(c.provider_hint)} · ${escHtml(c.base_url)}</div>
-          <div class="models">${c.ok ? escHtml('Modelle: '+(c.models?.length||0)+' · Vorschlag: '+rec) : escHtml(c.error||'')}</div>
+          <div class="models">${c.ok ? escHtml('Modelle: '+(c.models?.length||0)+' · '+c.latency_ms+' ms · Vorschlag: '+rec) : escHtml(c.error||'')}</div>
         </div>
         <div class="right">
           ${badge}
@@ -827,7 +1109,8 @@ async function testEndpointAndLoadModels(){
       chatSel.appendChild(opt1);
 
       const opt2 = document.createElement('option');
-      opt2.value = m; opt2.textContent = m;
+      const dim = r.model_info?.[m]?.embedding_dim;
+      opt2.value = m; opt2.textContent = dim ? `${m} (${dim}d)` : m;
       embSel.appendChild(opt2);
     });
 
@@ -845,27 +1128,51 @@ async function testEndpointAndLoadModels(){
     pick(embSel, curEmb, r.recommend_embed);
 
     $('#chatHint').textContent = r.recommend_chat?.length ? ('Vorschläge: '+r.recommend_chat.join(', ')) : '';
-    $('#embedHint').textContent = r.recommend_embed?.length ? ('Vorschläge: '+r.recommend_embed.join(', ')) : 'Tipp: wähle ein Embedding-Modell (oft mit „embed“ im Namen).';
+    const withDim = m => r.model_info?.[m]?.embedding_dim ? `${m} (${r.model_info[m].embedding_dim}d)` : m;
+    $('#embedHint').textContent = r.recommend_embed?.length ? ('Vorschläge: '+r.recommend_embed.map(withDim).join(', ')) : 'Tipp: wähle ein Embedding-Modell (oft mit „embed“ im Namen).';
 
   }catch(e){
     setStatus($('#endpointStatus'), 'Fehler: '+(e.message||String(e)), 'err');
   }
 }
 
+// checkHealth shows the banner while the server runs without a reachable
+// LLM endpoint and re-checks until it is back.
+let healthTimer = null;
+async function checkHealth(){
+  clearTimeout(healthTimer);
+  const h = await apiGet('/api/health').catch(()=>null);
+  const down = !!(h && h.degraded);
+  $('#llmBanner').hidden = !down;
+  if(down){
+    $('#llmBannerText').textContent = t('llm_unreachable', h.base_url, h.llm);
+    healthTimer = setTimeout(checkHealth, 15000);
+  }
+}
+
 async function saveSettings(force=false){
   const base = $('#setBaseUrl').value.trim();
   const chat = $('#setChatModel').value;
   const emb = $('#setEmbedModel').value;
   const allowNano = $('#allowNanoGo') ? !!$('#allowNanoGo').checked : false;
+  const apiKey = $('#setApiKey').value.trim();
   if(!base || !chat || !emb){
     setStatus($('#saveStatus'), 'Bitte Endpoint und Modelle wählen.', 'err');
     return;
   }
   setStatus($('#saveStatus'), 'Speichere…', '');
   try{
-    await apiPost('/api/settings', {base_url: base, chat_model: chat, embed_model: emb, force, allow_nanogo: allowNano});
+    const body = {base_url: base, chat_model: chat, embed_model: emb, force, allow_nanogo: allowNano};
+    if(apiKey) body.api_key = apiKey;
+    const res = await apiPost('/api/settings', body);
+    if(res && res.warning){
+      setStatus($('#saveStatus'), 'Gespeichert. '+res.warning, 'warn');
+      checkHealth();
+      return;
+    }
     setStatus($('#saveStatus'), 'Gespeichert. Einstellungen aktiv.', 'ok');
     closeModal();
+    checkHealth();
   }catch(e){
     if(e.status === 409 && e.payload && e.payload.requires_force){
       setStatus($('#saveStatus'), e.payload.message + ' (Nochmal klicken zum Bestätigen)', 'warn');
@@ -896,7 +1203,9 @@ async function loadCustomApis(){
       <div>
         <div class="name">${escHtml(a.name)}</div>
         <div class="desc">${escHtml(a.desc||'')}</div>
-        <div class="tmpl">${escHtml(a.template)}</div>
+        <div class="tmpl">${escHtml((a.method && a.method !== 'GET' ? a.method+' ' : '') + a.template)}</div>
+        ${a.headers ? `<div class="tmpl">${escHtml(Object.entries(a.headers).map(([k,v])=>k+': '+v).join(' · '))}</div>` : ''}
+        ${a.extract ? `<div class="tmpl">→ ${escHtml(a.extract)}</div>` : ''}
       </div>
       <div class="actions">
         <button class="tool-btn danger">Löschen</button>
@@ -911,9 +1220,54 @@ async function loadCustomApis(){
   });
 }
 
+async function loadCollections(){
+  const list = await apiGet('/api/collections');
+  const sel = $('#collectionSelect');
+  if(!sel) return;
+  sel.innerHTML = '';
+  (list || []).forEach(c=>{
+    const opt = document.createElement('option');
+    opt.value = c.name;
+    opt.textContent = `${c.name} (${c.chunks})`;
+    sel.appendChild(opt);
+  });
+  const opt = document.createElement('option');
+  opt.value = '+';
+  opt.textContent = '＋ Neue Sammlung…';
+  sel.appendChild(opt);
+  sel.value = currentCollection || 'default';
+}
+
+async function switchCollection(name){
+  if(name === '+'){
+    name = (prompt('Name der neuen Sammlung (a-z, 0-9, - und _):') || '').trim().toLowerCase();
+    if(name){
+      const r = await fetch('/api/collections', {method:'POST', headers:{'Content-Type':'application/json'}, body: JSON.stringify({name})});
+      if(!r.ok && r.status !== 409){
+        alert(await r.text());
+        name = '';
+      }
+    }
+    if(!name){
+      $('#collectionSelect').value = currentCollection || 'default';
+      return;
+    }
+  }
+  currentCollection = name === 'default' ? '' : name;
+  currentChatId = '';
+  $('#chatMessages').innerHTML = `<div class="empty-state" id="chatEmpty"><div class="icon">💬</div><p>Stelle eine Frage an deine Wissensbasis.<br>Die Antwort basiert auf den gespeicherten Dokumenten.</p></div>`;
+  await loadCollections();
+  await refreshStats();
+  await refreshChats();
+}
+
+let editingPersonaId = '';
+
 async function loadPersonas(){
   const list = await apiGet('/api/personas');
   cachedPersonas = list || [];
+  const st = await apiGet('/api/settings').catch(()=>({}));
+  const defaultPersonaId = st.default_persona_id || '';
 
   // Update selector
   const sel = $('#personaSelect');
@@ -926,7 +1280,7 @@ async function loadPersonas(){
       sel.appendChild(opt);
     });
     if(!currentPersonaId && cachedPersonas.length){
-      currentPersonaId = cachedPersonas[0].id;
+      currentPersonaId = defaultPersonaId || cachedPersonas[0].id;
     }
     const has = cachedPersonas.some(p=>p.id === currentPersonaId);
     if(!has && cachedPersonas.length){
@@ -945,17 +1299,32 @@ async function loadPersonas(){
       cachedPersonas.forEach(p=>{
         const div = document.createElement('div');
         div.className = 'api-item';
-        const snippet = (p.prompt||'').split('\n').slice(0,2).join(' ');
+        let snippet = (p.prompt||'').split('\n').slice(0,2).join(' ');
+        if(p.allowed_tools && p.allowed_tools.length) snippet += ' 🔧 ' + p.allowed_tools.join(', ');
         div.innerHTML = `
           <div>
-            <div class="name">${escHtml(p.name)}</div>
+            <div class="name">${escHtml(p.name)}${p.id === defaultPersonaId ? ' ★' : ''}</div>
             <div class="desc">${escHtml(snippet)}</div>
           </div>
           <div class="actions">
-            <button class="tool-btn danger">Löschen</button>
+            <button class="tool-btn" data-act="default" title="Als Standard für neue Chats">★</button>
+            <button class="tool-btn" data-act="edit">Bearbeiten</button>
+            <button class="tool-btn danger" data-act="delete">Löschen</button>
           </div>
         `;
-        div.querySelector('button').addEventListener('click', async ()=>{
+        div.querySelector('[data-act="default"]').addEventListener('click', async ()=>{
+          await apiPost('/api/settings', {default_persona_id: p.id});
+          await loadPersonas();
+        });
+        div.querySelector('[data-act="edit"]').addEventListener('click', ()=>{
+          editingPersonaId = p.id;
+          $('#newPersonaName').value = p.name;
+          $('#newPersonaPrompt').value = p.prompt || '';
+          $('#newPersonaTools').value = (p.allowed_tools || []).join(', ');
+          $('#btnAddPersona span').textContent = t('save');
+          $('#newPersonaName').focus();
+        });
+        div.querySelector('[data-act="delete"]').addEventListener('click', async ()=>{
           if(!confirm('Persona löschen?\n\n'+p.name)) return;
           await apiPost('/api/personas/delete', {id: p.id});
           if(currentPersonaId === p.id) currentPersonaId = '';
@@ -970,19 +1339,54 @@ async function loadPersonas(){
 async function addPersona(){
   const name = $('#newPersonaName').value.trim();
   const prompt = $('#newPersonaPrompt').value.trim();
+  const allowed_tools = $('#newPersonaTools').value.split(',').map(s=>s.trim()).filter(Boolean);
   if(!name){
     alert('Bitte Namen angeben');
     return;
   }
-  await apiPost('/api/personas', {name, prompt});
+  try{
+    if(editingPersonaId){
+      // Keep fields the form does not edit (model, sampling parameters).
+      const cur = cachedPersonas.find(p=>p.id === editingPersonaId) || {};
+      await apiPost('/api/personas/update', {...cur, id: editingPersonaId, name, prompt, allowed_tools});
+      editingPersonaId = '';
+      $('#btnAddPersona span').textContent = t('add');
+    }else{
+      await apiPost('/api/personas', {name, prompt, allowed_tools});
+    }
+  }catch(e){
+    alert('Fehler: '+(e.message||String(e)));
+    return;
+  }
   $('#newPersonaName').value = '';
   $('#newPersonaPrompt').value = '';
+  $('#newPersonaTools').value = '';
+  await loadPersonas();
+}
+
+async function installDefaultPersonas(){
+  const res = await apiPost('/api/personas/install-defaults', {});
+  alert(`${res.created} Persona(s) hinzugefügt, ${res.skipped} übersprungen`);
+  await loadPersonas();
+}
+
+function exportPersonas(){
+  window.location.href = '/api/personas/export';
+}
+
+async function importPersonas(file){
+  try{
+    const res = await apiPost('/api/personas/import', JSON.parse(await file.text()));
+    alert(`${res.created} Persona(s) importiert, ${res.skipped} übersprungen`);
+  }catch(e){
+    alert('Import fehlgeschlagen: '+(e.message||String(e)));
+  }
   await loadPersonas();
 }
 
 // Tool suggestion UI (adapted from original tinyRAG)
-var toolIcons={wikipedia:'\u{1F4D6}',duckduckgo:'\u{1F50E}',wiktionary:'\u{1F4DD}',stackoverflow:'\u{1F4BB}',websearch:'\u{1F50D}'};
-var toolLabels={wikipedia:'Wikipedia-Suche',duckduckgo:'DuckDuckGo Websuche',wiktionary:'Wiktionary (Wörterbuch)',stackoverflow:'StackOverflow-Suche',websearch:'Websuche'};
+var toolIcons={wikipedia:'\u{1F4D6}',duckduckgo:'\u{1F50E}',wiktionary:'\u{1F4DD}',stackoverflow:'\u{1F4BB}',websearch:'\u{1F50D}',rag_search:'\u{1F4DA}',weather:'\u{1F326}',sql:'\u{1F5C3}',convert:'\u{1F4CF}',python:'\u{1F40D}'};
+var toolLabels={wikipedia:'Wikipedia-Suche',duckduckgo:'DuckDuckGo Websuche',wiktionary:'Wiktionary (Wörterbuch)',stackoverflow:'StackOverflow-Suche',websearch:'Websuche',rag_search:'Wissensbasis-Suche',weather:'Wetter',sql:'SQL-Abfrage',convert:'Umrechnung',python:'Python'};
 var cachedCustomAPIs=[];
 var cachedPersonas=[];
 
@@ -1049,7 +1453,7 @@ function executeToolAndReask(btn, tool, query, originalQuestion){
   const input = card.querySelector('.tool-query-edit'); if(input) input.disabled = true;
   status.innerHTML = '<span class="spinner"></span>' + (toolIcons[tool]||'') + ' ' + escHtml(toolLabels[tool]||tool) + ': Suche läuft…';
 
-  fetch('/api/tool/execute',{method:'POST',headers:{'Content-Type':'application/json'},body:JSON.stringify({tool:tool,query:query})}).then(async function(resp){
+  fetch('/api/tool/execute',{method:'POST',headers:{'Content-Type':'application/json'},body:JSON.stringify({tool:tool,query:query,chat_id:currentChatId,collection:currentCollection})}).then(async function(resp){
     if(!resp.ok){
       const t = await resp.text();
       status.innerHTML = '<span style="color:var(--red)">Fehler: '+escHtml(t)+'</span>';
@@ -1058,7 +1462,8 @@ function executeToolAndReask(btn, tool, query, originalQuestion){
       return;
     }
     const d = await resp.json();
-    status.innerHTML = '<span style="color:#22c55e">✓ '+escHtml(d.source)+': '+d.chars+' Zeichen, '+d.chunks+' Chunks geladen</span>';
+    const where = d.persisted ? d.chunks+' Chunks geladen' : 'nur für diesen Chat';
+    status.innerHTML = '<span style="color:#22c55e">✓ '+escHtml(d.source)+': '+d.chars+' Zeichen, '+where+'</span>';
     const actions = card.querySelector('.tool-actions'); if(actions) actions.style.display = 'none';
     refreshStats();
     // auto re-ask after short delay
@@ -1073,19 +1478,59 @@ function executeToolAndReask(btn, tool, query, originalQuestion){
   });
 }
 
+function customApiForm(){
+  const headers = {};
+  $('#newApiHeaders').value.split('\n').forEach(line=>{
+    const i = line.indexOf(':');
+    if(i > 0) headers[line.slice(0, i).trim()] = line.slice(i+1).trim();
+  });
+  return {
+    name: $('#newApiName').value.trim(),
+    template: $('#newApiTemplate').value.trim(),
+    desc: $('#newApiDesc').value.trim(),
+    method: $('#newApiMethod').value,
+    headers,
+    body_template: $('#newApiBody').value.trim(),
+    response_type: $('#newApiResponseType').value,
+    extract: $('#newApiExtract').value.trim(),
+  };
+}
+
+async function testCustomApi(){
+  const api = customApiForm();
+  const out = $('#apiTestResult');
+  if(!api.template){
+    alert('Bitte ein URL-Template ausfüllen.');
+    return;
+  }
+  out.hidden = false;
+  out.textContent = '…';
+  try{
+    const r = await apiPost('/api/settings/apis/test', {...api, name: api.name || 'test', query: $('#newApiTestQuery').value.trim()});
+    let txt = `HTTP ${r.status} · ${r.extracted ? 'Pfad getroffen' : 'kein Treffer (Fallback)'}\n\n`;
+    if(r.error) txt += `Fehler: ${r.error}\n\n`;
+    txt += `── Text ──\n${r.text||''}\n\n── Roh${r.raw_truncated ? ' (gekürzt)' : ''} ──\n${r.raw||''}`;
+    out.textContent = txt;
+  }catch(e){
+    out.textContent = 'Fehler: '+(e.message||String(e));
+  }
+}
+
 async function addCustomApi(){
-  const name = $('#newApiName').value.trim();
-  const template = $('#newApiTemplate').value.trim();
-  const desc = $('#newApiDesc').value.trim();
-  if(!name || !template){
+  const api = customApiForm();
+  if(!api.name || !api.template){
     alert('Bitte Name und URL-Template ausfüllen.');
     return;
   }
   try{
-    await apiPost('/api/settings/apis', {name, template, desc});
+    await apiPost('/api/settings/apis', api);
     $('#newApiName').value = '';
     $('#newApiTemplate').value = '';
     $('#newApiDesc').value = '';
+    $('#newApiHeaders').value = '';
+    $('#newApiBody').value = '';
+    $('#newApiExtract').value = '';
+    $('#apiTestResult').hidden = true;
     await loadCustomApis();
   }catch(e){
     alert('Fehler: '+(e.message||String(e)));
@@ -1097,8 +1542,9 @@ async function executeTool(tool, query){
   // show in chat that tool is being executed
   addMessage('assistant', `🔎 Tool wird ausgeführt: ${tool}("${query}")`, new Date().toISOString());
   try{
-    const r = await apiPost('/api/tool/execute', {tool, query});
-    addMessage('assistant', `✅ Tool fertig. Quelle: ${r.source} · ${r.chunks} Chunks hinzugefügt.`, new Date().toISOString());
+    const r = await apiPost('/api/tool/execute', {tool, query, chat_id: currentChatId, collection: currentCollection});
+    const where = r.persisted ? `${r.chunks} Chunks hinzugefügt` : 'nur für diesen Chat gespeichert';
+    addMessage('assistant', `✅ Tool fertig. Quelle: ${r.source} · ${where}.`, new Date().toISOString());
     await refreshStats();
   }catch(e){
     addMessage('assistant', `❌ Tool-Fehler: ${e.message||String(e)}`, new Date().toISOString());
@@ -1127,12 +1573,25 @@ async function askChat(){
   }catch(e){}
   let acc = '';
   let hasError = false;
+  // Planner tokens ("planning" events) shown below the stage until the
+  // answer starts; never part of the answer.
+  let typingLabel = t('assistant_typing'), planSource = '', planTrace = '';
+  const showTyping = () => {
+    if(acc || !typingBubble) return;
+    typingBubble.textContent = typingLabel;
+    if(planTrace){
+      const tr = document.createElement('div');
+      tr.className = 'planning-trace';
+      tr.textContent = t('planning_thinking') + ' ' + planTrace.slice(-300);
+      typingBubble.appendChild(tr);
+    }
+  };
 
   try{
     const resp = await fetch('/api/ask', {
       method:'POST',
       headers:{'Content-Type':'application/json'},
-      body: JSON.stringify({question:q, chat_id: currentChatId, debug: debugMode, persona_id: currentPersonaId})
+      body: JSON.stringify({question:q, chat_id: currentChatId, debug: debugMode, persona_id: currentPersonaId, collection: currentCollection})
     });
 
     if(!resp.ok){
@@ -1176,6 +1635,21 @@ async function askChat(){
               const sel = $('#personaSelect');
               if(sel) sel.value = currentPersonaId;
             }
+            if(meta.tags?.length){
+              const msgs = $$('#chatMessages .msg.assistant');
+              if(msgs.length){
+                const last = msgs[msgs.length-1];
+                last.insertBefore(tagFilterPill(meta.tags, meta.tag_sources||0), last.querySelector('.bubble'));
+              }
+            }
+            if(meta.empty_kb || meta.refused){
+              const msgs = $$('#chatMessages .msg.assistant');
+              if(msgs.length){
+                const last = msgs[msgs.length-1];
+                const note = meta.refused ? refusedNote(meta.refused) : emptyKBNote(meta.tags?.length && !meta.tag_sources ? 'empty_tags_note' : '');
+                last.insertBefore(note, last.querySelector('.bubble'));
+              }
+            }
             // refresh chats sidebar
             refreshChats();
           }catch(e){}
@@ -1199,6 +1673,94 @@ async function askChat(){
           }catch(e){ console.error('debug parse error', e); }
           continue;
         }
+        if(event === 'debug_note'){
+          try{
+            const note = JSON.parse(dataStr);
+            console.warn('RAG debug note:', note);
+            const panels = document.querySelectorAll('#chatMessages .msg.assistant .debug-panel .debug-body');
+            if(panels.length){
+              const div = document.createElement('div');
+              div.className = 'debug-note';
+              div.textContent = '⚠️ ' + (note.note||'');
+              panels[panels.length-1].appendChild(div);
+            }
+          }catch(e){}
+          continue;
+        }
+        if(event === 'timings'){
+          // LLM phase timings, shown in the debug panel if there is one.
+          try{
+            const tm = JSON.parse(dataStr);
+            console.debug('LLM timings:', tm);
+            const panels = document.querySelectorAll('#chatMessages .msg.assistant .debug-panel .debug-body');
+            if(panels.length){
+              const sec = document.createElement('div');
+              sec.className = 'debug-section';
+              sec.innerHTML = `<div class="debug-section-title">⏱️ Generierung</div>
+                <div class="debug-grid">
+                  <div class="debug-kv"><span class="debug-k">Erstes Token</span><span class="debug-v">${tm.ttfb_ms} ms</span></div>
+                  <div class="debug-kv"><span class="debug-k">Gesamt</span><span class="debug-v">${tm.total_ms} ms (${(tm.calls||[]).length} LLM-Aufrufe)</span></div>
+                  <div class="debug-kv"><span class="debug-k">Tokens</span><span class="debug-v">${tm.tokens} (${tm.tokens_per_s} Tokens/s)</span></div>
+                </div>`;
+              panels[panels.length-1].appendChild(sec);
+            }
+          }catch(e){}
+          continue;
+        }
+        if(event === 'citations'){
+          try{
+            const bubbles = $$('#chatMessages .msg.assistant .bubble');
+            if(bubbles.length) bubbles[bubbles.length-1]._citations = JSON.parse(dataStr);
+          }catch(e){}
+          continue;
+        }
+        if(event === 'confidence'){
+          try{
+            const msgs = $$('#chatMessages .msg.assistant .meta');
+            if(msgs.length) msgs[msgs.length-1].appendChild(confidenceBadge(JSON.parse(dataStr)));
+          }catch(e){}
+          continue;
+        }
+        if(event === 'status'){
+          // Progress until the first token arrives.
+          try{
+            const st = JSON.parse(dataStr);
+            const [stage, arg] = st.stage.split(/:(.*)/);
+            typingLabel = t('stage_'+stage, arg, st);
+            showTyping();
+          }catch(e){}
+          continue;
+        }
+        if(event === 'planning'){
+          try{
+            const p = JSON.parse(dataStr);
+            if(p.source !== planSource){ planSource = p.source; planTrace = ''; }
+            planTrace += p.text;
+            showTyping();
+          }catch(e){}
+          continue;
+        }
+        if(event === 'similar'){
+          try{
+            const msgs = $$('#chatMessages .msg.assistant');
+            if(msgs.length){
+              const last = msgs[msgs.length-1];
+              last.insertBefore(similarNote(JSON.parse(dataStr)), last.querySelector('.bubble'));
+            }
+          }catch(e){}
+          continue;
+        }
+        if(event === 'error'){
+          try{
+            const msgs = $$('#chatMessages .msg.assistant');
+            if(msgs.length){
+              const last = msgs[msgs.length-1];
+              last.insertBefore(errorNote(JSON.parse(dataStr)), last.querySelector('.meta'));
+            }
+            hasError = true;
+          }catch(e){}
+          continue;
+        }
         if(event === 'tool_request'){
           try{
             const tr = JSON.parse(dataStr);
@@ -1219,12 +1781,15 @@ async function askChat(){
             if(msgs && msgs.length){
               const bubble = msgs[msgs.length-1];
               const raw = acc || bubble.dataset.raw || '';
-              if(!raw.trim()){
+              if(!raw.trim() && hasError){
+                bubble.classList.remove('typing');
+                bubble.hidden = true;
+              }else if(!raw.trim()){
                 bubble.textContent = '❌ Keine Antwort vom LLM erhalten';
                 hasError = true;
               }else{
                 // Strip [TOOL_REQUEST] markers, then render final markdown
-                const cleaned = raw.replace(/\[TOOL_REQUEST\]\s*\{[^}]*\}\s*\[\/TOOL_REQUEST\]/g,'').trim();
+                const cleaned = raw.replace(/\[TOOL_REQUEST\][\s\S]*?(\[\/TOOL_REQUEST\]|$)/g,'').trim();
                 renderBubbleContent(bubble, cleaned);
               }
             }
@@ -1237,14 +1802,7 @@ async function askChat(){
             acc += tok;
             replaceAssistantLast(acc);
           }
-        }catch(e){
-          // Check if it's an error message (starts with ⚠️ or doesn't parse as JSON)
-          if(dataStr.startsWith('⚠️') || dataStr.startsWith('Fehler')){
-            acc += dataStr;
-            replaceAssistantLast(acc);
-            hasError = true;
-          }
-        }
+        }catch(e){}
       }
     }
   }catch(e){
@@ -1257,7 +1815,7 @@ async function runSearch(){
   if(!q) return;
   $('#searchResults').innerHTML = `<p class="muted">Suche…</p>`;
   try{
-    const res = await apiPost('/api/search', {query:q, k: 8});
+    const res = await apiPost('/api/search', {query:q, k: 8, collection: currentCollection});
     if(!res.length){
       $('#searchResults').innerHTML = `<p class="muted">Keine Treffer.</p>`;
       return;
@@ -1288,7 +1846,7 @@ async function addWiki(opts={}){
   setLoading('#wikiBtn', true);
   setStatus($('#wikiStatus'), t('loading'), '');
   try{
-    const r = await apiPost('/api/add-wiki', {article, lang});
+    const r = await apiPost('/api/add-wiki', {article, lang, collection: currentCollection});
     if(r.not_found){
       const box = $('#wikiStatus');
       box.className = 'tool-status warn';
@@ -1323,7 +1881,7 @@ async function addWiki(opts={}){
       }
       return;
     }
-    setStatus($('#wikiStatus'), t('ok_chunks', r.chunks, r.total), 'ok');
+    okStatus($('#wikiStatus'), r, t('ok_chunks', r.chunks, r.total));
     if(!preserveSuggestions) $('#wikiArticle').value = '';
     await refreshStats();
   }catch(e){
@@ -1333,14 +1891,36 @@ async function addWiki(opts={}){
   }
 }
 
+// Wikipedia typeahead: fill the datalist of #wikiArticle while typing.
+let wikiTypeaheadTimer = null;
+function wikiTypeahead(){
+  clearTimeout(wikiTypeaheadTimer);
+  const q = $('#wikiArticle').value.trim();
+  if(q.length < 3) return;
+  wikiTypeaheadTimer = setTimeout(async () => {
+    const lang = $('#wikiLang').value.trim();
+    try{
+      const res = await apiGet('/api/wiki/search?limit=8&q='+encodeURIComponent(q)+(lang ? '&lang='+encodeURIComponent(lang) : ''));
+      const list = $('#wikiTypeahead');
+      list.innerHTML = '';
+      (res||[]).forEach(item => {
+        const opt = document.createElement('option');
+        opt.value = item.title;
+        if(item.snippet) opt.label = item.snippet.slice(0, 80);
+        list.appendChild(opt);
+      });
+    }catch(e){ /* typeahead is best-effort */ }
+  }, 300);
+}
+
 async function addURL(){
   const url = $('#scrapeUrl').value.trim();
   if(!url) return;
   setLoading('#urlBtn', true);
   setStatus($('#urlStatus'), t('scrape'), '');
   try{
-    const r = await apiPost('/api/add-url', {url});
-    setStatus($('#urlStatus'), t('ok_chunks', r.chunks, r.total), 'ok');
+    const r = await apiPost('/api/add-url', {url, collection: currentCollection});
+    okStatus($('#urlStatus'), r, t('ok_chunks', r.chunks, r.total));
     $('#scrapeUrl').value = '';
     await refreshStats();
   }catch(e){
@@ -1357,8 +1937,8 @@ async function addText(){
   setLoading('#textBtn', true);
   setStatus($('#textStatus'), t('saving'), '');
   try{
-    const r = await apiPost('/api/add-text', {title, text});
-    setStatus($('#textStatus'), t('ok_chunks', r.chunks, r.total), 'ok');
+    const r = await apiPost('/api/add-text', {title, text, collection: currentCollection});
+    okStatus($('#textStatus'), r, t('ok_chunks', r.chunks, r.total));
     $('#textTitle').value = '';
     $('#textContent').value = '';
     await refreshStats();
@@ -1383,21 +1963,33 @@ function initUpload(){
     }
   });
 
-  function handleFile(file){
+  function handleFile(file, onConflict){
     if(!file) return;
     setStatus($('#uploadStatus'), t('uploading'), '');
     const form = new FormData();
     form.append('file', file);
+    form.append('collection', currentCollection);
+    if(onConflict) form.append('on_conflict', onConflict);
     inp.disabled = true;
-    fetch('/api/upload', {method:'POST', body: form})
+    return fetch('/api/upload', {method:'POST', body: form})
       .then(async r=>{
         const ct = r.headers.get('content-type')||'';
         const isJson = ct.includes('application/json');
         const payload = isJson ? await r.json().catch(()=>null) : await r.text();
+        if(r.status === 409 && payload && payload.conflict){
+          // Same name, different content: ask whether to replace or keep both.
+          const choice = confirm(t('upload_conflict', payload.existing_source)) ? 'replace'
+            : confirm(t('upload_keep_both')) ? 'keep_both' : '';
+          if(choice) return handleFile(file, choice);
+          setStatus($('#uploadStatus'), payload.message, 'warn');
+          return;
+        }
         if(!r.ok){
           throw new Error(typeof payload==='string' ? payload : JSON.stringify(payload));
         }
-        setStatus($('#uploadStatus'), t('ok_chunks', payload.chunks, payload.total), 'ok');
+        let msg = t('ok_chunks', payload.chunks, payload.total);
+        if(payload.skipped_binary?.length) msg += ' · ' + t('skipped_binary', payload.skipped_binary.length);
+        okStatus($('#uploadStatus'), payload, msg);
         refreshStats();
       })
         .catch(e=>setStatus($('#uploadStatus'), t('error_prefix') + (e.message||String(e)), 'err'))
@@ -1423,12 +2015,14 @@ async function addFolder(){
   setLoading('#folderBtn', true);
   setStatus($('#folderStatus'), t('importing'), '');
   try{
-    const r = await apiPost('/api/add-folder', {path, recursive});
+    const r = await apiPost('/api/add-folder', {path, recursive, collection: currentCollection});
     let msg = `OK: ${r.files} Dateien · ${r.total_chunks} Chunks · Total: ${r.total}`;
     if(r.errors && r.errors.length){
       msg += ` · Fehler: ${r.errors.length}`;
     }
-    setStatus($('#folderStatus'), msg, r.errors?.length ? 'warn' : 'ok');
+    if(r.skipped_binary?.length) msg += ' · ' + t('skipped_binary', r.skipped_binary.length);
+    if(r.warning) msg += ` · ${r.warning}`;
+    setStatus($('#folderStatus'), msg, (r.errors?.length || r.warning) ? 'warn' : 'ok');
     await refreshStats();
   }catch(e){
     setStatus($('#folderStatus'), t('error_prefix') + (e.message||String(e)), 'err');
@@ -1450,6 +2044,8 @@ window.addEventListener('DOMContentLoaded', async ()=>{
   }
 
   await loadPersonas();
+  await loadCollections().catch(()=>{});
+  checkHealth();
 
   if(window.mermaid){
     mermaid.initialize({startOnLoad:false, theme:'dark', securityLevel:'strict'});
@@ -1478,9 +2074,14 @@ window.addEventListener('DOMContentLoaded', async ()=>{
       currentPersonaId = e.target.value;
     });
   }
+  const collectionSelect = $('#collectionSelect');
+  if(collectionSelect){
+    collectionSelect.addEventListener('change', (e)=>switchCollection(e.target.value));
+  }
   const chatBox = $('#chatQ');
   if(chatBox){
     chatBox.addEventListener('input', ()=>autosize(chatBox));
+    chatBox.addEventListener('focus', warmUp);
     chatBox.addEventListener('keydown', (e)=>{
       if(e.key === 'Enter' && !e.shiftKey && !e.ctrlKey && !e.metaKey){
         e.preventDefault();
@@ -1502,6 +2103,7 @@ window.addEventListener('DOMContentLoaded', async ()=>{
   $('#textBtn').addEventListener('click', addText);
   $('#folderBtn').addEventListener('click', addFolder);
   onEnter($('#wikiArticle'), addWiki);
+  $('#wikiArticle').addEventListener('input', wikiTypeahead);
   onEnter($('#wikiLang'), addWiki);
   onEnter($('#scrapeUrl'), addURL);
   onEnter($('#textTitle'), addText);
@@ -1526,8 +2128,16 @@ window.addEventListener('DOMContentLoaded', async ()=>{
     openModal();
     await initSettingsUI();
   });
+  $('#llmBannerSettings').addEventListener('click', async ()=>{
+    openModal();
+    showSettingsTab('llm');
+    await initSettingsUI();
+  });
   $('#settingsClose').addEventListener('click', closeModal);
   $('#settingsModal').addEventListener('click', (e)=>{ if(e.target.id === 'settingsModal') closeModal(); });
+  $('#previewClose').addEventListener('click', closePreview);
+  $('#previewModal').addEventListener('click', (e)=>{ if(e.target.id === 'previewModal') closePreview(); });
+  $('#previewModal').addEventListener('keydown', (e)=>{ if(e.key === 'Escape') closePreview(); });
 
   // Settings tabs
   $$('.settings-tab').forEach(b => {
@@ -1586,7 +2196,16 @@ window.addEventListener('DOMContentLoaded', async ()=>{
   $('#btnTestEndpoint').addEventListener('click', testEndpointAndLoadModels);
   $('#btnSaveSettings').addEventListener('click', ()=>saveSettings(false));
   $('#btnAddCustomApi').addEventListener('click', addCustomApi);
+  $('#btnTestCustomApi').addEventListener('click', testCustomApi);
   $('#btnAddPersona').addEventListener('click', addPersona);
+  $('#btnInstallPersonas').addEventListener('click', installDefaultPersonas);
+  $('#btnExportPersonas').addEventListener('click', exportPersonas);
+  $('#btnImportPersonas').addEventListener('click', ()=>$('#personaImportFile').click());
+  $('#personaImportFile').addEventListener('change', (e)=>{
+    const f = e.target.files[0];
+    e.target.value = '';
+    if(f) importPersonas(f);
+  });
 
   await refreshStats();
   await refreshChats();
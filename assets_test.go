@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// getAsset requests `path` from the test server with an optional
+// If-None-Match header.
+func (e *testEnv) getAsset(t *testing.T, path, etag string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", e.srv.URL+path, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestStaticAssetsETag(t *testing.T) {
+	e := newTestEnv(t)
+	for path, body := range map[string]string{"/": indexHTML, "/style.css": styleCSS, "/app.js": appJS} {
+		resp := e.getAsset(t, path, "")
+		etag := resp.Header.Get("ETag")
+		if resp.StatusCode != 200 || etag != assetETag(body) || resp.Header.Get("Cache-Control") != "no-cache" || resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+			t.Fatalf("%s: %d %v", path, resp.StatusCode, resp.Header)
+		}
+		if resp := e.getAsset(t, path, etag); resp.StatusCode != http.StatusNotModified {
+			t.Fatalf("%s with its ETag: %d, want 304", path, resp.StatusCode)
+		}
+		if resp := e.getAsset(t, path, `"veraltet"`); resp.StatusCode != 200 {
+			t.Fatalf("%s with another ETag: %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestDevAssetsReload(t *testing.T) {
+	e := newTestEnv(t)
+	devAssetsDir = t.TempDir()
+	t.Cleanup(func() { devAssetsDir = "" })
+	css := filepath.Join(devAssetsDir, "style.css")
+	if err := os.WriteFile(css, []byte("a{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	first := e.getAsset(t, "/style.css", "").Header.Get("ETag")
+	if first != assetETag("a{}") {
+		t.Fatalf("ETag %q of the file on disk", first)
+	}
+	if err := os.WriteFile(css, []byte("a{color:red}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resp := e.getAsset(t, "/style.css", first)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "a{color:red}" {
+		t.Fatalf("changed file: %d %q", resp.StatusCode, body)
+	}
+	if resp := e.getAsset(t, "/app.js", ""); resp.StatusCode != 500 {
+		t.Fatalf("missing file in the dev directory: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls `cond` until it holds or a few seconds have passed.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// startAsk posts `body` to /api/ask with a cancellable context.
+func (e *testEnv) startAsk(t testing.TB, ctx context.Context, body map[string]any) *http.Response {
+	t.Helper()
+	b, _ := json.Marshal(body)
+	req, _ := http.NewRequestWithContext(ctx, "POST", e.srv.URL+"/api/ask", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAskCancelledDuringRetrieval(t *testing.T) {
+	e := newTestEnv(t, "Der Rhein mündet in die Nordsee.")
+	e.add(t, "Rhein", "Der Rhein mündet in die Nordsee.")
+	e.llm.mu.Lock()
+	e.llm.embedDelay = time.Minute
+	e.llm.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	e.startAsk(t, ctx, map[string]any{"question": "Wohin fließt der Rhein?"})
+	waitFor(t, "the question embedding", func() bool {
+		e.llm.mu.Lock()
+		defer e.llm.mu.Unlock()
+		return e.llm.embeds > 0
+	})
+	cancel()
+	waitFor(t, "the embedding to be cancelled", func() bool {
+		e.llm.mu.Lock()
+		defer e.llm.mu.Unlock()
+		return e.llm.embedsCancelled > 0
+	})
+	time.Sleep(100 * time.Millisecond)
+	if n := e.llm.chatCount(); n != 0 {
+		t.Fatalf("%d chat requests after the client went away", n)
+	}
+}
+
+func TestAskCancelledDuringAnswerKeepsPartial(t *testing.T) {
+	e := newTestEnv(t, "Der Rhein mündet bei Rotterdam in die Nordsee, nach über tausend Kilometern.")
+	e.llm.mu.Lock()
+	e.llm.pieceDelay = 50 * time.Millisecond
+	e.llm.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	resp := e.startAsk(t, ctx, map[string]any{"question": "Wohin fließt der Rhein?"})
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() && !strings.HasPrefix(sc.Text(), `data: "`) {
+	}
+	cancel()
+	var partial string
+	waitFor(t, "the partial answer", func() bool {
+		e.chats.mu.Lock()
+		defer e.chats.mu.Unlock()
+		for _, id := range e.chats.order {
+			for _, m := range e.chats.chats[id].Messages {
+				if m.Role == "assistant" {
+					partial = m.Content
+					return true
+				}
+			}
+		}
+		return false
+	})
+	if !strings.HasPrefix(partial, "Der") || strings.HasSuffix(partial, "Kilometern.") {
+		t.Fatalf("stored answer %q", partial)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestImportConversationsUniqueIDs(t *testing.T) {
+	cs := newChatStore("")
+	var list []conversation
+	for i := 0; i < 50; i++ {
+		list = append(list, conversation{Title: "Gleich", ImportID: fmt.Sprintf("conv-%d", i)})
+	}
+	added, skipped := cs.importConversations(list)
+	if len(added) != 50 || skipped != 0 {
+		t.Fatalf("added %d, skipped %d", len(added), skipped)
+	}
+	seen := map[string]bool{}
+	for _, c := range added {
+		if seen[c.ID] {
+			t.Fatalf("duplicate id %s", c.ID)
+		}
+		seen[c.ID] = true
+	}
+	if len(cs.order) != 50 || len(cs.chats) != 50 {
+		t.Fatalf("order %d, chats %d", len(cs.order), len(cs.chats))
+	}
+
+	// Same import IDs again: all skipped.
+	if added, skipped := cs.importConversations(list); len(added) != 0 || skipped != 50 {
+		t.Fatalf("re-import: added %d, skipped %d", len(added), skipped)
+	}
+}
+
+func TestChatImportSource(t *testing.T) {
+	a := chatImportSource(conversation{Title: "Notizen", ImportID: "x1"})
+	b := chatImportSource(conversation{Title: "Notizen", ImportID: "x2"})
+	if a == b {
+		t.Fatalf("same source for different conversations: %s", a)
+	}
+	if got := inferOrigin(a).Type; got != "chat" {
+		t.Fatalf("origin %q", got)
+	}
+}
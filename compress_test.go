@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	tinysql "github.com/SimonWaldherr/tinySQL"
+)
+
+// rawContents returns the stored content column of `article`.
+func rawContents(t *testing.T, r *ragSystem, article string) []string {
+	t.Helper()
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	rs, err := r.execLocked("SELECT content FROM chunks WHERE article = " + sqlText(article) + " ORDER BY chunk_idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, row := range rs.Rows {
+		v, _ := row["content"].(string)
+		out = append(out, v)
+	}
+	return out
+}
+
+func TestCompressedChunks(t *testing.T) {
+	e := newTestEnv(t)
+	text := "Der Rhein mündet in die Nordsee. " + strings.Repeat("Köln liegt am Rhein. ", 20)
+	e.add(t, "plain", "Kaffee wird geröstet.")
+	e.rag.compress = true
+	e.add(t, "Rhein", text)
+
+	raw := rawContents(t, e.rag, "Rhein")[0]
+	if !isCompressed(raw) || len(raw) >= len(text) {
+		t.Fatalf("stored %d bytes, compressed %v", len(raw), isCompressed(raw))
+	}
+	if got := storedContents(t, e.rag, "Rhein")[0]; got != text {
+		t.Fatalf("decoded %q", got)
+	}
+	results, err := e.rag.searchJSON(context.Background(), text, 2, "")
+	if err != nil || len(results) == 0 || results[0].Content != text {
+		t.Fatalf("search %+v %v", results, err)
+	}
+
+	if n, err := e.rag.recompress(false); err != nil || n != 1 {
+		t.Fatalf("decompress: %d %v", n, err)
+	}
+	if raw := rawContents(t, e.rag, "Rhein")[0]; raw != text {
+		t.Fatalf("decompressed %q", raw)
+	}
+	if n, err := e.rag.recompress(true); err != nil || n != 2 {
+		t.Fatalf("compress: %d %v", n, err)
+	}
+	for _, a := range []string{"plain", "Rhein"} {
+		if !isCompressed(rawContents(t, e.rag, a)[0]) {
+			t.Fatalf("%s not compressed", a)
+		}
+	}
+	if got := storedContents(t, e.rag, "plain")[0]; got != "Kaffee wird geröstet." {
+		t.Fatalf("decoded %q", got)
+	}
+	if n := e.rag.docCount(); n != 2 {
+		t.Fatalf("%d chunks after converting", n)
+	}
+}
+
+func TestChunksStartingWithPrefixBytes(t *testing.T) {
+	e := newTestEnv(t)
+	texts := map[string]string{
+		"eins": "\x01Kopfzeile und Text",
+		"zwei": "\x02Noch ein Text",
+		"drei": "\x01\x02",
+	}
+	for title, text := range texts {
+		if status, out := e.post(t, "/api/add-text", map[string]any{"title": title, "text": text}); status != 200 {
+			t.Fatalf("add-text: %d %s", status, out)
+		}
+	}
+	check := func(when string) {
+		t.Helper()
+		for title, text := range texts {
+			if got := storedContents(t, e.rag, title); len(got) != 1 || got[0] != text {
+				t.Fatalf("%s: %s decoded %q", when, title, got)
+			}
+		}
+	}
+	check("plain")
+	if raw := rawContents(t, e.rag, "eins")[0]; isCompressed(raw) {
+		t.Fatalf("plain text stored as compressed: %q", raw)
+	}
+	if n, err := e.rag.recompress(true); err != nil || n != len(texts) {
+		t.Fatalf("compress: %d %v", n, err)
+	}
+	check("compressed")
+	if n, err := e.rag.recompress(false); err != nil || n != len(texts) {
+		t.Fatalf("decompress: %d %v", n, err)
+	}
+	check("decompressed")
+}
+
+// BenchmarkChunkCompression measures the snapshot size and the search
+// latency with plain and compressed chunk text on up to 20 MB of the Go
+// standard library's source (chunks of 800 characters, 16-dimensional
+// random vectors):
+//
+//	go test -run XXX -bench ChunkCompression -benchtime 20x
+func BenchmarkChunkCompression(b *testing.B) {
+	var sources [][]string
+	total := 0
+	filepath.WalkDir(filepath.Join(runtime.GOROOT(), "src"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || total >= 20<<20 || d.IsDir() || !strings.HasSuffix(p, ".go") {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		if chunks := chunkText(string(data), 800); len(chunks) > 0 {
+			total += len(data)
+			sources = append(sources, chunks)
+		}
+		return nil
+	})
+	if len(sources) == 0 {
+		b.Skip("no Go source tree")
+	}
+	const dims = 16
+	randVec := func(rng *rand.Rand) []float64 {
+		v := make([]float64, dims)
+		for i := range v {
+			v[i] = rng.Float64()
+		}
+		return v
+	}
+	for _, compress := range []bool{false, true} {
+		b.Run(map[bool]string{false: "plain", true: "compressed"}[compress], func(b *testing.B) {
+			rag, err := newRAG(newLMClient("http://127.0.0.1:0", "embed", "chat", ""), 5, "", tinysql.ModeMemory, 64)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := rag.init(); err != nil {
+				b.Fatal(err)
+			}
+			rag.compress = compress
+			rng := rand.New(rand.NewPCG(1, 2))
+			for i, chunks := range sources {
+				vecs := make([][]float64, len(chunks))
+				for j := range vecs {
+					vecs[j] = randVec(rng)
+				}
+				if _, err := rag.storeChunks(sourceInfo{Name: fmt.Sprintf("src%d", i)}, chunks, vecs); err != nil {
+					b.Fatal(err)
+				}
+			}
+			snapshot := filepath.Join(b.TempDir(), "db.gob")
+			if err := tinysql.SaveToFile(rag.db, snapshot); err != nil {
+				b.Fatal(err)
+			}
+			st, err := os.Stat(snapshot)
+			if err != nil {
+				b.Fatal(err)
+			}
+			qvec := randVec(rng)
+			ctx := context.Background()
+			b.ResetTimer()
+			for b.Loop() {
+				hits, err := rag.searchHits(ctx, qvec, candidateLimit(5), "")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, _, _, _, err := rag.assembleContext(hits, hits[:min(5, len(hits))], defaultRetrievalOptions(5).MaxChars); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(st.Size())/1e6, "snapshot-MB")
+			b.ReportMetric(float64(rag.docCount()), "chunks")
+		})
+	}
+}
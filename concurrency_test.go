@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentSearchAndInsert hammers searches, saves and inserts
+// concurrently (run with -race). Readers must never see an article with
+// only part of its chunks or without its sources row.
+func TestConcurrentSearchAndInsert(t *testing.T) {
+	e := newTestEnv(t)
+	const articles, perArticle = 12, 150
+	chunks := func(a int) ([]string, [][]float64) {
+		var cs []string
+		var vs [][]float64
+		for i := 0; i < perArticle; i++ {
+			c := fmt.Sprintf("Artikel %d Abschnitt %d über Flüsse", a, i)
+			cs = append(cs, c)
+			vs = append(vs, wordVec(c))
+		}
+		return cs, vs
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := w; a < articles; a += 4 {
+				cs, vs := chunks(a)
+				if _, err := e.rag.storeChunks(sourceInfo{Name: fmt.Sprintf("A%d", a)}, cs, vs); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	var readers sync.WaitGroup
+	var slowest time.Duration
+	var mu sync.Mutex
+	for w := 0; w < 4; w++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for ctx.Err() == nil {
+				start := time.Now()
+				if _, err := e.rag.searchHits(ctx, wordVec("Abschnitt Flüsse"), 20, ""); err != nil && ctx.Err() == nil {
+					t.Error(err)
+				}
+				mu.Lock()
+				slowest = max(slowest, time.Since(start))
+				mu.Unlock()
+
+				e.rag.dbMu.RLock()
+				rs, err := e.rag.execLocked("SELECT article, COUNT(*) AS n FROM chunks GROUP BY article")
+				if err != nil {
+					e.rag.dbMu.RUnlock()
+					t.Error(err)
+					return
+				}
+				for _, row := range rs.Rows {
+					name, _ := row["article"].(string)
+					if n := fmt.Sprint(row["n"]); n != fmt.Sprint(perArticle) {
+						t.Errorf("%s visible with %s of %d chunks", name, n, perArticle)
+					}
+					if _, ok := e.rag.getSourceLocked(name); !ok {
+						t.Errorf("%s visible without its source", name)
+					}
+				}
+				e.rag.dbMu.RUnlock()
+				e.rag.docCount()
+				e.rag.listSources()
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+	readers.Wait()
+	if n := e.rag.docCount(); n != articles*perArticle {
+		t.Fatalf("%d chunks, want %d", n, articles*perArticle)
+	}
+	t.Logf("slowest search during the inserts: %s", slowest)
+}
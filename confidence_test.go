@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEstimateConfidence(t *testing.T) {
+	chunks := func(scores ...float64) []debugChunk {
+		var out []debugChunk
+		for _, s := range scores {
+			out = append(out, debugChunk{Score: s, Content: "x", Article: "A"})
+		}
+		return out
+	}
+	cases := []struct {
+		name string
+		di   *debugInfo
+		want string
+	}{
+		{"no debug info", nil, "low"},
+		{"no chunks", &debugInfo{}, "low"},
+		{"no chunks, high decision", &debugInfo{Decision: "high_confidence"}, "low"},
+		{"only neighbors", &debugInfo{Decision: "lm_requested_retrieval", Chunks: []debugChunk{{Score: -1, Content: "n", IsNeighbor: true}}}, "low"},
+		{"empty content", &debugInfo{Decision: "lm_requested_retrieval", Chunks: []debugChunk{{Score: 0.9, Content: "  "}}}, "low"},
+		{"answer direct", &debugInfo{Decision: "answer_direct", Chunks: chunks(0.95, 0.91)}, "low"},
+		{"two strong hits", &debugInfo{Decision: "high_confidence", Chunks: chunks(0.95, 0.91)}, "high"},
+		{"one strong hit", &debugInfo{Decision: "high_confidence", Chunks: chunks(0.95)}, "medium"},
+		{"relaxed fallback", &debugInfo{Decision: "relaxed_fallback", Chunks: chunks(0.95, 0.91)}, "medium"},
+		{"weak hits", &debugInfo{Decision: "lm_requested_retrieval", Chunks: chunks(0.4, 0.3)}, "low"},
+		{"middling hits", &debugInfo{Decision: "lm_requested_retrieval", Chunks: chunks(0.7, 0.6)}, "medium"},
+		{"exact article", &debugInfo{Decision: "article_specific", Chunks: chunks(-1, -1)}, "high"},
+	}
+	for _, c := range cases {
+		if got := estimateConfidence(c.di, defaultConfidenceThresholds); got.Level != c.want || len(got.Reasons) == 0 {
+			t.Errorf("%s: got %+v, want %s", c.name, got, c.want)
+		}
+	}
+	// Thresholds are tunable.
+	strict := confidenceThresholds{High: 0.99, Low: 0.9, MinHits: 1}
+	if got := estimateConfidence(&debugInfo{Decision: "high_confidence", Chunks: chunks(0.95, 0.91)}, strict); got.Level != "medium" {
+		t.Errorf("strict thresholds: %+v", got)
+	}
+}
+
+// askConfidence asks `question` and returns the level of the confidence
+// event and of the stored answer.
+func askConfidence(t *testing.T, e *testEnv, body map[string]any) (string, string) {
+	t.Helper()
+	events := sseEvents(e.ask(t, body), "confidence")
+	if len(events) != 1 {
+		t.Fatalf("%d confidence events", len(events))
+	}
+	var c confidence
+	if err := json.Unmarshal([]byte(events[0]), &c); err != nil {
+		t.Fatal(err)
+	}
+	stored := e.lastAnswer(t).Confidence
+	if stored == nil {
+		t.Fatal("no confidence stored with the answer")
+	}
+	return c.Level, stored.Level
+}
+
+func TestConfidenceEvent(t *testing.T) {
+	e := newTestEnv(t, "Eine Antwort.")
+	if sent, stored := askConfidence(t, e, map[string]any{"question": "Wo liegt Atlantis?"}); sent != "low" || stored != "low" {
+		t.Fatalf("empty knowledge base: %s/%s", sent, stored)
+	}
+
+	e = newTestEnv(t, "Eine Antwort.")
+	text := "Die Wartburg steht oberhalb von Eisenach in Thüringen."
+	e.add(t, "Wartburg", text)
+	e.add(t, "Eisenach", text)
+	if sent, stored := askConfidence(t, e, map[string]any{"question": text, "offline": true}); sent != "high" || stored != "high" {
+		t.Fatalf("exact match: %s/%s", sent, stored)
+	}
+}
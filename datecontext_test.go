@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDateContextLine(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	now := time.Date(2026, 10, 16, 14, 5, 0, 0, berlin)
+	for lang, want := range map[string]string{
+		"de": "Aktuelles Datum und Uhrzeit: Freitag, 16. Oktober 2026, 14:05 Uhr (CEST, UTC+02:00). Sprache: de.",
+		"en": "Current date and time: Friday, October 16, 2026, 14:05 (CEST, UTC+02:00). Language: en.",
+		"fr": "Date et heure actuelles: vendredi 16 octobre 2026, 14:05 (CEST, UTC+02:00). Langue: fr.",
+		"nl": "Current date and time: Friday, October 16, 2026, 14:05 (CEST, UTC+02:00). Language: nl.",
+	} {
+		if got := dateContextLine(now, lang); got != want {
+			t.Errorf("%s: %q, want %q", lang, got, want)
+		}
+	}
+}
+
+// askSystemPrompt asks `question` with full debug output and returns
+// the system prompt the answer was generated with.
+func askSystemPrompt(t *testing.T, e *testEnv, question string) string {
+	t.Helper()
+	full := sseEvents(e.ask(t, map[string]any{"question": question, "debug_full": true}), "debug_full")
+	if len(full) != 1 {
+		t.Fatalf("%d debug_full events", len(full))
+	}
+	var d debugFull
+	if err := json.Unmarshal([]byte(full[0]), &d); err != nil {
+		t.Fatal(err)
+	}
+	return d.SystemPrompt
+}
+
+func TestDateContextPerRequest(t *testing.T) {
+	e := newTestEnv(t, "Antwort.")
+	e.settings.update(func(s *appSettings) error {
+		s.AllowFullDebug = true
+		return nil
+	})
+	now := time.Date(2026, 10, 16, 14, 5, 0, 0, time.UTC)
+	prev := dateContextNow
+	dateContextNow = func() time.Time { return now }
+	t.Cleanup(func() { dateContextNow = prev })
+
+	if p := askSystemPrompt(t, e, "Welcher Tag ist heute?"); !strings.HasPrefix(p, dateContextLine(now, "de")+"\n\n") {
+		t.Fatalf("system prompt %q", p)
+	}
+	now = now.Add(26 * time.Hour)
+	if p := askSystemPrompt(t, e, "Und morgen?"); !strings.HasPrefix(p, "Aktuelles Datum und Uhrzeit: Samstag, 17. Oktober 2026, 16:05 Uhr") {
+		t.Fatalf("system prompt of the second request %q", p)
+	}
+
+	e.settings.update(func(s *appSettings) error {
+		s.DisableDateContext = true
+		return nil
+	})
+	if p := askSystemPrompt(t, e, "Und jetzt?"); strings.Contains(p, "Aktuelles Datum") {
+		t.Fatalf("disabled date context in %q", p)
+	}
+}
+
+func TestDateContextCLI(t *testing.T) {
+	e := newTestEnv(t, "Antwort.")
+	var out strings.Builder
+	if _, err := answerCLI(t.Context(), e.rag, e.settings.get(), "Welcher Tag ist heute?", &out); err != nil {
+		t.Fatal(err)
+	}
+	e.llm.mu.Lock()
+	defer e.llm.mu.Unlock()
+	last := e.llm.chatReqs[len(e.llm.chatReqs)-1]
+	if system := last.Messages[0].Content; !strings.HasPrefix(system, "Aktuelles Datum und Uhrzeit: ") || !strings.Contains(system, cliSystemPrompt) {
+		t.Fatalf("CLI system prompt %q", system)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+
+	tinysql "github.com/SimonWaldherr/tinySQL"
+)
+
+func TestTruncateEmbedding(t *testing.T) {
+	v, err := truncateEmbedding([]float64{3, 4, 12}, 2)
+	if err != nil || v[0] != 0.6 || v[1] != 0.8 {
+		t.Fatalf("%v %v", v, err)
+	}
+	if v, err := truncateEmbedding([]float64{0, 0, 1}, 2); err != nil || v[0] != 0 || v[1] != 0 {
+		t.Fatalf("zero vector: %v %v", v, err)
+	}
+	if _, err := truncateEmbedding([]float64{1}, 2); err == nil {
+		t.Fatal("a vector shorter than embed_dimensions was accepted")
+	}
+}
+
+func TestEmbedDimensionsChange(t *testing.T) {
+	e := newTestEnv(t, "Antwort.")
+	e.add(t, "Rhein", "Der Rhein mündet in die Nordsee.")
+
+	if status, out := e.post(t, "/api/settings", map[string]any{"embed_dimensions": 8}); status != 409 {
+		t.Fatalf("change without force: %d %s", status, out)
+	}
+	if status, out := e.post(t, "/api/settings", map[string]any{"embed_dimensions": 8, "force": true}); status != 200 {
+		t.Fatalf("change with force: %d %s", status, out)
+	}
+	const want = "the question embedding has 8 dimensions, collection default stores 16"
+	if _, err := e.rag.searchJSON(t.Context(), "Rhein", 3, ""); err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("search: %v", err)
+	}
+	if status, out := e.post(t, "/api/search", map[string]any{"query": "Rhein"}); status != 500 || !strings.Contains(out, "re-embed") {
+		t.Fatalf("search endpoint: %d %s", status, out)
+	}
+	frames := e.ask(t, map[string]any{"question": "Wohin fließt der Rhein?"})
+	if errs := sseEvents(frames, "error"); len(errs) != 1 || !strings.Contains(errs[0], want) {
+		t.Fatalf("ask errors %v", errs)
+	}
+	if e.llm.answerCount() != 0 {
+		t.Fatal("answered without a usable retrieval")
+	}
+	if err := e.rag.addChunks(t.Context(), "Elbe", []string{"Die Elbe mündet bei Cuxhaven."}); err == nil || !strings.Contains(err.Error(), "stores 16") {
+		t.Fatalf("insert: %v", err)
+	}
+}
+
+// BenchmarkEmbedDimensions compares searching 10,000 chunks of 768
+// dimensions with searching their first 256 and 128. It reports the
+// recall@10 against the exact ranking at 768 dimensions for vectors
+// whose variance falls with the dimension, as Matryoshka embeddings put
+// most information first; how much a real model keeps depends on it.
+//
+//	go test -run XXX -bench EmbedDimensions -benchtime 20x
+func BenchmarkEmbedDimensions(b *testing.B) {
+	const chunks, full, queries = 10000, 768, 20
+	rng := rand.New(rand.NewPCG(1, 2))
+	vec := func() []float64 {
+		v := make([]float64, full)
+		for j := range v {
+			v[j] = rng.NormFloat64() / math.Sqrt(1+float64(j)/16)
+		}
+		return v
+	}
+	vecs := make([][]float64, chunks)
+	for i := range vecs {
+		vecs[i] = vec()
+	}
+	// Queries are noisy copies of chunks, so each has close neighbors.
+	qvecs := make([][]float64, queries)
+	for i := range qvecs {
+		noise := vec()
+		qvecs[i] = slices.Clone(vecs[rng.IntN(chunks)])
+		for j := range qvecs[i] {
+			qvecs[i][j] += 0.5 * noise[j]
+		}
+	}
+	exact := make([][]int, queries)
+	for i, q := range qvecs {
+		ids := make([]int, chunks)
+		scores := make([]float64, chunks)
+		for j, v := range vecs {
+			ids[j], scores[j] = j, cosineSimilarity(q, v)
+		}
+		slices.SortFunc(ids, func(a, b int) int { return cmp.Compare(scores[b], scores[a]) })
+		exact[i] = ids[:10]
+	}
+
+	for _, dims := range []int{768, 256, 128} {
+		b.Run(fmt.Sprint(dims), func(b *testing.B) {
+			rag, err := newRAG(newLMClient("http://127.0.0.1:0", "embed", "chat", ""), 5, "", tinysql.ModeMemory, 64)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := rag.init(); err != nil {
+				b.Fatal(err)
+			}
+			trunc := func(v []float64) []float64 {
+				t, err := truncateEmbedding(v, dims)
+				if err != nil {
+					b.Fatal(err)
+				}
+				return t
+			}
+			for a := 0; a < chunks/100; a++ {
+				texts, batch := make([]string, 100), make([][]float64, 100)
+				for i := range texts {
+					texts[i], batch[i] = fmt.Sprint(a*100+i), trunc(vecs[a*100+i])
+				}
+				if _, err := rag.storeChunks(sourceInfo{Name: fmt.Sprint(a)}, texts, batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			ctx := context.Background()
+			found := 0
+			for i, q := range qvecs {
+				hits, err := rag.searchHits(ctx, trunc(q), 10, "")
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, h := range hits {
+					a := 0
+					fmt.Sscan(h.article, &a)
+					if slices.Contains(exact[i], a*100+h.chunkIdx) {
+						found++
+					}
+				}
+			}
+			qvec := trunc(qvecs[0])
+			b.ResetTimer()
+			for b.Loop() {
+				if _, err := rag.searchHits(ctx, qvec, 10, ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(found)/(queries*10), "recall@10")
+		})
+	}
+}
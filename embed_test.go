@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	tinysql "github.com/SimonWaldherr/tinySQL"
+)
+
+// droppingEmbedder is an embedding endpoint that, like some local
+// backends, silently drops inputs longer than 50 bytes. The vector of
+// each input is its length.
+type droppingEmbedder struct {
+	mu      sync.Mutex
+	indexed bool // send the index of each vector
+	drop    bool
+	reverse bool // send the vectors in reverse order
+}
+
+func (d *droppingEmbedder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req embReq
+	json.NewDecoder(r.Body).Decode(&req)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var data []map[string]any
+	for i, in := range req.Input {
+		if d.drop && len(in) > 50 {
+			continue
+		}
+		v := map[string]any{"embedding": []float64{float64(len(in)), 1}}
+		if d.indexed {
+			v["index"] = i
+		}
+		data = append(data, v)
+	}
+	if d.reverse {
+		slices.Reverse(data)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func TestEmbedAlignment(t *testing.T) {
+	backend := &droppingEmbedder{}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+	lm := newLMClient(srv.URL, "embed", "chat", "")
+	texts := []string{"a", strings.Repeat("b", 80), "ccc"}
+
+	for _, c := range []struct {
+		name                   string
+		indexed, drop, reverse bool
+		err                    string
+	}{
+		{"dropped without index", false, true, false, "the longest is input 1 (80 chars)"},
+		{"dropped with index", true, true, false, "input 1 (80 chars) is missing"},
+		{"reordered with index", true, false, true, ""},
+		{"complete", false, false, false, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			backend.mu.Lock()
+			backend.indexed, backend.drop, backend.reverse = c.indexed, c.drop, c.reverse
+			backend.mu.Unlock()
+			vecs, err := lm.embed(t.Context(), texts)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("error %v, want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil || len(vecs) != 3 || vecs[0][0] != 1 || vecs[1][0] != 80 || vecs[2][0] != 3 {
+				t.Fatalf("vectors %v, %v", vecs, err)
+			}
+		})
+	}
+
+	backend.mu.Lock()
+	backend.indexed, backend.drop, backend.reverse = false, true, false
+	backend.mu.Unlock()
+	r, err := newRAG(lm, 5, "", tinysql.ModeMemory, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.addChunks(t.Context(), "X", texts); err == nil || r.docCount() != 0 {
+		t.Fatalf("addChunks stored %d chunks with a vector missing: %v", r.docCount(), err)
+	}
+	if _, err := r.storeChunks(sourceInfo{Name: "Y"}, texts, [][]float64{{1, 1}, {2, 1}}); err == nil || r.docCount() != 0 {
+		t.Fatalf("storeChunks stored %d chunks for 2 vectors: %v", r.docCount(), err)
+	}
+}
+
+func TestAlignEmbeddings(t *testing.T) {
+	texts := []string{"a", "b"}
+	for _, c := range []struct{ name, data, err string }{
+		{"index out of range", `[{"index":0,"embedding":[1]},{"index":2,"embedding":[1]}]`, "out of range"},
+		{"index twice", `[{"index":0,"embedding":[1]},{"index":0,"embedding":[1]}]`, "returned twice"},
+		{"index missing on one", `[{"index":1,"embedding":[1]},{"embedding":[1]}]`, "has no index"},
+		{"empty vector", `[{"embedding":[1]},{"embedding":[]}]`, "empty embedding for input 1"},
+		{"too many", `[{"embedding":[1]},{"embedding":[1]},{"embedding":[1]}]`, "out of range"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var er embResp
+			if err := json.Unmarshal([]byte(`{"data":`+c.data+`}`), &er); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := alignEmbeddings(er, texts); err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("error %v, want %q", err, c.err)
+			}
+		})
+	}
+}
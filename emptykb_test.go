@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// emptyKBAsk asks `body` on an empty knowledge base and checks that the
+// meta event flags it and that no question was embedded.
+func emptyKBAsk(t *testing.T, e *testEnv, body map[string]any) []sseFrame {
+	t.Helper()
+	frames := e.ask(t, body)
+	metas := sseEvents(frames, "meta")
+	if len(metas) == 0 {
+		t.Fatal("no meta event")
+	}
+	var meta map[string]any
+	if err := json.Unmarshal([]byte(metas[0]), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta["empty_kb"] != true {
+		t.Fatalf("meta %v", meta)
+	}
+	if dbg := sseEvents(frames, "debug"); len(dbg) == 0 || !strings.Contains(dbg[0], `"decision":"empty_kb"`) {
+		t.Fatalf("debug events %v", dbg)
+	}
+	e.llm.mu.Lock()
+	defer e.llm.mu.Unlock()
+	if e.llm.embeds != 0 {
+		t.Fatalf("%d embedding requests", e.llm.embeds)
+	}
+	return frames
+}
+
+func TestEmptyKBAnswersFromModel(t *testing.T) {
+	e := newTestEnv(t, "Aus allgemeinem Wissen: Der Rhein mündet in die Nordsee.")
+	frames := emptyKBAsk(t, e, map[string]any{"question": "Wohin fließt der Rhein?", "debug": true})
+	if text := sseText(t, frames); !strings.Contains(text, "Nordsee") {
+		t.Fatalf("answer %q", text)
+	}
+	e.llm.mu.Lock()
+	defer e.llm.mu.Unlock()
+	if len(e.llm.chatReqs) != 1 {
+		t.Fatalf("%d chat requests, want only the answer", len(e.llm.chatReqs))
+	}
+	if system := e.llm.chatReqs[0].Messages[0].Content; !strings.Contains(system, strings.TrimSpace(emptyKBNote)) {
+		t.Fatalf("system prompt without the empty knowledge base note: %q", system)
+	}
+}
+
+func TestEmptyKBOffline(t *testing.T) {
+	e := newTestEnv(t)
+	frames := emptyKBAsk(t, e, map[string]any{"question": "Wohin fließt der Rhein?", "debug": true, "offline": true})
+	if text := sseText(t, frames); text != emptyKBAnswer {
+		t.Fatalf("answer %q", text)
+	}
+	if n := e.llm.chatCount(); n != 0 {
+		t.Fatalf("%d chat requests in offline mode", n)
+	}
+}
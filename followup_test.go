@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// followUpEnv is a knowledge base in which "und wie hoch ist sie?" finds
+// the wrong source on its own; the aux model rewrites follow-ups to
+// "Wie hoch ist die Zugspitze?" and retrieves the best hit.
+func followUpEnv(t *testing.T, mode string) *testEnv {
+	e := newTestEnv(t, "Die Zugspitze ist ein Berg [1].", "Sie ist 2962 Meter hoch [1].")
+	e.llm.aux = func(req chatReq) string {
+		if strings.HasPrefix(req.Messages[0].Content, "Rewrite the follow-up question") {
+			return "\"Wie hoch ist die Zugspitze?\"\n"
+		}
+		return `{"action":"RETRIEVE_MORE","k":1,"threshold":0}`
+	}
+	e.add(t, "Zugspitze", "Zugspitze Zugspitze Meter")
+	e.add(t, "Brot", "sie sie sie lecker")
+	e.settings.update(func(s *appSettings) error {
+		s.FollowUpQuery = mode
+		return nil
+	})
+	return e
+}
+
+// followUp asks a question and then "und wie hoch ist sie?" in the same
+// chat and returns the search query and the top source of the second.
+func followUp(t *testing.T, e *testEnv) (string, string) {
+	t.Helper()
+	e.ask(t, map[string]any{"question": "Was ist die Zugspitze?"})
+	dbg := sseEvents(e.ask(t, map[string]any{"question": "und wie hoch ist sie?", "chat_id": e.chats.order[0], "debug": true}), "debug")
+	if len(dbg) == 0 {
+		t.Fatal("no debug event")
+	}
+	var d struct {
+		SearchQuery string    `json:"search_query"`
+		Retrieval   debugInfo `json:"retrieval"`
+	}
+	if err := json.Unmarshal([]byte(dbg[0]), &d); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Retrieval.Chunks) == 0 {
+		return d.SearchQuery, ""
+	}
+	return d.SearchQuery, d.Retrieval.Chunks[0].Article
+}
+
+func TestFollowUpQuery(t *testing.T) {
+	for _, c := range []struct {
+		mode, query, top string
+	}{
+		{"", "und wie hoch ist sie?", "Brot"},
+		{"rewrite", "Wie hoch ist die Zugspitze?", "Zugspitze"},
+		{"concat", "Zugspitze? Die Zugspitze ist ein Berg . und wie hoch ist sie", "Zugspitze"},
+	} {
+		t.Run("mode "+c.mode, func(t *testing.T) {
+			query, top := followUp(t, followUpEnv(t, c.mode))
+			if query != c.query || top != c.top {
+				t.Fatalf("searched %q and found %q, want %q and %q", query, top, c.query, c.top)
+			}
+		})
+	}
+}
+
+func TestFollowUpQueryNotOnFirstMessage(t *testing.T) {
+	e := followUpEnv(t, "rewrite")
+	e.ask(t, map[string]any{"question": "Was ist die Zugspitze?"})
+	e.llm.mu.Lock()
+	defer e.llm.mu.Unlock()
+	for _, req := range e.llm.chatReqs {
+		if strings.HasPrefix(req.Messages[0].Content, "Rewrite the follow-up question") {
+			t.Fatal("the first message was rewritten")
+		}
+	}
+}
@@ -4,11 +4,14 @@ go 1.25.5
 
 require (
 	github.com/SimonWaldherr/tinySQL v0.5.6
+	golang.org/x/net v0.57.0
+	golang.org/x/term v0.45.0
 	simonwaldherr.de/go/nanogo v0.0.1
 	simonwaldherr.de/go/smallr v0.0.1
 )
 
 require (
 	github.com/robfig/cron/v3 v3.0.1 // indirect
+	golang.org/x/sys v0.47.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
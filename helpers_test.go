@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tinysql "github.com/SimonWaldherr/tinySQL"
+)
+
+// fakeLLM is an OpenAI-compatible test backend. Embeddings count the
+// words of each input in 16 hashed dimensions. Answers are taken from
+// `replies` in turn, the last one repeating; auxiliary completions at
+// temperature 0 (planners, rewrites) are answered by `aux`, which by
+// default answers directly.
+type fakeLLM struct {
+	*httptest.Server
+	mu       sync.Mutex
+	replies  []string
+	answers  int
+	aux      func(req chatReq) string
+	chatReqs []chatReq
+	embeds   int
+	// failEmbeds makes embedding requests fail from this one on (1-based).
+	failEmbeds int
+	// embedDelay is waited before answering an embedding request;
+	// embedsCancelled counts the requests cancelled while waiting.
+	embedDelay      time.Duration
+	embedsCancelled int
+	// pieceLen splits streamed replies into pieces of this many bytes
+	// (default 5); firstDelay and pieceDelay are waited before the first
+	// and before every other piece.
+	pieceLen   int
+	firstDelay time.Duration
+	pieceDelay time.Duration
+}
+
+func newFakeLLM(t testing.TB, replies ...string) *fakeLLM {
+	f := &fakeLLM{replies: replies, pieceLen: 5}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// wordVec is the embedding fakeLLM returns for `s`.
+func wordVec(s string) []float64 {
+	v := make([]float64, 16)
+	for _, w := range strings.Fields(strings.ToLower(s)) {
+		h := fnv.New32a()
+		h.Write([]byte(strings.Trim(w, "?!.,:;\"'()")))
+		v[h.Sum32()%16]++
+	}
+	v[0] += 0.01
+	return v
+}
+
+func (f *fakeLLM) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/models":
+		json.NewEncoder(w).Encode(map[string]any{"data": []any{map[string]string{"id": "chat"}, map[string]string{"id": "embed"}}})
+	case "/v1/embeddings":
+		var req embReq
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		f.embeds++
+		fail := f.failEmbeds > 0 && f.embeds >= f.failEmbeds
+		delay := f.embedDelay
+		f.mu.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			f.mu.Lock()
+			f.embedsCancelled++
+			f.mu.Unlock()
+			return
+		}
+		if fail {
+			http.Error(w, "embedding backend down", 500)
+			return
+		}
+		var data []map[string]any
+		for i, in := range req.Input {
+			data = append(data, map[string]any{"index": i, "embedding": wordVec(in)})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	case "/v1/chat/completions":
+		var req chatReq
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		f.chatReqs = append(f.chatReqs, req)
+		reply := `{"action":"ANSWER_DIRECT"}`
+		switch {
+		case req.Temperature != nil && *req.Temperature == 0:
+			if f.aux != nil {
+				reply = f.aux(req)
+			}
+		case len(f.replies) > 0:
+			f.answers++
+			reply = f.replies[min(f.answers, len(f.replies))-1]
+		}
+		pieceLen, first, delay := f.pieceLen, f.firstDelay, f.pieceDelay
+		f.mu.Unlock()
+		if !req.Stream {
+			json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": map[string]any{"role": "assistant", "content": reply}}}})
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		for i := 0; i < len(reply); i += pieceLen {
+			d := delay
+			if i == 0 {
+				d = first
+			}
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return
+			}
+			c, _ := json.Marshal(map[string]any{"choices": []any{map[string]any{"delta": map[string]any{"content": reply[i:min(i+pieceLen, len(reply))]}}}})
+			w.Write([]byte("data: " + string(c) + "\n\n"))
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// chatCount returns the number of chat requests received so far,
+// auxiliary ones included.
+func (f *fakeLLM) chatCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.chatReqs)
+}
+
+// answerCount returns the number of answer requests received so far.
+func (f *fakeLLM) answerCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.answers
+}
+
+// testEnv is a web server with an in-memory knowledge base backed by
+// a fakeLLM.
+type testEnv struct {
+	llm      *fakeLLM
+	rag      *ragSystem
+	settings *settingsStore
+	chats    *chatStore
+	srv      *httptest.Server
+}
+
+func newTestEnv(t testing.TB, replies ...string) *testEnv {
+	t.Helper()
+	llm := newFakeLLM(t, replies...)
+	settings, err := loadOrCreateSettings(filepath.Join(t.TempDir(), "settings.json"), defaultSettingsFromFlags(llm.URL, "chat", "embed", "de", 800, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rag, err := newRAG(newLMClient(llm.URL, "embed", "chat", ""), 5, "", tinysql.ModeMemory, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rag.init(); err != nil {
+		t.Fatal(err)
+	}
+	chats := newChatStore("")
+	srv := httptest.NewServer(newWebHandler(rag, settings, chats, newAPIStore(settings), newPersonaStore(settings)))
+	t.Cleanup(srv.Close)
+	return &testEnv{llm: llm, rag: rag, settings: settings, chats: chats, srv: srv}
+}
+
+// add stores `text` as one chunk of source `name`, embedded like the
+// fakeLLM does.
+func (e *testEnv) add(t testing.TB, name, text string) {
+	t.Helper()
+	if _, err := e.rag.storeChunks(sourceInfo{Name: name}, []string{text}, [][]float64{wordVec(text)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// post sends `body` as JSON to `path` and returns the status and body.
+func (e *testEnv) post(t testing.TB, path string, body any) (int, string) {
+	t.Helper()
+	b, _ := json.Marshal(body)
+	resp, err := http.Post(e.srv.URL+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out bytes.Buffer
+	out.ReadFrom(resp.Body)
+	return resp.StatusCode, out.String()
+}
+
+// sseFrame is one frame of an event stream; Event is "" for tokens.
+type sseFrame struct {
+	Event string
+	Data  string
+}
+
+// ask posts `body` to /api/ask and returns the frames of the answer.
+func (e *testEnv) ask(t testing.TB, body map[string]any) []sseFrame {
+	t.Helper()
+	status, out := e.post(t, "/api/ask", body)
+	if status != 200 {
+		t.Fatalf("ask: %d %s", status, out)
+	}
+	return parseSSE(out)
+}
+
+func parseSSE(body string) []sseFrame {
+	var frames []sseFrame
+	for _, raw := range strings.Split(body, "\n\n") {
+		var f sseFrame
+		for _, line := range strings.Split(raw, "\n") {
+			if ev, ok := strings.CutPrefix(line, "event: "); ok {
+				f.Event = ev
+			} else if d, ok := strings.CutPrefix(line, "data: "); ok {
+				f.Data = d
+			}
+		}
+		if f.Event != "" || f.Data != "" {
+			frames = append(frames, f)
+		}
+	}
+	return frames
+}
+
+// sseText joins the tokens of `frames`.
+func sseText(t testing.TB, frames []sseFrame) string {
+	t.Helper()
+	var b strings.Builder
+	for _, f := range frames {
+		if f.Event != "" || f.Data == "[DONE]" {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal([]byte(f.Data), &s); err != nil {
+			t.Fatalf("token frame %q: %v", f.Data, err)
+		}
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+// sseEvents returns the data of the frames of event `name`.
+func sseEvents(frames []sseFrame, name string) []string {
+	var out []string
+	for _, f := range frames {
+		if f.Event == name {
+			out = append(out, f.Data)
+		}
+	}
+	return out
+}
+
+// noFetchDelay replaces the page fetcher with one that doesn't wait
+// between requests to the same host, for the duration of the test.
+func noFetchDelay(t testing.TB) {
+	prev := fetcher
+	fetcher = newFetchCoordinator("", 0, nil)
+	t.Cleanup(func() { fetcher = prev })
+}
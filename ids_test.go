@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	tinysql "github.com/SimonWaldherr/tinySQL"
+)
+
+// openRAG opens the knowledge base at `path`, embedding with `llm`.
+func openRAG(t testing.TB, llm *fakeLLM, path string, mode tinysql.StorageMode) *ragSystem {
+	t.Helper()
+	r, err := newRAG(newLMClient(llm.URL, "embed", "chat", ""), 5, path, mode, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.init(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestChunkIDsSurviveDeleteAndRestart(t *testing.T) {
+	llm := newFakeLLM(t)
+	ctx := context.Background()
+	for _, mode := range []tinysql.StorageMode{tinysql.ModeMemory, tinysql.ModeDisk} {
+		t.Run(storageModeLabel(mode), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			r := openRAG(t, llm, path, mode)
+			r.addChunks(ctx, "a", []string{"eins", "zwei"})
+			r.addChunks(ctx, "b", []string{"drei", "vier", "fünf"})
+			if err := r.deleteSource("b"); err != nil { // the highest ids
+				t.Fatal(err)
+			}
+			if err := r.save(); err != nil {
+				t.Fatal(err)
+			}
+			r.db.Close()
+
+			r = openRAG(t, llm, path, mode)
+			defer r.db.Close()
+			if r.nextIDs[r.collection] != 5 {
+				t.Fatalf("next id %d after restart, want 5", r.nextIDs[r.collection])
+			}
+			r.addChunks(ctx, "c", []string{"sechs"})
+			if r.maxChunkIDLocked() != 5 {
+				t.Fatalf("new chunk got id %d", r.maxChunkIDLocked())
+			}
+		})
+	}
+}
+
+func TestChunkIDsLegacyDatabase(t *testing.T) {
+	llm := newFakeLLM(t)
+	path := filepath.Join(t.TempDir(), "db")
+	r := openRAG(t, llm, path, tinysql.ModeMemory)
+	r.addChunks(context.Background(), "a", []string{"eins", "zwei", "drei"})
+	r.execLocked("DROP TABLE meta")
+	r.save()
+	r.db.Close()
+
+	r = openRAG(t, llm, path, tinysql.ModeMemory)
+	if r.nextIDs[r.collection] != 3 {
+		t.Fatalf("next id %d, want MAX(id)+1 = 3", r.nextIDs[r.collection])
+	}
+}
+
+func TestAllocIDsFailsWithoutMeta(t *testing.T) {
+	e := newTestEnv(t)
+	e.rag.execLocked("DROP TABLE meta")
+	if _, err := e.rag.allocIDs(3); err == nil {
+		t.Fatal("ids reserved without a counter")
+	}
+	if err := e.rag.addChunks(context.Background(), "a", []string{"x"}); err == nil || e.rag.docCount() != 0 {
+		t.Fatalf("chunks stored without reserved ids: %v", err)
+	}
+}
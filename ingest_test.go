@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestAddChunksIsAllOrNothing(t *testing.T) {
+	e := newTestEnv(t)
+	var chunks []string
+	for i := 0; i < 40; i++ { // three embedding batches
+		chunks = append(chunks, fmt.Sprintf("Abschnitt %d über die Donau", i))
+	}
+	e.llm.mu.Lock()
+	e.llm.failEmbeds = 2
+	e.llm.mu.Unlock()
+	if err := e.rag.addChunks(context.Background(), "Donau", chunks); err == nil {
+		t.Fatal("no error from the failing embedder")
+	}
+	if n := e.rag.docCount(); n != 0 {
+		t.Fatalf("%d chunks stored after the failure", n)
+	}
+	if _, ok := e.rag.getSource("Donau"); ok {
+		t.Fatal("source recorded after the failure")
+	}
+
+	e.llm.mu.Lock()
+	e.llm.failEmbeds = 0
+	e.llm.mu.Unlock()
+	if err := e.rag.addChunks(context.Background(), "Donau", chunks); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if n := e.rag.docCount(); n != 40 {
+		t.Fatalf("%d chunks after the retry", n)
+	}
+}
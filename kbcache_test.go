@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// checkKBCache compares the cached chunk count and source list of `r`
+// with freshly queried ones.
+func checkKBCache(t *testing.T, r *ragSystem, step string) {
+	t.Helper()
+	n, src := r.docCount(), r.listSources()
+	r.noCache = true
+	n2, src2 := r.docCount(), r.listSources()
+	r.noCache = false
+	if n != n2 || !reflect.DeepEqual(src, src2) {
+		t.Fatalf("%s: cached %d/%v, queried %d/%v", step, n, src, n2, src2)
+	}
+}
+
+// storeN stores `n` chunks as source `name`.
+func storeN(r *ragSystem, name string, n int) {
+	chunks, vecs := make([]string, n), make([][]float64, n)
+	for i := range chunks {
+		chunks[i], vecs[i] = strings.Repeat("x", i+1), []float64{1, float64(i)}
+	}
+	r.storeChunks(sourceInfo{Name: name, sourceOrigin: inferOrigin(name)}, chunks, vecs)
+}
+
+func TestKBCacheStaysCorrect(t *testing.T) {
+	rag := newTestEnv(t).rag
+	checkKBCache(t, rag, "empty")
+	storeN(rag, "b", 3)
+	checkKBCache(t, rag, "add b")
+	storeN(rag, "a", 100)
+	checkKBCache(t, rag, "add a")
+	storeN(rag, "a", 5)
+	checkKBCache(t, rag, "add a again")
+	storeN(rag, "c", 1)
+	checkKBCache(t, rag, "add c")
+	if n := rag.docCount(); n != 104 {
+		t.Fatalf("%d chunks", n)
+	}
+	rag.deleteSource("a")
+	checkKBCache(t, rag, "delete a")
+	rag.deleteSource("fehlt")
+	checkKBCache(t, rag, "delete missing")
+
+	if err := rag.createCollection("other"); err != nil {
+		t.Fatal(err)
+	}
+	other := rag.in("other")
+	storeN(other, "x", 7)
+	checkKBCache(t, other, "add to other")
+	checkKBCache(t, rag, "default after other")
+	if other.docCount() != 7 || rag.docCount() != 4 {
+		t.Fatalf("other %d, default %d", other.docCount(), rag.docCount())
+	}
+	rag.deleteCollection("other")
+	rag.createCollection("other")
+	checkKBCache(t, rag.in("other"), "recreated")
+	if n := rag.in("other").docCount(); n != 0 {
+		t.Fatalf("recreated collection has %d chunks", n)
+	}
+
+	rag.dbMu.Lock()
+	rag.execLocked("INSERT INTO chunks (id, article, chunk_idx, content, embedding) VALUES (999, 'b', 0, 'doppelt', VEC_FROM_JSON('[1,0]'))")
+	rag.invalidateCacheLocked()
+	rag.dbMu.Unlock()
+	if _, err := rag.compact(); err != nil {
+		t.Fatal(err)
+	}
+	checkKBCache(t, rag, "compact")
+
+	var dump strings.Builder
+	if _, err := rag.exportDump(&dump, "embed"); err != nil {
+		t.Fatal(err)
+	}
+	rag2 := newTestEnv(t).rag
+	rag2.docCount()
+	rag2.listSources()
+	if _, err := rag2.importDump(strings.NewReader(dump.String()), "embed"); err != nil {
+		t.Fatal(err)
+	}
+	checkKBCache(t, rag2, "import")
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				storeN(rag, fmt.Sprintf("g%d-%d", g, i), 20)
+				rag.docCount()
+				rag.listSources()
+			}
+		}()
+	}
+	wg.Wait()
+	checkKBCache(t, rag, "concurrent adds")
+}
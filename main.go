@@ -5,30 +5,60 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"cmp"
+	"compress/flate"
 	"compress/gzip"
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
 	"html"
 	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"math"
+	mrand "math/rand/v2"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"runtime/metrics"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	_ "embed"
 
 	tinysql "github.com/SimonWaldherr/tinySQL"
+	htmlparse "golang.org/x/net/html"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/term"
 	nanogo "simonwaldherr.de/go/nanogo/interp"
 	smallr "simonwaldherr.de/go/smallr"
 )
@@ -46,6 +76,46 @@ var styleCSS string
 //go:embed app.js
 var appJS string
 
+// devAssetsDir is set by -dev-assets: the assets are then read from this
+// directory on every request instead of the embedded copies.
+var devAssetsDir string
+
+// staticAsset is a file of the web interface with its ETag.
+type staticAsset struct {
+	name        string
+	contentType string
+	body        string
+	etag        string
+}
+
+func newStaticAsset(name, contentType, body string) staticAsset {
+	return staticAsset{name: name, contentType: contentType, body: body, etag: assetETag(body)}
+}
+
+// assetETag returns a strong ETag for `body`.
+func assetETag(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// ServeHTTP serves the asset with Content-Length and ETag. Browsers
+// revalidate on every load (no-cache) and get 304 while it is unchanged.
+func (a staticAsset) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, etag := a.body, a.etag
+	if devAssetsDir != "" {
+		b, err := os.ReadFile(filepath.Join(devAssetsDir, a.name))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		body, etag = string(b), assetETag(string(b))
+	}
+	w.Header().Set("Content-Type", a.contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, a.name, time.Time{}, strings.NewReader(body))
+}
+
 // ─────────────────────────────────────────────────────────────────────────────
 // Settings (persisted as JSON)
 // ─────────────────────────────────────────────────────────────────────────────
@@ -63,20 +133,321 @@ type appSettings struct {
 	K          int         `json:"k"`
 	CustomAPIs []customAPI `json:"custom_apis"`
 	Personas   []persona   `json:"personas"`
+	// EmbedDimensions keeps only the first N dimensions of each embedding
+	// (Matryoshka models such as nomic-embed or text-embedding-3);
+	// 0 keeps them all. Changing it requires a re-embed.
+	EmbedDimensions int `json:"embed_dimensions,omitempty"`
+	// DefaultPersonaID is used for new chats; empty means the first persona.
+	DefaultPersonaID string `json:"default_persona_id,omitempty"`
+	// APIKey is the bearer token for the LLM endpoint. It is stored in
+	// secrets.json and referenced by APIKeyRef; LegacyAPIKey only reads
+	// plaintext keys of older settings files for migration.
+	APIKey       string `json:"-"`
+	APIKeyRef    string `json:"api_key_ref,omitempty"`
+	LegacyAPIKey string `json:"api_key,omitempty"`
 	// AllowCodeExec must be explicitly enabled to allow running user
 	// provided code. Defaults to false for safety.
 	AllowCodeExec bool `json:"allow_code_exec"`
 	// AllowNanoGo enables execution of untrusted Go source via the
 	// embedded nanoGo interpreter. Default: false.
 	AllowNanoGo bool `json:"allow_nanogo"`
+	// AllowFullDebug permits "debug_full" in /api/ask, which reveals the
+	// complete prompt including retrieved content. Default: false.
+	AllowFullDebug bool `json:"allow_full_debug"`
+	// HistoryBudget is the estimated token budget for prior chat
+	// messages sent along with a question.
+	HistoryBudget int `json:"history_budget"`
+	// MaxContextChars bounds the retrieved context of a question in
+	// characters; chunks beyond it are left out, neighbors first.
+	MaxContextChars int `json:"max_context_chars"`
+	// MaxToolIterations limits how many tool requests are executed
+	// automatically while answering a single question.
+	MaxToolIterations int `json:"max_tool_iterations"`
+	// MaxToolsPerAnswer limits the tool requests of one answer segment
+	// that are executed (concurrently) before it is continued.
+	MaxToolsPerAnswer int `json:"max_tools_per_answer"`
+	// AllowPythonExec enables the python tool, which runs snippets with
+	// the interpreter at PythonPath (default "python3"). Default: false.
+	AllowPythonExec bool   `json:"allow_python_exec"`
+	PythonPath      string `json:"python_path,omitempty"`
+	// NanoGoMaxOutput, NanoGoMaxSteps and NanoGoMaxMemMB limit console
+	// output bytes, executed steps and heap growth of a nanoGo run.
+	NanoGoMaxOutput int `json:"nanogo_max_output"`
+	NanoGoMaxSteps  int `json:"nanogo_max_steps"`
+	NanoGoMaxMemMB  int `json:"nanogo_max_mem_mb"`
+	// AllowPlugins enables external plugin tools loaded from -plugins-dir.
+	AllowPlugins bool `json:"allow_plugins"`
+	// WebSearchFollow is how many websearch result pages are fetched and
+	// added to the tool output (0 = snippets only, max 5).
+	WebSearchFollow int `json:"websearch_follow"`
+	// ProxyURL overrides HTTP_PROXY/HTTPS_PROXY for all outbound requests,
+	// including the LLM endpoint. NO_PROXY is still honored.
+	ProxyURL string `json:"proxy_url,omitempty"`
+	// AllowedHosts lists hostnames (".corp.example" for subdomains), IPs
+	// or CIDR networks that add-url and custom APIs may fetch even though
+	// they resolve to private or loopback addresses.
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+	// OfflineNetwork refuses all web fetches: web tools, custom APIs,
+	// plugins, URL/Wikipedia imports and refreshes.
+	OfflineNetwork bool `json:"offline_network"`
+	// ToolPolicy overrides the default execution policy per tool name.
+	ToolPolicy map[string]toolPolicy `json:"tool_policy,omitempty"`
+	// QueryPatterns replaces the built-in query refinement patterns per
+	// language (see defaultQueryPatterns).
+	QueryPatterns map[string][]string `json:"query_patterns,omitempty"`
+	// SourceFootnotes appends a "Quellen:" block listing the articles of
+	// the context to every answer.
+	SourceFootnotes bool `json:"source_footnotes"`
+	// CrossLangHint tells the model to answer in the language of the
+	// question when all retrieved chunks are in another language.
+	CrossLangHint bool `json:"cross_lang_hint"`
+	// StrictGrounding refuses to answer, without calling the model, when
+	// retrieval finds nothing relevant (see groundingGap).
+	StrictGrounding bool `json:"strict_grounding"`
+	// DisableDateContext leaves out the line with the current date and
+	// time that otherwise starts every answer's system prompt.
+	DisableDateContext bool `json:"disable_date_context"`
+	// CompressChunks stores the text of new chunks DEFLATE-compressed,
+	// which shrinks the snapshot and memory use of large corpora. Read
+	// at startup; `tinyrag compress` converts existing chunks.
+	CompressChunks bool `json:"compress_chunks"`
+	// FollowUpQuery builds the retrieval query of follow-up questions
+	// from the previous turn: "concat" searches the previous question and
+	// answer along with the question, "rewrite" has the model rewrite it
+	// as a standalone question. Empty or "off" searches the question alone.
+	FollowUpQuery string `json:"followup_query,omitempty"`
+	// DisablePlanningStream stops sending the tokens of the retrieval
+	// planners as "planning" events of /api/ask, except in debug mode.
+	DisablePlanningStream bool `json:"disable_planning_stream"`
+	// Confidence tunes the answer confidence estimation.
+	Confidence confidenceThresholds `json:"confidence"`
+	// AnswerCache replays answers to repeated questions without calling
+	// the LLM. Disabled by default.
+	AnswerCache answerCacheSettings `json:"answer_cache"`
+	// KeepWarm pings the LLM endpoint when it has been idle for a while,
+	// so local servers keep the models loaded.
+	KeepWarm keepWarmSettings `json:"keep_warm"`
+	// Webhook is notified when long-running jobs finish.
+	Webhook webhookSettings `json:"webhook"`
+	// SimilarQuestions points out earlier questions from other chats
+	// that match a new one. Enabled by default.
+	SimilarQuestions similarQuestionSettings `json:"similar_questions"`
+	// ModelRules extend the recommendation of chat and embedding models.
+	ModelRules modelRules `json:"model_rules"`
+	// DiscoverCandidates replaces the base URLs probed by /api/discover
+	// (see defaultDiscoverCandidates).
+	DiscoverCandidates []string `json:"discover_candidates,omitempty"`
+	// Calibration holds retrieval thresholds per embedding model, set by
+	// POST /api/calibrate.
+	Calibration map[string]scoreCalibration `json:"calibration,omitempty"`
+}
+
+// answerCacheSettings configure the answer cache: at most Size entries,
+// each served for TTLSeconds.
+type answerCacheSettings struct {
+	Enabled    bool `json:"enabled"`
+	Size       int  `json:"size"`
+	TTLSeconds int  `json:"ttl_seconds"`
+}
+
+// keepWarmSettings configure the model warmer: with Enabled, the
+// endpoint gets an embedding and a 1-token chat completion after
+// IdleMinutes without requests.
+type keepWarmSettings struct {
+	Enabled     bool `json:"enabled"`
+	IdleMinutes int  `json:"idle_minutes"`
+}
+
+// defaultKeepWarmIdle is the warm-up interval used when none is
+// configured, just below Ollama's default keep-alive of 5 minutes.
+const defaultKeepWarmIdle = 4
+
+// interval returns the configured idle time before a warm-up.
+func (kw keepWarmSettings) interval() time.Duration {
+	if kw.IdleMinutes <= 0 {
+		return defaultKeepWarmIdle * time.Minute
+	}
+	return time.Duration(kw.IdleMinutes) * time.Minute
+}
+
+// webhookSettings configure job notifications: events are POSTed to URL
+// and signed with Secret. Like APIKey, Secret is stored in secrets.json
+// and referenced by SecretRef; a plaintext "secret" is moved there.
+type webhookSettings struct {
+	URL          string `json:"url,omitempty"`
+	Secret       string `json:"-"`
+	SecretRef    string `json:"secret_ref,omitempty"`
+	LegacySecret string `json:"secret,omitempty"`
+}
+
+// similarQuestionSettings configure the "event: similar" of /api/ask:
+// earlier questions count as similar from Threshold on.
+type similarQuestionSettings struct {
+	Disabled  bool    `json:"disabled"`
+	Threshold float64 `json:"threshold"`
+}
+
+// modelRules are case-insensitive regexps on model IDs that mark models
+// as chat or embedding models (Include) or rule them out (Exclude, which
+// wins). They override the name heuristics of recommendModels but not
+// what the backend reports about a model.
+type modelRules struct {
+	ChatInclude  []string `json:"chat_include,omitempty"`
+	ChatExclude  []string `json:"chat_exclude,omitempty"`
+	EmbedInclude []string `json:"embed_include,omitempty"`
+	EmbedExclude []string `json:"embed_exclude,omitempty"`
+}
+
+// lists returns pointers to the pattern lists of `m`.
+func (m *modelRules) lists() []*[]string {
+	return []*[]string{&m.ChatInclude, &m.ChatExclude, &m.EmbedInclude, &m.EmbedExclude}
+}
+
+// defaultAnswerCache is used for unset answer cache limits.
+var defaultAnswerCache = answerCacheSettings{Size: 100, TTLSeconds: 3600}
+
+// confidenceThresholds configure estimateConfidence: an answer is
+// "high" when the best chunk scores at least High and MinHits chunks
+// reach High, "low" when the best chunk scores below Low.
+type confidenceThresholds struct {
+	High    float64 `json:"high"`
+	Low     float64 `json:"low"`
+	MinHits int     `json:"min_hits"`
 }
 
+// defaultConfidenceThresholds are used for unset confidence settings.
+var defaultConfidenceThresholds = confidenceThresholds{High: 0.80, Low: 0.55, MinHits: 2}
+
+// defaultHistoryBudget is the history token budget used when none is configured.
+const defaultHistoryBudget = 2000
+
+// defaultMaxContextChars is the context budget used when none is
+// configured. With the tool instructions and a persona it keeps the
+// system prompt below maxSystemPromptChars.
+const defaultMaxContextChars = 24000
+
+// maxSystemPromptChars is the system prompt length /api/ask expects
+// never to exceed with the default context budget.
+const maxSystemPromptChars = 32000
+
+// defaultMaxToolIterations is the tool loop limit used when none is configured.
+const defaultMaxToolIterations = 3
+
+// defaultMaxToolsPerAnswer is the per-segment tool limit used when none
+// is configured.
+const defaultMaxToolsPerAnswer = 3
+
+// Default nanoGo limits used when none are configured.
+const (
+	defaultNanoGoMaxOutput = 64 << 10
+	defaultNanoGoMaxSteps  = 1000000
+	defaultNanoGoMaxMemMB  = 256
+)
+
 // settingsStore provides a thread-safe wrapper around persisted
 // `appSettings`, handling reading and atomic writes to disk.
 type settingsStore struct {
 	mu   sync.Mutex
 	path string
 	s    appSettings
+	// pins are environment overrides by settings key. They are applied
+	// on get() only, so they are never written to the settings file.
+	pins map[string]settingsPin
+	// secrets mirrors secrets.json next to the settings file.
+	secretsPath string
+	secrets     map[string]string
+}
+
+// Names of the secrets in secrets.json.
+const (
+	secretLLMAPIKey     = "llm_api_key"
+	secretWebhookSecret = "webhook_secret"
+	// secretAPIHeaderPrefix starts the names of custom API headers,
+	// followed by "<api id>:<header>" (see apiHeaderSecret).
+	secretAPIHeaderPrefix = "api_header:"
+)
+
+// apiHeaderSecret returns the secrets.json name of header `header` of
+// the custom API `apiID`.
+func apiHeaderSecret(apiID, header string) string {
+	return secretAPIHeaderPrefix + apiID + ":" + strings.ToLower(header)
+}
+
+// maskSecret hides a credential for display, keeping the last 4
+// characters of long values.
+func maskSecret(v string) string {
+	if v == "" {
+		return ""
+	}
+	if utf8.RuneCountInString(v) <= 8 {
+		return "•••"
+	}
+	r := []rune(v)
+	return "•••" + string(r[len(r)-4:])
+}
+
+// settingsPin is a settings value taken from an environment variable.
+type settingsPin struct {
+	Env   string
+	Value string
+}
+
+// applySettingsPin sets the field behind settings key `key` to `v`.
+func applySettingsPin(s *appSettings, key, v string) error {
+	switch key {
+	case "base_url":
+		s.BaseURL = normalizeBaseURL(v)
+	case "chat_model":
+		s.ChatModel = v
+	case "embed_model":
+		s.EmbedModel = v
+	case "api_key":
+		s.APIKey = v
+	case "lang":
+		s.Lang = v
+	case "proxy_url":
+		s.ProxyURL = v
+	case "k", "chunk_size":
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%s must be a positive integer, got %q", key, v)
+		}
+		if key == "k" {
+			s.K = n
+		} else {
+			s.ChunkSize = n
+		}
+	default:
+		return fmt.Errorf("setting %q cannot be set from the environment", key)
+	}
+	return nil
+}
+
+// pin overrides settings key `key` with the value of environment
+// variable `env`.
+func (ss *settingsStore) pin(key, env, value string) error {
+	var probe appSettings
+	if err := applySettingsPin(&probe, key, value); err != nil {
+		return fmt.Errorf("%s: %w", env, err)
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.pins == nil {
+		ss.pins = map[string]settingsPin{}
+	}
+	ss.pins[key] = settingsPin{Env: env, Value: value}
+	return nil
+}
+
+// pinned maps each env-pinned settings key to its variable name.
+func (ss *settingsStore) pinned() map[string]string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	out := make(map[string]string, len(ss.pins))
+	for key, p := range ss.pins {
+		out[key] = p.Env
+	}
+	return out
 }
 
 // normalizeBaseURL trims and normalizes an LLM base URL, removing
@@ -95,29 +466,42 @@ func normalizeBaseURL(raw string) string {
 // used on first-run when no settings file exists.
 func defaultSettingsFromFlags(urlFlag, chatModelFlag, embedModelFlag, lang string, chunkSize, k int) appSettings {
 	return appSettings{
-		Version:       1,
-		BaseURL:       normalizeBaseURL(urlFlag),
-		ChatModel:     chatModelFlag,
-		EmbedModel:    embedModelFlag,
-		Lang:          lang,
-		ChunkSize:     chunkSize,
-		K:             k,
-		CustomAPIs:    []customAPI{},
-		AllowCodeExec: false,
-		AllowNanoGo:   false,
+		Version:           1,
+		BaseURL:           normalizeBaseURL(urlFlag),
+		ChatModel:         chatModelFlag,
+		EmbedModel:        embedModelFlag,
+		Lang:              lang,
+		ChunkSize:         chunkSize,
+		K:                 k,
+		CustomAPIs:        []customAPI{},
+		AllowCodeExec:     false,
+		AllowNanoGo:       false,
+		HistoryBudget:     defaultHistoryBudget,
+		MaxContextChars:   defaultMaxContextChars,
+		MaxToolIterations: defaultMaxToolIterations,
+		MaxToolsPerAnswer: defaultMaxToolsPerAnswer,
+		NanoGoMaxOutput:   defaultNanoGoMaxOutput,
+		NanoGoMaxSteps:    defaultNanoGoMaxSteps,
+		NanoGoMaxMemMB:    defaultNanoGoMaxMemMB,
+		Confidence:        defaultConfidenceThresholds,
+		AnswerCache:       defaultAnswerCache,
+		SimilarQuestions:  similarQuestionSettings{Threshold: defaultSimilarThreshold},
 	}
 }
 
 // loadOrCreateSettings loads settings from `path` or creates the file
 // with `defaults` if it does not exist, returning a settingsStore.
 func loadOrCreateSettings(path string, defaults appSettings) (*settingsStore, error) {
-	ss := &settingsStore{path: path}
+	ss := &settingsStore{path: path, secretsPath: filepath.Join(filepath.Dir(path), "secrets.json")}
+	if err := ss.loadSecrets(); err != nil {
+		return nil, err
+	}
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			ss.s = defaults
 			if len(ss.s.Personas) == 0 {
-				ss.s.Personas = []persona{{ID: "persona-default", Name: "Standard", Prompt: ""}}
+				ss.s.Personas = builtinPersonas(ss.s.Lang)
 			}
 			if err := ss.saveLocked(); err != nil {
 				return nil, err
@@ -130,6 +514,55 @@ func loadOrCreateSettings(path string, defaults appSettings) (*settingsStore, er
 		return nil, fmt.Errorf("settings JSON parse error: %w", err)
 	}
 	// Minimal migrations / sanity
+	// Resolve stored secrets and move plaintext ones (older versions,
+	// hand-edited settings) into secrets.json; the save below removes
+	// them from settings.json.
+	var moved []string
+	for _, sec := range []struct {
+		name   string
+		value  *string
+		ref    string
+		legacy *string
+	}{
+		{"api_key", &ss.s.APIKey, ss.s.APIKeyRef, &ss.s.LegacyAPIKey},
+		{"webhook secret", &ss.s.Webhook.Secret, ss.s.Webhook.SecretRef, &ss.s.Webhook.LegacySecret},
+	} {
+		if *sec.legacy != "" {
+			*sec.value, *sec.legacy = *sec.legacy, ""
+			moved = append(moved, sec.name)
+		} else if sec.ref != "" {
+			v, ok := ss.secrets[sec.ref]
+			if !ok {
+				log.Printf("WARN: settings: secret %q not found in %s", sec.ref, ss.secretsPath)
+			}
+			*sec.value = v
+		}
+	}
+	for i, api := range ss.s.CustomAPIs {
+		headers := maps.Clone(api.Headers)
+		for name, v := range headers {
+			if isSecretHeader(name) && v != "" && api.HeaderRefs[name] == "" {
+				moved = append(moved, fmt.Sprintf("header %s of API %s", name, api.Name))
+			}
+		}
+		for name, ref := range api.HeaderRefs {
+			v, ok := ss.secrets[ref]
+			if !ok {
+				log.Printf("WARN: settings: secret %q not found in %s", ref, ss.secretsPath)
+			}
+			if headers == nil {
+				headers = map[string]string{}
+			}
+			headers[name] = v
+		}
+		ss.s.CustomAPIs[i].Headers, ss.s.CustomAPIs[i].HeaderRefs = headers, nil
+	}
+	if len(moved) > 0 {
+		if err := ss.saveLocked(); err != nil {
+			return nil, fmt.Errorf("moving %s to %s: %w", strings.Join(moved, ", "), ss.secretsPath, err)
+		}
+		log.Printf("Moved %s from %s to %s", strings.Join(moved, ", "), path, ss.secretsPath)
+	}
 	if ss.s.Version == 0 {
 		ss.s.Version = 1
 	}
@@ -142,7 +575,72 @@ func loadOrCreateSettings(path string, defaults appSettings) (*settingsStore, er
 	if ss.s.K <= 0 {
 		ss.s.K = defaults.K
 	}
+	if ss.s.HistoryBudget <= 0 {
+		ss.s.HistoryBudget = defaultHistoryBudget
+	}
+	if ss.s.MaxContextChars <= 0 {
+		ss.s.MaxContextChars = defaultMaxContextChars
+	}
+	if ss.s.MaxToolIterations <= 0 {
+		ss.s.MaxToolIterations = defaultMaxToolIterations
+	}
+	if ss.s.MaxToolsPerAnswer <= 0 {
+		ss.s.MaxToolsPerAnswer = defaultMaxToolsPerAnswer
+	}
+	switch ss.s.FollowUpQuery {
+	case "", "off", "concat", "rewrite":
+	default:
+		log.Printf("Unknown followup_query %q in %s, searching questions alone", ss.s.FollowUpQuery, path)
+		ss.s.FollowUpQuery = ""
+	}
+	if ss.s.NanoGoMaxOutput <= 0 {
+		ss.s.NanoGoMaxOutput = defaultNanoGoMaxOutput
+	}
+	if ss.s.NanoGoMaxSteps <= 0 {
+		ss.s.NanoGoMaxSteps = defaultNanoGoMaxSteps
+	}
+	if ss.s.NanoGoMaxMemMB <= 0 {
+		ss.s.NanoGoMaxMemMB = defaultNanoGoMaxMemMB
+	}
+	if ss.s.Confidence.High <= 0 {
+		ss.s.Confidence.High = defaultConfidenceThresholds.High
+	}
+	if ss.s.Confidence.Low <= 0 {
+		ss.s.Confidence.Low = defaultConfidenceThresholds.Low
+	}
+	if ss.s.Confidence.MinHits <= 0 {
+		ss.s.Confidence.MinHits = defaultConfidenceThresholds.MinHits
+	}
+	if ss.s.AnswerCache.Size <= 0 {
+		ss.s.AnswerCache.Size = defaultAnswerCache.Size
+	}
+	if ss.s.AnswerCache.TTLSeconds <= 0 {
+		ss.s.AnswerCache.TTLSeconds = defaultAnswerCache.TTLSeconds
+	}
+	if t := ss.s.SimilarQuestions.Threshold; t <= 0 || t > 1 {
+		ss.s.SimilarQuestions.Threshold = defaultSimilarThreshold
+	}
 	ss.s.BaseURL = normalizeBaseURL(ss.s.BaseURL)
+	for lang, patterns := range ss.s.QueryPatterns {
+		valid := patterns[:0]
+		for _, p := range patterns {
+			if err := checkQueryPattern(p); err != nil {
+				log.Printf("WARN: settings: dropping query pattern %q (%s): %v", p, lang, err)
+				continue
+			}
+			valid = append(valid, p)
+		}
+		ss.s.QueryPatterns[lang] = valid
+	}
+	for _, l := range ss.s.ModelRules.lists() {
+		*l = slices.DeleteFunc(*l, func(p string) bool {
+			_, err := regexp.Compile(p)
+			if err != nil {
+				log.Printf("WARN: settings: dropping model rule %q: %v", p, err)
+			}
+			return err != nil
+		})
+	}
 	if len(ss.s.Personas) == 0 {
 		ss.s.Personas = []persona{{ID: "persona-default", Name: "Standard", Prompt: ""}}
 	}
@@ -150,11 +648,128 @@ func loadOrCreateSettings(path string, defaults appSettings) (*settingsStore, er
 	return ss, nil
 }
 
-// get returns the current settings snapshot in a thread-safe manner.
+// Limits for settings changed through the API.
+const (
+	minChunkSize = 100
+	maxChunkSize = 20000
+	maxK         = 50
+)
+
+// themes are the UI themes a client may select.
+var themes = []string{"dark", "light", "nord", "solarized", "monokai", "dracula"}
+
+// validateSettingsUpdate checks the `changed` fields of settings
+// submitted through the API.
+func validateSettingsUpdate(s appSettings, changed map[string]bool) error {
+	switch {
+	case changed["base_url"] && s.BaseURL == "",
+		changed["chat_model"] && s.ChatModel == "",
+		changed["embed_model"] && s.EmbedModel == "":
+		return errors.New("base_url, chat_model and embed_model must not be empty")
+	case changed["chunk_size"] && (s.ChunkSize < minChunkSize || s.ChunkSize > maxChunkSize):
+		return fmt.Errorf("chunk_size must be between %d and %d", minChunkSize, maxChunkSize)
+	case changed["k"] && (s.K < 1 || s.K > maxK):
+		return fmt.Errorf("k must be between 1 and %d", maxK)
+	case changed["embed_dimensions"] && s.EmbedDimensions < 0:
+		return errors.New("embed_dimensions must not be negative")
+	case changed["lang"] && !wikiLangRe.MatchString(s.Lang):
+		return fmt.Errorf("lang %q is not a Wikipedia language code", s.Lang)
+	case changed["theme"] && !validTheme(s.Theme):
+		return fmt.Errorf("unknown theme %q (one of %s)", s.Theme, strings.Join(themes, ", "))
+	}
+	return nil
+}
+
+// validTheme reports whether `theme` is empty (default) or known.
+func validTheme(theme string) bool {
+	return theme == "" || slices.Contains(themes, theme)
+}
+
+// get returns the current settings snapshot, including environment
+// overrides, in a thread-safe manner.
 func (ss *settingsStore) get() appSettings {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
-	return ss.s
+	s := ss.s
+	for key, p := range ss.pins {
+		_ = applySettingsPin(&s, key, p.Value) // validated by pin
+	}
+	return s
+}
+
+// errSettingsUnchanged lets an update function abort without saving.
+var errSettingsUnchanged = errors.New("settings unchanged")
+
+// update applies `fn` to a copy of the persisted settings (without
+// environment overrides) and saves the result atomically. If fn or the
+// save fails, the settings stay unchanged and the error is returned.
+func (ss *settingsStore) update(fn func(s *appSettings) error) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	next := ss.s.clone()
+	if err := fn(&next); err != nil {
+		return err
+	}
+	prev := ss.s
+	ss.s = next
+	if err := ss.saveLocked(); err != nil {
+		ss.s = prev
+		return err
+	}
+	return nil
+}
+
+// fileSettings returns `s` as written to settings.json: the values of
+// secret custom API headers are replaced by references to secrets.json.
+func (s appSettings) fileSettings() appSettings {
+	apis := slices.Clone(s.CustomAPIs)
+	for i, api := range apis {
+		var headers, refs map[string]string
+		for name, v := range api.Headers {
+			if isSecretHeader(name) && v != "" {
+				if refs == nil {
+					refs = map[string]string{}
+				}
+				refs[name] = apiHeaderSecret(api.ID, name)
+				continue
+			}
+			if headers == nil {
+				headers = map[string]string{}
+			}
+			headers[name] = v
+		}
+		apis[i].Headers, apis[i].HeaderRefs = headers, refs
+	}
+	s.CustomAPIs = apis
+	return s
+}
+
+// unusedID returns "<prefix>-<time>" for which `taken` is false. IDs are
+// based on the current time, counted up where the clock is too coarse to
+// tell two calls apart.
+func unusedID(prefix string, taken func(id string) bool) string {
+	n := time.Now().UnixNano()
+	for {
+		if id := fmt.Sprintf("%s-%d", prefix, n); !taken(id) {
+			return id
+		}
+		n++
+	}
+}
+
+// clone returns a copy of `s` that shares no slices or maps with it.
+func (s appSettings) clone() appSettings {
+	s.CustomAPIs = slices.Clone(s.CustomAPIs)
+	s.Personas = slices.Clone(s.Personas)
+	s.AllowedHosts = slices.Clone(s.AllowedHosts)
+	s.DiscoverCandidates = slices.Clone(s.DiscoverCandidates)
+	for _, l := range s.ModelRules.lists() {
+		*l = slices.Clone(*l)
+	}
+	s.ToolPolicy = maps.Clone(s.ToolPolicy)
+	s.QueryPatterns = maps.Clone(s.QueryPatterns)
+	s.Calibration = maps.Clone(s.Calibration)
+	return s
 }
 
 // save persists the current settings to disk using an atomic write.
@@ -164,9 +779,80 @@ func (ss *settingsStore) save() error {
 	return ss.saveLocked()
 }
 
+// loadSecrets reads secrets.json if it exists.
+func (ss *settingsStore) loadSecrets() error {
+	ss.secrets = map[string]string{}
+	data, err := os.ReadFile(ss.secretsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &ss.secrets); err != nil {
+		return fmt.Errorf("%s: %w", ss.secretsPath, err)
+	}
+	return nil
+}
+
+// saveSecretsLocked stores the API key, the webhook secret and the secret
+// custom API headers in secrets.json (mode 0600) and sets the references
+// to the first two; fileSettings refers to the headers. The file is only
+// rewritten on changes.
+func (ss *settingsStore) saveSecretsLocked() error {
+	next := maps.Clone(ss.secrets)
+	if next == nil {
+		next = map[string]string{}
+	}
+	maps.DeleteFunc(next, func(name, _ string) bool { return strings.HasPrefix(name, secretAPIHeaderPrefix) })
+	for _, api := range ss.s.CustomAPIs {
+		for name, v := range api.Headers {
+			if isSecretHeader(name) && v != "" {
+				next[apiHeaderSecret(api.ID, name)] = v
+			}
+		}
+	}
+	for _, sec := range []struct {
+		name  string
+		value string
+		ref   *string
+	}{
+		{secretLLMAPIKey, ss.s.APIKey, &ss.s.APIKeyRef},
+		{secretWebhookSecret, ss.s.Webhook.Secret, &ss.s.Webhook.SecretRef},
+	} {
+		if sec.value != "" {
+			*sec.ref = sec.name
+			next[sec.name] = sec.value
+		} else {
+			*sec.ref = ""
+			delete(next, sec.name)
+		}
+	}
+	if maps.Equal(next, ss.secrets) {
+		return nil
+	}
+	b, err := json.MarshalIndent(next, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal secrets: %w", err)
+	}
+	tmp := ss.secretsPath + ".tmp"
+	_ = os.Remove(tmp) // WriteFile only applies the mode to new files
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ss.secretsPath); err != nil {
+		return err
+	}
+	ss.secrets = next
+	return nil
+}
+
 // saveLocked writes settings to disk and must be called with `ss.mu` held.
 func (ss *settingsStore) saveLocked() error {
-	b, err := json.MarshalIndent(ss.s, "", "  ")
+	if err := ss.saveSecretsLocked(); err != nil {
+		return fmt.Errorf("failed to save secrets: %w", err)
+	}
+	b, err := json.MarshalIndent(ss.s.fileSettings(), "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal settings: %w", err)
 	}
@@ -179,3785 +865,15220 @@ func (ss *settingsStore) saveLocked() error {
 }
 
 // ─────────────────────────────────────────────────────────────────────────────
-// Wikipedia fetcher
+// Outbound HTTP
 // ─────────────────────────────────────────────────────────────────────────────
 
-func fetchWikipedia(article, lang string) (string, error) {
-	u := fmt.Sprintf(
-		"https://%s.wikipedia.org/w/api.php?action=query&prop=extracts&explaintext=1&titles=%s&format=json",
-		lang, url.QueryEscape(article),
-	)
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+// Response size limits for outbound fetches.
+const (
+	maxPageBytes = 5 << 20  // HTML pages and article text
+	maxJSONBytes = 2 << 20  // JSON APIs
+	maxLLMBytes  = 64 << 20 // model lists and embedding batches
+	maxRedirects = 5
+)
+
+// outboundProxy is the proxy configuration shared by all outbound clients.
+var outboundProxy struct {
+	mu     sync.RWMutex
+	source string // "settings", "environment" or "" (direct)
+	cfg    httpproxy.Config
+	fn     func(*url.URL) (*url.URL, error)
+}
+
+// setOutboundProxy configures the proxy for outbound requests. An explicit
+// `proxyURL` overrides HTTP_PROXY/HTTPS_PROXY; NO_PROXY still applies and
+// localhost is never proxied.
+func setOutboundProxy(proxyURL string) error {
+	cfg := httpproxy.FromEnvironment()
+	source := ""
+	if cfg.HTTPProxy != "" || cfg.HTTPSProxy != "" {
+		source = "environment"
+	}
+	if proxyURL = strings.TrimSpace(proxyURL); proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy_url %q", proxyURL)
+		}
+		cfg.HTTPProxy, cfg.HTTPSProxy, source = proxyURL, proxyURL, "settings"
+	}
+	outboundProxy.mu.Lock()
+	outboundProxy.source, outboundProxy.cfg, outboundProxy.fn = source, *cfg, cfg.ProxyFunc()
+	outboundProxy.mu.Unlock()
+	return nil
+}
+
+// proxyForRequest is the Proxy function of sharedTransport.
+func proxyForRequest(req *http.Request) (*url.URL, error) {
+	outboundProxy.mu.RLock()
+	fn := outboundProxy.fn
+	outboundProxy.mu.RUnlock()
+	if fn == nil {
+		return http.ProxyFromEnvironment(req)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("Wikipedia API returned HTTP %d for %q", resp.StatusCode, article)
+	return fn(req.URL)
+}
+
+// proxyStatus describes the proxy in effect and whether requests to
+// `target` use it.
+func proxyStatus(target string) map[string]any {
+	outboundProxy.mu.RLock()
+	source, cfg := outboundProxy.source, outboundProxy.cfg
+	outboundProxy.mu.RUnlock()
+	st := map[string]any{"source": source, "active": source != ""}
+	if source == "" {
+		return st
+	}
+	if u, err := url.Parse(cfg.HTTPSProxy); err == nil && cfg.HTTPSProxy != "" {
+		st["url"] = u.Redacted()
+	} else if u, err := url.Parse(cfg.HTTPProxy); err == nil {
+		st["url"] = u.Redacted()
+	}
+	if req, err := http.NewRequest("GET", target, nil); err == nil {
+		p, _ := proxyForRequest(req)
+		st["target"] = target
+		st["target_proxied"] = p != nil
+	}
+	return st
+}
+
+// isProxyHost reports whether `host` is a configured proxy; the SSRF
+// guard lets connections to it through.
+func isProxyHost(host string) bool {
+	outboundProxy.mu.RLock()
+	cfg := outboundProxy.cfg
+	outboundProxy.mu.RUnlock()
+	for _, p := range []string{cfg.HTTPProxy, cfg.HTTPSProxy} {
+		if u, err := url.Parse(p); err == nil && p != "" && strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
 	}
-	ct := resp.Header.Get("Content-Type")
-	if !strings.Contains(ct, "json") {
-		return "", fmt.Errorf("Wikipedia API returned unexpected content-type %q for %q", ct, article)
+	return false
+}
+
+// sharedTransport is used by all outbound clients so they share the
+// connection pool and proxy configuration.
+var sharedTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxyForRequest
+	return t
+}()
+
+// newHTTPClient returns a client with the given timeout that gives up
+// after maxRedirects redirects.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: statsTransport{sharedTransport},
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
 	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+}
+
+// limitedReader fails with an error once more than `limit` bytes were
+// read, instead of silently truncating like io.LimitReader.
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n > l.limit {
+		return 0, fmt.Errorf("response exceeds %d bytes", l.limit)
 	}
-	var result struct {
-		Query struct {
-			Pages map[string]struct {
-				Title   string `json:"title"`
-				Extract string `json:"extract"`
-			} `json:"pages"`
-		} `json:"query"`
+	if rem := l.limit + 1 - l.n; int64(len(p)) > rem {
+		p = p[:rem]
 	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", fmt.Errorf("Wikipedia JSON parse error for %q: %w", article, err)
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n, fmt.Errorf("response exceeds %d bytes", l.limit)
 	}
-	for _, p := range result.Query.Pages {
-		if p.Extract == "" {
-			return "", fmt.Errorf("Wikipedia article %q has no content", article)
+	return n, err
+}
+
+// limitBody wraps `r` so that reading past `limit` bytes is an error.
+func limitBody(r io.Reader, limit int64) io.Reader {
+	return &limitedReader{r: r, limit: limit}
+}
+
+// readLimited reads all of `r`, failing if it is larger than `limit`.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	return io.ReadAll(limitBody(r, limit))
+}
+
+// errBlockedHost is returned when an outbound request targets a private
+// or internal address that is not on the allowed_hosts list.
+type errBlockedHost struct {
+	host string
+	ip   net.IP
+}
+
+func (e *errBlockedHost) Error() string {
+	return fmt.Sprintf("blocked request to %s (%s): private or internal address; add the host or network to \"allowed_hosts\" in settings.json to allow it", e.host, e.ip)
+}
+
+// hostAllowed reports whether `host` or `ip` matches an allowed_hosts
+// entry. Entries are hostnames (".example.com" also matches subdomains),
+// IP addresses or CIDR networks.
+func hostAllowed(host string, ip net.IP, allow []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, a := range allow {
+		a = strings.ToLower(strings.TrimSpace(a))
+		switch {
+		case a == "":
+		case strings.Contains(a, "/"):
+			if _, n, err := net.ParseCIDR(a); err == nil && ip != nil && n.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(a, "."):
+			if strings.HasSuffix(host, a) || host == a[1:] {
+				return true
+			}
+		default:
+			if host == a || (ip != nil && ip.Equal(net.ParseIP(a))) {
+				return true
+			}
 		}
-		return p.Extract, nil
 	}
-	return "", fmt.Errorf("no pages found for %q", article)
+	return false
 }
 
-// searchWikipedia performs a MediaWiki search and returns a slice of simple results
-func searchWikipedia(query, lang string) ([]map[string]string, error) {
-	if lang == "" {
-		lang = "de"
+// reservedNets are special-purpose ranges the net.IP predicates miss:
+// "this network", carrier-grade NAT, IETF protocol assignments,
+// benchmarking and the reserved class E.
+var reservedNets = func() []*net.IPNet {
+	var out []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		out = append(out, n)
 	}
-	apiURL := fmt.Sprintf("https://%s.wikipedia.org/w/api.php?action=query&list=search&srsearch=%s&utf8=&format=json&srlimit=10", lang, url.QueryEscape(query))
-	req, err := http.NewRequest("GET", apiURL, nil)
-	if err != nil {
-		return nil, err
+	return out
+}()
+
+// isInternalIP reports whether `ip` is loopback, private, link-local,
+// unique-local or otherwise not publicly routable.
+func isInternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return true
 	}
-	req.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return true
+		}
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("wikipedia search returned status %d", resp.StatusCode)
+	return false
+}
+
+// checkOutboundHost resolves `host` and fails with errBlockedHost if any
+// of its addresses is internal and not allowed.
+func checkOutboundHost(ctx context.Context, host string, allow []string) ([]net.IP, error) {
+	if hostAllowed(host, nil, allow) {
+		return nil, nil
 	}
-	var root struct {
-		Query struct {
-			Search []struct {
-				Title   string `json:"title"`
-				Snippet string `json:"snippet"`
-				PageID  int    `json:"pageid"`
-			} `json:"search"`
-		} `json:"query"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&root); err != nil {
-		return nil, err
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
 	}
-	out := make([]map[string]string, 0, len(root.Query.Search))
-	for _, s := range root.Query.Search {
-		out = append(out, map[string]string{"title": s.Title, "snippet": s.Snippet, "pageid": fmt.Sprintf("%d", s.PageID)})
+	for _, ip := range ips {
+		if isInternalIP(ip) && !hostAllowed(host, ip, allow) {
+			return nil, &errBlockedHost{host: host, ip: ip}
+		}
 	}
-	return out, nil
+	return ips, nil
 }
 
-// ─────────────────────────────────────────────────────────────────────────────
-// Generic web scraper
-// ─────────────────────────────────────────────────────────────────────────────
+// guardTransport refuses requests to internal hosts. It checks the URL
+// of every hop, so redirects are re-checked, and dials only the addresses
+// it validated to avoid DNS rebinding between check and connect.
+type guardTransport struct {
+	allow []string
+	base  *http.Transport
+}
 
-var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
-var multiSpaceRe = regexp.MustCompile(`\s{3,}`)
+func (g *guardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", req.URL.Scheme)
+	}
+	if _, err := checkOutboundHost(req.Context(), req.URL.Hostname(), g.allow); err != nil {
+		// Behind a proxy the local resolver may not know public names;
+		// only a positive internal match blocks then.
+		var blocked *errBlockedHost
+		if p, _ := proxyForRequest(req); p == nil || errors.As(err, &blocked) {
+			return nil, err
+		}
+	}
+	return g.base.RoundTrip(req)
+}
 
-// fetchURL retrieves and heuristically strips HTML from a URL,
-// returning plain text suitable for chunking and embedding.
-func fetchURL(rawURL string) (string, error) {
-	req, err := http.NewRequest("GET", rawURL, nil)
+func (g *guardTransport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	req.Header.Set("User-Agent", "tinyRAG/1.1")
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	var d net.Dialer
+	if isProxyHost(host) {
+		// The target URL was checked in RoundTrip; the proxy itself may
+		// well live in a private network.
+		return d.DialContext(ctx, network, addr)
+	}
+	ips, err := checkOutboundHost(ctx, host, g.allow)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("HTTP %d for %s", resp.StatusCode, rawURL)
+	if len(ips) == 0 { // allowlisted by name
+		return d.DialContext(ctx, network, addr)
 	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	var lastErr error
+	for _, ip := range ips {
+		c, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		lastErr = err
 	}
-	text := string(body)
+	return nil, lastErr
+}
 
-	// Strip script/style and some layout blocks
-	for _, tag := range []string{"script", "style", "nav", "footer", "header"} {
-		re := regexp.MustCompile(`(?is)<` + tag + `[^>]*>.*?</` + tag + `>`)
-		text = re.ReplaceAllString(text, " ")
+// newGuardedClient is newHTTPClient for user supplied URLs: requests to
+// private, loopback and link-local addresses fail unless the host is
+// listed in `allow`.
+func newGuardedClient(timeout time.Duration, allow []string) *http.Client {
+	c := newHTTPClient(timeout)
+	g := &guardTransport{allow: allow}
+	g.base = sharedTransport.Clone()
+	g.base.DialContext = g.dial
+	c.Transport = statsTransport{g}
+	return c
+}
+
+// ── Outbound request stats ─────────────────────────────────────────
+
+// Outbound request and tool stats keep the latencies of the last
+// statsLatencyWindow calls per host or tool, and the last maxNetFailures
+// failed requests with the start of their response body.
+const (
+	statsLatencyWindow  = 500
+	maxNetFailures      = 50
+	netFailureBodyBytes = 512
+)
+
+// callStats counts the calls to one host or tool by status ("200",
+// "error", "canceled" for requests; "ok", "error" for tools).
+type callStats struct {
+	Calls   int            `json:"calls"`
+	Errors  int            `json:"errors"`
+	Status  map[string]int `json:"status"`
+	TotalMs float64        `json:"total_ms"`
+	P50Ms   float64        `json:"p50_ms"`
+	P90Ms   float64        `json:"p90_ms"`
+	P99Ms   float64        `json:"p99_ms"`
+	// latencies is a ring of the last statsLatencyWindow durations in ms.
+	latencies []float64
+	next      int
+}
+
+func (c *callStats) record(status string, failed bool, d time.Duration) {
+	ms := float64(d.Microseconds()) / 1000
+	c.Calls++
+	if failed {
+		c.Errors++
 	}
-	text = htmlTagRe.ReplaceAllString(text, " ")
-	text = html.UnescapeString(text)
-	text = multiSpaceRe.ReplaceAllString(text, "\n")
-	text = strings.TrimSpace(text)
+	if c.Status == nil {
+		c.Status = map[string]int{}
+	}
+	c.Status[status]++
+	c.TotalMs += ms
+	if len(c.latencies) < statsLatencyWindow {
+		c.latencies = append(c.latencies, ms)
+		return
+	}
+	c.latencies[c.next] = ms
+	c.next = (c.next + 1) % statsLatencyWindow
+}
 
-	if len(text) < 50 {
-		return "", fmt.Errorf("page too short after stripping HTML (%d chars)", len(text))
+// snapshot returns a copy of `c` with the latency percentiles filled in.
+func (c *callStats) snapshot() callStats {
+	out := callStats{Calls: c.Calls, Errors: c.Errors, Status: maps.Clone(c.Status), TotalMs: math.Round(c.TotalMs*1000) / 1000}
+	if len(c.latencies) > 0 {
+		sorted := slices.Sorted(slices.Values(c.latencies))
+		out.P50Ms, out.P90Ms, out.P99Ms = percentile(sorted, 0.50), percentile(sorted, 0.90), percentile(sorted, 0.99)
 	}
-	return text, nil
+	return out
 }
 
-// ─────────────────────────────────────────────────────────────────────────────
-// DuckDuckGo Instant Answer (fallback to HTML snippets)
-// ─────────────────────────────────────────────────────────────────────────────
+// netFailure is an outbound request that failed or got a status of 400
+// or more. URL is without query, which may hold credentials.
+type netFailure struct {
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Status     int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Body       string    `json:"body,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
 
-// fetchDuckDuckGo queries DuckDuckGo Instant Answer API and falls
-// back to scraping HTML snippets when needed, returning markdown-ish text.
-func fetchDuckDuckGo(query string) (string, error) {
-	u := fmt.Sprintf(
-		"https://api.duckduckgo.com/?q=%s&format=json&no_html=1&skip_disambig=1",
-		url.QueryEscape(query),
-	)
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+// callRecorder collects the stats of outbound requests by host and of
+// tool executions by tool name.
+type callRecorder struct {
+	mu       sync.Mutex
+	hosts    map[string]*callStats
+	tools    map[string]*callStats
+	failures []netFailure
+	next     int
+}
+
+var netStats = &callRecorder{hosts: map[string]*callStats{}, tools: map[string]*callStats{}}
+
+// statsFor returns the entry of `name` in `m`, creating it.
+func statsFor(m map[string]*callStats, name string) *callStats {
+	st, ok := m[name]
+	if !ok {
+		st = &callStats{}
+		m[name] = st
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	return st
+}
+
+// recordRequest adds an outbound request; `f` is non-nil for failures.
+func (c *callRecorder) recordRequest(host, status string, failed bool, d time.Duration, f *netFailure) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	statsFor(c.hosts, host).record(status, failed, d)
+	if f == nil {
+		return
 	}
-	var result struct {
-		Abstract       string `json:"Abstract"`
-		AbstractSource string `json:"AbstractSource"`
-		AbstractURL    string `json:"AbstractURL"`
-		Heading        string `json:"Heading"`
-		Answer         string `json:"Answer"`
-		RelatedTopics  []struct {
-			Text     string `json:"Text"`
-			FirstURL string `json:"FirstURL"`
-		} `json:"RelatedTopics"`
+	if len(c.failures) < maxNetFailures {
+		c.failures = append(c.failures, *f)
+		return
 	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
+	c.failures[c.next] = *f
+	c.next = (c.next + 1) % maxNetFailures
+}
+
+// recordTool adds a tool execution.
+func (c *callRecorder) recordTool(tool string, err error, d time.Duration) {
+	status := "ok"
+	if err != nil {
+		status = "error"
 	}
-	var parts []string
-	if result.Heading != "" {
-		parts = append(parts, "# "+result.Heading)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	statsFor(c.tools, tool).record(status, err != nil, d)
+}
+
+// netStatsReport is the response of GET /api/net-stats.
+type netStatsReport struct {
+	Hosts map[string]callStats `json:"hosts"`
+	Tools map[string]callStats `json:"tools"`
+	// Failures are the most recent failed requests, newest first.
+	Failures []netFailure `json:"failures"`
+}
+
+func (c *callRecorder) report() netStatsReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := netStatsReport{Hosts: map[string]callStats{}, Tools: map[string]callStats{}, Failures: []netFailure{}}
+	for h, st := range c.hosts {
+		r.Hosts[h] = st.snapshot()
 	}
-	if result.Abstract != "" {
-		parts = append(parts, result.Abstract)
-		if result.AbstractSource != "" {
-			parts = append(parts, fmt.Sprintf("(Quelle: %s — %s)", result.AbstractSource, result.AbstractURL))
-		}
+	for t, st := range c.tools {
+		r.Tools[t] = st.snapshot()
 	}
-	if result.Answer != "" {
-		parts = append(parts, "Antwort: "+result.Answer)
+	for i := 1; i <= len(c.failures); i++ {
+		r.Failures = append(r.Failures, c.failures[(c.next-i+len(c.failures))%len(c.failures)])
 	}
-	for i, rt := range result.RelatedTopics {
-		if i >= 5 {
-			break
+	return r
+}
+
+// writeMetrics writes `r` in the Prometheus text format.
+func (r netStatsReport) writeMetrics(w io.Writer) {
+	summary := func(name, help, label string, m map[string]callStats) {
+		fmt.Fprintf(w, "# HELP %s_total %s by status.\n# TYPE %s_total counter\n", name, help, name)
+		for _, key := range slices.Sorted(maps.Keys(m)) {
+			for _, status := range slices.Sorted(maps.Keys(m[key].Status)) {
+				fmt.Fprintf(w, "%s_total{%s=%s,status=%s} %d\n", name, label, strconv.Quote(key), strconv.Quote(status), m[key].Status[status])
+			}
 		}
-		if rt.Text != "" {
-			parts = append(parts, "- "+rt.Text)
+		fmt.Fprintf(w, "# HELP %s_duration_ms %s duration in milliseconds.\n# TYPE %s_duration_ms summary\n", name, help, name)
+		for _, key := range slices.Sorted(maps.Keys(m)) {
+			st := m[key]
+			for _, q := range []struct {
+				q string
+				v float64
+			}{{"0.5", st.P50Ms}, {"0.9", st.P90Ms}, {"0.99", st.P99Ms}} {
+				fmt.Fprintf(w, "%s_duration_ms{%s=%s,quantile=%q} %g\n", name, label, strconv.Quote(key), q.q, q.v)
+			}
+			fmt.Fprintf(w, "%s_duration_ms_sum{%s=%s} %g\n", name, label, strconv.Quote(key), st.TotalMs)
+			fmt.Fprintf(w, "%s_duration_ms_count{%s=%s} %d\n", name, label, strconv.Quote(key), st.Calls)
 		}
 	}
-	text := strings.Join(parts, "\n\n")
-	if strings.TrimSpace(text) != "" {
-		return text, nil
+	summary("tinyrag_outbound_requests", "Outbound HTTP requests", "host", r.Hosts)
+	summary("tinyrag_tool_calls", "Tool executions", "tool", r.Tools)
+}
+
+// statsTransport records every request in netStats. The duration is the
+// time until the response headers arrived.
+type statsTransport struct {
+	base http.RoundTripper
+}
+
+func (t statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	d := time.Since(start)
+	host := req.URL.Host
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		// Aborted by the caller, which says nothing about the host.
+		netStats.recordRequest(host, "canceled", false, d, nil)
+	case err != nil:
+		netStats.recordRequest(host, "error", true, d, newNetFailure(req, start, d, 0, err.Error(), ""))
+	case resp.StatusCode >= 400:
+		// Keep the start of the body and hand the caller all of it.
+		head, _ := io.ReadAll(io.LimitReader(resp.Body, netFailureBodyBytes))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+		netStats.recordRequest(host, strconv.Itoa(resp.StatusCode), true, d, newNetFailure(req, start, d, resp.StatusCode, "", string(head)))
+	default:
+		netStats.recordRequest(host, strconv.Itoa(resp.StatusCode), false, d, nil)
 	}
+	return resp, err
+}
 
-	// Fallback: scrape DuckDuckGo HTML search results
-	htmlURL := fmt.Sprintf("https://html.duckduckgo.com/html/?q=%s", url.QueryEscape(query))
-	htmlReq, err := http.NewRequest("GET", htmlURL, nil)
-	if err != nil {
-		return "", fmt.Errorf("DuckDuckGo returned no results for %q", query)
+func newNetFailure(req *http.Request, start time.Time, d time.Duration, status int, errText, body string) *netFailure {
+	u := *req.URL
+	u.RawQuery, u.Fragment, u.User = "", "", nil
+	return &netFailure{
+		Time:       start,
+		Host:       req.URL.Host,
+		Method:     req.Method,
+		URL:        u.String(),
+		Status:     status,
+		Error:      errText,
+		Body:       strings.ToValidUTF8(body, "�"),
+		DurationMs: d.Milliseconds(),
 	}
-	htmlReq.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
-	htmlResp, err := client.Do(htmlReq)
+}
+
+// ── Webhook notifications ──────────────────────────────────────────
+
+// Webhook delivery: each attempt may take webhookTimeout, a failed one
+// is retried once after webhookRetryDelay.
+const (
+	webhookTimeout    = 10 * time.Second
+	webhookRetryDelay = 5 * time.Second
+)
+
+// webhookEvent is the payload POSTed to the webhook. Event is the job
+// kind followed by ".completed" or ".failed".
+type webhookEvent struct {
+	Event   string `json:"event"`
+	JobID   string `json:"job_id"`
+	Summary string `json:"summary"`
+	Error   string `json:"error,omitempty"`
+}
+
+// jobEvent returns the webhook event for job `kind` ending with `err`.
+func jobEvent(kind, jobID, summary string, err error) webhookEvent {
+	ev := webhookEvent{Event: kind + ".completed", JobID: jobID, Summary: summary}
 	if err != nil {
-		return "", fmt.Errorf("DuckDuckGo HTML fallback failed: %w", err)
+		ev.Event, ev.Error = kind+".failed", err.Error()
+	}
+	return ev
+}
+
+// notifyWebhook delivers `ev` to the webhook configured in `s` in the
+// background and logs the outcome; it never blocks or fails the job.
+func notifyWebhook(s appSettings, ev webhookEvent) {
+	wh := s.Webhook
+	if wh.URL == "" {
+		return
 	}
-	defer htmlResp.Body.Close()
-	htmlBody, err := io.ReadAll(htmlResp.Body)
+	body, err := json.Marshal(ev)
 	if err != nil {
-		return "", err
+		return
 	}
-	snippetRe := regexp.MustCompile(`(?s)<a[^>]+class="result__snippet"[^>]*>(.*?)</a>`)
-	matches := snippetRe.FindAllStringSubmatch(string(htmlBody), 10)
-	var snippets []string
-	for _, m := range matches {
-		s := htmlTagRe.ReplaceAllString(m[1], "")
-		s = html.UnescapeString(strings.TrimSpace(s))
-		if s != "" {
-			snippets = append(snippets, "- "+s)
+	go func() {
+		client := newGuardedClient(webhookTimeout, s.AllowedHosts)
+		for attempt := 1; ; attempt++ {
+			err := postWebhook(client, wh, body)
+			if err == nil {
+				log.Printf("Webhook %s (%s) delivered", ev.Event, ev.JobID)
+				return
+			}
+			if attempt == 2 {
+				log.Printf("WARN: webhook %s (%s) not delivered: %v", ev.Event, ev.JobID, err)
+				return
+			}
+			log.Printf("WARN: webhook %s (%s) failed, retrying: %v", ev.Event, ev.JobID, err)
+			time.Sleep(webhookRetryDelay)
 		}
-	}
-	if len(snippets) == 0 {
-		return "", fmt.Errorf("DuckDuckGo returned no results for %q", query)
-	}
-	return fmt.Sprintf("DuckDuckGo-Suchergebnisse für \"%s\":\n\n%s", query, strings.Join(snippets, "\n")), nil
+	}()
 }
 
-// ─────────────────────────────────────────────────────────────────────────────
-// Wiktionary / Dictionary
-// ─────────────────────────────────────────────────────────────────────────────
-
-// fetchWiktionary fetches a plain-text extract for `word` from the
-// specified Wiktionary language and returns a formatted string.
-func fetchWiktionary(word, lang string) (string, error) {
-	u := fmt.Sprintf(
-		"https://%s.wiktionary.org/w/api.php?action=query&prop=extracts&explaintext=1&titles=%s&format=json",
-		lang, url.QueryEscape(word),
-	)
-	req, err := http.NewRequest("GET", u, nil)
+// postWebhook sends `body` to wh.URL. With a secret, the hex HMAC-SHA256
+// of the body is sent as "X-TinyRAG-Signature: sha256=<hex>".
+func postWebhook(client *http.Client, wh webhookSettings, body []byte) error {
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
 	if err != nil {
-		return "", err
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", fetchUserAgent)
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(body)
+		req.Header.Set("X-TinyRAG-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
 	}
-	req.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
-	client := &http.Client{Timeout: 15 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	var result struct {
-		Query struct {
-			Pages map[string]struct {
-				Title   string `json:"title"`
-				Extract string `json:"extract"`
-			} `json:"pages"`
-		} `json:"query"`
-	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
-	}
-	for _, p := range result.Query.Pages {
-		if p.Extract == "" {
-			return "", fmt.Errorf("no Wiktionary entry found for %q", word)
-		}
-		return fmt.Sprintf("Wiktionary: %s\n\n%s", p.Title, p.Extract), nil
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
 	}
-	return "", fmt.Errorf("no Wiktionary entry found for %q", word)
+	return nil
 }
 
 // ─────────────────────────────────────────────────────────────────────────────
-// Text chunker
+// Fetch coordinator (robots.txt, per-host politeness, response cache)
 // ─────────────────────────────────────────────────────────────────────────────
 
-// chunkText splits `text` into paragraphs and joins them into chunks
-// of at most `maxLen` characters for embedding and storage.
-func chunkText(text string, maxLen int) []string {
-	paragraphs := strings.Split(text, "\n")
-	var chunks []string
-	var buf strings.Builder
-	for _, p := range paragraphs {
-		p = strings.TrimSpace(p)
-		if p == "" {
-			continue
-		}
-		if buf.Len()+len(p)+1 > maxLen && buf.Len() > 0 {
-			chunks = append(chunks, buf.String())
-			buf.Reset()
-		}
-		if buf.Len() > 0 {
-			buf.WriteByte('\n')
-		}
-		buf.WriteString(p)
-	}
-	if buf.Len() > 0 {
-		chunks = append(chunks, buf.String())
-	}
-	return chunks
+// fetchUserAgent identifies tinyRAG to web servers; robotsAgent is the
+// token matched against robots.txt User-agent lines.
+const (
+	fetchUserAgent = "tinyRAG/1.1 (+https://github.com/SimonWaldherr/tinyRAG)"
+	robotsAgent    = "tinyrag"
+	robotsTTL      = 24 * time.Hour
+)
+
+// fetchCoordinator is used for page fetches (add-url and friends). It
+// allows one request per host at a time with a minimum delay between
+// them, honors robots.txt and keeps a disk cache so refetches can be
+// answered with conditional requests.
+type fetchCoordinator struct {
+	mu           sync.Mutex
+	hosts        map[string]*hostState
+	cacheDir     string // empty disables the disk cache
+	minDelay     time.Duration
+	ignoreRobots map[string]bool
+
+	fetched, notModified, robotsBlocked int64 // guarded by mu
 }
 
-// ─────────────────────────────────────────────────────────────────────────────
-// OpenAI-compatible client (LM Studio, Ollama, …)
-// ─────────────────────────────────────────────────────────────────────────────
+// hostState holds the per-host slot, last request time and robots rules.
+type hostState struct {
+	slot         chan struct{}
+	last         time.Time
+	robots       *robotsRules
+	robotsLoaded time.Time
+}
 
-// lmClient is a small OpenAI-compatible client used for embeddings
-// and chat completions against local or remote LLM endpoints.
-type lmClient struct {
-	base       string
-	embedModel string
-	chatModel  string
-	http       *http.Client
+// fetchCacheEntry is the on-disk form of a cached response.
+type fetchCacheEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+	Body         []byte    `json:"body"`
 }
 
-// newLMClient constructs an `lmClient` configured for the given
-// base URL and model names.
-func newLMClient(base, embedModel, chatModel string) *lmClient {
-	return &lmClient{
-		base:       normalizeBaseURL(base),
-		embedModel: embedModel,
-		chatModel:  chatModel,
-		http:       &http.Client{Timeout: 120 * time.Second},
+// fetcher is the process-wide coordinator, configured from flags in main.
+var fetcher = newFetchCoordinator("", time.Second, nil)
+
+// newFetchCoordinator creates a coordinator caching in `cacheDir` (empty =
+// no cache) and waiting `minDelay` between requests to the same host.
+// Hosts in `ignoreRobots` skip robots.txt checks.
+func newFetchCoordinator(cacheDir string, minDelay time.Duration, ignoreRobots []string) *fetchCoordinator {
+	f := &fetchCoordinator{
+		hosts:        map[string]*hostState{},
+		cacheDir:     cacheDir,
+		minDelay:     minDelay,
+		ignoreRobots: map[string]bool{},
+	}
+	for _, h := range ignoreRobots {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			f.ignoreRobots[h] = true
+		}
 	}
+	return f
 }
 
-// ping checks the LLM endpoint for reachability by requesting
-// the list of available models.
-func (c *lmClient) ping() error {
-	resp, err := c.http.Get(c.base + "/v1/models")
-	if err != nil {
-		return err
-	}
-	resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("LLM endpoint returned %d", resp.StatusCode)
+func (f *fetchCoordinator) host(key string) *hostState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, ok := f.hosts[key]
+	if !ok {
+		h = &hostState{slot: make(chan struct{}, 1)}
+		f.hosts[key] = h
 	}
-	return nil
+	return h
 }
 
-// modelsResp is a helper for parsing the /v1/models response.
-type modelsResp struct {
-	Data []struct {
-		ID string `json:"id"`
-	} `json:"data"`
+func (f *fetchCoordinator) count(n *int64) {
+	f.mu.Lock()
+	*n++
+	f.mu.Unlock()
 }
 
-// listModels queries the LLM endpoint for available model IDs,
-// optionally overriding the client's base URL.
-func (c *lmClient) listModels(baseOverride string) ([]string, error) {
-	base := c.base
-	if strings.TrimSpace(baseOverride) != "" {
-		base = normalizeBaseURL(baseOverride)
-	}
-	req, err := http.NewRequest("GET", base+"/v1/models", nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create models request: %w", err)
-	}
-	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+// get fetches `rawURL` with `client` and returns at most `limit` bytes of
+// the body. Non-200 responses are errors; 304 answers are served from
+// the cache.
+func (f *fetchCoordinator) get(ctx context.Context, client *http.Client, rawURL string, limit int64) ([]byte, error) {
+	u, err := url.Parse(rawURL)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	raw, readErr := io.ReadAll(resp.Body)
-	if readErr != nil {
-		return nil, fmt.Errorf("failed to read models response: %w", readErr)
-	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("models HTTP %d: %s", resp.StatusCode, string(raw))
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
 	}
-	var mr modelsResp
-	if err := json.Unmarshal(raw, &mr); err != nil {
-		return nil, err
+	h := f.host(strings.ToLower(u.Host))
+
+	select {
+	case h.slot <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	var out []string
-	for _, d := range mr.Data {
-		if d.ID != "" {
-			out = append(out, d.ID)
+	defer func() { <-h.slot }()
+
+	if !f.ignoreRobots[strings.ToLower(u.Hostname())] {
+		if h.robots == nil || time.Since(h.robotsLoaded) > robotsTTL {
+			robotsURL := u.Scheme + "://" + u.Host + "/robots.txt"
+			if err := f.wait(ctx, h); err != nil {
+				return nil, err
+			}
+			h.robots = fetchRobots(ctx, client, robotsURL)
+			h.robotsLoaded = time.Now()
+			h.last = time.Now()
+		}
+		if !h.robots.allowed(u.EscapedPath()) {
+			f.count(&f.robotsBlocked)
+			return nil, fmt.Errorf("robots.txt of %s disallows %s (start with -ignore-robots %s for hosts you own)", u.Host, u.EscapedPath(), u.Hostname())
 		}
 	}
-	sort.Strings(out)
-	return out, nil
-}
 
-// embReq represents an embeddings request payload.
-type embReq struct {
-	Model string   `json:"model"`
-	Input []string `json:"input"`
-}
-
-// embResp represents an embeddings response payload.
-type embResp struct {
-	Data []struct {
-		Embedding []float64 `json:"embedding"`
-	} `json:"data"`
-}
+	if err := f.wait(ctx, h); err != nil {
+		return nil, err
+	}
+	defer func() { h.last = time.Now() }()
 
-// embed sends multiple `texts` to the embedding endpoint and returns
-// their vector embeddings.
-func (c *lmClient) embed(texts []string) ([][]float64, error) {
-	body, err := json.Marshal(embReq{Model: c.embedModel, Input: texts})
+	cached := f.loadCache(rawURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal embed request: %w", err)
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fetchUserAgent)
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
 	}
-	resp, err := c.http.Post(c.base+"/v1/embeddings", "application/json", bytes.NewReader(body))
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	raw, readErr := io.ReadAll(resp.Body)
-	if readErr != nil {
-		return nil, fmt.Errorf("failed to read embeddings response: %w", readErr)
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		f.count(&f.notModified)
+		return cached.Body, nil
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("embed %d: %s", resp.StatusCode, string(raw))
+		return nil, fmt.Errorf("HTTP %d for %s", resp.StatusCode, rawURL)
 	}
-	var er embResp
-	if err := json.Unmarshal(raw, &er); err != nil {
-		return nil, err
+	body, err := readLimited(resp.Body, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", rawURL, err)
 	}
-	vecs := make([][]float64, len(er.Data))
-	for i, d := range er.Data {
-		vecs[i] = d.Embedding
+	f.count(&f.fetched)
+	etag, lastMod := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag != "" || lastMod != "" {
+		f.storeCache(fetchCacheEntry{URL: rawURL, ETag: etag, LastModified: lastMod, Fetched: time.Now(), Body: body})
 	}
-	return vecs, nil
+	return body, nil
 }
 
-// embedSingle returns the embedding vector for a single text input.
-func (c *lmClient) embedSingle(text string) ([]float64, error) {
-	vecs, err := c.embed([]string{text})
-	if err != nil {
-		return nil, err
+// wait sleeps until the minimum delay since the last request to `h` passed.
+func (f *fetchCoordinator) wait(ctx context.Context, h *hostState) error {
+	d := time.Until(h.last.Add(f.minDelay))
+	if d <= 0 {
+		return nil
 	}
-	if len(vecs) == 0 {
-		return nil, fmt.Errorf("no embedding returned")
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return vecs[0], nil
 }
 
-// chatReq models the request payload for chat completions.
-type chatReq struct {
-	Model    string    `json:"model"`
-	Messages []chatMsg `json:"messages"`
-	Stream   bool      `json:"stream"`
+func (f *fetchCoordinator) cachePath(rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(f.cacheDir, hex.EncodeToString(sum[:])+".json")
 }
 
-// chatMsg represents a single chat message with a role and content.
-type chatMsg struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+func (f *fetchCoordinator) loadCache(rawURL string) *fetchCacheEntry {
+	if f.cacheDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(f.cachePath(rawURL))
+	if err != nil {
+		return nil
+	}
+	var e fetchCacheEntry
+	if json.Unmarshal(data, &e) != nil || e.URL != rawURL {
+		return nil
+	}
+	return &e
 }
 
-// chatStream streams tokens from the chat completion endpoint and
-// writes them to `w` as they arrive.
-func (c *lmClient) chatStream(ctx context.Context, system string, msgs []chatMsg, w io.Writer) error {
-	all := make([]chatMsg, 0, len(msgs)+1)
-	all = append(all, chatMsg{Role: "system", Content: system})
-	all = append(all, msgs...)
-	body, err := json.Marshal(chatReq{Model: c.chatModel, Messages: all, Stream: true})
+func (f *fetchCoordinator) storeCache(e fetchCacheEntry) {
+	if f.cacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(f.cacheDir, 0o755); err != nil {
+		log.Printf("fetch cache: %v", err)
+		return
+	}
+	b, err := json.Marshal(e)
 	if err != nil {
-		return fmt.Errorf("failed to marshal chat request: %w", err)
+		return
 	}
+	p := f.cachePath(e.URL)
+	if err := os.WriteFile(p+".tmp", b, 0o644); err != nil {
+		log.Printf("fetch cache: %v", err)
+		return
+	}
+	_ = os.Rename(p+".tmp", p)
+}
+
+// stats reports cache usage for /api/stats.
+func (f *fetchCoordinator) stats() map[string]any {
+	f.mu.Lock()
+	st := map[string]any{
+		"enabled":        f.cacheDir != "",
+		"fetched":        f.fetched,
+		"not_modified":   f.notModified,
+		"robots_blocked": f.robotsBlocked,
+		"hosts":          len(f.hosts),
+	}
+	f.mu.Unlock()
+	if f.cacheDir != "" {
+		var n, size int64
+		entries, _ := os.ReadDir(f.cacheDir)
+		for _, e := range entries {
+			if info, err := e.Info(); err == nil && strings.HasSuffix(e.Name(), ".json") {
+				n++
+				size += info.Size()
+			}
+		}
+		st["entries"] = n
+		st["bytes"] = size
+	}
+	return st
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", c.base+"/v1/chat/completions", bytes.NewReader(body))
+// robotsRules are the Allow/Disallow lines that apply to robotsAgent.
+type robotsRules struct {
+	allow, disallow []string
+}
+
+// fetchRobots loads and parses robots.txt. Missing or unreadable files
+// allow everything.
+func fetchRobots(ctx context.Context, client *http.Client, robotsURL string) *robotsRules {
+	req, err := http.NewRequestWithContext(ctx, "GET", robotsURL, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create HTTP request: %w", err)
+		return &robotsRules{}
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.http.Do(req)
+	req.Header.Set("User-Agent", fetchUserAgent)
+	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("chat request failed: %w", err)
+		return &robotsRules{}
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		raw, readErr := io.ReadAll(resp.Body)
-		if readErr != nil {
-			return fmt.Errorf("chat HTTP %d (failed to read body: %v)", resp.StatusCode, readErr)
-		}
-		return fmt.Errorf("chat HTTP %d: %s", resp.StatusCode, string(raw))
+		return &robotsRules{}
 	}
+	body, err := readLimited(resp.Body, 512<<10)
+	if err != nil {
+		return &robotsRules{}
+	}
+	return parseRobots(string(body), robotsAgent)
+}
 
-	inThink := false
-	scanner := bufio.NewScanner(resp.Body)
-	scanner.Buffer(make([]byte, 0, 1024*1024), 1024*1024)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
+// parseRobots returns the rules of the group naming `agent`, or of the
+// "*" group if no group names it.
+func parseRobots(txt, agent string) *robotsRules {
+	var specific, wildcard robotsRules
+	var foundSpecific bool
+	var current []*robotsRules
+	inRules := false
+	for _, line := range strings.Split(txt, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
 			continue
 		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
-			break
-		}
-		var chunk struct {
-			Choices []struct {
-				Delta struct {
-					Content string `json:"content"`
-				} `json:"delta"`
-			} `json:"choices"`
-		}
-		if json.Unmarshal([]byte(data), &chunk) == nil && len(chunk.Choices) > 0 {
-			tok := chunk.Choices[0].Delta.Content
-			// Some local models wrap "thinking" in markers; strip them from the UI
-			if strings.Contains(tok, "[THINK]") {
-				inThink = true
-				tok = strings.ReplaceAll(tok, "[THINK]", "")
+		key = strings.ToLower(strings.TrimSpace(key))
+		val = strings.TrimSpace(val)
+		switch key {
+		case "user-agent":
+			if inRules {
+				current, inRules = nil, false
 			}
-			if strings.Contains(tok, "[/THINK]") {
-				inThink = false
-				tok = strings.ReplaceAll(tok, "[/THINK]", "")
+			ua := strings.ToLower(val)
+			if ua == "*" {
+				current = append(current, &wildcard)
+			} else if strings.Contains(agent, ua) || strings.Contains(ua, agent) {
+				current = append(current, &specific)
+				foundSpecific = true
 			}
-			if !inThink && tok != "" {
-				fmt.Fprint(w, tok)
+		case "allow", "disallow":
+			inRules = true
+			for _, r := range current {
+				if key == "allow" {
+					r.allow = append(r.allow, val)
+				} else if val != "" {
+					r.disallow = append(r.disallow, val)
+				}
 			}
 		}
 	}
-	return scanner.Err()
+	if foundSpecific {
+		return &specific
+	}
+	return &wildcard
+}
+
+// allowed applies the longest matching rule; Allow wins ties.
+func (r *robotsRules) allowed(p string) bool {
+	if p == "" {
+		p = "/"
+	}
+	best, allow := -1, true
+	for _, pat := range r.disallow {
+		if robotsMatch(pat, p) && len(pat) > best {
+			best, allow = len(pat), false
+		}
+	}
+	for _, pat := range r.allow {
+		if pat != "" && robotsMatch(pat, p) && len(pat) >= best {
+			best, allow = len(pat), true
+		}
+	}
+	return allow
+}
+
+// robotsMatch matches a robots.txt path pattern with "*" and "$".
+func robotsMatch(pat, p string) bool {
+	anchored := strings.HasSuffix(pat, "$")
+	pat = strings.TrimSuffix(pat, "$")
+	parts := strings.Split(pat, "*")
+	if !strings.HasPrefix(p, parts[0]) {
+		return false
+	}
+	rest := p[len(parts[0]):]
+	for _, part := range parts[1:] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	if anchored && rest != "" {
+		// the last literal must end the path
+		last := parts[len(parts)-1]
+		return len(parts) > 1 && strings.HasSuffix(p, last)
+	}
+	return true
 }
 
 // ─────────────────────────────────────────────────────────────────────────────
-// RAG system
+// Wikipedia fetcher
 // ─────────────────────────────────────────────────────────────────────────────
 
-// vecJSON marshals a float64 slice into a JSON string for SQL usage.
-func vecJSON(v []float64) string {
-	b, err := json.Marshal(v)
+// fetchWikipedia loads the plain-text extract of a Wikipedia article.
+// `lang` becomes part of the host name, so it must be a language code.
+func fetchWikipedia(ctx context.Context, article, lang string) (string, error) {
+	if !wikiLangRe.MatchString(lang) {
+		return "", fmt.Errorf("invalid Wikipedia language %q", lang)
+	}
+	u := fmt.Sprintf(
+		"https://%s.wikipedia.org/w/api.php?action=query&prop=extracts&explaintext=1&titles=%s&format=json",
+		lang, url.QueryEscape(article),
+	)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
-		// This should never happen with float64 slices, but handle it anyway
-		log.Printf("Warning: failed to marshal vector: %v", err)
-		return "[]"
+		return "", err
 	}
-	return string(b)
+	req.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
+	resp, err := newHTTPClient(30 * time.Second).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("Wikipedia API returned HTTP %d for %q", resp.StatusCode, article)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if !strings.Contains(ct, "json") {
+		return "", fmt.Errorf("Wikipedia API returned unexpected content-type %q for %q", ct, article)
+	}
+	body, err := readLimited(resp.Body, maxPageBytes)
+	if err != nil {
+		return "", fmt.Errorf("Wikipedia %q: %w", article, err)
+	}
+	var result struct {
+		Query struct {
+			Pages map[string]struct {
+				Title   string `json:"title"`
+				Extract string `json:"extract"`
+			} `json:"pages"`
+		} `json:"query"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("Wikipedia JSON parse error for %q: %w", article, err)
+	}
+	for _, p := range result.Query.Pages {
+		if p.Extract == "" {
+			return "", fmt.Errorf("Wikipedia article %q has no content", article)
+		}
+		return p.Extract, nil
+	}
+	return "", fmt.Errorf("no pages found for %q", article)
 }
 
-// escapeSQ escapes single quotes for safe SQL insertion.
-func escapeSQ(s string) string {
-	return strings.ReplaceAll(s, "'", "''")
-}
+// wikiLangRe matches Wikipedia language codes ("de", "en", "zh-yue").
+var wikiLangRe = regexp.MustCompile(`^[a-z]{2,3}(-[a-z]{2,8})*$`)
 
-// storageModeLabel returns a short string label for a tinySQL storage mode.
-func storageModeLabel(mode tinysql.StorageMode) string {
-	switch mode {
-	case tinysql.ModeMemory:
-		return "memory"
-	case tinysql.ModeWAL:
-		return "wal"
-	case tinysql.ModeDisk:
-		return "disk"
-	case tinysql.ModeIndex:
-		return "index"
-	case tinysql.ModeHybrid:
-		return "hybrid"
-	default:
-		return "legacy"
-	}
+// wikiSearchResult is a single MediaWiki search hit; Snippet is plain text.
+type wikiSearchResult struct {
+	Title   string `json:"title"`
+	Snippet string `json:"snippet"`
+	PageID  int    `json:"pageid"`
 }
 
-// newRequestID generates a short random request identifier.
-func newRequestID() string {
-	b := make([]byte, 4)
-	if _, err := rand.Read(b); err == nil {
-		return fmt.Sprintf("req-%x", b)
+// searchWikipedia performs a MediaWiki full-text search in the `lang`
+// Wikipedia and returns up to `limit` results. API errors are returned
+// with the upstream message.
+func searchWikipedia(ctx context.Context, query, lang string, limit int) ([]wikiSearchResult, error) {
+	if !wikiLangRe.MatchString(lang) {
+		return nil, fmt.Errorf("invalid Wikipedia language %q", lang)
+	}
+	apiURL := fmt.Sprintf("https://%s.wikipedia.org/w/api.php?action=query&list=search&srsearch=%s&utf8=&format=json&srlimit=%d", lang, url.QueryEscape(query), limit)
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
+	resp, err := newHTTPClient(15 * time.Second).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("wikipedia search returned status %d", resp.StatusCode)
 	}
-	return fmt.Sprintf("req-%d", time.Now().UnixNano())
+	var root struct {
+		Error *struct {
+			Code string `json:"code"`
+			Info string `json:"info"`
+		} `json:"error"`
+		Query struct {
+			Search []wikiSearchResult `json:"search"`
+		} `json:"query"`
+	}
+	if err := json.NewDecoder(limitBody(resp.Body, maxJSONBytes)).Decode(&root); err != nil {
+		return nil, err
+	}
+	if root.Error != nil {
+		return nil, fmt.Errorf("wikipedia search: %s (%s)", root.Error.Info, root.Error.Code)
+	}
+	out := root.Query.Search
+	if out == nil {
+		out = []wikiSearchResult{}
+	}
+	for i := range out {
+		out[i].Snippet = html.UnescapeString(htmlTagRe.ReplaceAllString(out[i].Snippet, ""))
+	}
+	return out, nil
 }
 
-// ragSystem encapsulates the tinyRAG knowledge store, embedding
-// functionality and an associated tinySQL database instance.
-type ragSystem struct {
-	db     *tinysql.DB
-	dbPath string
-	k      int
-	dim    int
-
-	// Storage mode (for display / logging)
-	storageMode tinysql.StorageMode
+// ─────────────────────────────────────────────────────────────────────────────
+// Generic web scraper
+// ─────────────────────────────────────────────────────────────────────────────
 
-	// Settings-sensitive runtime state
-	lmMu sync.RWMutex
-	lm   *lmClient
+var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+var multiSpaceRe = regexp.MustCompile(`\s{3,}`)
 
-	// DB mutex (tinySQL isn't designed for heavy concurrent writes)
-	dbMu sync.Mutex
+// fetchURL retrieves a URL and returns its main text, suitable for
+// chunking and embedding. See fetchPage.
+func fetchURL(ctx context.Context, rawURL string, allow []string) (string, error) {
+	_, text, err := fetchPage(ctx, rawURL, allow)
+	return text, err
+}
+
+// layoutBlockRes match the script, style and layout blocks htmlToText drops.
+var layoutBlockRes = func() []*regexp.Regexp {
+	var out []*regexp.Regexp
+	for _, tag := range []string{"script", "style", "nav", "footer", "header"} {
+		out = append(out, regexp.MustCompile(`(?is)<`+tag+`[^>]*>.*?</`+tag+`>`))
+	}
+	return out
+}()
 
-	// Monotonic chunk IDs (avoid collisions even after deletes)
-	idMu   sync.Mutex
-	nextID int
+// htmlToText heuristically strips markup, scripts and layout blocks
+// from an HTML document.
+func htmlToText(text string) string {
+	for _, re := range layoutBlockRes {
+		text = re.ReplaceAllString(text, " ")
+	}
+	text = htmlTagRe.ReplaceAllString(text, " ")
+	text = html.UnescapeString(text)
+	text = multiSpaceRe.ReplaceAllString(text, "\n")
+	return strings.TrimSpace(text)
 }
 
-// newRAG initializes a new `ragSystem` backed by a tinySQL DB using
-// the provided storage mode and memory constraints.
-func newRAG(lm *lmClient, k int, dbPath string, storageMode tinysql.StorageMode, maxMemMB int64) (*ragSystem, error) {
-	var db *tinysql.DB
-	var err error
+// ─────────────────────────────────────────────────────────────────────────────
+// Main content extraction (readability-style)
+// ─────────────────────────────────────────────────────────────────────────────
 
-	switch storageMode {
-	case tinysql.ModeMemory:
-		// In-memory with optional save-on-close.
-		db, err = tinysql.OpenDB(tinysql.StorageConfig{
-			Mode: tinysql.ModeMemory,
-			Path: dbPath, // saves GOB on Close if non-empty
-		})
-		if err != nil {
-			return nil, fmt.Errorf("open memory db: %w", err)
+// minMainContentChars is the least amount of text the DOM extraction must
+// yield before it is preferred over the regex stripper.
+const minMainContentChars = 250
+
+var (
+	unlikelyCandidateRe = regexp.MustCompile(`(?i)cookie|consent|banner|sidebar|menu|nav|footer|masthead|comment|share|social|advert|promo|related|breadcrumb|popup|modal|newsletter|subscribe|skip`)
+	maybeCandidateRe    = regexp.MustCompile(`(?i)article|content|main|post|entry|story|text|body`)
+	positiveWeightRe    = regexp.MustCompile(`(?i)article|content|main|post|entry|story|text|blog|body|docs?|markdown`)
+	negativeWeightRe    = regexp.MustCompile(`(?i)cookie|consent|sidebar|menu|nav|footer|comment|share|social|advert|promo|related|widget|meta|tags?\b`)
+	inlineSpaceRe       = regexp.MustCompile(`[ \t]+`)
+	lineBreakRe         = regexp.MustCompile(`\s*\n\s*`)
+)
+
+// skippedTags never contribute content.
+var skippedTags = map[string]bool{
+	"script": true, "style": true, "noscript": true, "nav": true, "footer": true,
+	"header": true, "aside": true, "form": true, "iframe": true, "svg": true,
+	"button": true, "select": true, "template": true,
+}
+
+// blockTags end a line when rendering text.
+var blockTags = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "main": true, "br": true,
+	"li": true, "ul": true, "ol": true, "pre": true, "blockquote": true, "table": true,
+	"tr": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"dd": true, "dt": true, "figcaption": true,
+}
+
+// fetchPage downloads `rawURL` and returns its title and main text.
+// The DOM-based extraction is used when it finds enough content,
+// otherwise the regex stripper of htmlToText. Internal hosts are refused
+// unless listed in `allow`; the request goes through the fetcher.
+func fetchPage(ctx context.Context, rawURL string, allow []string) (title, text string, err error) {
+	body, err := fetcher.get(ctx, newGuardedClient(30*time.Second, allow), rawURL, maxPageBytes)
+	if err != nil {
+		return "", "", err
+	}
+	title, text = extractMainContent(string(body))
+	if len(text) < minMainContentChars {
+		text = htmlToText(string(body))
+	}
+	if len(text) < 50 {
+		return "", "", fmt.Errorf("page too short after stripping HTML (%d chars)", len(text))
+	}
+	return title, text, nil
+}
+
+// extractMainContent parses an HTML document and returns its title and
+// the text of the highest scoring content block. Blocks are scored by
+// paragraph length and comma count, weighted by class/id hints and
+// penalized by link density.
+func extractMainContent(doc string) (title, text string) {
+	root, err := htmlparse.Parse(strings.NewReader(doc))
+	if err != nil {
+		return "", ""
+	}
+	title = strings.TrimSpace(nodeText(findElement(root, "title")))
+	if title == "" {
+		title = strings.TrimSpace(nodeText(findElement(root, "h1")))
+	}
+
+	// Candidates are kept in the order they were found so that ties go to
+	// the earlier block on every run.
+	scores := map[*htmlparse.Node]float64{}
+	var candidates []*htmlparse.Node
+	initScore := func(n *htmlparse.Node) {
+		if _, ok := scores[n]; ok {
+			return
 		}
-		if dbPath != "" {
-			fmt.Printf("Storage mode: memory (save to %s on exit)\n", dbPath)
-		} else {
-			fmt.Println("Storage mode: memory (ephemeral, no persistence)")
+		candidates = append(candidates, n)
+		s := classWeight(n)
+		switch n.Data {
+		case "article", "main":
+			s += 10
+		case "div":
+			s += 5
+		case "pre", "td", "blockquote":
+			s += 3
+		case "ol", "ul", "dl", "dd", "dt", "li", "form":
+			s -= 3
+		case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+			s -= 5
+		}
+		scores[n] = s
+	}
+
+	var walk func(n *htmlparse.Node)
+	walk = func(n *htmlparse.Node) {
+		if n.Type == htmlparse.ElementNode {
+			if skippedTags[n.Data] || isUnlikelyCandidate(n) {
+				return
+			}
+			switch n.Data {
+			case "p", "pre", "td", "blockquote":
+				inner := strings.TrimSpace(nodeText(n))
+				if len(inner) >= 25 {
+					s := 1 + float64(strings.Count(inner, ",")) + math.Min(float64(len(inner))/100, 3)
+					if p := n.Parent; p != nil && p.Type == htmlparse.ElementNode {
+						initScore(p)
+						scores[p] += s
+						if gp := p.Parent; gp != nil && gp.Type == htmlparse.ElementNode {
+							initScore(gp)
+							scores[gp] += s / 2
+						}
+					}
+				}
+			}
 		}
-
-	case tinysql.ModeWAL:
-		if dbPath == "" {
-			dbPath = "tinyrag.gob"
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
 		}
-		db, err = tinysql.OpenDB(tinysql.StorageConfig{
-			Mode: tinysql.ModeWAL,
-			Path: dbPath,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("open wal db: %w", err)
+	}
+	walk(root)
+
+	var best *htmlparse.Node
+	bestScore := 0.0
+	for _, n := range candidates {
+		s := scores[n] * (1 - linkDensity(n))
+		scores[n] = s
+		if best == nil || s > bestScore {
+			best, bestScore = n, s
 		}
-		fmt.Printf("Storage mode: WAL (checkpoint to %s)\n", dbPath)
+	}
+	if best == nil {
+		return title, ""
+	}
 
-	case tinysql.ModeDisk:
-		if dbPath == "" {
-			dbPath = "tinyrag.db"
+	// Siblings that scored well or are link-poor paragraphs belong to the
+	// article too (e.g. content split across several divs).
+	var b strings.Builder
+	threshold := math.Max(10, bestScore*0.2)
+	for sib := firstSibling(best); sib != nil; sib = sib.NextSibling {
+		include := sib == best || scores[sib] >= threshold
+		if !include && sib.Type == htmlparse.ElementNode && sib.Data == "p" {
+			t := nodeText(sib)
+			include = len(t) > 80 && linkDensity(sib) < 0.25
 		}
-		db, err = tinysql.OpenDB(tinysql.StorageConfig{
-			Mode: tinysql.ModeDisk,
-			Path: dbPath,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("open disk db: %w", err)
+		if include {
+			renderText(&b, sib)
+			b.WriteString("\n")
 		}
-		fmt.Printf("Storage mode: disk (tables in %s/)\n", dbPath)
+	}
+	text = inlineSpaceRe.ReplaceAllString(b.String(), " ")
+	text = lineBreakRe.ReplaceAllString(text, "\n")
+	return title, strings.TrimSpace(text)
+}
 
-	case tinysql.ModeIndex:
-		if dbPath == "" {
-			dbPath = "tinyrag.db"
+// isUnlikelyCandidate reports whether class/id mark `n` as page chrome.
+func isUnlikelyCandidate(n *htmlparse.Node) bool {
+	if n.Data == "body" || n.Data == "article" || n.Data == "main" {
+		return false
+	}
+	hint := attr(n, "class") + " " + attr(n, "id") + " " + attr(n, "role")
+	return unlikelyCandidateRe.MatchString(hint) && !maybeCandidateRe.MatchString(hint)
+}
+
+// classWeight rates class and id names of `n`.
+func classWeight(n *htmlparse.Node) float64 {
+	w := 0.0
+	for _, v := range []string{attr(n, "class"), attr(n, "id")} {
+		if v == "" {
+			continue
 		}
-		mem := maxMemMB * 1024 * 1024
-		if mem <= 0 {
-			mem = 64 * 1024 * 1024
+		if negativeWeightRe.MatchString(v) {
+			w -= 25
 		}
-		db, err = tinysql.OpenDB(tinysql.StorageConfig{
-			Mode:           tinysql.ModeIndex,
-			Path:           dbPath,
-			MaxMemoryBytes: mem,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("open index db: %w", err)
+		if positiveWeightRe.MatchString(v) {
+			w += 25
 		}
-		fmt.Printf("Storage mode: index (schemas in RAM, rows on disk in %s/, max %d MB)\n", dbPath, maxMemMB)
+	}
+	return w
+}
 
-	case tinysql.ModeHybrid:
-		if dbPath == "" {
-			dbPath = "tinyrag.db"
-		}
-		mem := maxMemMB * 1024 * 1024
-		if mem <= 0 {
-			mem = 256 * 1024 * 1024
+// linkDensity is the share of text inside links below `n`.
+func linkDensity(n *htmlparse.Node) float64 {
+	total := len(nodeText(n))
+	if total == 0 {
+		return 0
+	}
+	links := 0
+	var walk func(*htmlparse.Node)
+	walk = func(c *htmlparse.Node) {
+		if c.Type == htmlparse.ElementNode && c.Data == "a" {
+			links += len(nodeText(c))
+			return
 		}
-		db, err = tinysql.OpenDB(tinysql.StorageConfig{
-			Mode:           tinysql.ModeHybrid,
-			Path:           dbPath,
-			MaxMemoryBytes: mem,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("open hybrid db: %w", err)
+		for x := c.FirstChild; x != nil; x = x.NextSibling {
+			walk(x)
 		}
-		fmt.Printf("Storage mode: hybrid (LRU cache %d MB, disk in %s/)\n", maxMemMB, dbPath)
+	}
+	walk(n)
+	return float64(links) / float64(total)
+}
 
-	default:
-		// Fallback: legacy behaviour (load GOB if exists, else new)
-		if dbPath != "" {
-			if loaded, loadErr := tinysql.LoadFromFile(dbPath); loadErr == nil {
-				db = loaded
-				fmt.Printf("Loaded existing database from %s\n", dbPath)
-			} else {
-				db = tinysql.NewDB()
-				fmt.Printf("Creating new database (will save to %s)\n", dbPath)
-			}
-		} else {
-			db = tinysql.NewDB()
+func attr(n *htmlparse.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
 		}
 	}
-
-	r := &ragSystem{db: db, lm: lm, k: k, dbPath: dbPath, storageMode: storageMode}
-	return r, nil
+	return ""
 }
 
-// setLM atomically replaces the runtime `lmClient` used for embeddings
-// and chat requests.
-func (r *ragSystem) setLM(lm *lmClient) {
-	r.lmMu.Lock()
-	defer r.lmMu.Unlock()
-	r.lm = lm
+func firstSibling(n *htmlparse.Node) *htmlparse.Node {
+	if n.Parent == nil {
+		return n
+	}
+	return n.Parent.FirstChild
 }
 
-// getLM returns the currently configured `lmClient`.
-func (r *ragSystem) getLM() *lmClient {
-	r.lmMu.RLock()
-	defer r.lmMu.RUnlock()
-	return r.lm
+// findElement returns the first element named `tag` below `n`.
+func findElement(n *htmlparse.Node, tag string) *htmlparse.Node {
+	if n.Type == htmlparse.ElementNode && n.Data == tag {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if f := findElement(c, tag); f != nil {
+			return f
+		}
+	}
+	return nil
 }
 
-// save flushes the underlying database to disk or performs a sync
-// depending on the configured storage mode.
-func (r *ragSystem) save() error {
-	if r.dbPath == "" {
-		return nil
+// nodeText concatenates all text below `n`, skipping scripts and styles.
+func nodeText(n *htmlparse.Node) string {
+	if n == nil {
+		return ""
 	}
-	r.dbMu.Lock()
-	defer r.dbMu.Unlock()
+	var b strings.Builder
+	var walk func(*htmlparse.Node)
+	walk = func(c *htmlparse.Node) {
+		switch {
+		case c.Type == htmlparse.TextNode:
+			b.WriteString(c.Data)
+		case c.Type == htmlparse.ElementNode && (c.Data == "script" || c.Data == "style"):
+			return
+		}
+		for x := c.FirstChild; x != nil; x = x.NextSibling {
+			walk(x)
+		}
+	}
+	walk(n)
+	return b.String()
+}
 
-	// For disk-backed modes, Sync flushes dirty tables to disk.
-	// For memory mode, this is a no-op (data saved on Close).
-	switch r.storageMode {
-	case tinysql.ModeDisk, tinysql.ModeHybrid, tinysql.ModeIndex:
-		return r.db.Sync()
-	default:
-		// Legacy / ModeMemory / ModeWAL: full GOB snapshot
-		return tinysql.SaveToFile(r.db, r.dbPath)
+// renderText writes the visible text of `n` with line breaks after
+// block elements, leaving out page chrome.
+func renderText(b *strings.Builder, n *htmlparse.Node) {
+	switch n.Type {
+	case htmlparse.TextNode:
+		b.WriteString(n.Data)
+		return
+	case htmlparse.ElementNode:
+		if skippedTags[n.Data] || isUnlikelyCandidate(n) {
+			return
+		}
+		if n.Data == "li" {
+			b.WriteString("\n- ")
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		renderText(b, c)
+	}
+	if n.Type == htmlparse.ElementNode && blockTags[n.Data] {
+		b.WriteString("\n")
 	}
 }
 
-// init creates required DB tables and initializes runtime counters.
-func (r *ragSystem) init() error {
-	q := "CREATE TABLE IF NOT EXISTS chunks (id INT, article TEXT, chunk_idx INT, content TEXT, embedding VECTOR)"
-	stmt, err := tinysql.ParseSQL(q)
+// fetchCustomAPI executes a custom API definition for `query` and turns
+// the response into text according to its Extract path and ResponseType.
+// Definitions using only a GET template keep the plain fetchURL behavior.
+func fetchCustomAPI(ctx context.Context, api customAPI, query string, allow []string) (string, error) {
+	method := strings.ToUpper(api.Method)
+	if (method == "" || method == "GET") && len(api.Headers) == 0 && api.ResponseType == "" && api.Extract == "" {
+		return fetchURL(ctx, strings.ReplaceAll(api.Template, "$q", url.QueryEscape(query)), allow)
+	}
+	raw, status, err := customAPIRequest(ctx, api, query, allow)
 	if err != nil {
-		return err
+		return "", err
 	}
-	r.dbMu.Lock()
-	defer r.dbMu.Unlock()
-	_, err = tinysql.Execute(context.Background(), r.db, "default", stmt)
+	if status < 200 || status > 299 {
+		return "", fmt.Errorf("HTTP %d for %s", status, api.Name)
+	}
+	text, _, err := customAPIText(api, raw)
 	if err != nil {
-		return err
+		return "", err
 	}
-	// Initialize nextID from MAX(id)+1
-	r.idMu.Lock()
-	defer r.idMu.Unlock()
-	r.nextID = r.maxChunkIDLocked() + 1
-	return nil
+	if text == "" {
+		return "", fmt.Errorf("empty response from %s", api.Name)
+	}
+	return text, nil
 }
 
-// maxChunkIDLocked queries the DB for the maximum chunk id and must
-// be called with appropriate locking by the caller.
-func (r *ragSystem) maxChunkIDLocked() int {
-	q := "SELECT MAX(id) AS mid FROM chunks"
-	stmt, err := tinysql.ParseSQL(q)
+// customAPIRequest sends the request described by `api` and returns the
+// raw response body and status code.
+func customAPIRequest(ctx context.Context, api customAPI, query string, allow []string) ([]byte, int, error) {
+	method := strings.ToUpper(api.Method)
+	if method == "" {
+		method = "GET"
+	}
+	finalURL := strings.ReplaceAll(api.Template, "$q", url.QueryEscape(query))
+
+	contentType := ""
+	for k, v := range api.Headers {
+		if strings.EqualFold(k, "Content-Type") {
+			contentType = v
+		}
+	}
+	var body io.Reader
+	if api.BodyTemplate != "" {
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+			if t := strings.TrimSpace(api.BodyTemplate); strings.HasPrefix(t, "{") || strings.HasPrefix(t, "[") {
+				contentType = "application/json"
+			}
+		}
+		body = strings.NewReader(strings.ReplaceAll(api.BodyTemplate, "$q", escapeBodyValue(query, contentType)))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, finalURL, body)
 	if err != nil {
-		return -1
+		return nil, 0, err
 	}
-	rs, err := tinysql.Execute(context.Background(), r.db, "default", stmt)
-	if err != nil || rs == nil || len(rs.Rows) == 0 {
-		return -1
+	req.Header.Set("User-Agent", "tinyRAG/1.1")
+	for k, v := range api.Headers {
+		req.Header.Set(k, v)
 	}
-	v, ok := tinysql.GetVal(rs.Rows[0], "mid")
-	if !ok || v == nil {
-		return -1
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
 	}
-	switch n := v.(type) {
-	case int:
-		return n
-	case int64:
-		return int(n)
-	case float64:
-		return int(n)
+	resp, err := newGuardedClient(30*time.Second, allow).Do(req)
+	if err != nil {
+		return nil, 0, err
 	}
-	return -1
-}
-
-// allocIDs reserves `n` monotonic IDs for new chunks.
-func (r *ragSystem) allocIDs(n int) int {
-	r.idMu.Lock()
-	defer r.idMu.Unlock()
-	start := r.nextID
-	r.nextID += n
-	return start
+	defer resp.Body.Close()
+	raw, err := readLimited(resp.Body, maxPageBytes)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return raw, resp.StatusCode, nil
 }
 
-// addChunks embeds and stores `chunks` for the given `article` into
-// the database, performing batched inserts.
-func (r *ragSystem) addChunks(article string, chunks []string) error {
-	if len(chunks) == 0 {
-		return nil
-	}
-	// If this article already exists in the DB, skip adding again to avoid duplicates.
-	// This makes imports idempotent; to replace content delete the source first.
-	checkQ := fmt.Sprintf("SELECT COUNT(*) AS cnt FROM chunks WHERE article = '%s'", escapeSQ(article))
-	if st, err := tinysql.ParseSQL(checkQ); err == nil {
-		r.dbMu.Lock()
-		if rs, err := tinysql.Execute(context.Background(), r.db, "default", st); err == nil && rs != nil && len(rs.Rows) > 0 {
-			if v, ok := tinysql.GetVal(rs.Rows[0], "cnt"); ok && v != nil {
-				cnt := 0
-				switch nv := v.(type) {
-				case int:
-					cnt = nv
-				case int64:
-					cnt = int(nv)
-				case float64:
-					cnt = int(nv)
+// customAPIText converts a raw API response into text. If an Extract path
+// is set and matches the JSON response, the matched values are used and
+// `extracted` is true; otherwise the ResponseType conversion applies.
+func customAPIText(api customAPI, raw []byte) (text string, extracted bool, err error) {
+	if api.Extract != "" {
+		if segs, perr := jsonPathSegments(api.Extract); perr == nil {
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.UseNumber()
+			var v any
+			if dec.Decode(&v) == nil {
+				var parts []string
+				for _, n := range extractJSONPath(v, segs) {
+					if s := strings.TrimSpace(jsonValueText(n)); s != "" {
+						parts = append(parts, s)
+					}
 				}
-				if cnt > 0 {
-					fmt.Printf("skip addChunks: article '%s' already present (%d chunks)\n", article, cnt)
-					r.dbMu.Unlock()
-					return nil
+				if len(parts) > 0 {
+					return strings.Join(parts, "\n\n"), true, nil
 				}
 			}
 		}
-		r.dbMu.Unlock()
 	}
-	batchSize := 16
-
-	for i := 0; i < len(chunks); i += batchSize {
-		end := i + batchSize
-		if end > len(chunks) {
-			end = len(chunks)
-		}
-		batch := chunks[i:end]
-
-		// Embed without holding DB lock
-		vecs, err := r.getLM().embed(batch)
-		if err != nil {
-			return fmt.Errorf("embed batch %d: %w", i/batchSize, err)
-		}
-		if r.dim == 0 && len(vecs) > 0 {
-			r.dim = len(vecs[0])
+	switch api.ResponseType {
+	case "json":
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, raw, "", "  "); err != nil {
+			return "", false, fmt.Errorf("invalid JSON response: %w", err)
 		}
+		return pretty.String(), false, nil
+	case "text":
+		return strings.TrimSpace(string(raw)), false, nil
+	default:
+		return htmlToText(string(raw)), false, nil
+	}
+}
 
-		// Allocate IDs for this batch
-		startID := r.allocIDs(len(batch))
-
-		// Insert
-		r.dbMu.Lock()
-		for j, v := range vecs {
-			idx := i + j
-			q := fmt.Sprintf(
-				"INSERT INTO chunks VALUES (%d, '%s', %d, '%s', VEC_FROM_JSON('%s'))",
-				startID+j, escapeSQ(article), idx, escapeSQ(batch[j]), vecJSON(v),
-			)
-			stmt, err := tinysql.ParseSQL(q)
-			if err != nil {
-				r.dbMu.Unlock()
-				return fmt.Errorf("parse insert %d: %w", idx, err)
+// jsonPathSegments splits a dot-path ("results.0.snippet") or simple
+// JSONPath ("$.items[*].title") into keys; "*" matches every element.
+func jsonPathSegments(path string) ([]string, error) {
+	p := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	var segs []string
+	for _, part := range strings.Split(p, ".") {
+		for part != "" {
+			i := strings.IndexByte(part, '[')
+			if i < 0 {
+				segs = append(segs, part)
+				break
 			}
-			if _, err := tinysql.Execute(context.Background(), r.db, "default", stmt); err != nil {
-				r.dbMu.Unlock()
-				return fmt.Errorf("exec insert %d: %w", idx, err)
+			if i > 0 {
+				segs = append(segs, part[:i])
 			}
-		}
-		r.dbMu.Unlock()
+			j := strings.IndexByte(part[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated [ in path %q", path)
+			}
+			key := strings.Trim(part[i+1:i+j], `'"`)
+			if key == "" {
+				return nil, fmt.Errorf("empty [] in path %q", path)
+			}
+			segs = append(segs, key)
+			part = part[i+j+1:]
+		}
+	}
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	return segs, nil
+}
 
-		fmt.Printf("  embedded+stored %d/%d chunks\n", end, len(chunks))
+// extractJSONPath evaluates path segments against a decoded JSON value
+// and returns all matching nodes. Negative indexes count from the end.
+func extractJSONPath(v any, segs []string) []any {
+	nodes := []any{v}
+	for _, seg := range segs {
+		var next []any
+		for _, n := range nodes {
+			switch t := n.(type) {
+			case map[string]any:
+				if seg != "*" {
+					if c, ok := t[seg]; ok {
+						next = append(next, c)
+					}
+					continue
+				}
+				keys := make([]string, 0, len(t))
+				for k := range t {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					next = append(next, t[k])
+				}
+			case []any:
+				if seg == "*" {
+					next = append(next, t...)
+					continue
+				}
+				i, err := strconv.Atoi(seg)
+				if err != nil {
+					continue
+				}
+				if i < 0 {
+					i += len(t)
+				}
+				if i >= 0 && i < len(t) {
+					next = append(next, t[i])
+				}
+			}
+		}
+		nodes = next
 	}
+	return nodes
+}
 
-	if err := r.save(); err != nil {
-		log.Printf("WARN: save failed: %v", err)
+// jsonValueText renders a JSON node as text: scalars verbatim,
+// objects and arrays as indented JSON.
+func jsonValueText(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		return strconv.FormatBool(t)
+	default:
+		b, err := json.MarshalIndent(t, "", "  ")
+		if err != nil {
+			return fmt.Sprint(t)
+		}
+		return string(b)
 	}
-	return nil
 }
 
-// docCount returns the total number of stored chunks.
-func (r *ragSystem) docCount() int {
-	q := "SELECT COUNT(*) AS cnt FROM chunks"
-	stmt, _ := tinysql.ParseSQL(q)
+// escapeBodyValue escapes `q` for insertion into a request body of the
+// given content type.
+func escapeBodyValue(q, contentType string) string {
+	switch {
+	case strings.Contains(contentType, "json"):
+		b, _ := json.Marshal(q)
+		return string(b[1 : len(b)-1])
+	case strings.Contains(contentType, "x-www-form-urlencoded"):
+		return url.QueryEscape(q)
+	}
+	return q
+}
 
-	r.dbMu.Lock()
-	rs, err := tinysql.Execute(context.Background(), r.db, "default", stmt)
-	r.dbMu.Unlock()
+// ─────────────────────────────────────────────────────────────────────────────
+// DuckDuckGo Instant Answer (fallback to HTML snippets)
+// ─────────────────────────────────────────────────────────────────────────────
 
-	if err != nil || rs == nil || len(rs.Rows) == 0 {
-		return 0
+// fetchDuckDuckGo queries DuckDuckGo Instant Answer API and falls
+// back to scraping HTML snippets when needed, returning markdown-ish text.
+func fetchDuckDuckGo(ctx context.Context, query string) (string, error) {
+	u := fmt.Sprintf(
+		"https://api.duckduckgo.com/?q=%s&format=json&no_html=1&skip_disambig=1",
+		url.QueryEscape(query),
+	)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
 	}
-	v, ok := tinysql.GetVal(rs.Rows[0], "cnt")
-	if !ok {
-		return 0
+	req.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
+	client := newHTTPClient(15 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
 	}
-	switch n := v.(type) {
-	case int:
-		return n
-	case int64:
-		return int(n)
-	case float64:
-		return int(n)
+	defer resp.Body.Close()
+	body, err := readLimited(resp.Body, maxJSONBytes)
+	if err != nil {
+		return "", fmt.Errorf("DuckDuckGo: %w", err)
 	}
-	return 0
+	var result struct {
+		Abstract       string `json:"Abstract"`
+		AbstractSource string `json:"AbstractSource"`
+		AbstractURL    string `json:"AbstractURL"`
+		Heading        string `json:"Heading"`
+		Answer         string `json:"Answer"`
+		RelatedTopics  []struct {
+			Text     string `json:"Text"`
+			FirstURL string `json:"FirstURL"`
+		} `json:"RelatedTopics"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	var parts []string
+	if result.Heading != "" {
+		parts = append(parts, "# "+result.Heading)
+	}
+	if result.Abstract != "" {
+		parts = append(parts, result.Abstract)
+		if result.AbstractSource != "" {
+			parts = append(parts, fmt.Sprintf("(Quelle: %s — %s)", result.AbstractSource, result.AbstractURL))
+		}
+	}
+	if result.Answer != "" {
+		parts = append(parts, "Antwort: "+result.Answer)
+	}
+	for i, rt := range result.RelatedTopics {
+		if i >= 5 {
+			break
+		}
+		if rt.Text != "" {
+			parts = append(parts, "- "+rt.Text)
+		}
+	}
+	text := strings.Join(parts, "\n\n")
+	if strings.TrimSpace(text) != "" {
+		return text, nil
+	}
+
+	// Fallback: scrape DuckDuckGo HTML search results
+	results, err := fetchWebSearch(ctx, query)
+	if err != nil {
+		return "", fmt.Errorf("DuckDuckGo HTML fallback failed: %w", err)
+	}
+	var snippets []string
+	for i, r := range results {
+		if i >= 10 {
+			break
+		}
+		if r.Snippet != "" {
+			snippets = append(snippets, "- "+r.Snippet)
+		}
+	}
+	if len(snippets) == 0 {
+		return "", fmt.Errorf("DuckDuckGo returned no results for %q", query)
+	}
+	return fmt.Sprintf("DuckDuckGo-Suchergebnisse für \"%s\":\n\n%s", query, strings.Join(snippets, "\n")), nil
 }
 
-// searchResult represents a single retrieval hit returned by searchJSON.
-type searchResult struct {
-	Score   float64 `json:"score"`
-	Content string  `json:"content"`
+// webResult is a single web search hit.
+type webResult struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Snippet string `json:"snippet"`
 }
 
-// searchJSON performs an embedding-based vector search for `query`,
-// returning up to `k` primary hits along with neighbor chunks.
-func (r *ragSystem) searchJSON(query string, k int) ([]searchResult, error) {
-	qvec, err := r.getLM().embedSingle(query)
+// fetchWebSearch scrapes the DuckDuckGo HTML endpoint for organic
+// results. Ads are skipped and redirect links are resolved to the
+// target URL.
+func fetchWebSearch(ctx context.Context, query string) ([]webResult, error) {
+	u := "https://html.duckduckgo.com/html/?q=" + url.QueryEscape(query)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		return nil, err
 	}
-	// fetch a larger candidate set, we'll filter by score>0.6 and pick up to k primary hits
-	limit := 100
-	if k*3 > limit {
-		limit = k * 3
+	req.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
+	resp, err := newHTTPClient(15 * time.Second).Do(req)
+	if err != nil {
+		return nil, err
 	}
-	// Defensive cap to avoid excessively large queries
-	const maxLimit = 1000
-	if limit > maxLimit {
-		limit = maxLimit
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("DuckDuckGo HTML returned HTTP %d", resp.StatusCode)
 	}
-	q := fmt.Sprintf(
-		"SELECT content, article, chunk_idx, VEC_COSINE_SIMILARITY(embedding, VEC_FROM_JSON('%s')) AS score FROM chunks ORDER BY score DESC LIMIT %d",
-		vecJSON(qvec), limit,
-	)
-	stmt, err := tinysql.ParseSQL(q)
+	root, err := htmlparse.Parse(limitBody(resp.Body, maxPageBytes))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("DuckDuckGo HTML: %w", err)
 	}
+	return parseWebResults(root), nil
+}
 
-	r.dbMu.Lock()
-	rs, err := tinysql.Execute(context.Background(), r.db, "default", stmt)
-	r.dbMu.Unlock()
+// parseWebResults collects result__a / result__snippet pairs of a
+// DuckDuckGo HTML result page.
+func parseWebResults(root *htmlparse.Node) []webResult {
+	var results []webResult
+	var walk func(*htmlparse.Node)
+	walk = func(n *htmlparse.Node) {
+		if n.Type == htmlparse.ElementNode {
+			class := " " + attr(n, "class") + " "
+			switch {
+			case strings.Contains(class, " result--ad "):
+				return
+			case strings.Contains(class, " result__a "):
+				results = append(results, webResult{
+					Title: strings.TrimSpace(nodeText(n)),
+					URL:   ddgTargetURL(attr(n, "href")),
+				})
+				return
+			case strings.Contains(class, " result__snippet ") && len(results) > 0:
+				results[len(results)-1].Snippet = strings.Join(strings.Fields(nodeText(n)), " ")
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+	out := results[:0]
+	for _, r := range results {
+		if r.URL != "" && r.Title != "" {
+			out = append(out, r)
+		}
+	}
+	return out
+}
 
+// ddgTargetURL unwraps DuckDuckGo redirect links ("//duckduckgo.com/l/?uddg=…").
+func ddgTargetURL(href string) string {
+	if strings.HasPrefix(href, "//") {
+		href = "https:" + href
+	}
+	u, err := url.Parse(href)
 	if err != nil {
-		return nil, err
+		return ""
 	}
-	// We'll collect primary hits (score>0.6) up to k, and include immediate neighbors (prev/next)
-	type hit struct {
-		article  string
-		chunkIdx int
-		content  string
-		score    float64
+	if strings.HasSuffix(u.Host, "duckduckgo.com") && strings.HasPrefix(u.Path, "/l/") {
+		return u.Query().Get("uddg")
 	}
-	var candidates = make([]hit, 0, len(rs.Rows))
-	for _, row := range rs.Rows {
-		c, ok1 := tinysql.GetVal(row, "content")
-		art, _ := tinysql.GetVal(row, "article")
-		idxVal, _ := tinysql.GetVal(row, "chunk_idx")
-		scoreVal, _ := tinysql.GetVal(row, "score")
-		if !ok1 || art == nil || idxVal == nil || scoreVal == nil {
-			continue
-		}
-		artStr := fmt.Sprint(art)
-		cStr := fmt.Sprint(c)
-		idx := 0
-		switch iv := idxVal.(type) {
-		case int:
-			idx = iv
-		case int64:
-			idx = int(iv)
-		case float64:
-			idx = int(iv)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return href
+}
+
+// webPage is a search result page fetched by the websearch tool.
+type webPage struct {
+	Source string `json:"source"`
+	URL    string `json:"url"`
+	Title  string `json:"title"`
+	Text   string `json:"-"`
+	Error  string `json:"error,omitempty"`
+}
+
+// maxWebSearchFollow caps the websearch_follow setting.
+const maxWebSearchFollow = 5
+
+// maxWebPageExcerpt is how much of each followed page goes into the
+// websearch tool output.
+const maxWebPageExcerpt = 3000
+
+// webSearch runs fetchWebSearch and fetches the first `follow` result
+// pages via fetchPage. Pages that fail are reported, not fatal.
+func webSearch(ctx context.Context, query string, follow int, allow []string) ([]webResult, []webPage, error) {
+	results, err := fetchWebSearch(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(results) == 0 {
+		return nil, nil, fmt.Errorf("keine Suchergebnisse für %q", query)
+	}
+	var pages []webPage
+	for i := 0; i < len(results) && i < min(follow, maxWebSearchFollow); i++ {
+		r := results[i]
+		p := webPage{URL: r.URL, Title: r.Title}
+		title, text, err := fetchPage(ctx, r.URL, allow)
+		if err != nil {
+			p.Error = err.Error()
+		} else {
+			if title != "" {
+				p.Title = title
+			}
+			p.Text = text
 		}
-		s := 0.0
-		switch sv := scoreVal.(type) {
-		case float64:
-			s = sv
-		case int:
-			s = float64(sv)
+		host := r.URL
+		if u, err := url.Parse(r.URL); err == nil {
+			host = strings.TrimPrefix(u.Hostname(), "www.")
 		}
-		candidates = append(candidates, hit{article: artStr, chunkIdx: idx, content: cStr, score: s})
+		p.Source = "web:" + host + ":" + p.Title
+		pages = append(pages, p)
 	}
+	return results, pages, nil
+}
 
-	// preallocate expected result size (primary + neighbors)
-	results := make([]searchResult, 0, k*3)
-	type seenKey struct {
-		article string
-		idx     int
-	}
-	seen := make(map[seenKey]bool)
-	primaryCount := 0
-	for _, h := range candidates {
-		if primaryCount >= k {
+// formatWebSearch renders results and page excerpts as tool output.
+func formatWebSearch(query string, results []webResult, pages []webPage) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Websuche nach \"%s\":\n\n", query)
+	for i, r := range results {
+		if i >= 10 {
 			break
 		}
-		if h.score <= 0.6 {
-			// skip low-score primary candidates
-			continue
+		fmt.Fprintf(&b, "%d. [%s](%s)\n", i+1, r.Title, r.URL)
+		if r.Snippet != "" {
+			fmt.Fprintf(&b, "   %s\n", r.Snippet)
 		}
-		key := seenKey{article: h.article, idx: h.chunkIdx}
-		if seen[key] {
+	}
+	for _, p := range pages {
+		if p.Error != "" {
+			fmt.Fprintf(&b, "\n## %s\n(Seite nicht geladen: %s)\n", p.Title, p.Error)
 			continue
 		}
-		// add previous neighbor if exists and not seen
-		if h.chunkIdx > 0 {
-			pkey := seenKey{article: h.article, idx: h.chunkIdx - 1}
-			if !seen[pkey] {
-				if prevContent, ok := r.fetchNeighborContent(h.article, h.chunkIdx-1); ok {
-					results = append(results, searchResult{Score: -1, Content: prevContent})
-					seen[pkey] = true
-				}
-			}
-		}
+		fmt.Fprintf(&b, "\n## %s\n%s\n\n%s\n", p.Title, p.URL, truncate(p.Text, maxWebPageExcerpt))
+	}
+	return strings.TrimSpace(b.String())
+}
 
-		// add primary hit
-		results = append(results, searchResult{Score: h.score, Content: h.content})
-		seen[key] = true
-		primaryCount++
+// ─────────────────────────────────────────────────────────────────────────────
+// StackOverflow (StackExchange API 2.3)
+// ─────────────────────────────────────────────────────────────────────────────
 
-		// add next neighbor
-		nkey := seenKey{article: h.article, idx: h.chunkIdx + 1}
-		if !seen[nkey] {
-			if nextContent, ok := r.fetchNeighborContent(h.article, h.chunkIdx+1); ok {
-				results = append(results, searchResult{Score: -1, Content: nextContent})
-				seen[nkey] = true
-			}
+// stackExchangeBackoff remembers per-method backoff deadlines requested
+// by the StackExchange API.
+var stackExchangeBackoff = struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}{until: map[string]time.Time{}}
+
+// stackExchangeGet calls `method` of the StackExchange API and decodes the
+// items of the response wrapper into `items`. It waits for a pending
+// backoff, honors quota and error fields, and decompresses gzip bodies.
+func stackExchangeGet(ctx context.Context, method string, params url.Values, items any) error {
+	stackExchangeBackoff.mu.Lock()
+	wait := time.Until(stackExchangeBackoff.until[method])
+	stackExchangeBackoff.mu.Unlock()
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("StackExchange backoff (%s) not elapsed: %w", wait.Round(time.Second), ctx.Err())
+		}
+	}
+
+	params.Set("site", "stackoverflow")
+	u := "https://api.stackexchange.com/2.3/" + method + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := newHTTPClient(15 * time.Second).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("StackExchange: %w", err)
 		}
+		defer gz.Close()
+		body = gz
 	}
+	var wrapper struct {
+		Items          json.RawMessage `json:"items"`
+		QuotaMax       int             `json:"quota_max"`
+		QuotaRemaining int             `json:"quota_remaining"`
+		Backoff        int             `json:"backoff"`
+		ErrorID        int             `json:"error_id"`
+		ErrorName      string          `json:"error_name"`
+		ErrorMessage   string          `json:"error_message"`
+	}
+	if err := json.NewDecoder(limitBody(body, maxJSONBytes)).Decode(&wrapper); err != nil {
+		return fmt.Errorf("StackExchange: invalid response (HTTP %d): %w", resp.StatusCode, err)
+	}
+	if wrapper.Backoff > 0 {
+		stackExchangeBackoff.mu.Lock()
+		stackExchangeBackoff.until[method] = time.Now().Add(time.Duration(wrapper.Backoff) * time.Second)
+		stackExchangeBackoff.mu.Unlock()
+	}
+	if wrapper.ErrorID != 0 {
+		return fmt.Errorf("StackExchange %s (%d): %s", wrapper.ErrorName, wrapper.ErrorID, wrapper.ErrorMessage)
+	}
+	if wrapper.QuotaMax > 0 && wrapper.QuotaRemaining < 10 {
+		log.Printf("StackExchange quota low: %d/%d remaining", wrapper.QuotaRemaining, wrapper.QuotaMax)
+	}
+	if len(wrapper.Items) == 0 {
+		return nil
+	}
+	return json.Unmarshal(wrapper.Items, items)
+}
 
-	return results, nil
+var soTagRe = regexp.MustCompile(`\[([^\[\]\s]+)\]`)
+var soCodeBlockRe = regexp.MustCompile(`(?is)<pre[^>]*>\s*<code[^>]*>(.*?)</code>\s*</pre>`)
+var soInlineCodeRe = regexp.MustCompile(`(?is)<code>(.*?)</code>`)
+var soBreakRe = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</li>|</h[1-6]>`)
+var soBlankLinesRe = regexp.MustCompile(`\n{3,}`)
+
+// stackOverflowBodyToMarkdown turns an answer body into markdown,
+// keeping code blocks and inline code intact.
+func stackOverflowBodyToMarkdown(body string) string {
+	var blocks []string
+	body = soCodeBlockRe.ReplaceAllStringFunc(body, func(m string) string {
+		code := soCodeBlockRe.FindStringSubmatch(m)[1]
+		blocks = append(blocks, "```\n"+strings.TrimRight(html.UnescapeString(code), "\n")+"\n```")
+		return fmt.Sprintf("\x00%d\x00", len(blocks)-1)
+	})
+	body = soInlineCodeRe.ReplaceAllString(body, "`$1`")
+	body = strings.ReplaceAll(body, "<li>", "- ")
+	body = soBreakRe.ReplaceAllString(body, "\n")
+	body = htmlTagRe.ReplaceAllString(body, "")
+	body = html.UnescapeString(body)
+	for i, b := range blocks {
+		body = strings.Replace(body, fmt.Sprintf("\x00%d\x00", i), "\n"+b+"\n", 1)
+	}
+	body = soBlankLinesRe.ReplaceAllString(body, "\n\n")
+	return strings.TrimSpace(body)
 }
 
-// ── Tool / API definitions ─────────────────────────────────────────
+// fetchStackOverflow searches StackOverflow for `query` and returns the
+// best matching answered question with its accepted answer and the top
+// alternative as markdown. Tags can be given in brackets, e.g. "[go] timeout".
+func fetchStackOverflow(ctx context.Context, query string) (text string, questionID int, err error) {
+	var tags []string
+	for _, m := range soTagRe.FindAllStringSubmatch(query, -1) {
+		tags = append(tags, m[1])
+	}
+	q := strings.TrimSpace(soTagRe.ReplaceAllString(query, " "))
+
+	params := url.Values{}
+	params.Set("order", "desc")
+	params.Set("sort", "relevance")
+	params.Set("answers", "1")
+	params.Set("pagesize", "5")
+	if q != "" {
+		params.Set("q", q)
+	}
+	if len(tags) > 0 {
+		params.Set("tagged", strings.Join(tags, ";"))
+	}
+	var questions []struct {
+		QuestionID       int      `json:"question_id"`
+		Title            string   `json:"title"`
+		Score            int      `json:"score"`
+		Link             string   `json:"link"`
+		Tags             []string `json:"tags"`
+		AcceptedAnswerID int      `json:"accepted_answer_id"`
+	}
+	if err := stackExchangeGet(ctx, "search/advanced", params, &questions); err != nil {
+		return "", 0, err
+	}
+	if len(questions) == 0 {
+		return "", 0, fmt.Errorf("StackOverflow returned no results for %q", query)
+	}
+	best := questions[0]
+	for _, qu := range questions {
+		if qu.AcceptedAnswerID != 0 {
+			best = qu
+			break
+		}
+	}
 
-// toolDef describes a built-in or custom tool available to the assistant.
-type toolDef struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	ParamHint   string `json:"param_hint"`
+	params = url.Values{}
+	params.Set("order", "desc")
+	params.Set("sort", "votes")
+	params.Set("filter", "withbody")
+	params.Set("pagesize", "10")
+	var answers []struct {
+		AnswerID   int    `json:"answer_id"`
+		Score      int    `json:"score"`
+		IsAccepted bool   `json:"is_accepted"`
+		Body       string `json:"body"`
+	}
+	if err := stackExchangeGet(ctx, fmt.Sprintf("questions/%d/answers", best.QuestionID), params, &answers); err != nil {
+		return "", 0, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", html.UnescapeString(best.Title))
+	fmt.Fprintf(&b, "Score: %d", best.Score)
+	if len(best.Tags) > 0 {
+		fmt.Fprintf(&b, " · Tags: %s", strings.Join(best.Tags, ", "))
+	}
+	fmt.Fprintf(&b, "\n%s\n", best.Link)
+	alternative := false
+	for _, a := range answers {
+		if a.IsAccepted {
+			fmt.Fprintf(&b, "\n## Akzeptierte Antwort (Score %d)\n\n%s\n", a.Score, stackOverflowBodyToMarkdown(a.Body))
+		}
+	}
+	for _, a := range answers {
+		if !a.IsAccepted && !alternative {
+			fmt.Fprintf(&b, "\n## Alternative Antwort (Score %d)\n\n%s\n", a.Score, stackOverflowBodyToMarkdown(a.Body))
+			alternative = true
+		}
+	}
+	if len(answers) == 0 {
+		b.WriteString("\n(Keine Antworten verfügbar.)\n")
+	}
+	return b.String(), best.QuestionID, nil
 }
 
-// persona represents a user-selectable assistant persona with a
-// pre-prompt that influences system behavior.
-type persona struct {
-	ID     string `json:"id"`
-	Name   string `json:"name"`
-	Prompt string `json:"prompt"`
+// ─────────────────────────────────────────────────────────────────────────────
+// Weather (Open-Meteo)
+// ─────────────────────────────────────────────────────────────────────────────
+
+// geoPlace is a single Open-Meteo geocoding result.
+type geoPlace struct {
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Country   string  `json:"country"`
+	Admin1    string  `json:"admin1"`
 }
 
-// toolRequest is the structured marker the assistant can emit to
-// request that the frontend run a specific tool with a query.
-type toolRequest struct {
-	Tool  string `json:"tool"`
-	Query string `json:"query"`
+func (p geoPlace) label() string {
+	parts := []string{p.Name}
+	if p.Admin1 != "" && p.Admin1 != p.Name {
+		parts = append(parts, p.Admin1)
+	}
+	if p.Country != "" {
+		parts = append(parts, p.Country)
+	}
+	return strings.Join(parts, ", ")
 }
 
-var builtinTools = []toolDef{
-	{
-		Name:        "wikipedia",
-		Description: "Sucht einen Wikipedia-Artikel und lädt dessen Volltext. Verwende dies für Fakten über Personen, Orte, Ereignisse, Wissenschaft etc.",
-		ParamHint:   "Artikelname (z.B. 'Sonnensystem', 'Albert_Einstein')",
-	},
-	{
-		Name:        "duckduckgo",
-		Description: "Durchsucht das Web über DuckDuckGo und liefert eine Kurzantwort. Gut für aktuelle Fakten, Definitionen, kurze Zusammenfassungen.",
-		ParamHint:   "Suchbegriff (z.B. 'Hauptstadt von Frankreich')",
-	},
-	{
-		Name:        "wiktionary",
-		Description: "Schlägt ein Wort im Wiktionary (Wörterbuch) nach. Liefert Bedeutung, Etymologie, Übersetzungen.",
-		ParamHint:   "Einzelnes Wort (z.B. 'Apfel', 'serendipity')",
-	},
-	{
-		Name:        "stackoverflow",
-		Description: "Sucht relevante StackOverflow-Antworten (gut für Programmierfragen).",
-		ParamHint:   "Suchbegriff (z.B. 'go http client timeout')",
-	},
-	{
-		Name:        "websearch",
-		Description: "Allgemeine Websuche (DuckDuckGo-basiert) für breite Recherchen.",
-		ParamHint:   "Suchbegriff (z.B. 'Wetter Berlin heute')",
-	},
-	{
-		Name:        "nanogo",
-		Description: "Führt sicheren, interpretierten Go-Code (nanoGo) aus. Muss in den Einstellungen aktiviert werden.",
-		ParamHint:   "Go-Quelltext (kurze Snippets)",
-	},
-	{
-		Name:        "llm",
-		Description: "Führe einen direkten Prompt gegen das konfigurierte LLM aus (für kreative Antworten oder kurze Analysen).",
-		ParamHint:   "Prompt / Frage",
-	},
-	{
-		Name:        "calculate",
-		Description: "Führt eine sichere Berechnung aus (arithmetische Ausdrücke). Nutzt das eingebundene smallR für Evaluation.",
-		ParamHint:   "Expression (z.B. '3*2+(2^3)')",
-	},
-	{
-		Name:        "exec_code",
-		Description: "Führt (sichere) Code-Analysen oder -Ausführungen durch. Standardmäßig nur statische Prüfungen; Ausführung muss in den Einstellungen aktiviert werden.",
-		ParamHint:   "Quelltext (z.B. Go code)",
-	},
+// getJSON fetches `u` and decodes the JSON response into `out`.
+func getJSON(ctx context.Context, u string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
+	resp, err := newHTTPClient(15 * time.Second).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("HTTP %d for %s", resp.StatusCode, u)
+	}
+	return json.NewDecoder(limitBody(resp.Body, maxJSONBytes)).Decode(out)
 }
 
-// ── Custom API store (persisted through settingsStore) ──────────────
+// geocode looks up `name` via the Open-Meteo geocoding API.
+func geocode(ctx context.Context, name, lang string) ([]geoPlace, error) {
+	u := fmt.Sprintf(
+		"https://geocoding-api.open-meteo.com/v1/search?name=%s&count=5&language=%s&format=json",
+		url.QueryEscape(name), url.QueryEscape(lang),
+	)
+	var res struct {
+		Results []geoPlace `json:"results"`
+	}
+	if err := getJSON(ctx, u, &res); err != nil {
+		return nil, err
+	}
+	return res.Results, nil
+}
 
-// customAPI models a user-added external API template persisted in settings.
-type customAPI struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	Template string `json:"template"` // URL with $q placeholder
-	Desc     string `json:"desc"`
+// resolvePlace geocodes a location like "Berlin" or "Springfield, Illinois".
+// The part after the first comma narrows the matches by region or country.
+// For unknown places the error lists the closest matches of shorter queries.
+func resolvePlace(ctx context.Context, query, lang string) (geoPlace, error) {
+	name, region, _ := strings.Cut(query, ",")
+	name, region = strings.TrimSpace(name), strings.ToLower(strings.TrimSpace(region))
+	places, err := geocode(ctx, name, lang)
+	if err != nil {
+		return geoPlace{}, err
+	}
+	for _, p := range places {
+		if region == "" || strings.Contains(strings.ToLower(p.Admin1+" "+p.Country), region) {
+			return p, nil
+		}
+	}
+
+	suggestions := places
+	if len(suggestions) == 0 {
+		var tries []string
+		if fields := strings.Fields(name); len(fields) > 1 {
+			tries = append(tries, fields[0])
+		}
+		if r := []rune(name); len(r) > 4 {
+			tries = append(tries, string(r[:4]))
+		}
+		for _, t := range tries {
+			if suggestions, err = geocode(ctx, t, lang); err == nil && len(suggestions) > 0 {
+				break
+			}
+		}
+	}
+	if len(suggestions) == 0 {
+		return geoPlace{}, fmt.Errorf("Ort %q nicht gefunden", query)
+	}
+	labels := make([]string, 0, len(suggestions))
+	for _, p := range suggestions {
+		labels = append(labels, p.label())
+	}
+	return geoPlace{}, fmt.Errorf("Ort %q nicht gefunden. Meintest du: %s?", query, strings.Join(labels, "; "))
 }
 
-// apiStore manages the set of persisted custom APIs through settings.
-type apiStore struct {
-	mu       sync.Mutex
-	settings *settingsStore
+// weatherCodeText describes a WMO weather code in German or English.
+func weatherCodeText(code int, lang string) string {
+	type desc struct{ de, en string }
+	var d desc
+	switch {
+	case code == 0:
+		d = desc{"klar", "clear sky"}
+	case code <= 2:
+		d = desc{"leicht bewölkt", "partly cloudy"}
+	case code == 3:
+		d = desc{"bedeckt", "overcast"}
+	case code == 45 || code == 48:
+		d = desc{"Nebel", "fog"}
+	case code >= 51 && code <= 57:
+		d = desc{"Nieselregen", "drizzle"}
+	case code >= 61 && code <= 67:
+		d = desc{"Regen", "rain"}
+	case code >= 71 && code <= 77:
+		d = desc{"Schnee", "snow"}
+	case code >= 80 && code <= 82:
+		d = desc{"Regenschauer", "rain showers"}
+	case code == 85 || code == 86:
+		d = desc{"Schneeschauer", "snow showers"}
+	case code >= 95:
+		d = desc{"Gewitter", "thunderstorm"}
+	default:
+		return fmt.Sprintf("WMO %d", code)
+	}
+	if lang == "de" {
+		return d.de
+	}
+	return d.en
 }
 
-// newAPIStore creates an apiStore backed by `settings`.
-func newAPIStore(settings *settingsStore) *apiStore {
-	return &apiStore{settings: settings}
+// fetchWeather returns current conditions and a 3-day forecast for
+// `query` from Open-Meteo as a markdown table.
+func fetchWeather(ctx context.Context, query, lang string) (string, error) {
+	place, err := resolvePlace(ctx, query, lang)
+	if err != nil {
+		return "", err
+	}
+	u := fmt.Sprintf(
+		"https://api.open-meteo.com/v1/forecast?latitude=%.4f&longitude=%.4f"+
+			"&current=temperature_2m,apparent_temperature,relative_humidity_2m,weather_code,wind_speed_10m"+
+			"&daily=weather_code,temperature_2m_max,temperature_2m_min,precipitation_sum,precipitation_probability_max"+
+			"&timezone=auto&forecast_days=3",
+		place.Latitude, place.Longitude,
+	)
+	var res struct {
+		Current struct {
+			Time        string  `json:"time"`
+			Temperature float64 `json:"temperature_2m"`
+			Apparent    float64 `json:"apparent_temperature"`
+			Humidity    float64 `json:"relative_humidity_2m"`
+			WeatherCode int     `json:"weather_code"`
+			Wind        float64 `json:"wind_speed_10m"`
+		} `json:"current"`
+		Daily struct {
+			Time        []string  `json:"time"`
+			WeatherCode []int     `json:"weather_code"`
+			TempMax     []float64 `json:"temperature_2m_max"`
+			TempMin     []float64 `json:"temperature_2m_min"`
+			Precip      []float64 `json:"precipitation_sum"`
+			PrecipProb  []float64 `json:"precipitation_probability_max"`
+		} `json:"daily"`
+	}
+	if err := getJSON(ctx, u, &res); err != nil {
+		return "", err
+	}
+
+	de := lang == "de"
+	var b strings.Builder
+	c := res.Current
+	if de {
+		fmt.Fprintf(&b, "## Wetter für %s\n\nAktuell (%s): %s, %.1f °C (gefühlt %.1f °C), Luftfeuchte %.0f %%, Wind %.0f km/h\n\n",
+			place.label(), c.Time, weatherCodeText(c.WeatherCode, lang), c.Temperature, c.Apparent, c.Humidity, c.Wind)
+		b.WriteString("| Tag | Wetter | Min | Max | Niederschlag |\n|---|---|---|---|---|\n")
+	} else {
+		fmt.Fprintf(&b, "## Weather for %s\n\nCurrent (%s): %s, %.1f °C (feels like %.1f °C), humidity %.0f %%, wind %.0f km/h\n\n",
+			place.label(), c.Time, weatherCodeText(c.WeatherCode, lang), c.Temperature, c.Apparent, c.Humidity, c.Wind)
+		b.WriteString("| Day | Weather | Min | Max | Precipitation |\n|---|---|---|---|---|\n")
+	}
+	d := res.Daily
+	for i, day := range d.Time {
+		if i >= len(d.WeatherCode) || i >= len(d.TempMin) || i >= len(d.TempMax) || i >= len(d.Precip) {
+			break
+		}
+		precip := fmt.Sprintf("%.1f mm", d.Precip[i])
+		if i < len(d.PrecipProb) {
+			precip += fmt.Sprintf(" (%.0f %%)", d.PrecipProb[i])
+		}
+		fmt.Fprintf(&b, "| %s | %s | %.1f °C | %.1f °C | %s |\n",
+			day, weatherCodeText(d.WeatherCode[i], lang), d.TempMin[i], d.TempMax[i], precip)
+	}
+	b.WriteString("\n(Quelle: Open-Meteo)\n")
+	return b.String(), nil
 }
 
-// list returns a copy of configured custom APIs.
-func (s *apiStore) list() []customAPI {
-	s.settings.mu.Lock()
-	defer s.settings.mu.Unlock()
-	out := make([]customAPI, len(s.settings.s.CustomAPIs))
-	copy(out, s.settings.s.CustomAPIs)
-	return out
+// ─────────────────────────────────────────────────────────────────────────────
+// Unit and currency conversion
+// ─────────────────────────────────────────────────────────────────────────────
+
+// unitDef is a unit of measurement: value in base unit = v*factor + offset.
+type unitDef struct {
+	symbol string
+	dim    string
+	factor float64
+	offset float64
 }
 
-// add registers a new custom API template and persists settings.
-func (s *apiStore) add(name, template, desc string) (customAPI, error) {
-	s.settings.mu.Lock()
-	defer s.settings.mu.Unlock()
-	api := customAPI{
-		ID:       fmt.Sprintf("api-%d", time.Now().UnixNano()),
-		Name:     name,
-		Template: template,
-		Desc:     desc,
+var unitTable = func() map[string]unitDef {
+	m := map[string]unitDef{}
+	add := func(u unitDef, aliases ...string) {
+		m[strings.ToLower(u.symbol)] = u
+		for _, a := range aliases {
+			m[a] = u
+		}
+	}
+	// length (meter)
+	add(unitDef{"m", "length", 1, 0}, "meter", "metre", "meters", "metres")
+	add(unitDef{"km", "length", 1000, 0}, "kilometer", "kilometre", "kilometers", "kilometres")
+	add(unitDef{"cm", "length", 0.01, 0}, "zentimeter", "centimeter", "centimeters", "centimetre")
+	add(unitDef{"mm", "length", 0.001, 0}, "millimeter", "millimeters", "millimetre")
+	add(unitDef{"mi", "length", 1609.344, 0}, "mile", "miles", "meile", "meilen")
+	add(unitDef{"nmi", "length", 1852, 0}, "seemeile", "seemeilen", "nautical mile", "nautical miles")
+	add(unitDef{"yd", "length", 0.9144, 0}, "yard", "yards")
+	add(unitDef{"ft", "length", 0.3048, 0}, "foot", "feet", "fuß", "fuss")
+	add(unitDef{"in", "length", 0.0254, 0}, "inch", "inches", "zoll", `"`)
+	// mass (kilogram)
+	add(unitDef{"kg", "mass", 1, 0}, "kilogramm", "kilogram", "kilograms", "kilo", "kilos")
+	add(unitDef{"g", "mass", 0.001, 0}, "gramm", "gram", "grams")
+	add(unitDef{"mg", "mass", 1e-6, 0}, "milligramm", "milligram", "milligrams")
+	add(unitDef{"t", "mass", 1000, 0}, "tonne", "tonnen", "tonnes")
+	add(unitDef{"lb", "mass", 0.45359237, 0}, "lbs", "pound", "pounds")
+	add(unitDef{"Pfund", "mass", 0.5, 0}, "pfd")
+	add(unitDef{"oz", "mass", 0.028349523125, 0}, "ounce", "ounces", "unze", "unzen")
+	// temperature (kelvin)
+	add(unitDef{"°C", "temperature", 1, 273.15}, "c", "celsius", "grad celsius", "grad")
+	add(unitDef{"°F", "temperature", 5.0 / 9, 273.15 - 32*5.0/9}, "f", "fahrenheit", "grad fahrenheit")
+	add(unitDef{"K", "temperature", 1, 0}, "kelvin")
+	// data size (byte)
+	add(unitDef{"B", "data", 1, 0}, "byte", "bytes")
+	add(unitDef{"bit", "data", 0.125, 0}, "bits")
+	for i, p := range []string{"k", "m", "g", "t", "p"} {
+		dec, bin := math.Pow(1000, float64(i+1)), math.Pow(1024, float64(i+1))
+		up := strings.ToUpper(p)
+		add(unitDef{up + "B", "data", dec, 0}, p+"byte", p+"bytes")
+		add(unitDef{up + "iB", "data", bin, 0}, p+"ibyte", p+"ibytes")
+	}
+	return m
+}()
+
+// currencyAliases maps symbols and German/English names to ISO codes.
+var currencyAliases = map[string]string{
+	"€": "EUR", "euro": "EUR", "euros": "EUR",
+	"$": "USD", "us$": "USD", "dollar": "USD", "dollars": "USD", "us-dollar": "USD",
+	"£": "GBP", "pfund sterling": "GBP", "sterling": "GBP",
+	"¥": "JPY", "yen": "JPY",
+	"fr": "CHF", "franken": "CHF",
+}
+
+var convertRe = regexp.MustCompile(`(?i)([-+]?\d+(?:[.,]\d+)?)\s*(.+?)\s+(?:to|in|into|nach|zu|als|->|=)\s+(.+?)\s*[?.!]*\s*$`)
+
+// parseConversion extracts amount, source and target unit from queries
+// like "25 miles to km", "100 USD in EUR" or "30 Grad Celsius in Fahrenheit".
+func parseConversion(q string) (float64, string, string, error) {
+	m := convertRe.FindStringSubmatch(strings.TrimSpace(q))
+	if m == nil {
+		return 0, "", "", fmt.Errorf("Format: <Zahl> <Einheit> in <Einheit> (z.B. '25 mi in km', '100 USD in EUR')")
 	}
-	s.settings.s.CustomAPIs = append(s.settings.s.CustomAPIs, api)
-	if err := s.settings.saveLocked(); err != nil {
-		return customAPI{}, err
+	amount, err := strconv.ParseFloat(strings.ReplaceAll(m[1], ",", "."), 64)
+	if err != nil {
+		return 0, "", "", err
 	}
-	return api, nil
+	return amount, strings.TrimSpace(m[2]), strings.TrimSpace(m[3]), nil
 }
 
-// remove deletes a custom API by id and persists the change.
-func (s *apiStore) remove(id string) (bool, error) {
-	s.settings.mu.Lock()
-	defer s.settings.mu.Unlock()
-	apis := s.settings.s.CustomAPIs
-	for i, a := range apis {
-		if a.ID == id {
-			s.settings.s.CustomAPIs = append(apis[:i], apis[i+1:]...)
-			return true, s.settings.saveLocked()
+// lookupCurrency resolves a currency symbol, name or ISO code.
+func lookupCurrency(s string) (string, bool) {
+	l := strings.ToLower(s)
+	if c, ok := currencyAliases[l]; ok {
+		return c, true
+	}
+	if len(s) != 3 {
+		return "", false
+	}
+	for _, r := range l {
+		if r < 'a' || r > 'z' {
+			return "", false
 		}
 	}
-	return false, nil
+	return strings.ToUpper(s), true
 }
 
-// ── Persona store (persisted through settingsStore) ───────────────
+// convertAmount converts `amount` between units or currencies and returns
+// the result with its conversion factor (and rate date for currencies).
+func convertAmount(ctx context.Context, query string) (string, error) {
+	amount, fromS, toS, err := parseConversion(query)
+	if err != nil {
+		return "", err
+	}
+	from, okF := unitTable[strings.ToLower(fromS)]
+	to, okT := unitTable[strings.ToLower(toS)]
+	if okF && okT {
+		if from.dim != to.dim {
+			return "", fmt.Errorf("%s (%s) lässt sich nicht in %s (%s) umrechnen", from.symbol, from.dim, to.symbol, to.dim)
+		}
+		base := amount*from.factor + from.offset
+		result := (base - to.offset) / to.factor
+		out := fmt.Sprintf("%s %s = %s %s\n", formatNumber(amount), from.symbol, formatNumber(result), to.symbol)
+		if from.offset == 0 && to.offset == 0 {
+			out += fmt.Sprintf("Faktor: 1 %s = %s %s\n", from.symbol, formatNumber(from.factor/to.factor), to.symbol)
+		}
+		return out, nil
+	}
 
-// personaStore manages persisted personas stored inside settings.
-type personaStore struct {
-	mu       sync.Mutex
-	settings *settingsStore
+	fromC, okF := lookupCurrency(fromS)
+	toC, okT := lookupCurrency(toS)
+	if !okF || !okT {
+		return "", fmt.Errorf("unbekannte Einheit oder Währung: %q / %q", fromS, toS)
+	}
+	rate, date, err := currencyRate(ctx, fromC, toC)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s = %s %s\nKurs: 1 %s = %s %s (EZB-Referenzkurs vom %s)\n",
+		formatNumber(amount), fromC, formatNumber(math.Round(amount*rate*100)/100), toC,
+		fromC, formatNumber(rate), toC, date), nil
 }
 
-// newPersonaStore constructs a personaStore backed by `settings`.
-func newPersonaStore(settings *settingsStore) *personaStore {
-	return &personaStore{settings: settings}
+// formatNumber prints `v` with up to 10 significant digits and no exponent.
+func formatNumber(v float64) string {
+	r, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', 10, 64), 64)
+	return strconv.FormatFloat(r, 'f', -1, 64)
 }
 
-// list returns a copy of all configured personas.
-func (p *personaStore) list() []persona {
-	p.settings.mu.Lock()
-	defer p.settings.mu.Unlock()
-	out := make([]persona, len(p.settings.s.Personas))
-	copy(out, p.settings.s.Personas)
-	return out
+// currencyRates caches daily ECB rates from the Frankfurter API.
+var currencyRates = struct {
+	mu      sync.Mutex
+	entries map[string]currencyRateEntry
+}{entries: map[string]currencyRateEntry{}}
+
+type currencyRateEntry struct {
+	rate    float64
+	date    string
+	fetched time.Time
 }
 
-// defaultID returns the ID of the first persona or an empty string.
-func (p *personaStore) defaultID() string {
-	p.settings.mu.Lock()
-	defer p.settings.mu.Unlock()
-	if len(p.settings.s.Personas) == 0 {
-		return ""
+// currencyRate returns the exchange rate from -> to and the date of the
+// rate. Rates are cached for six hours since the ECB publishes daily.
+func currencyRate(ctx context.Context, from, to string) (float64, string, error) {
+	if from == to {
+		return 1, time.Now().Format("2006-01-02"), nil
 	}
-	return p.settings.s.Personas[0].ID
+	key := from + "/" + to
+	currencyRates.mu.Lock()
+	e, ok := currencyRates.entries[key]
+	currencyRates.mu.Unlock()
+	if ok && time.Since(e.fetched) < 6*time.Hour {
+		return e.rate, e.date, nil
+	}
+
+	var res struct {
+		Date  string             `json:"date"`
+		Rates map[string]float64 `json:"rates"`
+	}
+	u := fmt.Sprintf("https://api.frankfurter.app/latest?from=%s&to=%s", url.QueryEscape(from), url.QueryEscape(to))
+	if err := getJSON(ctx, u, &res); err != nil {
+		return 0, "", fmt.Errorf("Wechselkurs %s: %w", key, err)
+	}
+	rate, ok := res.Rates[to]
+	if !ok {
+		return 0, "", fmt.Errorf("kein Wechselkurs für %s verfügbar", key)
+	}
+	currencyRates.mu.Lock()
+	currencyRates.entries[key] = currencyRateEntry{rate: rate, date: res.Date, fetched: time.Now()}
+	currencyRates.mu.Unlock()
+	return rate, res.Date, nil
 }
 
-// get retrieves a persona by id.
-func (p *personaStore) get(id string) (persona, bool) {
-	p.settings.mu.Lock()
-	defer p.settings.mu.Unlock()
-	for _, per := range p.settings.s.Personas {
-		if per.ID == id {
-			return per, true
+// ─────────────────────────────────────────────────────────────────────────────
+// Wiktionary / Dictionary
+// ─────────────────────────────────────────────────────────────────────────────
+
+// fetchWiktionary fetches a plain-text extract for `word` from the
+// specified Wiktionary language and returns a formatted string.
+func fetchWiktionary(ctx context.Context, word, lang string) (string, error) {
+	u := fmt.Sprintf(
+		"https://%s.wiktionary.org/w/api.php?action=query&prop=extracts&explaintext=1&titles=%s&format=json",
+		lang, url.QueryEscape(word),
+	)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "tinyRAG/1.1 (https://github.com/SimonWaldherr/tinyRAG)")
+	resp, err := newHTTPClient(15 * time.Second).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := readLimited(resp.Body, maxJSONBytes)
+	if err != nil {
+		return "", fmt.Errorf("Wiktionary: %w", err)
+	}
+	var result struct {
+		Query struct {
+			Pages map[string]struct {
+				Title   string `json:"title"`
+				Extract string `json:"extract"`
+			} `json:"pages"`
+		} `json:"query"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	for _, p := range result.Query.Pages {
+		if p.Extract == "" {
+			return "", fmt.Errorf("no Wiktionary entry found for %q", word)
 		}
+		return fmt.Sprintf("Wiktionary: %s\n\n%s", p.Title, p.Extract), nil
 	}
-	return persona{}, false
+	return "", fmt.Errorf("no Wiktionary entry found for %q", word)
 }
 
-// add creates and persists a new persona with the given name and prompt.
-func (p *personaStore) add(name, prompt string) (persona, error) {
-	name = strings.TrimSpace(name)
-	prompt = strings.TrimSpace(prompt)
-	if name == "" {
-		return persona{}, fmt.Errorf("name required")
+// ─────────────────────────────────────────────────────────────────────────────
+// Text chunker
+// ─────────────────────────────────────────────────────────────────────────────
+
+// chunkText splits `text` into paragraphs and joins them into chunks
+// of at most `maxLen` characters for embedding and storage.
+func chunkText(text string, maxLen int) []string {
+	paragraphs := strings.Split(text, "\n")
+	var chunks []string
+	var buf strings.Builder
+	for _, p := range paragraphs {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if buf.Len()+len(p)+1 > maxLen && buf.Len() > 0 {
+			chunks = append(chunks, buf.String())
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(p)
+	}
+	if buf.Len() > 0 {
+		chunks = append(chunks, buf.String())
 	}
-	p.settings.mu.Lock()
-	defer p.settings.mu.Unlock()
-	per := persona{
-		ID:     fmt.Sprintf("persona-%d", time.Now().UnixNano()),
-		Name:   name,
-		Prompt: prompt,
+	return chunks
+}
+
+// estimateTokens returns a rough token count for `text` using the
+// common heuristic of about four characters per token.
+func estimateTokens(text string) int {
+	n := len([]rune(text))
+	if n == 0 {
+		return 0
 	}
-	p.settings.s.Personas = append(p.settings.s.Personas, per)
-	return per, p.settings.saveLocked()
+	return (n + 3) / 4
 }
 
-// remove deletes a persona by id and persists the change.
-func (p *personaStore) remove(id string) (bool, error) {
-	p.settings.mu.Lock()
-	defer p.settings.mu.Unlock()
-	list := p.settings.s.Personas
-	for i, per := range list {
-		if per.ID == id {
-			p.settings.s.Personas = append(list[:i], list[i+1:]...)
-			return true, p.settings.saveLocked()
+// truncate shortens `s` to at most `n` characters, ellipsis included.
+// It cuts at a character boundary and, if there is one in the last
+// quarter, at the last space before the limit.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+	r := []rune(s)
+	cut := n - 1
+	for i := cut; i > cut*3/4; i-- {
+		if unicode.IsSpace(r[i]) {
+			cut = i
+			break
 		}
 	}
-	return false, nil
+	return strings.TrimRightFunc(string(r[:cut]), unicode.IsSpace) + "…"
 }
 
-// get returns a customAPI by id if it exists.
-func (s *apiStore) get(id string) (customAPI, bool) {
-	s.settings.mu.Lock()
-	defer s.settings.mu.Unlock()
-	for _, a := range s.settings.s.CustomAPIs {
-		if a.ID == id {
-			return a, true
+// ── File text decoding ─────────────────────────────────────────────
+
+// errBinaryFile is returned by decodeFileText for content that is not text.
+var errBinaryFile = errors.New("skipped: binary")
+
+// binarySniffBytes is how much of a file decodeFileText inspects.
+const binarySniffBytes = 8 << 10
+
+// decodeFileText returns the content of an imported file as UTF-8. A
+// UTF-8 BOM is dropped, UTF-16 with BOM and other non-UTF-8 text is
+// transcoded (the latter as Windows-1252, a superset of Latin-1).
+// Content whose first 8 KB hold a NUL byte, or more than 30% control
+// characters and invalid UTF-8 bytes, fails with errBinaryFile.
+func decodeFileText(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		data = data[3:]
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return decodeUTF16(data[2:], binary.LittleEndian), nil
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return decodeUTF16(data[2:], binary.BigEndian), nil
+	}
+	head := data[:min(len(data), binarySniffBytes)]
+	if bytes.IndexByte(head, 0) >= 0 {
+		return "", errBinaryFile
+	}
+	suspicious := 0
+	for i := 0; i < len(head); {
+		r, size := utf8.DecodeRune(head[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			// A sequence cut off at the end of head is not suspicious.
+			if len(head) < len(data) && len(head)-i < utf8.UTFMax {
+				i = len(head)
+				continue
+			}
+			suspicious++
+		case r == 0x7F, r < 0x20 && !strings.ContainsRune("\t\n\r\f", r):
+			suspicious++
 		}
+		i += size
 	}
-	return customAPI{}, false
+	if suspicious*10 > len(head)*3 {
+		return "", errBinaryFile
+	}
+	if utf8.Valid(data) {
+		return string(data), nil
+	}
+	return decodeWindows1252(data), nil
 }
 
-// allTools returns the union of builtin tools and persisted custom APIs.
-func (s *apiStore) allTools() []toolDef {
-	all := make([]toolDef, len(builtinTools))
-	copy(all, builtinTools)
+// decodeUTF16 decodes UTF-16 text without BOM in byte order `order`.
+func decodeUTF16(data []byte, order binary.ByteOrder) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
 
-	s.settings.mu.Lock()
-	defer s.settings.mu.Unlock()
+// cp1252High maps the bytes 0x80-0x9F of Windows-1252 to runes; the
+// rest of the code page equals Latin-1. Unassigned bytes map to the
+// C1 control of the same value.
+var cp1252High = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
 
-	for _, a := range s.settings.s.CustomAPIs {
-		desc := a.Desc
-		if desc == "" {
-			desc = "Custom API: " + a.Template
+// decodeWindows1252 transcodes Windows-1252 text to UTF-8.
+func decodeWindows1252(data []byte) string {
+	var b strings.Builder
+	b.Grow(len(data) + len(data)/8)
+	for _, c := range data {
+		switch {
+		case c < 0x80:
+			b.WriteByte(c)
+		case c < 0xA0:
+			b.WriteRune(cp1252High[c-0x80])
+		default:
+			b.WriteRune(rune(c))
 		}
-		all = append(all, toolDef{
-			Name:        a.ID,
-			Description: desc,
-			ParamHint:   "Suchbegriff (wird in $q eingesetzt)",
-		})
 	}
-	return all
+	return b.String()
 }
 
-var toolRequestRe = regexp.MustCompile(`\[TOOL_REQUEST\]\s*(\{[^}]+\})\s*\[/TOOL_REQUEST\]`)
+// ─────────────────────────────────────────────────────────────────────────────
+// OpenAI-compatible client (LM Studio, Ollama, …)
+// ─────────────────────────────────────────────────────────────────────────────
 
-// buildToolSystemPrompt constructs the system prompt describing
-// available tools and how the assistant should emit tool requests.
-func buildToolSystemPrompt(ctxText string, tools []toolDef) string {
-	var sb strings.Builder
-	sb.WriteString("Du bist ein hilfreicher Assistent. Beantworte Fragen basierend auf dem bereitgestellten Kontext.\n\n")
-	sb.WriteString("## Verfügbare Such-APIs\n")
-	sb.WriteString("Wenn der Kontext NICHT genügend Informationen enthält, um die Frage zuverlässig zu beantworten, ")
-	sb.WriteString("kannst du dem Nutzer vorschlagen, eine der folgenden Suchfunktionen zu verwenden. ")
-	sb.WriteString("Schreibe dazu am ENDE deiner Antwort einen Tool-Request in exakt diesem Format:\n\n")
-	sb.WriteString("[TOOL_REQUEST]{\"tool\":\"<name>\",\"query\":\"<suchbegriff>\"}[/TOOL_REQUEST]\n\n")
-	sb.WriteString("Verfügbare Tools:\n")
-	for _, t := range tools {
-		sb.WriteString(fmt.Sprintf("- **%s**: %s (Parameter: %s)\n", t.Name, t.Description, t.ParamHint))
-	}
-	sb.WriteString("\nWichtig:\n")
-	sb.WriteString("- Schlage nur EIN Tool pro Antwort vor.\n")
-	sb.WriteString("- Gib trotzdem eine kurze Antwort mit dem was du weißt, bevor du den Tool-Request anfügst.\n")
-	sb.WriteString("- Wenn der Kontext ausreicht, antworte normal OHNE Tool-Request.\n")
-	sb.WriteString("- Der Tool-Request muss EXAKT das Format [TOOL_REQUEST]{...}[/TOOL_REQUEST] haben.\n\n")
-	sb.WriteString("Kontext:\n")
-	sb.WriteString(ctxText)
-	return sb.String()
-}
-
-// ── Debug / Search models ─────────────────────────────────────────
+// lmClient is a small OpenAI-compatible client used for embeddings
+// and chat completions against local or remote LLM endpoints.
+type lmClient struct {
+	base       string
+	embedModel string
+	chatModel  string
+	apiKey     string
+	http       *http.Client
 
-// debugChunk contains information about a retrieved chunk useful for
-// emitting debug payloads back to the frontend.
-type debugChunk struct {
-	Score      float64 `json:"score"`
-	Content    string  `json:"content"`
-	Article    string  `json:"article"`
-	ChunkIdx   int     `json:"chunk_idx"`
-	IsNeighbor bool    `json:"is_neighbor"`
-}
+	// embedDims truncates embeddings to this many dimensions (0 = all).
+	embedDims int
+	// generation counts the clients installed by setLM; requests report
+	// it to show which settings they ran with.
+	generation int
 
-// debugInfo aggregates retrieval timing and chunk-level debug data.
-type debugInfo struct {
-	Chunks      []debugChunk `json:"chunks"`
-	EmbedMs     int64        `json:"embed_ms"`
-	SearchMs    int64        `json:"search_ms"`
-	TotalChunks int          `json:"total_chunks"`
-	UsedK       int          `json:"used_k"`
-	Decision    string       `json:"decision,omitempty"`
+	// Optional sampling parameters sent with chat requests.
+	temperature *float64
+	maxTokens   int
 }
 
-// debugModels records which LLM endpoint and models were used for a request.
-type debugModels struct {
-	BaseURL    string `json:"base_url"`
-	ChatModel  string `json:"chat_model"`
-	EmbedModel string `json:"embed_model"`
+// newLMClient constructs an `lmClient` configured for the given
+// base URL, model names and optional API key.
+func newLMClient(base, embedModel, chatModel, apiKey string) *lmClient {
+	return &lmClient{
+		base:       normalizeBaseURL(base),
+		embedModel: embedModel,
+		chatModel:  chatModel,
+		apiKey:     apiKey,
+		http:       newHTTPClient(120 * time.Second),
+	}
 }
 
-// debugPayload is the top-level debug information emitted alongside
-// SSE responses to help diagnose retrieval and model behavior.
-type debugPayload struct {
-	RequestID          string      `json:"request_id"`
-	Mode               string      `json:"mode"`
-	AutoSearch         bool        `json:"auto_search"`
-	Offline            bool        `json:"offline"`
-	Deep               bool        `json:"deep"`
-	Question           string      `json:"question"`
-	UsedK              int         `json:"used_k"`
-	BaseK              int         `json:"base_k"`
-	ChunkSize          int         `json:"chunk_size"`
-	TotalChunks        int         `json:"total_chunks"`
-	ContextChars       int         `json:"context_chars"`
-	SystemPromptChars  int         `json:"system_prompt_chars"`
-	HistoryMessages    int         `json:"history_messages"`
-	StorageMode        string      `json:"storage_mode"`
-	DBPath             string      `json:"db_path"`
-	Models             debugModels `json:"models"`
-	Retrieval          *debugInfo  `json:"retrieval"`
-	PersonaID          string      `json:"persona_id"`
-	PersonaName        string      `json:"persona_name"`
-	PersonaPromptChars int         `json:"persona_prompt_chars"`
+// withParams returns a copy of the client that chats with the model and
+// sampling parameters of `g`.
+func (c *lmClient) withParams(g genParams) *lmClient {
+	cc := *c
+	if g.Model != "" {
+		cc.chatModel = g.Model
+	}
+	cc.temperature, cc.maxTokens = g.Temperature, g.MaxTokens
+	return &cc
 }
 
-// prepareContext does the embedding + vector search and returns the context string and optional debug info.
-// prepareContext computes embeddings for `question`, runs a vector
-// search against the DB and returns the assembled context text and
-// optional debug information.
-func (r *ragSystem) prepareContext(question string, debug bool) (string, *debugInfo, error) {
-	// First, try a refined search query for entity-like questions.
-	searchQuery := refineSearchQuery(question)
-
-	t0 := time.Now()
-	qvec, err := r.getLM().embedSingle(searchQuery)
+// newRequest builds a request to the LLM endpoint, authorized with the
+// API key if one is configured.
+func (c *lmClient) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		return "", nil, err
-	}
-	embedMs := time.Since(t0).Milliseconds()
-
-	// Special-case: if the refined searchQuery matches an article we have
-	// stored, return that article's chunks (including neighbors implicitly
-	// by returning adjacent content).
-	acheck := fmt.Sprintf("SELECT COUNT(*) AS cnt FROM chunks WHERE article = '%s'", escapeSQ(searchQuery))
-	ast, aerr := tinysql.ParseSQL(acheck)
-	if aerr == nil {
-		r.dbMu.Lock()
-		ars, aerr2 := tinysql.Execute(context.Background(), r.db, "default", ast)
-		r.dbMu.Unlock()
-		if aerr2 == nil && ars != nil && len(ars.Rows) > 0 {
-			v, _ := tinysql.GetVal(ars.Rows[0], "cnt")
-			cnt := 0
-			switch nv := v.(type) {
-			case int:
-				cnt = nv
-			case int64:
-				cnt = int(nv)
-			case float64:
-				cnt = int(nv)
-			}
-			if cnt > 0 {
-				// fetch all chunks for the article
-				fq := fmt.Sprintf("SELECT chunk_idx, content FROM chunks WHERE article = '%s' ORDER BY chunk_idx", escapeSQ(searchQuery))
-				fst, _ := tinysql.ParseSQL(fq)
-				r.dbMu.Lock()
-				frs, _ := tinysql.Execute(context.Background(), r.db, "default", fst)
-				r.dbMu.Unlock()
-				var parts []string
-				var dbgChunks []debugChunk
-				if frs != nil {
-					for _, row := range frs.Rows {
-						c, ok := tinysql.GetVal(row, "content")
-						if !ok {
-							continue
-						}
-						idxVal, _ := tinysql.GetVal(row, "chunk_idx")
-						idx := 0
-						switch iv := idxVal.(type) {
-						case int:
-							idx = iv
-						case int64:
-							idx = int(iv)
-						case float64:
-							idx = int(iv)
-						}
-						s := fmt.Sprintf("%v", c)
-						parts = append(parts, s)
-						if debug {
-							dbgChunks = append(dbgChunks, debugChunk{Score: -1, Content: s, Article: searchQuery, ChunkIdx: idx, IsNeighbor: false})
-						}
-					}
-				}
-				di := &debugInfo{Chunks: dbgChunks, EmbedMs: embedMs, SearchMs: 0, TotalChunks: r.docCount(), UsedK: r.k, Decision: "article_specific"}
-				return strings.Join(parts, "\n---\n"), di, nil
-			}
-		}
+		return nil, err
 	}
-
-	t1 := time.Now()
-	// Initial quick retrieval: fetch a larger candidate set to allow
-	// filtering by high-confidence threshold.
-	limit := 100
-	if r.k*3 > limit {
-		limit = r.k * 3
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
 	}
-	const maxLimit = 1000
-	if limit > maxLimit {
-		limit = maxLimit
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
-	q := fmt.Sprintf(
-		"SELECT content, article, chunk_idx, VEC_COSINE_SIMILARITY(embedding, VEC_FROM_JSON('%s')) AS score FROM chunks ORDER BY score DESC LIMIT %d",
-		vecJSON(qvec), limit,
-	)
+	return req, nil
+}
 
-	r.dbMu.Lock()
-	stmt, err := tinysql.ParseSQL(q)
+// ping checks the LLM endpoint for reachability by requesting
+// the list of available models.
+func (c *lmClient) ping() error {
+	req, err := c.newRequest(context.Background(), "GET", c.base+"/v1/models", nil)
 	if err != nil {
-		r.dbMu.Unlock()
-		return "", nil, err
+		return err
 	}
-	rs, err := tinysql.Execute(context.Background(), r.db, "default", stmt)
-	r.dbMu.Unlock()
-
+	resp, err := c.http.Do(req)
 	if err != nil {
-		return "", nil, err
+		return err
 	}
-	searchMs := time.Since(t1).Milliseconds()
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("LLM endpoint returned %d", resp.StatusCode)
+	}
+	return nil
+}
 
-	rows := rs.Rows
+// modelsResp is a helper for parsing the /v1/models response.
+type modelsResp struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
 
-	type chunkHit struct {
-		article  string
-		chunkIdx int
-		content  string
-		score    float64
+// listModels queries the LLM endpoint for available model IDs,
+// optionally overriding the client's base URL.
+func (c *lmClient) listModels(ctx context.Context, baseOverride string) ([]string, error) {
+	base := c.base
+	if strings.TrimSpace(baseOverride) != "" {
+		base = normalizeBaseURL(baseOverride)
 	}
-	var hits []chunkHit
-	for _, row := range rows {
-		c, ok := tinysql.GetVal(row, "content")
-		if !ok {
-			continue
-		}
-		cStr := fmt.Sprintf("%v", c)
-		art, _ := tinysql.GetVal(row, "article")
-		artStr := fmt.Sprintf("%v", art)
-		idxVal, _ := tinysql.GetVal(row, "chunk_idx")
-		idx := 0
-		switch iv := idxVal.(type) {
-		case int:
-			idx = iv
-		case int64:
-			idx = int(iv)
-		case float64:
-			idx = int(iv)
-		}
-		scoreVal, _ := tinysql.GetVal(row, "score")
-		s := 0.0
-		switch sv := scoreVal.(type) {
-		case float64:
-			s = sv
-		case int:
-			s = float64(sv)
-		}
-		hits = append(hits, chunkHit{article: artStr, chunkIdx: idx, content: cStr, score: s})
+	req, err := c.newRequest(ctx, "GET", base+"/v1/models", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create models request: %w", err)
 	}
-
-	// If we have a clear high-confidence hit, return context immediately.
-	const highThreshold = 0.90
-	var primaryCount int
-	for _, h := range hits {
-		if h.score > highThreshold {
-			primaryCount++
-		}
+	resp, err := newHTTPClient(10 * time.Second).Do(req)
+	if err != nil {
+		return nil, err
 	}
-
-	type chunkKey struct {
-		article  string
-		chunkIdx int
+	defer resp.Body.Close()
+	raw, readErr := readLimited(resp.Body, maxLLMBytes)
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read models response: %w", readErr)
 	}
-
-	// Helper to assemble context from selected hits (and neighbors)
-	assemble := func(sel []chunkHit, usedK int, decision string) (string, *debugInfo, error) {
-		seen := make(map[chunkKey]bool)
-		for _, h := range hits {
-			seen[chunkKey{h.article, h.chunkIdx}] = true
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("models HTTP %d: %s", resp.StatusCode, string(raw))
+	}
+	var mr modelsResp
+	if err := json.Unmarshal(raw, &mr); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, d := range mr.Data {
+		if d.ID != "" {
+			out = append(out, d.ID)
 		}
-		var contextParts []string
-		var dbgChunks []debugChunk
-		for _, h := range sel {
-			prevKey := chunkKey{h.article, h.chunkIdx - 1}
-			if h.chunkIdx > 0 && !seen[prevKey] {
-				seen[prevKey] = true
-				if prevContent, ok := r.fetchNeighborContent(h.article, h.chunkIdx-1); ok {
-					contextParts = append(contextParts, prevContent)
-					dbgChunks = append(dbgChunks, debugChunk{Score: -1, Content: prevContent, Article: h.article, ChunkIdx: h.chunkIdx - 1, IsNeighbor: true})
-				}
-			}
+	}
+	sort.Strings(out)
+	return out, nil
+}
 
-			contextParts = append(contextParts, h.content)
-			dbgChunks = append(dbgChunks, debugChunk{Score: h.score, Content: h.content, Article: h.article, ChunkIdx: h.chunkIdx, IsNeighbor: false})
+// embReq represents an embeddings request payload.
+type embReq struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
 
-			nextKey := chunkKey{h.article, h.chunkIdx + 1}
-			if !seen[nextKey] {
-				seen[nextKey] = true
-				if nextContent, ok := r.fetchNeighborContent(h.article, h.chunkIdx+1); ok {
-					contextParts = append(contextParts, nextContent)
-					dbgChunks = append(dbgChunks, debugChunk{Score: -1, Content: nextContent, Article: h.article, ChunkIdx: h.chunkIdx + 1, IsNeighbor: true})
-				}
-			}
-		}
-		di := &debugInfo{Chunks: dbgChunks, EmbedMs: embedMs, SearchMs: searchMs, TotalChunks: r.docCount(), UsedK: usedK, Decision: decision}
-		return strings.Join(contextParts, "\n---\n"), di, nil
-	}
+// embResp represents an embeddings response payload.
+type embResp struct {
+	Data []struct {
+		// Index is the position of the input; backends that leave it
+		// out are taken to answer in input order.
+		Index     *int      `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+}
 
-	// If high-confidence primary found, use those hits (top k by score)
-	if primaryCount > 0 {
-		var sel []chunkHit
-		for _, h := range hits {
-			if h.score > highThreshold {
-				sel = append(sel, h)
-				if len(sel) >= r.k {
-					break
-				}
-			}
-		}
-		return assemble(sel, r.k, "high_confidence")
+// embed sends multiple `texts` to the embedding endpoint and returns
+// their vector embeddings, one per text in the same order. Some
+// backends silently drop inputs above their token limit, so a reply
+// with a vector missing fails instead of pairing the remaining vectors
+// with the wrong texts.
+func (c *lmClient) embed(ctx context.Context, texts []string) ([][]float64, error) {
+	defer lmActivity.track()()
+	body, err := json.Marshal(embReq{Model: c.embedModel, Input: texts})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embed request: %w", err)
 	}
-
-	// Prepare a concise summary of top candidates to let the LM decide
-	// whether more retrieval is needed.
-	var summaryParts []string
-	topN := 5
-	if len(hits) < topN {
-		topN = len(hits)
+	req, err := c.newRequest(ctx, "POST", c.base+"/v1/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embed request: %w", err)
 	}
-	for i := 0; i < topN; i++ {
-		h := hits[i]
-		summaryParts = append(summaryParts, fmt.Sprintf("%s (score=%.4f)", h.article, h.score))
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
 	}
-	summary := strings.Join(summaryParts, "; ")
-
-	// Ask LM whether to answer directly or retrieve more context.
-	decisionMap, derr := r.analyzeQuestion(question, summary)
-	if derr != nil {
-		// Fallback: perform relaxed retrieval
-		var sel []chunkHit
-		thresh := 0.60
-		for _, h := range hits {
-			if h.score >= thresh {
-				sel = append(sel, h)
-				if len(sel) >= r.k {
-					break
-				}
-			}
+	defer resp.Body.Close()
+	raw, readErr := readLimited(resp.Body, maxLLMBytes)
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read embeddings response: %w", readErr)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("embed %d: %s", resp.StatusCode, string(raw))
+	}
+	var er embResp
+	if err := json.Unmarshal(raw, &er); err != nil {
+		return nil, err
+	}
+	vecs, err := alignEmbeddings(er, texts)
+	if err != nil || c.embedDims <= 0 {
+		return vecs, err
+	}
+	for i, v := range vecs {
+		if vecs[i], err = truncateEmbedding(v, c.embedDims); err != nil {
+			return nil, err
 		}
-		return assemble(sel, r.k, "relaxed_fallback")
 	}
+	return vecs, nil
+}
 
-	action, _ := decisionMap["action"].(string)
-	if strings.ToUpper(action) == "ANSWER_DIRECT" {
-		// Let the chat model answer without extra context.
-		di := &debugInfo{EmbedMs: embedMs, SearchMs: searchMs, TotalChunks: r.docCount(), UsedK: 0, Decision: "answer_direct"}
-		return "", di, nil
+// truncateEmbedding keeps the first `n` dimensions of `v` and scales
+// them back to unit length. Models trained with Matryoshka loss keep
+// most of their quality this way; other models lose a lot.
+func truncateEmbedding(v []float64, n int) ([]float64, error) {
+	if len(v) < n {
+		return nil, fmt.Errorf("embedding has %d dimensions, embed_dimensions is %d", len(v), n)
+	}
+	if len(v) == n {
+		return v, nil
 	}
+	out := slices.Clone(v[:n])
+	var norm float64
+	for _, x := range out {
+		norm += x * x
+	}
+	if norm == 0 {
+		return out, nil
+	}
+	norm = math.Sqrt(norm)
+	for i := range out {
+		out[i] /= norm
+	}
+	return out, nil
+}
 
-	// Otherwise, gather retrieval parameters and perform relaxed retrieval.
-	desiredK := r.k
-	if v, ok := decisionMap["k"]; ok {
-		if fv, ok2 := v.(float64); ok2 {
-			desiredK = int(fv)
+// alignEmbeddings orders the vectors of `er` by their index, or takes
+// them in order if the backend sent none, and checks that every text
+// of `texts` got exactly one non-empty vector.
+func alignEmbeddings(er embResp, texts []string) ([][]float64, error) {
+	vecs := make([][]float64, len(texts))
+	indexed := len(er.Data) > 0 && er.Data[0].Index != nil
+	for i, d := range er.Data {
+		at := i
+		if indexed {
+			if d.Index == nil {
+				return nil, fmt.Errorf("embedding %d has no index while others have one", i)
+			}
+			at = *d.Index
 		}
-	}
-	thresh := 0.60
-	if v, ok := decisionMap["threshold"]; ok {
-		if fv, ok2 := v.(float64); ok2 {
-			thresh = fv
+		if at < 0 || at >= len(texts) {
+			return nil, fmt.Errorf("embedding index %d out of range for %d inputs", at, len(texts))
 		}
-	}
-	// Optionally allow the LM to suggest a refined query
-	if v, ok := decisionMap["query"]; ok {
-		if qs, ok2 := v.(string); ok2 && strings.TrimSpace(qs) != "" {
-			searchQuery = qs
+		if vecs[at] != nil {
+			return nil, fmt.Errorf("embedding index %d returned twice", at)
+		}
+		if len(d.Embedding) == 0 {
+			return nil, fmt.Errorf("empty embedding for input %d (%d chars)", at, utf8.RuneCountInString(texts[at]))
 		}
+		vecs[at] = d.Embedding
 	}
-
-	var sel []chunkHit
-	for _, h := range hits {
-		if h.score >= thresh {
-			sel = append(sel, h)
-			if len(sel) >= desiredK {
-				break
+	if len(er.Data) == len(texts) {
+		return vecs, nil
+	}
+	if indexed {
+		for i, v := range vecs {
+			if v == nil {
+				return nil, fmt.Errorf("embedding endpoint returned %d vectors for %d inputs: input %d (%d chars) is missing", len(er.Data), len(texts), i, utf8.RuneCountInString(texts[i]))
 			}
 		}
 	}
-	if len(sel) == 0 && len(hits) > 0 {
-		// fallback to top-k by score
-		for i := 0; i < desiredK && i < len(hits); i++ {
-			sel = append(sel, hits[i])
+	// Without indices the missing input is unknown; the longest one is
+	// the likely culprit.
+	longest := 0
+	for i, t := range texts {
+		if len(t) > len(texts[longest]) {
+			longest = i
 		}
 	}
-	return assemble(sel, desiredK, "lm_requested_retrieval")
+	return nil, fmt.Errorf("embedding endpoint returned %d vectors for %d inputs; the longest is input %d (%d chars), shorter chunks may help", len(er.Data), len(texts), longest, utf8.RuneCountInString(texts[longest]))
 }
 
-// prepareContextWithK does the same as prepareContext but allows specifying k (number of primary hits)
-// prepareContextWithK behaves like prepareContext but allows specifying
-// the number `k` of primary retrieval hits to consider.
-func (r *ragSystem) prepareContextWithK(question string, debug bool, k int) (string, *debugInfo, error) {
-	// refine query for entity-like questions
-	searchQuery := refineSearchQuery(question)
-
-	t0 := time.Now()
-	qvec, err := r.getLM().embedSingle(searchQuery)
+// embedSingle returns the embedding vector for a single text input.
+func (c *lmClient) embedSingle(ctx context.Context, text string) ([]float64, error) {
+	vecs, err := c.embed(ctx, []string{text})
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
-	embedMs := time.Since(t0).Milliseconds()
-
-	t1 := time.Now()
-	// initial candidate limit
-	limit := 100
-	if k*3 > limit {
-		limit = k * 3
-	}
-	const maxLimit = 1000
-	if limit > maxLimit {
-		limit = maxLimit
+	if len(vecs) == 0 {
+		return nil, fmt.Errorf("no embedding returned")
 	}
-	q := fmt.Sprintf(
-		"SELECT content, article, chunk_idx, VEC_COSINE_SIMILARITY(embedding, VEC_FROM_JSON('%s')) AS score FROM chunks ORDER BY score DESC LIMIT %d",
-		vecJSON(qvec), limit,
-	)
+	return vecs[0], nil
+}
 
-	r.dbMu.Lock()
-	stmt, err := tinysql.ParseSQL(q)
-	if err != nil {
-		r.dbMu.Unlock()
-		return "", nil, err
-	}
-	rs, err := tinysql.Execute(context.Background(), r.db, "default", stmt)
-	r.dbMu.Unlock()
+// chatReq models the request payload for chat completions.
+type chatReq struct {
+	Model       string    `json:"model"`
+	Messages    []chatMsg `json:"messages"`
+	Stream      bool      `json:"stream"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	MaxTokens   int       `json:"max_tokens,omitempty"`
+	// ResponseFormat constrains the reply, e.g. to a JSON object.
+	ResponseFormat *responseFormat `json:"response_format,omitempty"`
+}
+
+// responseFormat is the OpenAI response_format request field.
+type responseFormat struct {
+	Type string `json:"type"`
+}
+
+// chatMsg represents a single chat message with a role and content.
+type chatMsg struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// chatStream streams tokens from the chat completion endpoint and
+// writes them to `w` as they arrive.
+func (c *lmClient) chatStream(ctx context.Context, system string, msgs []chatMsg, w io.Writer) error {
+	_, err := c.streamRequest(ctx, chatReq{Model: c.chatModel, Messages: withSystem(system, msgs), Stream: true, Temperature: c.temperature, MaxTokens: c.maxTokens}, w)
+	return err
+}
+
+// withSystem returns `msgs` preceded by the system message `system`.
+func withSystem(system string, msgs []chatMsg) []chatMsg {
+	all := make([]chatMsg, 0, len(msgs)+1)
+	all = append(all, chatMsg{Role: "system", Content: system})
+	return append(all, msgs...)
+}
 
+// streamRequest sends the streaming chat request `cr` and writes the
+// tokens to `w` as they arrive. It returns the HTTP status, 0 if there
+// was no response.
+func (c *lmClient) streamRequest(ctx context.Context, cr chatReq, w io.Writer) (int, error) {
+	defer lmActivity.track()()
+	body, err := json.Marshal(cr)
 	if err != nil {
-		return "", nil, err
+		return 0, fmt.Errorf("failed to marshal chat request: %w", err)
 	}
-	searchMs := time.Since(t1).Milliseconds()
 
-	rows := rs.Rows
-
-	type chunkHit struct {
-		article  string
-		chunkIdx int
-		content  string
-		score    float64
+	req, err := c.newRequest(ctx, "POST", c.base+"/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
-	var hits []chunkHit
-	for _, row := range rows {
-		c, ok := tinysql.GetVal(row, "content")
-		if !ok {
-			continue
-		}
-		cStr := fmt.Sprintf("%v", c)
-		art, _ := tinysql.GetVal(row, "article")
-		artStr := fmt.Sprintf("%v", art)
-		idxVal, _ := tinysql.GetVal(row, "chunk_idx")
-		idx := 0
-		switch iv := idxVal.(type) {
-		case int:
-			idx = iv
-		case int64:
-			idx = int(iv)
-		case float64:
-			idx = int(iv)
-		}
-		scoreVal, _ := tinysql.GetVal(row, "score")
-		s := 0.0
-		switch sv := scoreVal.(type) {
-		case float64:
-			s = sv
-		case int:
-			s = float64(sv)
-		}
-		hits = append(hits, chunkHit{article: artStr, chunkIdx: idx, content: cStr, score: s})
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("chat request failed: %w", err)
 	}
-
-	const highThreshold = 0.90
-	var primaryCount int
-	for _, h := range hits {
-		if h.score > highThreshold {
-			primaryCount++
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		raw, readErr := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if readErr != nil {
+			return resp.StatusCode, fmt.Errorf("chat HTTP %d (failed to read body: %v)", resp.StatusCode, readErr)
 		}
+		return resp.StatusCode, fmt.Errorf("chat HTTP %d: %s", resp.StatusCode, string(raw))
 	}
 
-	type chunkKey struct {
-		article  string
-		chunkIdx int
-	}
+	inThink := false
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 1024*1024)
 
-	assemble := func(sel []chunkHit, usedK int, decision string) (string, *debugInfo, error) {
-		seen := make(map[chunkKey]bool)
-		for _, h := range hits {
-			seen[chunkKey{h.article, h.chunkIdx}] = true
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
 		}
-		var contextParts []string
-		var dbgChunks []debugChunk
-		for _, h := range sel {
-			prevKey := chunkKey{h.article, h.chunkIdx - 1}
-			if h.chunkIdx > 0 && !seen[prevKey] {
-				seen[prevKey] = true
-				if prevContent, ok := r.fetchNeighborContent(h.article, h.chunkIdx-1); ok {
-					contextParts = append(contextParts, prevContent)
-					dbgChunks = append(dbgChunks, debugChunk{Score: -1, Content: prevContent, Article: h.article, ChunkIdx: h.chunkIdx - 1, IsNeighbor: true})
-				}
+		data := strings.TrimPrefix(line, "data: ")
+		if data == "[DONE]" {
+			break
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if json.Unmarshal([]byte(data), &chunk) == nil && len(chunk.Choices) > 0 {
+			tok := chunk.Choices[0].Delta.Content
+			// Some local models wrap "thinking" in markers; strip them from the UI
+			if strings.Contains(tok, "[THINK]") {
+				inThink = true
+				tok = strings.ReplaceAll(tok, "[THINK]", "")
 			}
-
-			contextParts = append(contextParts, h.content)
-			dbgChunks = append(dbgChunks, debugChunk{Score: h.score, Content: h.content, Article: h.article, ChunkIdx: h.chunkIdx, IsNeighbor: false})
-
-			nextKey := chunkKey{h.article, h.chunkIdx + 1}
-			if !seen[nextKey] {
-				seen[nextKey] = true
-				if nextContent, ok := r.fetchNeighborContent(h.article, h.chunkIdx+1); ok {
-					contextParts = append(contextParts, nextContent)
-					dbgChunks = append(dbgChunks, debugChunk{Score: -1, Content: nextContent, Article: h.article, ChunkIdx: h.chunkIdx + 1, IsNeighbor: true})
-				}
+			if strings.Contains(tok, "[/THINK]") {
+				inThink = false
+				tok = strings.ReplaceAll(tok, "[/THINK]", "")
+			}
+			if !inThink && tok != "" {
+				fmt.Fprint(w, tok)
 			}
 		}
-		di := &debugInfo{Chunks: dbgChunks, EmbedMs: embedMs, SearchMs: searchMs, TotalChunks: r.docCount(), UsedK: usedK, Decision: decision}
-		return strings.Join(contextParts, "\n---\n"), di, nil
 	}
+	return resp.StatusCode, scanner.Err()
+}
 
-	if primaryCount > 0 {
-		var sel []chunkHit
-		for _, h := range hits {
-			if h.score > highThreshold {
-				sel = append(sel, h)
-				if len(sel) >= k {
-					break
-				}
-			}
-		}
-		return assemble(sel, k, "high_confidence")
+// jsonModeUnsupported holds the endpoints ("base\x00model") that
+// rejected response_format; chatJSON asks them without it.
+var jsonModeUnsupported sync.Map
+
+// chatJSON runs a completion at temperature 0, asking for a JSON object
+// reply where the backend supports it. With a writer `w` the reply is
+// streamed to it as well, otherwise it is requested without streaming.
+// A backend that rejects response_format (HTTP 400 or 422) is asked
+// again without it.
+func (c *lmClient) chatJSON(ctx context.Context, system string, msgs []chatMsg, w io.Writer) (string, error) {
+	run := func(jsonMode bool) (string, int, error) {
+		if w == nil {
+			return c.complete(ctx, system, msgs, jsonMode)
+		}
+		var buf bytes.Buffer
+		cr := c.auxRequest(system, msgs, jsonMode)
+		cr.Stream = true
+		status, err := c.streamRequest(ctx, cr, io.MultiWriter(&buf, w))
+		return buf.String(), status, err
+	}
+	key := c.base + "\x00" + c.chatModel
+	_, unsupported := jsonModeUnsupported.Load(key)
+	out, status, err := run(!unsupported)
+	if err != nil && !unsupported && (status == 400 || status == 422) {
+		jsonModeUnsupported.Store(key, true)
+		log.Printf("LLM %s rejected response_format json_object, retrying without: %v", c.chatModel, err)
+		out, _, err = run(false)
+	}
+	return out, err
+}
+
+// auxRequest builds the request of an auxiliary completion: temperature
+// 0 and, with `jsonMode`, a JSON object reply.
+func (c *lmClient) auxRequest(system string, msgs []chatMsg, jsonMode bool) chatReq {
+	zero := 0.0
+	cr := chatReq{Model: c.chatModel, Messages: withSystem(system, msgs), Temperature: &zero, MaxTokens: c.maxTokens}
+	if jsonMode {
+		cr.ResponseFormat = &responseFormat{Type: "json_object"}
 	}
+	return cr
+}
 
-	// Summarize top candidates
-	var summaryParts []string
-	topN := 5
-	if len(hits) < topN {
-		topN = len(hits)
+// complete runs a non-streaming auxiliary completion (see auxRequest)
+// and returns the reply with the HTTP status.
+func (c *lmClient) complete(ctx context.Context, system string, msgs []chatMsg, jsonMode bool) (string, int, error) {
+	defer lmActivity.track()()
+	body, err := json.Marshal(c.auxRequest(system, msgs, jsonMode))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to marshal chat request: %w", err)
 	}
-	for i := 0; i < topN; i++ {
-		h := hits[i]
-		summaryParts = append(summaryParts, fmt.Sprintf("%s (score=%.4f)", h.article, h.score))
+	req, err := c.newRequest(ctx, "POST", c.base+"/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
-	summary := strings.Join(summaryParts, "; ")
-
-	decisionMap, derr := r.analyzeQuestion(question, summary)
-	if derr != nil {
-		var sel []chunkHit
-		thresh := 0.60
-		for _, h := range hits {
-			if h.score >= thresh {
-				sel = append(sel, h)
-				if len(sel) >= k {
-					break
-				}
-			}
-		}
-		return assemble(sel, k, "relaxed_fallback")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("chat request failed: %w", err)
 	}
-
-	action, _ := decisionMap["action"].(string)
-	if strings.ToUpper(action) == "ANSWER_DIRECT" {
-		di := &debugInfo{EmbedMs: embedMs, SearchMs: searchMs, TotalChunks: r.docCount(), UsedK: 0, Decision: "answer_direct"}
-		return "", di, nil
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return "", resp.StatusCode, fmt.Errorf("chat HTTP %d: %s", resp.StatusCode, string(raw))
 	}
-
-	desiredK := k
-	if v, ok := decisionMap["k"]; ok {
-		if fv, ok2 := v.(float64); ok2 {
-			desiredK = int(fv)
-		}
+	var out struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
 	}
-	thresh := 0.60
-	if v, ok := decisionMap["threshold"]; ok {
-		if fv, ok2 := v.(float64); ok2 {
-			thresh = fv
-		}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return "", resp.StatusCode, fmt.Errorf("invalid chat response: %w", err)
 	}
-	if v, ok := decisionMap["query"]; ok {
-		if qs, ok2 := v.(string); ok2 && strings.TrimSpace(qs) != "" {
-			searchQuery = qs
-		}
+	if len(out.Choices) == 0 {
+		return "", resp.StatusCode, fmt.Errorf("chat response without choices")
 	}
+	return out.Choices[0].Message.Content, resp.StatusCode, nil
+}
 
-	var sel []chunkHit
-	for _, h := range hits {
-		if h.score >= thresh {
-			sel = append(sel, h)
-			if len(sel) >= desiredK {
-				break
-			}
-		}
-	}
-	if len(sel) == 0 && len(hits) > 0 {
-		for i := 0; i < desiredK && i < len(hits); i++ {
-			sel = append(sel, hits[i])
-		}
+// lmActivity records when the LLM endpoint was last used for embeddings
+// or chat completions and how many such requests are running.
+var lmActivity activityTracker
+
+// activityTracker tracks requests to the LLM endpoint for the model
+// warmer, which only pings an idle endpoint.
+type activityTracker struct {
+	mu       sync.Mutex
+	last     time.Time
+	inFlight int
+}
+
+// track marks the start of a request; the returned func marks its end.
+func (a *activityTracker) track() func() {
+	a.mu.Lock()
+	a.inFlight++
+	a.last = time.Now()
+	a.mu.Unlock()
+	return func() {
+		a.mu.Lock()
+		a.inFlight--
+		a.last = time.Now()
+		a.mu.Unlock()
 	}
-	return assemble(sel, desiredK, "lm_requested_retrieval")
 }
 
-// refineSearchQuery attempts to extract an entity-like phrase from the
-// user's question (e.g., "was weißt du über Ettling") to narrow the
-// retrieval query. Falls back to the original question.
-func refineSearchQuery(q string) string {
-	q = strings.TrimSpace(q)
-	low := strings.ToLower(q)
-	patterns := []string{
-		`was weißt du über (.+)`,
-		`wer ist (.+)`,
-		`erzähl mir von (.+)`,
-		`tell me about (.+)`,
-		`who is (.+)`,
+// idle returns how long no request has run, 0 while one is running.
+func (a *activityTracker) idle() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.inFlight > 0 {
+		return 0
 	}
-	for _, p := range patterns {
-		re := regexp.MustCompile(`(?i)` + p)
-		if m := re.FindStringSubmatch(low); len(m) >= 2 {
-			candidate := strings.TrimSpace(m[1])
-			// restore original casing by finding candidate in original
-			idx := strings.Index(strings.ToLower(q), candidate)
-			if idx >= 0 {
-				return strings.TrimSpace(q[idx : idx+len(candidate)])
-			}
-			return candidate
-		}
+	if a.last.IsZero() {
+		return time.Duration(math.MaxInt64)
 	}
-	return q
+	return time.Since(a.last)
 }
 
-// analyzeQuestion asks the LM to decide whether to answer directly or
-// to request additional retrieval. It returns a parsed map with at
-// least an "action" key (ANSWER_DIRECT or RETRIEVE_MORE) and optional
-// parameters (k, threshold, query).
-func (r *ragSystem) analyzeQuestion(question, summary string) (map[string]any, error) {
-	system := `You are an analysis agent. Given a user question and a short summary of retrieval candidates, decide whether the assistant can answer directly or needs more retrieval.
+// warmCheckEvery is how often the warmer looks at the idle time.
+const warmCheckEvery = 30 * time.Second
 
-Return ONLY a single JSON object and nothing else (no explanation, no extra text). Examples:
-	{"action":"ANSWER_DIRECT"}
-	{"action":"RETRIEVE_MORE","k":10,"threshold":0.6,"query":"Ettling"}
+// warmRecent is the idle time below which POST /api/warmup assumes the
+// models are still loaded and skips the ping.
+const warmRecent = time.Minute
 
-Deutsch:
-Du bist ein Analyse-Agent. Gegeben eine Nutzerfrage und eine kurze Zusammenfassung der Retrieval-Kandidaten entscheide, ob der Assistent direkt antworten soll oder zusätzliche Kontextsuche benötigt.
+// warmTimeout bounds one warm-up; loading a large model takes a while.
+const warmTimeout = 3 * time.Minute
 
-Gib AUSSCHLIESSLICH ein einzelnes JSON-Objekt zurück (keine Erklärungen oder zusätzlichen Text). Beispiele:
-	{"action":"ANSWER_DIRECT"}
-	{"action":"RETRIEVE_MORE","k":10,"threshold":0.6,"query":"Ettling"}
-`
-	user := fmt.Sprintf("Question: %s\n\nCandidates: %s", question, summary)
-	msgs := []chatMsg{{Role: "user", Content: user}}
+// warmResult reports one warm-up: how long the embedding and the chat
+// completion took.
+type warmResult struct {
+	EmbedMS int64 `json:"embed_ms"`
+	ChatMS  int64 `json:"chat_ms"`
+}
 
-	var buf bytes.Buffer
-	if err := r.getLM().chatStream(context.Background(), system, msgs, &buf); err != nil {
-		return nil, err
-	}
-	out := buf.String()
-	// Try to find the first JSON object in the output
-	i := strings.Index(out, "{")
-	if i == -1 {
-		// fallback heuristic
-		if strings.Contains(strings.ToUpper(out), "ANSWER_DIRECT") {
-			return map[string]any{"action": "ANSWER_DIRECT"}, nil
+// modelWarmer keeps the models of local servers loaded. LM Studio and
+// Ollama unload them after a while without requests, and the next
+// question waits until they are loaded again.
+type modelWarmer struct {
+	mu      sync.Mutex
+	running bool
+	failing bool // the last warm-up failed; logged once per outage
+}
+
+// warmer is the warmer of the web server.
+var warmer = &modelWarmer{}
+
+// run pings the endpoint of `rag` whenever it has been idle for the
+// keep_warm interval of the settings. It never returns.
+func (mw *modelWarmer) run(rag *ragSystem, settings *settingsStore) {
+	for range time.Tick(warmCheckEvery) {
+		kw := settings.get().KeepWarm
+		if !kw.Enabled || rag.lmError() != nil || lmActivity.idle() < kw.interval() {
+			continue
 		}
-		return map[string]any{"action": "RETRIEVE_MORE", "k": r.k, "threshold": 0.6}, nil
-	}
-	var m map[string]any
-	if err := json.Unmarshal([]byte(out[i:]), &m); err != nil {
-		return nil, err
+		mw.warm(context.Background(), rag.getLM(), "idle")
 	}
-	return m, nil
 }
 
-// fetchNeighborContent loads the content of a chunk at (article, chunk_idx).
-// fetchNeighborContent returns the content for a specific chunk index
-// of an article, used to include context neighbors around hits.
-func (r *ragSystem) fetchNeighborContent(article string, chunkIdx int) (string, bool) {
-	q := fmt.Sprintf(
-		"SELECT content FROM chunks WHERE article = '%s' AND chunk_idx = %d",
-		escapeSQ(article), chunkIdx,
-	)
-	stmt, err := tinysql.ParseSQL(q)
+// warm sends a one-word embedding and a 1-token chat completion to `lm`
+// and logs how long they took. It returns errWarmRunning if a warm-up
+// is already running.
+func (mw *modelWarmer) warm(ctx context.Context, lm *lmClient, reason string) (warmResult, error) {
+	mw.mu.Lock()
+	if mw.running {
+		mw.mu.Unlock()
+		return warmResult{}, errWarmRunning
+	}
+	mw.running = true
+	mw.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, warmTimeout)
+	defer cancel()
+	var res warmResult
+	start := time.Now()
+	_, err := lm.embed(ctx, []string{"ping"})
+	res.EmbedMS = time.Since(start).Milliseconds()
+	if err == nil {
+		start = time.Now()
+		_, _, err = lm.withParams(genParams{MaxTokens: 1}).complete(ctx, "Reply with one word.", []chatMsg{{Role: "user", Content: "ping"}}, false)
+		res.ChatMS = time.Since(start).Milliseconds()
+	}
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	mw.running = false
 	if err != nil {
-		return "", false
-	}
-
-	r.dbMu.Lock()
-	rs, err := tinysql.Execute(context.Background(), r.db, "default", stmt)
-	r.dbMu.Unlock()
-
-	if err != nil || rs == nil || len(rs.Rows) == 0 {
-		return "", false
+		if !mw.failing {
+			log.Printf("warm-up (%s) failed: %v", reason, err)
+		}
+		mw.failing = true
+		return res, err
 	}
-	c, ok := tinysql.GetVal(rs.Rows[0], "content")
-	if !ok {
-		return "", false
+	if mw.failing {
+		log.Printf("warm-up (%s) works again", reason)
 	}
-	return fmt.Sprintf("%v", c), true
+	mw.failing = false
+	log.Printf("warm-up (%s): embed %d ms, chat %d ms", reason, res.EmbedMS, res.ChatMS)
+	return res, nil
 }
 
-// listSources returns distinct article names with their chunk counts
-// listSources returns metadata about stored articles and their chunk counts.
-func (r *ragSystem) listSources() []map[string]any {
-	q := "SELECT article, COUNT(*) AS cnt FROM chunks GROUP BY article ORDER BY article"
-	stmt, err := tinysql.ParseSQL(q)
-	if err != nil {
-		return nil
-	}
+// errWarmRunning is returned by warm while another warm-up runs.
+var errWarmRunning = errors.New("warm-up already running")
 
-	r.dbMu.Lock()
-	rs, err := tinysql.Execute(context.Background(), r.db, "default", stmt)
-	r.dbMu.Unlock()
+// ─────────────────────────────────────────────────────────────────────────────
+// RAG system
+// ─────────────────────────────────────────────────────────────────────────────
 
-	if err != nil || rs == nil {
-		return nil
-	}
-	var sources []map[string]any
-	for _, row := range rs.Rows {
-		art, ok1 := tinysql.GetVal(row, "article")
-		cnt, ok2 := tinysql.GetVal(row, "cnt")
-		if ok1 && ok2 {
-			sources = append(sources, map[string]any{"article": fmt.Sprintf("%v", art), "chunks": cnt})
-		}
+// vecJSON marshals a float64 slice into a JSON string for SQL usage.
+func vecJSON(v []float64) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		// This should never happen with float64 slices, but handle it anyway
+		log.Printf("Warning: failed to marshal vector: %v", err)
+		return "[]"
 	}
-	return sources
+	return string(b)
 }
 
-// deleteSource removes all chunks belonging to `article` and persists
-// the change.
-func (r *ragSystem) deleteSource(article string) error {
-	q := fmt.Sprintf("DELETE FROM chunks WHERE article = '%s'", escapeSQ(article))
+// qvecParam stands for the query vector in statements for parseVecQuery.
+const qvecParam = "'$qvec'"
+
+// parseVecQuery parses `q` with the vector `vec` in place of qvecParam.
+// tinySQL has no parameter binding, and a VEC_FROM_JSON literal is
+// decoded again for every row, so the vector is set directly on the
+// parsed literal. Should tinySQL's AST no longer allow that, the vector
+// is inlined as JSON instead.
+func parseVecQuery(q string, vec []float64) (tinysql.Statement, error) {
 	stmt, err := tinysql.ParseSQL(q)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	r.dbMu.Lock()
-	_, err = tinysql.Execute(context.Background(), r.db, "default", stmt)
-	r.dbMu.Unlock()
-	if err != nil {
-		return err
+	if bindLiteral(reflect.ValueOf(stmt), strings.Trim(qvecParam, "'"), vec) {
+		return stmt, nil
 	}
-	return r.save()
+	inlineVecOnce.Do(func() { log.Printf("WARN: cannot bind the query vector in tinySQL's AST; inlining it as JSON") })
+	return tinysql.ParseSQL(inlineVecQuery(q, vec))
 }
 
-// ─────────────────────────────────────────────────────────────────────────────
-// Chat history (in-memory)
-// ─────────────────────────────────────────────────────────────────────────────
+// inlineVecOnce logs the first fallback of parseVecQuery.
+var inlineVecOnce sync.Once
 
-// chatMessage represents a single message in a conversation timeline.
-type chatMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-	Time    string `json:"time"`
+// inlineVecQuery returns `q` with the vector `vec` in place of qvecParam
+// as a JSON literal.
+func inlineVecQuery(q string, vec []float64) string {
+	return strings.ReplaceAll(q, qvecParam, "VEC_FROM_JSON('"+vecJSON(vec)+"')")
 }
 
-// conversation stores metadata and the message history for a chat.
-type conversation struct {
-	ID       string        `json:"id"`
-	Title    string        `json:"title"`
-	Messages []chatMessage `json:"messages"`
-	Created  string        `json:"created"`
-	Updated  string        `json:"updated"`
-	Persona  string        `json:"persona_id,omitempty"`
+// bindLiteral replaces the value of string literals equal to `name`
+// anywhere in the AST `v` with `val` and reports whether it did.
+func bindLiteral(v reflect.Value, name string, val any) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return !v.IsNil() && bindLiteral(v.Elem(), name, val)
+	case reflect.Struct:
+		if lit := v.FieldByName("Val"); v.NumField() == 1 && lit.IsValid() && lit.Kind() == reflect.Interface {
+			if lit.CanSet() && lit.CanInterface() && lit.Interface() == name {
+				lit.Set(reflect.ValueOf(val))
+				return true
+			}
+			return false
+		}
+		found := false
+		for i := range v.NumField() {
+			found = bindLiteral(v.Field(i), name, val) || found
+		}
+		return found
+	case reflect.Slice, reflect.Array:
+		found := false
+		for i := range v.Len() {
+			found = bindLiteral(v.Index(i), name, val) || found
+		}
+		return found
+	}
+	return false
 }
 
-// chatStore manages in-memory conversations and persists them to disk
-// when a path is provided.
-type chatStore struct {
-	mu    sync.Mutex
-	chats map[string]*conversation
-	order []string
-	path  string
+// sqlText returns an SQL expression that evaluates to exactly `s`.
+// tinySQL has no parameter binding and its lexer reads string literals
+// byte by byte, which garbles non-ASCII text, so values are passed
+// base64 encoded and decoded by the engine. The result is safe for any
+// input, including quotes, backslashes, control characters and NULs.
+func sqlText(s string) string {
+	return "BASE64_DECODE('" + base64.StdEncoding.EncodeToString([]byte(s)) + "')"
 }
 
-// newChatStore initializes a chatStore and loads persisted chats if available.
-func newChatStore(path string) *chatStore {
-	cs := &chatStore{chats: make(map[string]*conversation), path: path}
-	if path != "" {
-		if err := cs.load(); err != nil {
-			log.Printf("WARN: konnte Chats nicht laden (%v)", err)
-		}
+// storageModeLabel returns a short string label for a tinySQL storage mode.
+func storageModeLabel(mode tinysql.StorageMode) string {
+	switch mode {
+	case tinysql.ModeMemory:
+		return "memory"
+	case tinysql.ModeWAL:
+		return "wal"
+	case tinysql.ModeDisk:
+		return "disk"
+	case tinysql.ModeIndex:
+		return "index"
+	case tinysql.ModeHybrid:
+		return "hybrid"
+	default:
+		return "legacy"
 	}
-	return cs
 }
 
-// create makes a new conversation, persists it, and returns it.
-func (cs *chatStore) create(title, persona string) *conversation {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	now := time.Now().Format(time.RFC3339)
-	id := fmt.Sprintf("chat-%d", time.Now().UnixNano())
-	c := &conversation{ID: id, Title: title, Created: now, Updated: now, Persona: persona}
-	cs.chats[id] = c
-	cs.order = append(cs.order, id)
-	_ = cs.saveLocked()
-	return c
+// newRequestID generates a short random request identifier.
+func newRequestID() string {
+	return newID("req")
 }
 
-// get returns a conversation by id or nil if not found.
-func (cs *chatStore) get(id string) *conversation {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	return cs.chats[id]
+// newID returns a short random identifier starting with `prefix`.
+func newID(prefix string) string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err == nil {
+		return fmt.Sprintf("%s-%x", prefix, b)
+	}
+	return fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
 }
 
-// addMessage appends a message to the conversation and persists the store.
-func (cs *chatStore) addMessage(id, role, content string) {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	c, ok := cs.chats[id]
-	if !ok {
-		return
-	}
-	now := time.Now().Format(time.RFC3339)
-	c.Messages = append(c.Messages, chatMessage{Role: role, Content: content, Time: now})
-	c.Updated = now
-	if c.Title == "" && role == "user" {
-		t := content
-		if len(t) > 60 {
-			t = t[:60] + "…"
-		}
-		c.Title = t
-	}
-	_ = cs.saveLocked()
+// ragSystem encapsulates the tinyRAG knowledge store, embedding
+// functionality and an associated tinySQL database instance. Each
+// ragSystem value is a view on one collection (see in); the shared
+// state lives in ragCore.
+type ragSystem struct {
+	*ragCore
+	// collection is the tinySQL tenant holding this collection's tables.
+	collection string
 }
 
-// setPersona assigns a persona to an existing conversation and saves it.
-func (cs *chatStore) setPersona(id, persona string) {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	c, ok := cs.chats[id]
-	if !ok {
-		return
-	}
-	c.Persona = persona
-	c.Updated = time.Now().Format(time.RFC3339)
-	_ = cs.saveLocked()
+// defaultCollection is the collection of databases without collections.
+const defaultCollection = "default"
+
+// ragCore is the state shared by all collections.
+type ragCore struct {
+	db     *tinysql.DB
+	dbPath string
+	dim    int
+
+	// Storage mode (for display / logging)
+	storageMode tinysql.StorageMode
+
+	// Settings-sensitive runtime state
+	lmMu    sync.RWMutex
+	lm      *lmClient
+	lmGen   int   // generation of lm
+	lmErr   error // set while the endpoint is known to be unreachable
+	k       int
+	refiner []*regexp.Regexp // nil = built-in query patterns
+	// maxContext is the context budget in characters (0 = unbounded).
+	maxContext int
+	// calibrations holds thresholds per embedding model (see calibrate).
+	calibrations map[string]scoreCalibration
+
+	// DB lock: SELECTs share it, everything else holds it exclusively
+	// (tinySQL tolerates concurrent reads, not concurrent writes).
+	// "…Locked" helpers that only read may be called in either mode.
+	dbMu sync.RWMutex
+
+	// Monotonic chunk IDs per collection (avoid collisions even after
+	// deletes and restarts); guarded by dbMu and persisted in the meta
+	// table of each collection.
+	nextIDs map[string]int
+
+	// Sources being re-fetched by refreshSource, keyed likewise;
+	// guarded by dbMu.
+	refreshing map[string]bool
+
+	// Chunk counts and source lists per collection between mutations.
+	// Entries are filled and changed only with dbMu held (read or
+	// write), so a cached value never predates a mutation.
+	cacheMu sync.Mutex
+	caches  map[string]*kbCache
+	noCache bool // -no-kb-cache: always query (troubleshooting)
+	// compress stores new chunk content compressed (compress_chunks).
+	compress bool
+
+	// Persistence state: mutations set dirty, a successful save clears it.
+	// version counts all mutations and keys the answer cache.
+	saveMu      sync.Mutex
+	dirty       bool
+	version     uint64
+	lastSave    time.Time
+	lastSaveErr error
 }
 
-// list returns conversations in reverse chronological order.
-func (cs *chatStore) list() []conversation {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	result := make([]conversation, 0, len(cs.order))
-	for i := len(cs.order) - 1; i >= 0; i-- {
-		if c, ok := cs.chats[cs.order[i]]; ok {
-			result = append(result, *c)
+// newRAG initializes a new `ragSystem` backed by a tinySQL DB using
+// the provided storage mode and memory constraints.
+func newRAG(lm *lmClient, k int, dbPath string, storageMode tinysql.StorageMode, maxMemMB int64) (*ragSystem, error) {
+	var db *tinysql.DB
+	var err error
+
+	switch storageMode {
+	case tinysql.ModeMemory:
+		// In-memory with optional save-on-close.
+		db, err = tinysql.OpenDB(tinysql.StorageConfig{
+			Mode: tinysql.ModeMemory,
+			Path: dbPath, // saves GOB on Close if non-empty
+		})
+		if err != nil {
+			return nil, fmt.Errorf("open memory db: %w", err)
+		}
+		if dbPath != "" {
+			fmt.Printf("Storage mode: memory (save to %s on exit)\n", dbPath)
+		} else {
+			fmt.Println("Storage mode: memory (ephemeral, no persistence)")
 		}
-	}
-	return result
-}
 
-// remove deletes a conversation and persists the updated store.
-func (cs *chatStore) remove(id string) bool {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	if _, ok := cs.chats[id]; !ok {
-		return false
-	}
-	delete(cs.chats, id)
-	for i, oid := range cs.order {
-		if oid == id {
-			cs.order = append(cs.order[:i], cs.order[i+1:]...)
-			break
+	case tinysql.ModeWAL:
+		if dbPath == "" {
+			dbPath = "tinyrag.gob"
 		}
-	}
-	_ = cs.saveLocked()
-	return true
-}
+		db, err = tinysql.OpenDB(tinysql.StorageConfig{
+			Mode: tinysql.ModeWAL,
+			Path: dbPath,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("open wal db: %w", err)
+		}
+		fmt.Printf("Storage mode: WAL (checkpoint to %s)\n", dbPath)
 
-// saveLocked writes the chat store payload to disk and must be called
-// with `cs.mu` held.
-func (cs *chatStore) saveLocked() error {
-	if cs.path == "" {
-		return nil
-	}
-	payload := struct {
-		Chats []*conversation `json:"chats"`
-	}{}
-	for _, id := range cs.order {
-		if c, ok := cs.chats[id]; ok {
-			payload.Chats = append(payload.Chats, c)
+	case tinysql.ModeDisk:
+		if dbPath == "" {
+			dbPath = "tinyrag.db"
 		}
-	}
-	b, err := json.MarshalIndent(payload, "", "  ")
-	if err != nil {
-		return err
-	}
-	tmp := cs.path + ".tmp"
-	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
-		return err
-	}
-	return os.Rename(tmp, cs.path)
-}
+		db, err = tinysql.OpenDB(tinysql.StorageConfig{
+			Mode: tinysql.ModeDisk,
+			Path: dbPath,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("open disk db: %w", err)
+		}
+		fmt.Printf("Storage mode: disk (tables in %s/)\n", dbPath)
 
-// load reads persisted chats from disk into the in-memory store.
-func (cs *chatStore) load() error {
-	data, err := os.ReadFile(cs.path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+	case tinysql.ModeIndex:
+		if dbPath == "" {
+			dbPath = "tinyrag.db"
+		}
+		mem := maxMemMB * 1024 * 1024
+		if mem <= 0 {
+			mem = 64 * 1024 * 1024
+		}
+		db, err = tinysql.OpenDB(tinysql.StorageConfig{
+			Mode:           tinysql.ModeIndex,
+			Path:           dbPath,
+			MaxMemoryBytes: mem,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("open index db: %w", err)
+		}
+		fmt.Printf("Storage mode: index (schemas in RAM, rows on disk in %s/, max %d MB)\n", dbPath, maxMemMB)
+
+	case tinysql.ModeHybrid:
+		if dbPath == "" {
+			dbPath = "tinyrag.db"
+		}
+		mem := maxMemMB * 1024 * 1024
+		if mem <= 0 {
+			mem = 256 * 1024 * 1024
+		}
+		db, err = tinysql.OpenDB(tinysql.StorageConfig{
+			Mode:           tinysql.ModeHybrid,
+			Path:           dbPath,
+			MaxMemoryBytes: mem,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("open hybrid db: %w", err)
+		}
+		fmt.Printf("Storage mode: hybrid (LRU cache %d MB, disk in %s/)\n", maxMemMB, dbPath)
+
+	default:
+		// Fallback: legacy behaviour (load GOB if exists, else new)
+		if dbPath != "" {
+			if loaded, loadErr := tinysql.LoadFromFile(dbPath); loadErr == nil {
+				db = loaded
+				fmt.Printf("Loaded existing database from %s\n", dbPath)
+			} else {
+				db = tinysql.NewDB()
+				fmt.Printf("Creating new database (will save to %s)\n", dbPath)
+			}
+		} else {
+			db = tinysql.NewDB()
 		}
-		return err
-	}
-	var payload struct {
-		Chats []conversation `json:"chats"`
-	}
-	if err := json.Unmarshal(data, &payload); err != nil {
-		return err
-	}
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	cs.chats = make(map[string]*conversation)
-	cs.order = nil
-	for _, c := range payload.Chats {
-		copyC := c
-		cs.chats[c.ID] = &copyC
-		cs.order = append(cs.order, c.ID)
 	}
-	return nil
+
+	core := &ragCore{db: db, lm: lm, k: k, dbPath: dbPath, storageMode: storageMode, nextIDs: map[string]int{}, refreshing: map[string]bool{}, caches: map[string]*kbCache{}}
+	return &ragSystem{ragCore: core, collection: defaultCollection}, nil
 }
 
-// ─────────────────────────────────────────────────────────────────────────────
-// Web server + helper endpoints
-// ─────────────────────────────────────────────────────────────────────────────
+// in returns a view of collection `name` sharing this system's database.
+func (r *ragSystem) in(name string) *ragSystem {
+	return &ragSystem{ragCore: r.ragCore, collection: name}
+}
 
-// mustJSON encodes `v` to a compact JSON string, ignoring errors.
-func mustJSON(v any) string {
-	b, _ := json.Marshal(v)
-	return string(b)
+// setLM atomically replaces the runtime `lmClient` used for embeddings
+// and chat requests and gives it the next generation. The new client is
+// assumed to be reachable. Requests already running keep the client
+// they started with (see withLM).
+func (r *ragSystem) setLM(lm *lmClient) {
+	r.lmMu.Lock()
+	defer r.lmMu.Unlock()
+	r.lmGen++
+	lm.generation = r.lmGen
+	r.lm = lm
+	r.lmErr = nil
 }
 
-// llmCheckReq is the request structure for model/endpoint validation.
-type llmCheckReq struct {
-	BaseURL string `json:"base_url"`
+type lmKey struct{}
+
+// withLM returns a context whose retrieval, planning and tool calls use
+// `lm` instead of the client configured when they run.
+func withLM(ctx context.Context, lm *lmClient) context.Context {
+	return context.WithValue(ctx, lmKey{}, lm)
 }
 
-// llmCheckResp is the response structure returned when validating an LLM endpoint.
-type llmCheckResp struct {
-	OK             bool     `json:"ok"`
-	BaseURL        string   `json:"base_url"`
-	ProviderHint   string   `json:"provider_hint"`
-	Error          string   `json:"error,omitempty"`
-	Models         []string `json:"models,omitempty"`
-	RecommendChat  []string `json:"recommend_chat,omitempty"`
-	RecommendEmbed []string `json:"recommend_embed,omitempty"`
+// lmFor returns the client set by withLM on `ctx`, or the configured one.
+func (r *ragSystem) lmFor(ctx context.Context) *lmClient {
+	if lm, ok := ctx.Value(lmKey{}).(*lmClient); ok {
+		return lm
+	}
+	return r.getLM()
 }
 
-// providerHintFromURL returns a human-friendly hint about the LLM
-// provider based on common port patterns in the base URL.
-func providerHintFromURL(base string) string {
-	if strings.Contains(base, "11434") {
-		return "Ollama"
-	}
-	if strings.Contains(base, "1234") {
-		return "LM Studio"
-	}
-	return "OpenAI-compatible"
+// setLMError marks the LLM endpoint as unreachable (nil = reachable).
+func (r *ragSystem) setLMError(err error) {
+	r.lmMu.Lock()
+	defer r.lmMu.Unlock()
+	r.lmErr = err
 }
 
-// recommendModels heuristically selects likely chat and embedding models
-// from a list of available model IDs.
-func recommendModels(models []string) (chat []string, embed []string) {
-	// Heuristics only: highlight likely candidates.
-	for _, m := range models {
-		ml := strings.ToLower(m)
-		if strings.Contains(ml, "embed") || strings.Contains(ml, "embedding") {
-			embed = append(embed, m)
-		}
-		// Common chat-ish hints
-		if strings.Contains(ml, "llama") ||
-			strings.Contains(ml, "mistral") ||
-			strings.Contains(ml, "qwen") ||
-			strings.Contains(ml, "gemma") ||
-			strings.Contains(ml, "phi") ||
-			strings.Contains(ml, "gpt") ||
-			strings.Contains(ml, "ministral") {
-			chat = append(chat, m)
-		}
-	}
-	// Keep lists short
-	if len(chat) > 8 {
-		chat = chat[:8]
-	}
-	if len(embed) > 8 {
-		embed = embed[:8]
-	}
-	return
+// lmError returns why the LLM endpoint is unusable, or nil.
+func (r *ragSystem) lmError() error {
+	r.lmMu.RLock()
+	defer r.lmMu.RUnlock()
+	return r.lmErr
 }
 
-// discoverCandidate contains information about a discovered LLM endpoint.
-type discoverCandidate struct {
-	BaseURL        string   `json:"base_url"`
-	ProviderHint   string   `json:"provider_hint"`
-	OK             bool     `json:"ok"`
-	Error          string   `json:"error,omitempty"`
-	Models         []string `json:"models,omitempty"`
-	RecommendChat  []string `json:"recommend_chat,omitempty"`
-	RecommendEmbed []string `json:"recommend_embed,omitempty"`
+// getLM returns the currently configured `lmClient`.
+func (r *ragSystem) getLM() *lmClient {
+	r.lmMu.RLock()
+	defer r.lmMu.RUnlock()
+	return r.lm
 }
 
-// discoverResp is returned from the /api/discover endpoint.
-type discoverResp struct {
-	Candidates []discoverCandidate `json:"candidates"`
+// setK changes the number of chunks retrieved per question.
+func (r *ragSystem) setK(k int) {
+	r.lmMu.Lock()
+	r.k = k
+	r.lmMu.Unlock()
 }
 
-// runWebServer registers HTTP handlers and starts the web interface.
-func runWebServer(rag *ragSystem, addr string, settings *settingsStore, chats *chatStore, customAPIs *apiStore, personas *personaStore) {
-	mux := http.NewServeMux()
+// topK returns the number of chunks retrieved per question.
+func (r *ragSystem) topK() int {
+	r.lmMu.RLock()
+	defer r.lmMu.RUnlock()
+	return r.k
+}
 
-	// Static assets
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		fmt.Fprint(w, indexHTML)
-	})
-	mux.HandleFunc("/style.css", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/css; charset=utf-8")
-		fmt.Fprint(w, styleCSS)
-	})
-	mux.HandleFunc("/app.js", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
-		fmt.Fprint(w, appJS)
-	})
+// setMaxContextChars changes the context budget of retrievals.
+func (r *ragSystem) setMaxContextChars(n int) {
+	r.lmMu.Lock()
+	r.maxContext = n
+	r.lmMu.Unlock()
+}
 
-	// GET /api/settings — current settings
-	mux.HandleFunc("/api/settings", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			s := settings.get()
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]any{
-				"base_url":    s.BaseURL,
-				"chat_model":  s.ChatModel,
-				"embed_model": s.EmbedModel,
-				"lang":        s.Lang,
-				"theme":       s.Theme,
-				"chunk_size":  s.ChunkSize,
-				"k":           s.K,
-			})
-			return
+// setQueryPatterns replaces the query refinement patterns.
+func (r *ragSystem) setQueryPatterns(patterns []string) {
+	res := compileQueryPatterns(patterns)
+	r.lmMu.Lock()
+	r.refiner = res
+	r.lmMu.Unlock()
+}
 
-		case "POST":
-			var req struct {
-				BaseURL    string `json:"base_url"`
-				ChatModel  string `json:"chat_model"`
-				EmbedModel string `json:"embed_model"`
-				Theme      string `json:"theme"`
-				Force      bool   `json:"force"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				http.Error(w, "invalid JSON", 400)
-				return
-			}
-			req.BaseURL = normalizeBaseURL(req.BaseURL)
-			if req.BaseURL == "" || req.ChatModel == "" || req.EmbedModel == "" {
-				http.Error(w, "base_url, chat_model and embed_model are required", 400)
-				return
-			}
+// setCalibrations replaces the calibrated thresholds per embedding model.
+func (r *ragSystem) setCalibrations(c map[string]scoreCalibration) {
+	c = maps.Clone(c)
+	r.lmMu.Lock()
+	r.calibrations = c
+	r.lmMu.Unlock()
+}
 
-			// Validate endpoint quickly
-			tmp := newLMClient(req.BaseURL, req.EmbedModel, req.ChatModel)
-			if err := tmp.ping(); err != nil {
-				http.Error(w, "LLM endpoint not reachable: "+err.Error(), 400)
-				return
-			}
+// refineQuery applies the configured query refinement patterns.
+func (r *ragSystem) refineQuery(question string) string {
+	r.lmMu.RLock()
+	res := r.refiner
+	r.lmMu.RUnlock()
+	if res == nil {
+		res = builtinQueryRefiner
+	}
+	return refineSearchQuery(question, res)
+}
 
-			// Warn on embedding model changes if DB already has data
-			old := settings.get()
-			if old.EmbedModel != "" && old.EmbedModel != req.EmbedModel && rag.docCount() > 0 && !req.Force {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(409)
-				json.NewEncoder(w).Encode(map[string]any{
-					"ok":             false,
-					"requires_force": true,
-					"message":        "Du hast das Embedding-Modell geändert. Bestehende Chunks wurden mit dem alten Modell eingebettet; Retrieval kann schlechter werden. Wenn du fortfährst, solltest du die Wissensbasis neu einbetten (oder die DB leeren).",
-				})
-				return
-			}
+// ── Follow-up queries ──────────────────────────────────────────────
 
-			// Persist + apply
-			settings.mu.Lock()
-			settings.s.BaseURL = req.BaseURL
-			settings.s.ChatModel = req.ChatModel
-			settings.s.EmbedModel = req.EmbedModel
-			if req.Theme != "" {
-				settings.s.Theme = req.Theme
-			}
-			_ = settings.saveLocked()
-			settings.mu.Unlock()
+const (
+	// maxFollowUpTurnRunes caps the previous question and answer used
+	// for a follow-up query.
+	maxFollowUpTurnRunes = 300
+	// followUpRewriteTimeout bounds the rewrite call.
+	followUpRewriteTimeout = 30 * time.Second
+)
 
-			rag.setLM(tmp)
+// lastTurn returns the question and answer before the last message of
+// `msgs`, the current question. Failed answers without text are skipped.
+func lastTurn(msgs []chatMessage) (question, answer string, ok bool) {
+	for i := len(msgs) - 2; i >= 0; i-- {
+		switch m := msgs[i]; {
+		case m.Role == "assistant" && answer == "":
+			answer = m.Content
+		case m.Role == "user":
+			return m.Content, answer, true
+		}
+	}
+	return "", "", false
+}
 
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]any{"ok": true})
-			return
+// followUpQuery returns the retrieval query for `question`, the last
+// message of `msgs`, built as `mode` says (see appSettings.FollowUpQuery).
+// The first question of a chat is returned as is. On error the question
+// is returned along with it.
+func followUpQuery(ctx context.Context, lm *lmClient, mode string, msgs []chatMessage, question string) (string, error) {
+	prevQ, prevA, ok := lastTurn(msgs)
+	if !ok || (mode != "concat" && mode != "rewrite") {
+		return question, nil
+	}
+	prevQ = truncate(strings.Join(strings.Fields(prevQ), " "), maxFollowUpTurnRunes)
+	prevA = truncate(strings.Join(strings.Fields(citationMarkerRe.ReplaceAllString(prevA, "")), " "), maxFollowUpTurnRunes)
+	if mode == "concat" {
+		parts := []string{prevQ}
+		if prevA != "" {
+			parts = append(parts, prevA)
+		}
+		return strings.Join(append(parts, question), " "), nil
+	}
+	system := "Rewrite the follow-up question as a standalone question that can be understood without the conversation: replace pronouns and references with what they refer to. Keep the language of the follow-up question. Return ONLY the rewritten question."
+	user := fmt.Sprintf("Conversation:\nUser: %s\nAssistant: %s\n\nFollow-up question: %s", prevQ, prevA, question)
+	out, _, err := lm.complete(ctx, system, []chatMsg{{Role: "user", Content: user}}, false)
+	if err != nil {
+		return question, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if q := strings.Trim(strings.TrimSpace(line), "\"'„“”»«"); q != "" {
+			return truncate(q, maxFollowUpTurnRunes), nil
+		}
+	}
+	return question, fmt.Errorf("empty rewrite")
+}
 
-		default:
-			http.Error(w, "GET or POST only", 405)
-			return
+// save flushes the underlying database to disk or performs a sync
+// depending on the configured storage mode, and records the outcome
+// for saveStatus. Holding dbMu keeps explicit saves and autosave apart.
+func (r *ragSystem) save() error {
+	if r.dbPath == "" {
+		return nil
+	}
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+
+	var err error
+	// For disk-backed modes, Sync flushes dirty tables to disk.
+	switch r.storageMode {
+	case tinysql.ModeDisk, tinysql.ModeHybrid, tinysql.ModeIndex:
+		err = r.db.Sync()
+	default:
+		// Legacy / ModeMemory / ModeWAL: full GOB snapshot
+		err = tinysql.SaveToFile(r.db, r.dbPath)
+	}
+
+	r.saveMu.Lock()
+	r.lastSaveErr = err
+	if err == nil {
+		r.dirty = false
+		r.lastSave = time.Now()
+	}
+	r.saveMu.Unlock()
+	return err
+}
+
+// markDirty records an unsaved change.
+func (r *ragSystem) markDirty() {
+	r.saveMu.Lock()
+	r.dirty = true
+	r.version++
+	r.saveMu.Unlock()
+}
+
+// kbVersion returns the knowledge-base version; it changes with every
+// added or deleted chunk.
+func (r *ragSystem) kbVersion() uint64 {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	return r.version
+}
+
+// autosave saves every `interval` while there are unsaved changes.
+func (r *ragSystem) autosave(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.saveMu.Lock()
+		dirty := r.dirty
+		r.saveMu.Unlock()
+		if !dirty {
+			continue
+		}
+		if err := r.save(); err != nil {
+			log.Printf("WARN: autosave failed: %v", err)
 		}
+	}
+}
+
+// saveStatus reports the persistence state for /api/stats.
+func (r *ragSystem) saveStatus() map[string]any {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	st := map[string]any{"persistent": r.dbPath != "", "unsaved_changes": r.dirty}
+	if !r.lastSave.IsZero() {
+		st["last_save"] = r.lastSave.UTC().Format(time.RFC3339)
+	}
+	if r.lastSaveErr != nil {
+		st["last_save_error"] = r.lastSaveErr.Error()
+	}
+	return st
+}
+
+// withSaveWarning adds a "warning" to a mutation response when the most
+// recent save failed, so the change may not survive a restart.
+func withSaveWarning(r *ragSystem, res map[string]any) map[string]any {
+	r.saveMu.Lock()
+	err := r.lastSaveErr
+	r.saveMu.Unlock()
+	if err != nil {
+		res["warning"] = "Speichern der Datenbank fehlgeschlagen: " + err.Error()
+	}
+	return res
+}
+
+// writeDuplicate answers an import that added nothing because its
+// content is already stored as source `existing`.
+func writeDuplicate(w http.ResponseWriter, r *ragSystem, existing string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"duplicate":       true,
+		"existing_source": existing,
+		"chunks":          0,
+		"total":           r.docCount(),
 	})
+}
 
-	// POST /api/settings/theme — lightweight theme switch (no LLM validation)
-	mux.HandleFunc("/api/settings/theme", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
-		}
-		var req struct {
-			Theme string `json:"theme"`
+// init creates required DB tables of the default collection and all
+// registered collections and initializes runtime counters.
+func (r *ragSystem) init() error {
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+	if err := r.initCollectionLocked(); err != nil {
+		return err
+	}
+	if _, err := r.execLocked("CREATE TABLE IF NOT EXISTS collections (name TEXT, created_at TEXT)"); err != nil {
+		return err
+	}
+	for _, c := range r.collectionNamesLocked() {
+		if err := r.in(c).initCollectionLocked(); err != nil {
+			return fmt.Errorf("collection %s: %w", c, err)
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "invalid JSON", 400)
-			return
+	}
+	return nil
+}
+
+// initCollectionLocked creates the tables of this collection, repairs
+// legacy data and loads its ID counter. It must be called with r.dbMu
+// held.
+func (r *ragSystem) initCollectionLocked() error {
+	if _, err := r.execLocked("CREATE TABLE IF NOT EXISTS chunks (id INT, article TEXT, chunk_idx INT, content TEXT, embedding VECTOR, lang TEXT)"); err != nil {
+		return err
+	}
+	if err := r.addColumnLocked("chunks", "lang", tinysql.TextType); err != nil {
+		return err
+	}
+	if _, err := r.execLocked("CREATE TABLE IF NOT EXISTS sources (name TEXT, origin_type TEXT, origin_ref TEXT, created_at TEXT, updated_at TEXT, chunk_count INT, chars INT, content_hash TEXT, prov_request TEXT, prov_chat TEXT, prov_tool TEXT, prov_query TEXT, prov_at TEXT, seq_group TEXT, seq_pos INT, tags TEXT)"); err != nil {
+		return err
+	}
+	for _, c := range []string{"content_hash", "prov_request", "prov_chat", "prov_tool", "prov_query", "prov_at", "seq_group"} {
+		if err := r.addColumnLocked("sources", c, tinysql.TextType); err != nil {
+			return err
 		}
-		settings.mu.Lock()
-		settings.s.Theme = req.Theme
-		_ = settings.saveLocked()
-		settings.mu.Unlock()
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{"ok": true, "theme": req.Theme})
-	})
+	}
+	if err := r.addColumnLocked("sources", "seq_pos", tinysql.IntType); err != nil {
+		return err
+	}
+	if err := r.addColumnLocked("sources", "tags", tinysql.TextType); err != nil {
+		return err
+	}
+	if _, err := r.execLocked("CREATE TABLE IF NOT EXISTS meta (name TEXT, value INT)"); err != nil {
+		return err
+	}
+	if _, err := r.execLocked("CREATE TABLE IF NOT EXISTS refresh_schedule (name TEXT, interval_s INT, last_run TEXT, last_status TEXT, last_error TEXT, failures INT, next_run TEXT)"); err != nil {
+		return err
+	}
+	if n, err := r.backfillSourcesLocked(); err != nil {
+		log.Printf("WARN: backfilling sources failed: %v", err)
+	} else if n > 0 {
+		log.Printf("Recorded metadata for %d existing sources", n)
+		r.markDirty()
+	}
+	if n, err := r.backfillChunkLangLocked(); err != nil {
+		log.Printf("WARN: detecting chunk languages failed: %v", err)
+	} else if n > 0 {
+		log.Printf("Detected the language of %d existing chunks", n)
+		r.markDirty()
+	}
+	if n, err := r.backfillContentHashLocked(); err != nil {
+		log.Printf("WARN: hashing source contents failed: %v", err)
+	} else if n > 0 {
+		log.Printf("Hashed the content of %d existing sources", n)
+		r.markDirty()
+	}
+	return r.loadNextIDLocked()
+}
 
-	// GET /api/discover — auto-discover common local endpoints
-	mux.HandleFunc("/api/discover", func(w http.ResponseWriter, r *http.Request) {
-		candidates := []string{
-			"http://localhost:1234",  // LM Studio default
-			"http://localhost:11434", // Ollama default
+// addColumnLocked adds `column` to `table` of databases from older
+// versions; existing rows get NULL. The table is rebuilt because
+// tinySQL's ALTER TABLE ... ADD COLUMN leaves the new column unknown to
+// queries. It must be called with r.dbMu held.
+func (r *ragSystem) addColumnLocked(table, column string, typ tinysql.ColType) error {
+	t, err := r.db.Get(r.collection, table)
+	if err != nil {
+		return err
+	}
+	for _, c := range t.Cols {
+		if strings.EqualFold(c.Name, column) {
+			return nil
 		}
-		var out []discoverCandidate
-		for _, base := range candidates {
-			c := discoverCandidate{BaseURL: base, ProviderHint: providerHintFromURL(base)}
-			tmp := newLMClient(base, "x", "x")
-			models, err := tmp.listModels(base)
-			if err != nil {
-				c.OK = false
-				c.Error = err.Error()
-			} else {
-				c.OK = true
-				c.Models = models
-				c.RecommendChat, c.RecommendEmbed = recommendModels(models)
+	}
+	nt := tinysql.NewTable(t.Name, append(slices.Clone(t.Cols), tinysql.Column{Name: column, Type: typ}), t.IsTemp)
+	nt.Rows = make([][]any, len(t.Rows))
+	for i, row := range t.Rows {
+		nt.Rows[i] = append(row, nil)
+	}
+	if err := r.db.Drop(r.collection, table); err != nil {
+		return err
+	}
+	r.markDirty()
+	return r.db.Put(r.collection, nt)
+}
+
+// backfillChunkLangLocked detects the language of chunks stored before
+// languages were recorded. Chunks whose language is unknown get "" so
+// they are not examined again. It must be called with r.dbMu held.
+func (r *ragSystem) backfillChunkLangLocked() (int, error) {
+	rs, err := r.execLocked("SELECT id, content FROM chunks WHERE lang IS NULL")
+	if err != nil || rs == nil {
+		return 0, err
+	}
+	byLang := make(map[string][]string)
+	for _, row := range rs.Rows {
+		idV, _ := tinysql.GetVal(row, "id")
+		cV, _ := tinysql.GetVal(row, "content")
+		lang := detectLang(contentVal(cV))
+		byLang[lang] = append(byLang[lang], fmt.Sprint(idV))
+	}
+	const batch = 500
+	for lang, ids := range byLang {
+		for i := 0; i < len(ids); i += batch {
+			q := fmt.Sprintf("UPDATE chunks SET lang = %s WHERE id IN (%s)", sqlText(lang), strings.Join(ids[i:min(i+batch, len(ids))], ", "))
+			if _, err := r.execLocked(q); err != nil {
+				return 0, err
 			}
-			out = append(out, c)
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(discoverResp{Candidates: out})
-	})
+	}
+	return len(rs.Rows), nil
+}
 
-	// POST /api/llm/list-models — validate an endpoint and list models
-	mux.HandleFunc("/api/llm/list-models", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
-		}
-		var req llmCheckReq
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "invalid JSON", 400)
-			return
+// backfillContentHashLocked records the content hash of sources stored
+// before sources had one. It must be called with r.dbMu held.
+func (r *ragSystem) backfillContentHashLocked() (int, error) {
+	rs, err := r.execLocked("SELECT name, content_hash FROM sources")
+	if err != nil || rs == nil {
+		return 0, err
+	}
+	n := 0
+	for _, row := range rs.Rows {
+		src := sourceFromRow(row)
+		if src.ContentHash != "" {
+			continue
 		}
-		req.BaseURL = normalizeBaseURL(req.BaseURL)
-		if req.BaseURL == "" {
-			http.Error(w, "missing base_url", 400)
-			return
+		hash := chunksHash(r.sourceChunkTextsLocked(src.Name))
+		if hash == "" {
+			continue
 		}
-		tmp := newLMClient(req.BaseURL, "x", "x")
-		models, err := tmp.listModels(req.BaseURL)
-		resp := llmCheckResp{BaseURL: req.BaseURL, ProviderHint: providerHintFromURL(req.BaseURL)}
-		if err != nil {
-			resp.OK = false
-			resp.Error = err.Error()
-		} else {
-			resp.OK = true
-			resp.Models = models
-			resp.RecommendChat, resp.RecommendEmbed = recommendModels(models)
+		q := fmt.Sprintf("UPDATE sources SET content_hash = %s WHERE name = %s", sqlText(hash), sqlText(src.Name))
+		if _, err := r.execLocked(q); err != nil {
+			return 0, err
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(resp)
-	})
+		n++
+	}
+	if n > 0 {
+		r.invalidateCacheLocked()
+	}
+	return n, nil
+}
 
-	// POST /api/ask — SSE streaming answer
+const metaNextChunkID = "next_chunk_id"
+
+// loadNextIDLocked initializes nextID from the meta table. Databases
+// from older versions have no counter yet and start at MAX(id)+1. It
+// must be called with r.dbMu held.
+func (r *ragSystem) loadNextIDLocked() error {
+	stored, _, err := r.getMetaLocked(metaNextChunkID)
+	if err != nil {
+		return err
+	}
+	next := max(stored, r.maxChunkIDLocked()+1)
+	r.nextIDs[r.collection] = next
+	return r.putMetaLocked(metaNextChunkID, next)
+}
+
+// getMetaLocked reads an integer from the meta table. It must be called
+// with r.dbMu held.
+func (r *ragSystem) getMetaLocked(name string) (int, bool, error) {
+	rs, err := r.execLocked(fmt.Sprintf("SELECT value FROM meta WHERE name = %s", sqlText(name)))
+	if err != nil {
+		return 0, false, err
+	}
+	if rs == nil || len(rs.Rows) == 0 {
+		return 0, false, nil
+	}
+	v, _ := tinysql.GetVal(rs.Rows[0], "value")
+	switch n := v.(type) {
+	case int:
+		return n, true, nil
+	case int64:
+		return int(n), true, nil
+	case float64:
+		return int(n), true, nil
+	}
+	return 0, false, fmt.Errorf("meta %s: unexpected value %v", name, v)
+}
+
+// setMetaLocked updates an existing meta entry. It must be called with
+// r.dbMu held.
+func (r *ragSystem) setMetaLocked(name string, value int) error {
+	_, err := r.execLocked(fmt.Sprintf("UPDATE meta SET value = %d WHERE name = %s", value, sqlText(name)))
+	return err
+}
+
+// putMetaLocked sets a meta entry, creating it if needed. It must be
+// called with r.dbMu held.
+func (r *ragSystem) putMetaLocked(name string, value int) error {
+	stored, ok, err := r.getMetaLocked(name)
+	if err != nil || ok && stored == value {
+		return err
+	}
+	if ok {
+		return r.setMetaLocked(name, value)
+	}
+	if _, err := r.execLocked(fmt.Sprintf("INSERT INTO meta (name, value) VALUES (%s, %d)", sqlText(name), value)); err != nil {
+		return err
+	}
+	r.markDirty()
+	return nil
+}
+
+const metaEmbedDim = "embed_dim"
+
+// checkEmbedDimLocked makes sure all of `vecs` have the dimension of the
+// embeddings already stored in the collection, so a changed embedding
+// model or embed_dimensions cannot mix vectors that never match. The
+// dimension is recorded in the meta table; databases from older
+// versions take it from their first chunk. It must be called with
+// r.dbMu held.
+func (r *ragSystem) checkEmbedDimLocked(vecs [][]float64) error {
+	if len(vecs) == 0 {
+		return nil
+	}
+	dim := len(vecs[0])
+	for i, v := range vecs {
+		if len(v) != dim {
+			return fmt.Errorf("embedding %d has %d dimensions, embedding 0 has %d", i, len(v), dim)
+		}
+	}
+	first := r.firstEmbedDimLocked()
+	if first == 0 {
+		// Empty collection: any dimension goes.
+		return r.putMetaLocked(metaEmbedDim, dim)
+	}
+	stored, ok, err := r.getMetaLocked(metaEmbedDim)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		stored = first
+	}
+	if stored != dim {
+		return fmt.Errorf("embeddings have %d dimensions, collection %s stores %d; re-embed after changing embed_model or embed_dimensions", dim, r.collection, stored)
+	}
+	return r.putMetaLocked(metaEmbedDim, dim)
+}
+
+// checkQueryDimLocked fails with a clear error if `qvec` doesn't have
+// the dimension recorded for the collection's embeddings, as after a
+// change of embed_model or embed_dimensions without a re-embed; the
+// similarity of vectors of different length means nothing. It must be
+// called with r.dbMu held, for reading at least, on a non-empty
+// collection.
+func (r *ragSystem) checkQueryDimLocked(qvec []float64) error {
+	stored, ok, err := r.getMetaLocked(metaEmbedDim)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		stored = r.firstEmbedDimLocked()
+	}
+	if stored != 0 && stored != len(qvec) {
+		return fmt.Errorf("the question embedding has %d dimensions, collection %s stores %d; re-embed after changing embed_model or embed_dimensions", len(qvec), r.collection, stored)
+	}
+	return nil
+}
+
+// firstEmbedDimLocked returns the dimension of the first chunk of the
+// collection, or 0 if it has none. It must be called with r.dbMu held.
+func (r *ragSystem) firstEmbedDimLocked() int {
+	rs, err := r.execLocked("SELECT embedding FROM chunks LIMIT 1")
+	if err != nil || rs == nil || len(rs.Rows) == 0 {
+		return 0
+	}
+	v, _ := tinysql.GetVal(rs.Rows[0], "embedding")
+	vec, _ := v.([]float64)
+	return len(vec)
+}
+
+// maxChunkIDLocked queries the DB for the maximum chunk id and must
+// be called with appropriate locking by the caller.
+func (r *ragSystem) maxChunkIDLocked() int {
+	q := "SELECT MAX(id) AS mid FROM chunks"
+	stmt, err := tinysql.ParseSQL(q)
+	if err != nil {
+		return -1
+	}
+	rs, err := tinysql.Execute(context.Background(), r.db, r.collection, stmt)
+	if err != nil || rs == nil || len(rs.Rows) == 0 {
+		return -1
+	}
+	v, ok := tinysql.GetVal(rs.Rows[0], "mid")
+	if !ok || v == nil {
+		return -1
+	}
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return -1
+}
+
+// allocIDs reserves `n` monotonic IDs for new chunks. The counter is
+// written before any chunk using the IDs, so a saved database never
+// holds chunks beyond its counter.
+func (r *ragSystem) allocIDs(n int) (int, error) {
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+	start := r.nextIDs[r.collection]
+	if err := r.setMetaLocked(metaNextChunkID, start+n); err != nil {
+		return 0, fmt.Errorf("reserve chunk ids: %w", err)
+	}
+	r.nextIDs[r.collection] = start + n
+	r.markDirty()
+	return start, nil
+}
+
+// articleChunkCountLocked returns the number of stored chunks of
+// `article`. It must be called with r.dbMu held.
+func (r *ragSystem) articleChunkCountLocked(article string) int {
+	st, err := tinysql.ParseSQL(fmt.Sprintf("SELECT COUNT(*) AS cnt FROM chunks WHERE article = %s", sqlText(article)))
+	if err != nil {
+		return 0
+	}
+	rs, err := tinysql.Execute(context.Background(), r.db, r.collection, st)
+	if err != nil || rs == nil || len(rs.Rows) == 0 {
+		return 0
+	}
+	v, _ := tinysql.GetVal(rs.Rows[0], "cnt")
+	switch nv := v.(type) {
+	case int:
+		return nv
+	case int64:
+		return int(nv)
+	case float64:
+		return int(nv)
+	}
+	return 0
+}
+
+// errSourceExists is returned by addSourceChunks for a source name that
+// is already stored; nothing is added then.
+var errSourceExists = errors.New("source already exists")
+
+// addChunks is addChunksFrom with the origin inferred from the name.
+func (r *ragSystem) addChunks(ctx context.Context, article string, chunks []string) error {
+	return r.addChunksFrom(ctx, article, inferOrigin(article), chunks)
+}
+
+// addChunksFrom is addSourceChunks for a source without provenance.
+func (r *ragSystem) addChunksFrom(ctx context.Context, article string, origin sourceOrigin, chunks []string) error {
+	return r.addSourceChunks(ctx, sourceInfo{Name: article, sourceOrigin: origin}, chunks)
+}
+
+// addSourceChunks embeds and stores `chunks` for source `src` into
+// the database and records it in the sources table. It is all-or-nothing per article: every batch is
+// embedded before the first row is inserted, and a failing insert
+// removes the rows already written, so a retry starts from scratch
+// instead of hitting the "already present" skip with a partial article.
+// An article that is already present is not replaced: the call returns
+// errSourceExists. `ctx` bounds the embedding; once embedded, the
+// chunks are stored.
+func (r *ragSystem) addSourceChunks(ctx context.Context, src sourceInfo, chunks []string) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	article := src.Name
+	// If this article already exists in the DB, skip adding again to avoid duplicates.
+	// This makes imports idempotent; to replace content delete the source first.
+	r.dbMu.RLock()
+	cnt := r.articleChunkCountLocked(article)
+	r.dbMu.RUnlock()
+	if cnt > 0 {
+		fmt.Printf("skip addChunks: article '%s' already present (%d chunks)\n", article, cnt)
+		return errSourceExists
+	}
+	// Stage: embed everything without holding the DB lock.
+	vecs, err := r.embedChunks(ctx, chunks)
+	if err != nil {
+		return err
+	}
+
+	stored, err := r.storeChunks(src, chunks, vecs)
+	if err != nil {
+		return err
+	}
+	if !stored {
+		fmt.Printf("skip addChunks: article '%s' was added concurrently\n", article)
+		return errSourceExists
+	}
+	fmt.Printf("  stored %d chunks\n", len(chunks))
+
+	if err := r.save(); err != nil {
+		log.Printf("WARN: save failed: %v", err)
+	}
+	return nil
+}
+
+// embedChunks embeds `chunks` in batches, in order.
+func (r *ragSystem) embedChunks(ctx context.Context, chunks []string) ([][]float64, error) {
+	batchSize := 16
+	vecs := make([][]float64, 0, len(chunks))
+	for i := 0; i < len(chunks); i += batchSize {
+		end := min(i+batchSize, len(chunks))
+		batchVecs, err := r.lmFor(ctx).embed(ctx, chunks[i:end])
+		if err != nil {
+			return nil, fmt.Errorf("embed batch %d: %w", i/batchSize, err)
+		}
+		if len(batchVecs) != end-i {
+			return nil, fmt.Errorf("embed batch %d: got %d vectors for %d chunks", i/batchSize, len(batchVecs), end-i)
+		}
+		if r.dim == 0 && len(batchVecs) > 0 {
+			r.dim = len(batchVecs[0])
+		}
+		vecs = append(vecs, batchVecs...)
+		fmt.Printf("  embedded %d/%d chunks\n", end, len(chunks))
+	}
+	return vecs, nil
+}
+
+// chunkInsertSQL returns the statement storing chunk `idx` of `article`
+// along with its embedding and detected language, with `compress` in
+// the compressed format.
+func chunkInsertSQL(id int, article string, idx int, content string, vec []float64, compress bool) string {
+	stored := encodeContent(content, compress)
+	return fmt.Sprintf(
+		"INSERT INTO chunks (id, article, chunk_idx, content, embedding, lang) VALUES (%d, %s, %d, %s, VEC_FROM_JSON('%s'), %s)",
+		id, sqlText(article), idx, sqlText(stored), vecJSON(vec), sqlText(detectLang(content)),
+	)
+}
+
+// ── Chunk compression ──────────────────────────────────────────────
+
+// compressedPrefix starts chunk content stored as raw DEFLATE data.
+// Plain text starting with compressedPrefix or escapedPrefix is stored
+// behind escapedPrefix, so that it is not mistaken for compressed data.
+const (
+	compressedPrefix = "\x01"
+	escapedPrefix    = "\x02"
+)
+
+// Compressors are large, so they are reused.
+var (
+	flateWriters sync.Pool
+	flateReaders sync.Pool
+)
+
+// compressContent returns `text` in the compressed storage format.
+func compressContent(text string) string {
+	var b bytes.Buffer
+	b.WriteString(compressedPrefix)
+	fw, _ := flateWriters.Get().(*flate.Writer)
+	if fw == nil {
+		fw, _ = flate.NewWriter(&b, flate.DefaultCompression)
+	} else {
+		fw.Reset(&b)
+	}
+	io.WriteString(fw, text)
+	fw.Close()
+	flateWriters.Put(fw)
+	return b.String()
+}
+
+// encodeContent returns `text` in the storage format, compressed if
+// `compress` is set.
+func encodeContent(text string, compress bool) string {
+	switch {
+	case compress:
+		return compressContent(text)
+	case strings.HasPrefix(text, compressedPrefix), strings.HasPrefix(text, escapedPrefix):
+		return escapedPrefix + text
+	}
+	return text
+}
+
+// isCompressed reports whether stored chunk content is compressed.
+func isCompressed(stored string) bool {
+	return strings.HasPrefix(stored, compressedPrefix)
+}
+
+// decodeContent returns the text of stored chunk content, compressed
+// or not.
+func decodeContent(stored string) string {
+	if text, ok := strings.CutPrefix(stored, escapedPrefix); ok {
+		return text
+	}
+	if !isCompressed(stored) {
+		return stored
+	}
+	src := strings.NewReader(stored[len(compressedPrefix):])
+	fr, _ := flateReaders.Get().(io.ReadCloser)
+	if fr == nil {
+		fr = flate.NewReader(src)
+	} else {
+		fr.(flate.Resetter).Reset(src, nil)
+	}
+	defer flateReaders.Put(fr)
+	b, err := io.ReadAll(fr)
+	if err != nil {
+		log.Printf("WARN: damaged compressed chunk: %v", err)
+	}
+	return string(b)
+}
+
+// contentVal returns the text of a content column value.
+func contentVal(v any) string {
+	if s, ok := v.(string); ok {
+		return decodeContent(s)
+	}
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// recompress converts the chunks of all collections to the compressed
+// format, or with `compress` false back to plain text, and saves the
+// database. It returns the number of converted chunks.
+func (r *ragSystem) recompress(compress bool) (int, error) {
+	total := 0
+	for _, c := range r.allCollections() {
+		r.dbMu.Lock()
+		n, err := c.recompressLocked(compress)
+		if n > 0 {
+			c.invalidateCacheLocked()
+		}
+		r.dbMu.Unlock()
+		if err != nil {
+			return total, fmt.Errorf("collection %s: %w", c.collection, err)
+		}
+		total += n
+		log.Printf("compress: %s: %d chunks converted", c.collection, n)
+	}
+	return total, r.save()
+}
+
+// recompressLocked converts the chunks of this collection. Like
+// addColumnLocked it rebuilds the table, which is much faster than an
+// UPDATE per chunk. It must be called with r.dbMu held.
+func (r *ragSystem) recompressLocked(compress bool) (int, error) {
+	t, err := r.db.Get(r.collection, "chunks")
+	if err != nil {
+		return 0, err
+	}
+	col := slices.IndexFunc(t.Cols, func(c tinysql.Column) bool { return strings.EqualFold(c.Name, "content") })
+	if col < 0 {
+		return 0, errors.New("chunks table without content column")
+	}
+	rows := make([][]any, len(t.Rows))
+	n := 0
+	for i, row := range t.Rows {
+		rows[i] = row
+		stored, ok := row[col].(string)
+		if !ok || isCompressed(stored) == compress {
+			continue
+		}
+		row = slices.Clone(row)
+		row[col] = encodeContent(decodeContent(stored), compress)
+		rows[i] = row
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	nt := tinysql.NewTable(t.Name, slices.Clone(t.Cols), t.IsTemp)
+	nt.Rows = rows
+	if err := r.db.Drop(r.collection, "chunks"); err != nil {
+		return 0, err
+	}
+	r.markDirty()
+	return n, r.db.Put(r.collection, nt)
+}
+
+// storeChunks inserts the embedded `chunks` of source `src` and records
+// the source, rolling back on failure. It stores nothing and returns
+// false if the article is already present. The rows and the source are
+// written under one exclusive lock, so readers and saves never see a
+// partial article. Callers save the database.
+func (r *ragSystem) storeChunks(src sourceInfo, chunks []string, vecs [][]float64) (bool, error) {
+	if len(vecs) != len(chunks) {
+		return false, fmt.Errorf("%d vectors for %d chunks of %q", len(vecs), len(chunks), src.Name)
+	}
+	startID, err := r.allocIDs(len(chunks))
+	if err != nil {
+		return false, err
+	}
+	// Parsing needs no lock; only the inserts hold it.
+	stmts := make([]tinysql.Statement, len(chunks))
+	for idx := range chunks {
+		if stmts[idx], err = tinysql.ParseSQL(chunkInsertSQL(startID+idx, src.Name, idx, chunks[idx], vecs[idx], r.compress)); err != nil {
+			return false, fmt.Errorf("insert chunk %d: %w", idx, err)
+		}
+	}
+
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+	if r.articleChunkCountLocked(src.Name) > 0 {
+		return false, nil
+	}
+	if err := r.checkEmbedDimLocked(vecs); err != nil {
+		return false, err
+	}
+	for idx, stmt := range stmts {
+		if _, err := tinysql.Execute(context.Background(), r.db, r.collection, stmt); err != nil {
+			if rbErr := r.deleteIDRangeLocked(startID, startID+idx); rbErr != nil {
+				log.Printf("WARN: rollback of %q failed: %v", src.Name, rbErr)
+			}
+			r.markDirty()
+			return false, fmt.Errorf("insert chunk %d: %w", idx, err)
+		}
+	}
+	r.addCachedChunksLocked(len(chunks))
+	r.addCachedCentroidLocked(src.Name, vecs)
+	src.ChunkCount, src.Chars, src.ContentHash = len(chunks), 0, chunksHash(chunks)
+	for _, c := range chunks {
+		src.Chars += len(c)
+	}
+	if err := r.upsertSourceLocked(src); err != nil {
+		log.Printf("WARN: recording source %q failed: %v", src.Name, err)
+	}
+	r.markDirty()
+	return true, nil
+}
+
+// deleteIDRangeLocked removes chunks with from <= id < to. It must be
+// called with r.dbMu held.
+func (r *ragSystem) deleteIDRangeLocked(from, to int) error {
+	if to <= from {
+		return nil
+	}
+	stmt, err := tinysql.ParseSQL(fmt.Sprintf("DELETE FROM chunks WHERE id >= %d AND id < %d", from, to))
+	if err != nil {
+		return err
+	}
+	_, err = tinysql.Execute(context.Background(), r.db, r.collection, stmt)
+	r.invalidateCacheLocked()
+	return err
+}
+
+// kbCache is the cached state of one collection.
+type kbCache struct {
+	chunks  int
+	counted bool
+	sources []sourceInfo // ordered by name; nil = not loaded
+	// centroids sums the chunk vectors per source (nil = not loaded);
+	// centroidGen counts their updates. graph was computed from them
+	// with the parameters in graphKey.
+	centroids   map[string]*centroid
+	centroidGen int
+	graph       *sourceGraph
+	graphKey    string
+}
+
+// cacheLocked returns the cache entry of this collection, creating it.
+// It must be called with r.cacheMu held.
+func (r *ragSystem) cacheLocked() *kbCache {
+	c := r.caches[r.collection]
+	if c == nil {
+		c = &kbCache{}
+		r.caches[r.collection] = c
+	}
+	return c
+}
+
+// addCachedChunksLocked adjusts the cached chunk count by `n`. It must
+// be called with r.dbMu held for writing.
+func (r *ragSystem) addCachedChunksLocked(n int) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	if c := r.cacheLocked(); c.counted {
+		c.chunks += n
+	}
+}
+
+// addCachedCentroidLocked adds the vectors of new chunks of `source` to
+// the cached centroids. It must be called with r.dbMu held for writing.
+func (r *ragSystem) addCachedCentroidLocked(source string, vecs [][]float64) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	c := r.cacheLocked()
+	if c.centroids == nil {
+		return
+	}
+	cen := c.centroids[source]
+	if cen == nil {
+		cen = &centroid{}
+		c.centroids[source] = cen
+	}
+	for _, v := range vecs {
+		cen.add(v)
+	}
+	c.centroidGen++
+	c.graph = nil
+}
+
+// putCachedSourceLocked adds or replaces `info` in the cached source
+// list. It must be called with r.dbMu held for writing.
+func (r *ragSystem) putCachedSourceLocked(info sourceInfo) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	c := r.cacheLocked()
+	if c.sources == nil {
+		return
+	}
+	i, found := slices.BinarySearchFunc(c.sources, info.Name, func(s sourceInfo, name string) int {
+		return strings.Compare(s.Name, name)
+	})
+	if found {
+		c.sources[i] = info
+	} else {
+		c.sources = slices.Insert(c.sources, i, info)
+	}
+}
+
+// invalidateCacheLocked drops the cached state of this collection. It
+// must be called with r.dbMu held for writing.
+func (r *ragSystem) invalidateCacheLocked() {
+	r.cacheMu.Lock()
+	delete(r.caches, r.collection)
+	r.cacheMu.Unlock()
+}
+
+// docCount returns the total number of stored chunks.
+func (r *ragSystem) docCount() int {
+	if !r.noCache {
+		r.cacheMu.Lock()
+		c := r.cacheLocked()
+		n, ok := c.chunks, c.counted
+		r.cacheMu.Unlock()
+		if ok {
+			return n
+		}
+	}
+	stmt, _ := tinysql.ParseSQL("SELECT COUNT(*) AS cnt FROM chunks")
+
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	rs, err := tinysql.Execute(context.Background(), r.db, r.collection, stmt)
+	if err != nil || rs == nil || len(rs.Rows) == 0 {
+		return 0
+	}
+	v, ok := tinysql.GetVal(rs.Rows[0], "cnt")
+	if !ok {
+		return 0
+	}
+	n := 0
+	switch cnt := v.(type) {
+	case int:
+		n = cnt
+	case int64:
+		n = int(cnt)
+	case float64:
+		n = int(cnt)
+	}
+	r.cacheMu.Lock()
+	c := r.cacheLocked()
+	c.chunks, c.counted = n, true
+	r.cacheMu.Unlock()
+	return n
+}
+
+// corpusDim returns the dimension of the stored embeddings, taken from
+// the first collection that has chunks, or 0 for an empty database.
+func (r *ragSystem) corpusDim() int {
+	stmt, _ := tinysql.ParseSQL("SELECT embedding FROM chunks LIMIT 1")
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	for _, c := range r.allCollections() {
+		rs, err := tinysql.Execute(context.Background(), r.db, c.collection, stmt)
+		if err != nil || rs == nil || len(rs.Rows) == 0 {
+			continue
+		}
+		v, _ := tinysql.GetVal(rs.Rows[0], "embedding")
+		if vec, ok := v.([]float64); ok && len(vec) > 0 {
+			return len(vec)
+		}
+	}
+	return 0
+}
+
+// searchResult represents a single retrieval hit returned by searchJSON.
+type searchResult struct {
+	Score   float64 `json:"score"`
+	Content string  `json:"content"`
+	Article string  `json:"article,omitempty"`
+	Lang    string  `json:"lang,omitempty"`
+}
+
+// searchJSON performs an embedding-based vector search for `query`,
+// returning up to `k` primary hits along with neighbor chunks. A
+// non-empty `lang` restricts the primary hits to chunks in that language.
+func (r *ragSystem) searchJSON(ctx context.Context, query string, k int, lang string) ([]searchResult, error) {
+	if names, ok := sourceFilter(ctx); ok && len(names) == 0 {
+		return []searchResult{}, nil
+	}
+	qvec, err := r.lmFor(ctx).embedSingle(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := r.searchHits(ctx, qvec, candidateLimit(k), lang)
+	if err != nil {
+		return nil, err
+	}
+	// Pick up to k primary hits above the relaxed threshold; a candidate
+	// that is a neighbor of an earlier pick is already part of the result.
+	thresh := r.retrievalOptions(k).RelaxedThreshold
+	taken := make(map[chunkKey]bool)
+	var sel []chunkHit
+	for _, h := range candidates {
+		if len(sel) >= k {
+			break
+		}
+		if h.score <= thresh || taken[chunkKey{h.article, h.chunkIdx}] {
+			continue
+		}
+		sel = append(sel, h)
+		for d := -1; d <= 1; d++ {
+			taken[chunkKey{h.article, h.chunkIdx + d}] = true
+		}
+	}
+	chunks, err := r.withNeighbors(sel, make(map[chunkKey]bool))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]searchResult, 0, len(chunks))
+	for _, h := range chunks {
+		results = append(results, searchResult{Score: h.score, Content: h.content, Article: h.article, Lang: h.lang})
+	}
+	return results, nil
+}
+
+// ── Tool / API definitions ─────────────────────────────────────────
+
+// toolDef describes a built-in or custom tool available to the assistant.
+type toolDef struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	ParamHint   string `json:"param_hint"`
+}
+
+// persona represents a user-selectable assistant persona with a
+// pre-prompt that influences system behavior.
+type persona struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Prompt string `json:"prompt"`
+	// Optional generation overrides; unset fields use the request or
+	// settings values.
+	ChatModel   string   `json:"chat_model,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	// AllowedTools restricts the tools offered to chats using this
+	// persona; empty means all enabled tools.
+	AllowedTools []string `json:"allowed_tools,omitempty"`
+}
+
+// builtinPersonas returns the persona library seeded on first run,
+// with prompts in `lang` (German or English).
+func builtinPersonas(lang string) []persona {
+	de := lang == "de"
+	pick := func(deText, enText string) string {
+		if de {
+			return deText
+		}
+		return enText
+	}
+	return []persona{
+		{ID: "persona-default", Name: "Standard"},
+		{ID: "persona-researcher", Name: "Researcher", Prompt: pick(
+			"Du bist ein gründlicher Rechercheur. Stütze jede Aussage auf den Kontext oder ein Tool-Ergebnis, nenne die Quellen und kennzeichne Unsicherheiten und Wissenslücken deutlich.",
+			"You are a thorough researcher. Back every statement with the context or a tool result, cite your sources and clearly flag uncertainty and gaps in knowledge.")},
+		{ID: "persona-coder", Name: "Coder", Prompt: pick(
+			"Du bist ein erfahrener Softwareentwickler. Antworte knapp und technisch präzise, zeige lauffähigen Code in Markdown-Codeblöcken und erkläre nur, was nicht offensichtlich ist.",
+			"You are an experienced software engineer. Answer concisely and precisely, show runnable code in Markdown code blocks and only explain what is not obvious.")},
+		{ID: "persona-translator", Name: "Translator", Prompt: pick(
+			"Du bist ein professioneller Übersetzer. Übersetze den Text in die gewünschte Sprache (ohne Angabe zwischen Deutsch und Englisch), erhalte Bedeutung, Ton und Formatierung und füge keine Erklärungen hinzu.",
+			"You are a professional translator. Translate the text into the requested language (if none is given, between English and German), preserve meaning, tone and formatting and add no explanations.")},
+		{ID: "persona-summarizer", Name: "Summarizer", Prompt: pick(
+			"Du fasst Inhalte zusammen. Beginne mit einem Satz zur Kernaussage, gefolgt von höchstens fünf Stichpunkten mit den wichtigsten Fakten. Lass Details und Wiederholungen weg.",
+			"You summarize content. Start with one sentence stating the key point, followed by at most five bullet points with the most important facts. Leave out details and repetition.")},
+	}
+}
+
+// maxGenTokens caps max_tokens of personas and requests.
+const maxGenTokens = 32768
+
+// validate normalizes the persona and checks its generation overrides.
+func (p *persona) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	p.Prompt = strings.TrimSpace(p.Prompt)
+	p.ChatModel = strings.TrimSpace(p.ChatModel)
+	if p.Name == "" {
+		return fmt.Errorf("name required")
+	}
+	var tools []string
+	for _, t := range p.AllowedTools {
+		if t = strings.TrimSpace(t); t != "" && !slices.Contains(tools, t) {
+			tools = append(tools, t)
+		}
+	}
+	p.AllowedTools = tools
+	return p.genParams().validate()
+}
+
+// allowsTool reports whether chats using this persona may run `name`.
+func (p persona) allowsTool(name string) bool {
+	return len(p.AllowedTools) == 0 || slices.Contains(p.AllowedTools, name)
+}
+
+// filterTools returns the tools of `tools` this persona may use.
+func (p persona) filterTools(tools []toolDef) []toolDef {
+	if len(p.AllowedTools) == 0 {
+		return tools
+	}
+	out := make([]toolDef, 0, len(tools))
+	for _, t := range tools {
+		if p.allowsTool(t.Name) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// genParams returns the persona's generation overrides.
+func (p persona) genParams() genParams {
+	return genParams{Model: p.ChatModel, Temperature: p.Temperature, MaxTokens: p.MaxTokens}
+}
+
+// genParams are the chat model and sampling parameters of an answer.
+// Zero values leave the choice to the next level or the LLM server.
+type genParams struct {
+	Model       string   `json:"chat_model,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+}
+
+// validate checks the ranges accepted by OpenAI-compatible servers.
+func (g genParams) validate() error {
+	if g.Temperature != nil && (*g.Temperature < 0 || *g.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if g.MaxTokens < 0 || g.MaxTokens > maxGenTokens {
+		return fmt.Errorf("max_tokens must be between 0 and %d", maxGenTokens)
+	}
+	return nil
+}
+
+// resolveGenParams picks each parameter from the persona, then the
+// request, then `model` (the configured chat model).
+func resolveGenParams(model string, req, per genParams) genParams {
+	g := genParams{Model: model}
+	for _, o := range []genParams{req, per} {
+		if o.Model != "" {
+			g.Model = o.Model
+		}
+		if o.Temperature != nil {
+			g.Temperature = o.Temperature
+		}
+		if o.MaxTokens > 0 {
+			g.MaxTokens = o.MaxTokens
+		}
+	}
+	return g
+}
+
+// toolRequest is the structured marker the assistant can emit to
+// request that the frontend run a specific tool with a query.
+type toolRequest struct {
+	Tool  string `json:"tool"`
+	Query string `json:"query"`
+}
+
+var builtinTools = []toolDef{
+	{
+		Name:        "wikipedia",
+		Description: "Sucht einen Wikipedia-Artikel und lädt dessen Volltext. Verwende dies für Fakten über Personen, Orte, Ereignisse, Wissenschaft etc.",
+		ParamHint:   "Artikelname (z.B. 'Sonnensystem', 'Albert_Einstein')",
+	},
+	{
+		Name:        "duckduckgo",
+		Description: "Durchsucht das Web über DuckDuckGo und liefert eine Kurzantwort. Gut für aktuelle Fakten, Definitionen, kurze Zusammenfassungen.",
+		ParamHint:   "Suchbegriff (z.B. 'Hauptstadt von Frankreich')",
+	},
+	{
+		Name:        "wiktionary",
+		Description: "Schlägt ein Wort im Wiktionary (Wörterbuch) nach. Liefert Bedeutung, Etymologie, Übersetzungen.",
+		ParamHint:   "Einzelnes Wort (z.B. 'Apfel', 'serendipity')",
+	},
+	{
+		Name:        "stackoverflow",
+		Description: "Sucht eine passende StackOverflow-Frage und lädt akzeptierte sowie beste alternative Antwort (gut für Programmierfragen).",
+		ParamHint:   "Suchbegriff, Tags in eckigen Klammern (z.B. '[go] http client timeout')",
+	},
+	{
+		Name:        "websearch",
+		Description: "Allgemeine Websuche (DuckDuckGo-basiert) für breite Recherchen.",
+		ParamHint:   "Suchbegriff (z.B. 'Wetter Berlin heute')",
+	},
+	{
+		Name:        "weather",
+		Description: "Liefert aktuelles Wetter und eine 3-Tage-Vorhersage (Open-Meteo) für einen Ort.",
+		ParamHint:   "Ortsname, optional mit Region/Land (z.B. 'Berlin', 'Springfield, Illinois')",
+	},
+	{
+		Name:        "convert",
+		Description: "Rechnet Einheiten (Länge, Masse, Temperatur, Datengröße) und Währungen (EZB-Tageskurse) um.",
+		ParamHint:   "Menge mit Einheit und Ziel (z.B. '25 mi in km', '100 USD in EUR', '30 °C in °F')",
+	},
+	{
+		Name:        "rag_search",
+		Description: "Durchsucht die lokale Wissensbasis erneut mit einer eigenen Suchanfrage. Gut für mehrstufige Fragen, wenn der Kontext einen weiteren Begriff nennt.",
+		ParamHint:   "Suchanfrage (z.B. 'Gründungsjahr der Firma X')",
+	},
+	{
+		Name:        "sql",
+		Description: "Führt eine lesende SQL-Abfrage (nur SELECT) auf der Tabelle chunks(article, chunk_idx, content, embedding, lang) aus. Muss in der Tool-Policy aktiviert werden.",
+		ParamHint:   "SELECT-Abfrage (z.B. 'SELECT article, COUNT(*) AS n FROM chunks GROUP BY article ORDER BY n DESC')",
+	},
+	{
+		Name:        "nanogo",
+		Description: "Führt sicheren, interpretierten Go-Code (nanoGo) aus. Muss in den Einstellungen aktiviert werden.",
+		ParamHint:   "Go-Quelltext (kurze Snippets)",
+	},
+	{
+		Name:        "python",
+		Description: "Führt ein Python-Snippet in einem isolierten Unterprozess aus und liefert stdout/stderr. Muss in den Einstellungen aktiviert werden.",
+		ParamHint:   "Python-Quelltext (z.B. 'print(sum(range(10)))')",
+	},
+	{
+		Name:        "llm",
+		Description: "Führe einen direkten Prompt gegen das konfigurierte LLM aus (für kreative Antworten oder kurze Analysen).",
+		ParamHint:   "Prompt / Frage",
+	},
+	{
+		Name:        "calculate",
+		Description: "Führt eine sichere Berechnung aus (arithmetische Ausdrücke). Nutzt das eingebundene smallR für Evaluation.",
+		ParamHint:   "Expression (z.B. '3*2+(2^3)')",
+	},
+	{
+		Name:        "exec_code",
+		Description: "Führt (sichere) Code-Analysen oder -Ausführungen durch. Standardmäßig nur statische Prüfungen; Ausführung muss in den Einstellungen aktiviert werden.",
+		ParamHint:   "Quelltext (z.B. Go code)",
+	},
+}
+
+// toolPolicy controls whether a tool may run, whether the assistant may
+// run it automatically during /api/ask, and how long it may take.
+type toolPolicy struct {
+	Enabled     bool `json:"enabled"`
+	AutoExecute bool `json:"auto_execute"`
+	TimeoutS    int  `json:"timeout_s"`
+	// Persist stores tool results as chunks in the knowledge base. When
+	// false, results only live in the conversation that requested them.
+	Persist *bool `json:"persist,omitempty"`
+}
+
+// persists reports whether results of the tool are embedded.
+func (p toolPolicy) persists() bool {
+	return p.Persist != nil && *p.Persist
+}
+
+// ephemeralSourcePrefixes are the source prefixes of tools that used to be
+// embedded but are ephemeral by default; see /api/sources/cleanup-ephemeral.
+var ephemeralSourcePrefixes = []string{"ddg:", "web:", "calc:"}
+
+// defaultToolPolicy returns the built-in policy for `name`. Unknown
+// names (custom APIs) are treated like network lookups.
+func defaultToolPolicy(name string) toolPolicy {
+	p := toolPolicy{Enabled: true, AutoExecute: true, TimeoutS: 30}
+	switch name {
+	case "duckduckgo", "wiktionary", "stackoverflow", "websearch", "weather", "convert":
+		p.TimeoutS = 15
+	case "llm":
+		p.TimeoutS = 120
+	case "calculate":
+		p.TimeoutS = 10
+	case "nanogo":
+		p.TimeoutS = 5
+	case "sql":
+		p.Enabled, p.AutoExecute, p.TimeoutS = false, false, 10
+	case "python":
+		p.TimeoutS = 10
+	}
+	if pl, ok := findPlugin(name); ok {
+		p.TimeoutS = pl.TimeoutS
+		p.Persist = &pl.Persist
+		return p
+	}
+	persist := true
+	switch name {
+	case "duckduckgo", "websearch", "llm", "calculate", "exec_code", "nanogo", "rag_search", "weather", "sql", "convert", "python":
+		persist = false
+	}
+	p.Persist = &persist
+	return p
+}
+
+// effectiveToolPolicy merges the default policy for `name` with the
+// configured override. The global code execution switches still apply:
+// nanogo is disabled without AllowNanoGo and exec_code only runs
+// automatically with AllowCodeExec.
+func effectiveToolPolicy(s appSettings, name string) toolPolicy {
+	p := defaultToolPolicy(name)
+	if override, ok := s.ToolPolicy[name]; ok {
+		def := p
+		p = override
+		if p.TimeoutS <= 0 {
+			p.TimeoutS = def.TimeoutS
+		}
+		if p.Persist == nil {
+			p.Persist = def.Persist
+		}
+	}
+	switch name {
+	case "rag_search":
+		// Results come from the knowledge base itself; never re-embed them.
+		persist := false
+		p.Persist = &persist
+	case "nanogo":
+		p.Enabled = p.Enabled && s.AllowNanoGo
+	case "python":
+		p.Enabled = p.Enabled && s.AllowPythonExec
+	case "exec_code":
+		p.AutoExecute = p.AutoExecute && s.AllowCodeExec
+	}
+	if _, ok := findPlugin(name); ok {
+		p.Enabled = p.Enabled && s.AllowPlugins
+	}
+	if !p.Enabled {
+		p.AutoExecute = false
+	}
+	return p
+}
+
+// enabledTools filters `tools` down to the ones enabled by policy.
+// With OfflineNetwork only local tools remain.
+func enabledTools(tools []toolDef, s appSettings) []toolDef {
+	return availableTools(tools, s, s.OfflineNetwork)
+}
+
+// availableTools filters `tools` down to the ones enabled by policy,
+// dropping network tools when `offline` is set.
+func availableTools(tools []toolDef, s appSettings, offline bool) []toolDef {
+	out := make([]toolDef, 0, len(tools))
+	for _, t := range tools {
+		if offline && !localTool(t.Name) {
+			continue
+		}
+		if effectiveToolPolicy(s, t.Name).Enabled {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// ── Custom API store (persisted through settingsStore) ──────────────
+
+// customAPI models a user-added external API template persisted in settings.
+// Entries without Method, Headers, BodyTemplate and ResponseType behave
+// like a plain GET of Template.
+type customAPI struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Template     string            `json:"template"` // URL with $q placeholder
+	Desc         string            `json:"desc"`
+	Method       string            `json:"method,omitempty"`        // GET (default), POST, PUT, PATCH, DELETE
+	Headers      map[string]string `json:"headers,omitempty"`       // extra request headers
+	BodyTemplate string            `json:"body_template,omitempty"` // request body with $q placeholder
+	ResponseType string            `json:"response_type,omitempty"` // html (default), text or json
+	Extract      string            `json:"extract,omitempty"`       // JSON path, e.g. "items[*].title"
+	// HeaderRefs name the secrets.json entries of the secret headers (see
+	// isSecretHeader). It is only used in settings.json; in memory the
+	// values are in Headers.
+	HeaderRefs map[string]string `json:"header_refs,omitempty"`
+}
+
+// validate normalizes the API definition and checks that it can be executed.
+func (a *customAPI) validate() error {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Template = strings.TrimSpace(a.Template)
+	a.Method = strings.ToUpper(strings.TrimSpace(a.Method))
+	a.ResponseType = strings.ToLower(strings.TrimSpace(a.ResponseType))
+	if a.Name == "" || a.Template == "" {
+		return fmt.Errorf("missing name or template")
+	}
+	u, err := url.Parse(strings.ReplaceAll(a.Template, "$q", "q"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("template must be an absolute http(s) URL")
+	}
+	if !strings.Contains(a.Template, "$q") && !strings.Contains(a.BodyTemplate, "$q") {
+		return fmt.Errorf("template or body_template must contain $q placeholder")
+	}
+	switch a.Method {
+	case "":
+		a.Method = "GET"
+	case "GET", "POST", "PUT", "PATCH", "DELETE":
+	default:
+		return fmt.Errorf("unsupported method %q", a.Method)
+	}
+	if a.Method == "GET" && a.BodyTemplate != "" {
+		return fmt.Errorf("body_template requires a method other than GET")
+	}
+	switch a.ResponseType {
+	case "", "html", "text", "json":
+	default:
+		return fmt.Errorf("response_type must be html, text or json")
+	}
+	a.Extract = strings.TrimSpace(a.Extract)
+	if a.Extract != "" {
+		if _, err := jsonPathSegments(a.Extract); err != nil {
+			return fmt.Errorf("invalid extract: %w", err)
+		}
+	}
+	for name := range a.Headers {
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// isSecretHeader reports whether a header likely carries credentials.
+func isSecretHeader(name string) bool {
+	n := strings.ToLower(name)
+	for _, hint := range []string{"auth", "key", "token", "secret", "cookie", "password"} {
+		if strings.Contains(n, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// masked returns a copy of the API with secret header values hidden.
+func (a customAPI) masked() customAPI {
+	if len(a.Headers) == 0 {
+		return a
+	}
+	h := make(map[string]string, len(a.Headers))
+	for k, v := range a.Headers {
+		if isSecretHeader(k) && v != "" {
+			v = "********"
+		}
+		h[k] = v
+	}
+	a.Headers = h
+	return a
+}
+
+// apiStore manages the set of persisted custom APIs through settings.
+type apiStore struct {
+	mu       sync.Mutex
+	settings *settingsStore
+}
+
+// newAPIStore creates an apiStore backed by `settings`.
+func newAPIStore(settings *settingsStore) *apiStore {
+	return &apiStore{settings: settings}
+}
+
+// list returns a copy of configured custom APIs.
+func (s *apiStore) list() []customAPI {
+	return slices.Clone(s.settings.get().CustomAPIs)
+}
+
+// add registers a new custom API and persists settings. The ID is
+// assigned by the store.
+func (s *apiStore) add(api customAPI) (customAPI, error) {
+	err := s.settings.update(func(st *appSettings) error {
+		api.ID = unusedID("api", func(id string) bool {
+			return slices.ContainsFunc(st.CustomAPIs, func(x customAPI) bool { return x.ID == id })
+		})
+		st.CustomAPIs = append(st.CustomAPIs, api)
+		return nil
+	})
+	if err != nil {
+		return customAPI{}, err
+	}
+	return api, nil
+}
+
+// remove deletes a custom API by id and persists the change.
+func (s *apiStore) remove(id string) (bool, error) {
+	err := s.settings.update(func(st *appSettings) error {
+		i := slices.IndexFunc(st.CustomAPIs, func(a customAPI) bool { return a.ID == id })
+		if i < 0 {
+			return errSettingsUnchanged
+		}
+		st.CustomAPIs = slices.Delete(st.CustomAPIs, i, i+1)
+		return nil
+	})
+	if err == errSettingsUnchanged {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ── Persona store (persisted through settingsStore) ───────────────
+
+// personaStore manages persisted personas stored inside settings.
+type personaStore struct {
+	mu       sync.Mutex
+	settings *settingsStore
+}
+
+// newPersonaStore constructs a personaStore backed by `settings`.
+func newPersonaStore(settings *settingsStore) *personaStore {
+	return &personaStore{settings: settings}
+}
+
+// list returns a copy of all configured personas.
+func (p *personaStore) list() []persona {
+	return slices.Clone(p.settings.get().Personas)
+}
+
+// defaultID returns the ID of the configured default persona, falling
+// back to the first persona or an empty string.
+func (p *personaStore) defaultID() string {
+	s := p.settings.get()
+	if s.DefaultPersonaID != "" && slices.ContainsFunc(s.Personas, func(per persona) bool { return per.ID == s.DefaultPersonaID }) {
+		return s.DefaultPersonaID
+	}
+	if len(s.Personas) == 0 {
+		return ""
+	}
+	return s.Personas[0].ID
+}
+
+// get retrieves a persona by id.
+func (p *personaStore) get(id string) (persona, bool) {
+	for _, per := range p.settings.get().Personas {
+		if per.ID == id {
+			return per, true
+		}
+	}
+	return persona{}, false
+}
+
+// add creates and persists a new persona; the ID is assigned by the store.
+func (p *personaStore) add(per persona) (persona, error) {
+	if err := per.validate(); err != nil {
+		return persona{}, err
+	}
+	err := p.settings.update(func(st *appSettings) error {
+		per.ID = unusedID("persona", func(id string) bool {
+			return slices.ContainsFunc(st.Personas, func(x persona) bool { return x.ID == id })
+		})
+		st.Personas = append(st.Personas, per)
+		return nil
+	})
+	return per, err
+}
+
+// update replaces an existing persona, keeping its ID so conversations
+// referencing it stay intact.
+func (p *personaStore) update(per persona) (persona, bool, error) {
+	if err := per.validate(); err != nil {
+		return persona{}, false, err
+	}
+	err := p.settings.update(func(st *appSettings) error {
+		i := slices.IndexFunc(st.Personas, func(x persona) bool { return x.ID == per.ID })
+		if i < 0 {
+			return errSettingsUnchanged
+		}
+		st.Personas[i] = per
+		return nil
+	})
+	if err == errSettingsUnchanged {
+		return persona{}, false, nil
+	}
+	return per, err == nil, err
+}
+
+// importPersonas adds `list` under fresh IDs, skipping invalid entries
+// and names that already exist (case-insensitive).
+func (p *personaStore) importPersonas(list []persona) (created, skipped int, err error) {
+	base := time.Now().UnixNano()
+	err = p.settings.update(func(st *appSettings) error {
+		created, skipped = 0, 0
+		for _, per := range list {
+			if per.validate() != nil || slices.ContainsFunc(st.Personas, func(x persona) bool { return strings.EqualFold(x.Name, per.Name) }) {
+				skipped++
+				continue
+			}
+			per.ID = fmt.Sprintf("persona-%d", base+int64(created))
+			st.Personas = append(st.Personas, per)
+			created++
+		}
+		if created == 0 {
+			return errSettingsUnchanged
+		}
+		return nil
+	})
+	if err == errSettingsUnchanged {
+		err = nil
+	}
+	return created, skipped, err
+}
+
+// remove deletes a persona by id and persists the change. Removing the
+// default persona clears the default.
+func (p *personaStore) remove(id string) (bool, error) {
+	err := p.settings.update(func(st *appSettings) error {
+		i := slices.IndexFunc(st.Personas, func(per persona) bool { return per.ID == id })
+		if i < 0 {
+			return errSettingsUnchanged
+		}
+		st.Personas = slices.Delete(st.Personas, i, i+1)
+		if st.DefaultPersonaID == id {
+			st.DefaultPersonaID = ""
+		}
+		return nil
+	})
+	if err == errSettingsUnchanged {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// get returns a customAPI by id if it exists.
+func (s *apiStore) get(id string) (customAPI, bool) {
+	for _, a := range s.settings.get().CustomAPIs {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return customAPI{}, false
+}
+
+// allTools returns the union of builtin tools and persisted custom APIs.
+func (s *apiStore) allTools() []toolDef {
+	all := make([]toolDef, len(builtinTools))
+	copy(all, builtinTools)
+
+	for _, a := range s.settings.get().CustomAPIs {
+		desc := a.Desc
+		if desc == "" {
+			desc = "Custom API: " + a.Template
+		}
+		all = append(all, toolDef{
+			Name:        a.ID,
+			Description: desc,
+			ParamHint:   "Suchbegriff (wird in $q eingesetzt)",
+		})
+	}
+	for _, p := range plugins {
+		all = append(all, p.toolDef)
+	}
+	return all
+}
+
+// ── Plugin tools (external executables) ────────────────────────────
+
+// pluginTool is an executable from the plugins directory. It receives
+// {"query": "..."} on stdin and answers {"output": "...", "error": "..."}
+// on stdout.
+type pluginTool struct {
+	toolDef
+	Path     string `json:"-"`
+	TimeoutS int    `json:"timeout"`
+	Persist  bool   `json:"persist"`
+}
+
+// plugins holds the plugin tools registered at startup.
+var plugins []pluginTool
+
+// maxPluginOutput caps the stdout read from a plugin.
+const maxPluginOutput = 1 << 20
+
+// loadPlugins scans `dir` for executables with a sidecar manifest
+// ("<file>.json" or "<file-without-extension>.json").
+func loadPlugins(dir string) ([]pluginTool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	builtin := map[string]bool{}
+	for _, t := range builtinTools {
+		builtin[t.Name] = true
+	}
+	var out []pluginTool
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || info.Mode()&0o111 == 0 {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		manifest := path + ".json"
+		if _, err := os.Stat(manifest); err != nil {
+			manifest = strings.TrimSuffix(path, filepath.Ext(path)) + ".json"
+		}
+		b, err := os.ReadFile(manifest)
+		if err != nil {
+			log.Printf("plugin %s: no manifest, skipped", e.Name())
+			continue
+		}
+		var p pluginTool
+		if err := json.Unmarshal(b, &p); err != nil {
+			log.Printf("plugin %s: invalid manifest: %v", e.Name(), err)
+			continue
+		}
+		if p.Name == "" {
+			p.Name = strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		}
+		if builtin[p.Name] || seen[p.Name] {
+			log.Printf("plugin %s: name %q already in use, skipped", e.Name(), p.Name)
+			continue
+		}
+		if p.TimeoutS <= 0 {
+			p.TimeoutS = 30
+		}
+		p.Path = path
+		seen[p.Name] = true
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// cappedBuffer is a bytes.Buffer that silently drops writes beyond max.
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room < len(p) {
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// findPlugin returns the registered plugin called `name`.
+func findPlugin(name string) (pluginTool, bool) {
+	for _, p := range plugins {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return pluginTool{}, false
+}
+
+// runPlugin executes `p` for `query`. Crashes, timeouts, non-zero exits
+// and malformed output are returned as errors; stderr goes to the log.
+func runPlugin(ctx context.Context, p pluginTool, query string) (string, error) {
+	in, _ := json.Marshal(map[string]string{"query": query})
+	cmd := exec.CommandContext(ctx, p.Path)
+	cmd.Dir = filepath.Dir(p.Path)
+	cmd.Stdin = bytes.NewReader(in)
+	// Don't wait for grandchildren holding the pipes after a kill.
+	cmd.WaitDelay = time.Second
+	stdout := &cappedBuffer{max: maxPluginOutput}
+	stderr := &cappedBuffer{max: 64 << 10}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	waitErr := cmd.Run()
+	raw := stdout.Bytes()
+	if stderr.Len() > 0 {
+		log.Printf("plugin %s stderr: %s", p.Name, strings.TrimSpace(stderr.String()))
+	}
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("plugin %s: %w", p.Name, ctx.Err())
+	}
+	if waitErr != nil {
+		return "", fmt.Errorf("plugin %s failed: %w", p.Name, waitErr)
+	}
+	var res struct {
+		Output string `json:"output"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return "", fmt.Errorf("plugin %s: invalid output: %w", p.Name, err)
+	}
+	if res.Error != "" {
+		return "", fmt.Errorf("plugin %s: %s", p.Name, res.Error)
+	}
+	return res.Output, nil
+}
+
+// Markers wrapping a tool request emitted by the assistant.
+const (
+	toolRequestOpen  = "[TOOL_REQUEST]"
+	toolRequestClose = "[/TOOL_REQUEST]"
+)
+
+// parseToolRequests returns the tool requests in `text` in order,
+// without duplicates. After each marker exactly one JSON value is
+// decoded, so queries may contain braces, escaped quotes or nested
+// objects. `found` reports whether a marker was present at all; `errs`
+// lists the requests that could not be parsed.
+func parseToolRequests(text string) (reqs []toolRequest, found bool, errs []error) {
+	seen := map[toolRequest]bool{}
+	for {
+		i := strings.Index(text, toolRequestOpen)
+		if i < 0 {
+			return reqs, found, errs
+		}
+		found = true
+		text = text[i+len(toolRequestOpen):]
+		tr, err := decodeToolRequest(text)
+		if err != nil {
+			errs = append(errs, err)
+		} else if !seen[tr] {
+			seen[tr] = true
+			reqs = append(reqs, tr)
+		}
+		if j := strings.Index(text, toolRequestClose); j >= 0 {
+			text = text[j+len(toolRequestClose):]
+		} else {
+			text = ""
+		}
+	}
+}
+
+// decodeToolRequest decodes the JSON value at the start of `text`.
+func decodeToolRequest(text string) (toolRequest, error) {
+	var raw struct {
+		Tool  string          `json:"tool"`
+		Query json.RawMessage `json:"query"`
+	}
+	if err := json.NewDecoder(strings.NewReader(text)).Decode(&raw); err != nil {
+		return toolRequest{}, fmt.Errorf("invalid tool request JSON: %w", err)
+	}
+	tr := toolRequest{Tool: strings.TrimSpace(raw.Tool)}
+	if tr.Tool == "" {
+		return toolRequest{}, fmt.Errorf("tool request without tool name")
+	}
+	// A non-string query (object, number, …) is passed on as raw JSON.
+	if len(raw.Query) > 0 && json.Unmarshal(raw.Query, &tr.Query) != nil {
+		tr.Query = string(raw.Query)
+	}
+	return tr, nil
+}
+
+// stripToolRequests removes every tool request marker from `text`,
+// including unparseable or unterminated ones.
+func stripToolRequests(text string) string {
+	for {
+		i := strings.Index(text, toolRequestOpen)
+		if i < 0 {
+			break
+		}
+		rest := text[i+len(toolRequestOpen):]
+		end := len(text)
+		if j := strings.Index(rest, toolRequestClose); j >= 0 {
+			end = i + len(toolRequestOpen) + j + len(toolRequestClose)
+		}
+		text = text[:i] + text[end:]
+	}
+	return strings.TrimSpace(text)
+}
+
+// toolRequestFilter removes tool request markers from streamed text.
+// Text that may be the start of a marker is held back until it is
+// clear whether it is one, so a marker split across several deltas
+// never reaches the client.
+type toolRequestFilter struct {
+	held   string
+	inside bool
+}
+
+// write takes the next piece of the stream and returns the text that
+// can be forwarded.
+func (f *toolRequestFilter) write(s string) string {
+	buf := f.held + s
+	var out strings.Builder
+	for {
+		if !f.inside {
+			if i := strings.Index(buf, toolRequestOpen); i >= 0 {
+				out.WriteString(buf[:i])
+				buf = buf[i+len(toolRequestOpen):]
+				f.inside = true
+				continue
+			}
+			n := len(buf) - partialMarker(buf, toolRequestOpen)
+			out.WriteString(buf[:n])
+			f.held = buf[n:]
+			return out.String()
+		}
+		if j := strings.Index(buf, toolRequestClose); j >= 0 {
+			buf = buf[j+len(toolRequestClose):]
+			f.inside = false
+			continue
+		}
+		f.held = buf[len(buf)-partialMarker(buf, toolRequestClose):]
+		return out.String()
+	}
+}
+
+// flush returns held back text at the end of the stream. The rest of an
+// unterminated tool request is dropped, as in stripToolRequests.
+func (f *toolRequestFilter) flush() string {
+	held := f.held
+	f.held = ""
+	if f.inside {
+		return ""
+	}
+	return held
+}
+
+// partialMarker returns the length of the longest suffix of `s` that is
+// a proper prefix of `marker`.
+func partialMarker(s, marker string) int {
+	for n := min(len(s), len(marker)-1); n > 0; n-- {
+		if strings.HasSuffix(s, marker[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// buildToolSystemPrompt constructs the system prompt describing
+// available tools and how the assistant should emit up to `maxTools`
+// tool requests.
+func buildToolSystemPrompt(ctxText string, tools []toolDef, maxTools int) string {
+	var sb strings.Builder
+	sb.WriteString("Du bist ein hilfreicher Assistent. Beantworte Fragen basierend auf dem bereitgestellten Kontext.\n\n")
+	sb.WriteString("## Verfügbare Such-APIs\n")
+	sb.WriteString("Wenn der Kontext NICHT genügend Informationen enthält, um die Frage zuverlässig zu beantworten, ")
+	sb.WriteString("kannst du dem Nutzer vorschlagen, eine der folgenden Suchfunktionen zu verwenden. ")
+	sb.WriteString("Schreibe dazu am ENDE deiner Antwort einen Tool-Request in exakt diesem Format:\n\n")
+	sb.WriteString("[TOOL_REQUEST]{\"tool\":\"<name>\",\"query\":\"<suchbegriff>\"}[/TOOL_REQUEST]\n\n")
+	sb.WriteString("Verfügbare Tools:\n")
+	for _, t := range tools {
+		sb.WriteString(fmt.Sprintf("- **%s**: %s (Parameter: %s)\n", t.Name, t.Description, t.ParamHint))
+	}
+	sb.WriteString("\nWichtig:\n")
+	if maxTools > 1 {
+		sb.WriteString(fmt.Sprintf("- Du kannst bis zu %d Tool-Requests pro Antwort stellen, wenn die Frage mehrere Nachschlagen braucht (z.B. einen Vergleich zweier Orte), jeden in einem eigenen [TOOL_REQUEST]-Block. Sie werden gleichzeitig ausgeführt.\n", maxTools))
+		sb.WriteString("- Stelle dieselbe Anfrage nicht mehrfach.\n")
+	} else {
+		sb.WriteString("- Schlage nur EIN Tool pro Antwort vor.\n")
+	}
+	sb.WriteString("- Gib trotzdem eine kurze Antwort mit dem was du weißt, bevor du den Tool-Request anfügst.\n")
+	sb.WriteString("- Wenn der Kontext ausreicht, antworte normal OHNE Tool-Request.\n")
+	sb.WriteString("- Der Tool-Request muss EXAKT das Format [TOOL_REQUEST]{...}[/TOOL_REQUEST] haben.\n")
+	sb.WriteString("- Belege Aussagen aus nummerierten Kontextstellen mit deren Nummer in eckigen Klammern direkt nach der Aussage, z.B. [1] oder [2][3]. Erfinde keine Nummern.\n\n")
+	sb.WriteString("Kontext:\n")
+	sb.WriteString(ctxText)
+	return sb.String()
+}
+
+// dateLocale holds the words dateContextLine needs in one language.
+type dateLocale struct {
+	label, lang string
+	weekdays    [7]string // Sunday first, like time.Weekday
+	months      [12]string
+	// layout takes the weekday, day, month, year and time in this order.
+	layout string
+}
+
+// dateLocales are the date formats by language; others use "en".
+var dateLocales = map[string]dateLocale{
+	"de": {"Aktuelles Datum und Uhrzeit", "Sprache",
+		[7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		[12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		"%s, %d. %s %d, %s Uhr"},
+	"en": {"Current date and time", "Language",
+		[7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		[12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		"%s, %[3]s %[2]d, %[4]d, %[5]s"},
+	"fr": {"Date et heure actuelles", "Langue",
+		[7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		[12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		"%s %d %s %d, %s"},
+	"es": {"Fecha y hora actuales", "Idioma",
+		[7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		[12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		"%s, %d de %s de %d, %s"},
+	"it": {"Data e ora attuali", "Lingua",
+		[7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		[12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		"%s %d %s %d, ore %s"},
+}
+
+// dateContextLine states `now` with its time zone and the configured
+// language `lang` in that language, e.g. "Aktuelles Datum und Uhrzeit:
+// Freitag, 16. Oktober 2026, 14:05 Uhr (CEST, UTC+02:00). Sprache: de."
+func dateContextLine(now time.Time, lang string) string {
+	loc, ok := dateLocales[lang]
+	if !ok {
+		loc = dateLocales["en"]
+	}
+	date := fmt.Sprintf(loc.layout, loc.weekdays[now.Weekday()], now.Day(), loc.months[now.Month()-1], now.Year(), now.Format("15:04"))
+	return fmt.Sprintf("%s: %s (%s, UTC%s). %s: %s.", loc.label, date, now.Format("MST"), now.Format("-07:00"), loc.lang, lang)
+}
+
+// withDateContext starts `system` with the dateContextLine of the
+// current server time unless s.DisableDateContext is set.
+func withDateContext(system string, s appSettings) string {
+	if s.DisableDateContext {
+		return system
+	}
+	return dateContextLine(dateContextNow(), s.Lang) + "\n\n" + system
+}
+
+// dateContextNow is the clock of withDateContext.
+var dateContextNow = time.Now
+
+// ── Debug / Search models ─────────────────────────────────────────
+
+// debugChunk contains information about a retrieved chunk useful for
+// emitting debug payloads back to the frontend.
+type debugChunk struct {
+	Score      float64 `json:"score"`
+	Content    string  `json:"content"`
+	Article    string  `json:"article"`
+	ChunkIdx   int     `json:"chunk_idx"`
+	IsNeighbor bool    `json:"is_neighbor"`
+	Lang       string  `json:"lang,omitempty"`
+}
+
+// debugInfo aggregates retrieval timing and chunk-level debug data.
+type debugInfo struct {
+	Chunks      []debugChunk `json:"chunks"`
+	EmbedMs     int64        `json:"embed_ms"`
+	SearchMs    int64        `json:"search_ms"`
+	TotalChunks int          `json:"total_chunks"`
+	UsedK       int          `json:"used_k"`
+	Decision    string       `json:"decision,omitempty"`
+	SearchQuery string       `json:"search_query,omitempty"`
+	// QuestionLang is the detected language of the question.
+	QuestionLang string `json:"question_lang,omitempty"`
+	// Thresholds are the score thresholds in effect.
+	Thresholds *retrievalThresholds `json:"thresholds,omitempty"`
+	// Article shortcut: chunks of the matched article and how many of
+	// them fit into the context budget.
+	ArticleChunks     int `json:"article_chunks,omitempty"`
+	ArticleChunksUsed int `json:"article_chunks_used,omitempty"`
+	// OmittedChunks and OmittedNeighbors count the selected chunks and
+	// their neighbors left out to stay within the context budget.
+	OmittedChunks    int `json:"omitted_chunks,omitempty"`
+	OmittedNeighbors int `json:"omitted_neighbors,omitempty"`
+	// AnalysisFallback is why the reply of analyzeQuestion was replaced
+	// by the heuristic, if it was.
+	AnalysisFallback string `json:"analysis_fallback,omitempty"`
+	// TopScore and TopArticles describe the best search candidates,
+	// whether or not they were selected.
+	TopScore    float64  `json:"top_score,omitempty"`
+	TopArticles []string `json:"top_articles,omitempty"`
+	// RejectedChunks are the best search candidates left out of the
+	// context, with the reason (see rejectedCandidates).
+	RejectedChunks []rejectedChunk `json:"rejected_chunks,omitempty"`
+	// FocusBoosted counts the candidates that got focusBonus.
+	FocusBoosted int `json:"focus_boosted,omitempty"`
+	// AnalysisRaw is the unparsed reply of analyzeQuestion; only full
+	// debug output reports it.
+	AnalysisRaw string `json:"-"`
+	// QueryVec is the embedding of SearchQuery.
+	QueryVec []float64 `json:"-"`
+}
+
+// rejectedChunk is a search candidate that did not make it into the
+// context.
+type rejectedChunk struct {
+	Article  string  `json:"article"`
+	ChunkIdx int     `json:"chunk_idx"`
+	Score    float64 `json:"score"`
+	Reason   string  `json:"reason"`
+}
+
+// maxRejectedChunks caps debugInfo.RejectedChunks.
+const maxRejectedChunks = 20
+
+// searchQuery returns the refined retrieval query, if any.
+func (di *debugInfo) searchQuery() string {
+	if di == nil {
+		return ""
+	}
+	return di.SearchQuery
+}
+
+// citation maps a [n] marker in an answer to the context chunk it
+// refers to.
+type citation struct {
+	N        int     `json:"n"`
+	Article  string  `json:"article"`
+	ChunkIdx int     `json:"chunk_idx"`
+	Score    float64 `json:"score"`
+	Snippet  string  `json:"snippet"`
+}
+
+// citationMarkerRe matches [n] citation markers.
+var citationMarkerRe = regexp.MustCompile(`\[(\d+)\]`)
+
+// numberContext renders retrieved chunks as numbered context blocks
+// ("[1] wiki:Ettling #3: …") and returns the citation for each number.
+func numberContext(chunks []debugChunk) (string, []citation) {
+	parts := make([]string, 0, len(chunks))
+	cites := make([]citation, 0, len(chunks))
+	for i, c := range chunks {
+		n := i + 1
+		parts = append(parts, contextBlock(n, c))
+		snippet := truncate(strings.Join(strings.Fields(c.Content), " "), 200)
+		cites = append(cites, citation{N: n, Article: c.Article, ChunkIdx: c.ChunkIdx, Score: c.Score, Snippet: snippet})
+	}
+	return strings.Join(parts, "\n---\n"), cites
+}
+
+// contextBlock renders chunk `c` as context block number `n`.
+func contextBlock(n int, c debugChunk) string {
+	return fmt.Sprintf("[%d] %s #%d: %s", n, c.Article, c.ChunkIdx, c.Content)
+}
+
+// citedOnly returns the citations referenced by [n] markers in `answer`.
+func citedOnly(cites []citation, answer string) []citation {
+	used := map[string]bool{}
+	for _, m := range citationMarkerRe.FindAllStringSubmatch(answer, -1) {
+		used[m[1]] = true
+	}
+	var out []citation
+	for _, c := range cites {
+		if used[strconv.Itoa(c.N)] {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// confidence is a rough estimate of how well an answer is supported.
+type confidence struct {
+	Level   string   `json:"level"` // high, medium or low
+	Reasons []string `json:"reasons"`
+}
+
+// sourceFootnotes renders the "Quellen:" block appended to answers: one
+// line per article in `chunks` with its chunk indices, marked when it
+// only supplied neighbor chunks, and a link for Wikipedia and URL
+// sources. `lang` is the Wikipedia language of sources that do not
+// record one. It returns "" without chunks.
+func (r *ragSystem) sourceFootnotes(chunks []debugChunk, lang string) string {
+	type entry struct {
+		idxs         []int
+		neighborOnly bool
+	}
+	var order []string
+	entries := map[string]*entry{}
+	for _, c := range chunks {
+		e, ok := entries[c.Article]
+		if !ok {
+			e = &entry{neighborOnly: true}
+			entries[c.Article] = e
+			order = append(order, c.Article)
+		}
+		if !slices.Contains(e.idxs, c.ChunkIdx) {
+			e.idxs = append(e.idxs, c.ChunkIdx)
+		}
+		e.neighborOnly = e.neighborOnly && c.IsNeighbor
+	}
+	if len(order) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n\n---\n**Quellen:**\n")
+	for _, name := range order {
+		e := entries[name]
+		slices.Sort(e.idxs)
+		idxs := make([]string, len(e.idxs))
+		for i, idx := range e.idxs {
+			idxs[i] = strconv.Itoa(idx)
+		}
+		label := "Chunk "
+		if len(idxs) > 1 {
+			label = "Chunks "
+		}
+		label += strings.Join(idxs, ", ")
+		if e.neighborOnly {
+			label += ", nur Nachbar-Chunks"
+		}
+		fmt.Fprintf(&b, "- %s (%s)", name, label)
+		link := ""
+		if src, ok := r.getSource(name); ok {
+			link = sourceLink(src.sourceOrigin, lang)
+		}
+		if link == "" {
+			link = sourceLink(inferOrigin(name), lang)
+		}
+		if link != "" && link != name {
+			b.WriteString(": " + link)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// sourceLink returns the web address of a Wikipedia or URL source, or
+// "" for other origins. Wikipedia refs without a language use `lang`.
+func sourceLink(o sourceOrigin, lang string) string {
+	switch o.Type {
+	case "url", "websearch":
+		if strings.HasPrefix(o.Ref, "http://") || strings.HasPrefix(o.Ref, "https://") {
+			return o.Ref
+		}
+	case "wikipedia":
+		article := o.Ref
+		if l, a, ok := strings.Cut(o.Ref, ":"); ok && a != "" && wikiLangRe.MatchString(l) {
+			lang, article = l, a
+		}
+		if article != "" && wikiLangRe.MatchString(lang) {
+			return fmt.Sprintf("https://%s.wikipedia.org/wiki/%s", lang, url.PathEscape(strings.ReplaceAll(article, " ", "_")))
+		}
+	}
+	return ""
+}
+
+// confidenceLevels orders confidence levels from low to high.
+var confidenceLevels = map[string]int{"low": 0, "medium": 1, "high": 2}
+
+// estimateConfidence derives a confidence level from retrieval signals:
+// the best similarity score, how many chunks reach th.High, and the
+// retrieval decision. Without retrieved chunks it is always low.
+func estimateConfidence(di *debugInfo, th confidenceThresholds) confidence {
+	if di != nil && di.Decision == "answer_direct" {
+		return confidence{Level: "low", Reasons: []string{"Antwort ohne Kontext (answer_direct)"}}
+	}
+	var hits []debugChunk
+	if di != nil {
+		for _, c := range di.Chunks {
+			if !c.IsNeighbor && strings.TrimSpace(c.Content) != "" {
+				hits = append(hits, c)
+			}
+		}
+	}
+	if len(hits) == 0 {
+		return confidence{Level: "low", Reasons: []string{"Keine passenden Chunks gefunden"}}
+	}
+	if di.Decision == "article_specific" {
+		return confidence{Level: "high", Reasons: []string{fmt.Sprintf("Artikel %q exakt gefunden", hits[0].Article)}}
+	}
+
+	top, above := hits[0].Score, 0
+	for _, h := range hits {
+		top = max(top, h.Score)
+		if h.Score >= th.High {
+			above++
+		}
+	}
+	reasons := []string{
+		fmt.Sprintf("Beste Ähnlichkeit %.2f", top),
+		fmt.Sprintf("%d Chunks mit Ähnlichkeit ≥ %.2f", above, th.High),
+	}
+	level := "medium"
+	switch {
+	case top < th.Low:
+		level = "low"
+		reasons = append(reasons, fmt.Sprintf("Beste Ähnlichkeit unter %.2f", th.Low))
+	case top >= th.High && above >= th.MinHits:
+		level = "high"
+	}
+	if di.Decision == "relaxed_fallback" && level == "high" {
+		level = "medium"
+		reasons = append(reasons, "Auswahl ohne Entscheidung des Modells (relaxed_fallback)")
+	}
+	return confidence{Level: level, Reasons: reasons}
+}
+
+// selfAssessConfidence asks the model how well `answer` is supported by
+// `ctxText`. It returns "high", "medium" or "low".
+func (r *ragSystem) selfAssessConfidence(ctx context.Context, question, ctxText, answer string) (string, error) {
+	system := "Du prüfst Antworten. Bewerte, wie gut die Antwort durch den Kontext belegt ist. Antworte NUR mit einem Wort: HIGH, MEDIUM oder LOW."
+	user := fmt.Sprintf("Kontext:\n%s\n\nFrage: %s\n\nAntwort:\n%s", ctxText, question, answer)
+	var buf bytes.Buffer
+	if err := r.lmFor(ctx).chatStream(ctx, system, []chatMsg{{Role: "user", Content: user}}, &buf); err != nil {
+		return "", err
+	}
+	out := strings.ToUpper(buf.String())
+	for _, level := range []string{"LOW", "MEDIUM", "HIGH"} {
+		if strings.Contains(out, level) {
+			return strings.ToLower(level), nil
+		}
+	}
+	return "", fmt.Errorf("unexpected self-assessment %q", truncateTitle(buf.String()))
+}
+
+// ── Deep research ──────────────────────────────────────────────────
+
+const (
+	// deepResearchBudget bounds planning, retrieval and tool calls of a
+	// deep answer; sub-questions not reached by then are skipped.
+	deepResearchBudget = 2 * time.Minute
+	deepMinSteps       = 2
+	deepMaxSteps       = 4
+	// deepToolChars caps the tool output added per sub-question.
+	deepToolChars = 3000
+)
+
+// deepPlanTemperature keeps the plan close to deterministic.
+var deepPlanTemperature = 0.2
+
+// deepWebTools are the tools deep mode may run, in order of preference,
+// for a sub-question the knowledge base covers poorly.
+var deepWebTools = []string{"websearch", "duckduckgo"}
+
+// researchStep records the retrieval for one sub-question.
+type researchStep struct {
+	Question string  `json:"question"`
+	Decision string  `json:"decision,omitempty"`
+	Chunks   int     `json:"chunks"` // chunks not already used by an earlier step
+	TopScore float64 `json:"top_score"`
+	Coverage string  `json:"coverage"` // confidence level of the retrieval alone
+	EmbedMs  int64   `json:"embed_ms"`
+	SearchMs int64   `json:"search_ms"`
+	Error    string  `json:"error,omitempty"`
+	// Tool is the web tool run because coverage was low.
+	Tool       string `json:"tool,omitempty"`
+	ToolSource string `json:"tool_source,omitempty"`
+	ToolError  string `json:"tool_error,omitempty"`
+	Ms         int64  `json:"ms"`
+}
+
+// researchTrace is what deep mode did for a question.
+type researchTrace struct {
+	Plan   []string       `json:"plan"`
+	Steps  []researchStep `json:"steps"`
+	PlanMs int64          `json:"plan_ms"`
+	// TotalMs covers planning and all steps.
+	TotalMs int64 `json:"total_ms"`
+	// BudgetExceeded reports that deepResearchBudget cut the steps short.
+	BudgetExceeded bool `json:"budget_exceeded,omitempty"`
+	// Fallback is why the single-pass retrieval was used instead.
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// planResearch asks `lm` to split `question` into deepMinSteps to
+// deepMaxSteps sub-questions.
+func planResearch(ctx context.Context, lm *lmClient, question string) ([]string, error) {
+	system := `You plan the research for a question. Split it into 2 to 4 short, self-contained sub-questions that together cover what is needed to answer it. Write them in the language of the question.
+
+Return ONLY a JSON array of strings and nothing else. Example:
+	["Wann wurde Ettlingen gegründet?","Wie viele Einwohner hat Ettlingen heute?"]`
+	t := deepPlanTemperature
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	if pw := planningWriter(ctx, "research_plan"); pw != nil {
+		w = io.MultiWriter(&buf, pw)
+	}
+	if err := lm.withParams(genParams{Temperature: &t, MaxTokens: 400}).chatStream(ctx, system, []chatMsg{{Role: "user", Content: question}}, w); err != nil {
+		return nil, err
+	}
+	return parsePlan(buf.String())
+}
+
+// parsePlan reads the JSON array of sub-questions in `out`, dropping
+// empty and repeated ones.
+func parsePlan(out string) ([]string, error) {
+	i, j := strings.Index(out, "["), strings.LastIndex(out, "]")
+	if i < 0 || j < i {
+		return nil, fmt.Errorf("no plan in reply %q", truncateTitle(out))
+	}
+	var raw []string
+	if err := json.Unmarshal([]byte(out[i:j+1]), &raw); err != nil {
+		return nil, fmt.Errorf("invalid plan %q: %w", truncateTitle(out), err)
+	}
+	var plan []string
+	seen := map[string]bool{}
+	for _, q := range raw {
+		q = strings.TrimSpace(q)
+		if key := strings.ToLower(q); q != "" && !seen[key] {
+			seen[key] = true
+			plan = append(plan, q)
+		}
+	}
+	if len(plan) < deepMinSteps {
+		return nil, fmt.Errorf("plan has %d sub-questions, need at least %d", len(plan), deepMinSteps)
+	}
+	return plan[:min(len(plan), deepMaxSteps)], nil
+}
+
+// deepResearcher runs the multi-pass retrieval of deep mode.
+type deepResearcher struct {
+	rag        *ragSystem
+	lm         *lmClient
+	k          int // primary hits for all sub-questions together
+	confidence confidenceThresholds
+	webTool    string // "" runs no tools
+	runTool    func(ctx context.Context, tr toolRequest) toolRun
+	progress   func(stage string, data map[string]any)
+}
+
+// run plans `question`, retrieves context for each sub-question and
+// returns the combined context, labeled by sub-question, with the
+// merged retrieval info. Chunks are numbered as numberContext numbers
+// the merged chunks. The trace is returned in any case; an error means
+// the caller should fall back to single-pass retrieval.
+func (d deepResearcher) run(ctx context.Context, question string) (string, *debugInfo, *researchTrace, error) {
+	started := time.Now()
+	trace := &researchTrace{}
+	defer func() { trace.TotalMs = time.Since(started).Milliseconds() }()
+
+	d.progress("deep_planning", nil)
+	plan, err := planResearch(ctx, d.lm, question)
+	trace.PlanMs = time.Since(started).Milliseconds()
+	if err != nil {
+		return "", nil, trace, fmt.Errorf("planner: %w", err)
+	}
+	trace.Plan = plan
+	d.progress("deep_plan", map[string]any{"plan": plan})
+
+	// Sub-questions share the primary hits and the context budget.
+	opts := d.rag.retrievalOptions(max(2, d.k/len(plan)))
+	if opts.MaxChars > 0 {
+		opts.MaxChars = max(1, opts.MaxChars/len(plan))
+	}
+	di := &debugInfo{TotalChunks: d.rag.docCount(), Decision: "deep_research", QuestionLang: detectLang(question)}
+	numbers := map[chunkKey]int{}
+	var sections []string
+	found := false
+	for i, q := range plan {
+		if ctx.Err() != nil {
+			trace.BudgetExceeded = true
+			break
+		}
+		d.progress("deep_step:"+q, map[string]any{"step": i + 1, "steps": len(plan)})
+		t0 := time.Now()
+		step := researchStep{Question: q}
+		var blocks, refs []string
+		_, sdi, err := d.rag.retrieve(ctx, q, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				trace.BudgetExceeded = true
+				break
+			}
+			step.Error = err.Error()
+		} else {
+			step.Decision, step.EmbedMs, step.SearchMs = sdi.Decision, sdi.EmbedMs, sdi.SearchMs
+			step.Coverage = estimateConfidence(sdi, d.confidence).Level
+			di.EmbedMs += sdi.EmbedMs
+			di.SearchMs += sdi.SearchMs
+			di.UsedK += sdi.UsedK
+			di.OmittedChunks += sdi.OmittedChunks
+			di.OmittedNeighbors += sdi.OmittedNeighbors
+			di.RejectedChunks = append(di.RejectedChunks, sdi.RejectedChunks...)
+			if sdi.TopScore > di.TopScore {
+				di.TopScore, di.TopArticles = sdi.TopScore, sdi.TopArticles
+			}
+			di.Thresholds = sdi.Thresholds
+			for _, c := range sdi.Chunks {
+				if !c.IsNeighbor {
+					step.TopScore = max(step.TopScore, c.Score)
+				}
+				key := chunkKey{c.Article, c.ChunkIdx}
+				if n, ok := numbers[key]; ok {
+					refs = append(refs, fmt.Sprintf("[%d]", n))
+					continue
+				}
+				di.Chunks = append(di.Chunks, c)
+				numbers[key] = len(di.Chunks)
+				blocks = append(blocks, contextBlock(len(di.Chunks), c))
+				step.Chunks++
+			}
+		}
+		if len(refs) > 0 {
+			blocks = append(blocks, "Siehe auch "+strings.Join(refs, ", "))
+		}
+		if (err != nil || step.Coverage == "low") && d.webTool != "" && ctx.Err() == nil {
+			tr := toolRequest{Tool: d.webTool, Query: q}
+			step.Tool = tr.Tool
+			d.progress("executing_tool:"+tr.Tool, map[string]any{"step": i + 1, "steps": len(plan)})
+			if res := d.runTool(ctx, tr); res.err != nil {
+				step.ToolError = res.err.Error()
+			} else {
+				step.ToolSource = res.source
+				blocks = append(blocks, fmt.Sprintf("Web-Ergebnis (%s %q, %s):\n%s", tr.Tool, tr.Query, res.source, truncate(res.text, deepToolChars)))
+			}
+		}
+		step.Ms = time.Since(t0).Milliseconds()
+		trace.Steps = append(trace.Steps, step)
+		if len(blocks) == 0 {
+			blocks = []string{"(nichts gefunden)"}
+		} else {
+			found = true
+		}
+		sections = append(sections, fmt.Sprintf("## Teilfrage %d: %s\n%s", i+1, q, strings.Join(blocks, "\n---\n")))
+	}
+	if !found {
+		if trace.BudgetExceeded {
+			return "", nil, trace, fmt.Errorf("time budget of %s exceeded", deepResearchBudget)
+		}
+		return "", nil, trace, fmt.Errorf("no context for any sub-question")
+	}
+	// A chunk rejected for one sub-question may serve another.
+	rejected := map[chunkKey]bool{}
+	di.RejectedChunks = slices.DeleteFunc(di.RejectedChunks, func(c rejectedChunk) bool {
+		key := chunkKey{c.Article, c.ChunkIdx}
+		_, used := numbers[key]
+		dup := rejected[key]
+		rejected[key] = true
+		return used || dup
+	})
+	sort.SliceStable(di.RejectedChunks, func(i, j int) bool { return di.RejectedChunks[i].Score > di.RejectedChunks[j].Score })
+	di.RejectedChunks = di.RejectedChunks[:min(len(di.RejectedChunks), maxRejectedChunks)]
+	return strings.Join(sections, "\n\n"), di, trace, nil
+}
+
+// debugModels records which LLM endpoint and models were used for a request.
+type debugModels struct {
+	BaseURL    string `json:"base_url"`
+	ChatModel  string `json:"chat_model"`
+	EmbedModel string `json:"embed_model"`
+	// Generation is the lmClient generation (see setLM) the request used.
+	Generation  int      `json:"generation"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+}
+
+// debugPayload is the top-level debug information emitted alongside
+// SSE responses to help diagnose retrieval and model behavior.
+type debugPayload struct {
+	RequestID          string      `json:"request_id"`
+	Mode               string      `json:"mode"`
+	AutoSearch         bool        `json:"auto_search"`
+	Offline            bool        `json:"offline"`
+	Deep               bool        `json:"deep"`
+	Question           string      `json:"question"`
+	UsedK              int         `json:"used_k"`
+	BaseK              int         `json:"base_k"`
+	ChunkSize          int         `json:"chunk_size"`
+	TotalChunks        int         `json:"total_chunks"`
+	ContextChars       int         `json:"context_chars"`
+	SystemPromptChars  int         `json:"system_prompt_chars"`
+	HistoryMessages    int         `json:"history_messages"`
+	HistoryTokens      int         `json:"history_tokens"`
+	StorageMode        string      `json:"storage_mode"`
+	DBPath             string      `json:"db_path"`
+	Models             debugModels `json:"models"`
+	Retrieval          *debugInfo  `json:"retrieval"`
+	SearchQuery        string      `json:"search_query,omitempty"`
+	PersonaID          string      `json:"persona_id"`
+	PersonaName        string      `json:"persona_name"`
+	PersonaPromptChars int         `json:"persona_prompt_chars"`
+	// RetrievalQuery is what was searched instead of a follow-up
+	// question (followup_query).
+	RetrievalQuery string `json:"retrieval_query,omitempty"`
+	// Research is what deep mode planned and retrieved.
+	Research *researchTrace `json:"research,omitempty"`
+	// Focus is the tool result of the previous answer the retrieval
+	// was biased towards.
+	Focus *retrievalFocus `json:"focus,omitempty"`
+}
+
+// debugFull is the opt-in "debug_full" output of /api/ask: what was
+// actually sent to the LM, each field capped at maxDebugFieldBytes.
+type debugFull struct {
+	RequestID    string    `json:"request_id"`
+	SystemPrompt string    `json:"system_prompt"`
+	Messages     []chatMsg `json:"messages"`
+	AnalysisRaw  string    `json:"analysis_raw,omitempty"`
+}
+
+// maxDebugFieldBytes caps each text field of debugFull.
+const maxDebugFieldBytes = 64 << 10
+
+// newDebugFull builds the full debug output with capped fields.
+func newDebugFull(reqID, system string, msgs []chatMsg, analysisRaw string) *debugFull {
+	d := &debugFull{
+		RequestID:    reqID,
+		SystemPrompt: capDebugField(system),
+		Messages:     make([]chatMsg, len(msgs)),
+		AnalysisRaw:  capDebugField(analysisRaw),
+	}
+	for i, m := range msgs {
+		d.Messages[i] = chatMsg{Role: m.Role, Content: capDebugField(m.Content)}
+	}
+	return d
+}
+
+// capDebugField cuts `s` to maxDebugFieldBytes at a rune boundary and
+// marks how much was dropped.
+func capDebugField(s string) string {
+	if len(s) <= maxDebugFieldBytes {
+		return s
+	}
+	cut := maxDebugFieldBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + fmt.Sprintf("\n[... %d von %d Bytes abgeschnitten ...]", len(s)-cut, len(s))
+}
+
+// retrievalOptions configures retrieve.
+type retrievalOptions struct {
+	K int // number of primary hits
+	// ArticleMatch answers from the chunks of an article named exactly
+	// like the refined query instead of running the vector search.
+	ArticleMatch bool
+	// HighThreshold: hits scoring above it are used without asking the LM.
+	HighThreshold float64
+	// RelaxedThreshold is the minimum score when the LM gives none.
+	RelaxedThreshold float64
+	// Calibrated reports that the thresholds come from calibrate.
+	Calibrated bool
+	// MaxChars bounds the context in characters (see fitContext); 0
+	// means no bound.
+	MaxChars int
+}
+
+// defaultRetrievalOptions returns the thresholds used by the chat.
+func defaultRetrievalOptions(k int) retrievalOptions {
+	return retrievalOptions{K: k, HighThreshold: 0.90, RelaxedThreshold: 0.60}
+}
+
+// retrievalOptions returns defaultRetrievalOptions with the thresholds
+// calibrated for the configured embedding model, if there are any.
+func (r *ragSystem) retrievalOptions(k int) retrievalOptions {
+	opts := defaultRetrievalOptions(k)
+	r.lmMu.RLock()
+	defer r.lmMu.RUnlock()
+	opts.MaxChars = r.maxContext
+	if r.lm == nil {
+		return opts
+	}
+	if c, ok := r.calibrations[r.lm.embedModel]; ok {
+		opts.HighThreshold, opts.RelaxedThreshold, opts.Calibrated = c.High, c.Relaxed, true
+	}
+	return opts
+}
+
+// retrievalThresholds reports the thresholds a retrieval used.
+type retrievalThresholds struct {
+	High    float64 `json:"high"`
+	Relaxed float64 `json:"relaxed"`
+	Source  string  `json:"source"` // "calibrated" or "default"
+}
+
+// thresholds returns the thresholds of `o` for debugInfo.
+func (o retrievalOptions) thresholds() *retrievalThresholds {
+	t := &retrievalThresholds{High: o.HighThreshold, Relaxed: o.RelaxedThreshold, Source: "default"}
+	if o.Calibrated {
+		t.Source = "calibrated"
+	}
+	return t
+}
+
+// prepareContext computes embeddings for `question`, runs a vector
+// search against the DB and returns the assembled context text and
+// retrieval information. The chunks in debugInfo are always filled
+// since they back answer citations; `debug` is kept for callers.
+func (r *ragSystem) prepareContext(ctx context.Context, question string, debug bool) (string, *debugInfo, error) {
+	opts := r.retrievalOptions(r.topK())
+	opts.ArticleMatch = true
+	return r.retrieve(ctx, question, opts)
+}
+
+// prepareContextWithK behaves like prepareContext but allows specifying
+// the number `k` of primary retrieval hits to consider.
+func (r *ragSystem) prepareContextWithK(ctx context.Context, question string, debug bool, k int) (string, *debugInfo, error) {
+	return r.retrieve(ctx, question, r.retrievalOptions(k))
+}
+
+type progressKey struct{}
+
+type planningKey struct{}
+
+// withPlanning returns a context in which the auxiliary completions of
+// retrieval pass their tokens to `fn` as they arrive, along with the
+// name of the call: "analysis" (analyzeQuestion) or "research_plan"
+// (planResearch).
+func withPlanning(ctx context.Context, fn func(source, text string)) context.Context {
+	return context.WithValue(ctx, planningKey{}, fn)
+}
+
+// planningWriter returns a writer passing its input to the function set
+// by withPlanning as `source`, or nil if there is none.
+func planningWriter(ctx context.Context, source string) io.Writer {
+	fn, ok := ctx.Value(planningKey{}).(func(string, string))
+	if !ok {
+		return nil
+	}
+	return planningFunc{source, fn}
+}
+
+// planningFunc is the io.Writer returned by planningWriter.
+type planningFunc struct {
+	source string
+	fn     func(source, text string)
+}
+
+func (p planningFunc) Write(b []byte) (int, error) {
+	p.fn(p.source, string(b))
+	return len(b), nil
+}
+
+type sourceFilterKey struct{}
+
+// withSourceFilter returns a context in which searches only consider
+// chunks of the sources `names`; an empty list matches nothing.
+func withSourceFilter(ctx context.Context, names []string) context.Context {
+	return context.WithValue(ctx, sourceFilterKey{}, names)
+}
+
+// sourceFilter returns the names set by withSourceFilter, if any.
+func sourceFilter(ctx context.Context) ([]string, bool) {
+	names, ok := ctx.Value(sourceFilterKey{}).([]string)
+	return names, ok
+}
+
+type noPlannerKey struct{}
+
+// errNoPlanner is what analyzeQuestion is replaced with under
+// withoutPlanner.
+var errNoPlanner = errors.New("no retrieval planner in offline mode")
+
+// withoutPlanner returns a context in which retrieve doesn't ask the
+// chat model which hits to use but takes those above the relaxed
+// threshold, for offline answers.
+func withoutPlanner(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noPlannerKey{}, true)
+}
+
+type focusKey struct{}
+
+// focusBonus is added to the score of candidates from the sources of a
+// retrievalFocus.
+const focusBonus = 0.05
+
+// withFocus returns a context in which retrieve prefers the sources of `f`.
+func withFocus(ctx context.Context, f *retrievalFocus) context.Context {
+	return context.WithValue(ctx, focusKey{}, f)
+}
+
+// boostFocus adds focusBonus (up to a score of 1) to the hits from the
+// sources of the focus set by withFocus, keeps `hits` sorted by score
+// and returns how many were boosted.
+func boostFocus(ctx context.Context, hits []chunkHit) int {
+	f, ok := ctx.Value(focusKey{}).(*retrievalFocus)
+	if !ok || f == nil {
+		return 0
+	}
+	n := 0
+	for i := range hits {
+		if slices.Contains(f.Sources, hits[i].article) {
+			hits[i].score = min(hits[i].score+focusBonus, 1)
+			n++
+		}
+	}
+	if n > 0 {
+		sort.SliceStable(hits, func(i, j int) bool { return hits[i].score > hits[j].score })
+	}
+	return n
+}
+
+// withProgress returns a context in which retrieve reports the stage it
+// enters ("embedding_query", "searching", "planning") to `fn`.
+func withProgress(ctx context.Context, fn func(stage string)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// reportProgress passes `stage` to the progress function of `ctx`, if any.
+func reportProgress(ctx context.Context, stage string) {
+	if fn, ok := ctx.Value(progressKey{}).(func(string)); ok {
+		fn(stage)
+	}
+}
+
+// retrieve embeds the refined question, searches for candidate chunks
+// and selects the context according to `opts` (see selectHits). It
+// stops with ctx.Err() when `ctx` ends between or during its steps.
+func (r *ragSystem) retrieve(ctx context.Context, question string, opts retrievalOptions) (string, *debugInfo, error) {
+	// Without chunks, or when the source filter matches nothing, there
+	// is nothing to embed the question for.
+	if names, ok := sourceFilter(ctx); r.docCount() == 0 || ok && len(names) == 0 {
+		return "", &debugInfo{UsedK: opts.K, Decision: "empty_kb", QuestionLang: detectLang(question), Thresholds: opts.thresholds()}, nil
+	}
+	searchQuery := r.refineQuery(question)
+
+	reportProgress(ctx, "embedding_query")
+	t0 := time.Now()
+	qvec, err := r.lmFor(ctx).embedSingle(ctx, searchQuery)
+	if err != nil {
+		return "", nil, err
+	}
+	embedMs := time.Since(t0).Milliseconds()
+
+	reportProgress(ctx, "searching")
+	if opts.ArticleMatch {
+		t1 := time.Now()
+		hits, total, err := r.articleContext(ctx, searchQuery, qvec, contextChunkBudget(opts.K))
+		if err != nil {
+			return "", nil, err
+		}
+		if total > 0 {
+			kept, omitted, _ := fitContext(hits, opts.MaxChars)
+			text, dbgChunks := joinContext(kept)
+			di := &debugInfo{Chunks: dbgChunks, EmbedMs: embedMs, SearchMs: time.Since(t1).Milliseconds(), TotalChunks: r.docCount(), UsedK: opts.K, Decision: "article_specific", SearchQuery: searchQuery, QuestionLang: detectLang(question), QueryVec: qvec, Thresholds: opts.thresholds(), ArticleChunks: total, ArticleChunksUsed: len(kept), OmittedChunks: omitted}
+			di.RejectedChunks = rejectedCandidates(hits, hits, dbgChunks, 0, "")
+			return text, di, nil
+		}
+	}
+
+	t1 := time.Now()
+	hits, err := r.searchHits(ctx, qvec, candidateLimit(opts.K), "")
+	if err != nil {
+		return "", nil, err
+	}
+	searchMs := time.Since(t1).Milliseconds()
+	boosted := boostFocus(ctx, hits)
+	topScore, topArticles := topCandidates(hits, maxTopArticles)
+
+	var analysisRaw, analysisFallback string
+	sel, usedK, thresh, decision := selectHits(hits, opts, func(summary string) (questionAnalysis, error) {
+		if ctx.Value(noPlannerKey{}) != nil {
+			return questionAnalysis{}, errNoPlanner
+		}
+		reportProgress(ctx, "planning")
+		a, raw, err := r.analyzeQuestion(ctx, question, summary)
+		analysisRaw, analysisFallback = raw, a.Fallback
+		return a, err
+	})
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	di := &debugInfo{EmbedMs: embedMs, SearchMs: searchMs, TotalChunks: r.docCount(), UsedK: usedK, Decision: decision, SearchQuery: searchQuery, QuestionLang: detectLang(question), QueryVec: qvec, Thresholds: opts.thresholds(), AnalysisRaw: analysisRaw, AnalysisFallback: analysisFallback, TopScore: topScore, TopArticles: topArticles, FocusBoosted: boosted}
+	if decision == "answer_direct" {
+		di.RejectedChunks = rejectedCandidates(hits, nil, nil, thresh, decision)
+		return "", di, nil
+	}
+	text, dbgChunks, omitted, omittedNeighbors, err := r.assembleContext(hits, sel, opts.MaxChars)
+	if err != nil {
+		return "", nil, err
+	}
+	di.Chunks, di.OmittedChunks, di.OmittedNeighbors = dbgChunks, omitted, omittedNeighbors
+	di.RejectedChunks = rejectedCandidates(hits, sel, dbgChunks, thresh, decision)
+	return text, di, nil
+}
+
+// rejectedCandidates returns up to maxRejectedChunks of the candidates
+// `hits` that are not in the context `used`, best first, with the
+// reason: "answer_direct" when the model answers without context,
+// "budget" for selected hits cut by the context budget, "k_limit" for
+// hits above `thresh` beyond the k selected, and "below_threshold" for
+// the rest. Candidates in the context as neighbors are not rejected.
+func rejectedCandidates(hits, sel []chunkHit, used []debugChunk, thresh float64, decision string) []rejectedChunk {
+	inCtx := make(map[chunkKey]bool, len(used))
+	for _, c := range used {
+		inCtx[chunkKey{c.Article, c.ChunkIdx}] = true
+	}
+	selected := make(map[chunkKey]bool, len(sel))
+	for _, h := range sel {
+		selected[chunkKey{h.article, h.chunkIdx}] = true
+	}
+	var out []rejectedChunk
+	for _, h := range hits {
+		key := chunkKey{h.article, h.chunkIdx}
+		if inCtx[key] {
+			continue
+		}
+		reason := "below_threshold"
+		switch {
+		case decision == "answer_direct":
+			reason = decision
+		case selected[key]:
+			reason = "budget"
+		case h.score > thresh:
+			reason = "k_limit"
+		}
+		out = append(out, rejectedChunk{Article: h.article, ChunkIdx: h.chunkIdx, Score: h.score, Reason: reason})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Score > out[j].Score })
+	return out[:min(len(out), maxRejectedChunks)]
+}
+
+// chunkHit is a vector search result.
+type chunkHit struct {
+	article  string
+	chunkIdx int
+	content  string
+	score    float64
+	lang     string // detected language, "" if unknown
+	neighbor bool   // context around a hit (score -1), not a hit itself
+	// link is the hit of another source in the same group that a
+	// neighbor continues or precedes (see sourceLinks).
+	link chunkKey
+}
+
+// chunkKey identifies a chunk by article and index.
+type chunkKey struct {
+	article  string
+	chunkIdx int
+}
+
+// contextChunkBudget is the most chunks assembleContext can produce for
+// `k` hits: each hit plus its two neighbors.
+func contextChunkBudget(k int) int {
+	return max(k, 1) * 3
+}
+
+// candidateLimit returns how many candidates to fetch for `k` primary
+// hits, leaving room for threshold filtering.
+func candidateLimit(k int) int {
+	const maxLimit = 1000
+	return min(max(100, k*3), maxLimit)
+}
+
+// searchHits returns the `limit` chunks most similar to `qvec`, only
+// those in language `lang` unless it is empty and only those of the
+// sources set by withSourceFilter. The hits carry no content;
+// withNeighbors loads it for the selected ones.
+func (r *ragSystem) searchHits(ctx context.Context, qvec []float64, limit int, lang string) ([]chunkHit, error) {
+	var conds []string
+	if lang != "" {
+		conds = append(conds, "lang = "+sqlText(lang))
+	}
+	if names, ok := sourceFilter(ctx); ok {
+		if len(names) == 0 {
+			return nil, nil
+		}
+		quoted := make([]string, len(names))
+		for i, n := range names {
+			quoted[i] = sqlText(n)
+		}
+		conds = append(conds, "article IN ("+strings.Join(quoted, ", ")+")")
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ") + " "
+	}
+	total := r.docCount()
+	if total == 0 {
+		return nil, nil
+	}
+	// No point in asking for more rows than there are chunks.
+	limit = min(limit, total)
+	q := fmt.Sprintf(
+		"SELECT article, chunk_idx, lang, VEC_COSINE_SIMILARITY(embedding, %s) AS score FROM chunks %sORDER BY score DESC LIMIT %d",
+		qvecParam, where, limit,
+	)
+	stmt, err := parseVecQuery(q, qvec)
+	if err != nil {
+		return nil, err
+	}
+	r.dbMu.RLock()
+	err = r.checkQueryDimLocked(qvec)
+	var rs *tinysql.ResultSet
+	if err == nil {
+		rs, err = tinysql.Execute(ctx, r.db, r.collection, stmt)
+	}
+	r.dbMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return parseHits(rs.Rows), nil
+}
+
+// parseHits converts search result rows into hits. Rows without
+// article are skipped, content is left empty when not selected.
+func parseHits(rows []tinysql.Row) []chunkHit {
+	var hits []chunkHit
+	for _, row := range rows {
+		art, ok := tinysql.GetVal(row, "article")
+		if !ok {
+			continue
+		}
+		content := ""
+		if c, ok := tinysql.GetVal(row, "content"); ok {
+			content = contentVal(c)
+		}
+		idxVal, _ := tinysql.GetVal(row, "chunk_idx")
+		idx := 0
+		switch iv := idxVal.(type) {
+		case int:
+			idx = iv
+		case int64:
+			idx = int(iv)
+		case float64:
+			idx = int(iv)
+		}
+		scoreVal, _ := tinysql.GetVal(row, "score")
+		s := 0.0
+		switch sv := scoreVal.(type) {
+		case float64:
+			s = sv
+		case int:
+			s = float64(sv)
+		}
+		langVal, _ := tinysql.GetVal(row, "lang")
+		lang, _ := langVal.(string)
+		hits = append(hits, chunkHit{article: fmt.Sprintf("%v", art), chunkIdx: idx, content: content, score: s, lang: lang})
+	}
+	return hits
+}
+
+// selectHits decides which hits form the context. Hits above the high
+// threshold are used directly; otherwise `analyze` (the LM) is shown a
+// summary of the top candidates and may answer directly or request
+// k/threshold. It returns the selection, the k and threshold used and
+// the decision.
+func selectHits(hits []chunkHit, opts retrievalOptions, analyze func(summary string) (questionAnalysis, error)) ([]chunkHit, int, float64, string) {
+	if sel := hitsAbove(hits, opts.HighThreshold, false, opts.K); len(sel) > 0 {
+		return sel, opts.K, opts.HighThreshold, "high_confidence"
+	}
+
+	a, err := analyze(hitSummary(hits, 5))
+	if err != nil {
+		return hitsAbove(hits, opts.RelaxedThreshold, true, opts.K), opts.K, opts.RelaxedThreshold, "relaxed_fallback"
+	}
+	if a.Action == "ANSWER_DIRECT" {
+		return nil, 0, 0, "answer_direct"
+	}
+
+	desiredK := opts.K
+	if a.K > 0 {
+		desiredK = a.K
+	}
+	thresh := opts.RelaxedThreshold
+	if a.Threshold != nil {
+		thresh = *a.Threshold
+	}
+	sel := hitsAbove(hits, thresh, true, desiredK)
+	if len(sel) == 0 {
+		// fallback to top-k by score
+		sel = hits[:min(max(desiredK, 0), len(hits))]
+	}
+	return sel, desiredK, thresh, "lm_requested_retrieval"
+}
+
+// hitsAbove returns up to `k` hits scoring above `thresh` (or equal to
+// it if `inclusive`), in search order.
+func hitsAbove(hits []chunkHit, thresh float64, inclusive bool, k int) []chunkHit {
+	var sel []chunkHit
+	for _, h := range hits {
+		if h.score > thresh || (inclusive && h.score == thresh) {
+			sel = append(sel, h)
+			if len(sel) >= k {
+				break
+			}
+		}
+	}
+	return sel
+}
+
+// maxTopArticles is how many candidate articles debugInfo names.
+const maxTopArticles = 3
+
+// topCandidates returns the best score of `hits` and the first `n`
+// distinct articles among them.
+func topCandidates(hits []chunkHit, n int) (float64, []string) {
+	if len(hits) == 0 {
+		return 0, nil
+	}
+	var articles []string
+	for _, h := range hits {
+		if len(articles) == n {
+			break
+		}
+		if !slices.Contains(articles, h.article) {
+			articles = append(articles, h.article)
+		}
+	}
+	return hits[0].score, articles
+}
+
+// hitSummary lists article and score of the first `n` hits for the LM.
+func hitSummary(hits []chunkHit, n int) string {
+	var parts []string
+	for _, h := range hits[:min(n, len(hits))] {
+		parts = append(parts, fmt.Sprintf("%s (score=%.4f)", h.article, h.score))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// assembleContext joins the selected hits with their neighboring
+// chunks, skipping chunks that are search hits themselves, within
+// `maxChars` characters (see fitContext). It also returns how many hits
+// and neighbors were left out for the budget.
+func (r *ragSystem) assembleContext(hits, sel []chunkHit, maxChars int) (string, []debugChunk, int, int, error) {
+	seen := make(map[chunkKey]bool)
+	for _, h := range hits {
+		seen[chunkKey{h.article, h.chunkIdx}] = true
+	}
+	chunks, err := r.withNeighbors(sel, seen)
+	if err != nil {
+		return "", nil, 0, 0, err
+	}
+	kept, omitted, omittedNeighbors := fitContext(chunks, maxChars)
+	text, dbgChunks := joinContext(kept)
+	return text, dbgChunks, omitted, omittedNeighbors, nil
+}
+
+// contextSep separates the chunks of a context.
+const contextSep = "\n---\n"
+
+// joinContext joins the contents of `chunks` with contextSep and
+// describes them for debugInfo.
+func joinContext(chunks []chunkHit) (string, []debugChunk) {
+	parts := make([]string, 0, len(chunks))
+	var dbgChunks []debugChunk
+	for _, h := range chunks {
+		parts = append(parts, h.content)
+		dbgChunks = append(dbgChunks, debugChunk{Score: h.score, Content: h.content, Article: h.article, ChunkIdx: h.chunkIdx, IsNeighbor: h.neighbor, Lang: h.lang})
+	}
+	return strings.Join(parts, contextSep), dbgChunks
+}
+
+// fitContext returns the chunks of `chunks` that fit into `maxChars`
+// characters when joined, in their order, along with the number of
+// hits and neighbors left out. Hits are taken by score, a smaller one
+// still filling the room a larger one left; neighbors follow in order,
+// and only around hits that were kept. If not even the best hit fits,
+// it is cut to the budget. `maxChars` <= 0 keeps everything.
+func fitContext(chunks []chunkHit, maxChars int) ([]chunkHit, int, int) {
+	if maxChars <= 0 {
+		return chunks, 0, 0
+	}
+	var hits, neighbors []int
+	for i, h := range chunks {
+		if h.neighbor {
+			neighbors = append(neighbors, i)
+		} else {
+			hits = append(hits, i)
+		}
+	}
+	sort.SliceStable(hits, func(a, b int) bool { return chunks[hits[a]].score > chunks[hits[b]].score })
+
+	keep := make([]bool, len(chunks))
+	kept := map[chunkKey]bool{}
+	used := -len(contextSep)
+	take := func(i int) bool {
+		n := utf8.RuneCountInString(chunks[i].content) + len(contextSep)
+		if used+n > maxChars {
+			return false
+		}
+		used += n
+		keep[i] = true
+		return true
+	}
+	omitted, omittedNeighbors := 0, 0
+	for _, i := range hits {
+		if take(i) {
+			kept[chunkKey{chunks[i].article, chunks[i].chunkIdx}] = true
+		} else {
+			omitted++
+		}
+	}
+	if len(kept) == 0 && len(hits) > 0 {
+		best := chunks[hits[0]]
+		best.content = truncate(best.content, maxChars)
+		return []chunkHit{best}, omitted - 1, len(neighbors)
+	}
+	for _, i := range neighbors {
+		h := chunks[i]
+		if (!kept[chunkKey{h.article, h.chunkIdx - 1}] && !kept[chunkKey{h.article, h.chunkIdx + 1}] && !kept[h.link]) || !take(i) {
+			omittedNeighbors++
+		}
+	}
+	out := make([]chunkHit, 0, len(chunks)-omitted-omittedNeighbors)
+	for i, h := range chunks {
+		if keep[i] {
+			out = append(out, h)
+		}
+	}
+	return out, omitted, omittedNeighbors
+}
+
+// withNeighbors returns `sel` in order, each hit between the chunks
+// before and after it unless those are in `seen`, which it updates. At
+// the start or end of a grouped source, the neighbors include the
+// adjoining chunk of the previous or next source (see sourceLinks).
+// Neighbors and hits without content are loaded with a single query.
+func (r *ragSystem) withNeighbors(sel []chunkHit, seen map[chunkKey]bool) ([]chunkHit, error) {
+	var plan []chunkHit
+	var keys []chunkKey
+	neighbor := func(key, link chunkKey) {
+		if key.chunkIdx < 0 || seen[key] {
+			return
+		}
+		seen[key] = true
+		plan = append(plan, chunkHit{article: key.article, chunkIdx: key.chunkIdx, score: -1, neighbor: true, link: link})
+		keys = append(keys, key)
+	}
+	prev, next := r.sourceLinks()
+	for _, h := range sel {
+		key := chunkKey{h.article, h.chunkIdx}
+		if p, ok := prev[key]; ok {
+			neighbor(p, key)
+		}
+		neighbor(chunkKey{h.article, h.chunkIdx - 1}, chunkKey{})
+		seen[key] = true
+		plan = append(plan, h)
+		if h.content == "" {
+			keys = append(keys, key)
+		}
+		neighbor(chunkKey{h.article, h.chunkIdx + 1}, chunkKey{})
+		if n, ok := next[key]; ok {
+			neighbor(n, key)
+		}
+	}
+	stored, err := r.fetchChunks(keys)
+	if err != nil {
+		return nil, err
+	}
+	out := plan[:0]
+	for _, h := range plan {
+		if h.neighbor || h.content == "" {
+			// Chunks deleted since the search are left out.
+			c, ok := stored[chunkKey{h.article, h.chunkIdx}]
+			if !ok {
+				continue
+			}
+			h.content, h.lang = c.content, c.lang
+		}
+		out = append(out, h)
+	}
+	return out, nil
+}
+
+// articleContext returns chunks of `article` in order along with the
+// article's chunk count (0 if it isn't stored or outside the filter of
+// withSourceFilter). Articles larger than
+// `budget` chunks are cut down to the chunks nearest to `qvec`; the
+// chunks of complete articles have score -1.
+func (r *ragSystem) articleContext(ctx context.Context, article string, qvec []float64, budget int) ([]chunkHit, int, error) {
+	if names, ok := sourceFilter(ctx); ok && !slices.Contains(names, article) {
+		return nil, 0, nil
+	}
+	r.dbMu.RLock()
+	total := r.articleChunkCountLocked(article)
+	r.dbMu.RUnlock()
+	if total == 0 {
+		return nil, 0, nil
+	}
+	q := fmt.Sprintf("SELECT article, chunk_idx, content, lang FROM chunks WHERE article = %s ORDER BY chunk_idx", sqlText(article))
+	if total > budget {
+		q = fmt.Sprintf(
+			"SELECT article, chunk_idx, content, lang, VEC_COSINE_SIMILARITY(embedding, %s) AS score FROM chunks WHERE article = %s ORDER BY score DESC LIMIT %d",
+			qvecParam, sqlText(article), budget,
+		)
+	}
+	stmt, err := parseVecQuery(q, qvec)
+	if err != nil {
+		return nil, 0, err
+	}
+	r.dbMu.RLock()
+	err = r.checkQueryDimLocked(qvec)
+	var rs *tinysql.ResultSet
+	if err == nil {
+		rs, err = tinysql.Execute(ctx, r.db, r.collection, stmt)
+	}
+	r.dbMu.RUnlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	hits := parseHits(rs.Rows)
+	if total > budget {
+		sort.SliceStable(hits, func(i, j int) bool { return hits[i].chunkIdx < hits[j].chunkIdx })
+	}
+	if total <= budget {
+		for i := range hits {
+			hits[i].score = -1
+		}
+	}
+	return hits, total, nil
+}
+
+// scoreCalibration holds retrieval thresholds derived by calibrate for
+// one embedding model, along with the distribution they came from.
+type scoreCalibration struct {
+	High         float64 `json:"high"`
+	Relaxed      float64 `json:"relaxed"`
+	Collection   string  `json:"collection"`
+	SampleChunks int     `json:"sample_chunks"`
+	Pairs        int     `json:"pairs"`
+	// Percentiles of the similarity between chunks of different
+	// articles, and the median between chunks of the same article.
+	P50            float64 `json:"p50"`
+	P90            float64 `json:"p90"`
+	P99            float64 `json:"p99"`
+	SameArticleP50 float64 `json:"same_article_p50,omitempty"`
+	CalibratedAt   string  `json:"calibrated_at"`
+}
+
+// Calibration sample sizes.
+const (
+	minCalibrationSamples     = 10
+	defaultCalibrationSamples = 200
+	maxCalibrationSamples     = 1000
+)
+
+// calibrate compares up to `n` random chunks with each other. Chunks of
+// different articles are taken as unrelated: a hit must score above 90%
+// of those pairs to be used (Relaxed) and above 99% of them to be used
+// without asking the LM (High).
+func (r *ragSystem) calibrate(n int) (scoreCalibration, error) {
+	r.dbMu.RLock()
+	rs, err := r.execLocked("SELECT id FROM chunks")
+	r.dbMu.RUnlock()
+	if err != nil {
+		return scoreCalibration{}, err
+	}
+	ids := make([]string, 0, len(rs.Rows))
+	for _, row := range rs.Rows {
+		if v, ok := tinysql.GetVal(row, "id"); ok {
+			ids = append(ids, fmt.Sprint(v))
+		}
+	}
+	if len(ids) < minCalibrationSamples {
+		return scoreCalibration{}, fmt.Errorf("need at least %d chunks to calibrate, collection %s has %d", minCalibrationSamples, r.collection, len(ids))
+	}
+	mrand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	ids = ids[:min(max(n, minCalibrationSamples), len(ids))]
+
+	r.dbMu.RLock()
+	rs, err = r.execLocked("SELECT article, embedding FROM chunks WHERE id IN (" + strings.Join(ids, ", ") + ")")
+	r.dbMu.RUnlock()
+	if err != nil {
+		return scoreCalibration{}, err
+	}
+	type sample struct {
+		article string
+		vec     []float64
+	}
+	var samples []sample
+	for _, row := range rs.Rows {
+		art, _ := tinysql.GetVal(row, "article")
+		emb, _ := tinysql.GetVal(row, "embedding")
+		if vec, ok := emb.([]float64); ok && len(vec) > 0 {
+			samples = append(samples, sample{fmt.Sprint(art), vec})
+		}
+	}
+	var other, same []float64
+	for i := range samples {
+		for j := i + 1; j < len(samples); j++ {
+			sim := cosineSimilarity(samples[i].vec, samples[j].vec)
+			if samples[i].article == samples[j].article {
+				same = append(same, sim)
+			} else {
+				other = append(other, sim)
+			}
+		}
+	}
+	if len(other) < 20 {
+		return scoreCalibration{}, fmt.Errorf("too few chunks from different articles to calibrate (%d pairs)", len(other))
+	}
+	sort.Float64s(other)
+	sort.Float64s(same)
+	c := scoreCalibration{
+		Collection:   r.collection,
+		SampleChunks: len(samples),
+		Pairs:        len(other) + len(same),
+		P50:          percentile(other, 0.50),
+		P90:          percentile(other, 0.90),
+		P99:          percentile(other, 0.99),
+		CalibratedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(same) > 0 {
+		c.SameArticleP50 = percentile(same, 0.50)
+	}
+	c.Relaxed = min(c.P90, 0.98)
+	c.High = min(max(c.P99, c.Relaxed+0.01), 0.99)
+	return c, nil
+}
+
+// percentile returns the `p` quantile of the sorted `vals`, rounded to
+// three decimals.
+func percentile(vals []float64, p float64) float64 {
+	v := vals[int(p*float64(len(vals)-1))]
+	return math.Round(v*1000) / 1000
+}
+
+// cosineSimilarity returns the cosine similarity of `a` and `b`, or 0
+// if either is a zero vector.
+func cosineSimilarity(a, b []float64) float64 {
+	var dot, na, nb float64
+	for i := range min(len(a), len(b)) {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// defaultQueryPatterns are the built-in query refinement patterns per
+// language. Each is a case-insensitive regexp whose first group is the
+// entity to search for; it must start at the beginning of a word.
+var defaultQueryPatterns = map[string][]string{
+	"de": {
+		`was weißt du (?:über|zu) (.+)`,
+		`erzähle? mir (?:etwas |mehr )?(?:von|über) (.+)`,
+		`erkläre? mir (?:bitte )?(.+)`,
+		`definiere (.+)`,
+		`(?:infos?|informationen) (?:zu|über) (.+)`,
+		`wer (?:ist|war|sind|waren) (.+)`,
+		`was (?:ist|sind|war|waren|bedeutet) (?:eine? |der |die |das )?(.+)`,
+	},
+	"en": {
+		`what do you know about (.+)`,
+		`tell me (?:something |more )?about (.+)`,
+		`explain (?:to me )?(.+)`,
+		`define (.+)`,
+		`information (?:on|about) (.+)`,
+		`who (?:is|was|are|were) (.+)`,
+		`what (?:is|are|was|were|does) (?:an? |the )?(.+?)(?: mean)?`,
+	},
+}
+
+// builtinQueryRefiner holds the compiled default patterns of all
+// languages, used until setQueryPatterns is called.
+var builtinQueryRefiner = compileQueryPatterns(queryPatternsFor(appSettings{Lang: "de"}))
+
+// queryPatternsFor returns the refinement patterns for `s`: those of
+// s.Lang first, then the other languages. Languages configured in
+// s.QueryPatterns replace the built-in list.
+func queryPatternsFor(s appSettings) []string {
+	langs := []string{s.Lang}
+	for lang := range defaultQueryPatterns {
+		langs = append(langs, lang)
+	}
+	for lang := range s.QueryPatterns {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs[1:])
+	var out []string
+	seen := map[string]bool{}
+	for _, lang := range langs {
+		if seen[lang] {
+			continue
+		}
+		seen[lang] = true
+		patterns, ok := s.QueryPatterns[lang]
+		if !ok {
+			patterns = defaultQueryPatterns[lang]
+		}
+		out = append(out, patterns...)
+	}
+	return out
+}
+
+// checkQueryPattern reports whether `p` compiles and captures the entity.
+func checkQueryPattern(p string) error {
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return err
+	}
+	if re.NumSubexp() < 1 {
+		return errors.New("pattern needs a capture group")
+	}
+	return nil
+}
+
+// compileQueryPatterns compiles query patterns for refineSearchQuery,
+// skipping invalid ones.
+func compileQueryPatterns(patterns []string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		if checkQueryPattern(p) != nil {
+			continue
+		}
+		res = append(res, regexp.MustCompile(`(?i)(?:^|[^\pL\pN])(?:`+p+`)\s*[?!.…]*\s*$`))
+	}
+	return res
+}
+
+// refineSearchQuery attempts to extract an entity-like phrase from the
+// user's question (e.g., "was weißt du über Ettling?" → "Ettling") to
+// narrow the retrieval query. Falls back to the original question.
+func refineSearchQuery(q string, patterns []*regexp.Regexp) string {
+	q = strings.TrimSpace(q)
+	for _, re := range patterns {
+		m := re.FindStringSubmatch(q)
+		if len(m) < 2 {
+			continue
+		}
+		if candidate := strings.TrimSpace(strings.TrimRight(m[1], " ?!.…")); candidate != "" {
+			return candidate
+		}
+	}
+	return q
+}
+
+// questionAnalysis is the decision of analyzeQuestion.
+type questionAnalysis struct {
+	Action    string   // ANSWER_DIRECT or RETRIEVE_MORE
+	K         int      // 0 keeps the configured k
+	Threshold *float64 // nil keeps the relaxed threshold
+	Query     string
+	// Fallback is why the reply was replaced by heuristicAnalysis.
+	Fallback string
+}
+
+// Bounds of the analysis reply; parseAnalysis clamps to them.
+const (
+	maxAnalysisK          = 50
+	maxAnalysisQueryRunes = 200
+)
+
+// analyzeQuestion asks the LM to decide whether to answer directly or
+// to request additional retrieval, along with optional parameters (k,
+// threshold, query). It returns the decision and the raw reply. A reply
+// that fails parseAnalysis is replaced by heuristicAnalysis; only a
+// failed request is an error.
+func (r *ragSystem) analyzeQuestion(ctx context.Context, question, summary string) (questionAnalysis, string, error) {
+	system := `You are an analysis agent. Given a user question and a short summary of retrieval candidates, decide whether the assistant can answer directly or needs more retrieval.
+
+Return ONLY a single JSON object and nothing else (no explanation, no extra text). "action" is ANSWER_DIRECT or RETRIEVE_MORE; "k" (whole number 1-50), "threshold" (0-1) and "query" (short search text) are optional. Examples:
+	{"action":"ANSWER_DIRECT"}
+	{"action":"RETRIEVE_MORE","k":10,"threshold":0.6,"query":"Ettling"}
+
+Deutsch:
+Du bist ein Analyse-Agent. Gegeben eine Nutzerfrage und eine kurze Zusammenfassung der Retrieval-Kandidaten entscheide, ob der Assistent direkt antworten soll oder zusätzliche Kontextsuche benötigt.
+
+Gib AUSSCHLIESSLICH ein einzelnes JSON-Objekt zurück (keine Erklärungen oder zusätzlichen Text). Beispiele:
+	{"action":"ANSWER_DIRECT"}
+	{"action":"RETRIEVE_MORE","k":10,"threshold":0.6,"query":"Ettling"}
+`
+	user := fmt.Sprintf("Question: %s\n\nCandidates: %s", question, summary)
+	out, err := r.lmFor(ctx).chatJSON(ctx, system, []chatMsg{{Role: "user", Content: user}}, planningWriter(ctx, "analysis"))
+	if err != nil {
+		return questionAnalysis{}, "", err
+	}
+	a, err := parseAnalysis(out)
+	if err != nil {
+		debugf("analysis reply rejected (%v): %q", err, out)
+		a = heuristicAnalysis(out, r.topK())
+		a.Fallback = err.Error()
+	}
+	return a, out, nil
+}
+
+// parseAnalysis reads the first JSON object with an "action" in `out`
+// and validates it: action ANSWER_DIRECT or RETRIEVE_MORE (any case), k
+// a whole number, threshold a number and query a string. k and
+// threshold are clamped to 1..maxAnalysisK and 0..1, the query is cut
+// to maxAnalysisQueryRunes. Missing or null fields keep their defaults.
+func parseAnalysis(out string) (questionAnalysis, error) {
+	var a questionAnalysis
+	m, err := firstJSONObject(out, "action")
+	if err != nil {
+		return a, err
+	}
+	action, _ := m["action"].(string)
+	a.Action = strings.ToUpper(strings.TrimSpace(action))
+	if a.Action != "ANSWER_DIRECT" && a.Action != "RETRIEVE_MORE" {
+		return a, fmt.Errorf("invalid action %v", m["action"])
+	}
+	if v := m["k"]; v != nil {
+		f, ok := v.(float64)
+		if !ok || f != math.Trunc(f) {
+			return a, fmt.Errorf("k is not a whole number: %v", v)
+		}
+		a.K = int(min(max(f, 1), maxAnalysisK))
+	}
+	if v := m["threshold"]; v != nil {
+		f, ok := v.(float64)
+		if !ok {
+			return a, fmt.Errorf("threshold is not a number: %v", v)
+		}
+		t := min(max(f, 0), 1)
+		a.Threshold = &t
+	}
+	if v := m["query"]; v != nil {
+		q, ok := v.(string)
+		if !ok {
+			return a, fmt.Errorf("query is not a string: %v", v)
+		}
+		a.Query = truncate(strings.TrimSpace(q), maxAnalysisQueryRunes)
+	}
+	return a, nil
+}
+
+// firstJSONObject decodes the first JSON object in `s` that has the
+// key `key`, skipping braces in surrounding text.
+func firstJSONObject(s, key string) (map[string]any, error) {
+	for i := strings.IndexByte(s, '{'); i >= 0; {
+		var m map[string]any
+		if json.NewDecoder(strings.NewReader(s[i:])).Decode(&m) == nil {
+			if _, ok := m[key]; ok {
+				return m, nil
+			}
+		}
+		next := strings.IndexByte(s[i+1:], '{')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return nil, fmt.Errorf("no JSON object with %q", key)
+}
+
+// heuristicAnalysis is the decision for a reply that failed
+// parseAnalysis: answer directly only if the reply names ANSWER_DIRECT
+// and not RETRIEVE_MORE, otherwise retrieve `k` hits above 0.6.
+func heuristicAnalysis(out string, k int) questionAnalysis {
+	up := strings.ToUpper(out)
+	if strings.Contains(up, "ANSWER_DIRECT") && !strings.Contains(up, "RETRIEVE_MORE") {
+		return questionAnalysis{Action: "ANSWER_DIRECT"}
+	}
+	t := 0.6
+	return questionAnalysis{Action: "RETRIEVE_MORE", K: k, Threshold: &t}
+}
+
+// fetchChunks loads the content and language of the chunks in `keys`
+// with a single query (one condition per article) and returns those
+// that exist.
+func (r *ragSystem) fetchChunks(keys []chunkKey) (map[chunkKey]chunkHit, error) {
+	out := make(map[chunkKey]chunkHit, len(keys))
+	if len(keys) == 0 {
+		return out, nil
+	}
+	idxs := make(map[string][]string)
+	var articles []string
+	for _, k := range keys {
+		if _, ok := idxs[k.article]; !ok {
+			articles = append(articles, k.article)
+		}
+		idxs[k.article] = append(idxs[k.article], strconv.Itoa(k.chunkIdx))
+	}
+	conds := make([]string, len(articles))
+	for i, a := range articles {
+		conds[i] = fmt.Sprintf("(article = %s AND chunk_idx IN (%s))", sqlText(a), strings.Join(idxs[a], ", "))
+	}
+	r.dbMu.RLock()
+	rs, err := r.execLocked("SELECT article, chunk_idx, content, lang FROM chunks WHERE " + strings.Join(conds, " OR "))
+	r.dbMu.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("loading chunks: %w", err)
+	}
+	for _, h := range parseHits(rs.Rows) {
+		out[chunkKey{h.article, h.chunkIdx}] = h
+	}
+	return out, nil
+}
+
+// listSources returns the metadata of all stored sources, ordered by name.
+func (r *ragSystem) listSources() []sourceInfo {
+	if !r.noCache {
+		r.cacheMu.Lock()
+		cached := slices.Clone(r.cacheLocked().sources)
+		r.cacheMu.Unlock()
+		if cached != nil {
+			return cached
+		}
+	}
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	rs, err := r.execLocked("SELECT * FROM sources ORDER BY name")
+	if err != nil || rs == nil {
+		return nil
+	}
+	sources := make([]sourceInfo, 0, len(rs.Rows))
+	for _, row := range rs.Rows {
+		sources = append(sources, sourceFromRow(row))
+	}
+	r.cacheMu.Lock()
+	r.cacheLocked().sources = slices.Clone(sources)
+	r.cacheMu.Unlock()
+	return sources
+}
+
+// deleteSource removes all chunks belonging to `article` and persists
+// the change.
+func (r *ragSystem) deleteSource(article string) error {
+	r.dbMu.Lock()
+	_, err := r.execLocked(fmt.Sprintf("DELETE FROM chunks WHERE article = %s", sqlText(article)))
+	if err == nil {
+		_, err = r.execLocked(fmt.Sprintf("DELETE FROM sources WHERE name = %s", sqlText(article)))
+	}
+	if err == nil {
+		_, err = r.execLocked(fmt.Sprintf("DELETE FROM refresh_schedule WHERE name = %s", sqlText(article)))
+	}
+	r.invalidateCacheLocked()
+	r.markDirty()
+	r.dbMu.Unlock()
+	if err != nil {
+		return err
+	}
+	// A failed save is reported via saveStatus; the deletion itself worked.
+	if err := r.save(); err != nil {
+		log.Printf("WARN: save failed: %v", err)
+	}
+	return nil
+}
+
+// ── Language detection ─────────────────────────────────────────────
+
+// langStopwords are frequent function words of the languages detectLang
+// recognizes. No word appears in two lists.
+var langStopwords = map[string][]string{
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "mit", "sich", "auch", "auf", "für", "von", "den", "dem", "zu", "im", "wird", "sind", "wie", "oder", "aber", "wenn", "nach", "bei", "aus", "noch", "nur", "über", "wer", "wo", "warum", "welche", "mir", "ich"},
+	"en": {"the", "and", "is", "are", "of", "to", "that", "it", "with", "for", "as", "be", "by", "this", "not", "from", "have", "at", "which", "but", "or", "were", "has", "what", "who", "where", "why", "how", "about"},
+	"fr": {"le", "les", "et", "est", "une", "dans", "qui", "pour", "pas", "sur", "avec", "ce", "sont", "au", "par", "plus", "quoi", "où", "comment", "pourquoi"},
+	"es": {"el", "los", "las", "y", "por", "para", "su", "sus", "como", "más", "pero", "está", "muy", "qué", "cómo", "dónde", "quién"},
+	"it": {"gli", "della", "delle", "degli", "che", "sono", "nel", "alla", "anche", "questo", "è", "ma", "dove", "perché", "chi"},
+}
+
+// langNames are the names of the languages detectLang recognizes, as
+// used in prompts.
+var langNames = map[string]string{"de": "Deutsch", "en": "Englisch", "fr": "Französisch", "es": "Spanisch", "it": "Italienisch"}
+
+// stopwordLang maps each word in langStopwords to its language.
+var stopwordLang = func() map[string]string {
+	m := make(map[string]string)
+	for lang, words := range langStopwords {
+		for _, w := range words {
+			m[w] = lang
+		}
+	}
+	return m
+}()
+
+// detectLang guesses the language of `text` by counting stopwords and
+// returns its code, or "" if no language clearly wins. Short texts such
+// as questions need one stopword, longer ones two.
+func detectLang(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) })
+	counts := make(map[string]int)
+	for _, w := range words {
+		if lang, ok := stopwordLang[w]; ok {
+			counts[lang]++
+		}
+	}
+	best, n, second := "", 0, 0
+	for lang, c := range counts {
+		if c > n {
+			best, n, second = lang, c, n
+		} else if c > second {
+			second = c
+		}
+	}
+	need := 2
+	if len(words) < 8 {
+		need = 1
+	}
+	if n < need || n == second {
+		return ""
+	}
+	return best
+}
+
+// crossLangNote returns an addition to the system prompt when the
+// question's language is known and all retrieved hits are in another
+// one, asking the model to answer in the question's language and to
+// say that the cited sources are not. It returns "" otherwise.
+func crossLangNote(di *debugInfo) string {
+	if di == nil || di.QuestionLang == "" {
+		return ""
+	}
+	var foreign []string
+	for _, c := range di.Chunks {
+		if c.IsNeighbor {
+			continue
+		}
+		if c.Lang == "" || c.Lang == di.QuestionLang {
+			return ""
+		}
+		if name := langNames[c.Lang]; !slices.Contains(foreign, name) {
+			foreign = append(foreign, name)
+		}
+	}
+	if len(foreign) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n\nSPRACHE: Die Frage ist auf %s gestellt, die Quellen im Kontext sind auf %s verfasst. Antworte auf %s und weise beim Zitieren darauf hin, dass die Quelle auf %s ist.\n",
+		langNames[di.QuestionLang], strings.Join(foreign, "/"), langNames[di.QuestionLang], strings.Join(foreign, "/"))
+}
+
+// ── Source graph ───────────────────────────────────────────────────
+
+// centroid accumulates the chunk vectors of one source.
+type centroid struct {
+	sum []float64
+	n   int
+}
+
+func (c *centroid) add(v []float64) {
+	if len(c.sum) < len(v) {
+		c.sum = append(c.sum, make([]float64, len(v)-len(c.sum))...)
+	}
+	for i, x := range v {
+		c.sum[i] += x
+	}
+	c.n++
+}
+
+// Defaults of GET /api/sources/preview.
+const (
+	defaultPreviewChars = 2000
+	maxPreviewChars     = 50000
+)
+
+// sourcePreview is the beginning of a source's text with its metadata.
+type sourcePreview struct {
+	sourceInfo
+	Text        string `json:"text"`
+	ChunksShown int    `json:"chunks_shown"`
+	Truncated   bool   `json:"truncated"`
+}
+
+// previewSource joins the chunks of source `name` in chunk order until
+// `maxChars` characters. Chunks are loaded in batches sized from the
+// source's average chunk length.
+func (r *ragSystem) previewSource(name string, maxChars int) (sourcePreview, bool) {
+	src, ok := r.getSource(name)
+	if !ok {
+		return sourcePreview{}, false
+	}
+	p := sourcePreview{sourceInfo: src}
+	batch := 8
+	if src.ChunkCount > 0 && src.Chars > 0 {
+		batch = min(100, maxChars*src.ChunkCount/src.Chars+1)
+	}
+	var b strings.Builder
+	n := 0
+	for start := 0; start < src.ChunkCount && n < maxChars; start += batch {
+		keys := make([]chunkKey, 0, batch)
+		for i := start; i < min(start+batch, src.ChunkCount); i++ {
+			keys = append(keys, chunkKey{name, i})
+		}
+		got, err := r.fetchChunks(keys)
+		if err != nil {
+			// The preview ends here and counts as truncated.
+			log.Printf("WARN: preview of %s: %v", name, err)
+			break
+		}
+		for _, k := range keys {
+			h, ok := got[k]
+			if !ok {
+				continue
+			}
+			text := h.content
+			if b.Len() > 0 {
+				text = "\n" + text
+			}
+			if l := utf8.RuneCountInString(text); n+l > maxChars {
+				text = truncate(text, maxChars-n)
+				n = maxChars
+				p.Truncated = true
+			} else {
+				n += l
+			}
+			b.WriteString(text)
+			p.ChunksShown++
+			if n >= maxChars {
+				break
+			}
+		}
+	}
+	p.Text = b.String()
+	p.Truncated = p.Truncated || p.ChunksShown < src.ChunkCount
+	return p, true
+}
+
+// sourceGraph links sources whose centroids are similar.
+type sourceGraph struct {
+	Nodes []graphNode `json:"nodes"`
+	Edges []graphEdge `json:"edges"`
+}
+
+type graphNode struct {
+	Source string `json:"source"`
+	Chunks int    `json:"chunks"`
+}
+
+type graphEdge struct {
+	Source string  `json:"source"`
+	Target string  `json:"target"`
+	Score  float64 `json:"score"`
+}
+
+// Defaults of GET /api/sources/graph.
+const (
+	defaultGraphThreshold = 0.8
+	defaultGraphMaxEdges  = 5
+	maxGraphMaxEdges      = 50
+)
+
+// sourceCentroids returns the summed vectors of each source. They are
+// read from the DB once and then kept up to date by storeChunks until
+// the cache is invalidated.
+func (r *ragSystem) sourceCentroids() (map[string]centroid, int) {
+	snapshot := func(c *kbCache) map[string]centroid {
+		out := make(map[string]centroid, len(c.centroids))
+		for name, cen := range c.centroids {
+			out[name] = centroid{sum: slices.Clone(cen.sum), n: cen.n}
+		}
+		return out
+	}
+	if !r.noCache {
+		r.cacheMu.Lock()
+		c := r.cacheLocked()
+		if c.centroids != nil {
+			defer r.cacheMu.Unlock()
+			return snapshot(c), c.centroidGen
+		}
+		r.cacheMu.Unlock()
+	}
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	cens := map[string]*centroid{}
+	if rs, err := r.execLocked("SELECT article, embedding FROM chunks"); err == nil && rs != nil {
+		for _, row := range rs.Rows {
+			article, _ := tinysql.GetVal(row, "article")
+			v, _ := tinysql.GetVal(row, "embedding")
+			name, _ := article.(string)
+			vec, ok := v.([]float64)
+			if !ok {
+				continue
+			}
+			if cens[name] == nil {
+				cens[name] = &centroid{}
+			}
+			cens[name].add(vec)
+		}
+	}
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	c := r.cacheLocked()
+	c.centroids = cens
+	c.centroidGen++
+	return snapshot(c), c.centroidGen
+}
+
+// sourceGraph returns the sources as nodes and an edge for each pair
+// whose centroids have a cosine similarity above `threshold`. Edges are
+// taken by descending score while both ends have fewer than `maxEdges`.
+// The result is cached until the knowledge base changes.
+func (r *ragSystem) sourceGraph(threshold float64, maxEdges int) *sourceGraph {
+	key := fmt.Sprintf("%g/%d", threshold, maxEdges)
+	if !r.noCache {
+		r.cacheMu.Lock()
+		c := r.cacheLocked()
+		g := c.graph
+		if g != nil && c.graphKey == key {
+			r.cacheMu.Unlock()
+			return g
+		}
+		r.cacheMu.Unlock()
+	}
+	cens, gen := r.sourceCentroids()
+	names := slices.Sorted(maps.Keys(cens))
+	g := &sourceGraph{Nodes: make([]graphNode, len(names)), Edges: []graphEdge{}}
+	for i, name := range names {
+		g.Nodes[i] = graphNode{Source: name, Chunks: cens[name].n}
+	}
+	var cands []graphEdge
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			if score := cosineSimilarity(cens[a].sum, cens[b].sum); score > threshold {
+				cands = append(cands, graphEdge{Source: a, Target: b, Score: score})
+			}
+		}
+	}
+	sort.SliceStable(cands, func(i, j int) bool { return cands[i].Score > cands[j].Score })
+	degree := map[string]int{}
+	for _, e := range cands {
+		if degree[e.Source] < maxEdges && degree[e.Target] < maxEdges {
+			degree[e.Source]++
+			degree[e.Target]++
+			g.Edges = append(g.Edges, e)
+		}
+	}
+	if !r.noCache {
+		r.cacheMu.Lock()
+		// Keep it unless chunks were added or deleted meanwhile.
+		if c := r.cacheLocked(); c.centroids != nil && c.centroidGen == gen {
+			c.graph, c.graphKey = g, key
+		}
+		r.cacheMu.Unlock()
+	}
+	return g
+}
+
+// ── Source refresh ─────────────────────────────────────────────────
+
+// refreshState is the refresh schedule and last outcome of a source
+// (a row of the refresh_schedule table). IntervalS 0 means it is only
+// refreshed on request.
+type refreshState struct {
+	IntervalS  int    `json:"interval_s"`
+	LastRun    string `json:"last_run,omitempty"`
+	LastStatus string `json:"last_status,omitempty"` // "updated", "unchanged" or "failed"
+	LastError  string `json:"last_error,omitempty"`
+	Failures   int    `json:"failures,omitempty"`
+	NextRun    string `json:"next_run,omitempty"`
+}
+
+// Bounds of refresh intervals and of the failure backoff, which doubles
+// the interval per consecutive failure.
+const (
+	minRefreshInterval  = 10 * time.Minute
+	maxRefreshBackoff   = 7 * 24 * time.Hour
+	refreshCheckEvery   = time.Minute
+	refreshStopWaitTime = 10 * time.Second
+)
+
+// refreshable reports whether sources of origin `o` can be re-fetched.
+func refreshable(o sourceOrigin) bool {
+	switch o.Type {
+	case "url":
+		return true
+	case "wikipedia":
+		lang, article, ok := strings.Cut(o.Ref, ":")
+		return ok && article != "" && wikiLangRe.MatchString(lang)
+	}
+	return false
+}
+
+// refreshStates returns the refresh_schedule rows by source name.
+func (r *ragSystem) refreshStates() map[string]refreshState {
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	out := map[string]refreshState{}
+	rs, err := r.execLocked("SELECT * FROM refresh_schedule")
+	if err != nil || rs == nil {
+		return out
+	}
+	for _, row := range rs.Rows {
+		str := func(col string) string {
+			v, _ := tinysql.GetVal(row, col)
+			s, _ := v.(string)
+			return s
+		}
+		num := func(col string) int {
+			v, _ := tinysql.GetVal(row, col)
+			n, _ := strconv.Atoi(fmt.Sprint(v))
+			return n
+		}
+		out[str("name")] = refreshState{
+			IntervalS:  num("interval_s"),
+			LastRun:    str("last_run"),
+			LastStatus: str("last_status"),
+			LastError:  str("last_error"),
+			Failures:   num("failures"),
+			NextRun:    str("next_run"),
+		}
+	}
+	return out
+}
+
+// putRefreshStateLocked replaces the refresh_schedule row of `name`. It
+// must be called with r.dbMu held for writing.
+func (r *ragSystem) putRefreshStateLocked(name string, st refreshState) error {
+	if _, err := r.execLocked(fmt.Sprintf("DELETE FROM refresh_schedule WHERE name = %s", sqlText(name))); err != nil {
+		return err
+	}
+	_, err := r.execLocked(fmt.Sprintf(
+		"INSERT INTO refresh_schedule VALUES (%s, %d, %s, %s, %s, %d, %s)",
+		sqlText(name), st.IntervalS, sqlText(st.LastRun), sqlText(st.LastStatus),
+		sqlText(st.LastError), st.Failures, sqlText(st.NextRun),
+	))
+	r.markDirty()
+	return err
+}
+
+// setRefreshInterval schedules source `name` for a refresh every
+// `interval`, or stops scheduling it for 0. The first run is due one
+// interval from now.
+func (r *ragSystem) setRefreshInterval(name string, interval time.Duration) (refreshState, error) {
+	src, ok := r.getSource(name)
+	if !ok {
+		return refreshState{}, fmt.Errorf("unknown source %q", name)
+	}
+	if interval != 0 && !refreshable(src.sourceOrigin) {
+		return refreshState{}, fmt.Errorf("source %q (%s) cannot be refreshed", name, src.Type)
+	}
+	st := r.refreshStates()[name]
+	st.IntervalS = int(interval / time.Second)
+	st.Failures, st.NextRun = 0, ""
+	if interval > 0 {
+		st.NextRun = time.Now().UTC().Add(interval).Format(time.RFC3339)
+	}
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+	return st, r.putRefreshStateLocked(name, st)
+}
+
+// recordRefresh stores the outcome of a refresh of `name` and schedules
+// the next one, backing off after failures.
+func (r *ragSystem) recordRefresh(name, status string, err error) refreshState {
+	st := r.refreshStates()[name]
+	now := time.Now().UTC()
+	st.LastRun, st.LastStatus, st.LastError = now.Format(time.RFC3339), status, ""
+	if err != nil {
+		st.LastStatus, st.LastError = "failed", err.Error()
+		st.Failures++
+	} else {
+		st.Failures = 0
+	}
+	st.NextRun = ""
+	if st.IntervalS > 0 {
+		next := time.Duration(st.IntervalS) * time.Second
+		for range min(st.Failures, 16) {
+			next = min(next*2, maxRefreshBackoff)
+		}
+		st.NextRun = now.Add(next).Format(time.RFC3339)
+	}
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+	if _, ok := r.getSourceLocked(name); !ok {
+		return st // deleted meanwhile
+	}
+	if perr := r.putRefreshStateLocked(name, st); perr != nil {
+		log.Printf("WARN: recording refresh of %q failed: %v", name, perr)
+	}
+	return st
+}
+
+// errRefreshRunning is returned while a source is already being refreshed.
+var errRefreshRunning = errors.New("refresh already running")
+
+// refreshSource re-fetches source `name` like the import did and, if
+// its text changed, replaces its chunks. It returns "updated" or
+// "unchanged"; on errors the stored chunks are kept. The outcome is
+// recorded in the refresh_schedule table. Nothing is fetched or
+// recorded while OfflineNetwork is set.
+func (r *ragSystem) refreshSource(ctx context.Context, name string, s appSettings) (string, error) {
+	if s.OfflineNetwork {
+		return "", errOfflineNetwork
+	}
+	key := r.collection + "\x00" + name
+	r.dbMu.Lock()
+	if r.refreshing[key] {
+		r.dbMu.Unlock()
+		return "", errRefreshRunning
+	}
+	r.refreshing[key] = true
+	r.dbMu.Unlock()
+	defer func() {
+		r.dbMu.Lock()
+		delete(r.refreshing, key)
+		r.dbMu.Unlock()
+	}()
+
+	status, err := r.refetchSource(ctx, name, s)
+	if ctx.Err() != nil {
+		// Cancelled (shutdown or client gone): not the source's fault.
+		return "", ctx.Err()
+	}
+	r.recordRefresh(name, status, err)
+	return status, err
+}
+
+func (r *ragSystem) refetchSource(ctx context.Context, name string, s appSettings) (string, error) {
+	src, ok := r.getSource(name)
+	if !ok {
+		return "", fmt.Errorf("unknown source %q", name)
+	}
+	if !refreshable(src.sourceOrigin) {
+		return "", fmt.Errorf("source %q (%s) cannot be refreshed", name, src.Type)
+	}
+	var text string
+	switch src.Type {
+	case "url":
+		title, body, err := fetchPage(ctx, src.Ref, s.AllowedHosts)
+		if err != nil {
+			return "", err
+		}
+		text = body
+		if title != "" {
+			text = "# " + title + "\n\n" + body
+		}
+	case "wikipedia":
+		lang, article, _ := strings.Cut(src.Ref, ":")
+		body, err := fetchWikipedia(ctx, article, lang)
+		if err != nil {
+			return "", err
+		}
+		text = body
+	}
+	chunks := chunkText(text, s.ChunkSize)
+	if len(chunks) == 0 {
+		return "", fmt.Errorf("source %q returned no text", name)
+	}
+	if slices.Equal(chunks, r.sourceChunkTexts(name)) {
+		return "unchanged", nil
+	}
+	if err := r.replaceSource(ctx, src, chunks); err != nil {
+		return "", err
+	}
+	return "updated", nil
+}
+
+// replaceSource embeds `chunks` and swaps them for the stored chunks of
+// the existing source `src`.
+func (r *ragSystem) replaceSource(ctx context.Context, src sourceInfo, chunks []string) error {
+	vecs, err := r.embedChunks(ctx, chunks)
+	if err != nil {
+		return err
+	}
+	if err := r.replaceChunks(src, chunks, vecs); err != nil {
+		return err
+	}
+	if err := r.save(); err != nil {
+		log.Printf("WARN: save failed: %v", err)
+	}
+	return nil
+}
+
+// sourceChunkTexts returns the chunk texts of source `name` in order.
+func (r *ragSystem) sourceChunkTexts(name string) []string {
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	return r.sourceChunkTextsLocked(name)
+}
+
+// sourceChunkTextsLocked is sourceChunkTexts for callers holding r.dbMu.
+func (r *ragSystem) sourceChunkTextsLocked(name string) []string {
+	rs, err := r.execLocked(fmt.Sprintf("SELECT article, chunk_idx, content FROM chunks WHERE article = %s ORDER BY chunk_idx", sqlText(name)))
+	if err != nil || rs == nil {
+		return nil
+	}
+	var out []string
+	for _, h := range parseHits(rs.Rows) {
+		out = append(out, h.content)
+	}
+	return out
+}
+
+// replaceChunks swaps the chunks of `src` for the embedded `chunks`.
+// The old chunks are deleted only after all new ones are stored.
+func (r *ragSystem) replaceChunks(src sourceInfo, chunks []string, vecs [][]float64) error {
+	startID, err := r.allocIDs(len(chunks))
+	if err != nil {
+		return err
+	}
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+	if _, ok := r.getSourceLocked(src.Name); !ok {
+		return fmt.Errorf("source %q was deleted", src.Name)
+	}
+	if err := r.checkEmbedDimLocked(vecs); err != nil {
+		return err
+	}
+	defer r.markDirty()
+	defer r.invalidateCacheLocked()
+	for idx := range chunks {
+		if _, err := r.execLocked(chunkInsertSQL(startID+idx, src.Name, idx, chunks[idx], vecs[idx], r.compress)); err != nil {
+			if rbErr := r.deleteIDRangeLocked(startID, startID+idx); rbErr != nil {
+				log.Printf("WARN: rollback of %q failed: %v", src.Name, rbErr)
+			}
+			return fmt.Errorf("insert chunk %d: %w", idx, err)
+		}
+	}
+	if _, err := r.execLocked(fmt.Sprintf("DELETE FROM chunks WHERE article = %s AND id < %d", sqlText(src.Name), startID)); err != nil {
+		if rbErr := r.deleteIDRangeLocked(startID, startID+len(chunks)); rbErr != nil {
+			log.Printf("WARN: rollback of %q failed: %v", src.Name, rbErr)
+		}
+		return fmt.Errorf("remove old chunks: %w", err)
+	}
+	src.ChunkCount, src.Chars, src.ContentHash = len(chunks), 0, chunksHash(chunks)
+	for _, c := range chunks {
+		src.Chars += len(c)
+	}
+	if err := r.upsertSourceLocked(src); err != nil {
+		log.Printf("WARN: recording source %q failed: %v", src.Name, err)
+	}
+	return nil
+}
+
+// refreshScheduler periodically refreshes the sources whose next_run is
+// due, one at a time.
+type refreshScheduler struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	done   chan struct{} // nil until started
+}
+
+func newRefreshScheduler() *refreshScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &refreshScheduler{ctx: ctx, cancel: cancel}
+}
+
+// start checks every refreshCheckEvery for due sources in all
+// collections of `rag`.
+func (rs *refreshScheduler) start(rag *ragSystem, settings *settingsStore) {
+	done := make(chan struct{})
+	rs.mu.Lock()
+	rs.done = done
+	rs.mu.Unlock()
+	go func() {
+		defer close(done)
+		t := time.NewTicker(refreshCheckEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-rs.ctx.Done():
+				return
+			case <-t.C:
+			}
+			if rag.lmError() != nil {
+				continue // embedding needs the LLM endpoint
+			}
+			for _, c := range rag.allCollections() {
+				c.runDueRefreshes(rs.ctx, settings)
+			}
+		}
+	}()
+}
+
+// runDueRefreshes refreshes the sources of this collection whose
+// next_run has passed.
+func (r *ragSystem) runDueRefreshes(ctx context.Context, settings *settingsStore) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	states := r.refreshStates()
+	for _, name := range slices.Sorted(maps.Keys(states)) {
+		st := states[name]
+		if st.IntervalS <= 0 || st.NextRun == "" || st.NextRun > now {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		s := settings.get()
+		status, err := r.refreshSource(ctx, name, s)
+		switch {
+		case err == errRefreshRunning || err == errOfflineNetwork || ctx.Err() != nil:
+			continue
+		case err != nil:
+			log.Printf("refresh %s/%s failed: %v", r.collection, name, err)
+		default:
+			log.Printf("refresh %s/%s: %s", r.collection, name, status)
+		}
+		// Unchanged sources are not worth a notification.
+		if err != nil || status == "updated" {
+			notifyWebhook(s, jobEvent("refresh", newID("job"), r.collection+"/"+name+": "+cmp.Or(status, "failed"), err))
+		}
+	}
+}
+
+// stop cancels a running refresh and waits up to refreshStopWaitTime for
+// the scheduler to exit.
+func (rs *refreshScheduler) stop() {
+	rs.cancel()
+	rs.mu.Lock()
+	done := rs.done
+	rs.mu.Unlock()
+	if done == nil {
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(refreshStopWaitTime):
+		log.Printf("WARN: source refresh did not stop in time")
+	}
+}
+
+// ─────────────────────────────────────────────────────────────────────────────
+// Collections
+// ─────────────────────────────────────────────────────────────────────────────
+
+// collectionNameRe restricts collection names; they double as tinySQL
+// tenant and, in disk modes, directory names.
+var collectionNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+var (
+	errUnknownCollection = errors.New("unknown collection")
+	errCollectionExists  = errors.New("collection already exists")
+)
+
+// collectionInfo summarizes a collection for /api/collections.
+type collectionInfo struct {
+	Name    string `json:"name"`
+	Chunks  int    `json:"chunks"`
+	Sources int    `json:"sources"`
+}
+
+// collectionNamesLocked lists the registered collections besides the
+// default one. It must be called with r.dbMu held.
+func (r *ragSystem) collectionNamesLocked() []string {
+	rs, err := r.in(defaultCollection).execLocked("SELECT name FROM collections ORDER BY name")
+	if err != nil || rs == nil {
+		return nil
+	}
+	var names []string
+	for _, row := range rs.Rows {
+		if v, ok := tinysql.GetVal(row, "name"); ok {
+			names = append(names, fmt.Sprintf("%v", v))
+		}
+	}
+	return names
+}
+
+// listCollections returns all collections, default first.
+func (r *ragSystem) listCollections() []collectionInfo {
+	r.dbMu.RLock()
+	names := append([]string{defaultCollection}, r.collectionNamesLocked()...)
+	r.dbMu.RUnlock()
+	out := make([]collectionInfo, 0, len(names))
+	for _, name := range names {
+		c := r.in(name)
+		out = append(out, collectionInfo{Name: name, Chunks: c.docCount(), Sources: len(c.listSources())})
+	}
+	return out
+}
+
+// collectionView returns the view of collection `name` ("" means the
+// default collection), or errUnknownCollection.
+func (r *ragSystem) collectionView(name string) (*ragSystem, error) {
+	if name == "" || name == defaultCollection {
+		return r.in(defaultCollection), nil
+	}
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	for _, c := range r.collectionNamesLocked() {
+		if c == name {
+			return r.in(name), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownCollection, name)
+}
+
+// createCollection registers collection `name` and creates its tables.
+func (r *ragSystem) createCollection(name string) error {
+	if !collectionNameRe.MatchString(name) {
+		return fmt.Errorf("invalid collection name %q (a-z, 0-9, _ and -, max 32)", name)
+	}
+	r.dbMu.Lock()
+	if name == defaultCollection || slices.Contains(r.collectionNamesLocked(), name) {
+		r.dbMu.Unlock()
+		return fmt.Errorf("%w: %s", errCollectionExists, name)
+	}
+	err := r.in(name).initCollectionLocked()
+	if err == nil {
+		now := time.Now().UTC().Format(time.RFC3339)
+		_, err = r.in(defaultCollection).execLocked(fmt.Sprintf("INSERT INTO collections (name, created_at) VALUES (%s, %s)", sqlText(name), sqlText(now)))
+	}
+	r.markDirty()
+	r.dbMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := r.save(); err != nil {
+		log.Printf("WARN: save failed: %v", err)
+	}
+	return nil
+}
+
+// deleteCollection drops all tables of collection `name`. The default
+// collection cannot be deleted.
+func (r *ragSystem) deleteCollection(name string) error {
+	if name == defaultCollection {
+		return errors.New("the default collection cannot be deleted")
+	}
+	r.dbMu.Lock()
+	if !slices.Contains(r.collectionNamesLocked(), name) {
+		r.dbMu.Unlock()
+		return fmt.Errorf("%w: %s", errUnknownCollection, name)
+	}
+	var err error
+	for _, table := range []string{"chunks", "sources", "meta"} {
+		if dropErr := r.db.Drop(name, table); dropErr != nil && err == nil {
+			err = dropErr
+		}
+	}
+	if _, delErr := r.in(defaultCollection).execLocked(fmt.Sprintf("DELETE FROM collections WHERE name = %s", sqlText(name))); delErr != nil && err == nil {
+		err = delErr
+	}
+	delete(r.nextIDs, name)
+	r.in(name).invalidateCacheLocked()
+	r.markDirty()
+	r.dbMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := r.save(); err != nil {
+		log.Printf("WARN: save failed: %v", err)
+	}
+	return nil
+}
+
+// ─────────────────────────────────────────────────────────────────────────────
+// Sources metadata
+// ─────────────────────────────────────────────────────────────────────────────
+
+// sourceOrigin describes where a source came from: Type is e.g.
+// "wikipedia", "url", "upload", "folder", "text" or a tool name, and
+// Ref is what is needed to fetch it again (URL, "lang:Article", path).
+type sourceOrigin struct {
+	Type string `json:"origin_type"`
+	Ref  string `json:"origin_ref"`
+}
+
+// sourceInfo is a row of the sources table.
+type sourceInfo struct {
+	Name string `json:"article"`
+	sourceOrigin
+	CreatedAt  string `json:"created_at"`
+	UpdatedAt  string `json:"updated_at"`
+	ChunkCount int    `json:"chunks"`
+	Chars      int    `json:"chars"`
+	// ContentHash identifies the chunked text (see chunksHash).
+	ContentHash string `json:"content_hash,omitempty"`
+	// Provenance is set for sources stored from tool results.
+	Provenance *sourceProvenance `json:"provenance,omitempty"`
+	// Group and GroupPos (from 1) order sources that continue each
+	// other, such as the files of a folder import (see sourceLinks).
+	Group    string `json:"group,omitempty"`
+	GroupPos int    `json:"group_pos,omitempty"`
+	// Tags are labels such as "legal" or "2024" that /api/ask and
+	// /api/search can filter by (see normalizeTags).
+	Tags []string `json:"tags,omitempty"`
+}
+
+// sourceProvenance records why a tool result was stored: the request
+// and conversation that ran the tool, the tool, its query and when.
+type sourceProvenance struct {
+	RequestID string `json:"request_id,omitempty"`
+	ChatID    string `json:"chat_id,omitempty"`
+	Tool      string `json:"tool"`
+	Query     string `json:"query"`
+	At        string `json:"at"`
+}
+
+// staleToolSources returns the names of the sources stored from tool
+// results before `before` (zero: any age) or, with `chatExists` set, for
+// a conversation that no longer exists. Results stored without a
+// conversation (CLI, /api/tool/execute) only expire by age.
+func staleToolSources(sources []sourceInfo, before time.Time, chatExists func(id string) bool) []string {
+	var names []string
+	for _, src := range sources {
+		p := src.Provenance
+		if p == nil {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, p.At)
+		old := !before.IsZero() && err == nil && at.Before(before)
+		orphaned := chatExists != nil && p.ChatID != "" && !chatExists(p.ChatID)
+		if old || orphaned {
+			names = append(names, src.Name)
+		}
+	}
+	return names
+}
+
+// sourcePrefixOrigins maps the name prefixes used before the sources
+// table existed (and still used by tools) to origin types.
+var sourcePrefixOrigins = []struct{ prefix, typ string }{
+	{"wiki:", "wikipedia"},
+	{"wikt:", "wiktionary"},
+	{"so:", "stackoverflow"},
+	{"web:", "websearch"},
+	{"ddg:", "duckduckgo"},
+	{"calc:", "calculate"},
+	{"api:", "api"},
+	{"plugin:", "plugin"},
+	{"upload:", "upload"},
+	{"folder:", "folder"},
+	{"chat-import:", "chat"},
+}
+
+// inferOrigin derives an origin from a source name.
+func inferOrigin(name string) sourceOrigin {
+	for _, p := range sourcePrefixOrigins {
+		if strings.HasPrefix(name, p.prefix) {
+			return sourceOrigin{Type: p.typ, Ref: strings.TrimPrefix(name, p.prefix)}
+		}
+	}
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		return sourceOrigin{Type: "url", Ref: name}
+	}
+	return sourceOrigin{Type: "manual"}
+}
+
+// execLocked parses and runs `q`. It must be called with r.dbMu held.
+func (r *ragSystem) execLocked(q string) (*tinysql.ResultSet, error) {
+	stmt, err := tinysql.ParseSQL(q)
+	if err != nil {
+		return nil, err
+	}
+	return tinysql.Execute(context.Background(), r.db, r.collection, stmt)
+}
+
+// upsertSourceLocked records `info`, keeping the creation time and
+// provenance of an existing entry or, if set, the ones in `info`
+// (imports). It must be called with r.dbMu held.
+func (r *ragSystem) upsertSourceLocked(info sourceInfo) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	if info.CreatedAt == "" {
+		info.CreatedAt = now
+	}
+	info.UpdatedAt = now
+	if old, ok := r.getSourceLocked(info.Name); ok {
+		if old.CreatedAt != "" {
+			info.CreatedAt = old.CreatedAt
+		}
+		if info.Provenance == nil {
+			info.Provenance = old.Provenance
+		}
+		if info.Group == "" {
+			info.Group, info.GroupPos = old.Group, old.GroupPos
+		}
+		if info.Tags == nil {
+			info.Tags = old.Tags
+		}
+	}
+	var prov sourceProvenance
+	if info.Provenance != nil {
+		prov = *info.Provenance
+	}
+	if _, err := r.execLocked(fmt.Sprintf("DELETE FROM sources WHERE name = %s", sqlText(info.Name))); err != nil {
+		return err
+	}
+	_, err := r.execLocked(fmt.Sprintf(
+		"INSERT INTO sources VALUES (%s, %s, %s, %s, %s, %d, %d, %s, %s, %s, %s, %s, %s, %s, %d, %s)",
+		sqlText(info.Name), sqlText(info.Type), sqlText(info.Ref),
+		sqlText(info.CreatedAt), sqlText(info.UpdatedAt), info.ChunkCount, info.Chars, sqlText(info.ContentHash),
+		sqlText(prov.RequestID), sqlText(prov.ChatID), sqlText(prov.Tool), sqlText(prov.Query), sqlText(prov.At),
+		sqlText(info.Group), info.GroupPos, sqlText(strings.Join(info.Tags, ",")),
+	))
+	if err != nil {
+		r.invalidateCacheLocked()
+		return err
+	}
+	r.putCachedSourceLocked(info)
+	return nil
+}
+
+// getSourceLocked returns the sources row of `name`. It must be called
+// with r.dbMu held.
+func (r *ragSystem) getSourceLocked(name string) (sourceInfo, bool) {
+	rs, err := r.execLocked(fmt.Sprintf("SELECT * FROM sources WHERE name = %s", sqlText(name)))
+	if err != nil || rs == nil || len(rs.Rows) == 0 {
+		return sourceInfo{}, false
+	}
+	return sourceFromRow(rs.Rows[0]), true
+}
+
+// setSourceGroup makes `names` the members of group `group` in this
+// order, replacing its previous members. No names dissolves the group.
+func (r *ragSystem) setSourceGroup(group string, names []string) error {
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+	for i, n := range names {
+		if _, ok := r.getSourceLocked(n); !ok {
+			return fmt.Errorf("unknown source %q", n)
+		}
+		if slices.Contains(names[:i], n) {
+			return fmt.Errorf("source %q listed twice", n)
+		}
+	}
+	if _, err := r.execLocked(fmt.Sprintf("UPDATE sources SET seq_group = '', seq_pos = 0 WHERE seq_group = %s", sqlText(group))); err != nil {
+		return err
+	}
+	var err error
+	for i, n := range names {
+		if _, err = r.execLocked(fmt.Sprintf("UPDATE sources SET seq_group = %s, seq_pos = %d WHERE name = %s", sqlText(group), i+1, sqlText(n))); err != nil {
+			break
+		}
+	}
+	r.invalidateCacheLocked()
+	r.markDirty()
+	return err
+}
+
+// maxSourceTags and maxTagLen limit the tags of a source.
+const (
+	maxSourceTags = 20
+	maxTagLen     = 64
+)
+
+// normalizeTags trims and lowercases `tags` and drops empty ones and
+// duplicates. Tags with commas or longer than maxTagLen are rejected.
+func normalizeTags(tags []string) ([]string, error) {
+	out := []string{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case t == "" || slices.Contains(out, t):
+			continue
+		case strings.Contains(t, ","):
+			return nil, fmt.Errorf("tag %q contains a comma", t)
+		case utf8.RuneCountInString(t) > maxTagLen:
+			return nil, fmt.Errorf("tag %q is longer than %d characters", t, maxTagLen)
+		}
+		out = append(out, t)
+	}
+	if len(out) > maxSourceTags {
+		return nil, fmt.Errorf("at most %d tags per source", maxSourceTags)
+	}
+	return out, nil
+}
+
+// setSourceTags replaces the tags of source `name`.
+func (r *ragSystem) setSourceTags(name string, tags []string) error {
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+	if _, ok := r.getSourceLocked(name); !ok {
+		return fmt.Errorf("unknown source %q", name)
+	}
+	_, err := r.execLocked(fmt.Sprintf("UPDATE sources SET tags = %s WHERE name = %s", sqlText(strings.Join(tags, ",")), sqlText(name)))
+	r.invalidateCacheLocked()
+	r.markDirty()
+	return err
+}
+
+// hasAnyTag reports whether `src` carries one of `tags`.
+func (src sourceInfo) hasAnyTag(tags []string) bool {
+	return slices.ContainsFunc(src.Tags, func(t string) bool { return slices.Contains(tags, t) })
+}
+
+// sourcesTagged returns the names of the sources carrying any of `tags`,
+// an empty (non-nil) list if there are none.
+func (r *ragSystem) sourcesTagged(tags []string) []string {
+	names := []string{}
+	for _, src := range r.listSources() {
+		if src.hasAnyTag(tags) {
+			names = append(names, src.Name)
+		}
+	}
+	return names
+}
+
+// sourceLinks maps the last chunk of each grouped source to the first
+// chunk of the next source in its group (`next`) and that first chunk
+// back to the last one (`prev`). Both are empty without groups.
+func (r *ragSystem) sourceLinks() (prev, next map[chunkKey]chunkKey) {
+	groups := map[string][]sourceInfo{}
+	for _, src := range r.listSources() {
+		if src.Group != "" && src.ChunkCount > 0 {
+			groups[src.Group] = append(groups[src.Group], src)
+		}
+	}
+	prev, next = map[chunkKey]chunkKey{}, map[chunkKey]chunkKey{}
+	for _, members := range groups {
+		sort.SliceStable(members, func(i, j int) bool { return members[i].GroupPos < members[j].GroupPos })
+		for i := 1; i < len(members); i++ {
+			last := chunkKey{members[i-1].Name, members[i-1].ChunkCount - 1}
+			first := chunkKey{members[i].Name, 0}
+			next[last], prev[first] = first, last
+		}
+	}
+	return prev, next
+}
+
+// getSource returns the metadata of source `name`.
+func (r *ragSystem) getSource(name string) (sourceInfo, bool) {
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	return r.getSourceLocked(name)
+}
+
+// chunksHash returns the hex SHA-256 of a source's chunk texts, "" for
+// none. Equal texts chunked with the same chunk size have the same hash.
+func chunksHash(chunks []string) string {
+	if len(chunks) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, c := range chunks {
+		h.Write([]byte(c))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sourceWithHash returns the name of a stored source whose content hash
+// is `hash`.
+func (r *ragSystem) sourceWithHash(hash string) (string, bool) {
+	if hash == "" {
+		return "", false
+	}
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	rs, err := r.execLocked(fmt.Sprintf("SELECT name FROM sources WHERE content_hash = %s ORDER BY name LIMIT 1", sqlText(hash)))
+	if err != nil || rs == nil || len(rs.Rows) == 0 {
+		return "", false
+	}
+	v, _ := tinysql.GetVal(rs.Rows[0], "name")
+	name, _ := v.(string)
+	return name, name != ""
+}
+
+// freeSourceName returns `name`, or "name (2)", "name (3)", … for the
+// first one not taken by a stored source.
+func (r *ragSystem) freeSourceName(name string) string {
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	candidate := name
+	for i := 2; r.articleChunkCountLocked(candidate) > 0; i++ {
+		candidate = fmt.Sprintf("%s (%d)", name, i)
+	}
+	return candidate
+}
+
+func sourceFromRow(row tinysql.Row) sourceInfo {
+	str := func(col string) string {
+		v, _ := tinysql.GetVal(row, col)
+		s, _ := v.(string)
+		return s
+	}
+	num := func(col string) int {
+		v, _ := tinysql.GetVal(row, col)
+		switch n := v.(type) {
+		case int:
+			return n
+		case int64:
+			return int(n)
+		case float64:
+			return int(n)
+		}
+		return 0
+	}
+	info := sourceInfo{
+		Name:         str("name"),
+		sourceOrigin: sourceOrigin{Type: str("origin_type"), Ref: str("origin_ref")},
+		CreatedAt:    str("created_at"),
+		UpdatedAt:    str("updated_at"),
+		ChunkCount:   num("chunk_count"),
+		Chars:        num("chars"),
+		ContentHash:  str("content_hash"),
+		Group:        str("seq_group"),
+		GroupPos:     num("seq_pos"),
+	}
+	if tags := str("tags"); tags != "" {
+		info.Tags = strings.Split(tags, ",")
+	}
+	if at := str("prov_at"); at != "" {
+		info.Provenance = &sourceProvenance{
+			RequestID: str("prov_request"),
+			ChatID:    str("prov_chat"),
+			Tool:      str("prov_tool"),
+			Query:     str("prov_query"),
+			At:        at,
+		}
+	}
+	return info
+}
+
+// backfillSourcesLocked fills an empty sources table from the chunks
+// table, inferring origins from the name prefixes. It must be called
+// with r.dbMu held.
+func (r *ragSystem) backfillSourcesLocked() (int, error) {
+	rs, err := r.execLocked("SELECT COUNT(*) AS cnt FROM sources")
+	if err != nil {
+		return 0, err
+	}
+	if rs != nil && len(rs.Rows) > 0 {
+		if v, _ := tinysql.GetVal(rs.Rows[0], "cnt"); v != nil && fmt.Sprint(v) != "0" {
+			return 0, nil
+		}
+	}
+	rs, err = r.execLocked("SELECT article, content FROM chunks")
+	if err != nil || rs == nil {
+		return 0, err
+	}
+	stats := map[string]*sourceInfo{}
+	var names []string
+	for _, row := range rs.Rows {
+		a, _ := tinysql.GetVal(row, "article")
+		c, _ := tinysql.GetVal(row, "content")
+		name, _ := a.(string)
+		content := contentVal(c)
+		info, ok := stats[name]
+		if !ok {
+			info = &sourceInfo{Name: name, sourceOrigin: inferOrigin(name)}
+			stats[name] = info
+			names = append(names, name)
+		}
+		info.ChunkCount++
+		info.Chars += len(content)
+	}
+	for _, name := range names {
+		if err := r.upsertSourceLocked(*stats[name]); err != nil {
+			return 0, err
+		}
+	}
+	return len(names), nil
+}
+
+// defaultSQLRows and maxSQLRows bound read-only SQL query results.
+const (
+	defaultSQLRows = 50
+	maxSQLRows     = 500
+)
+
+// querySQL runs a read-only SELECT against the knowledge base. Other
+// statement types are rejected, a LIMIT of `maxRows` is added when the
+// query has none, and execution is bounded by `ctx`.
+func (r *ragSystem) querySQL(ctx context.Context, query string, maxRows int) ([]string, [][]string, error) {
+	if maxRows <= 0 {
+		maxRows = defaultSQLRows
+	}
+	if maxRows > maxSQLRows {
+		maxRows = maxSQLRows
+	}
+	query = strings.TrimRight(strings.TrimSpace(query), "; \n\t")
+	// tinySQL parses the first statement and ignores what follows.
+	if hasStatementSeparator(query) {
+		return nil, nil, fmt.Errorf("only a single statement is allowed")
+	}
+	stmt, err := tinysql.ParseSQL(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	// tinySQL keeps its AST types internal, so identify SELECTs by type name.
+	if fmt.Sprintf("%T", stmt) != "*engine.Select" {
+		return nil, nil, fmt.Errorf("only SELECT statements are allowed")
+	}
+	if err := checkSQLNode(reflect.ValueOf(stmt)); err != nil {
+		return nil, nil, err
+	}
+	if limit := reflect.ValueOf(stmt).Elem().FieldByName("Limit"); limit.IsValid() && limit.IsNil() {
+		if stmt, err = tinysql.ParseSQL(fmt.Sprintf("%s LIMIT %d", query, maxRows)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	r.dbMu.RLock()
+	rs, err := tinysql.Execute(ctx, r.db, r.collection, stmt)
+	r.dbMu.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	if rs == nil {
+		return nil, nil, nil
+	}
+	rows := make([][]string, 0, len(rs.Rows))
+	for i, row := range rs.Rows {
+		if i >= maxRows {
+			break
+		}
+		cells := make([]string, len(rs.Cols))
+		for j, col := range rs.Cols {
+			if v, ok := tinysql.GetVal(row, col); ok && v != nil {
+				cells[j] = contentVal(v)
+			}
+		}
+		rows = append(rows, cells)
+	}
+	return rs.Cols, rows, nil
+}
+
+// hasStatementSeparator reports whether `query` has a ";" outside of
+// string literals, quoted identifiers and comments.
+func hasStatementSeparator(query string) bool {
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == ';':
+			return true
+		case c == '\'' || c == '"' || c == '`':
+			// A doubled quote inside a literal is an escaped quote and
+			// simply starts the next literal.
+			j := strings.IndexByte(query[i+1:], c)
+			if j < 0 {
+				return false
+			}
+			i += j + 1
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				return false
+			}
+			i += j
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				return false
+			}
+			i += j + 3
+		}
+	}
+	return false
+}
+
+// sqlFuncs are the functions querySQL allows. tinySQL also has
+// functions that read files (FILE), fetch URLs (HTTP), build tables
+// from data (TABLE_FROM_*) or allocate large values (REPEAT, LPAD);
+// those are rejected, as is anything added by later tinySQL versions.
+var sqlFuncs = map[string]bool{
+	"COUNT": true, "SUM": true, "AVG": true, "MIN": true, "MAX": true, "MEDIAN": true,
+	"FIRST": true, "LAST": true, "MIN_BY": true, "MAX_BY": true, "ARG_MIN": true,
+	"ARG_MAX": true, "ROW_NUMBER": true, "LAG": true, "LEAD": true, "FIRST_VALUE": true,
+	"LAST_VALUE": true, "MOVING_SUM": true, "MOVING_AVG": true, "COALESCE": true,
+	"NVL": true, "IFNULL": true, "NULLIF": true, "ISNULL": true, "IF": true, "IIF": true,
+	"GREATEST": true, "LEAST": true, "CAST": true, "TYPEOF": true, "LENGTH": true,
+	"LEN": true, "CHAR_LENGTH": true, "UPPER": true, "LOWER": true, "TRIM": true,
+	"LTRIM": true, "RTRIM": true, "SUBSTRING": true, "SUBSTR": true, "LEFT": true,
+	"RIGHT": true, "REPLACE": true, "INSTR": true, "LOCATE": true, "POSITION": true,
+	"CONCAT": true, "CONCAT_WS": true, "REVERSE": true, "INITCAP": true, "SPLIT_PART": true,
+	"REGEXP_MATCH": true, "REGEXP_EXTRACT": true, "JSON_GET": true, "JSON_EXTRACT": true,
+	"ABS": true, "ROUND": true, "FLOOR": true, "CEIL": true, "CEILING": true, "MOD": true,
+	"POWER": true, "POW": true, "SQRT": true, "LOG": true, "LN": true, "EXP": true,
+	"SIGN": true, "TRUNCATE": true, "TRUNC": true, "NOW": true, "CURRENT_DATE": true,
+	"CURRENT_TIME": true, "CURRENT_TIMESTAMP": true, "DATE": true, "TIME": true,
+	"YEAR": true, "MONTH": true, "DAY": true, "HOUR": true, "MINUTE": true, "SECOND": true,
+	"STRFTIME": true, "DATEDIFF": true, "DATE_TRUNC": true, "VEC_DIM": true,
+	"VEC_NORM": true, "VEC_FROM_JSON": true, "VEC_TO_JSON": true,
+	"VEC_COSINE_SIMILARITY": true, "VEC_COSINE_DISTANCE": true,
+	"VEC_EUCLIDEAN_DISTANCE": true, "VEC_DOT": true,
+}
+
+// checkSQLNode walks the parsed statement `v` and rejects functions
+// outside sqlFuncs, table functions and tables other than chunks.
+// Subqueries, joins and CTEs are walked as well.
+func checkSQLNode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return checkSQLNode(v.Elem())
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := checkSQLNode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		switch v.Type().Name() {
+		case "FuncCall":
+			if name := strings.ToUpper(v.FieldByName("Name").String()); !sqlFuncs[name] {
+				return fmt.Errorf("function %s is not allowed", name)
+			}
+		case "TableFuncCall":
+			return fmt.Errorf("table function %s is not allowed", strings.ToUpper(v.FieldByName("Name").String()))
+		case "FromItem":
+			if t := v.FieldByName("Table").String(); t != "" && !strings.EqualFold(t, "chunks") {
+				return fmt.Errorf("only the chunks table can be queried, not %q", t)
+			}
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if err := checkSQLNode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sqlMarkdownTable renders query results as a markdown table. Long cell
+// values (e.g. embeddings) are shortened.
+func sqlMarkdownTable(cols []string, rows [][]string) string {
+	if len(cols) == 0 {
+		return "(keine Spalten)"
+	}
+	cell := func(v string) string {
+		return truncate(strings.NewReplacer("|", `\|`, "\n", " ", "\r", " ").Replace(v), 120)
+	}
+	var b strings.Builder
+	b.WriteString("| " + strings.Join(cols, " | ") + " |\n")
+	b.WriteString("|" + strings.Repeat("---|", len(cols)) + "\n")
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, v := range row {
+			cells[i] = cell(v)
+		}
+		b.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+	}
+	fmt.Fprintf(&b, "\n(%d Zeilen)\n", len(rows))
+	return b.String()
+}
+
+// ─────────────────────────────────────────────────────────────────────────────
+// Chat history (in-memory)
+// ─────────────────────────────────────────────────────────────────────────────
+
+// chatMessage represents a single message in a conversation timeline.
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	Time    string `json:"time"`
+	// Citations resolves the [n] markers in an assistant answer.
+	Citations  []citation  `json:"citations,omitempty"`
+	Confidence *confidence `json:"confidence,omitempty"`
+	// Error is set when the answer failed; Content then holds what was
+	// streamed before the failure, if anything.
+	Error *askError `json:"error,omitempty"`
+	// DebugFull records the exact LM input of an answer requested with
+	// "debug_full".
+	DebugFull *debugFull `json:"debug_full,omitempty"`
+	// Timings measures the generation of an assistant answer.
+	Timings *llmTimings `json:"timings,omitempty"`
+	// Retrieval summarizes the retrieval behind an assistant answer.
+	Retrieval *retrievalRecord `json:"retrieval,omitempty"`
+	// Refused is why strict grounding refused to answer: "no_context"
+	// or "low_score" (see groundingGap).
+	Refused string `json:"refused,omitempty"`
+}
+
+// conversation stores metadata and the message history for a chat.
+type conversation struct {
+	ID       string        `json:"id"`
+	Title    string        `json:"title"`
+	Messages []chatMessage `json:"messages"`
+	Created  string        `json:"created"`
+	Updated  string        `json:"updated"`
+	Persona  string        `json:"persona_id,omitempty"`
+	// Collection names the knowledge base the chat retrieves from;
+	// empty means the default collection.
+	Collection string `json:"collection,omitempty"`
+	// ImportID is the original conversation id for imported chats and
+	// is used to detect duplicate imports.
+	ImportID string `json:"import_id,omitempty"`
+	// ToolResults holds outputs of ephemeral tools. They are added to the
+	// context of later questions in this chat instead of being embedded.
+	ToolResults []toolResult `json:"tool_results,omitempty"`
+	// Focus points the next question's retrieval at what the tools of
+	// the last answer fetched; it is cleared once used.
+	Focus *retrievalFocus `json:"focus,omitempty"`
+}
+
+// retrievalFocus is the tool query and the sources of the tool results
+// of one answer.
+type retrievalFocus struct {
+	Tool    string   `json:"tool"`
+	Query   string   `json:"query"`
+	Sources []string `json:"sources"`
+}
+
+// toolResult is the output of one tool execution kept on a conversation.
+type toolResult struct {
+	Tool   string `json:"tool"`
+	Query  string `json:"query"`
+	Source string `json:"source"`
+	Output string `json:"output"`
+	Time   string `json:"time"`
+}
+
+// maxChatToolResults caps how many ephemeral tool results a conversation keeps.
+const maxChatToolResults = 10
+
+// chatStore manages in-memory conversations and persists them to disk
+// when a path is provided.
+type chatStore struct {
+	mu    sync.Mutex
+	chats map[string]*conversation
+	order []string
+	path  string
+	// questions indexes the embedded user questions of all chats for
+	// similarQuestion; it is persisted to questionsPath.
+	questions     []questionEntry
+	questionsPath string
+}
+
+// newChatStore initializes a chatStore and loads persisted chats if available.
+func newChatStore(path string) *chatStore {
+	cs := &chatStore{chats: make(map[string]*conversation), path: path}
+	if path != "" {
+		if err := cs.load(); err != nil {
+			log.Printf("WARN: konnte Chats nicht laden (%v)", err)
+		}
+		cs.questionsPath = strings.TrimSuffix(path, ".json") + ".questions.jsonl"
+		if err := cs.loadQuestions(); err != nil {
+			log.Printf("WARN: konnte Fragen-Index nicht laden (%v)", err)
+		}
+	}
+	return cs
+}
+
+// create makes a new conversation, persists it, and returns it.
+func (cs *chatStore) create(title, persona string) *conversation {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	now := time.Now().Format(time.RFC3339)
+	id := cs.newIDLocked()
+	c := &conversation{ID: id, Title: title, Created: now, Updated: now, Persona: persona}
+	cs.chats[id] = c
+	cs.order = append(cs.order, id)
+	_ = cs.saveLocked()
+	return c
+}
+
+// newIDLocked returns an unused conversation ID.
+func (cs *chatStore) newIDLocked() string {
+	return unusedID("chat", func(id string) bool {
+		_, taken := cs.chats[id]
+		return taken
+	})
+}
+
+// get returns a conversation by id or nil if not found.
+func (cs *chatStore) get(id string) *conversation {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.chats[id]
+}
+
+// addMessage appends a message to the conversation and persists the store.
+func (cs *chatStore) addMessage(id, role, content string) {
+	cs.appendMessage(id, chatMessage{Role: role, Content: content})
+}
+
+// appendMessage appends `m`, stamped with the current time, and
+// persists the store.
+func (cs *chatStore) appendMessage(id string, m chatMessage) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.chats[id]
+	if !ok {
+		return
+	}
+	now := time.Now().Format(time.RFC3339)
+	m.Time = now
+	c.Messages = append(c.Messages, m)
+	c.Updated = now
+	if c.Title == "" && m.Role == "user" {
+		c.Title = truncateTitle(m.Content)
+	}
+	_ = cs.saveLocked()
+}
+
+// addToolResult stores an ephemeral tool result on the conversation,
+// keeping only the most recent maxChatToolResults entries.
+func (cs *chatStore) addToolResult(id string, tr toolResult) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.chats[id]
+	if !ok {
+		return false
+	}
+	if tr.Time == "" {
+		tr.Time = time.Now().Format(time.RFC3339)
+	}
+	c.ToolResults = append(c.ToolResults, tr)
+	if len(c.ToolResults) > maxChatToolResults {
+		c.ToolResults = c.ToolResults[len(c.ToolResults)-maxChatToolResults:]
+	}
+	_ = cs.saveLocked()
+	return true
+}
+
+// addFocus records that tool `tool` fetched `sources` for `query`. Tools
+// of the same answer add to the sources; the last query wins.
+func (cs *chatStore) addFocus(id, tool, query string, sources []string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.chats[id]
+	if !ok || len(sources) == 0 {
+		return
+	}
+	if c.Focus == nil {
+		c.Focus = &retrievalFocus{}
+	}
+	c.Focus.Tool, c.Focus.Query = tool, query
+	for _, src := range sources {
+		if !slices.Contains(c.Focus.Sources, src) {
+			c.Focus.Sources = append(c.Focus.Sources, src)
+		}
+	}
+	_ = cs.saveLocked()
+}
+
+// takeFocus returns the focus of a conversation and clears it, or nil
+// if it has none.
+func (cs *chatStore) takeFocus(id string) *retrievalFocus {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.chats[id]
+	if !ok || c.Focus == nil {
+		return nil
+	}
+	f := c.Focus
+	c.Focus = nil
+	_ = cs.saveLocked()
+	return f
+}
+
+// toolResultsContext renders the last `n` tool results of a conversation
+// as a context block, or "" if there are none.
+func (cs *chatStore) toolResultsContext(id string, n int) string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.chats[id]
+	if !ok || len(c.ToolResults) == 0 {
+		return ""
+	}
+	list := c.ToolResults
+	if len(list) > n {
+		list = list[len(list)-n:]
+	}
+	var b strings.Builder
+	for _, tr := range list {
+		fmt.Fprintf(&b, "[Tool-Ergebnis %s]\n%s\n\n", tr.Source, truncate(tr.Output, 2000))
+	}
+	return b.String()
+}
+
+// setPersona assigns a persona to an existing conversation and saves it.
+func (cs *chatStore) setPersona(id, persona string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.chats[id]
+	if !ok {
+		return
+	}
+	c.Persona = persona
+	c.Updated = time.Now().Format(time.RFC3339)
+	_ = cs.saveLocked()
+}
+
+// setCollection switches the knowledge base of an existing conversation.
+func (cs *chatStore) setCollection(id, collection string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.chats[id]
+	if !ok {
+		return
+	}
+	c.Collection = collection
+	c.Updated = time.Now().Format(time.RFC3339)
+	_ = cs.saveLocked()
+}
+
+// list returns conversations in reverse chronological order.
+func (cs *chatStore) list() []conversation {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	result := make([]conversation, 0, len(cs.order))
+	for i := len(cs.order) - 1; i >= 0; i-- {
+		if c, ok := cs.chats[cs.order[i]]; ok {
+			result = append(result, *c)
+		}
+	}
+	return result
+}
+
+// remove deletes a conversation and persists the updated store.
+func (cs *chatStore) remove(id string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.chats[id]; !ok {
+		return false
+	}
+	delete(cs.chats, id)
+	for i, oid := range cs.order {
+		if oid == id {
+			cs.order = append(cs.order[:i], cs.order[i+1:]...)
+			break
+		}
+	}
+	_ = cs.saveLocked()
+	n := len(cs.questions)
+	cs.questions = slices.DeleteFunc(cs.questions, func(q questionEntry) bool { return q.ChatID == id })
+	if len(cs.questions) != n {
+		if err := cs.saveQuestionsLocked(); err != nil {
+			log.Printf("WARN: saving question index failed: %v", err)
+		}
+	}
+	return true
+}
+
+// saveLocked writes the chat store payload to disk and must be called
+// with `cs.mu` held.
+func (cs *chatStore) saveLocked() error {
+	if cs.path == "" {
+		return nil
+	}
+	payload := struct {
+		Chats []*conversation `json:"chats"`
+	}{}
+	for _, id := range cs.order {
+		if c, ok := cs.chats[id]; ok {
+			payload.Chats = append(payload.Chats, c)
+		}
+	}
+	b, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := cs.path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cs.path)
+}
+
+// load reads persisted chats from disk into the in-memory store.
+func (cs *chatStore) load() error {
+	data, err := os.ReadFile(cs.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var payload struct {
+		Chats []conversation `json:"chats"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.chats = make(map[string]*conversation)
+	cs.order = nil
+	for _, c := range payload.Chats {
+		copyC := c
+		cs.chats[c.ID] = &copyC
+		cs.order = append(cs.order, c.ID)
+	}
+	return nil
+}
+
+// selectHistory walks `history` backwards and returns the most recent
+// messages whose estimated tokens fit into `budget`, together with
+// their token estimate. User/assistant pairs are never split and the
+// last exchange is always included, even if it exceeds the budget.
+func selectHistory(history []chatMessage, budget int) ([]chatMessage, int) {
+	start := len(history)
+	tokens := 0
+	for start > 0 {
+		// A unit is an assistant reply plus the user message before it,
+		// or a single message otherwise.
+		unitStart := start - 1
+		if history[unitStart].Role == "assistant" && unitStart > 0 && history[unitStart-1].Role == "user" {
+			unitStart--
+		}
+		unitTokens := 0
+		for _, m := range history[unitStart:start] {
+			unitTokens += estimateTokens(m.Content)
+		}
+		if start < len(history) && tokens+unitTokens > budget {
+			break
+		}
+		tokens += unitTokens
+		start = unitStart
+	}
+	return history[start:], tokens
+}
+
+// chatImportSource is the source name of the indexed answers of an
+// imported conversation. The ID keeps conversations with the same
+// title apart.
+func chatImportSource(c conversation) string {
+	id := c.ImportID
+	if id == "" {
+		id = c.ID
+	}
+	return fmt.Sprintf("chat-import:%s (%s)", c.Title, id)
+}
+
+// importConversations adds already converted conversations to the store.
+// Conversations whose ID or import ID is already known are skipped. It
+// returns the added conversations and the number of skipped ones.
+func (cs *chatStore) importConversations(list []conversation) ([]conversation, int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	known := make(map[string]bool, len(cs.chats)*2)
+	for id, c := range cs.chats {
+		known[id] = true
+		if c.ImportID != "" {
+			known[c.ImportID] = true
+		}
+	}
+	var added []conversation
+	skipped := 0
+	for _, c := range list {
+		key := c.ImportID
+		if key == "" {
+			key = c.ID
+		}
+		if key == "" || known[key] || known[c.ID] {
+			skipped++
+			continue
+		}
+		if c.ID == "" {
+			c.ID = cs.newIDLocked()
+		}
+		copyC := c
+		cs.chats[c.ID] = &copyC
+		cs.order = append(cs.order, c.ID)
+		known[key] = true
+		known[c.ID] = true
+		added = append(added, c)
+	}
+	if len(added) > 0 {
+		_ = cs.saveLocked()
+	}
+	return added, skipped
+}
+
+// ── Retrieval insights ─────────────────────────────────────────────
+
+// retrievalRecord is the summary of the retrieval behind an assistant
+// answer, kept so that weak retrievals can be reviewed later.
+type retrievalRecord struct {
+	Decision     string  `json:"decision"`
+	TopScore     float64 `json:"top_score"`
+	UsedK        int     `json:"used_k"`
+	ContextChars int     `json:"context_chars"`
+	// Sources are the articles of the context's hits, best first;
+	// Nearest are the articles of the best candidates, used or not.
+	Sources []string `json:"sources,omitempty"`
+	Nearest []string `json:"nearest,omitempty"`
+	// Query is what was searched if it differs from the question.
+	Query string `json:"query,omitempty"`
+}
+
+// newRetrievalRecord summarizes `di` for the chat; nil without one.
+func newRetrievalRecord(di *debugInfo, contextChars int, query string) *retrievalRecord {
+	if di == nil {
+		return nil
+	}
+	rec := &retrievalRecord{Decision: di.Decision, TopScore: di.TopScore, UsedK: di.UsedK, ContextChars: contextChars, Nearest: di.TopArticles, Query: query}
+	for _, c := range di.Chunks {
+		if !c.IsNeighbor && !slices.Contains(rec.Sources, c.Article) {
+			rec.Sources = append(rec.Sources, c.Article)
+		}
+	}
+	return rec
+}
+
+// Defaults and limits of GET /api/insights/low-recall.
+const (
+	defaultLowRecallDays  = 30
+	defaultLowRecallLimit = 200
+	maxLowRecallLimit     = 1000
+)
+
+// lowRecallQuestion is a question whose retrieval scored low.
+type lowRecallQuestion struct {
+	ChatID     string           `json:"chat_id"`
+	ChatTitle  string           `json:"chat_title"`
+	Collection string           `json:"collection"`
+	Question   string           `json:"question"`
+	Time       string           `json:"time"`
+	Retrieval  *retrievalRecord `json:"retrieval"`
+}
+
+// lowRecallGroup collects the low-recall questions that drew on one
+// source; Source is "" for questions answered without context.
+type lowRecallGroup struct {
+	Source    string              `json:"source"`
+	Count     int                 `json:"count"`
+	Questions []lowRecallQuestion `json:"questions"`
+}
+
+// lowRecallQuestions returns the questions answered since `since` whose
+// best search candidate scored below `threshold`, newest first, at most
+// `limit`. Exact article matches never count; `collection` ("" for
+// all) restricts the chats.
+func (cs *chatStore) lowRecallQuestions(threshold float64, since time.Time, collection string, limit int) []lowRecallQuestion {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var out []lowRecallQuestion
+	for _, c := range cs.chats {
+		col := cmp.Or(c.Collection, defaultCollection)
+		if collection != "" && col != collection {
+			continue
+		}
+		question := ""
+		for _, m := range c.Messages {
+			if m.Role == "user" {
+				question = m.Content
+				continue
+			}
+			rec := m.Retrieval
+			if rec == nil || rec.Decision == "article_specific" || rec.TopScore >= threshold {
+				continue
+			}
+			if t, err := time.Parse(time.RFC3339, m.Time); err != nil || t.Before(since) {
+				continue
+			}
+			out = append(out, lowRecallQuestion{ChatID: c.ID, ChatTitle: c.Title, Collection: col, Question: question, Time: m.Time, Retrieval: rec})
+		}
+	}
+	slices.SortFunc(out, func(a, b lowRecallQuestion) int {
+		return cmp.Or(strings.Compare(b.Time, a.Time), strings.Compare(a.ChatID, b.ChatID))
+	})
+	return out[:min(limit, len(out))]
+}
+
+// groupLowRecall groups `questions` by the sources of their context. A
+// question appears in the group of each of its sources; groups with
+// the most questions come first.
+func groupLowRecall(questions []lowRecallQuestion) []lowRecallGroup {
+	groups := map[string]*lowRecallGroup{}
+	for _, q := range questions {
+		sources := q.Retrieval.Sources
+		if len(sources) == 0 {
+			sources = []string{""}
+		}
+		for _, src := range sources {
+			g := groups[src]
+			if g == nil {
+				g = &lowRecallGroup{Source: src}
+				groups[src] = g
+			}
+			g.Count++
+			g.Questions = append(g.Questions, q)
+		}
+	}
+	out := make([]lowRecallGroup, 0, len(groups))
+	for _, g := range groups {
+		out = append(out, *g)
+	}
+	slices.SortFunc(out, func(a, b lowRecallGroup) int {
+		return cmp.Or(b.Count-a.Count, strings.Compare(a.Source, b.Source))
+	})
+	return out
+}
+
+// ── Similar questions ──────────────────────────────────────────────
+
+// defaultSimilarThreshold is the similarity from which an earlier
+// question counts as the same question.
+const defaultSimilarThreshold = 0.92
+
+// maxSimilarAnswerChars limits the answer snippet of a similar question.
+const maxSimilarAnswerChars = 300
+
+// questionEntry is the embedding of one user question of a chat.
+type questionEntry struct {
+	ChatID string    `json:"chat_id"`
+	Msg    int       `json:"msg"`   // index of the question in the chat's messages
+	Model  string    `json:"model"` // embedding model of Vec
+	Vec    []float64 `json:"vec"`
+}
+
+// similarQuestion is an earlier question from another chat that closely
+// matches the current one, with the start of its answer.
+type similarQuestion struct {
+	ChatID   string  `json:"chat_id"`
+	Title    string  `json:"title"`
+	Question string  `json:"question"`
+	Answer   string  `json:"answer,omitempty"`
+	Score    float64 `json:"score"`
+}
+
+// similarQuestion returns the indexed question most similar to `vec`
+// (embedded with `model`) outside chat `chatID`, if it reaches
+// `threshold`.
+func (cs *chatStore) similarQuestion(chatID, model string, vec []float64, threshold float64) (similarQuestion, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var best *questionEntry
+	bestScore := threshold
+	for i := range cs.questions {
+		q := &cs.questions[i]
+		if q.ChatID == chatID || q.Model != model || len(q.Vec) != len(vec) {
+			continue
+		}
+		if score := cosineSimilarity(q.Vec, vec); score >= bestScore {
+			best, bestScore = q, score
+		}
+	}
+	if best == nil {
+		return similarQuestion{}, false
+	}
+	c, ok := cs.chats[best.ChatID]
+	if !ok || best.Msg >= len(c.Messages) {
+		return similarQuestion{}, false
+	}
+	m := similarQuestion{ChatID: c.ID, Title: c.Title, Question: c.Messages[best.Msg].Content, Score: bestScore}
+	if next := best.Msg + 1; next < len(c.Messages) && c.Messages[next].Role == "assistant" {
+		m.Answer = truncate(c.Messages[next].Content, maxSimilarAnswerChars)
+	}
+	return m, true
+}
+
+// indexQuestion records `vec` as the embedding of the latest user
+// message of chat `chatID` and appends it to the index file.
+func (cs *chatStore) indexQuestion(chatID, model string, vec []float64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.chats[chatID]
+	if !ok {
+		return
+	}
+	msg := len(c.Messages) - 1
+	for msg >= 0 && c.Messages[msg].Role != "user" {
+		msg--
+	}
+	if msg < 0 {
+		return
+	}
+	q := questionEntry{ChatID: chatID, Msg: msg, Model: model, Vec: vec}
+	cs.questions = append(cs.questions, q)
+	if cs.questionsPath == "" {
+		return
+	}
+	b, err := json.Marshal(q)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(cs.questionsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+			_, err = f.Write(append(b, '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("WARN: saving question index failed: %v", err)
+	}
+}
+
+// saveQuestionsLocked rewrites the question index file and must be
+// called with `cs.mu` held.
+func (cs *chatStore) saveQuestionsLocked() error {
+	if cs.questionsPath == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, q := range cs.questions {
+		if err := enc.Encode(q); err != nil {
+			return err
+		}
+	}
+	tmp := cs.questionsPath + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cs.questionsPath)
+}
+
+// loadQuestions reads the question index, skipping entries of chats
+// that no longer exist.
+func (cs *chatStore) loadQuestions() error {
+	f, err := os.Open(cs.questionsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for sc.Scan() {
+		var q questionEntry
+		if json.Unmarshal(sc.Bytes(), &q) != nil || cs.chats[q.ChatID] == nil {
+			continue
+		}
+		cs.questions = append(cs.questions, q)
+	}
+	return sc.Err()
+}
+
+// openAIExportConversation models one entry of the conversations.json
+// file contained in ChatGPT / OpenAI data exports.
+type openAIExportConversation struct {
+	ID             string  `json:"id"`
+	ConversationID string  `json:"conversation_id"`
+	Title          string  `json:"title"`
+	CreateTime     float64 `json:"create_time"`
+	UpdateTime     float64 `json:"update_time"`
+	CurrentNode    string  `json:"current_node"`
+	Mapping        map[string]struct {
+		Parent   string   `json:"parent"`
+		Children []string `json:"children"`
+		Message  *struct {
+			Author struct {
+				Role string `json:"role"`
+			} `json:"author"`
+			CreateTime float64 `json:"create_time"`
+			Content    struct {
+				Parts []any `json:"parts"`
+			} `json:"content"`
+		} `json:"message"`
+	} `json:"mapping"`
+}
+
+// exportTime converts a fractional unix timestamp from an export into
+// RFC3339, falling back to `fallback` when the timestamp is missing.
+func exportTime(ts float64, fallback string) string {
+	if ts <= 0 {
+		return fallback
+	}
+	sec := int64(ts)
+	nsec := int64((ts - float64(sec)) * 1e9)
+	return time.Unix(sec, nsec).Format(time.RFC3339)
+}
+
+// convertOpenAIConversation turns an exported mapping tree into a
+// conversation by following the main branch (root → current_node).
+// Only user and assistant text messages are kept.
+func convertOpenAIConversation(oc openAIExportConversation) (conversation, error) {
+	importID := oc.ConversationID
+	if importID == "" {
+		importID = oc.ID
+	}
+	if importID == "" {
+		return conversation{}, fmt.Errorf("missing conversation id")
+	}
+	if len(oc.Mapping) == 0 {
+		return conversation{}, fmt.Errorf("empty mapping")
+	}
+
+	// Without current_node, follow the last child from the root.
+	leaf := oc.CurrentNode
+	if _, ok := oc.Mapping[leaf]; !ok {
+		leaf = ""
+		for id, n := range oc.Mapping {
+			if _, hasParent := oc.Mapping[n.Parent]; !hasParent {
+				leaf = id
+				break
+			}
+		}
+		for leaf != "" && len(oc.Mapping[leaf].Children) > 0 {
+			leaf = oc.Mapping[leaf].Children[len(oc.Mapping[leaf].Children)-1]
+		}
+	}
+
+	var branch []string
+	seen := make(map[string]bool)
+	for id := leaf; id != "" && !seen[id]; id = oc.Mapping[id].Parent {
+		if _, ok := oc.Mapping[id]; !ok {
+			break
+		}
+		seen[id] = true
+		branch = append(branch, id)
+	}
+
+	created := exportTime(oc.CreateTime, time.Now().Format(time.RFC3339))
+	c := conversation{
+		ImportID: importID,
+		Title:    strings.TrimSpace(oc.Title),
+		Created:  created,
+		Updated:  exportTime(oc.UpdateTime, created),
+	}
+	for i := len(branch) - 1; i >= 0; i-- {
+		msg := oc.Mapping[branch[i]].Message
+		if msg == nil {
+			continue
+		}
+		role := msg.Author.Role
+		if role != "user" && role != "assistant" {
+			continue
+		}
+		var parts []string
+		for _, p := range msg.Content.Parts {
+			if ps, ok := p.(string); ok && strings.TrimSpace(ps) != "" {
+				parts = append(parts, ps)
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		c.Messages = append(c.Messages, chatMessage{
+			Role:    role,
+			Content: strings.Join(parts, "\n"),
+			Time:    exportTime(msg.CreateTime, created),
+		})
+	}
+	if len(c.Messages) == 0 {
+		return conversation{}, fmt.Errorf("no user or assistant messages")
+	}
+	if c.Title == "" {
+		c.Title = truncateTitle(c.Messages[0].Content)
+	}
+	return c, nil
+}
+
+// truncateTitle shortens `t` to a chat title of at most 60 characters.
+func truncateTitle(t string) string {
+	return truncate(t, 60)
+}
+
+// ─────────────────────────────────────────────────────────────────────────────
+// Answer cache
+// ─────────────────────────────────────────────────────────────────────────────
+
+// answerKey identifies a cacheable answer. Version is the knowledge-base
+// version, so any import or deletion invalidates all entries.
+type answerKey struct {
+	Question   string
+	Collection string
+	Model      string
+	Persona    string
+	Deep       bool
+	Strict     bool
+	Tags       string
+	Version    uint64
+}
+
+// cachedAnswer is a stored answer with what the client needs to show it.
+type cachedAnswer struct {
+	Answer     string
+	Citations  []citation
+	Confidence *confidence
+	Stored     time.Time
+}
+
+// answerCache keeps answers for the current knowledge-base version.
+type answerCache struct {
+	mu      sync.Mutex
+	version uint64
+	entries map[answerKey]cachedAnswer
+	hits    int64
+	misses  int64
+}
+
+var answers = &answerCache{entries: map[answerKey]cachedAnswer{}}
+
+// normalizeQuestion folds case, whitespace and trailing punctuation so
+// trivially different spellings share a cache entry.
+func normalizeQuestion(q string) string {
+	q = strings.Join(strings.Fields(strings.ToLower(q)), " ")
+	return strings.TrimRight(q, "?!.… ")
+}
+
+// syncLocked drops all entries when the knowledge base changed. It
+// reports false for keys of an older version, which must not be stored.
+func (c *answerCache) syncLocked(version uint64) bool {
+	if version < c.version {
+		return false
+	}
+	if version > c.version {
+		clear(c.entries)
+		c.version = version
+	}
+	return true
+}
+
+// get returns a cached answer younger than `ttl`.
+func (c *answerCache) get(k answerKey, ttl time.Duration) (cachedAnswer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[k]
+	if !c.syncLocked(k.Version) {
+		ok = false
+	}
+	if ok && time.Since(e.Stored) > ttl {
+		delete(c.entries, k)
+		ok = false
+	}
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return e, ok
+}
+
+// put stores an answer, evicting the oldest entries beyond `size`.
+func (c *answerCache) put(k answerKey, e cachedAnswer, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.syncLocked(k.Version) {
+		return
+	}
+	e.Stored = time.Now()
+	c.entries[k] = e
+	for len(c.entries) > size {
+		var oldest answerKey
+		first := true
+		for key, v := range c.entries {
+			if first || v.Stored.Before(c.entries[oldest].Stored) {
+				oldest, first = key, false
+			}
+		}
+		delete(c.entries, oldest)
+	}
+}
+
+// stats reports cache counters for /api/stats.
+func (c *answerCache) stats() map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]any{"entries": len(c.entries), "hits": c.hits, "misses": c.misses}
+}
+
+// ─────────────────────────────────────────────────────────────────────────────
+// Web server + helper endpoints
+// ─────────────────────────────────────────────────────────────────────────────
+
+// mustJSON encodes `v` to a compact JSON string, ignoring errors.
+func mustJSON(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// SSE token batching: text is sent once this many bytes are pending or
+// the oldest pending byte is this old, whichever comes first.
+const (
+	sseBatchBytes = 64
+	sseBatchDelay = 40 * time.Millisecond
+)
+
+// askRetrievalTimeout bounds the retrieval phase of /api/ask: embedding
+// the question, the vector search and the LM's retrieval decision.
+const askRetrievalTimeout = 2 * time.Minute
+
+// Answers for an empty knowledge base: emptyKBNote is added to the
+// system prompt, emptyKBAnswer is the whole offline answer.
+const (
+	emptyKBNote   = "\n\nWISSENSBASIS: Es sind noch keine Quellen gespeichert, der Kontext ist leer. Antworte aus deinem allgemeinen Wissen, sag dazu, dass die Antwort nicht auf Dokumenten beruht, und schlage vor, Quellen hinzuzufügen.\n"
+	emptyKBAnswer = "📚 **Die Wissensbasis ist leer.** Füge zuerst Quellen hinzu (Wikipedia-Artikel, URLs, Texte, Dateien oder Ordner unter „Daten hinzufügen“), dann kann ich offline daraus antworten."
+	// noTaggedNote and noTaggedAnswer replace them when the tag filter
+	// of the request matches no source; %s are the tags.
+	noTaggedNote   = "\n\nWISSENSBASIS: Keine Quelle trägt die Tags %s, der Kontext ist leer. Antworte aus deinem allgemeinen Wissen, sag dazu, dass die Antwort nicht auf Dokumenten beruht, weil keine Quelle diese Tags trägt.\n"
+	noTaggedAnswer = "🏷️ **Keine Quelle trägt die Tags %s.** Vergib sie in der Quellenliste oder frage ohne Tag-Filter."
+)
+
+// strictMisses is how many near misses a strict-grounding refusal lists.
+const strictMisses = 3
+
+// refusalLocale is the strict-grounding refusal in one language.
+type refusalLocale struct {
+	text, nearest, hint string
+}
+
+// strictRefusals are the refusals by language; others use "en".
+var strictRefusals = map[string]refusalLocale{
+	"de": {"Dazu steht nichts in der Wissensbasis.", "Am nächsten kamen:", "Füge passende Quellen hinzu, damit ich die Frage beantworten kann."},
+	"en": {"This is not in the knowledge base.", "The nearest matches were:", "Add sources that cover it so that I can answer the question."},
+	"fr": {"Cela ne figure pas dans la base de connaissances.", "Les résultats les plus proches :", "Ajoutez des sources sur ce sujet pour que je puisse répondre à la question."},
+	"es": {"Esto no está en la base de conocimientos.", "Los resultados más cercanos fueron:", "Añade fuentes sobre el tema para que pueda responder a la pregunta."},
+	"it": {"Questo non è nella base di conoscenza.", "I risultati più vicini erano:", "Aggiungi fonti sull'argomento perché io possa rispondere alla domanda."},
+}
+
+// groundingGap reports why the context of `di` cannot ground an answer
+// in strict mode: "no_context" without retrieved chunks, "low_score"
+// when no hit reaches `relaxed`, and "" otherwise. Chunks of exact
+// article matches (score -1) always ground.
+func groundingGap(di *debugInfo, relaxed float64) string {
+	found := false
+	top := 0.0
+	if di != nil {
+		for _, c := range di.Chunks {
+			if c.IsNeighbor || strings.TrimSpace(c.Content) == "" {
+				continue
+			}
+			if c.Score < 0 {
+				return ""
+			}
+			top = max(top, c.Score)
+			found = true
+		}
+	}
+	switch {
+	case !found:
+		return "no_context"
+	case top < relaxed:
+		return "low_score"
+	}
+	return ""
+}
+
+// nearestMisses returns the best `n` candidates of `di`, one per
+// article. Rejected candidates keep their reason; hits that were in the
+// context but too weak to ground an answer have reason "in_context".
+func nearestMisses(di *debugInfo, n int) []rejectedChunk {
+	if di == nil {
+		return nil
+	}
+	cands := slices.Clone(di.RejectedChunks)
+	for _, c := range di.Chunks {
+		if !c.IsNeighbor {
+			cands = append(cands, rejectedChunk{Article: c.Article, ChunkIdx: c.ChunkIdx, Score: c.Score, Reason: "in_context"})
+		}
+	}
+	sort.SliceStable(cands, func(i, j int) bool { return cands[i].Score > cands[j].Score })
+	var out []rejectedChunk
+	for _, c := range cands {
+		if len(out) == n {
+			break
+		}
+		if !slices.ContainsFunc(out, func(o rejectedChunk) bool { return o.Article == c.Article }) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// strictRefusal renders the refusal in language `lang`, listing `misses`.
+func strictRefusal(lang string, misses []rejectedChunk) string {
+	loc, ok := strictRefusals[lang]
+	if !ok {
+		loc = strictRefusals["en"]
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "📚 **%s**\n\n", loc.text)
+	if len(misses) > 0 {
+		b.WriteString(loc.nearest + "\n")
+		for _, m := range misses {
+			fmt.Fprintf(&b, "- %s (Chunk %d, Score %.2f)\n", m.Article, m.ChunkIdx, m.Score)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(loc.hint)
+	return b.String()
+}
+
+// ── Offline answers ────────────────────────────────────────────────
+
+const (
+	// offlineAnswerBudget is the most characters of an extractive
+	// offline answer, without the source footnotes.
+	offlineAnswerBudget = 1500
+	// offlineMaxSentences caps the sentences of an offline answer.
+	offlineMaxSentences = 8
+	offlineHeader       = "📚 **Offline-Antwort** (ohne LLM, passende Sätze aus den Dokumenten)\n"
+)
+
+// splitSentences splits `text` at line breaks and after ".", "!" or "?"
+// followed by white space. A period after a number of up to two digits
+// ("2. Oktober") or after a short abbreviation ("z. B.", "Dr.") does
+// not end a sentence.
+func splitSentences(text string) []string {
+	rs := []rune(text)
+	var out []string
+	start := 0
+	flush := func(end int) {
+		if s := strings.Join(strings.Fields(string(rs[start:end])), " "); s != "" {
+			out = append(out, s)
+		}
+		start = end
+	}
+	for i, r := range rs {
+		switch r {
+		case '\n':
+			flush(i)
+		case '.', '!', '?':
+			if i+1 < len(rs) && !unicode.IsSpace(rs[i+1]) {
+				continue
+			}
+			if r == '.' && isAbbreviation(rs[start:i]) {
+				continue
+			}
+			flush(i + 1)
+		}
+	}
+	flush(len(rs))
+	return out
+}
+
+// isAbbreviation reports whether the last word of `rs` followed by a
+// period is more likely an ordinal or abbreviation than a sentence end.
+func isAbbreviation(rs []rune) bool {
+	i := len(rs)
+	for i > 0 && !unicode.IsSpace(rs[i-1]) {
+		i--
+	}
+	w := rs[i:]
+	if len(w) == 0 || len(w) > 2 {
+		return false
+	}
+	return unicode.IsDigit(w[0]) || unicode.IsUpper(w[0]) || len(w) == 1
+}
+
+// queryTerms returns the lower-cased words of `s` with at least two
+// letters or digits, without the stopwords of langStopwords.
+func queryTerms(s string) []string {
+	var terms []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if _, stop := stopwordLang[w]; utf8.RuneCountInString(w) >= 2 && !stop && !slices.Contains(terms, w) {
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// termsMatch reports whether two terms are equal or, when both have at
+// least four characters, one is a prefix of the other ("Einwohner",
+// "Einwohnern").
+func termsMatch(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	return utf8.RuneCountInString(a) >= 4 && strings.HasPrefix(b, a)
+}
+
+// extractiveAnswer answers `question` from `chunks` without a model:
+// it scores every sentence by the question terms it contains, each
+// weighted by how rare it is among the sentences, keeps those scoring
+// at least half the best, adds a tenth of the chunk's similarity score
+// and picks the best ones that fit into
+// `budget` characters (at most offlineMaxSentences). They are grouped
+// by article in context order, each followed by the citation number of
+// its chunk as numberContext numbers `chunks`. Without any matching
+// sentence the first sentence of each hit is used.
+func extractiveAnswer(question string, chunks []debugChunk, budget int) string {
+	type sentence struct {
+		text    string
+		words   []string
+		article string
+		n, pos  int
+		score   float64
+	}
+	var all []sentence
+	seen := map[string]bool{}
+	for i, c := range chunks {
+		for _, s := range splitSentences(c.Content) {
+			if !seen[s] {
+				seen[s] = true
+				all = append(all, sentence{text: s, words: queryTerms(s), article: c.Article, n: i + 1, pos: len(all)})
+			}
+		}
+	}
+	terms := queryTerms(question)
+	weights := make([]float64, len(terms))
+	total := 0.0
+	for i, t := range terms {
+		df := 0
+		for _, s := range all {
+			if slices.ContainsFunc(s.words, func(w string) bool { return termsMatch(t, w) }) {
+				df++
+			}
+		}
+		weights[i] = math.Log(1 + float64(len(all))/float64(1+df))
+		total += weights[i]
+	}
+	lexical := make([]float64, len(all))
+	best := 0.0
+	for j, s := range all {
+		for i, t := range terms {
+			if slices.ContainsFunc(s.words, func(w string) bool { return termsMatch(t, w) }) {
+				lexical[j] += weights[i] / total
+			}
+		}
+		best = max(best, lexical[j])
+	}
+	// Sentences sharing only common words with the question are noise.
+	var candidates []sentence
+	for j, s := range all {
+		if lexical[j] >= max(0.15, best/2) {
+			s.score = lexical[j] + max(chunks[s.n-1].Score, 0)/10
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		// Nothing matches: the lead sentence of each hit.
+		leads := map[int]bool{}
+		for _, s := range all {
+			if !leads[s.n] && !chunks[s.n-1].IsNeighbor {
+				leads[s.n] = true
+				s.score = chunks[s.n-1].Score
+				candidates = append(candidates, s)
+			}
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b sentence) int { return cmp.Compare(b.score, a.score) })
+
+	render := func(sel []sentence) string {
+		sel = slices.Clone(sel)
+		slices.SortFunc(sel, func(a, b sentence) int { return cmp.Compare(a.pos, b.pos) })
+		var order []string
+		groups := map[string][]string{}
+		for _, s := range sel {
+			if _, ok := groups[s.article]; !ok {
+				order = append(order, s.article)
+			}
+			groups[s.article] = append(groups[s.article], fmt.Sprintf("- %s [%d]", s.text, s.n))
+		}
+		var b strings.Builder
+		b.WriteString(offlineHeader)
+		for _, a := range order {
+			fmt.Fprintf(&b, "\n**%s**\n%s\n", a, strings.Join(groups[a], "\n"))
+		}
+		return strings.TrimSuffix(b.String(), "\n")
+	}
+	var sel []sentence
+	for _, s := range candidates {
+		if len(sel) == offlineMaxSentences {
+			break
+		}
+		if utf8.RuneCountInString(render(append(sel, s))) <= budget {
+			sel = append(sel, s)
+		}
+	}
+	if len(sel) == 0 && len(candidates) > 0 {
+		// Even the best sentence is too long: cut it.
+		s := candidates[0]
+		s.text = truncate(s.text, max(budget-utf8.RuneCountInString(render([]sentence{{article: s.article, n: s.n}})), 1))
+		sel = append(sel, s)
+	}
+	if len(sel) == 0 {
+		return offlineHeader + "\nIn den Dokumenten wurde nichts Passendes gefunden."
+	}
+	return render(sel)
+}
+
+// askError describes a failure of /api/ask. It is sent as an
+// "event: error" frame and kept on the assistant message it belongs to.
+type askError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Phase     string `json:"phase"`
+	RequestID string `json:"request_id"`
+}
+
+// streamTokens copies the text read from `r` to the client as SSE data
+// frames and returns it. The first token is sent immediately, later
+// ones in batches (see sseBatchBytes), the rest when `r` ends. Tool
+// request markers are kept in the returned text but never sent. The
+// error is the one `r` ended with (nil for io.EOF).
+func streamTokens(r io.Reader, w io.Writer, flusher http.Flusher) (string, error) {
+	chunks := make(chan string)
+	var readErr error
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, 4096)
+		var carry []byte
+		for {
+			n, err := r.Read(buf)
+			data := append(carry, buf[:n]...)
+			// Keep an incomplete trailing rune for the next read.
+			cut := len(data)
+			for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+				if utf8.RuneStart(data[len(data)-i]) {
+					if !utf8.FullRune(data[len(data)-i:]) {
+						cut = len(data) - i
+					}
+					break
+				}
+			}
+			if err != nil {
+				cut = len(data)
+			}
+			if cut > 0 {
+				chunks <- string(data[:cut])
+			}
+			carry = append([]byte(nil), data[cut:]...)
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+		}
+	}()
+
+	var text, pending strings.Builder
+	var filter toolRequestFilter
+	var deadline <-chan time.Time
+	send := func() {
+		if pending.Len() > 0 {
+			fmt.Fprintf(w, "data: %s\n\n", mustJSON(pending.String()))
+			flusher.Flush()
+			pending.Reset()
+		}
+		deadline = nil
+	}
+	for {
+		select {
+		case c, ok := <-chunks:
+			if !ok {
+				pending.WriteString(filter.flush())
+				send()
+				return text.String(), readErr
+			}
+			first := text.Len() == 0
+			text.WriteString(c)
+			pending.WriteString(filter.write(c))
+			if first || pending.Len() >= sseBatchBytes {
+				send()
+			} else if deadline == nil {
+				deadline = time.After(sseBatchDelay)
+			}
+		case <-deadline:
+			send()
+		}
+	}
+}
+
+// streamAnswerSegment streams one chat completion to the client as SSE
+// data frames and returns the streamed text. Its timings are added to `t`.
+func streamAnswerSegment(ctx context.Context, lm *lmClient, system string, msgs []chatMsg, t *llmTimings, w io.Writer, flusher http.Flusher) (string, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(t.chatStream(ctx, lm, system, msgs, pw))
+	}()
+	return streamTokens(pr, w, flusher)
+}
+
+// ── LLM timings ──────────────────────────────────────────────────
+
+// llmCall measures one chatStream call. Tokens counts the streamed
+// content deltas; most backends send one token per delta.
+type llmCall struct {
+	TTFBMs  int64 `json:"ttfb_ms"`
+	TotalMs int64 `json:"total_ms"`
+	Tokens  int   `json:"tokens"`
+}
+
+// llmTimings measures the generation phase of an answer: the first
+// chatStream call and its tool continuations. TTFBMs is the time to the
+// first token of the first call, TotalMs and Tokens add up all calls,
+// TokensPerS relates the tokens to the time after each call's first one.
+type llmTimings struct {
+	TTFBMs     int64     `json:"ttfb_ms"`
+	TotalMs    int64     `json:"total_ms"`
+	Tokens     int       `json:"tokens"`
+	TokensPerS float64   `json:"tokens_per_s"`
+	Calls      []llmCall `json:"calls"`
+}
+
+// timedWriter notes when chatStream writes its first token and counts
+// the writes, one per token.
+type timedWriter struct {
+	w      io.Writer
+	first  time.Time
+	tokens int
+}
+
+func (tw *timedWriter) Write(p []byte) (int, error) {
+	if tw.tokens == 0 {
+		tw.first = time.Now()
+	}
+	tw.tokens++
+	return tw.w.Write(p)
+}
+
+// chatStream runs lm.chatStream and records the call in `t`. It must
+// not run concurrently with other calls on the same `t`.
+func (t *llmTimings) chatStream(ctx context.Context, lm *lmClient, system string, msgs []chatMsg, w io.Writer) error {
+	start := time.Now()
+	tw := &timedWriter{w: w}
+	err := lm.chatStream(ctx, system, msgs, tw)
+	c := llmCall{TotalMs: time.Since(start).Milliseconds(), Tokens: tw.tokens}
+	if tw.tokens > 0 {
+		c.TTFBMs = tw.first.Sub(start).Milliseconds()
+	}
+	if len(t.Calls) == 0 {
+		t.TTFBMs = c.TTFBMs
+	}
+	t.Calls = append(t.Calls, c)
+	t.TotalMs += c.TotalMs
+	t.Tokens += c.Tokens
+	var genMs int64
+	for _, c := range t.Calls {
+		genMs += c.TotalMs - c.TTFBMs
+	}
+	if genMs > 0 {
+		t.TokensPerS = math.Round(float64(t.Tokens)*10000/float64(genMs)) / 10
+	}
+	return err
+}
+
+// llmCheckReq is the request structure for model/endpoint validation.
+type llmCheckReq struct {
+	BaseURL string `json:"base_url"`
+}
+
+// llmCheckResp is the response structure returned when validating an LLM endpoint.
+type llmCheckResp struct {
+	OK             bool     `json:"ok"`
+	BaseURL        string   `json:"base_url"`
+	ProviderHint   string   `json:"provider_hint"`
+	Error          string   `json:"error,omitempty"`
+	Models         []string `json:"models,omitempty"`
+	RecommendChat  []string `json:"recommend_chat,omitempty"`
+	RecommendEmbed []string `json:"recommend_embed,omitempty"`
+	// ModelInfo holds what the backend reports per model, including the
+	// dimension of embedding models (Ollama only).
+	ModelInfo map[string]modelMeta `json:"model_info,omitempty"`
+}
+
+// providerHintFromURL returns a human-friendly hint about the LLM
+// provider based on common port patterns in the base URL.
+func providerHintFromURL(base string) string {
+	if strings.Contains(base, "11434") {
+		return "Ollama"
+	}
+	if strings.Contains(base, "1234") {
+		return "LM Studio"
+	}
+	return "OpenAI-compatible"
+}
+
+// Name fragments of embedding and chat model families for the
+// heuristics of recommendModels.
+var (
+	embedModelHints = []string{"embed", "bge-", "bge:", "e5-", "gte-", "minilm", "mpnet", "nomic-bert"}
+	chatModelHints  = []string{"llama", "mistral", "ministral", "qwen", "gemma", "phi", "gpt", "deepseek", "granite", "command-r", "hermes"}
+)
+
+// recommendModels selects likely chat and embedding models from a list
+// of available model IDs. What the backend reports in `meta` decides;
+// other models are classified by `rules`, then by name. A model
+// recognized as an embedding model is never recommended for chat.
+func recommendModels(models []string, rules modelRules, meta map[string]modelMeta) (chat []string, embed []string) {
+	compile := func(ps []string) []*regexp.Regexp {
+		var res []*regexp.Regexp
+		for _, p := range ps {
+			if re, err := regexp.Compile("(?i)" + p); err == nil {
+				res = append(res, re)
+			}
+		}
+		return res
+	}
+	matches := func(res []*regexp.Regexp, m string) bool {
+		return slices.ContainsFunc(res, func(re *regexp.Regexp) bool { return re.MatchString(m) })
+	}
+	chatIn, chatEx := compile(rules.ChatInclude), compile(rules.ChatExclude)
+	embedIn, embedEx := compile(rules.EmbedInclude), compile(rules.EmbedExclude)
+	hinted := func(m string, hints []string) bool {
+		ml := strings.ToLower(m)
+		return slices.ContainsFunc(hints, func(h string) bool { return strings.Contains(ml, h) })
+	}
+	for _, m := range models {
+		isEmbed := hinted(m, embedModelHints)
+		isChat := !isEmbed && hinted(m, chatModelHints)
+		if matches(embedIn, m) {
+			isEmbed = true
+		}
+		if matches(chatIn, m) {
+			isChat = true
+		}
+		if matches(embedEx, m) {
+			isEmbed = false
+		}
+		if matches(chatEx, m) {
+			isChat = false
+		}
+		if md, ok := meta[m]; ok && md.Kind != "" {
+			isEmbed, isChat = md.Kind == "embedding", md.Kind == "chat"
+		}
+		if isEmbed {
+			embed = append(embed, m)
+		}
+		if isChat {
+			chat = append(chat, m)
+		}
+	}
+	// Keep lists short
+	if len(chat) > 8 {
+		chat = chat[:8]
+	}
+	if len(embed) > 8 {
+		embed = embed[:8]
+	}
+	return
+}
+
+// modelMeta is what the backend reports about a model.
+type modelMeta struct {
+	Kind         string `json:"kind,omitempty"` // "chat" or "embedding"
+	Family       string `json:"family,omitempty"`
+	EmbeddingDim int    `json:"embedding_dim,omitempty"`
+}
+
+// maxProbedModels caps the models probeModelMeta asks about.
+const maxProbedModels = 50
+
+// probeModelMeta asks an Ollama backend (POST /api/show) about each of
+// `models`. It returns nil if the first model cannot be looked up
+// there, which is the case for other backends.
+func probeModelMeta(ctx context.Context, c *lmClient, base string, models []string) map[string]modelMeta {
+	show := func(model string) (modelMeta, error) {
+		body, _ := json.Marshal(map[string]string{"model": model})
+		req, err := c.newRequest(ctx, "POST", base+"/api/show", bytes.NewReader(body))
+		if err != nil {
+			return modelMeta{}, err
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return modelMeta{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return modelMeta{}, fmt.Errorf("show HTTP %d", resp.StatusCode)
+		}
+		var sr struct {
+			Details struct {
+				Family string `json:"family"`
+			} `json:"details"`
+			ModelInfo    map[string]any `json:"model_info"`
+			Capabilities []string       `json:"capabilities"`
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxLLMBytes)).Decode(&sr); err != nil {
+			return modelMeta{}, err
+		}
+		md := modelMeta{Family: sr.Details.Family}
+		switch {
+		case slices.Contains(sr.Capabilities, "embedding"):
+			md.Kind = "embedding"
+		case slices.Contains(sr.Capabilities, "completion"):
+			md.Kind = "chat"
+		case len(sr.Capabilities) == 0 && strings.Contains(sr.Details.Family, "bert"):
+			// Older Ollama versions report no capabilities.
+			md.Kind = "embedding"
+		}
+		if md.Kind == "embedding" {
+			arch, _ := sr.ModelInfo["general.architecture"].(string)
+			if n, ok := sr.ModelInfo[arch+".embedding_length"].(float64); ok {
+				md.EmbeddingDim = int(n)
+			}
+		}
+		return md, nil
+	}
+	models = models[:min(len(models), maxProbedModels)]
+	if len(models) == 0 {
+		return nil
+	}
+	first, err := show(models[0])
+	if err != nil {
+		return nil
+	}
+	out := map[string]modelMeta{models[0]: first}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 4)
+	for _, m := range models[1:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if md, err := show(m); err == nil {
+				mu.Lock()
+				out[m] = md
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+// ── Folder import roots ─────────────────────────────────────────────
+
+// importRoots lists the directories /api/add-folder may read from,
+// with symlinks resolved. It is set once at startup by setImportRoots.
+var importRoots []string
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// setImportRoots resolves `roots` and installs them as importRoots; no
+// roots means the current working directory.
+func setImportRoots(roots []string) error {
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	resolved := make([]string, 0, len(roots))
+	for _, root := range roots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		if abs, err = filepath.EvalSymlinks(abs); err != nil {
+			return fmt.Errorf("import root %s: %w", root, err)
+		}
+		resolved = append(resolved, abs)
+	}
+	importRoots = resolved
+	return nil
+}
+
+// errOutsideImportRoots is returned by resolveImportPath for paths that
+// are not inside one of importRoots.
+var errOutsideImportRoots = errors.New("path outside the allowed import roots")
+
+// resolveImportPath returns `path` with symlinks resolved if it lies
+// inside one of importRoots.
+func resolveImportPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return "", err
+	}
+	for _, root := range importRoots {
+		if rel, err := filepath.Rel(root, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return abs, nil
+		}
+	}
+	return "", errOutsideImportRoots
+}
+
+// discoverCandidate contains information about a discovered LLM endpoint.
+type discoverCandidate struct {
+	BaseURL        string   `json:"base_url"`
+	ProviderHint   string   `json:"provider_hint"`
+	OK             bool     `json:"ok"`
+	LatencyMs      int64    `json:"latency_ms"`
+	Error          string   `json:"error,omitempty"`
+	Models         []string `json:"models,omitempty"`
+	RecommendChat  []string `json:"recommend_chat,omitempty"`
+	RecommendEmbed []string `json:"recommend_embed,omitempty"`
+}
+
+// discoverResp is returned from the /api/discover endpoint.
+type discoverResp struct {
+	Candidates []discoverCandidate `json:"candidates"`
+}
+
+// defaultDiscoverCandidates are probed by /api/discover unless the
+// discover_candidates setting lists others.
+var defaultDiscoverCandidates = []string{
+	"http://localhost:1234",  // LM Studio default
+	"http://localhost:11434", // Ollama default
+}
+
+// discoverProbeTimeout bounds each endpoint probe of discoverEndpoints.
+const discoverProbeTimeout = 2 * time.Second
+
+// discoverEndpoints probes the base URLs in `candidates` concurrently
+// and returns one result per distinct URL, in the given order.
+func discoverEndpoints(ctx context.Context, candidates []string, rules modelRules) []discoverCandidate {
+	var bases []string
+	for _, c := range candidates {
+		if base := normalizeBaseURL(c); base != "" && !slices.Contains(bases, base) {
+			bases = append(bases, base)
+		}
+	}
+	out := make([]discoverCandidate, len(bases))
+	var wg sync.WaitGroup
+	for i, base := range bases {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := discoverCandidate{BaseURL: base, ProviderHint: providerHintFromURL(base)}
+			pctx, cancel := context.WithTimeout(ctx, discoverProbeTimeout)
+			defer cancel()
+			start := time.Now()
+			models, err := newLMClient(base, "x", "x", "").listModels(pctx, base)
+			c.LatencyMs = time.Since(start).Milliseconds()
+			if err != nil {
+				c.Error = err.Error()
+			} else {
+				c.OK = true
+				c.Models = models
+				c.RecommendChat, c.RecommendEmbed = recommendModels(models, rules, nil)
+			}
+			out[i] = c
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+// runWebServer registers HTTP handlers and starts the web interface.
+func runWebServer(rag *ragSystem, addr string, settings *settingsStore, chats *chatStore, customAPIs *apiStore, personas *personaStore) {
+	mux := newWebHandler(rag, settings, chats, customAPIs, personas)
+	fmt.Printf("Web interface: http://localhost%s\n", addr)
+	fmt.Printf("Folder imports allowed from: %s\n", strings.Join(importRoots, ", "))
+	if devAssetsDir != "" {
+		fmt.Printf("Serving web assets from: %s\n", devAssetsDir)
+	}
+	if err := rag.lmError(); err != nil {
+		fmt.Printf("⚠ LLM endpoint unreachable — open http://localhost%s and configure it in Settings.\n", addr)
+	}
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// newWebHandler returns the handler of the web interface and the API.
+func newWebHandler(rag *ragSystem, settings *settingsStore, chats *chatStore, customAPIs *apiStore, personas *personaStore) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// collectionFor resolves the collection of a request ("" = default)
+	// and answers 404 for unknown collections.
+	collectionFor := func(w http.ResponseWriter, name string) (*ragSystem, bool) {
+		col, err := rag.collectionView(name)
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return nil, false
+		}
+		return col, true
+	}
+
+	// llmReady answers 503 while the LLM endpoint is unreachable, so the
+	// UI stays usable for fixing the settings.
+	llmReady := func(w http.ResponseWriter) bool {
+		if err := rag.lmError(); err != nil {
+			http.Error(w, "LLM endpoint unreachable — configure it in Settings ("+err.Error()+")", 503)
+			return false
+		}
+		return true
+	}
+
+	// Static assets
+	mux.Handle("/", newStaticAsset("index.html", "text/html; charset=utf-8", indexHTML))
+	mux.Handle("/style.css", newStaticAsset("style.css", "text/css; charset=utf-8", styleCSS))
+	mux.Handle("/app.js", newStaticAsset("app.js", "application/javascript; charset=utf-8", appJS))
+
+	// GET /api/settings — current settings
+	mux.HandleFunc("/api/settings", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			s := settings.get()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{
+				"base_url":           s.BaseURL,
+				"chat_model":         s.ChatModel,
+				"embed_model":        s.EmbedModel,
+				"embed_dimensions":   s.EmbedDimensions,
+				"lang":               s.Lang,
+				"theme":              s.Theme,
+				"chunk_size":         s.ChunkSize,
+				"k":                  s.K,
+				"history_budget":     s.HistoryBudget,
+				"api_key":            maskSecret(s.APIKey),
+				"default_persona_id": personas.defaultID(),
+				"api_key_set":        s.APIKey != "",
+				"pinned":             settings.pinned(),
+			})
+			return
+
+		case "POST":
+			// Partial update: absent fields keep their current values.
+			var req struct {
+				BaseURL          *string `json:"base_url"`
+				ChatModel        *string `json:"chat_model"`
+				EmbedModel       *string `json:"embed_model"`
+				EmbedDimensions  *int    `json:"embed_dimensions"`
+				Theme            *string `json:"theme"`
+				Lang             *string `json:"lang"`
+				K                *int    `json:"k"`
+				ChunkSize        *int    `json:"chunk_size"`
+				APIKey           *string `json:"api_key"`
+				DefaultPersonaID *string `json:"default_persona_id"`
+				Force            bool    `json:"force"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid JSON", 400)
+				return
+			}
+			old := settings.get()
+			next := old
+			if req.BaseURL != nil {
+				next.BaseURL = normalizeBaseURL(*req.BaseURL)
+			}
+			if req.ChatModel != nil {
+				next.ChatModel = strings.TrimSpace(*req.ChatModel)
+			}
+			if req.EmbedModel != nil {
+				next.EmbedModel = strings.TrimSpace(*req.EmbedModel)
+			}
+			if req.EmbedDimensions != nil {
+				next.EmbedDimensions = *req.EmbedDimensions
+			}
+			if req.Theme != nil {
+				next.Theme = *req.Theme
+			}
+			if req.Lang != nil {
+				next.Lang = strings.ToLower(strings.TrimSpace(*req.Lang))
+			}
+			if req.K != nil {
+				next.K = *req.K
+			}
+			if req.ChunkSize != nil {
+				next.ChunkSize = *req.ChunkSize
+			}
+			if req.APIKey != nil {
+				next.APIKey = strings.TrimSpace(*req.APIKey)
+			}
+			if req.DefaultPersonaID != nil {
+				next.DefaultPersonaID = *req.DefaultPersonaID
+				if _, ok := personas.get(next.DefaultPersonaID); next.DefaultPersonaID != "" && !ok {
+					http.Error(w, "unknown persona "+next.DefaultPersonaID, 400)
+					return
+				}
+			}
+			changed := map[string]bool{
+				"base_url":           next.BaseURL != old.BaseURL,
+				"chat_model":         next.ChatModel != old.ChatModel,
+				"embed_model":        next.EmbedModel != old.EmbedModel,
+				"embed_dimensions":   next.EmbedDimensions != old.EmbedDimensions,
+				"lang":               next.Lang != old.Lang,
+				"k":                  next.K != old.K,
+				"chunk_size":         next.ChunkSize != old.ChunkSize,
+				"theme":              next.Theme != old.Theme,
+				"api_key":            next.APIKey != old.APIKey,
+				"default_persona_id": next.DefaultPersonaID != old.DefaultPersonaID,
+			}
+			if err := validateSettingsUpdate(next, changed); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+
+			// Env-pinned fields cannot be changed here.
+			pinned := settings.pinned()
+			for key, env := range pinned {
+				if changed[key] {
+					http.Error(w, key+" is set by "+env+" and cannot be changed", 409)
+					return
+				}
+			}
+
+			// Validate endpoint quickly
+			var tmp *lmClient
+			if changed["base_url"] || changed["chat_model"] || changed["embed_model"] || changed["embed_dimensions"] || changed["api_key"] {
+				tmp = newLMClient(next.BaseURL, next.EmbedModel, next.ChatModel, next.APIKey)
+				tmp.embedDims = next.EmbedDimensions
+				if err := tmp.ping(); err != nil {
+					http.Error(w, "LLM endpoint not reachable: "+err.Error(), 400)
+					return
+				}
+			} else if rag.lmError() != nil {
+				// Unchanged endpoint that was down: use it if it is up now.
+				if c := newLMClient(next.BaseURL, next.EmbedModel, next.ChatModel, next.APIKey); c.ping() == nil {
+					c.embedDims = next.EmbedDimensions
+					tmp = c
+				}
+			}
+
+			// The model must deliver at least embed_dimensions dimensions.
+			if changed["embed_dimensions"] && next.EmbedDimensions > 0 {
+				if _, err := tmp.embedSingle(r.Context(), "dimension probe"); err != nil {
+					http.Error(w, "embed_dimensions: "+err.Error(), 400)
+					return
+				}
+			}
+
+			// Warn on embedding model changes if DB already has data
+			warning := ""
+			if old.EmbedModel != "" && (changed["embed_model"] || changed["embed_dimensions"]) && rag.docCount() > 0 {
+				msg := "Du hast das Embedding-Modell geändert. Bestehende Chunks wurden mit dem alten Modell eingebettet; Retrieval kann schlechter werden. Wenn du fortfährst, solltest du die Wissensbasis neu einbetten (`tinyrag reembed` oder POST /api/db/reembed) oder die DB leeren."
+				if !changed["embed_model"] {
+					msg = "Du hast embed_dimensions geändert. Wenn du fortfährst, musst du die Wissensbasis neu einbetten (`tinyrag reembed` oder POST /api/db/reembed); bis dahin werden neue Quellen abgelehnt."
+				}
+				resp := map[string]any{"ok": false, "requires_force": true}
+				corpusDim, modelDim := rag.corpusDim(), 0
+				if vec, err := tmp.embedSingle(r.Context(), "dimension probe"); err == nil {
+					modelDim = len(vec)
+				}
+				if corpusDim > 0 && modelDim > 0 && corpusDim != modelDim {
+					warning = fmt.Sprintf("Das Modell %s liefert %d-dimensionale Embeddings, die gespeicherten Chunks haben %d Dimensionen. Bis zum Neu-Einbetten schlägt die Suche fehl.", next.EmbedModel, modelDim, corpusDim)
+					msg = warning + " " + msg
+					resp["corpus_dim"], resp["model_dim"] = corpusDim, modelDim
+				}
+				if !req.Force {
+					resp["message"] = msg
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(409)
+					json.NewEncoder(w).Encode(resp)
+					return
+				}
+			}
+
+			// Persist + apply. Pinned values stay out of settings.json.
+			err := settings.update(func(st *appSettings) error {
+				if changed["base_url"] {
+					st.BaseURL = next.BaseURL
+				}
+				if changed["chat_model"] {
+					st.ChatModel = next.ChatModel
+				}
+				if changed["embed_model"] {
+					st.EmbedModel = next.EmbedModel
+				}
+				if changed["embed_dimensions"] {
+					st.EmbedDimensions = next.EmbedDimensions
+				}
+				if changed["lang"] {
+					st.Lang = next.Lang
+				}
+				if changed["k"] {
+					st.K = next.K
+				}
+				if changed["chunk_size"] {
+					st.ChunkSize = next.ChunkSize
+				}
+				if changed["theme"] {
+					st.Theme = next.Theme
+				}
+				if changed["api_key"] {
+					st.APIKey = next.APIKey
+				}
+				if changed["default_persona_id"] {
+					st.DefaultPersonaID = next.DefaultPersonaID
+				}
+				return nil
+			})
+			if err != nil {
+				http.Error(w, "failed to save settings: "+err.Error(), 500)
+				return
+			}
+
+			if tmp != nil {
+				rag.setLM(tmp)
+			}
+			rag.setK(next.K)
+
+			w.Header().Set("Content-Type", "application/json")
+			if warning != "" {
+				json.NewEncoder(w).Encode(map[string]any{"ok": true, "warning": warning})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"ok": true})
+			return
+
+		default:
+			http.Error(w, "GET or POST only", 405)
+			return
+		}
+	})
+
+	// POST /api/settings/theme — lightweight theme switch (no LLM validation)
+	mux.HandleFunc("/api/settings/theme", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			Theme string `json:"theme"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", 400)
+			return
+		}
+		if !validTheme(req.Theme) {
+			http.Error(w, fmt.Sprintf("unknown theme %q", req.Theme), 400)
+			return
+		}
+		if err := settings.update(func(st *appSettings) error {
+			st.Theme = req.Theme
+			return nil
+		}); err != nil {
+			http.Error(w, "failed to save settings: "+err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"ok": true, "theme": req.Theme})
+	})
+
+	// GET /api/discover — auto-discover common local endpoints
+	mux.HandleFunc("/api/discover", func(w http.ResponseWriter, r *http.Request) {
+		candidates := settings.get().DiscoverCandidates
+		if len(candidates) == 0 {
+			candidates = defaultDiscoverCandidates
+		}
+		// POST {"extra": ["http://nas.local:11434"]} probes more endpoints.
+		if r.Method == "POST" {
+			var req struct {
+				Extra []string `json:"extra"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+				http.Error(w, "invalid JSON", 400)
+				return
+			}
+			candidates = append(slices.Clone(candidates), req.Extra...)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(discoverResp{Candidates: discoverEndpoints(r.Context(), candidates, settings.get().ModelRules)})
+	})
+
+	// POST /api/llm/list-models — validate an endpoint and list models
+	mux.HandleFunc("/api/llm/list-models", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req llmCheckReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", 400)
+			return
+		}
+		req.BaseURL = normalizeBaseURL(req.BaseURL)
+		if req.BaseURL == "" {
+			http.Error(w, "missing base_url", 400)
+			return
+		}
+		tmp := newLMClient(req.BaseURL, "x", "x", settings.get().APIKey)
+		models, err := tmp.listModels(r.Context(), req.BaseURL)
+		resp := llmCheckResp{BaseURL: req.BaseURL, ProviderHint: providerHintFromURL(req.BaseURL)}
+		if err != nil {
+			resp.OK = false
+			resp.Error = err.Error()
+		} else {
+			resp.OK = true
+			resp.Models = models
+			pctx, cancel := context.WithTimeout(r.Context(), discoverProbeTimeout)
+			resp.ModelInfo = probeModelMeta(pctx, tmp, req.BaseURL, models)
+			cancel()
+			resp.RecommendChat, resp.RecommendEmbed = recommendModels(models, settings.get().ModelRules, resp.ModelInfo)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	// POST /api/warmup — load the models before the user asks (keep_warm)
+	mux.HandleFunc("/api/warmup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !settings.get().KeepWarm.Enabled {
+			json.NewEncoder(w).Encode(map[string]any{"status": "disabled"})
+			return
+		}
+		if !llmReady(w) {
+			return
+		}
+		switch idle := lmActivity.idle(); {
+		case idle == 0:
+			json.NewEncoder(w).Encode(map[string]any{"status": "busy"})
+			return
+		case idle < warmRecent:
+			json.NewEncoder(w).Encode(map[string]any{"status": "warm"})
+			return
+		}
+		// Not bound to the request: the model keeps loading when the
+		// page is left.
+		res, err := warmer.warm(context.Background(), rag.getLM(), "request")
+		switch {
+		case err == errWarmRunning:
+			json.NewEncoder(w).Encode(map[string]any{"status": "running"})
+		case err != nil:
+			http.Error(w, err.Error(), 502)
+		default:
+			json.NewEncoder(w).Encode(map[string]any{"status": "ok", "embed_ms": res.EmbedMS, "chat_ms": res.ChatMS})
+		}
+	})
+
+	// POST /api/ask — SSE streaming answer
 	mux.HandleFunc("/api/ask", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "POST only", 405)
 			return
 		}
-
-		reqID := newRequestID()
+		if !llmReady(w) {
+			return
+		}
+
+		reqID := newRequestID()
+		started := time.Now()
+		var req struct {
+			Question   string `json:"question"`
+			ChatID     string `json:"chat_id"`
+			Debug      bool   `json:"debug"`
+			DebugFull  bool   `json:"debug_full"`
+			Deep       bool   `json:"deep"`
+			Offline    bool   `json:"offline"`
+			Raw        bool   `json:"raw"` // offline: the whole context instead of sentences
+			AutoSearch bool   `json:"auto_search"`
+			PersonaID  string `json:"persona_id"`
+			Collection string `json:"collection"`
+			NoCache    bool   `json:"no_cache"`
+			// StrictGrounding turns strict grounding on for this request;
+			// it cannot turn off the setting.
+			StrictGrounding bool `json:"strict_grounding"`
+			// Tags restricts retrieval to sources with any of these tags.
+			Tags []string `json:"tags"`
+			genParams
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Question) == "" {
+			http.Error(w, "missing question", 400)
+			return
+		}
+		tags, tagErr := normalizeTags(req.Tags)
+		if tagErr != nil {
+			http.Error(w, tagErr.Error(), 400)
+			return
+		}
+		req.Model = strings.TrimSpace(req.Model)
+		if err := req.genParams.validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		s := settings.get()
+		if req.DebugFull && !s.AllowFullDebug {
+			http.Error(w, "debug_full requires allow_full_debug", 403)
+			return
+		}
+		// All phases of the request use the client it started with, even
+		// if the settings change meanwhile.
+		baseLM := rag.getLM()
+		r = r.WithContext(withLM(r.Context(), baseLM))
+
+		var conv *conversation
+		if req.ChatID != "" {
+			conv = chats.get(req.ChatID)
+		}
+		personaID := strings.TrimSpace(req.PersonaID)
+		if conv != nil && personaID == "" {
+			personaID = conv.Persona
+		}
+		if _, ok := personas.get(personaID); personaID != "" && !ok {
+			log.Printf("ASK[%s] persona %q no longer exists, using the default persona", reqID, personaID)
+			personaID = ""
+		}
+		if personaID == "" {
+			personaID = personas.defaultID()
+		}
+		collection := strings.TrimSpace(req.Collection)
+		if conv != nil && collection == "" {
+			collection = conv.Collection
+		}
+		col, ok := collectionFor(w, collection)
+		if !ok {
+			return
+		}
+		// Tag filters apply to every search of the request, tools included.
+		var tagSources []string
+		if len(tags) > 0 {
+			tagSources = col.sourcesTagged(tags)
+			r = r.WithContext(withSourceFilter(r.Context(), tagSources))
+		}
+		if conv == nil {
+			conv = chats.create("", personaID)
+		} else if conv.Persona != personaID {
+			conv.Persona = personaID
+			chats.setPersona(conv.ID, personaID)
+		}
+		if conv.Collection != collection {
+			conv.Collection = collection
+			chats.setCollection(conv.ID, collection)
+		}
+		chats.addMessage(conv.ID, "user", req.Question)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", 500)
+			return
+		}
+		// sendError reports a failure to the client without making it
+		// part of the answer text.
+		sendError := func(e *askError) {
+			e.RequestID = reqID
+			d, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", d)
+			flusher.Flush()
+		}
+		// sendStatusData reports the stage the answer is in, for progress
+		// display, with optional details; clients may ignore it.
+		sendStatusData := func(stage string, data map[string]any) {
+			payload := map[string]any{"stage": stage, "elapsed_ms": time.Since(started).Milliseconds()}
+			for k, v := range data {
+				payload[k] = v
+			}
+			d, _ := json.Marshal(payload)
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", d)
+			flusher.Flush()
+		}
+		sendStatus := func(stage string) { sendStatusData(stage, nil) }
+		// planCtx streams the tokens of the retrieval planners as
+		// "planning" events; they never become part of the answer.
+		planCtx := r.Context()
+		if req.Debug || !s.DisablePlanningStream {
+			planCtx = withPlanning(planCtx, func(source, text string) {
+				d, _ := json.Marshal(map[string]string{"source": source, "text": text})
+				fmt.Fprintf(w, "event: planning\ndata: %s\n\n", d)
+				flusher.Flush()
+			})
+		}
+		var full *debugFull
+		// fail ends the stream after a failure and stores the partial
+		// answer, if any, flagged with the error.
+		fail := func(e *askError, partial string) {
+			sendError(e)
+			fmt.Fprintf(w, "data: [DONE]\n\n")
+			flusher.Flush()
+			chats.appendMessage(conv.ID, chatMessage{Role: "assistant", Content: partial, Error: e, DebugFull: full})
+		}
+
+		totalChunks := col.docCount()
+		// A tag filter without matching sources leaves nothing to search,
+		// like an empty knowledge base.
+		noTagged := len(tags) > 0 && len(tagSources) == 0
+		emptyKB := totalChunks == 0 || noTagged
+		baseK := s.K
+		usedK := baseK
+		mode := "normal"
+		if req.Deep {
+			usedK = baseK * 3
+			if usedK < 10 {
+				usedK = 10
+			}
+			if usedK > totalChunks {
+				usedK = totalChunks
+			}
+			if usedK > 50 {
+				usedK = 50 // hard cap to avoid huge prompts
+			}
+			mode = "deep"
+		}
+		if req.Offline {
+			mode = "offline"
+		}
+		strict := s.StrictGrounding || req.StrictGrounding
+
+		var per persona
+		if personaID != "" {
+			per, _ = personas.get(personaID)
+		}
+		personaName, personaPrompt := per.Name, per.Prompt
+		gen := resolveGenParams(baseLM.chatModel, req.genParams, per.genParams())
+		lm := baseLM.withParams(gen)
+
+		// Only opening questions are cached: later answers depend on the
+		// chat history. no_cache skips the lookup but refreshes the entry.
+		cacheable := s.AnswerCache.Enabled && !req.Offline && len(conv.Messages) == 1
+		cacheKey := answerKey{
+			Question:   normalizeQuestion(req.Question),
+			Collection: col.collection,
+			Model:      mustJSON(gen),
+			Persona:    personaID + "\x00" + personaPrompt,
+			Deep:       req.Deep,
+			Strict:     strict,
+			Tags:       strings.Join(tags, ","),
+			Version:    col.kbVersion(),
+		}
+		var hit cachedAnswer
+		cached := false
+		if cacheable && !req.NoCache {
+			hit, cached = answers.get(cacheKey, time.Duration(s.AnswerCache.TTLSeconds)*time.Second)
+		}
+
+		metaPayload := map[string]any{
+			"chat_id":       conv.ID,
+			"title":         conv.Title,
+			"request_id":    reqID,
+			"mode":          mode,
+			"k":             usedK,
+			"base_k":        baseK,
+			"chunk_size":    s.ChunkSize,
+			"total_chunks":  totalChunks,
+			"empty_kb":      emptyKB,
+			"storage_mode":  storageModeLabel(rag.storageMode),
+			"db_path":       rag.dbPath,
+			"auto_search":   req.AutoSearch,
+			"debug":         req.Debug,
+			"deep":          req.Deep,
+			"offline":       req.Offline,
+			"message_count": len(conv.Messages),
+			"created":       conv.Created,
+			"updated":       conv.Updated,
+			"persona_id":    personaID,
+			"persona_name":  personaName,
+			"collection":    col.collection,
+			"cached":        cached,
+			"strict":        strict,
+			"tags":          tags,
+			"tag_sources":   len(tagSources),
+			"models": map[string]any{
+				"base_url":    lm.base,
+				"chat_model":  lm.chatModel,
+				"embed_model": lm.embedModel,
+				"generation":  lm.generation,
+			},
+		}
+		meta, _ := json.Marshal(metaPayload)
+		fmt.Fprintf(w, "event: meta\ndata: %s\n\n", meta)
+		flusher.Flush()
+
+		log.Printf("ASK[%s] chat=%s mode=%s debug=%t deep=%t offline=%t auto_search=%t cached=%t q=%q", reqID, conv.ID, mode, req.Debug, req.Deep, req.Offline, req.AutoSearch, cached, req.Question)
+
+		if cached {
+			for _, part := range strings.SplitAfter(hit.Answer, " ") {
+				fmt.Fprintf(w, "data: %s\n\n", mustJSON(part))
+				flusher.Flush()
+			}
+			if len(hit.Citations) > 0 {
+				d, _ := json.Marshal(hit.Citations)
+				fmt.Fprintf(w, "event: citations\ndata: %s\n\n", d)
+			}
+			if hit.Confidence != nil {
+				d, _ := json.Marshal(hit.Confidence)
+				fmt.Fprintf(w, "event: confidence\ndata: %s\n\n", d)
+			}
+			fmt.Fprintf(w, "data: [DONE]\n\n")
+			flusher.Flush()
+			chats.appendMessage(conv.ID, chatMessage{Role: "assistant", Content: hit.Answer, Citations: hit.Citations, Confidence: hit.Confidence})
+			return
+		}
+
+		// toolRequested marks answers that used tool output.
+		toolRequested := false
+		// deliverToolResult sends the outcome of a tool run to the client.
+		// Persistent tools feed the knowledge base; ephemeral results stay
+		// with this conversation only.
+		deliverToolResult := func(tr toolRequest, tres toolRun) {
+			s := settings.get()
+			if tres.err != nil {
+				res := map[string]any{"tool": tr.Tool, "query": tr.Query, "error": tres.err.Error()}
+				d, _ := json.Marshal(res)
+				fmt.Fprintf(w, "event: tool_result\ndata: %s\n\n", d)
+				flusher.Flush()
+				log.Printf("REQ %s: tool %s failed: %v", reqID, tr.Tool, tres.err)
+				return
+			}
+			policy := effectiveToolPolicy(s, tr.Tool)
+			res := map[string]any{"tool": tr.Tool, "query": tr.Query, "source": tres.source, "output": tres.text, "persisted": policy.persists()}
+			if len(tres.details.Results) > 0 {
+				res["results"], res["pages"] = tres.details.Results, tres.details.Pages
+			}
+			d, _ := json.Marshal(res)
+			fmt.Fprintf(w, "event: tool_result\ndata: %s\n\n", d)
+			flusher.Flush()
+			// The next question is searched with this query and prefers
+			// what the tool fetched.
+			sources := []string{tres.source}
+			for _, p := range tres.details.Pages {
+				if p.Error == "" && p.Text != "" {
+					sources = append(sources, p.Source)
+				}
+			}
+			chats.addFocus(conv.ID, tr.Tool, tr.Query, sources)
+			if policy.persists() {
+				prov := sourceProvenance{RequestID: reqID, ChatID: conv.ID, Tool: tr.Tool, Query: tr.Query}
+				if n, err := persistToolResult(r.Context(), col, s.ChunkSize, tres.source, tres.text, tres.details, prov); err != nil {
+					log.Printf("REQ %s: failed to add tool result to RAG: %v", reqID, err)
+				} else {
+					log.Printf("REQ %s: tool result added to RAG: %s (%d chunks)", reqID, tres.source, n)
+				}
+			} else {
+				chats.addToolResult(conv.ID, toolResult{Tool: tr.Tool, Query: tr.Query, Source: tres.source, Output: tres.text})
+				log.Printf("REQ %s: ephemeral tool result stored on chat: %s", reqID, tres.source)
+			}
+		}
+
+		var ctxText string
+		var di *debugInfo
+		var err error
+
+		// Follow-up questions are searched with the previous turn.
+		retrievalQuestion := req.Question
+		if fq := s.FollowUpQuery; (fq == "concat" || fq == "rewrite") && len(conv.Messages) > 1 && !emptyKB && !(req.Offline && fq == "rewrite") {
+			if fq == "rewrite" {
+				sendStatus("rewriting_query")
+			}
+			fqCtx, cancel := context.WithTimeout(r.Context(), followUpRewriteTimeout)
+			q, fqErr := followUpQuery(fqCtx, lm, fq, conv.Messages, req.Question)
+			cancel()
+			if r.Context().Err() != nil {
+				log.Printf("REQ %s: client went away during query rewrite", reqID)
+				return
+			}
+			retrievalQuestion = q
+			if fqErr != nil {
+				log.Printf("REQ %s: follow-up query failed, searching the question alone: %v", reqID, fqErr)
+			} else if retrievalQuestion != req.Question {
+				log.Printf("REQ %s: follow-up query (%s): %q", reqID, fq, retrievalQuestion)
+			}
+		}
+		// A question following a tool result is searched with the tool's
+		// query and prefers its sources, for this question only.
+		focus := chats.takeFocus(conv.ID)
+		if focus != nil && !emptyKB {
+			if !strings.Contains(strings.ToLower(retrievalQuestion), strings.ToLower(focus.Query)) {
+				retrievalQuestion += " " + focus.Query
+			}
+			planCtx = withFocus(planCtx, focus)
+			log.Printf("REQ %s: focus on %s result %q (%d sources)", reqID, focus.Tool, focus.Query, len(focus.Sources))
+		}
+
+		// Deep mode researches a plan of sub-questions; without a usable
+		// plan it retrieves once with a larger k.
+		var research *researchTrace
+		if req.Deep && !req.Offline && !emptyKB {
+			webTool := ""
+			for _, name := range deepWebTools {
+				if per.allowsTool(name) && effectiveToolPolicy(s, name).AutoExecute {
+					webTool = name
+					break
+				}
+			}
+			researcher := deepResearcher{
+				rag:        col,
+				lm:         lm,
+				k:          usedK,
+				confidence: s.Confidence,
+				webTool:    webTool,
+				runTool: func(ctx context.Context, tr toolRequest) toolRun {
+					toolRequested = true
+					trJSON, _ := json.Marshal(tr)
+					fmt.Fprintf(w, "event: tool_request\ndata: %s\n\n", trJSON)
+					tres := runToolsConcurrently(ctx, col, customAPIs, s, conv.ID, reqID, []toolRequest{tr})[0]
+					deliverToolResult(tr, tres)
+					return tres
+				},
+				progress: sendStatusData,
+			}
+			deepCtx, cancel := context.WithTimeout(planCtx, deepResearchBudget)
+			ctxText, di, research, err = researcher.run(deepCtx, retrievalQuestion)
+			cancel()
+			if r.Context().Err() != nil {
+				log.Printf("REQ %s: client went away during deep research", reqID)
+				return
+			}
+			if err != nil {
+				log.Printf("REQ %s: DEEP: research failed, falling back to single pass: %v", reqID, err)
+				research.Fallback = err.Error()
+			} else {
+				log.Printf("REQ %s: DEEP: %d sub-questions, %d chunks in %dms", reqID, len(research.Steps), len(di.Chunks), research.TotalMs)
+			}
+		}
+		researched := research != nil && research.Fallback == ""
+
+		// Every phase below stops once the client has gone away.
+		retrCtx, cancelRetr := context.WithTimeout(withProgress(planCtx, sendStatus), askRetrievalTimeout)
+		if req.Offline {
+			retrCtx = withoutPlanner(retrCtx)
+		}
+		switch {
+		case researched:
+		case req.Deep:
+			log.Printf("REQ %s: DEEP: k=%d (base=%d, total_chunks=%d)", reqID, usedK, baseK, totalChunks)
+			ctxText, di, err = col.prepareContextWithK(retrCtx, retrievalQuestion, req.Debug, usedK)
+		default:
+			ctxText, di, err = col.prepareContext(retrCtx, retrievalQuestion, req.Debug)
+			if di != nil {
+				di.UsedK = usedK
+			}
+		}
+		cancelRetr()
+		if err != nil && r.Context().Err() != nil {
+			log.Printf("REQ %s: client went away during retrieval: %v", reqID, err)
+			return
+		}
+		if err != nil {
+			log.Printf("REQ %s: context fetch failed: %v", reqID, err)
+			fail(&askError{Code: "retrieval_failed", Message: "Fehler beim Kontext-Abruf: " + err.Error(), Phase: "retrieval"}, "")
+			return
+		}
+		if sq := s.SimilarQuestions; !sq.Disabled && di != nil && len(di.QueryVec) > 0 {
+			if m, ok := chats.similarQuestion(conv.ID, s.EmbedModel, di.QueryVec, sq.Threshold); ok {
+				d, _ := json.Marshal(m)
+				fmt.Fprintf(w, "event: similar\ndata: %s\n\n", d)
+				flusher.Flush()
+			}
+			chats.indexQuestion(conv.ID, s.EmbedModel, di.QueryVec)
+		}
+
+		if di == nil && req.Debug {
+			di = &debugInfo{UsedK: usedK, TotalChunks: totalChunks}
+		}
+		var cites []citation
+		if di != nil && len(di.Chunks) > 0 {
+			// The research context is numbered like numberContext but
+			// labeled by sub-question.
+			numbered, c := numberContext(di.Chunks)
+			if !researched {
+				ctxText = numbered
+			}
+			cites = c
+		}
+		// emitCitations sends the citations referenced in `answer` to the
+		// client and returns them for storage.
+		emitCitations := func(answer string) []citation {
+			cited := citedOnly(cites, answer)
+			if len(cited) > 0 {
+				d, _ := json.Marshal(cited)
+				fmt.Fprintf(w, "event: citations\ndata: %s\n\n", d)
+				flusher.Flush()
+			}
+			return cited
+		}
+		// appendSources streams the source footnotes of the context after
+		// `answer` and returns the answer including them.
+		appendSources := func(answer string) string {
+			if !s.SourceFootnotes || di == nil {
+				return answer
+			}
+			block := col.sourceFootnotes(di.Chunks, s.Lang)
+			if block == "" {
+				return answer
+			}
+			fmt.Fprintf(w, "data: %s\n\n", mustJSON(block))
+			flusher.Flush()
+			return answer + block
+		}
+		emitConfidence := func(c confidence) *confidence {
+			d, _ := json.Marshal(c)
+			fmt.Fprintf(w, "event: confidence\ndata: %s\n\n", d)
+			flusher.Flush()
+			return &c
+		}
+		if tc := chats.toolResultsContext(conv.ID, 3); tc != "" {
+			ctxText = tc + ctxText
+		}
+
+		historyCount := len(conv.Messages) - 1
+		if historyCount < 0 {
+			historyCount = 0
+		}
+
+		debugBase := debugPayload{
+			RequestID:          reqID,
+			Mode:               mode,
+			AutoSearch:         req.AutoSearch,
+			Offline:            req.Offline,
+			Deep:               req.Deep,
+			Question:           req.Question,
+			UsedK:              usedK,
+			BaseK:              baseK,
+			ChunkSize:          s.ChunkSize,
+			TotalChunks:        totalChunks,
+			ContextChars:       len(ctxText),
+			HistoryMessages:    historyCount,
+			StorageMode:        storageModeLabel(rag.storageMode),
+			DBPath:             rag.dbPath,
+			Models:             debugModels{BaseURL: lm.base, ChatModel: lm.chatModel, EmbedModel: lm.embedModel, Generation: lm.generation, Temperature: gen.Temperature, MaxTokens: gen.MaxTokens},
+			Retrieval:          di,
+			SearchQuery:        di.searchQuery(),
+			PersonaID:          personaID,
+			PersonaName:        personaName,
+			PersonaPromptChars: len(personaPrompt),
+			Research:           research,
+			Focus:              focus,
+		}
+		if retrievalQuestion != req.Question {
+			debugBase.RetrievalQuery = retrievalQuestion
+		}
+		retrieval := newRetrievalRecord(di, len(ctxText), debugBase.RetrievalQuery)
+
+		// STRICT GROUNDING: refuse without an LM call when nothing in the
+		// knowledge base is relevant.
+		if strict {
+			if reason := groundingGap(di, col.retrievalOptions(usedK).RelaxedThreshold); reason != "" {
+				log.Printf("REQ %s: STRICT refusing (%s)", reqID, reason)
+				misses := nearestMisses(di, strictMisses)
+				refusal, _ := json.Marshal(map[string]any{"chat_id": conv.ID, "request_id": reqID, "refused": reason, "nearest": misses})
+				fmt.Fprintf(w, "event: meta\ndata: %s\n\n", refusal)
+				if req.Debug {
+					dbgJSON, _ := json.Marshal(debugBase)
+					fmt.Fprintf(w, "event: debug\ndata: %s\n\n", dbgJSON)
+				}
+				text := strictRefusal(s.Lang, misses)
+				streamTokens(strings.NewReader(text), w, flusher)
+				fmt.Fprintf(w, "data: [DONE]\n\n")
+				flusher.Flush()
+				chats.appendMessage(conv.ID, chatMessage{Role: "assistant", Content: text, Retrieval: retrieval, Refused: reason})
+				return
+			}
+		}
+
+		// Build answer string
+		var answer strings.Builder
+
+		// OFFLINE MODE: return context directly, no LM call
+		if req.Offline {
+			log.Printf("REQ %s: OFFLINE returning RAG context without LM call", reqID)
+			if req.Debug {
+				dbgJSON, _ := json.Marshal(debugBase)
+				fmt.Fprintf(w, "event: debug\ndata: %s\n\n", dbgJSON)
+				flusher.Flush()
+			}
+			// Answer with the best matching sentences; raw returns the
+			// whole context.
+			var chunks []debugChunk
+			if di != nil {
+				chunks = di.Chunks
+			}
+			switch {
+			case noTagged:
+				fmt.Fprintf(&answer, noTaggedAnswer, strings.Join(tags, ", "))
+			case emptyKB:
+				answer.WriteString(emptyKBAnswer)
+			case req.Raw:
+				answer.WriteString("📚 **Offline Mode** (no LLM)\n\nBased auf den verfügbaren Dokumenten:\n\n")
+				answer.WriteString(ctxText)
+			default:
+				answer.WriteString(extractiveAnswer(retrievalQuestion, chunks, offlineAnswerBudget))
+			}
+
+			streamTokens(strings.NewReader(answer.String()), w, flusher)
+			text := appendSources(answer.String())
+
+			cited := emitCitations(text)
+			conf := emitConfidence(estimateConfidence(di, s.Confidence))
+			fmt.Fprintf(w, "data: [DONE]\n\n")
+			flusher.Flush()
+			chats.appendMessage(conv.ID, chatMessage{Role: "assistant", Content: text, Citations: cited, Confidence: conf, Retrieval: retrieval})
+			return
+		}
+
+		// Normal mode: call LM with SSE streaming
+		pr, pw := io.Pipe()
+
+		allTools := per.filterTools(enabledTools(customAPIs.allTools(), s))
+		// build system prompt; in deep mode add research instructions
+		var systemPrompt string
+		if req.Deep {
+			base := buildToolSystemPrompt(ctxText, allTools, s.MaxToolsPerAnswer)
+			systemPrompt = base + "\n--- DEEP-RESEARCH MODE ---\nGib eine strukturierte, gut durchdachte Antwort basierend auf dem Kontext:\n1) Kurze Zusammenfassung der Erkenntnisse\n2) Quellenangaben: relevante Chunks und Artikel\n3) Konfidenzlevel und alternative Interpretationen\n4) Finale prägnante Antwort\nZeige keine interne Logik; nur Analyse und Ergebnis.\n"
+			if researched {
+				systemPrompt += "Der Kontext ist nach Teilfragen gegliedert. Beantworte jede Teilfrage und führe die Ergebnisse zu einer Antwort zusammen.\n"
+			}
+		} else {
+			systemPrompt = buildToolSystemPrompt(ctxText, allTools, s.MaxToolsPerAnswer)
+		}
+		if personaPrompt != "" {
+			systemPrompt = personaPrompt + "\n\n" + systemPrompt
+		}
+
+		// The context budget keeps the prompt short; a longer one means a
+		// large max_context_chars, a long persona or a bug.
+		if n := utf8.RuneCountInString(systemPrompt); n > maxSystemPromptChars {
+			log.Printf("REQ %s: WARN system prompt has %d chars (context %d, max_context_chars %d)", reqID, n, utf8.RuneCountInString(ctxText), s.MaxContextChars)
+		}
+		if s.CrossLangHint {
+			systemPrompt += crossLangNote(di)
+		}
+		switch {
+		case noTagged:
+			systemPrompt += fmt.Sprintf(noTaggedNote, strings.Join(tags, ", "))
+		case emptyKB:
+			systemPrompt += emptyKBNote
+		}
+		systemPrompt = withDateContext(systemPrompt, s)
+		debugBase.SystemPromptChars = len(systemPrompt)
+		debugBase.ContextChars = len(ctxText)
+
+		// Prepare multi-turn messages within the configured token budget
+		// Failed answers without text are not part of the dialogue.
+		past := slices.DeleteFunc(slices.Clone(conv.Messages[:len(conv.Messages)-1]), func(m chatMessage) bool {
+			return m.Error != nil && m.Content == ""
+		})
+		history, historyTokens := selectHistory(past, s.HistoryBudget)
+		msgs := make([]chatMsg, 0, len(history)+1)
+		for _, m := range history {
+			content := m.Content
+			if len(m.Citations) > 0 {
+				// Numbers refer to that answer's context, not this one.
+				content = citationMarkerRe.ReplaceAllString(content, "")
+			}
+			msgs = append(msgs, chatMsg{Role: m.Role, Content: content})
+		}
+		msgs = append(msgs, chatMsg{Role: "user", Content: req.Question})
+
+		debugBase.HistoryMessages = len(history)
+		debugBase.HistoryTokens = historyTokens
+		if req.Debug {
+			dbgJSON, _ := json.Marshal(debugBase)
+			fmt.Fprintf(w, "event: debug\ndata: %s\n\n", dbgJSON)
+			flusher.Flush()
+		}
+		if req.DebugFull {
+			analysisRaw := ""
+			if di != nil {
+				analysisRaw = di.AnalysisRaw
+			}
+			full = newDebugFull(reqID, systemPrompt, msgs, analysisRaw)
+			d, _ := json.Marshal(full)
+			fmt.Fprintf(w, "event: debug_full\ndata: %s\n\n", d)
+			flusher.Flush()
+		}
+
+		sendStatus("generating")
+		timings := &llmTimings{}
+		streamErr := make(chan error, 1)
+		go func() {
+			err := timings.chatStream(r.Context(), lm, systemPrompt, msgs, pw)
+			streamErr <- err
+			if err != nil {
+				pw.CloseWithError(err)
+				log.Printf("REQ %s: LM chat stream failed: %v", reqID, err)
+			} else {
+				pw.Close()
+			}
+		}()
+
+		streamed, serr := streamTokens(pr, w, flusher)
+		answer.WriteString(streamed)
+		received := len(streamed)
+
+		// abandoned stores what was answered before the client went away.
+		abandoned := func(phase, partial string) {
+			log.Printf("REQ %s: client went away during %s (bytes received: %d)", reqID, phase, received)
+			if partial = strings.TrimSpace(partial); partial != "" {
+				chats.addMessage(conv.ID, "assistant", partial)
+			}
+		}
+		if r.Context().Err() != nil {
+			abandoned("answer stream", stripToolRequests(answer.String()))
+			return
+		}
+
+		// Check for stream errors
+		if serr != nil {
+			log.Printf("REQ %s: WARN LM chat stream error: %v (bytes received: %d)", reqID, serr, received)
+			fail(&askError{Code: "llm_stream_failed", Message: "Fehler im LLM-Stream: " + serr.Error(), Phase: "answer stream"}, stripToolRequests(answer.String()))
+			return
+		}
+
+		// Check goroutine result
+		if err := <-streamErr; err != nil {
+			log.Printf("REQ %s: LM goroutine failed: %v (bytes before error: %d)", reqID, err, received)
+			answerStr := answer.String()
+			if trs, found, _ := parseToolRequests(answerStr); found {
+				for _, tr := range trs {
+					trJSON, _ := json.Marshal(tr)
+					fmt.Fprintf(w, "event: tool_request\ndata: %s\n\n", trJSON)
+				}
+				flusher.Flush()
+				answerStr = stripToolRequests(answerStr)
+			}
+			fail(&askError{Code: "llm_failed", Message: "LLM-Fehler: " + err.Error(), Phase: "answer stream"}, answerStr)
+			return
+		}
+
+		if received == 0 {
+			log.Printf("REQ %s: WARN LM returned no tokens despite no error", reqID)
+		}
+
+		// Tool request handling: execute requested tools and let the model
+		// continue with their output until it answers without a request or
+		// the iteration budget is exhausted.
+		segment := answer.String()
+		segments := []string{stripToolRequests(segment)}
+		convMsgs := msgs
+		phase := "answer stream"
+		// toolErr keeps the last tool failure for the stored answer.
+		var toolErr *askError
+		for iter := 0; ; iter++ {
+			trs, found, perrs := parseToolRequests(segment)
+			if !found {
+				break
+			}
+			toolRequested = true
+			for _, perr := range perrs {
+				log.Printf("REQ %s: ignoring tool request: %v", reqID, perr)
+				if req.Debug {
+					note := map[string]any{"request_id": reqID, "note": "Tool-Request konnte nicht gelesen werden: " + perr.Error()}
+					d, _ := json.Marshal(note)
+					fmt.Fprintf(w, "event: debug_note\ndata: %s\n\n", d)
+					flusher.Flush()
+				}
+			}
+			if len(trs) == 0 {
+				break
+			}
+			if iter >= s.MaxToolIterations {
+				log.Printf("REQ %s: max tool iterations (%d) reached", reqID, s.MaxToolIterations)
+				notice := fmt.Sprintf("⚠️ Maximale Anzahl an Tool-Iterationen erreicht (%d).", s.MaxToolIterations)
+				fmt.Fprintf(w, "data: %s\n\n", mustJSON("\n\n"+notice))
+				flusher.Flush()
+				segments = append(segments, notice)
+				break
+			}
+
+			// Decide per request whether to execute it automatically:
+			// within the per-answer limit, allowed for the persona and by
+			// the tool policy.
+			s := settings.get()
+			var run []toolRequest
+			for i, tr := range trs {
+				trJSON, _ := json.Marshal(tr)
+				// Notify frontend that a tool was requested
+				fmt.Fprintf(w, "event: tool_request\ndata: %s\n\n", trJSON)
+				res := map[string]any{"tool": tr.Tool, "query": tr.Query, "allowed": false}
+				switch {
+				case i >= s.MaxToolsPerAnswer:
+					log.Printf("REQ %s: tool %s skipped, more than %d requests", reqID, tr.Tool, s.MaxToolsPerAnswer)
+					res["reason"] = "limit"
+				case !per.allowsTool(tr.Tool):
+					log.Printf("REQ %s: tool %s not allowed for persona %s", reqID, tr.Tool, personaID)
+					res["reason"] = "persona"
+				case !effectiveToolPolicy(s, tr.Tool).AutoExecute:
+				default:
+					run = append(run, tr)
+					continue
+				}
+				toolHistory.record(toolAuditEntry{Time: time.Now(), ChatID: conv.ID, RequestID: reqID, Tool: tr.Tool, Query: tr.Query, Outcome: "not_allowed"})
+				d, _ := json.Marshal(res)
+				fmt.Fprintf(w, "event: tool_result\ndata: %s\n\n", d)
+			}
+			flusher.Flush()
+			if len(run) == 0 {
+				break
+			}
+
+			names := make([]string, len(run))
+			for i, tr := range run {
+				names[i] = tr.Tool
+			}
+			phase = "tool " + strings.Join(names, ", ")
+			sendStatus("executing_tool:" + strings.Join(names, ", "))
+			runs := runToolsConcurrently(r.Context(), col, customAPIs, s, conv.ID, reqID, run)
+			var hint strings.Builder
+			var lastErr *askError
+			for i, tr := range run {
+				tres := runs[i]
+				deliverToolResult(tr, tres)
+				if tres.err != nil {
+					lastErr = &askError{Code: "tool_failed", Message: "Tool " + tr.Tool + " fehlgeschlagen: " + tres.err.Error(), Phase: "tool " + tr.Tool}
+					fmt.Fprintf(&hint, "Tool %s (query %q) failed: %v\n\n", tr.Tool, tr.Query, tres.err)
+					continue
+				}
+				fmt.Fprintf(&hint, "Tool %s (query %q) returned:\n%s\n\n", tr.Tool, tr.Query, tres.text)
+			}
+			if lastErr != nil && !slices.ContainsFunc(runs, func(tr toolRun) bool { return tr.err == nil }) {
+				// Nothing to continue with.
+				toolErr = lastErr
+				sendError(toolErr)
+				break
+			}
+
+			// Continue the answer: previous assistant segment plus the tool
+			// outputs as a user hint.
+			hint.WriteString("Please continue the answer using this information.")
+			next := make([]chatMsg, 0, len(convMsgs)+2)
+			next = append(next, convMsgs...)
+			next = append(next, chatMsg{Role: "assistant", Content: segment})
+			next = append(next, chatMsg{Role: "user", Content: hint.String()})
+			convMsgs = next
+
+			fmt.Fprintf(w, "data: %s\n\n", mustJSON("\n\n"))
+			flusher.Flush()
+			phase = "tool continuation"
+			sendStatus("continuing")
+			cont, err := streamAnswerSegment(r.Context(), lm, systemPrompt, convMsgs, timings, w, flusher)
+			if err != nil && r.Context().Err() == nil {
+				log.Printf("REQ %s: LM continuation failed: %v", reqID, err)
+				toolErr = &askError{Code: "llm_failed", Message: "LLM-Fehler: " + err.Error(), Phase: phase}
+				sendError(toolErr)
+			}
+			log.Printf("REQ %s: tool-driven continuation %d complete", reqID, iter+1)
+			segment = cont
+			if cleaned := stripToolRequests(cont); cleaned != "" {
+				segments = append(segments, cleaned)
+			}
+			if err != nil {
+				break
+			}
+		}
+		answerStr := strings.Join(segments, "\n\n")
+		if r.Context().Err() != nil {
+			abandoned(phase, answerStr)
+			return
+		}
+		answerStr = appendSources(answerStr)
+
+		cited := emitCitations(answerStr)
+		conf := estimateConfidence(di, s.Confidence)
+		if req.Deep && conf.Level != "low" {
+			selfCtx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+			level, err := rag.selfAssessConfidence(selfCtx, req.Question, ctxText, answerStr)
+			cancel()
+			if err != nil {
+				log.Printf("REQ %s: confidence self-assessment failed: %v", reqID, err)
+			} else {
+				conf.Reasons = append(conf.Reasons, "Selbsteinschätzung des Modells: "+level)
+				if confidenceLevels[level] < confidenceLevels[conf.Level] {
+					conf.Level = level
+				}
+			}
+		}
+		confPtr := emitConfidence(conf)
+		d, _ := json.Marshal(timings)
+		fmt.Fprintf(w, "event: timings\ndata: %s\n\n", d)
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+		flusher.Flush()
+
+		log.Printf("REQ %s: Chat response complete: %d chars, bytes_streamed=%d, citations=%d, confidence=%s, ttfb=%dms, llm=%dms, tokens=%d", reqID, len(answerStr), received, len(cited), conf.Level, timings.TTFBMs, timings.TotalMs, timings.Tokens)
+		chats.appendMessage(conv.ID, chatMessage{Role: "assistant", Content: answerStr, Citations: cited, Confidence: confPtr, Error: toolErr, DebugFull: full, Timings: timings, Retrieval: retrieval})
+		// Tool output may be live data (weather, web search), so such
+		// answers are not replayed.
+		if cacheable && !toolRequested && strings.TrimSpace(answerStr) != "" {
+			answers.put(cacheKey, cachedAnswer{Answer: answerStr, Citations: cited, Confidence: confPtr}, s.AnswerCache.Size)
+		}
+	})
+
+	// GET /api/tools?persona_id= — list available tools with their
+	// effective policy, optionally limited to what a persona may use
+	mux.HandleFunc("/api/tools", func(w http.ResponseWriter, r *http.Request) {
+		s := settings.get()
+		type toolInfo struct {
+			toolDef
+			Policy toolPolicy `json:"policy"`
+		}
+		tools := customAPIs.allTools()
+		if off, _ := strconv.ParseBool(r.URL.Query().Get("offline")); off || s.OfflineNetwork {
+			tools = slices.DeleteFunc(tools, func(t toolDef) bool { return !localTool(t.Name) })
+		}
+		if id := r.URL.Query().Get("persona_id"); id != "" {
+			per, ok := personas.get(id)
+			if !ok {
+				http.Error(w, "unknown persona", 404)
+				return
+			}
+			tools = per.filterTools(tools)
+		}
+		var out []toolInfo
+		for _, t := range tools {
+			out = append(out, toolInfo{toolDef: t, Policy: effectiveToolPolicy(s, t.Name)})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+
+	// GET /api/tools/history?tool=&since=&until=&limit= — recent tool
+	// executions, newest first. since/until are RFC 3339 timestamps.
+	mux.HandleFunc("/api/tools/history", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var since, until time.Time
+		for _, f := range []struct {
+			name string
+			dst  *time.Time
+		}{{"since", &since}, {"until", &until}} {
+			if v := q.Get(f.name); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					http.Error(w, "invalid "+f.name+": "+err.Error(), 400)
+					return
+				}
+				*f.dst = t
+			}
+		}
+		limit := 100
+		if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 {
+			limit = v
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(toolHistory.list(q.Get("tool"), since, until, limit))
+	})
+
+	// GET /api/net-stats — outbound requests by host, tool executions
+	// and the most recent failed requests
+	mux.HandleFunc("/api/net-stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(netStats.report())
+	})
+
+	// GET /metrics — the same counters in the Prometheus text format
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		netStats.report().writeMetrics(w)
+	})
+
+	// POST /api/tool/execute — execute a tool and add results to RAG, or
+	// to the given chat for ephemeral tools. "persist" overrides the policy.
+	mux.HandleFunc("/api/tool/execute", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			toolRequest
+			Persist    *bool  `json:"persist"`
+			ChatID     string `json:"chat_id"`
+			Collection string `json:"collection"`
+			Offline    bool   `json:"offline"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Tool == "" || req.Query == "" {
+			http.Error(w, "missing tool or query", 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+
+		s := settings.get()
+		policy := effectiveToolPolicy(s, req.Tool)
+		if !policy.Enabled {
+			toolHistory.record(toolAuditEntry{Time: time.Now(), ChatID: req.ChatID, Tool: req.Tool, Query: req.Query, Outcome: "not_allowed"})
+			http.Error(w, fmt.Sprintf("Tool %q ist deaktiviert", req.Tool), 403)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(policy.TimeoutS)*time.Second)
+		defer cancel()
+		ctx, details := withToolDetails(ctx)
+		if req.Offline {
+			ctx = withOffline(ctx)
+		}
+		text, source, fetchErr := runToolAudited(ctx, col, customAPIs, s, req.ChatID, "", req.toolRequest)
+		if errors.Is(fetchErr, errOfflineNetwork) {
+			http.Error(w, fmt.Sprintf("Tool %q ist offline nicht verfügbar", req.Tool), 503)
+			return
+		}
+		if fetchErr != nil {
+			http.Error(w, fmt.Sprintf("Tool %q fehlgeschlagen: %v", req.Tool, fetchErr), 500)
+			return
+		}
+
+		persist := policy.persists()
+		if req.Persist != nil && req.Tool != "rag_search" {
+			persist = *req.Persist
+		}
+		chunks := 0
+		storedOnChat := false
+		if persist {
+			prov := sourceProvenance{ChatID: req.ChatID, Tool: req.Tool, Query: req.Query}
+			n, err := persistToolResult(r.Context(), col, s.ChunkSize, source, text, details, prov)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			chunks = n
+		} else if req.ChatID != "" {
+			storedOnChat = chats.addToolResult(req.ChatID, toolResult{Tool: req.Tool, Query: req.Query, Source: source, Output: text})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{
+			"tool":      req.Tool,
+			"query":     req.Query,
+			"source":    source,
+			"chars":     len(text),
+			"chunks":    chunks,
+			"persisted": persist,
+			"chat":      storedOnChat,
+			"output":    text,
+			"results":   details.Results,
+			"pages":     details.Pages,
+			"total":     col.docCount(),
+		}))
+	})
+
+	// POST /api/nanogo — execute Go source using the embedded nanoGo interpreter
+	mux.HandleFunc("/api/nanogo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			Source   string `json:"source"`
+			TimeoutS int    `json:"timeout_s"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Source) == "" {
+			http.Error(w, "missing source", 400)
+			return
+		}
+		s := settings.get()
+		if !s.AllowNanoGo {
+			http.Error(w, "nanoGo execution disabled in settings", 403)
+			return
+		}
+		timeout := 5 * time.Second
+		if req.TimeoutS > 0 {
+			timeout = time.Duration(req.TimeoutS) * time.Second
+		}
+		res := runNanoGo(req.Source, nanoGoLimitsFromSettings(s, timeout))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	// POST /api/smallr — execute a smallR expression using the bundled demo.
+	mux.HandleFunc("/api/smallr", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			Expr   string `json:"expr"`
+			ChatID string `json:"chat_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Expr) == "" {
+			http.Error(w, "missing expr", 400)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		out, err := execSmallRContext(ctx, req.ChatID, req.Expr)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"output": out})
+	})
+
+	// POST /api/search
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		if !llmReady(w) {
+			return
+		}
+		var req struct {
+			Query      string   `json:"query"`
+			K          int      `json:"k"`
+			Lang       string   `json:"lang"`
+			Tags       []string `json:"tags"`
+			Collection string   `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Query == "" {
+			http.Error(w, "missing query", 400)
+			return
+		}
+		tags, err := normalizeTags(req.Tags)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if _, ok := langNames[req.Lang]; req.Lang != "" && !ok {
+			http.Error(w, "unknown lang", 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		if req.K <= 0 {
+			req.K = rag.topK()
+		}
+		ctx := r.Context()
+		if len(tags) > 0 {
+			ctx = withSourceFilter(ctx, col.sourcesTagged(tags))
+		}
+		results, err := col.searchJSON(ctx, req.Query, req.K, req.Lang)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// POST /api/calibrate — derive the retrieval thresholds of the embedding
+	// model from stored chunks; {"reset": true} restores the defaults
+	mux.HandleFunc("/api/calibrate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			Collection string `json:"collection"`
+			Samples    int    `json:"samples"`
+			Reset      bool   `json:"reset"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "invalid JSON", 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		model := settings.get().EmbedModel
+		var cal scoreCalibration
+		if !req.Reset {
+			n := req.Samples
+			if n <= 0 {
+				n = defaultCalibrationSamples
+			}
+			var err error
+			if cal, err = col.calibrate(min(n, maxCalibrationSamples)); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		err := settings.update(func(st *appSettings) error {
+			if req.Reset {
+				if _, ok := st.Calibration[model]; !ok {
+					return errSettingsUnchanged
+				}
+				delete(st.Calibration, model)
+				return nil
+			}
+			if st.Calibration == nil {
+				st.Calibration = make(map[string]scoreCalibration)
+			}
+			st.Calibration[model] = cal
+			return nil
+		})
+		if err != nil && err != errSettingsUnchanged {
+			http.Error(w, "failed to save settings: "+err.Error(), 500)
+			return
+		}
+		rag.setCalibrations(settings.get().Calibration)
+		res := map[string]any{"embed_model": model, "thresholds": col.retrievalOptions(rag.topK()).thresholds()}
+		if !req.Reset {
+			res["calibration"] = cal
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	// GET /api/wiki/search?q=...&lang=...&limit=... — typeahead for add-wiki
+	mux.HandleFunc("/api/wiki/search", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		query := strings.TrimSpace(q.Get("q"))
+		if query == "" {
+			http.Error(w, "missing q", 400)
+			return
+		}
+		if settings.get().OfflineNetwork {
+			http.Error(w, errOfflineNetwork.Error(), 503)
+			return
+		}
+		lang := strings.ToLower(strings.TrimSpace(q.Get("lang")))
+		if lang == "" {
+			lang = settings.get().Lang
+		}
+		if !wikiLangRe.MatchString(lang) {
+			http.Error(w, "invalid lang", 400)
+			return
+		}
+		limit := 10
+		if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 {
+			limit = min(v, 50)
+		}
+		results, err := searchWikipedia(r.Context(), query, lang, limit)
+		if err != nil {
+			http.Error(w, err.Error(), 502)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// POST /api/add-wiki
+	mux.HandleFunc("/api/add-wiki", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		if !llmReady(w) {
+			return
+		}
+		var req struct {
+			Article    string `json:"article"`
+			Lang       string `json:"lang"`
+			Collection string `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Article == "" {
+			http.Error(w, "missing article", 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		s := settings.get()
+		if s.OfflineNetwork {
+			http.Error(w, errOfflineNetwork.Error(), 503)
+			return
+		}
+		if req.Lang == "" {
+			req.Lang = s.Lang
+		}
+		if !wikiLangRe.MatchString(req.Lang) {
+			http.Error(w, "invalid lang", 400)
+			return
+		}
+		text, err := fetchWikipedia(r.Context(), req.Article, req.Lang)
+		if err != nil {
+			log.Printf("fetchWikipedia(%q,%q) failed: %v", req.Article, req.Lang, err)
+			if sv, err2 := searchWikipedia(r.Context(), req.Article, req.Lang, 10); err2 == nil && len(sv) > 0 {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{"not_found": true, "query": req.Article, "results": sv}))
+				return
+			}
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		chunks := chunkText(text, s.ChunkSize)
+		err = col.addChunksFrom(r.Context(), req.Article, sourceOrigin{Type: "wikipedia", Ref: req.Lang + ":" + req.Article}, chunks)
+		if errors.Is(err, errSourceExists) {
+			writeDuplicate(w, col, req.Article)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{
+			"article": req.Article,
+			"chars":   len(text),
+			"chunks":  len(chunks),
+			"total":   col.docCount(),
+		}))
+	})
+
+	// POST /api/add-url
+	mux.HandleFunc("/api/add-url", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		if !llmReady(w) {
+			return
+		}
+		var req struct {
+			URL        string `json:"url"`
+			Collection string `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+			http.Error(w, "missing url", 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		if _, err := url.ParseRequestURI(req.URL); err != nil {
+			http.Error(w, "invalid url", 400)
+			return
+		}
+		s := settings.get()
+		if s.OfflineNetwork {
+			http.Error(w, errOfflineNetwork.Error(), 503)
+			return
+		}
+		title, text, err := fetchPage(r.Context(), req.URL, s.AllowedHosts)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if title != "" {
+			text = "# " + title + "\n\n" + text
+		}
+		chunks := chunkText(text, s.ChunkSize)
+		err = col.addChunksFrom(r.Context(), req.URL, sourceOrigin{Type: "url", Ref: req.URL}, chunks)
+		if errors.Is(err, errSourceExists) {
+			writeDuplicate(w, col, req.URL)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{
+			"source": req.URL,
+			"title":  title,
+			"chars":  len(text),
+			"chunks": len(chunks),
+			"total":  col.docCount(),
+		}))
+	})
+
+	// POST /api/add-folder — import all text files from a server directory
+	mux.HandleFunc("/api/add-folder", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		if !llmReady(w) {
+			return
+		}
+		var req struct {
+			Path       string `json:"path"`
+			Recursive  bool   `json:"recursive"`
+			Collection string `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			http.Error(w, "missing path", 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		root, err := resolveImportPath(req.Path)
+		if errors.Is(err, errOutsideImportRoots) {
+			http.Error(w, fmt.Sprintf("%s is outside the allowed import roots (%s); start tinyrag with -allowed-import-roots to permit other directories", req.Path, strings.Join(importRoots, ", ")), 403)
+			return
+		}
+		if err != nil {
+			http.Error(w, "path not found: "+err.Error(), 400)
+			return
+		}
+		info, err := os.Stat(root)
+		if err != nil {
+			http.Error(w, "path not found: "+err.Error(), 400)
+			return
+		}
+		if !info.IsDir() {
+			http.Error(w, "path is not a directory", 400)
+			return
+		}
+
+		allowedExts := map[string]bool{
+			".txt": true, ".md": true, ".csv": true, ".json": true,
+			".xml": true, ".html": true, ".log": true, ".htm": true,
+			".yaml": true, ".yml": true, ".toml": true, ".ini": true,
+			".cfg": true, ".conf": true, ".sql": true, ".go": true,
+			".py": true, ".js": true, ".ts": true, ".rs": true,
+			".c": true, ".h": true, ".cpp": true, ".java": true,
+		}
+
+		s := settings.get()
+		var totalFiles, totalChars, totalChunksN, skipped int
+		var errors, skippedBinary []string
+		// sources are the imported files in walk order; they form a
+		// group so that neighbor chunks cross from one file to the next.
+		var sources []string
+
+		walkFn := func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if !req.Recursive && path != root {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			ext := strings.ToLower(filepath.Ext(d.Name()))
+			if !allowedExts[ext] {
+				return nil
+			}
+			// Symlinks are only followed to files inside the import roots.
+			if d.Type()&fs.ModeSymlink != 0 {
+				if _, err := resolveImportPath(path); err != nil {
+					errors = append(errors, filepath.Base(path)+": symlink target outside the allowed import roots")
+					return nil
+				}
+			}
+			fi, err := os.Stat(path)
+			if err != nil || !fi.Mode().IsRegular() || fi.Size() > 5*1024*1024 {
+				return nil
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				errors = append(errors, filepath.Base(path)+": "+err.Error())
+				return nil
+			}
+			relPath, _ := filepath.Rel(root, path)
+			if relPath == "" {
+				relPath = filepath.Base(path)
+			}
+			text, err := decodeFileText(data)
+			if err != nil {
+				skippedBinary = append(skippedBinary, relPath)
+				return nil
+			}
+			if strings.TrimSpace(text) == "" {
+				return nil
+			}
+			source := "folder:" + relPath
+			chunks := chunkText(text, s.ChunkSize)
+			err = col.addChunksFrom(r.Context(), source, sourceOrigin{Type: "folder", Ref: path}, chunks)
+			if err == errSourceExists {
+				skipped++
+				sources = append(sources, source)
+				return nil
+			}
+			if err != nil {
+				errors = append(errors, relPath+": "+err.Error())
+				return nil
+			}
+			sources = append(sources, source)
+			totalFiles++
+			totalChars += len(text)
+			totalChunksN += len(chunks)
+			return nil
+		}
+
+		filepath.WalkDir(root, walkFn)
+		group := ""
+		if len(sources) > 1 {
+			group = "folder:" + root
+			if err := col.setSourceGroup(group, sources); err != nil {
+				errors = append(errors, "group: "+err.Error())
+				group = ""
+			}
+		}
+
+		// The import only counts as failed when no file made it in.
+		jobID := newID("job")
+		var jobErr error
+		if totalFiles == 0 && len(errors) > 0 {
+			jobErr = fmt.Errorf("%d errors, first: %s", len(errors), errors[0])
+		}
+		notifyWebhook(s, jobEvent("folder_import", jobID,
+			fmt.Sprintf("%s: %d files, %d chunks, %d already present, %d binary, %d errors", req.Path, totalFiles, totalChunksN, skipped, len(skippedBinary), len(errors)), jobErr))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{
+			"job_id":         jobID,
+			"files":          totalFiles,
+			"total_chars":    totalChars,
+			"total_chunks":   totalChunksN,
+			"skipped":        skipped,
+			"skipped_binary": skippedBinary,
+			"group":          group,
+			"total":          col.docCount(),
+			"errors":         errors,
+		}))
+	})
+
+	// POST /api/add-text
+	mux.HandleFunc("/api/add-text", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		if !llmReady(w) {
+			return
+		}
+		var req struct {
+			Title      string `json:"title"`
+			Text       string `json:"text"`
+			Collection string `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Text == "" {
+			http.Error(w, "missing text", 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		s := settings.get()
+		if req.Title == "" {
+			req.Title = "manual-" + strconv.FormatInt(time.Now().Unix(), 10)
+		}
+		chunks := chunkText(req.Text, s.ChunkSize)
+		err := col.addChunksFrom(r.Context(), req.Title, sourceOrigin{Type: "text"}, chunks)
+		if errors.Is(err, errSourceExists) {
+			writeDuplicate(w, col, req.Title)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{
+			"title":  req.Title,
+			"chars":  len(req.Text),
+			"chunks": len(chunks),
+			"total":  col.docCount(),
+		}))
+	})
+
+	// POST /api/upload
+	mux.HandleFunc("/api/upload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		if !llmReady(w) {
+			return
+		}
+		r.ParseMultipartForm(50 << 20) // allow larger archives (50MB)
+		col, ok := collectionFor(w, r.FormValue("collection"))
+		if !ok {
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "missing file: "+err.Error(), 400)
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		filename := header.Filename
+		lower := strings.ToLower(filename)
+		s := settings.get()
+		allowedExts := map[string]bool{
+			".txt": true, ".md": true, ".csv": true, ".json": true,
+			".xml": true, ".html": true, ".log": true, ".htm": true,
+			".yaml": true, ".yml": true, ".toml": true, ".ini": true,
+			".cfg": true, ".conf": true, ".sql": true, ".go": true,
+			".py": true, ".js": true, ".ts": true, ".rs": true,
+			".c": true, ".h": true, ".cpp": true, ".java": true,
+		}
+
+		var totalFiles, totalChars, totalChunks int
+		var errorsList, skippedBinary []string
+		// duplicates maps archive entries already stored to that source.
+		duplicates := map[string]string{}
+		// sources are the stored entries in archive order (see add-folder).
+		var sources []string
+
+		isZip := strings.HasSuffix(lower, ".zip")
+		isTarGz := strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz")
+
+		if isZip || isTarGz {
+			// write archive to temp file
+			tmpDir, err := os.MkdirTemp("", "upload-archive-")
+			if err != nil {
+				http.Error(w, "internal: "+err.Error(), 500)
+				return
+			}
+			defer os.RemoveAll(tmpDir)
+			tmpPath := filepath.Join(tmpDir, "archive")
+			if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+				http.Error(w, "internal: "+err.Error(), 500)
+				return
+			}
+
+			if isZip {
+				zr, err := zip.OpenReader(tmpPath)
+				if err != nil {
+					http.Error(w, "invalid zip: "+err.Error(), 400)
+					return
+				}
+				defer zr.Close()
+				for _, f := range zr.File {
+					if f.FileInfo().IsDir() {
+						continue
+					}
+					ext := strings.ToLower(filepath.Ext(f.Name))
+					if !allowedExts[ext] {
+						continue
+					}
+					rc, err := f.Open()
+					if err != nil {
+						errorsList = append(errorsList, f.Name+": "+err.Error())
+						continue
+					}
+					content, err := io.ReadAll(io.LimitReader(rc, 6*1024*1024))
+					if closeErr := rc.Close(); closeErr != nil && err == nil {
+						err = closeErr
+					}
+					if err != nil {
+						errorsList = append(errorsList, f.Name+": "+err.Error())
+						continue
+					}
+					if len(content) == 0 {
+						continue
+					}
+					text, err := decodeFileText(content)
+					if err != nil {
+						skippedBinary = append(skippedBinary, f.Name)
+						continue
+					}
+					src := "upload:" + filename + ":" + f.Name
+					chunks := chunkText(text, s.ChunkSize)
+					if existing, ok := col.sourceWithHash(chunksHash(chunks)); ok {
+						duplicates[f.Name] = existing
+						continue
+					}
+					err = col.addChunksFrom(r.Context(), src, sourceOrigin{Type: "upload", Ref: filename + ":" + f.Name}, chunks)
+					if err != nil {
+						errorsList = append(errorsList, f.Name+": "+err.Error())
+						continue
+					}
+					sources = append(sources, src)
+					totalFiles++
+					totalChars += len(text)
+					totalChunks += len(chunks)
+				}
+			} else {
+				// tar.gz
+				f, err := os.Open(tmpPath)
+				if err != nil {
+					http.Error(w, "internal: "+err.Error(), 500)
+					return
+				}
+				defer f.Close()
+				gz, err := gzip.NewReader(f)
+				if err != nil {
+					http.Error(w, "invalid gzip: "+err.Error(), 400)
+					return
+				}
+				defer gz.Close()
+				tr := tar.NewReader(gz)
+				for {
+					hdr, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						errorsList = append(errorsList, "tar read: "+err.Error())
+						break
+					}
+					if hdr.FileInfo().IsDir() {
+						continue
+					}
+					ext := strings.ToLower(filepath.Ext(hdr.Name))
+					if !allowedExts[ext] {
+						continue
+					}
+					if hdr.Size > 5*1024*1024 {
+						errorsList = append(errorsList, hdr.Name+": file too large")
+						continue
+					}
+					content, err := io.ReadAll(io.LimitReader(tr, 6*1024*1024))
+					if err != nil {
+						errorsList = append(errorsList, hdr.Name+": "+err.Error())
+						continue
+					}
+					text, err := decodeFileText(content)
+					if err != nil {
+						skippedBinary = append(skippedBinary, hdr.Name)
+						continue
+					}
+					src := "upload:" + filename + ":" + hdr.Name
+					chunks := chunkText(text, s.ChunkSize)
+					if existing, ok := col.sourceWithHash(chunksHash(chunks)); ok {
+						duplicates[hdr.Name] = existing
+						continue
+					}
+					err = col.addChunksFrom(r.Context(), src, sourceOrigin{Type: "upload", Ref: filename + ":" + hdr.Name}, chunks)
+					if err != nil {
+						errorsList = append(errorsList, hdr.Name+": "+err.Error())
+						continue
+					}
+					sources = append(sources, src)
+					totalFiles++
+					totalChars += len(text)
+					totalChunks += len(chunks)
+				}
+			}
+			group := ""
+			if len(sources) > 1 {
+				group = "upload:" + filename
+				if err := col.setSourceGroup(group, sources); err != nil {
+					errorsList = append(errorsList, "group: "+err.Error())
+					group = ""
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{
+				"archive":        header.Filename,
+				"group":          group,
+				"files":          totalFiles,
+				"chars":          totalChars,
+				"chunks":         totalChunks,
+				"duplicates":     duplicates,
+				"total":          col.docCount(),
+				"errors":         errorsList,
+				"skipped_binary": skippedBinary,
+			}))
+			return
+		}
+
+		// regular single-file upload
+		text, err := decodeFileText(data)
+		if err != nil {
+			http.Error(w, header.Filename+": "+err.Error(), 415)
+			return
+		}
+		title := filepath.Base(header.Filename)
+		origin := sourceOrigin{Type: "upload", Ref: header.Filename}
+		chunks := chunkText(text, s.ChunkSize)
+		if existing, ok := col.sourceWithHash(chunksHash(chunks)); ok {
+			writeDuplicate(w, col, existing)
+			return
+		}
+		// A different file under a taken name is replaced or stored
+		// next to it only when the client says so ("on_conflict").
+		replaced := false
+		if src, ok := col.getSource(title); ok {
+			switch r.FormValue("on_conflict") {
+			case "replace":
+				src.sourceOrigin = origin
+				if err := col.replaceSource(r.Context(), src, chunks); err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				replaced = true
+			case "keep_both":
+				title = col.freeSourceName(title)
+			case "":
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(409)
+				json.NewEncoder(w).Encode(map[string]any{
+					"conflict":        "name",
+					"existing_source": title,
+					"message":         fmt.Sprintf("Es gibt bereits eine Quelle %q mit anderem Inhalt.", title),
+					"options":         []string{"replace", "keep_both"},
+				})
+				return
+			default:
+				http.Error(w, "on_conflict must be replace or keep_both", 400)
+				return
+			}
+		}
+		if !replaced {
+			err := col.addChunksFrom(r.Context(), title, origin, chunks)
+			if errors.Is(err, errSourceExists) {
+				http.Error(w, fmt.Sprintf("source %q was added meanwhile", title), 409)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{
+			"file":     title,
+			"chars":    len(text),
+			"chunks":   len(chunks),
+			"replaced": replaced,
+			"total":    col.docCount(),
+		}))
+	})
+
+	// GET /api/stats
+	mux.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		col, ok := collectionFor(w, r.URL.Query().Get("collection"))
+		if !ok {
+			return
+		}
+		st := col.kbStats()
+		st["fetch_cache"] = fetcher.stats()
+		st["answer_cache"] = answers.stats()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	})
+
+	// GET /api/db/export — all collections as a JSONL dump
+	mux.HandleFunc("/api/db/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="tinyrag-dump.jsonl"`)
+		if _, err := rag.exportDump(w, settings.get().EmbedModel); err != nil {
+			log.Printf("export failed: %v", err)
+		}
+	})
+
+	// POST /api/db/import — add the sources of a JSONL dump (request body)
+	mux.HandleFunc("/api/db/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		s := settings.get()
+		jobID := newID("job")
+		st, err := rag.importDump(r.Body, s.EmbedModel)
+		notifyWebhook(s, jobEvent("db_import", jobID, fmt.Sprintf("%d sources, %d chunks, %d skipped", st.Sources, st.Chunks, st.Skipped), err))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{"job_id": jobID, "import": st}))
+	})
+
+	// POST /api/db/reembed — recompute all embeddings with the configured model
+	mux.HandleFunc("/api/db/reembed", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		if !llmReady(w) {
+			return
+		}
+		s := settings.get()
+		jobID := newID("job")
+		n, err := rag.reembed()
+		notifyWebhook(s, jobEvent("reembed", jobID, fmt.Sprintf("%d chunks re-embedded with %s", n, s.EmbedModel), err))
+		if err != nil {
+			http.Error(w, err.Error(), 502)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"job_id": jobID, "reembedded": n, "embed_model": s.EmbedModel})
+	})
+
+	// POST /api/db/compact — remove duplicates and orphans, rewrite the database
+	mux.HandleFunc("/api/db/compact", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		st, err := rag.compact()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"compact": st})
+	})
+
+	// GET /api/health — LLM reachability and proxy in effect
+	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		lm := rag.getLM()
+		res := map[string]any{"ok": true, "llm": "ok", "proxy": proxyStatus(lm.base), "base_url": lm.base}
+		err := lm.ping()
+		if err != nil {
+			res["ok"], res["llm"] = false, err.Error()
+		}
+		// A successful check ends the degraded mode started without LLM;
+		// a failed one does not start it, transient errors are reported
+		// by the requests themselves.
+		if err == nil && rag.lmError() != nil {
+			rag.setLMError(nil)
+			log.Printf("LLM endpoint %s is reachable again", lm.base)
+		}
+		res["degraded"] = rag.lmError() != nil
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	// GET /api/sources
+	mux.HandleFunc("/api/sources", func(w http.ResponseWriter, r *http.Request) {
+		col, ok := collectionFor(w, r.URL.Query().Get("collection"))
+		if !ok {
+			return
+		}
+		// Sources with a refresh schedule or history carry its state.
+		type sourceEntry struct {
+			sourceInfo
+			Refresh *refreshState `json:"refresh,omitempty"`
+		}
+		states := col.refreshStates()
+		sources := col.listSources()
+		// ?tag= lists only the sources carrying that tag.
+		if tag := r.URL.Query().Get("tag"); tag != "" {
+			tag = strings.ToLower(strings.TrimSpace(tag))
+			sources = slices.DeleteFunc(sources, func(src sourceInfo) bool { return !slices.Contains(src.Tags, tag) })
+		}
+		out := make([]sourceEntry, len(sources))
+		for i, src := range sources {
+			out[i].sourceInfo = src
+			if st, ok := states[src.Name]; ok {
+				out[i].Refresh = &st
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+
+	// GET /api/sources/preview?article=...&max_chars=2000
+	mux.HandleFunc("/api/sources/preview", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		article := q.Get("article")
+		if article == "" {
+			http.Error(w, "missing article", 400)
+			return
+		}
+		maxChars := defaultPreviewChars
+		if v := q.Get("max_chars"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxPreviewChars {
+				http.Error(w, fmt.Sprintf("max_chars must be between 1 and %d", maxPreviewChars), 400)
+				return
+			}
+			maxChars = n
+		}
+		col, ok := collectionFor(w, q.Get("collection"))
+		if !ok {
+			return
+		}
+		p, ok := col.previewSource(article, maxChars)
+		if !ok {
+			http.Error(w, "unknown source", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	})
+
+	// POST /api/sources/schedule — {"article", "interval_s"}; 0 disables
+	mux.HandleFunc("/api/sources/schedule", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			Article    string `json:"article"`
+			IntervalS  int    `json:"interval_s"`
+			Collection string `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Article == "" {
+			http.Error(w, "missing article", 400)
+			return
+		}
+		interval := time.Duration(req.IntervalS) * time.Second
+		if interval != 0 && (interval < minRefreshInterval || interval > maxRefreshBackoff) {
+			http.Error(w, fmt.Sprintf("interval_s must be 0 or between %d and %d", int(minRefreshInterval.Seconds()), int(maxRefreshBackoff.Seconds())), 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		st, err := col.setRefreshInterval(req.Article, interval)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{"article": req.Article, "refresh": st}))
+	})
+
+	// POST /api/sources/tags — replace the tags of a source
+	mux.HandleFunc("/api/sources/tags", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			Article    string   `json:"article"`
+			Tags       []string `json:"tags"`
+			Collection string   `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Article == "" {
+			http.Error(w, "missing article", 400)
+			return
+		}
+		tags, err := normalizeTags(req.Tags)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		if err := col.setSourceTags(req.Article, tags); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{"article": req.Article, "tags": tags}))
+	})
+
+	// POST /api/sources/group — set the ordered members of a source group
+	mux.HandleFunc("/api/sources/group", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			Group      string   `json:"group"`
+			Sources    []string `json:"sources"`
+			Collection string   `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Group == "" {
+			http.Error(w, "missing group", 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		if err := col.setSourceGroup(req.Group, req.Sources); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{"group": req.Group, "sources": req.Sources}))
+	})
+
+	// POST /api/sources/refresh — re-fetch a URL or Wikipedia source now
+	mux.HandleFunc("/api/sources/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		if !llmReady(w) {
+			return
+		}
+		var req struct {
+			Article    string `json:"article"`
+			Collection string `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Article == "" {
+			http.Error(w, "missing article", 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		if src, ok := col.getSource(req.Article); !ok {
+			http.Error(w, "unknown source", 404)
+			return
+		} else if !refreshable(src.sourceOrigin) {
+			http.Error(w, "source "+req.Article+" ("+src.Type+") cannot be refreshed", 400)
+			return
+		}
+		status, err := col.refreshSource(r.Context(), req.Article, settings.get())
+		if err == errRefreshRunning {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		if err == errOfflineNetwork {
+			http.Error(w, err.Error(), 503)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 502)
+			return
+		}
+		src, _ := col.getSource(req.Article)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{"article": req.Article, "status": status, "chunks": src.ChunkCount, "refresh": col.refreshStates()[req.Article]}))
+	})
+
+	// GET /api/sources/graph?threshold=0.8&max_edges=5 — related sources
+	mux.HandleFunc("/api/sources/graph", func(w http.ResponseWriter, r *http.Request) {
+		col, ok := collectionFor(w, r.URL.Query().Get("collection"))
+		if !ok {
+			return
+		}
+		threshold, maxEdges := defaultGraphThreshold, defaultGraphMaxEdges
+		if v := r.URL.Query().Get("threshold"); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < -1 || f > 1 {
+				http.Error(w, "threshold must be between -1 and 1", 400)
+				return
+			}
+			threshold = f
+		}
+		if v := r.URL.Query().Get("max_edges"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxGraphMaxEdges {
+				http.Error(w, fmt.Sprintf("max_edges must be between 1 and %d", maxGraphMaxEdges), 400)
+				return
+			}
+			maxEdges = n
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(col.sourceGraph(threshold, maxEdges))
+	})
+
+	// GET /api/collections — list; POST — create {"name": "..."}
+	mux.HandleFunc("/api/collections", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var req struct {
+				Name string `json:"name"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+				http.Error(w, "missing name", 400)
+				return
+			}
+			if err := rag.createCollection(req.Name); err != nil {
+				code := 400
+				if errors.Is(err, errCollectionExists) {
+					code = 409
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+		default:
+			http.Error(w, "GET or POST only", 405)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{"collections": rag.listCollections()}))
+	})
+
+	// POST /api/collections/delete — drop a collection with all its chunks
+	mux.HandleFunc("/api/collections/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, "missing name", 400)
+			return
+		}
+		if err := rag.deleteCollection(req.Name); err != nil {
+			code := 400
+			if errors.Is(err, errUnknownCollection) {
+				code = 404
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{"deleted": req.Name, "collections": rag.listCollections()}))
+	})
+
+	// POST /api/sources/delete
+	mux.HandleFunc("/api/sources/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			Article    string `json:"article"`
+			Collection string `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Article == "" {
+			http.Error(w, "missing article", 400)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		if err := col.deleteSource(req.Article); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{"deleted": req.Article, "total": col.docCount()}))
+	})
+
+	// POST /api/sql — read-only SELECT over the knowledge base
+	mux.HandleFunc("/api/sql", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			Query      string `json:"query"`
+			MaxRows    int    `json:"max_rows"`
+			Collection string `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Query) == "" {
+			http.Error(w, "missing query", 400)
+			return
+		}
+		// The endpoint follows the policy of the sql tool, which is
+		// disabled by default.
+		if !effectiveToolPolicy(settings.get(), "sql").Enabled {
+			http.Error(w, "the sql tool is disabled in tool_policy", 403)
+			return
+		}
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		cols, rows, err := col.querySQL(ctx, req.Query, req.MaxRows)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"columns":  cols,
+			"rows":     rows,
+			"count":    len(rows),
+			"markdown": sqlMarkdownTable(cols, rows),
+		})
+	})
+
+	// POST /api/sources/cleanup-ephemeral — delete sources created by
+	// ephemeral tools before they stopped being embedded.
+	mux.HandleFunc("/api/sources/cleanup-ephemeral", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		col, ok := collectionFor(w, r.URL.Query().Get("collection"))
+		if !ok {
+			return
+		}
+		var deleted []string
+		for _, src := range col.listSources() {
+			article := src.Name
+			for _, prefix := range ephemeralSourcePrefixes {
+				if !strings.HasPrefix(article, prefix) {
+					continue
+				}
+				if err := col.deleteSource(article); err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				deleted = append(deleted, article)
+				break
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{"deleted": deleted, "count": len(deleted), "total": col.docCount()}))
+	})
+
+	// POST /api/sources/cleanup-tools — {"older_than_days", "deleted_chats",
+	// "dry_run"}; delete tool results stored more than N days ago or for
+	// conversations that were deleted since.
+	mux.HandleFunc("/api/sources/cleanup-tools", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			OlderThanDays int  `json:"older_than_days"`
+			DeletedChats  bool `json:"deleted_chats"`
+			DryRun        bool `json:"dry_run"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", 400)
+			return
+		}
+		if req.OlderThanDays < 0 || (req.OlderThanDays == 0 && !req.DeletedChats) {
+			http.Error(w, "older_than_days > 0 or deleted_chats required", 400)
+			return
+		}
+		col, ok := collectionFor(w, r.URL.Query().Get("collection"))
+		if !ok {
+			return
+		}
+		var before time.Time
+		if req.OlderThanDays > 0 {
+			before = time.Now().AddDate(0, 0, -req.OlderThanDays)
+		}
+		var chatExists func(string) bool
+		if req.DeletedChats {
+			chatExists = func(id string) bool { return chats.get(id) != nil }
+		}
+		stale := staleToolSources(col.listSources(), before, chatExists)
+		if stale == nil {
+			stale = []string{}
+		}
+		deleted := []string{}
+		if !req.DryRun {
+			for _, name := range stale {
+				if err := col.deleteSource(name); err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				deleted = append(deleted, name)
+			}
+			if len(deleted) > 0 {
+				log.Printf("Deleted %d stale tool sources", len(deleted))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withSaveWarning(rag, map[string]any{"matched": stale, "deleted": deleted, "count": len(deleted), "total": col.docCount()}))
+	})
+
+	// GET /api/chats — list conversations
+	mux.HandleFunc("/api/chats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(chats.list())
+	})
+
+	// GET /api/insights/low-recall?threshold=0.55&days=30&limit=200 —
+	// recent questions whose retrieval scored low, grouped by source
+	mux.HandleFunc("/api/insights/low-recall", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		threshold := settings.get().Confidence.Low
+		if v := q.Get("threshold"); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 1 {
+				http.Error(w, "threshold must be between 0 and 1", 400)
+				return
+			}
+			threshold = f
+		}
+		days := defaultLowRecallDays
+		if v := q.Get("days"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "days must be 0 (all) or more", 400)
+				return
+			}
+			days = n
+		}
+		limit := defaultLowRecallLimit
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxLowRecallLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxLowRecallLimit), 400)
+				return
+			}
+			limit = n
+		}
+		var since time.Time
+		if days > 0 {
+			since = time.Now().AddDate(0, 0, -days)
+		}
+		questions := chats.lowRecallQuestions(threshold, since, q.Get("collection"), limit)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"threshold": threshold,
+			"days":      days,
+			"questions": len(questions),
+			"groups":    groupLowRecall(questions),
+		})
+	})
+
+	// GET /api/chat/<id> and DELETE /api/chat/<id>
+	mux.HandleFunc("/api/chat/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/chat/")
+		if id == "" {
+			http.Error(w, "missing chat id", 400)
+			return
+		}
+		if r.Method == "DELETE" {
+			chats.remove(id)
+			smallrSessions.drop(id)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"ok":true}`)
+			return
+		}
+		conv := chats.get(id)
+		if conv == nil {
+			http.Error(w, "not found", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(conv)
+	})
+
+	// POST /api/chats/new
+	mux.HandleFunc("/api/chats/new", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			Persona    string `json:"persona_id"`
+			Collection string `json:"collection"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		col, ok := collectionFor(w, req.Collection)
+		if !ok {
+			return
+		}
+		conv := chats.create("", req.Persona)
+		if req.Collection != "" {
+			chats.setCollection(conv.ID, col.collection)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(conv)
+	})
+
+	// POST /api/chats/import — import OpenAI/ChatGPT exports or native chats
+	mux.HandleFunc("/api/chats/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 200<<20))
+		if err != nil {
+			http.Error(w, "failed to read body: "+err.Error(), 400)
+			return
+		}
+		raw = bytes.TrimSpace(raw)
+		index := r.URL.Query().Get("index") == "true" || r.URL.Query().Get("index") == "1"
+
+		// Accepted shapes: a bare conversations.json array, or an object
+		// with "conversations" (OpenAI) and/or "chats" (native) plus "index".
+		var req struct {
+			Conversations []json.RawMessage `json:"conversations"`
+			Chats         []json.RawMessage `json:"chats"`
+			Index         bool              `json:"index"`
+		}
+		if len(raw) > 0 && raw[0] == '[' {
+			if err := json.Unmarshal(raw, &req.Conversations); err != nil {
+				http.Error(w, "invalid JSON: "+err.Error(), 400)
+				return
+			}
+		} else if err := json.Unmarshal(raw, &req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), 400)
+			return
+		}
+		index = index || req.Index
+
+		var converted []conversation
+		var errorsList []string
+		for i, item := range req.Conversations {
+			var oc openAIExportConversation
+			if err := json.Unmarshal(item, &oc); err != nil {
+				errorsList = append(errorsList, fmt.Sprintf("conversation %d: %v", i, err))
+				continue
+			}
+			c, err := convertOpenAIConversation(oc)
+			if err != nil {
+				errorsList = append(errorsList, fmt.Sprintf("conversation %d (%s): %v", i, oc.Title, err))
+				continue
+			}
+			converted = append(converted, c)
+		}
+		for i, item := range req.Chats {
+			var c conversation
+			if err := json.Unmarshal(item, &c); err != nil {
+				errorsList = append(errorsList, fmt.Sprintf("chat %d: %v", i, err))
+				continue
+			}
+			if c.ID == "" {
+				errorsList = append(errorsList, fmt.Sprintf("chat %d (%s): missing id", i, c.Title))
+				continue
+			}
+			converted = append(converted, c)
+		}
+
+		added, skipped := chats.importConversations(converted)
+
+		indexedChunks, indexSkipped := 0, 0
+		if index {
+			s := settings.get()
+			for _, c := range added {
+				var answers []string
+				for _, m := range c.Messages {
+					if m.Role == "assistant" {
+						answers = append(answers, m.Content)
+					}
+				}
+				if len(answers) == 0 {
+					continue
+				}
+				chunks := chunkText(strings.Join(answers, "\n\n"), s.ChunkSize)
+				err := rag.addChunks(r.Context(), chatImportSource(c), chunks)
+				if errors.Is(err, errSourceExists) {
+					indexSkipped++
+					continue
+				}
+				if err != nil {
+					errorsList = append(errorsList, fmt.Sprintf("index %s: %v", c.Title, err))
+					continue
+				}
+				indexedChunks += len(chunks)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"imported":      len(added),
+			"skipped":       skipped,
+			"indexed":       indexedChunks,
+			"index_skipped": indexSkipped,
+			"errors":        errorsList,
+			"total":         rag.docCount(),
+		})
+	})
+
+	// Custom APIs (persisted)
+	mux.HandleFunc("/api/settings/apis", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			list := customAPIs.list()
+			for i := range list {
+				list[i] = list[i].masked()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+		case "POST":
+			var req customAPI
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid JSON", 400)
+				return
+			}
+			if err := req.validate(); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			api, err := customAPIs.add(req)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(api.masked())
+		default:
+			http.Error(w, "GET or POST only", 405)
+		}
+	})
+
+	// Try a custom API definition without saving it. With an id the stored
+	// definition (including unmasked headers) is used; extract may override.
+	mux.HandleFunc("/api/settings/apis/test", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
 		var req struct {
-			Question   string `json:"question"`
-			ChatID     string `json:"chat_id"`
-			Debug      bool   `json:"debug"`
-			Deep       bool   `json:"deep"`
-			Offline    bool   `json:"offline"`
-			AutoSearch bool   `json:"auto_search"`
-			PersonaID  string `json:"persona_id"`
+			customAPI
+			Query string `json:"query"`
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Question) == "" {
-			http.Error(w, "missing question", 400)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", 400)
 			return
 		}
-
-		s := settings.get()
-
-		var conv *conversation
-		if req.ChatID != "" {
-			conv = chats.get(req.ChatID)
+		api := req.customAPI
+		if req.ID != "" {
+			stored, ok := customAPIs.get(req.ID)
+			if !ok {
+				http.Error(w, "not found", 404)
+				return
+			}
+			if req.Extract != "" {
+				stored.Extract = req.Extract
+			}
+			api = stored
 		}
-		personaID := strings.TrimSpace(req.PersonaID)
-		if conv != nil && personaID == "" {
-			personaID = conv.Persona
+		if err := api.validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
 		}
-		if personaID == "" {
-			personaID = personas.defaultID()
+		q := strings.TrimSpace(req.Query)
+		if q == "" {
+			q = "test"
 		}
-		if conv == nil {
-			conv = chats.create("", personaID)
-		} else if conv.Persona != personaID {
-			conv.Persona = personaID
-			chats.setPersona(conv.ID, personaID)
+		raw, status, err := customAPIRequest(r.Context(), api, q, settings.get().AllowedHosts)
+		if err != nil {
+			http.Error(w, err.Error(), 502)
+			return
 		}
-		chats.addMessage(conv.ID, "user", req.Question)
+		text, extracted, convErr := customAPIText(api, raw)
+		const maxRaw = 20000
+		rawText := truncate(string(raw), maxRaw)
+		truncated := rawText != string(raw)
+		out := map[string]any{
+			"status":        status,
+			"raw":           rawText,
+			"raw_truncated": truncated,
+			"extracted":     extracted,
+			"text":          text,
+		}
+		if convErr != nil {
+			out["error"] = convErr.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
 
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		flusher, ok := w.(http.Flusher)
+	mux.HandleFunc("/api/settings/apis/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			http.Error(w, "missing id", 400)
+			return
+		}
+		ok, err := customAPIs.remove(req.ID)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 		if !ok {
-			http.Error(w, "streaming not supported", 500)
+			http.Error(w, "not found", 404)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ok":true}`)
+	})
 
-		totalChunks := rag.docCount()
-		usedK := rag.k
-		mode := "normal"
-		if req.Deep {
-			usedK = rag.k * 3
-			if usedK < 10 {
-				usedK = 10
+	// Personas (persisted)
+	// checkPersona verifies that a persona's tools exist and its chat
+	// model is offered by the LLM endpoint.
+	checkPersona := func(w http.ResponseWriter, p persona) bool {
+		tools := customAPIs.allTools()
+		for _, name := range p.AllowedTools {
+			if !slices.ContainsFunc(tools, func(t toolDef) bool { return t.Name == name }) {
+				http.Error(w, fmt.Sprintf("unknown tool %q", name), 400)
+				return false
 			}
-			if usedK > totalChunks {
-				usedK = totalChunks
+		}
+		if p.ChatModel == "" {
+			return true
+		}
+		models, err := rag.getLM().listModels(context.Background(), "")
+		if err != nil {
+			http.Error(w, "cannot verify chat_model: "+err.Error(), 502)
+			return false
+		}
+		if !slices.Contains(models, p.ChatModel) {
+			http.Error(w, fmt.Sprintf("unknown chat_model %q", p.ChatModel), 400)
+			return false
+		}
+		return true
+	}
+
+	mux.HandleFunc("/api/personas", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(personas.list())
+		case "POST":
+			var req persona
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid JSON", 400)
+				return
 			}
-			if usedK > 50 {
-				usedK = 50 // hard cap to avoid huge prompts
+			if err := req.validate(); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
 			}
-			mode = "deep"
+			if !checkPersona(w, req) {
+				return
+			}
+			p, err := personas.add(req)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(p)
+		default:
+			http.Error(w, "GET or POST only", 405)
 		}
-		if req.Offline {
-			mode = "offline"
+	})
+
+	mux.HandleFunc("/api/personas/update", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
 		}
+		var req persona
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			http.Error(w, "missing id", 400)
+			return
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if !checkPersona(w, req) {
+			return
+		}
+		p, ok, err := personas.update(req)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if !ok {
+			http.Error(w, "not found", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	})
 
-		personaName := ""
-		personaPrompt := ""
-		if personaID != "" {
-			if per, ok := personas.get(personaID); ok {
-				personaName = per.Name
-				personaPrompt = per.Prompt
-			}
+	// GET /api/personas/export — personas as JSON for another instance
+	mux.HandleFunc("/api/personas/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="personas.json"`)
+		json.NewEncoder(w).Encode(map[string]any{"version": 1, "personas": personas.list()})
+	})
+
+	// POST /api/personas/import — accepts the export format or a bare
+	// array; IDs are regenerated and existing names are skipped.
+	mux.HandleFunc("/api/personas/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 10<<20))
+		if err != nil {
+			http.Error(w, "failed to read body: "+err.Error(), 400)
+			return
+		}
+		raw = bytes.TrimSpace(raw)
+		var req struct {
+			Personas []persona `json:"personas"`
+		}
+		if len(raw) > 0 && raw[0] == '[' {
+			err = json.Unmarshal(raw, &req.Personas)
+		} else {
+			err = json.Unmarshal(raw, &req)
+		}
+		if err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), 400)
+			return
+		}
+		created, skipped, err := personas.importPersonas(req.Personas)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"created": created, "skipped": skipped})
+	})
 
-		metaPayload := map[string]any{
-			"chat_id":       conv.ID,
-			"title":         conv.Title,
-			"request_id":    reqID,
-			"mode":          mode,
-			"k":             usedK,
-			"base_k":        rag.k,
-			"chunk_size":    s.ChunkSize,
-			"total_chunks":  totalChunks,
-			"storage_mode":  storageModeLabel(rag.storageMode),
-			"db_path":       rag.dbPath,
-			"auto_search":   req.AutoSearch,
-			"debug":         req.Debug,
-			"deep":          req.Deep,
-			"offline":       req.Offline,
-			"message_count": len(conv.Messages),
-			"created":       conv.Created,
-			"updated":       conv.Updated,
-			"persona_id":    personaID,
-			"persona_name":  personaName,
-			"models": map[string]string{
-				"base_url":    s.BaseURL,
-				"chat_model":  s.ChatModel,
-				"embed_model": s.EmbedModel,
-			},
+	// POST /api/personas/install-defaults — add the built-in personas
+	// whose names are missing, in the configured language
+	mux.HandleFunc("/api/personas/install-defaults", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
 		}
-		meta, _ := json.Marshal(metaPayload)
-		fmt.Fprintf(w, "event: meta\ndata: %s\n\n", meta)
-		flusher.Flush()
+		created, skipped, err := personas.importPersonas(builtinPersonas(settings.get().Lang))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"created": created, "skipped": skipped})
+	})
+
+	mux.HandleFunc("/api/personas/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		var req struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			http.Error(w, "missing id", 400)
+			return
+		}
+		ok, err := personas.remove(req.ID)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if !ok {
+			http.Error(w, "not found", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ok":true}`)
+	})
 
-		log.Printf("ASK[%s] chat=%s mode=%s debug=%t deep=%t offline=%t auto_search=%t q=%q", reqID, conv.ID, mode, req.Debug, req.Deep, req.Offline, req.AutoSearch, req.Question)
+	return mux
+}
 
-		// Prepare context: support Deep-Research mode with larger K
-		var ctxText string
-		var di *debugInfo
-		var err error
+// toolDetails collects structured output of a tool besides its text,
+// such as websearch results and the pages it followed.
+type toolDetails struct {
+	Results []webResult `json:"results,omitempty"`
+	Pages   []webPage   `json:"pages,omitempty"`
+}
 
-		if req.Deep {
-			log.Printf("REQ %s: DEEP: k=%d (base=%d, total_chunks=%d)", reqID, usedK, rag.k, totalChunks)
-			ctxText, di, err = rag.prepareContextWithK(req.Question, req.Debug, usedK)
-		} else {
-			ctxText, di, err = rag.prepareContext(req.Question, req.Debug)
-			if di != nil {
-				di.UsedK = usedK
+type toolDetailsKey struct{}
+
+// withToolDetails returns a context in which executeTool records
+// structured output into the returned toolDetails.
+func withToolDetails(ctx context.Context) (context.Context, *toolDetails) {
+	d := &toolDetails{}
+	return context.WithValue(ctx, toolDetailsKey{}, d), d
+}
+
+// toolDetailsFrom returns the toolDetails of `ctx`, or nil.
+func toolDetailsFrom(ctx context.Context) *toolDetails {
+	d, _ := ctx.Value(toolDetailsKey{}).(*toolDetails)
+	return d
+}
+
+// persistToolResult embeds a tool result. Pages followed by the tool are
+// stored under their own sources instead of the tool output, which
+// only repeats excerpts of them. Every stored source records `prov`,
+// stamped with the current time. It returns the number of chunks added.
+func persistToolResult(ctx context.Context, rag *ragSystem, chunkSize int, source, text string, d *toolDetails, prov sourceProvenance) (int, error) {
+	prov.At = time.Now().UTC().Format(time.RFC3339)
+	var pages []webPage
+	if d != nil {
+		for _, p := range d.Pages {
+			if p.Error == "" && p.Text != "" {
+				pages = append(pages, p)
 			}
 		}
-		if err != nil {
-			log.Printf("REQ %s: context fetch failed: %v", reqID, err)
-			fmt.Fprintf(w, "data: %s\n\n", mustJSON("Fehler beim Kontext-Abruf: "+err.Error()))
-			fmt.Fprintf(w, "data: [DONE]\n\n")
-			flusher.Flush()
-			return
+	}
+	if len(pages) == 0 {
+		chunks := chunkText(text, chunkSize)
+		err := rag.addSourceChunks(ctx, sourceInfo{Name: source, sourceOrigin: inferOrigin(source), Provenance: &prov}, chunks)
+		if errors.Is(err, errSourceExists) {
+			return 0, nil
 		}
-
-		if di == nil && req.Debug {
-			di = &debugInfo{UsedK: usedK, TotalChunks: totalChunks}
+		return len(chunks), err
+	}
+	n := 0
+	for _, p := range pages {
+		chunks := chunkText("# "+p.Title+"\n"+p.URL+"\n\n"+p.Text, chunkSize)
+		err := rag.addSourceChunks(ctx, sourceInfo{Name: p.Source, sourceOrigin: sourceOrigin{Type: "websearch", Ref: p.URL}, Provenance: &prov}, chunks)
+		if errors.Is(err, errSourceExists) {
+			continue
 		}
-
-		historyCount := len(conv.Messages) - 1
-		if historyCount < 0 {
-			historyCount = 0
+		if err != nil {
+			return n, err
 		}
+		n += len(chunks)
+	}
+	return n, nil
+}
 
-		debugBase := debugPayload{
-			RequestID:          reqID,
-			Mode:               mode,
-			AutoSearch:         req.AutoSearch,
-			Offline:            req.Offline,
-			Deep:               req.Deep,
-			Question:           req.Question,
-			UsedK:              usedK,
-			BaseK:              rag.k,
-			ChunkSize:          s.ChunkSize,
-			TotalChunks:        totalChunks,
-			ContextChars:       len(ctxText),
-			HistoryMessages:    historyCount,
-			StorageMode:        storageModeLabel(rag.storageMode),
-			DBPath:             rag.dbPath,
-			Models:             debugModels{BaseURL: s.BaseURL, ChatModel: s.ChatModel, EmbedModel: s.EmbedModel},
-			Retrieval:          di,
-			PersonaID:          personaID,
-			PersonaName:        personaName,
-			PersonaPromptChars: len(personaPrompt),
-		}
+// errOfflineNetwork is returned instead of fetching anything over the
+// network while offline mode is active.
+var errOfflineNetwork = errors.New("offline mode: network access disabled")
 
-		// Build answer string
-		var answer strings.Builder
+// localTools run without any outbound request besides the LLM endpoint.
+var localTools = []string{"calculate", "rag_search", "sql", "exec_code", "nanogo", "python"}
 
-		// OFFLINE MODE: return context directly, no LM call
-		if req.Offline {
-			log.Printf("REQ %s: OFFLINE returning RAG context without LM call", reqID)
-			if req.Debug {
-				dbgJSON, _ := json.Marshal(debugBase)
-				fmt.Fprintf(w, "event: debug\ndata: %s\n\n", dbgJSON)
-				flusher.Flush()
-			}
-			// Format context as a simple summary
-			answer.WriteString("📚 **Offline Mode** (no LLM)\n\nBased auf den verfügbaren Dokumenten:\n\n")
-			answer.WriteString(ctxText)
+// localTool reports whether tool `name` works offline. Custom APIs and
+// plugins are treated as network tools.
+func localTool(name string) bool {
+	return slices.Contains(localTools, name)
+}
 
-			// Stream the offline answer character by character
-			for _, ch := range answer.String() {
-				data, _ := json.Marshal(string(ch))
-				fmt.Fprintf(w, "data: %s\n\n", data)
-				flusher.Flush()
-			}
+type offlineKey struct{}
 
-			fmt.Fprintf(w, "data: [DONE]\n\n")
-			flusher.Flush()
-			chats.addMessage(conv.ID, "assistant", answer.String())
-			return
-		}
+// withOffline marks `ctx` as belonging to an offline request, so that
+// executeTool refuses network tools even without OfflineNetwork.
+func withOffline(ctx context.Context) context.Context {
+	return context.WithValue(ctx, offlineKey{}, true)
+}
 
-		// Normal mode: call LM with SSE streaming
-		pr, pw := io.Pipe()
+// isOffline reports whether network access is disabled for `ctx`.
+func isOffline(ctx context.Context, s appSettings) bool {
+	off, _ := ctx.Value(offlineKey{}).(bool)
+	return off || s.OfflineNetwork
+}
 
-		allTools := customAPIs.allTools()
-		// build system prompt; in deep mode add research instructions
-		var systemPrompt string
-		if req.Deep {
-			base := buildToolSystemPrompt(ctxText, allTools)
-			systemPrompt = base + "\n--- DEEP-RESEARCH MODE ---\nGib eine strukturierte, gut durchdachte Antwort basierend auf dem Kontext:\n1) Kurze Zusammenfassung der Erkenntnisse\n2) Quellenangaben: relevante Chunks und Artikel\n3) Konfidenzlevel und alternative Interpretationen\n4) Finale prägnante Antwort\nZeige keine interne Logik; nur Analyse und Ergebnis.\n"
-		} else {
-			systemPrompt = buildToolSystemPrompt(ctxText, allTools)
+// executeTool runs the tool requested by `tr` and returns its text
+// output together with the source name used when adding it to the RAG.
+// Network tools fail with errOfflineNetwork while offline.
+func executeTool(ctx context.Context, rag *ragSystem, customAPIs *apiStore, s appSettings, chatID string, tr toolRequest) (text, source string, err error) {
+	if !localTool(tr.Tool) && isOffline(ctx, s) {
+		return "", "", fmt.Errorf("%s: %w", tr.Tool, errOfflineNetwork)
+	}
+	switch tr.Tool {
+	case "wikipedia":
+		text, err = fetchWikipedia(ctx, tr.Query, s.Lang)
+		return text, "wiki:" + tr.Query, err
+	case "duckduckgo":
+		text, err = fetchDuckDuckGo(ctx, tr.Query)
+		return text, "ddg:" + tr.Query, err
+	case "wiktionary":
+		text, err = fetchWiktionary(ctx, tr.Query, s.Lang)
+		return text, "wikt:" + tr.Query, err
+	case "stackoverflow":
+		text, id, err := fetchStackOverflow(ctx, tr.Query)
+		if err != nil {
+			return "", "", err
 		}
-		if personaPrompt != "" {
-			systemPrompt = personaPrompt + "\n\n" + systemPrompt
+		return text, "so:" + strconv.Itoa(id), nil
+	case "websearch":
+		results, pages, err := webSearch(ctx, tr.Query, s.WebSearchFollow, s.AllowedHosts)
+		if err != nil {
+			return "", "", err
 		}
-
-		// Validate system prompt isn't absurdly long
-		if len(systemPrompt) > 32000 {
-			log.Printf("REQ %s: WARN system prompt too long (%d chars), truncating context", reqID, len(systemPrompt))
-			// Truncate context to first 5000 chars as fallback
-			if len(ctxText) > 5000 {
-				ctxText = ctxText[:5000] + "\n[... Kontext gekürzt ...]"
-				systemPrompt = buildToolSystemPrompt(ctxText, allTools)
+		if d := toolDetailsFrom(ctx); d != nil {
+			d.Results, d.Pages = results, pages
+		}
+		return formatWebSearch(tr.Query, results, pages), "web:" + tr.Query, nil
+	case "sql":
+		cols, rows, err := rag.querySQL(ctx, tr.Query, defaultSQLRows)
+		if err != nil {
+			return "", "", err
+		}
+		return sqlMarkdownTable(cols, rows), "sql:query", nil
+	case "convert":
+		text, err = convertAmount(ctx, tr.Query)
+		return text, "convert:" + tr.Query, err
+	case "weather":
+		text, err = fetchWeather(ctx, tr.Query, s.Lang)
+		return text, "weather:" + tr.Query, err
+	case "rag_search":
+		results, err := rag.searchJSON(ctx, tr.Query, rag.topK(), "")
+		if err != nil {
+			return "", "", err
+		}
+		return formatRAGSearch(tr.Query, results), "rag:" + tr.Query, nil
+	case "llm":
+		var buf bytes.Buffer
+		msgs := []chatMsg{{Role: "user", Content: tr.Query}}
+		if err := rag.lmFor(ctx).chatStream(ctx, "", msgs, &buf); err != nil {
+			return "", "", err
+		}
+		return buf.String(), "llm:prompt", nil
+	case "calculate":
+		out, err := execSmallRContext(ctx, chatID, tr.Query)
+		if err != nil {
+			return "", "", err
+		}
+		return out, "calc:" + tr.Query, nil
+	case "exec_code":
+		if s.AllowCodeExec {
+			// Full execution via nanoGo
+			out, err := runNanoGo(tr.Query, nanoGoLimitsFromSettings(s, timeoutFromContext(ctx, 5*time.Second))).text()
+			if err != nil {
+				return "", "", err
 			}
+			return out, "nanogo:exec", nil
 		}
-		debugBase.SystemPromptChars = len(systemPrompt)
-		debugBase.ContextChars = len(ctxText)
+		// Static checks only (gofmt/go vet)
+		tmpDir, err := os.MkdirTemp("", "codeexec-")
+		if err != nil {
+			return "", "", err
+		}
+		defer os.RemoveAll(tmpDir)
+		filePath := filepath.Join(tmpDir, "code.go")
+		if err := os.WriteFile(filePath, []byte(tr.Query), 0o644); err != nil {
+			return "", "", err
+		}
+		var outBuf bytes.Buffer
+		cmdFmt := exec.CommandContext(ctx, "gofmt", "-l", filePath)
+		cmdFmt.Stdout = &outBuf
+		cmdFmt.Stderr = &outBuf
+		_ = cmdFmt.Run()
+		cmdVet := exec.CommandContext(ctx, "go", "vet", "./...")
+		cmdVet.Dir = tmpDir
+		var vetOut bytes.Buffer
+		cmdVet.Stdout = &vetOut
+		cmdVet.Stderr = &vetOut
+		_ = cmdVet.Run()
+		return fmt.Sprintf("gofmt output:\n%s\n\ngo vet output:\n%s", outBuf.String(), vetOut.String()), "code:go", nil
+	case "python":
+		if !s.AllowPythonExec {
+			return "", "", fmt.Errorf("python execution disabled in settings (allow_python_exec)")
+		}
+		out, err := runPython(ctx, s.PythonPath, tr.Query)
+		if err != nil {
+			return "", "", err
+		}
+		return out, "python:exec", nil
+	case "nanogo":
+		out, err := runNanoGo(tr.Query, nanoGoLimitsFromSettings(s, timeoutFromContext(ctx, 5*time.Second))).text()
+		if err != nil {
+			return "", "", err
+		}
+		return out, "nanogo:exec", nil
+	default:
+		if pl, ok := findPlugin(tr.Tool); ok {
+			if !s.AllowPlugins {
+				return "", "", fmt.Errorf("plugins are disabled (allow_plugins)")
+			}
+			text, err = runPlugin(ctx, pl, tr.Query)
+			return text, "plugin:" + pl.Name + ":" + tr.Query, err
+		}
+		api, ok := customAPIs.get(tr.Tool)
+		if !ok {
+			return "", "", fmt.Errorf("unknown tool: %s", tr.Tool)
+		}
+		text, err = fetchCustomAPI(ctx, api, tr.Query, s.AllowedHosts)
+		return text, "api:" + api.Name + ":" + tr.Query, err
+	}
+}
+
+// maxPythonOutput caps the combined stdout/stderr of a python run.
+const maxPythonOutput = 64 << 10
+
+// runPython runs `code` with the python interpreter `interp` (default
+// "python3") in isolated mode, with an empty environment and a temporary
+// working directory. A non-zero exit is an error that keeps the output.
+func runPython(ctx context.Context, interp, code string) (string, error) {
+	if interp == "" {
+		interp = "python3"
+	}
+	bin, err := exec.LookPath(interp)
+	if err != nil {
+		return "", fmt.Errorf("Python-Interpreter %q nicht gefunden (python_path in den Einstellungen prüfen)", interp)
+	}
+	tmpDir, err := os.MkdirTemp("", "pyexec-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.WriteFile(filepath.Join(tmpDir, "snippet.py"), []byte(code), 0o600); err != nil {
+		return "", err
+	}
+
+	cmd := exec.CommandContext(ctx, bin, "-I", "snippet.py")
+	cmd.Dir = tmpDir
+	cmd.Env = []string{}
+	cmd.WaitDelay = time.Second
+	out := &cappedBuffer{max: maxPythonOutput}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	runErr := cmd.Run()
+	text := out.String()
+	if out.Len() >= maxPythonOutput {
+		text += "\n[… Ausgabe gekürzt …]"
+	}
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("python: %w\n%s", ctx.Err(), text)
+	}
+	if runErr != nil {
+		return "", fmt.Errorf("python: %v\n%s", runErr, text)
+	}
+	return text, nil
+}
 
-		// Prepare multi-turn messages (last 10 messages for efficiency)
-		history := conv.Messages[:len(conv.Messages)-1]
-		start := 0
-		if len(history) > 10 {
-			start = len(history) - 10
+// formatRAGSearch renders knowledge base hits as a tool result. Neighbor
+// chunks (score -1) are attached to the preceding hit of the same article.
+func formatRAGSearch(query string, results []searchResult) string {
+	if len(results) == 0 {
+		return fmt.Sprintf("Keine Treffer in der Wissensbasis für %q.", query)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Treffer in der Wissensbasis für %q:\n", query)
+	n := 0
+	for _, res := range results {
+		if res.Score < 0 {
+			fmt.Fprintf(&b, "\n(Umfeld aus %s)\n%s\n", res.Article, res.Content)
+			continue
 		}
-		msgs := make([]chatMsg, 0, len(history[start:])+1)
-		for _, m := range history[start:] {
-			msgs = append(msgs, chatMsg{Role: m.Role, Content: m.Content})
+		n++
+		fmt.Fprintf(&b, "\n[%d] %s (Score %.3f)\n%s\n", n, res.Article, res.Score, res.Content)
+	}
+	return b.String()
+}
+
+// ── Tool audit log ─────────────────────────────────────────────────
+
+// toolAuditEntry records one tool execution.
+type toolAuditEntry struct {
+	Time        time.Time `json:"time"`
+	ChatID      string    `json:"chat_id,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Tool        string    `json:"tool"`
+	Query       string    `json:"query"`
+	Source      string    `json:"source,omitempty"`
+	Outcome     string    `json:"outcome"` // ok, error or not_allowed
+	Error       string    `json:"error,omitempty"`
+	DurationMS  int64     `json:"duration_ms"`
+	OutputBytes int       `json:"output_bytes"`
+}
+
+// toolAuditLog keeps the most recent tool executions in a ring buffer
+// and optionally appends every entry to a JSONL file.
+type toolAuditLog struct {
+	mu      sync.Mutex
+	entries []toolAuditEntry
+	next    int
+	full    bool
+	file    *os.File
+}
+
+// maxToolAuditEntries is the size of the in-memory tool history.
+const maxToolAuditEntries = 1000
+
+var toolHistory = &toolAuditLog{entries: make([]toolAuditEntry, maxToolAuditEntries)}
+
+// openFile appends all future entries to the JSONL file at `path`.
+func (l *toolAuditLog) openFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.file = f
+	l.mu.Unlock()
+	return nil
+}
+
+// record adds `e` to the history.
+func (l *toolAuditLog) record(e toolAuditEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+	if l.file != nil {
+		b, _ := json.Marshal(e)
+		if _, err := l.file.Write(append(b, '\n')); err != nil {
+			log.Printf("tool audit: write failed: %v", err)
 		}
-		msgs = append(msgs, chatMsg{Role: "user", Content: req.Question})
+	}
+}
 
-		debugBase.HistoryMessages = len(msgs)
-		if req.Debug {
-			dbgJSON, _ := json.Marshal(debugBase)
-			fmt.Fprintf(w, "event: debug\ndata: %s\n\n", dbgJSON)
-			flusher.Flush()
+// list returns entries newest first, filtered by tool ("" = all) and
+// time range (zero = open), capped at `limit`.
+func (l *toolAuditLog) list(tool string, since, until time.Time, limit int) []toolAuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.entries)
+	}
+	out := []toolAuditEntry{}
+	for i := 1; i <= n && len(out) < limit; i++ {
+		e := l.entries[(l.next-i+len(l.entries))%len(l.entries)]
+		if tool != "" && e.Tool != tool {
+			continue
+		}
+		if (!since.IsZero() && e.Time.Before(since)) || (!until.IsZero() && e.Time.After(until)) {
+			continue
 		}
+		out = append(out, e)
+	}
+	return out
+}
 
-		streamErr := make(chan error, 1)
+// maxParallelTools is how many tool requests of one answer run at once.
+const maxParallelTools = 4
+
+// toolRun is the outcome of one tool request run by runToolsConcurrently.
+type toolRun struct {
+	text, source string
+	err          error
+	details      *toolDetails
+}
+
+// runToolsConcurrently executes `trs` with at most maxParallelTools at
+// a time, each bounded by its policy's timeout, and returns the
+// outcomes in the order of `trs`.
+func runToolsConcurrently(ctx context.Context, rag *ragSystem, customAPIs *apiStore, s appSettings, chatID, requestID string, trs []toolRequest) []toolRun {
+	out := make([]toolRun, len(trs))
+	sem := make(chan struct{}, maxParallelTools)
+	var wg sync.WaitGroup
+	for i, tr := range trs {
+		wg.Add(1)
 		go func() {
-			err := rag.getLM().chatStream(context.Background(), systemPrompt, msgs, pw)
-			streamErr <- err
-			if err != nil {
-				pw.CloseWithError(err)
-				log.Printf("REQ %s: LM chat stream failed: %v", reqID, err)
-			} else {
-				pw.Close()
-			}
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			toolCtx, cancel := context.WithTimeout(ctx, time.Duration(effectiveToolPolicy(s, tr.Tool).TimeoutS)*time.Second)
+			defer cancel()
+			toolCtx, details := withToolDetails(toolCtx)
+			text, source, err := runToolAudited(toolCtx, rag, customAPIs, s, chatID, requestID, tr)
+			out[i] = toolRun{text: text, source: source, err: err, details: details}
 		}()
+	}
+	wg.Wait()
+	return out
+}
 
-		scanner := bufio.NewScanner(pr)
-		scanner.Split(bufio.ScanRunes)
-		tokenCount := 0
-		for scanner.Scan() {
-			tok := scanner.Text()
-			answer.WriteString(tok)
-			data, _ := json.Marshal(tok)
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
-			tokenCount++
-		}
+// runToolAudited executes a tool via executeTool and records the
+// execution in the tool history.
+func runToolAudited(ctx context.Context, rag *ragSystem, customAPIs *apiStore, s appSettings, chatID, requestID string, tr toolRequest) (string, string, error) {
+	start := time.Now()
+	text, source, err := executeTool(ctx, rag, customAPIs, s, chatID, tr)
+	e := toolAuditEntry{
+		Time:        start,
+		ChatID:      chatID,
+		RequestID:   requestID,
+		Tool:        tr.Tool,
+		Query:       tr.Query,
+		Source:      source,
+		Outcome:     "ok",
+		DurationMS:  time.Since(start).Milliseconds(),
+		OutputBytes: len(text),
+	}
+	if err != nil {
+		e.Outcome, e.Error = "error", err.Error()
+	}
+	toolHistory.record(e)
+	netStats.recordTool(tr.Tool, err, time.Since(start))
+	return text, source, err
+}
 
-		// Check for scanner errors
-		if serr := scanner.Err(); serr != nil {
-			log.Printf("REQ %s: WARN LM chat stream scanner error: %v (tokens received: %d)", reqID, serr, tokenCount)
-			fmt.Fprintf(w, "data: %s\n\n", mustJSON("Fehler im LLM-Stream: "+serr.Error()))
-			fmt.Fprintf(w, "data: [DONE]\n\n")
-			flusher.Flush()
-			chats.addMessage(conv.ID, "assistant", "Fehler im LLM-Stream: "+serr.Error())
+// execSmallR executes the smallR demo to evaluate `expr` and returns its stdout.
+// It prefers a local `./smallr` binary if present, otherwise falls back to
+// `go run smallr.go -e` which requires the Go toolchain at runtime.
+func execSmallR(expr string) (string, error) {
+	return evalSmallR(smallr.NewContext(), expr)
+}
+
+// evalSmallR evaluates `expr` in the smallR context `sc`.
+func evalSmallR(sc *smallr.Context, expr string) (string, error) {
+	res, err := sc.EvalString(expr)
+	if err != nil {
+		return "", fmt.Errorf("smallr eval failed: %w", err)
+	}
+	if strings.TrimSpace(res.Output) != "" {
+		return res.Output, nil
+	}
+	return res.Value.String(), nil
+}
+
+// execSmallRContext evaluates `expr` but gives up once `ctx` is done.
+// With a chat ID the chat's persistent smallR session is used; the
+// query "reset" clears it.
+func execSmallRContext(ctx context.Context, chatID, expr string) (string, error) {
+	if chatID != "" && strings.EqualFold(strings.TrimSpace(expr), "reset") {
+		smallrSessions.drop(chatID)
+		return "smallR-Sitzung zurückgesetzt.", nil
+	}
+	type result struct {
+		out string
+		err error
+	}
+	var sess *smallrSession
+	if chatID != "" {
+		sess = smallrSessions.get(chatID)
+	}
+	done := make(chan result, 1)
+	go func() {
+		if sess == nil {
+			out, err := execSmallR(expr)
+			done <- result{out, err}
 			return
 		}
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		out, err := evalSmallR(sess.ctx, expr)
+		done <- result{out, err}
+	}()
+	select {
+	case res := <-done:
+		return res.out, res.err
+	case <-ctx.Done():
+		// The evaluation can't be interrupted and keeps the session
+		// locked, so the chat continues with a fresh session.
+		if sess != nil {
+			smallrSessions.discard(chatID, sess)
+		}
+		return "", fmt.Errorf("calculation aborted: %w", ctx.Err())
+	}
+}
 
-		// Check goroutine result
-		if err := <-streamErr; err != nil {
-			log.Printf("REQ %s: LM goroutine failed: %v (tokens before error: %d)", reqID, err, tokenCount)
-			if tokenCount == 0 {
-				// No tokens received at all
-				fmt.Fprintf(w, "data: %s\n\n", mustJSON("⚠️ LLM-Fehler: "+err.Error()))
-			}
-			fmt.Fprintf(w, "data: [DONE]\n\n")
-			flusher.Flush()
-			if answer.Len() == 0 {
-				chats.addMessage(conv.ID, "assistant", "LLM-Fehler: "+err.Error())
-			} else {
-				answerStr := answer.String()
-				if m := toolRequestRe.FindStringSubmatch(answerStr); len(m) >= 2 {
-					var tr toolRequest
-					if json.Unmarshal([]byte(m[1]), &tr) == nil && tr.Tool != "" {
-						trJSON, _ := json.Marshal(tr)
-						fmt.Fprintf(w, "event: tool_request\ndata: %s\n\n", trJSON)
-						flusher.Flush()
-					}
-					answerStr = strings.TrimSpace(toolRequestRe.ReplaceAllString(answerStr, ""))
-				}
-				chats.addMessage(conv.ID, "assistant", answerStr)
-			}
-			return
+// smallrSessionTTL is how long an unused per-chat smallR session is kept.
+const smallrSessionTTL = 30 * time.Minute
+
+// smallrSession is a smallR context shared by the calculations of one
+// chat. `mu` serializes evaluations.
+type smallrSession struct {
+	mu       sync.Mutex
+	ctx      *smallr.Context
+	lastUsed time.Time
+}
+
+// smallrSessionStore keeps lazily created smallR sessions per chat ID and
+// drops sessions that were idle for longer than ttl.
+type smallrSessionStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*smallrSession
+}
+
+var smallrSessions = &smallrSessionStore{ttl: smallrSessionTTL, sessions: map[string]*smallrSession{}}
+
+// get returns the session for `chatID`, creating it if needed.
+func (st *smallrSessionStore) get(chatID string) *smallrSession {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	for id, sess := range st.sessions {
+		if now.Sub(sess.lastUsed) > st.ttl {
+			delete(st.sessions, id)
 		}
+	}
+	sess, ok := st.sessions[chatID]
+	if !ok {
+		sess = &smallrSession{ctx: smallr.NewContext()}
+		st.sessions[chatID] = sess
+	}
+	sess.lastUsed = now
+	return sess
+}
 
-		if tokenCount == 0 {
-			log.Printf("REQ %s: WARN LM returned no tokens despite no error", reqID)
+// drop discards the session of `chatID`.
+func (st *smallrSessionStore) drop(chatID string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, chatID)
+}
+
+// discard drops the session of `chatID` if it is still `sess`.
+func (st *smallrSessionStore) discard(chatID string, sess *smallrSession) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.sessions[chatID] == sess {
+		delete(st.sessions, chatID)
+	}
+}
+
+// timeoutFromContext returns the time left until the deadline of `ctx`,
+// or `def` when it has none.
+func timeoutFromContext(ctx context.Context, def time.Duration) time.Duration {
+	if dl, ok := ctx.Deadline(); ok {
+		if left := time.Until(dl); left > 0 {
+			return left
 		}
+		return time.Millisecond
+	}
+	return def
+}
 
-		// Tool request marker handling
-		answerStr := answer.String()
-		if m := toolRequestRe.FindStringSubmatch(answerStr); len(m) >= 2 {
-			var tr toolRequest
-			if json.Unmarshal([]byte(m[1]), &tr) == nil && tr.Tool != "" {
-				trJSON, _ := json.Marshal(tr)
-				// Notify frontend that a tool was requested
-				fmt.Fprintf(w, "event: tool_request\ndata: %s\n\n", trJSON)
-				flusher.Flush()
+// nanoGoLimits bounds a single nanoGo execution.
+type nanoGoLimits struct {
+	Timeout   time.Duration
+	MaxOutput int // bytes of console output kept
+	MaxSteps  int // loop iterations, function calls and console writes
+	MaxMemMB  int // heap growth allowed while the program runs
+}
 
-				// Decide whether to execute automatically based on policy
-				s := settings.get()
-				execAllowed := false
-				switch tr.Tool {
-				case "calculate":
-					execAllowed = true
-				case "nanogo":
-					execAllowed = s.AllowNanoGo
-				case "exec_code":
-					execAllowed = s.AllowCodeExec
-				default:
-					// allow some builtin lookups by default (wiki, websearch etc.)
-					execAllowed = true
-				}
+// nanoGoLimitsFromSettings returns the configured limits with `timeout`.
+func nanoGoLimitsFromSettings(s appSettings, timeout time.Duration) nanoGoLimits {
+	return nanoGoLimits{Timeout: timeout, MaxOutput: s.NanoGoMaxOutput, MaxSteps: s.NanoGoMaxSteps, MaxMemMB: s.NanoGoMaxMemMB}
+}
 
-				if execAllowed {
-					// Execute the tool similarly to /api/tool/execute handler
-					var text string
-					var source string
-					var fetchErr error
-
-					switch tr.Tool {
-					case "wikipedia":
-						source = "wiki:" + tr.Query
-						text, fetchErr = fetchWikipedia(tr.Query, s.Lang)
-					case "duckduckgo":
-						source = "ddg:" + tr.Query
-						text, fetchErr = fetchDuckDuckGo(tr.Query)
-					case "wiktionary":
-						source = "wikt:" + tr.Query
-						text, fetchErr = fetchWiktionary(tr.Query, s.Lang)
-					case "stackoverflow":
-						source = "so:" + tr.Query
-						text, fetchErr = fetchDuckDuckGo("site:stackoverflow.com " + tr.Query)
-					case "websearch":
-						source = "web:" + tr.Query
-						text, fetchErr = fetchDuckDuckGo(tr.Query)
-					case "llm":
-						var buf bytes.Buffer
-						msgs2 := []chatMsg{{Role: "user", Content: tr.Query}}
-						if err := rag.getLM().chatStream(context.Background(), "", msgs2, &buf); err != nil {
-							fetchErr = err
-						} else {
-							text = buf.String()
-							source = "llm:prompt"
-						}
-					case "calculate":
-						out, err := execSmallR(tr.Query)
-						if err != nil {
-							fetchErr = err
-						} else {
-							text = out
-							source = "calc:" + tr.Query
-						}
-					case "exec_code":
-						// For exec_code we run static checks or full exec depending on setting
-						if !s.AllowCodeExec {
-							// run gofmt/govet static checks
-							tmpDir, err := os.MkdirTemp("", "codeexec-")
-							if err != nil {
-								fetchErr = err
-								break
-							}
-							defer os.RemoveAll(tmpDir)
-							filePath := filepath.Join(tmpDir, "code.go")
-							if err := os.WriteFile(filePath, []byte(tr.Query), 0o644); err != nil {
-								fetchErr = err
-								break
-							}
-							var outBuf bytes.Buffer
-							cmdFmt := exec.Command("gofmt", "-l", filePath)
-							cmdFmt.Stdout = &outBuf
-							cmdFmt.Stderr = &outBuf
-							_ = cmdFmt.Run()
-							cmdVet := exec.Command("go", "vet", "./...")
-							cmdVet.Dir = tmpDir
-							var vetOut bytes.Buffer
-							cmdVet.Stdout = &vetOut
-							cmdVet.Stderr = &vetOut
-							_ = cmdVet.Run()
-							text = fmt.Sprintf("gofmt output:\n%s\n\ngo vet output:\n%s", outBuf.String(), vetOut.String())
-							source = "code:go"
-						} else {
-							// Full execution via nanogo RunSafe
-							timeout := 5 * time.Second
-							out, err := RunSafe(tr.Query, timeout)
-							if err != nil {
-								fetchErr = err
-							} else {
-								text = out
-								source = "nanogo:exec"
-							}
-						}
-					case "nanogo":
-						timeout := 5 * time.Second
-						out, err := RunSafe(tr.Query, timeout)
-						if err != nil {
-							fetchErr = err
-						} else {
-							text = out
-							source = "nanogo:exec"
-						}
-					default:
-						if api, ok := customAPIs.get(tr.Tool); ok {
-							finalURL := strings.ReplaceAll(api.Template, "$q", url.QueryEscape(tr.Query))
-							source = "api:" + api.Name + ":" + tr.Query
-							text, fetchErr = fetchURL(finalURL)
-						} else {
-							fetchErr = fmt.Errorf("unknown tool: %s", tr.Tool)
-						}
-					}
+// nanoGoResult describes a finished (or aborted) nanoGo execution.
+type nanoGoResult struct {
+	Output     string `json:"output"`
+	Truncated  bool   `json:"truncated"`
+	DurationMS int64  `json:"duration_ms"`
+	PeakOutput int    `json:"peak_output"` // bytes written, including dropped ones
+	Steps      int    `json:"steps"`
+	Error      string `json:"error,omitempty"`
+}
+
+// text returns the output for use as a tool result.
+func (r nanoGoResult) text() (string, error) {
+	if r.Error != "" {
+		return "", fmt.Errorf("%s", r.Error)
+	}
+	if r.Truncated {
+		return r.Output + "\n[… Ausgabe gekürzt …]", nil
+	}
+	return r.Output, nil
+}
+
+// nanoGoSandbox collects output and enforces budgets for one program.
+// Its methods are called from interpreter natives and stay safe after the
+// host gave up waiting; once aborted every native call fails, which stops
+// the interpreter at its next loop iteration or function call.
+type nanoGoSandbox struct {
+	mu        sync.Mutex
+	lim       nanoGoLimits
+	out       bytes.Buffer
+	written   int
+	truncated bool
+	steps     int
+	heapBase  uint64
+	abort     error
+}
+
+func (sb *nanoGoSandbox) write(s string) error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if err := sb.tickLocked(); err != nil {
+		return err
+	}
+	sb.written += len(s)
+	room := sb.lim.MaxOutput - sb.out.Len()
+	if sb.lim.MaxOutput > 0 && room < len(s) {
+		if room > 0 {
+			sb.out.WriteString(s[:room])
+		}
+		sb.truncated = true
+		return nil
+	}
+	sb.out.WriteString(s)
+	return nil
+}
 
-					// Send tool result event and add to RAG if successful
-					if fetchErr != nil {
-						res := map[string]any{"tool": tr.Tool, "query": tr.Query, "error": fetchErr.Error()}
-						d, _ := json.Marshal(res)
-						fmt.Fprintf(w, "event: tool_result\ndata: %s\n\n", d)
-						flusher.Flush()
-						log.Printf("REQ %s: tool %s failed: %v", reqID, tr.Tool, fetchErr)
-					} else {
-						res := map[string]any{"tool": tr.Tool, "query": tr.Query, "source": source, "output": text}
-						d, _ := json.Marshal(res)
-						fmt.Fprintf(w, "event: tool_result\ndata: %s\n\n", d)
-						flusher.Flush()
-
-						// add to RAG as chunks so subsequent retrieval can use it
-						chunks := chunkText(text, s.ChunkSize)
-						if err := rag.addChunks(source, chunks); err != nil {
-							log.Printf("REQ %s: failed to add tool result to RAG: %v", reqID, err)
-						} else {
-							log.Printf("REQ %s: tool result added to RAG: %s (%d chunks)", reqID, source, len(chunks))
-						}
+func (sb *nanoGoSandbox) tick() error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.tickLocked()
+}
 
-						// Continue the assistant answer by asking the LM to incorporate the tool result
-						// Build continuation messages: include previous assistant partial answer and the tool output as a user hint
-						contMsgs := make([]chatMsg, 0, len(msgs)+2)
-						contMsgs = append(contMsgs, msgs...)
-						// previous assistant partial
-						contMsgs = append(contMsgs, chatMsg{Role: "assistant", Content: answerStr})
-						contMsgs = append(contMsgs, chatMsg{Role: "user", Content: fmt.Sprintf("Tool %s returned:\n%s\n\nPlease continue the answer using this information.", tr.Tool, text)})
-
-						// Stream continuation
-						pr2, pw2 := io.Pipe()
-						go func() {
-							err := rag.getLM().chatStream(context.Background(), systemPrompt, contMsgs, pw2)
-							if err != nil {
-								pw2.CloseWithError(err)
-								log.Printf("REQ %s: LM continuation failed: %v", reqID, err)
-							} else {
-								pw2.Close()
-							}
-						}()
-						sc2 := bufio.NewScanner(pr2)
-						sc2.Split(bufio.ScanRunes)
-						for sc2.Scan() {
-							tok := sc2.Text()
-							fmt.Fprintf(w, "data: %s\n\n", mustJSON(tok))
-							flusher.Flush()
-						}
-						// finished continuation
-						log.Printf("REQ %s: tool-driven continuation complete", reqID)
-					}
-				} else {
-					// Execution not allowed; inform frontend
-					res := map[string]any{"tool": tr.Tool, "query": tr.Query, "allowed": false}
-					d, _ := json.Marshal(res)
-					fmt.Fprintf(w, "event: tool_result\ndata: %s\n\n", d)
-					flusher.Flush()
-				}
-			}
-			answerStr = strings.TrimSpace(toolRequestRe.ReplaceAllString(answerStr, ""))
+func (sb *nanoGoSandbox) tickLocked() error {
+	if sb.abort != nil {
+		return sb.abort
+	}
+	sb.steps++
+	if sb.lim.MaxSteps > 0 && sb.steps > sb.lim.MaxSteps {
+		sb.abort = fmt.Errorf("step budget exceeded (%d steps)", sb.lim.MaxSteps)
+		return sb.abort
+	}
+	if sb.lim.MaxMemMB > 0 && sb.steps%1024 == 0 {
+		if heap := heapBytes(); heap > sb.heapBase+uint64(sb.lim.MaxMemMB)<<20 {
+			sb.abort = fmt.Errorf("memory limit exceeded (%d MB)", sb.lim.MaxMemMB)
+			return sb.abort
 		}
+	}
+	return nil
+}
 
-		fmt.Fprintf(w, "data: [DONE]\n\n")
-		flusher.Flush()
+func (sb *nanoGoSandbox) stop(err error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.abort == nil {
+		sb.abort = err
+	}
+}
 
-		log.Printf("REQ %s: Chat response complete: %d chars, tokens_streamed=%d", reqID, len(answerStr), tokenCount)
-		chats.addMessage(conv.ID, "assistant", answerStr)
-	})
+func (sb *nanoGoSandbox) result() nanoGoResult {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return nanoGoResult{Output: sb.out.String(), Truncated: sb.truncated, PeakOutput: sb.written, Steps: sb.steps}
+}
 
-	// GET /api/tools — list available tools
-	mux.HandleFunc("/api/tools", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(customAPIs.allTools())
-	})
+// heapBytes returns the bytes currently occupied by heap objects.
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
 
-	// POST /api/tool/execute — execute a tool and add results to RAG
-	mux.HandleFunc("/api/tool/execute", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
+// instrumentNanoGo inserts a __hostTick() call at the start of every
+// function and loop body so budgets are checked while user code runs.
+// Snippets without a package clause get "package main"; sources that still
+// don't parse are rejected, since the budgets could not be enforced.
+func instrumentNanoGo(source string) (string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "main.go", source, parser.ParseComments)
+	if err != nil {
+		var err2 error
+		if f, err2 = parser.ParseFile(fset, "main.go", "package main\n\n"+source, parser.ParseComments); err2 != nil {
+			return "", fmt.Errorf("source is not a valid Go file, so the step budget cannot be enforced: %v", err)
 		}
-		var req toolRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Tool == "" || req.Query == "" {
-			http.Error(w, "missing tool or query", 400)
-			return
+	}
+	tick := func(b *ast.BlockStmt) {
+		if b != nil {
+			call := &ast.ExprStmt{X: &ast.CallExpr{Fun: ast.NewIdent("__hostTick")}}
+			b.List = append([]ast.Stmt{call}, b.List...)
 		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			tick(n.Body)
+		case *ast.FuncLit:
+			tick(n.Body)
+		case *ast.ForStmt:
+			tick(n.Body)
+		case *ast.RangeStmt:
+			tick(n.Body)
+		}
+		return true
+	})
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
 
-		s := settings.get()
-
-		var text string
-		var source string
-		var fetchErr error
-
-		switch req.Tool {
-		case "wikipedia":
-			source = "wiki:" + req.Query
-			text, fetchErr = fetchWikipedia(req.Query, s.Lang)
-		case "duckduckgo":
-			source = "ddg:" + req.Query
-			text, fetchErr = fetchDuckDuckGo(req.Query)
-		case "wiktionary":
-			source = "wikt:" + req.Query
-			text, fetchErr = fetchWiktionary(req.Query, s.Lang)
-		case "stackoverflow":
-			// Search StackOverflow via DuckDuckGo site-restrict
-			source = "so:" + req.Query
-			text, fetchErr = fetchDuckDuckGo("site:stackoverflow.com " + req.Query)
-		case "websearch":
-			source = "web:" + req.Query
-			text, fetchErr = fetchDuckDuckGo(req.Query)
-
-		case "llm":
-			// Run a direct prompt against the configured LLM and return result
-			var buf bytes.Buffer
-			msgs := []chatMsg{{Role: "user", Content: req.Query}}
-			if err := rag.getLM().chatStream(context.Background(), "", msgs, &buf); err != nil {
-				http.Error(w, fmt.Sprintf("LLM error: %v", err), 500)
-				return
-			}
-			text = buf.String()
-			source = "llm:prompt"
-
-		case "calculate":
-			// Evaluate arithmetic expression via smallR and add to RAG as a small document
-			out, err := execSmallR(req.Query)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("calculation failed: %v", err), 500)
-				return
+// runNanoGo executes untrusted Go source inside the nanoGo interpreter.
+// Console output is captured up to lim.MaxOutput bytes, step and memory
+// budgets are enforced via natives, and panics in the interpreter are
+// recovered inside its goroutine so the host process survives.
+//
+// The interpreter has no allocation hooks, so the memory budget is checked
+// against the growth of the whole process heap since the run started:
+// allocations of concurrent requests count towards it (and a collection
+// of their garbage can hide some of the program's). It catches runaway
+// allocation, it is not an exact per-program quota.
+func runNanoGo(source string, lim nanoGoLimits) nanoGoResult {
+	source, err := instrumentNanoGo(source)
+	if err != nil {
+		return nanoGoResult{Error: err.Error()}
+	}
+	sb := &nanoGoSandbox{lim: lim, heapBase: heapBytes()}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("nanoGo panic: %v", r)
 			}
-			text = out
-			source = "calc:" + req.Query
+		}()
+		done <- runInterpreted(source, sb)
+	}()
 
-		case "exec_code":
-			// Secure code execution: by default perform only static analysis (format + vet for Go).
-			scfg := s.AllowCodeExec
-			if !scfg {
-				// Perform static checks only (gofmt/govet) but do not execute arbitrary code
-			}
-			// Create temp dir and write the provided code to a file
-			tmpDir, err := os.MkdirTemp("", "codeexec-")
-			if err != nil {
-				http.Error(w, fmt.Sprintf("internal: %v", err), 500)
-				return
-			}
-			defer os.RemoveAll(tmpDir)
-			filePath := filepath.Join(tmpDir, "code.go")
-			if err := os.WriteFile(filePath, []byte(req.Query), 0o644); err != nil {
-				http.Error(w, fmt.Sprintf("write failed: %v", err), 500)
-				return
-			}
-			var outBuf bytes.Buffer
-			// Check formatting
-			cmdFmt := exec.Command("gofmt", "-l", filePath)
-			cmdFmt.Stdout = &outBuf
-			cmdFmt.Stderr = &outBuf
-			if err := cmdFmt.Run(); err != nil {
-				// gofmt failing is non-fatal; capture output
-			}
-			// Try go vet (best-effort)
-			cmdVet := exec.Command("go", "vet", "./...")
-			cmdVet.Dir = tmpDir
-			var vetOut bytes.Buffer
-			cmdVet.Stdout = &vetOut
-			cmdVet.Stderr = &vetOut
-			_ = cmdVet.Run()
-			// Collate results
-			text = fmt.Sprintf("gofmt output:\n%s\n\ngo vet output:\n%s", outBuf.String(), vetOut.String())
-			source = "code:go"
-		default:
-			if api, ok := customAPIs.get(req.Tool); ok {
-				finalURL := strings.ReplaceAll(api.Template, "$q", url.QueryEscape(req.Query))
-				source = "api:" + api.Name + ":" + req.Query
-				text, fetchErr = fetchURL(finalURL)
-			} else {
-				http.Error(w, "unknown tool: "+req.Tool, 400)
-				return
-			}
-		}
+	timer := time.NewTimer(lim.Timeout)
+	defer timer.Stop()
+	select {
+	case err = <-done:
+	case <-timer.C:
+		err = fmt.Errorf("execution timed out after %s", lim.Timeout)
+		sb.stop(err)
+	}
+	res := sb.result()
+	res.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
 
-		if fetchErr != nil {
-			http.Error(w, fmt.Sprintf("Tool %q fehlgeschlagen: %v", req.Tool, fetchErr), 500)
-			return
-		}
+// runInterpreted creates a sandboxed interpreter, registers only the
+// host functions we choose to expose, and executes the source.
+func runInterpreted(source string, sb *nanoGoSandbox) error {
+	vm := nanogo.NewInterpreter()
+	registerSafeNatives(vm, sb)
+	nanogo.RegisterBuiltinPackages(vm)
+	return vm.Run(source)
+}
 
-		chunks := chunkText(text, s.ChunkSize)
-		if err := rag.addChunks(source, chunks); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+// registerSafeNatives installs a minimal set of host functions that are
+// safe to expose to untrusted user code. Output is written to `sb`.
+func registerSafeNatives(vm *nanogo.Interpreter, sb *nanoGoSandbox) {
+	vm.RegisterNative("ConsoleLog", func(args []any) (any, error) {
+		if len(args) > 0 {
+			return nil, sb.write(nanogo.ToString(args[0]) + "\n")
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"tool":   req.Tool,
-			"query":  req.Query,
-			"source": source,
-			"chars":  len(text),
-			"chunks": len(chunks),
-			"total":  rag.docCount(),
-		})
+		return nil, sb.tick()
 	})
 
-	// POST /api/nanogo — execute Go source using the embedded nanoGo interpreter
-	mux.HandleFunc("/api/nanogo", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
-		}
-		var req struct {
-			Source   string `json:"source"`
-			TimeoutS int    `json:"timeout_s"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Source) == "" {
-			http.Error(w, "missing source", 400)
-			return
-		}
-		s := settings.get()
-		if !s.AllowNanoGo {
-			http.Error(w, "nanoGo execution disabled in settings", 403)
-			return
-		}
-		timeout := 5 * time.Second
-		if req.TimeoutS > 0 {
-			timeout = time.Duration(req.TimeoutS) * time.Second
-		}
-		out, err := RunSafe(req.Source, timeout)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+	vm.RegisterNative("ConsoleWarn", func(args []any) (any, error) {
+		if len(args) > 0 {
+			return nil, sb.write("[warn] " + nanogo.ToString(args[0]) + "\n")
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{"ok": true, "output": out})
+		return nil, sb.tick()
 	})
 
-	// POST /api/smallr — execute a smallR expression using the bundled demo.
-	mux.HandleFunc("/api/smallr", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
-		}
-		var req struct {
-			Expr string `json:"expr"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Expr) == "" {
-			http.Error(w, "missing expr", 400)
-			return
-		}
-		out, err := execSmallR(req.Expr)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+	vm.RegisterNative("ConsoleError", func(args []any) (any, error) {
+		if len(args) > 0 {
+			return nil, sb.write("[error] " + nanogo.ToString(args[0]) + "\n")
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{"output": out})
+		return nil, sb.tick()
 	})
 
-	// POST /api/search
-	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
-		}
-		var req struct {
-			Query string `json:"query"`
-			K     int    `json:"k"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Query == "" {
-			http.Error(w, "missing query", 400)
-			return
-		}
-		if req.K <= 0 {
-			req.K = rag.k
-		}
-		results, err := rag.searchJSON(req.Query, req.K)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(results)
+	vm.RegisterNative("__hostTick", func(args []any) (any, error) {
+		return nil, sb.tick()
 	})
 
-	// POST /api/add-wiki
-	mux.HandleFunc("/api/add-wiki", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
-		}
-		var req struct {
-			Article string `json:"article"`
-			Lang    string `json:"lang"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Article == "" {
-			http.Error(w, "missing article", 400)
-			return
-		}
-		s := settings.get()
-		if req.Lang == "" {
-			req.Lang = s.Lang
-		}
-		text, err := fetchWikipedia(req.Article, req.Lang)
-		if err != nil {
-			log.Printf("fetchWikipedia(%q,%q) failed: %v", req.Article, req.Lang, err)
-			if sv, err2 := searchWikipedia(req.Article, req.Lang); err2 == nil && len(sv) > 0 {
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]any{"not_found": true, "query": req.Article, "results": sv})
-				return
-			}
-			http.Error(w, err.Error(), 500)
-			return
+	vm.RegisterNative("__hostSprintf", func(args []any) (any, error) {
+		if len(args) == 0 {
+			return "", nil
 		}
-		chunks := chunkText(text, s.ChunkSize)
-		if err := rag.addChunks(req.Article, chunks); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+		format := nanogo.ToString(args[0])
+		fmtArgs := make([]any, 0, len(args)-1)
+		for _, a := range args[1:] {
+			fmtArgs = append(fmtArgs, a)
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"article": req.Article,
-			"chars":   len(text),
-			"chunks":  len(chunks),
-			"total":   rag.docCount(),
-		})
+		return fmt.Sprintf(format, fmtArgs...), nil
 	})
+}
 
-	// POST /api/add-url
-	mux.HandleFunc("/api/add-url", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
-		}
-		var req struct {
-			URL string `json:"url"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
-			http.Error(w, "missing url", 400)
-			return
-		}
-		if _, err := url.ParseRequestURI(req.URL); err != nil {
-			http.Error(w, "invalid url", 400)
-			return
-		}
-		text, err := fetchURL(req.URL)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		s := settings.get()
-		chunks := chunkText(text, s.ChunkSize)
-		if err := rag.addChunks(req.URL, chunks); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"source": req.URL,
-			"chars":  len(text),
-			"chunks": len(chunks),
-			"total":  rag.docCount(),
-		})
-	})
+// ─────────────────────────────────────────────────────────────────────────────
+// Maintenance (dump, re-embed, compact, lock file)
+// ─────────────────────────────────────────────────────────────────────────────
+
+// dumpVersion is the format version of JSONL dumps.
+const dumpVersion = 1
+
+// dumpRecord is one line of a JSONL dump: a "header" first, then per
+// collection a "collection" line and each "source" followed by its
+// "chunk" lines.
+type dumpRecord struct {
+	Type       string      `json:"type"`
+	Version    int         `json:"version,omitempty"`
+	EmbedModel string      `json:"embed_model,omitempty"`
+	Collection string      `json:"collection,omitempty"`
+	Source     *sourceInfo `json:"source,omitempty"`
+	Chunk      *dumpChunk  `json:"chunk,omitempty"`
+}
+
+// dumpChunk is a stored chunk with its embedding.
+type dumpChunk struct {
+	Article   string    `json:"article"`
+	ChunkIdx  int       `json:"chunk_idx"`
+	Content   string    `json:"content"`
+	Embedding []float64 `json:"embedding"`
+}
+
+// dumpStats summarizes an export or import.
+type dumpStats struct {
+	Collections int      `json:"collections"`
+	Sources     int      `json:"sources"`
+	Chunks      int      `json:"chunks"`
+	Skipped     int      `json:"skipped"` // sources already present (import)
+	Warnings    []string `json:"warnings,omitempty"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+// allCollections returns the views of all collections, default first.
+func (r *ragSystem) allCollections() []*ragSystem {
+	r.dbMu.RLock()
+	names := append([]string{defaultCollection}, r.collectionNamesLocked()...)
+	r.dbMu.RUnlock()
+	out := make([]*ragSystem, 0, len(names))
+	for _, name := range names {
+		out = append(out, r.in(name))
+	}
+	return out
+}
+
+// allChunks returns the chunks of this collection with their
+// embeddings, ordered by article and chunk index.
+func (r *ragSystem) allChunks() ([]dumpChunk, error) {
+	r.dbMu.RLock()
+	rs, err := r.execLocked("SELECT article, chunk_idx, content, embedding FROM chunks ORDER BY article, chunk_idx")
+	r.dbMu.RUnlock()
+	if err != nil || rs == nil {
+		return nil, err
+	}
+	out := make([]dumpChunk, 0, len(rs.Rows))
+	for _, row := range rs.Rows {
+		a, _ := tinysql.GetVal(row, "article")
+		i, _ := tinysql.GetVal(row, "chunk_idx")
+		c, _ := tinysql.GetVal(row, "content")
+		e, _ := tinysql.GetVal(row, "embedding")
+		ch := dumpChunk{Article: fmt.Sprint(a), Content: contentVal(c)}
+		ch.ChunkIdx, _ = strconv.Atoi(fmt.Sprint(i))
+		ch.Embedding, _ = e.([]float64)
+		out = append(out, ch)
+	}
+	return out, nil
+}
 
-	// POST /api/add-folder — import all text files from a server directory
-	mux.HandleFunc("/api/add-folder", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
-		}
-		var req struct {
-			Path      string `json:"path"`
-			Recursive bool   `json:"recursive"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
-			http.Error(w, "missing path", 400)
-			return
-		}
-		info, err := os.Stat(req.Path)
+// exportDump writes all collections as JSONL to `w`. `embedModel` is
+// recorded so imports can detect vectors from another model.
+func (r *ragSystem) exportDump(w io.Writer, embedModel string) (dumpStats, error) {
+	var st dumpStats
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(dumpRecord{Type: "header", Version: dumpVersion, EmbedModel: embedModel}); err != nil {
+		return st, err
+	}
+	for _, c := range r.allCollections() {
+		chunks, err := c.allChunks()
 		if err != nil {
-			http.Error(w, "path not found: "+err.Error(), 400)
-			return
+			return st, fmt.Errorf("collection %s: %w", c.collection, err)
 		}
-		if !info.IsDir() {
-			http.Error(w, "path is not a directory", 400)
-			return
+		if err := enc.Encode(dumpRecord{Type: "collection", Collection: c.collection}); err != nil {
+			return st, err
 		}
-
-		allowedExts := map[string]bool{
-			".txt": true, ".md": true, ".csv": true, ".json": true,
-			".xml": true, ".html": true, ".log": true, ".htm": true,
-			".yaml": true, ".yml": true, ".toml": true, ".ini": true,
-			".cfg": true, ".conf": true, ".sql": true, ".go": true,
-			".py": true, ".js": true, ".ts": true, ".rs": true,
-			".c": true, ".h": true, ".cpp": true, ".java": true,
+		st.Collections++
+		sources := map[string]sourceInfo{}
+		for _, src := range c.listSources() {
+			sources[src.Name] = src
 		}
-
-		s := settings.get()
-		var totalFiles, totalChars, totalChunksN int
-		var errors []string
-
-		walkFn := func(path string, d os.DirEntry, err error) error {
-			if err != nil {
-				return nil
-			}
-			if d.IsDir() {
-				if !req.Recursive && path != req.Path {
-					return filepath.SkipDir
+		for i := range chunks {
+			if i == 0 || chunks[i].Article != chunks[i-1].Article {
+				src, ok := sources[chunks[i].Article]
+				if !ok {
+					src = sourceInfo{Name: chunks[i].Article, sourceOrigin: inferOrigin(chunks[i].Article)}
 				}
-				return nil
-			}
-			ext := strings.ToLower(filepath.Ext(d.Name()))
-			if !allowedExts[ext] {
-				return nil
-			}
-			fi, err := d.Info()
-			if err != nil || fi.Size() > 5*1024*1024 {
-				return nil
-			}
-			data, err := os.ReadFile(path)
-			if err != nil {
-				errors = append(errors, filepath.Base(path)+": "+err.Error())
-				return nil
-			}
-			text := string(data)
-			if strings.TrimSpace(text) == "" {
-				return nil
-			}
-			relPath, _ := filepath.Rel(req.Path, path)
-			if relPath == "" {
-				relPath = filepath.Base(path)
+				if err := enc.Encode(dumpRecord{Type: "source", Collection: c.collection, Source: &src}); err != nil {
+					return st, err
+				}
+				st.Sources++
 			}
-			source := "folder:" + relPath
-			chunks := chunkText(text, s.ChunkSize)
-			if err := rag.addChunks(source, chunks); err != nil {
-				errors = append(errors, relPath+": "+err.Error())
-				return nil
+			if err := enc.Encode(dumpRecord{Type: "chunk", Collection: c.collection, Chunk: &chunks[i]}); err != nil {
+				return st, err
 			}
-			totalFiles++
-			totalChars += len(text)
-			totalChunksN += len(chunks)
-			return nil
+			st.Chunks++
 		}
+		log.Printf("export: %s: %d chunks", c.collection, len(chunks))
+	}
+	return st, nil
+}
 
-		filepath.WalkDir(req.Path, walkFn)
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"files":        totalFiles,
-			"total_chars":  totalChars,
-			"total_chunks": totalChunksN,
-			"total":        rag.docCount(),
-			"errors":       errors,
-		})
-	})
-
-	// POST /api/add-text
-	mux.HandleFunc("/api/add-text", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
+// importDump adds the sources of a dump written by exportDump, creating
+// collections as needed. Sources already present in their collection
+// are skipped, so importing the same dump twice changes nothing.
+func (r *ragSystem) importDump(rd io.Reader, embedModel string) (dumpStats, error) {
+	var st dumpStats
+	var cur *ragSystem
+	var src sourceInfo
+	var chunks []string
+	var vecs [][]float64
+	flush := func() {
+		if cur == nil || len(chunks) == 0 {
 			return
 		}
-		var req struct {
-			Title string `json:"title"`
-			Text  string `json:"text"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Text == "" {
-			http.Error(w, "missing text", 400)
-			return
+		stored, err := cur.storeChunks(src, chunks, vecs)
+		switch {
+		case err != nil:
+			st.Errors = append(st.Errors, fmt.Sprintf("%s/%s: %v", cur.collection, src.Name, err))
+		case stored:
+			st.Sources++
+			st.Chunks += len(chunks)
+		default:
+			st.Skipped++
 		}
-		s := settings.get()
-		if req.Title == "" {
-			req.Title = "manual-" + strconv.FormatInt(time.Now().Unix(), 10)
+		chunks, vecs = nil, nil
+	}
+	collection := func(name string) (*ragSystem, error) {
+		if name == "" {
+			name = defaultCollection
 		}
-		chunks := chunkText(req.Text, s.ChunkSize)
-		if err := rag.addChunks(req.Title, chunks); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+		c, err := r.collectionView(name)
+		if errors.Is(err, errUnknownCollection) {
+			if err = r.createCollection(name); err == nil {
+				st.Collections++
+				c = r.in(name)
+			}
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"title":  req.Title,
-			"chars":  len(req.Text),
-			"chunks": len(chunks),
-			"total":  rag.docCount(),
-		})
-	})
+		return c, err
+	}
 
-	// POST /api/upload
-	mux.HandleFunc("/api/upload", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(make([]byte, 0, 1<<20), 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		raw := bytes.TrimSpace(sc.Bytes())
+		if len(raw) == 0 {
+			continue
 		}
-		r.ParseMultipartForm(50 << 20) // allow larger archives (50MB)
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			http.Error(w, "missing file: "+err.Error(), 400)
-			return
+		var rec dumpRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			st.Errors = append(st.Errors, fmt.Sprintf("line %d: %v", line, err))
+			continue
 		}
-		defer file.Close()
-		data, err := io.ReadAll(file)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+		switch rec.Type {
+		case "header":
+			if rec.Version > dumpVersion {
+				return st, fmt.Errorf("dump version %d is not supported (max %d)", rec.Version, dumpVersion)
+			}
+			if rec.EmbedModel != "" && embedModel != "" && rec.EmbedModel != embedModel {
+				st.Warnings = append(st.Warnings, fmt.Sprintf("embeddings were created with %s, configured model is %s; run reembed after the import", rec.EmbedModel, embedModel))
+			}
+		case "collection":
+			if _, err := collection(rec.Collection); err != nil {
+				st.Errors = append(st.Errors, fmt.Sprintf("line %d: %v", line, err))
+			}
+		case "source", "chunk":
+			if rec.Type == "source" && rec.Source == nil || rec.Type == "chunk" && (rec.Chunk == nil || len(rec.Chunk.Embedding) == 0) {
+				st.Errors = append(st.Errors, fmt.Sprintf("line %d: incomplete %s record", line, rec.Type))
+				continue
+			}
+			name := ""
+			if rec.Source != nil {
+				name = rec.Source.Name
+			} else {
+				name = rec.Chunk.Article
+			}
+			c, err := collection(rec.Collection)
+			if err != nil {
+				st.Errors = append(st.Errors, fmt.Sprintf("line %d: %v", line, err))
+				continue
+			}
+			if cur == nil || c.collection != cur.collection || name != src.Name {
+				flush()
+				cur, src = c, sourceInfo{Name: name, sourceOrigin: inferOrigin(name)}
+			}
+			if rec.Source != nil {
+				src = sourceInfo{Name: name, sourceOrigin: rec.Source.sourceOrigin, CreatedAt: rec.Source.CreatedAt, Provenance: rec.Source.Provenance, Tags: rec.Source.Tags}
+			} else {
+				chunks = append(chunks, rec.Chunk.Content)
+				vecs = append(vecs, rec.Chunk.Embedding)
+			}
+		default:
+			st.Errors = append(st.Errors, fmt.Sprintf("line %d: unknown record type %q", line, rec.Type))
 		}
-		filename := header.Filename
-		lower := strings.ToLower(filename)
-		s := settings.get()
-		allowedExts := map[string]bool{
-			".txt": true, ".md": true, ".csv": true, ".json": true,
-			".xml": true, ".html": true, ".log": true, ".htm": true,
-			".yaml": true, ".yml": true, ".toml": true, ".ini": true,
-			".cfg": true, ".conf": true, ".sql": true, ".go": true,
-			".py": true, ".js": true, ".ts": true, ".rs": true,
-			".c": true, ".h": true, ".cpp": true, ".java": true,
+		if line%1000 == 0 {
+			log.Printf("import: %d lines, %d chunks stored", line, st.Chunks)
 		}
+	}
+	flush()
+	if err := sc.Err(); err != nil {
+		return st, err
+	}
+	if err := r.save(); err != nil {
+		log.Printf("WARN: save failed: %v", err)
+	}
+	return st, nil
+}
 
-		var totalFiles, totalChars, totalChunks int
-		var errorsList []string
-
-		isZip := strings.HasSuffix(lower, ".zip")
-		isTarGz := strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz")
-
-		if isZip || isTarGz {
-			// write archive to temp file
-			tmpDir, err := os.MkdirTemp("", "upload-archive-")
+// reembed recomputes the embeddings of all chunks in all collections
+// with the configured embedding model, e.g. after changing it. Chunks
+// are updated batch by batch; an interrupted run can simply be repeated.
+func (r *ragSystem) reembed() (int, error) {
+	const batchSize = 16
+	total := 0
+	for _, c := range r.allCollections() {
+		r.dbMu.RLock()
+		rs, err := c.execLocked("SELECT id, content FROM chunks ORDER BY id")
+		r.dbMu.RUnlock()
+		if err != nil {
+			return total, fmt.Errorf("collection %s: %w", c.collection, err)
+		}
+		var ids []any
+		var contents []string
+		for _, row := range rs.Rows {
+			id, _ := tinysql.GetVal(row, "id")
+			content, _ := tinysql.GetVal(row, "content")
+			ids = append(ids, id)
+			contents = append(contents, contentVal(content))
+		}
+		for i := 0; i < len(ids); i += batchSize {
+			end := min(i+batchSize, len(ids))
+			vecs, err := r.getLM().embed(context.Background(), contents[i:end])
 			if err != nil {
-				http.Error(w, "internal: "+err.Error(), 500)
-				return
+				return total, fmt.Errorf("collection %s: embed: %w", c.collection, err)
 			}
-			defer os.RemoveAll(tmpDir)
-			tmpPath := filepath.Join(tmpDir, "archive")
-			if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
-				http.Error(w, "internal: "+err.Error(), 500)
-				return
+			if len(vecs) != end-i {
+				return total, fmt.Errorf("collection %s: got %d vectors for %d chunks", c.collection, len(vecs), end-i)
 			}
-
-			if isZip {
-				zr, err := zip.OpenReader(tmpPath)
-				if err != nil {
-					http.Error(w, "invalid zip: "+err.Error(), 400)
-					return
-				}
-				defer zr.Close()
-				for _, f := range zr.File {
-					if f.FileInfo().IsDir() {
-						continue
-					}
-					ext := strings.ToLower(filepath.Ext(f.Name))
-					if !allowedExts[ext] {
-						continue
-					}
-					rc, err := f.Open()
-					if err != nil {
-						errorsList = append(errorsList, f.Name+": "+err.Error())
-						continue
-					}
-					content, err := io.ReadAll(io.LimitReader(rc, 6*1024*1024))
-					if closeErr := rc.Close(); closeErr != nil && err == nil {
-						err = closeErr
-					}
-					if err != nil {
-						errorsList = append(errorsList, f.Name+": "+err.Error())
-						continue
-					}
-					if len(content) == 0 {
-						continue
-					}
-					src := "upload:" + filename + ":" + f.Name
-					chunks := chunkText(string(content), s.ChunkSize)
-					if err := rag.addChunks(src, chunks); err != nil {
-						errorsList = append(errorsList, f.Name+": "+err.Error())
-						continue
-					}
-					totalFiles++
-					totalChars += len(content)
-					totalChunks += len(chunks)
-				}
-			} else {
-				// tar.gz
-				f, err := os.Open(tmpPath)
-				if err != nil {
-					http.Error(w, "internal: "+err.Error(), 500)
-					return
-				}
-				defer f.Close()
-				gz, err := gzip.NewReader(f)
-				if err != nil {
-					http.Error(w, "invalid gzip: "+err.Error(), 400)
-					return
-				}
-				defer gz.Close()
-				tr := tar.NewReader(gz)
-				for {
-					hdr, err := tr.Next()
-					if err == io.EOF {
-						break
-					}
-					if err != nil {
-						errorsList = append(errorsList, "tar read: "+err.Error())
-						break
-					}
-					if hdr.FileInfo().IsDir() {
-						continue
-					}
-					ext := strings.ToLower(filepath.Ext(hdr.Name))
-					if !allowedExts[ext] {
-						continue
-					}
-					if hdr.Size > 5*1024*1024 {
-						errorsList = append(errorsList, hdr.Name+": file too large")
-						continue
-					}
-					content, err := io.ReadAll(io.LimitReader(tr, 6*1024*1024))
-					if err != nil {
-						errorsList = append(errorsList, hdr.Name+": "+err.Error())
-						continue
-					}
-					src := "upload:" + filename + ":" + hdr.Name
-					chunks := chunkText(string(content), s.ChunkSize)
-					if err := rag.addChunks(src, chunks); err != nil {
-						errorsList = append(errorsList, hdr.Name+": "+err.Error())
-						continue
-					}
-					totalFiles++
-					totalChars += len(content)
-					totalChunks += len(chunks)
+			r.dbMu.Lock()
+			for j, v := range vecs {
+				if _, err = c.execLocked(fmt.Sprintf("UPDATE chunks SET embedding = VEC_FROM_JSON('%s') WHERE id = %v", vecJSON(v), ids[i+j])); err != nil {
+					break
 				}
 			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]any{
-				"archive": header.Filename,
-				"files":   totalFiles,
-				"chars":   totalChars,
-				"chunks":  totalChunks,
-				"total":   rag.docCount(),
-				"errors":  errorsList,
-			})
-			return
+			if len(vecs) > 0 {
+				r.dim = len(vecs[0])
+			}
+			if err == nil && end == len(ids) {
+				err = c.putMetaLocked(metaEmbedDim, r.dim)
+			}
+			c.invalidateCacheLocked()
+			r.markDirty()
+			r.dbMu.Unlock()
+			if err != nil {
+				return total, fmt.Errorf("collection %s: %w", c.collection, err)
+			}
+			total += end - i
+			log.Printf("reembed: %s: %d/%d chunks", c.collection, end, len(ids))
+		}
+	}
+	return total, r.save()
+}
+
+// compactStats reports what compact changed.
+type compactStats struct {
+	Collections     int `json:"collections"`
+	DuplicateChunks int `json:"duplicate_chunks"`
+	OrphanedSources int `json:"orphaned_sources"`
+	RepairedSources int `json:"repaired_sources"`
+}
+
+// compact removes duplicate chunks (same article and index, the oldest
+// is kept), drops sources without chunks, corrects source counts and
+// then writes a fresh snapshot (checkpointing the WAL, if any).
+func (r *ragSystem) compact() (compactStats, error) {
+	var st compactStats
+	for _, c := range r.allCollections() {
+		r.dbMu.Lock()
+		n, err := c.compactLocked(&st)
+		if n > 0 || err != nil {
+			c.invalidateCacheLocked()
+			r.markDirty()
+		}
+		r.dbMu.Unlock()
+		if err != nil {
+			return st, fmt.Errorf("collection %s: %w", c.collection, err)
+		}
+		st.Collections++
+		log.Printf("compact: %s: %d changes", c.collection, n)
+	}
+	if err := r.save(); err != nil {
+		return st, err
+	}
+	if wal := r.db.WAL(); wal != nil {
+		r.dbMu.Lock()
+		defer r.dbMu.Unlock()
+		return st, wal.Checkpoint(r.db)
+	}
+	return st, nil
+}
+
+// compactLocked compacts this collection, adding to `st`, and returns
+// the number of changes. It must be called with r.dbMu held.
+func (r *ragSystem) compactLocked(st *compactStats) (int, error) {
+	rs, err := r.execLocked("SELECT id, article, chunk_idx, content FROM chunks ORDER BY id")
+	if err != nil || rs == nil {
+		return 0, err
+	}
+	type count struct{ chunks, chars int }
+	counts := map[string]*count{}
+	seen := map[string]bool{}
+	changes := 0
+	for _, row := range rs.Rows {
+		id, _ := tinysql.GetVal(row, "id")
+		a, _ := tinysql.GetVal(row, "article")
+		i, _ := tinysql.GetVal(row, "chunk_idx")
+		content, _ := tinysql.GetVal(row, "content")
+		article := fmt.Sprint(a)
+		if key := fmt.Sprintf("%s\x00%v", article, i); seen[key] {
+			if _, err := r.execLocked(fmt.Sprintf("DELETE FROM chunks WHERE id = %v", id)); err != nil {
+				return changes, err
+			}
+			st.DuplicateChunks++
+			changes++
+			continue
+		} else {
+			seen[key] = true
 		}
+		if counts[article] == nil {
+			counts[article] = &count{}
+		}
+		counts[article].chunks++
+		counts[article].chars += len(contentVal(content))
+	}
 
-		// regular single-file upload
-		text := string(data)
-		title := filepath.Base(header.Filename)
-		chunks := chunkText(text, s.ChunkSize)
-		if err := rag.addChunks(title, chunks); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+	rs, err = r.execLocked("SELECT * FROM sources")
+	if err != nil || rs == nil {
+		return changes, err
+	}
+	recorded := map[string]bool{}
+	for _, row := range rs.Rows {
+		src := sourceFromRow(row)
+		recorded[src.Name] = true
+		cnt, ok := counts[src.Name]
+		switch {
+		case !ok:
+			_, err = r.execLocked(fmt.Sprintf("DELETE FROM sources WHERE name = %s", sqlText(src.Name)))
+			st.OrphanedSources++
+		case cnt.chunks != src.ChunkCount || cnt.chars != src.Chars:
+			_, err = r.execLocked(fmt.Sprintf("UPDATE sources SET chunk_count = %d, chars = %d WHERE name = %s", cnt.chunks, cnt.chars, sqlText(src.Name)))
+			st.RepairedSources++
+		default:
+			continue
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"file":   title,
-			"chars":  len(text),
-			"chunks": len(chunks),
-			"total":  rag.docCount(),
-		})
-	})
+		if err != nil {
+			return changes, err
+		}
+		changes++
+	}
+	for article, cnt := range counts {
+		if recorded[article] {
+			continue
+		}
+		if err := r.upsertSourceLocked(sourceInfo{Name: article, sourceOrigin: inferOrigin(article), ChunkCount: cnt.chunks, Chars: cnt.chars}); err != nil {
+			return changes, err
+		}
+		st.RepairedSources++
+		changes++
+	}
+	return changes, nil
+}
 
-	// GET /api/stats
-	mux.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"chunks":  rag.docCount(),
-			"sources": rag.listSources(),
-		})
-	})
+// kbStats summarizes this collection and the storage state for
+// /api/stats and `tinyrag stats`.
+func (r *ragSystem) kbStats() map[string]any {
+	return map[string]any{
+		"collection": r.collection,
+		"chunks":     r.docCount(),
+		"sources":    r.listSources(),
+		"storage":    r.saveStatus(),
+	}
+}
 
-	// GET /api/sources
-	mux.HandleFunc("/api/sources", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(rag.listSources())
-	})
+// dbLock is the lock file of an open database. It keeps a second web
+// server, CLI or maintenance command from using the same database.
+type dbLock struct{ path string }
 
-	// POST /api/sources/delete
-	mux.HandleFunc("/api/sources/delete", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
+// lockDB creates `dbPath`.lock holding our PID. A lock left by a process
+// that no longer runs is taken over.
+func lockDB(dbPath string) (*dbLock, error) {
+	path := dbPath + ".lock"
+	for range 2 {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			return &dbLock{path: path}, f.Close()
 		}
-		var req struct {
-			Article string `json:"article"`
+		if !os.IsExist(err) {
+			return nil, err
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Article == "" {
-			http.Error(w, "missing article", 400)
-			return
+		data, _ := os.ReadFile(path)
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		if pid > 0 && pid != os.Getpid() && processAlive(pid) {
+			return nil, fmt.Errorf("database %s is in use by process %d (lock file %s)", dbPath, pid, path)
 		}
-		if err := rag.deleteSource(req.Article); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+		log.Printf("Removing stale lock file %s", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{"deleted": req.Article, "total": rag.docCount()})
-	})
+	}
+	return nil, fmt.Errorf("cannot lock database %s", dbPath)
+}
 
-	// GET /api/chats — list conversations
-	mux.HandleFunc("/api/chats", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(chats.list())
-	})
+// release removes the lock file; it does nothing on a nil lock.
+func (l *dbLock) release() {
+	if l != nil {
+		os.Remove(l.path)
+	}
+}
 
-	// GET /api/chat/<id> and DELETE /api/chat/<id>
-	mux.HandleFunc("/api/chat/", func(w http.ResponseWriter, r *http.Request) {
-		id := strings.TrimPrefix(r.URL.Path, "/api/chat/")
-		if id == "" {
-			http.Error(w, "missing chat id", 400)
-			return
+// processAlive reports whether process `pid` is running.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true // FindProcess fails for processes that do not exist
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// errUsage marks invalid maintenance command lines (exit code 2).
+var errUsage = errors.New("usage")
+
+// maintenanceCommands are the subcommands handled by runMaintenance.
+var maintenanceCommands = []string{"export", "import", "reembed", "stats", "compact", "compress", "decompress"}
+
+// maintenanceUsage lists the maintenance subcommands.
+const maintenanceUsage = `Maintenance commands (no web server, no LLM needed except reembed):
+  tinyrag [flags] export [-o dump.jsonl]   write all collections as JSONL (default: stdout)
+  tinyrag [flags] import dump.jsonl|-      add the sources of a dump
+  tinyrag [flags] reembed                  recompute all embeddings with the configured model
+  tinyrag [flags] stats                    print collections and storage state
+  tinyrag [flags] compact                  remove duplicates and orphans, rewrite the database
+  tinyrag [flags] compress|decompress      store the text of all chunks compressed or plain`
+
+// runMaintenance runs the subcommand in `args` on `rag`. Results are
+// written as JSON to `out`; progress goes to the log (stderr).
+func runMaintenance(args []string, rag *ragSystem, s appSettings, out io.Writer) error {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	outPath := fs.String("o", "-", "Output file for export (- = stdout)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	var res any
+	switch args[0] {
+	case "export":
+		if fs.NArg() > 0 {
+			return fmt.Errorf("%w: export takes no arguments, use -o FILE", errUsage)
+		}
+		if *outPath == "-" {
+			// The dump itself is the result on stdout.
+			st, err := rag.exportDump(out, s.EmbedModel)
+			if err == nil {
+				log.Printf("export: %d collections, %d sources, %d chunks", st.Collections, st.Sources, st.Chunks)
+			}
+			return err
 		}
-		if r.Method == "DELETE" {
-			chats.remove(id)
-			w.Header().Set("Content-Type", "application/json")
-			fmt.Fprint(w, `{"ok":true}`)
-			return
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return err
 		}
-		conv := chats.get(id)
-		if conv == nil {
-			http.Error(w, "not found", 404)
-			return
+		bw := bufio.NewWriter(f)
+		st, err := rag.exportDump(bw, s.EmbedModel)
+		if err == nil {
+			err = bw.Flush()
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(conv)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		res = map[string]any{"file": *outPath, "export": st}
+	case "import":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("%w: import needs exactly one file (- = stdin)", errUsage)
+		}
+		var rd io.Reader = os.Stdin
+		if name := fs.Arg(0); name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			rd = f
+		}
+		st, err := rag.importDump(rd, s.EmbedModel)
+		if err != nil {
+			return err
+		}
+		for _, w := range st.Warnings {
+			log.Printf("WARN: %s", w)
+		}
+		res = map[string]any{"import": st}
+	case "reembed":
+		n, err := rag.reembed()
+		if err != nil {
+			return err
+		}
+		res = map[string]any{"reembedded": n, "embed_model": s.EmbedModel}
+	case "stats":
+		st := rag.kbStats()
+		st["collections"] = rag.listCollections()
+		res = st
+	case "compact":
+		st, err := rag.compact()
+		if err != nil {
+			return err
+		}
+		res = map[string]any{"compact": st}
+	case "compress", "decompress":
+		n, err := rag.recompress(args[0] == "compress")
+		if err != nil {
+			return err
+		}
+		res = map[string]any{args[0] + "ed": n}
+	default:
+		return fmt.Errorf("%w: unknown command %q", errUsage, args[0])
+	}
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
+
+// ─────────────────────────────────────────────────────────────────────────────
+// CLI
+// ─────────────────────────────────────────────────────────────────────────────
+
+// cliSystemPrompt is the system prompt of CLI answers, which run
+// without tools.
+const cliSystemPrompt = "Du bist ein hilfreicher Assistent. Beantworte Fragen basierend auf dem bereitgestellten Kontext. Wenn der Kontext die Antwort nicht enthält, sage das ehrlich."
+
+// answerCLI retrieves context for `question` and streams a single-turn
+// answer to `w`.
+func answerCLI(ctx context.Context, rag *ragSystem, s appSettings, question string, w io.Writer) (*debugInfo, error) {
+	ctxText, di, err := rag.prepareContext(ctx, question, false)
+	if err != nil {
+		return nil, fmt.Errorf("retrieval failed: %w", err)
+	}
+	msgs := []chatMsg{{Role: "user", Content: fmt.Sprintf("Kontext:\n%s\n\nFrage: %s", ctxText, question)}}
+	if err := rag.getLM().chatStream(ctx, withDateContext(cliSystemPrompt, s), msgs, w); err != nil {
+		return di, fmt.Errorf("LLM request failed: %w", err)
+	}
+	return di, nil
+}
+
+// runQuery answers `question` once for -q: the answer is streamed to
+// `w`, or with `asJSON` written as a single JSON line with its sources
+// and timings.
+func runQuery(rag *ragSystem, s appSettings, question string, asJSON bool, w io.Writer) error {
+	start := time.Now()
+	if !asJSON {
+		_, err := answerCLI(context.Background(), rag, s, question, w)
+		fmt.Fprintln(w)
+		return err
+	}
+	var answer strings.Builder
+	di, err := answerCLI(context.Background(), rag, s, question, &answer)
+	if err != nil {
+		return err
+	}
+	type source struct {
+		Article  string  `json:"article"`
+		ChunkIdx int     `json:"chunk_idx"`
+		Score    float64 `json:"score"`
+	}
+	sources := []source{}
+	for _, c := range di.Chunks {
+		sources = append(sources, source{Article: c.Article, ChunkIdx: c.ChunkIdx, Score: c.Score})
+	}
+	total := time.Since(start).Milliseconds()
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(map[string]any{
+		"answer":  strings.TrimSpace(answer.String()),
+		"sources": sources,
+		"timings": map[string]int64{
+			"embed_ms":  di.EmbedMs,
+			"search_ms": di.SearchMs,
+			"llm_ms":    total - di.EmbedMs - di.SearchMs,
+			"total_ms":  total,
+		},
 	})
+}
 
-	// POST /api/chats/new
-	mux.HandleFunc("/api/chats/new", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
+// maxCLIHistory bounds the lines kept in the CLI history file.
+const maxCLIHistory = 500
+
+// cliHistory is the persistent line history of the interactive CLI; it
+// implements term.History. Entries are appended to `path` as they are
+// added.
+type cliHistory struct {
+	lines []string // oldest first
+	path  string
+}
+
+// loadCLIHistory reads the history file at `path`, trimming it to the
+// last maxCLIHistory lines. A missing file yields an empty history.
+func loadCLIHistory(path string) *cliHistory {
+	h := &cliHistory{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return h
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			h.lines = append(h.lines, l)
 		}
-		var req struct {
-			Persona string `json:"persona_id"`
+	}
+	if len(h.lines) > maxCLIHistory {
+		h.lines = h.lines[len(h.lines)-maxCLIHistory:]
+		_ = os.WriteFile(path, []byte(strings.Join(h.lines, "\n")+"\n"), 0600)
+	}
+	return h
+}
+
+// Add records `entry` unless it repeats the previous line.
+func (h *cliHistory) Add(entry string) {
+	if entry == "" || (len(h.lines) > 0 && h.lines[len(h.lines)-1] == entry) {
+		return
+	}
+	h.lines = append(h.lines, entry)
+	if len(h.lines) > maxCLIHistory {
+		h.lines = h.lines[1:]
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(f, entry)
+	f.Close()
+}
+
+// Len returns the number of entries.
+func (h *cliHistory) Len() int { return len(h.lines) }
+
+// At returns the entry `idx` steps back; 0 is the most recent one.
+func (h *cliHistory) At(idx int) string { return h.lines[len(h.lines)-1-idx] }
+
+// cliReader reads CLI input lines. On a terminal it offers line editing
+// and history (up/down arrows); otherwise it reads plain lines.
+type cliReader struct {
+	fd      int
+	term    *term.Terminal
+	scanner *bufio.Scanner
+}
+
+// newCLIReader returns a reader for stdin. `historyPath` may be empty
+// to keep the history in memory only.
+func newCLIReader(prompt, historyPath string) *cliReader {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return &cliReader{scanner: bufio.NewScanner(os.Stdin)}
+	}
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, prompt)
+	if historyPath != "" {
+		t.History = loadCLIHistory(historyPath)
+	}
+	return &cliReader{fd: fd, term: t}
+}
+
+// readLine returns the next input line; io.EOF ends the session.
+func (r *cliReader) readLine() (string, error) {
+	if r.term == nil {
+		fmt.Print("tinyRAG> ")
+		if !r.scanner.Scan() {
+			if err := r.scanner.Err(); err != nil {
+				return "", err
+			}
+			return "", io.EOF
 		}
-		_ = json.NewDecoder(r.Body).Decode(&req)
-		conv := chats.create("", req.Persona)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(conv)
-	})
+		return r.scanner.Text(), nil
+	}
+	// The terminal is raw only while editing, so command output and
+	// Ctrl+C during an answer behave as usual.
+	old, err := term.MakeRaw(r.fd)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(r.fd, old)
+	if w, h, err := term.GetSize(r.fd); err == nil && w > 0 {
+		r.term.SetSize(w, h)
+	}
+	line, err := r.term.ReadLine()
+	if err == term.ErrPasteIndicator {
+		err = nil
+	}
+	return line, err
+}
 
-	// Custom APIs (persisted)
-	mux.HandleFunc("/api/settings/apis", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(customAPIs.list())
-		case "POST":
-			var req struct {
-				Name     string `json:"name"`
-				Template string `json:"template"`
-				Desc     string `json:"desc"`
+// splitArgs splits CLI arguments at whitespace; double quotes group
+// words ("Albert Einstein").
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg, quoted := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted, inArg = !quoted, true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unclosed quote")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// cliCommand is a slash command of the interactive CLI. `run` receives
+// the arguments after the command name.
+type cliCommand struct {
+	name, usage, help string
+	run               func(args []string) error
+}
+
+// runCLI runs the interactive CLI until /quit or end of input. Command
+// errors are printed and the loop continues. /set changes settings for
+// this session only.
+func runCLI(rag *ragSystem, settings *settingsStore, customAPIs *apiStore, historyPath string) {
+	s := settings.get()
+	var commands []cliCommand
+	commands = []cliCommand{
+		{"/help", "", "Show this help", func(args []string) error {
+			for _, c := range commands {
+				fmt.Printf("  %-26s %s\n", strings.TrimSpace(c.name+" "+c.usage), c.help)
+			}
+			fmt.Println("  Any other input is answered from the knowledge base.")
+			return nil
+		}},
+		{"/search", "<query>", "Show the best matching chunks", func(args []string) error {
+			if len(args) == 0 {
+				return errors.New("usage: /search <query>")
+			}
+			results, err := rag.searchJSON(context.Background(), strings.Join(args, " "), rag.topK(), "")
+			if err != nil {
+				return err
+			}
+			for i, r := range results {
+				fmt.Printf("%d. [%.4f] %s\n\n", i+1, r.Score, r.Content)
+			}
+			return nil
+		}},
+		{"/add", "<Article>", "Add a Wikipedia article", func(args []string) error {
+			art := strings.Join(args, " ")
+			if art == "" {
+				return errors.New("usage: /add <Article>")
+			}
+			if s.OfflineNetwork {
+				return errOfflineNetwork
+			}
+			fmt.Printf("Fetching %s...\n", art)
+			text, err := fetchWikipedia(context.Background(), art, s.Lang)
+			if err != nil {
+				return err
+			}
+			chunks := chunkText(text, s.ChunkSize)
+			fmt.Printf("  %d chars -> %d chunks\n", len(text), len(chunks))
+			err = rag.addChunks(context.Background(), art, chunks)
+			if errors.Is(err, errSourceExists) {
+				fmt.Printf("%s is already in the knowledge base\n", art)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Total: %d chunks\n", rag.docCount())
+			return nil
+		}},
+		{"/delete", "<article>", "Delete a source and its chunks", func(args []string) error {
+			name := strings.Join(args, " ")
+			if name == "" {
+				return errors.New("usage: /delete <article>")
+			}
+			i := slices.IndexFunc(rag.listSources(), func(src sourceInfo) bool { return src.Name == name })
+			if i < 0 {
+				return fmt.Errorf("unknown source %q (see /sources)", name)
+			}
+			if err := rag.deleteSource(name); err != nil {
+				return err
+			}
+			fmt.Printf("Deleted %s. Total: %d chunks\n", name, rag.docCount())
+			return nil
+		}},
+		{"/sources", "[article]", "List stored sources or preview one", func(args []string) error {
+			if name := strings.Join(args, " "); name != "" {
+				p, ok := rag.previewSource(name, defaultPreviewChars)
+				if !ok {
+					return fmt.Errorf("unknown source %q", name)
+				}
+				fmt.Printf("%s (%s) — %d chunks, %d chars, created %s, updated %s\n", p.Name, p.Type, p.ChunkCount, p.Chars, p.CreatedAt, p.UpdatedAt)
+				if p.Ref != "" {
+					fmt.Println(p.Ref)
+				}
+				if pv := p.Provenance; pv != nil {
+					fmt.Printf("Stored from %s %q at %s (chat %s, request %s)\n", pv.Tool, pv.Query, pv.At, cmp.Or(pv.ChatID, "-"), cmp.Or(pv.RequestID, "-"))
+				}
+				fmt.Println()
+				fmt.Println(p.Text)
+				if p.Truncated {
+					fmt.Printf("\n[%d of %d chunks shown]\n", p.ChunksShown, p.ChunkCount)
+				}
+				return nil
+			}
+			sources := rag.listSources()
+			if len(sources) == 0 {
+				fmt.Println("No sources.")
+				return nil
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "SOURCE\tTYPE\tCHUNKS\tCHARS\tUPDATED")
+			for _, src := range sources {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", src.Name, src.Type, src.ChunkCount, src.Chars, src.UpdatedAt)
+			}
+			return tw.Flush()
+		}},
+		{"/count", "", "Show the number of chunks", func(args []string) error {
+			fmt.Printf("%d chunks\n", rag.docCount())
+			return nil
+		}},
+		{"/settings", "", "Show the current settings", func(args []string) error {
+			v := s.clone()
+			for i := range v.CustomAPIs {
+				v.CustomAPIs[i] = v.CustomAPIs[i].masked()
+			}
+			b, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			if s.APIKey != "" {
+				fmt.Println("api_key:", maskSecret(s.APIKey))
+			}
+			return nil
+		}},
+		{"/set", "key=value ...", "Change k, chunk_size or lang for this session", func(args []string) error {
+			if len(args) == 0 {
+				return errors.New("usage: /set k=10 chunk_size=600 lang=en")
+			}
+			next := s
+			changed := map[string]bool{}
+			for _, a := range args {
+				key, val, ok := strings.Cut(a, "=")
+				if !ok {
+					return fmt.Errorf("expected key=value, got %q", a)
+				}
+				switch key {
+				case "k", "chunk_size":
+					n, err := strconv.Atoi(val)
+					if err != nil {
+						return fmt.Errorf("%s: %v", key, err)
+					}
+					if key == "k" {
+						next.K = n
+					} else {
+						next.ChunkSize = n
+					}
+				case "lang":
+					next.Lang = strings.ToLower(val)
+				default:
+					return fmt.Errorf("unknown setting %q (k, chunk_size, lang)", key)
+				}
+				changed[key] = true
 			}
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" || req.Template == "" {
-				http.Error(w, "missing name or template", 400)
-				return
+			if err := validateSettingsUpdate(next, changed); err != nil {
+				return err
 			}
-			if !strings.Contains(req.Template, "$q") {
-				http.Error(w, "template must contain $q placeholder", 400)
-				return
+			s = next
+			rag.setK(s.K)
+			fmt.Printf("k=%d chunk_size=%d lang=%s\n", s.K, s.ChunkSize, s.Lang)
+			return nil
+		}},
+		{"/tools", "[<name> <query>]", "List tools or run one", func(args []string) error {
+			if len(args) == 0 {
+				for _, t := range enabledTools(customAPIs.allTools(), s) {
+					fmt.Printf("  %-16s %s\n", t.Name, t.Description)
+				}
+				return nil
+			}
+			if len(args) < 2 {
+				return errors.New("usage: /tools <name> <query>")
 			}
-			api, err := customAPIs.add(req.Name, req.Template, req.Desc)
+			tr := toolRequest{Tool: args[0], Query: strings.Join(args[1:], " ")}
+			policy := effectiveToolPolicy(s, tr.Tool)
+			if !policy.Enabled {
+				return fmt.Errorf("tool %q is disabled", tr.Tool)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(policy.TimeoutS)*time.Second)
+			defer cancel()
+			ctx, details := withToolDetails(ctx)
+			text, source, err := runToolAudited(ctx, rag, customAPIs, s, "", "cli", tr)
 			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
+				return err
 			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(api)
-		default:
-			http.Error(w, "GET or POST only", 405)
-		}
-	})
+			fmt.Println(text)
+			if policy.persists() {
+				prov := sourceProvenance{RequestID: "cli", Tool: tr.Tool, Query: tr.Query}
+				n, err := persistToolResult(context.Background(), rag, s.ChunkSize, source, text, details, prov)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("\nStored as %s (%d chunks)\n", source, n)
+			}
+			return nil
+		}},
+		{"/quit", "", "Exit (also /exit, Ctrl+D)", nil},
+	}
 
-	mux.HandleFunc("/api/settings/apis/delete", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
-			return
-		}
-		var req struct {
-			ID string `json:"id"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
-			http.Error(w, "missing id", 400)
-			return
-		}
-		ok, err := customAPIs.remove(req.ID)
+	fmt.Println("Type /help for commands, or just ask a question.")
+	fmt.Println()
+
+	in := newCLIReader("tinyRAG> ", historyPath)
+	for {
+		line, err := in.readLine()
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			if err != io.EOF {
+				fmt.Printf("Error: %v\n", err)
+			}
+			fmt.Println("Bye!")
 			return
 		}
-		if !ok {
-			http.Error(w, "not found", 404)
-			return
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
 		}
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"ok":true}`)
-	})
 
-	// Personas (persisted)
-	mux.HandleFunc("/api/personas", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(personas.list())
-		case "POST":
-			var req struct {
-				Name   string `json:"name"`
-				Prompt string `json:"prompt"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
-				http.Error(w, "missing name", 400)
-				return
-			}
-			p, err := personas.add(req.Name, req.Prompt)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
+		if !strings.HasPrefix(line, "/") {
+			// Minimal single-turn ask: use top-k context and stream answer to stdout.
+			fmt.Print("\n>> ")
+			if _, err := answerCLI(context.Background(), rag, s, line, os.Stdout); err != nil {
+				fmt.Printf("Error: %v\n", err)
 			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(p)
-		default:
-			http.Error(w, "GET or POST only", 405)
+			fmt.Println()
+			fmt.Println()
+			continue
 		}
-	})
 
-	mux.HandleFunc("/api/personas/delete", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "POST only", 405)
+		name, rest, _ := strings.Cut(line, " ")
+		if name == "/quit" || name == "/exit" {
+			fmt.Println("Bye!")
 			return
 		}
-		var req struct {
-			ID string `json:"id"`
+		i := slices.IndexFunc(commands, func(c cliCommand) bool { return c.name == name })
+		if i < 0 {
+			fmt.Printf("Unknown command %s (see /help)\n\n", name)
+			continue
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
-			http.Error(w, "missing id", 400)
-			return
+		args, err := splitArgs(rest)
+		if err == nil {
+			err = commands[i].run(args)
 		}
-		ok, err := personas.remove(req.ID)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+			fmt.Printf("Error: %v\n", err)
 		}
-		if !ok {
-			http.Error(w, "not found", 404)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"ok":true}`)
-	})
-
-	fmt.Printf("Web interface: http://localhost%s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, mux))
-}
-
-// execSmallR executes the smallR demo to evaluate `expr` and returns its stdout.
-// It prefers a local `./smallr` binary if present, otherwise falls back to
-// `go run smallr.go -e` which requires the Go toolchain at runtime.
-func execSmallR(expr string) (string, error) {
-	ctx := smallr.NewContext()
-	res, err := ctx.EvalString(expr)
-	if err != nil {
-		return "", fmt.Errorf("smallr eval failed: %w", err)
-	}
-	if strings.TrimSpace(res.Output) != "" {
-		return res.Output, nil
+		fmt.Println()
 	}
-	return res.Value.String(), nil
 }
 
-// RunSafe executes untrusted Go source inside the nanoGo interpreter
-// with a context-based timeout. It captures ConsoleLog/ConsoleWarn/ConsoleError
-// output into a buffer and recovers from panics so the host application
-// is not crashed by user code.
-func RunSafe(source string, timeout time.Duration) (string, error) {
-	defer func() {
-		if r := recover(); r != nil {
-			// recovered panic will be returned as error below
-		}
-	}()
-
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+// ─────────────────────────────────────────────────────────────────────────────
+// main
+// ─────────────────────────────────────────────────────────────────────────────
 
-	outBuf := &bytes.Buffer{}
-	done := make(chan error, 1)
-	go func() {
-		done <- runInterpreted(source, outBuf)
-	}()
+// verboseLog enables debugf output (-verbose).
+var verboseLog bool
 
-	select {
-	case err := <-done:
-		return outBuf.String(), err
-	case <-ctx.Done():
-		return outBuf.String(), fmt.Errorf("execution timed out after %s", timeout)
+// debugf logs like log.Printf when -verbose is set.
+func debugf(format string, args ...any) {
+	if verboseLog {
+		log.Printf("DEBUG "+format, args...)
 	}
 }
 
-// runInterpreted creates a sandboxed interpreter, registers only the
-// host functions we choose to expose, and executes the source.
-func runInterpreted(source string, out *bytes.Buffer) error {
-	vm := nanogo.NewInterpreter()
-	registerSafeNatives(vm, out)
-	nanogo.RegisterBuiltinPackages(vm)
-	return vm.Run(source)
-}
-
-// registerSafeNatives installs a minimal set of host functions that are
-// safe to expose to untrusted user code. Output is written to `out`.
-func registerSafeNatives(vm *nanogo.Interpreter, out *bytes.Buffer) {
-	vm.RegisterNative("ConsoleLog", func(args []any) (any, error) {
-		if len(args) > 0 {
-			fmt.Fprintln(out, nanogo.ToString(args[0]))
-		}
-		return nil, nil
-	})
-
-	vm.RegisterNative("ConsoleWarn", func(args []any) (any, error) {
-		if len(args) > 0 {
-			fmt.Fprintln(out, "[warn] "+nanogo.ToString(args[0]))
-		}
-		return nil, nil
-	})
-
-	vm.RegisterNative("ConsoleError", func(args []any) (any, error) {
-		if len(args) > 0 {
-			fmt.Fprintln(out, "[error] "+nanogo.ToString(args[0]))
-		}
-		return nil, nil
-	})
-
-	vm.RegisterNative("__hostSprintf", func(args []any) (any, error) {
-		if len(args) == 0 {
-			return "", nil
-		}
-		format := nanogo.ToString(args[0])
-		fmtArgs := make([]any, 0, len(args)-1)
-		for _, a := range args[1:] {
-			fmtArgs = append(fmtArgs, a)
-		}
-		return fmt.Sprintf(format, fmtArgs...), nil
-	})
+// configEnv maps environment variables to flags and settings.json keys.
+// Precedence: environment > settings.json > flags (first run only).
+// Variables with a settings key are applied on top of settings.json and
+// never written back; the others replace the flag value.
+var configEnv = []struct {
+	Env, Flag, Setting string
+}{
+	{"TINYRAG_BASE_URL", "url", "base_url"},
+	{"TINYRAG_CHAT_MODEL", "chat-model", "chat_model"},
+	{"TINYRAG_EMBED_MODEL", "embed-model", "embed_model"},
+	{"TINYRAG_API_KEY", "", "api_key"},
+	{"TINYRAG_K", "k", "k"},
+	{"TINYRAG_CHUNK_SIZE", "chunk-size", "chunk_size"},
+	{"TINYRAG_LANG", "lang", "lang"},
+	{"TINYRAG_PROXY_URL", "", "proxy_url"},
+	{"TINYRAG_ADDR", "addr", ""},
+	{"TINYRAG_DB", "db", ""},
+	{"TINYRAG_SETTINGS", "settings", ""},
+	{"TINYRAG_CHATS", "chats", ""},
+	{"TINYRAG_STORAGE_MODE", "storage-mode", ""},
+	{"TINYRAG_MAX_MEM_MB", "max-mem-mb", ""},
+	{"TINYRAG_AUTOSAVE", "autosave", ""},
+	{"TINYRAG_FETCH_CACHE", "fetch-cache", ""},
+	{"TINYRAG_PLUGINS_DIR", "plugins-dir", ""},
 }
 
-// ─────────────────────────────────────────────────────────────────────────────
-// main
-// ─────────────────────────────────────────────────────────────────────────────
-
 // main parses flags, initializes components and starts either the
-// web interface or a minimal CLI loop.
+// web interface, a one-shot query (-q), a maintenance command or a
+// minimal CLI loop.
 func main() {
 	// Runtime flags
 	addr := flag.String("addr", ":8080", "Web interface listen address")
@@ -3967,6 +16088,20 @@ func main() {
 	chatsPath := flag.String("chats", "chats.json", "Persisted chats JSON path (empty=memory only)")
 	storageFlag := flag.String("storage-mode", "memory", "Storage mode: memory, wal, disk, index, hybrid")
 	maxMemMB := flag.Int64("max-mem-mb", 256, "Max memory in MB for hybrid/index mode")
+	toolLog := flag.String("tool-log", "", "Append tool executions as JSONL to this file (empty=memory only)")
+	pluginsDir := flag.String("plugins-dir", "", "Directory with plugin executables and their JSON manifests (requires allow_plugins)")
+	fetchCache := flag.String("fetch-cache", "fetch-cache", "Directory for cached web pages (empty=no cache)")
+	fetchDelay := flag.Duration("fetch-delay", time.Second, "Minimum delay between requests to the same host")
+	ignoreRobots := flag.String("ignore-robots", "", "Comma-separated hosts you own for which robots.txt is not checked")
+	autosaveEvery := flag.Duration("autosave", 5*time.Minute, "Save unsaved database changes at this interval (0=disabled)")
+	question := flag.String("q", "", "Answer this question, print the answer to stdout and exit (no web server)")
+	flag.StringVar(question, "question", "", "Alias for -q")
+	jsonOut := flag.Bool("json", false, "With -q: print answer, sources and timings as one JSON line")
+	var allowedImportRoots stringList
+	flag.Var(&allowedImportRoots, "allowed-import-roots", "Directory folder imports may read from, repeatable (default: the working directory)")
+	flag.StringVar(&devAssetsDir, "dev-assets", "", "Serve index.html, style.css and app.js from this directory, read per request (frontend development)")
+	noKBCache := flag.Bool("no-kb-cache", false, "Always query chunk counts and source lists instead of caching them (troubleshooting)")
+	flag.BoolVar(&verboseLog, "verbose", false, "Log debug details, e.g. model replies that fail validation")
 
 	// Defaults for first run (written to settings.json if it doesn't exist)
 	urlFlag := flag.String("url", "http://localhost:1234", "Default OpenAI-compatible base URL (first run only)")
@@ -3976,7 +16111,46 @@ func main() {
 	lang := flag.String("lang", "de", "Wikipedia language (first run only)")
 	chunkSize := flag.Int("chunk-size", 800, "Max characters per chunk (first run only)")
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: tinyrag [flags] [command]\n\nFlags:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\n%s\n", maintenanceUsage)
+	}
 	flag.Parse()
+	// Maintenance commands print results to stdout; everything else,
+	// including startup messages, goes to stderr.
+	sub := flag.Args()
+	maintenance := len(sub) > 0
+	resultOut := os.Stdout
+	if maintenance {
+		if !slices.Contains(maintenanceCommands, sub[0]) {
+			fmt.Fprintf(os.Stderr, "tinyrag: unknown command %q\n\n%s\n", sub[0], maintenanceUsage)
+			os.Exit(2)
+		}
+		if *question != "" {
+			fmt.Fprintln(os.Stderr, "tinyrag: -q cannot be combined with a command")
+			os.Exit(2)
+		}
+		os.Stdout = os.Stderr
+	}
+	// A one-shot query keeps stdout for the answer and reports errors on
+	// stderr with a non-zero exit code; startup messages are discarded.
+	oneShot := *question != ""
+	answerOut := os.Stdout
+	if oneShot {
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", os.DevNull, err)
+		}
+		os.Stdout = devNull
+	}
+	for _, e := range configEnv {
+		if v, ok := os.LookupEnv(e.Env); ok && e.Setting == "" {
+			if err := flag.Set(e.Flag, v); err != nil {
+				log.Fatalf("Invalid %s: %v", e.Env, err)
+			}
+		}
+	}
 
 	// Parse storage mode
 	storageMode, err := tinysql.ParseStorageMode(*storageFlag)
@@ -3990,24 +16164,67 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load settings: %v", err)
 	}
+	for _, e := range configEnv {
+		if v, ok := os.LookupEnv(e.Env); ok && e.Setting != "" {
+			if err := settings.pin(e.Setting, e.Env, v); err != nil {
+				log.Fatalf("Invalid environment override: %v", err)
+			}
+			log.Printf("Setting %s pinned by %s", e.Setting, e.Env)
+		}
+	}
 	s := settings.get()
+	if err := setOutboundProxy(s.ProxyURL); err != nil {
+		log.Fatalf("Failed to configure proxy: %v", err)
+	}
 
 	// Connect to LLM endpoint
-	lm := newLMClient(s.BaseURL, s.EmbedModel, s.ChatModel)
-	fmt.Printf("Connecting to LLM endpoint (%s)… ", s.BaseURL)
-	if err := lm.ping(); err != nil {
-		fmt.Println("FAILED")
-		log.Fatalf("Cannot reach LLM endpoint at %s: %v\nTip: open Settings in the UI and pick LM Studio (:1234) or Ollama (:11434).", s.BaseURL, err)
+	lm := newLMClient(s.BaseURL, s.EmbedModel, s.ChatModel, s.APIKey)
+	lm.embedDims = s.EmbedDimensions
+	var lmErr error
+	if oneShot {
+		if err := lm.ping(); err != nil {
+			fmt.Fprintf(os.Stderr, "tinyrag: cannot reach LLM endpoint at %s: %v\n", s.BaseURL, err)
+			os.Exit(1)
+		}
+	} else if !maintenance || sub[0] == "reembed" {
+		fmt.Printf("Connecting to LLM endpoint (%s)… ", s.BaseURL)
+		if err := lm.ping(); err != nil {
+			fmt.Println("FAILED")
+			if !*web || maintenance {
+				log.Fatalf("Cannot reach LLM endpoint at %s: %v\nTip: start LM Studio (:1234) or Ollama (:11434), or change base_url in %s.", s.BaseURL, err, *settingsPath)
+			}
+			// The web UI is where the endpoint gets fixed, so it starts
+			// anyway; LLM-backed endpoints answer 503 until then.
+			lmErr = err
+			log.Printf("WARNING: cannot reach LLM endpoint at %s: %v", s.BaseURL, err)
+			log.Printf("WARNING: asking, searching and adding data are disabled until a working endpoint is saved in Settings (LM Studio :1234, Ollama :11434).")
+		} else {
+			fmt.Println("OK")
+		}
+	}
+
+	// One process per database; -q only reads and needs no lock.
+	var lock *dbLock
+	if !oneShot && *dbPath != "" {
+		if lock, err = lockDB(*dbPath); err != nil {
+			log.Fatalf("%v", err)
+		}
 	}
-	fmt.Println("OK")
+	defer lock.release()
 
 	rag, err := newRAG(lm, s.K, *dbPath, storageMode, *maxMemMB)
 	if err != nil {
 		log.Fatalf("Failed to create RAG: %v", err)
 	}
+	rag.noCache = *noKBCache
+	rag.compress = s.CompressChunks
 	if err := rag.init(); err != nil {
 		log.Fatalf("Failed to init table: %v", err)
 	}
+	rag.setQueryPatterns(queryPatternsFor(s))
+	rag.setCalibrations(s.Calibration)
+	rag.setMaxContextChars(s.MaxContextChars)
+	rag.setLMError(lmErr)
 
 	// Ensure database is flushed on exit
 	defer func() {
@@ -4016,83 +16233,99 @@ func main() {
 		}
 	}()
 
+	if *autosaveEvery > 0 && *dbPath != "" {
+		go rag.autosave(*autosaveEvery)
+	}
+
+	// log.Fatal in the web server skips deferred calls, so flush on
+	// Ctrl+C / SIGTERM explicitly.
+	refresher := newRefreshScheduler()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		refresher.stop()
+		log.Println("Shutting down, saving database...")
+		if err := rag.save(); err != nil {
+			log.Printf("Warning: failed to save database: %v", err)
+		}
+		if err := rag.db.Close(); err != nil {
+			log.Printf("Warning: failed to close database: %v", err)
+		}
+		lock.release()
+		os.Exit(0)
+	}()
+
+	if maintenance {
+		if err := runMaintenance(sub, rag, s, resultOut); err != nil {
+			fmt.Fprintf(os.Stderr, "tinyrag %s: %v\n", sub[0], err)
+			rag.db.Close()
+			lock.release()
+			if errors.Is(err, errUsage) {
+				fmt.Fprintf(os.Stderr, "\n%s\n", maintenanceUsage)
+				os.Exit(2)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	if oneShot {
+		// Retrieval logs its progress; stderr is kept for the error.
+		log.SetOutput(io.Discard)
+		if err := runQuery(rag, s, *question, *jsonOut, answerOut); err != nil {
+			fmt.Fprintf(os.Stderr, "tinyrag: %v\n", err)
+			rag.db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
 	existing := rag.docCount()
 	if existing > 0 {
 		fmt.Printf("Database has %d existing chunks.\n", existing)
 	}
 
+	if *toolLog != "" {
+		if err := toolHistory.openFile(*toolLog); err != nil {
+			log.Fatalf("Failed to open tool log: %v", err)
+		}
+	}
+
+	fetcher = newFetchCoordinator(*fetchCache, *fetchDelay, strings.Split(*ignoreRobots, ","))
+	if err := setImportRoots(allowedImportRoots); err != nil {
+		log.Fatalf("Invalid -allowed-import-roots: %v", err)
+	}
+
+	if *pluginsDir != "" {
+		loaded, err := loadPlugins(*pluginsDir)
+		if err != nil {
+			log.Fatalf("Failed to load plugins: %v", err)
+		}
+		plugins = loaded
+		for _, p := range plugins {
+			fmt.Printf("Plugin loaded: %s (%s)\n", p.Name, p.Path)
+		}
+		if len(plugins) > 0 && !s.AllowPlugins {
+			fmt.Println("Plugins are disabled; set allow_plugins in settings to use them.")
+		}
+	}
+
 	customAPIs := newAPIStore(settings)
 	personas := newPersonaStore(settings)
 	chats := newChatStore(*chatsPath)
 
 	if *web {
+		refresher.start(rag, settings)
+		go warmer.run(rag, settings)
 		runWebServer(rag, *addr, settings, chats, customAPIs, personas)
 		return
 	}
 
-	// CLI mode (kept minimal)
-	fmt.Println("Commands: /search <query> | /add <Article> | /count | /quit")
-	fmt.Println("Or just type a question for RAG-answered chat.")
-	fmt.Println()
-
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		fmt.Print("tinyRAG> ")
-		if !scanner.Scan() {
-			break
-		}
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-
-		switch {
-		case line == "/quit" || line == "/exit":
-			fmt.Println("Bye!")
-			return
-
-		case line == "/count":
-			fmt.Printf("%d chunks\n", rag.docCount())
-
-		case strings.HasPrefix(line, "/add "):
-			art := strings.TrimSpace(strings.TrimPrefix(line, "/add "))
-			fmt.Printf("Fetching %s...\n", art)
-			text, err := fetchWikipedia(art, s.Lang)
-			if err != nil {
-				fmt.Printf("Error: %v\n", err)
-				continue
-			}
-			chunks := chunkText(text, s.ChunkSize)
-			fmt.Printf("  %d chars -> %d chunks\n", len(text), len(chunks))
-			if err := rag.addChunks(art, chunks); err != nil {
-				fmt.Printf("Error: %v\n", err)
-			}
-			fmt.Printf("Total: %d chunks\n", rag.docCount())
-
-		case strings.HasPrefix(line, "/search "):
-			query := strings.TrimSpace(strings.TrimPrefix(line, "/search "))
-			results, err := rag.searchJSON(query, s.K)
-			if err != nil {
-				fmt.Printf("Error: %v\n", err)
-				continue
-			}
-			for i, r := range results {
-				fmt.Printf("%d. [%.4f] %s\n\n", i+1, r.Score, r.Content)
-			}
-
-		default:
-			// Minimal single-turn ask: use top-k context and stream answer to stdout.
-			ctxText, _, err := rag.prepareContext(line, false)
-			if err != nil {
-				fmt.Printf("Error: %v\n", err)
-				continue
-			}
-			system := "Du bist ein hilfreicher Assistent. Beantworte Fragen basierend auf dem bereitgestellten Kontext. Wenn der Kontext die Antwort nicht enthält, sage das ehrlich."
-			msgs := []chatMsg{{Role: "user", Content: fmt.Sprintf("Kontext:\n%s\n\nFrage: %s", ctxText, line)}}
-			fmt.Print("\n>> ")
-			_ = rag.getLM().chatStream(context.Background(), system, msgs, os.Stdout)
-			fmt.Println()
-		}
-		fmt.Println()
+	// CLI mode; history is kept in the home directory if there is one
+	historyPath := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyPath = filepath.Join(home, ".tinyrag_history")
 	}
+	runCLI(rag, settings, customAPIs, historyPath)
 }
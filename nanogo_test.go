@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInstrumentNanoGo(t *testing.T) {
+	out, err := instrumentNanoGo("package main\n\nfunc main() {\n\tfor i := 0; i < 3; i++ {\n\t\tConsoleLog(i)\n\t}\n\tf := func() {}\n\tf()\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out, "__hostTick()"); n != 3 {
+		t.Fatalf("%d ticks in\n%s", n, out)
+	}
+	// A snippet without package clause is completed.
+	out, err = instrumentNanoGo("func main() {\n\tfor {\n\t}\n}\n")
+	if err != nil || !strings.HasPrefix(out, "package main") || strings.Count(out, "__hostTick()") != 2 {
+		t.Fatalf("snippet: %v\n%s", err, out)
+	}
+}
+
+func TestRunNanoGoRejectsUnparseableSource(t *testing.T) {
+	res := runNanoGo("for { ConsoleLog(1) }", nanoGoLimits{Timeout: 1e9, MaxSteps: 10})
+	if !strings.Contains(res.Error, "step budget cannot be enforced") || res.Steps != 0 {
+		t.Fatalf("%+v", res)
+	}
+}
+
+func TestNanoGoSandboxBudgets(t *testing.T) {
+	sb := &nanoGoSandbox{lim: nanoGoLimits{MaxOutput: 5, MaxSteps: 3}}
+	if sb.write("abc") != nil || sb.write("defg") != nil {
+		t.Fatal("writes within the step budget failed")
+	}
+	if err := sb.tick(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.tick(); err == nil || !strings.Contains(err.Error(), "step budget") {
+		t.Fatalf("4th step: %v", err)
+	}
+	if sb.write("x") == nil {
+		t.Fatal("write after abort succeeded")
+	}
+	if res := sb.result(); res.Output != "abcde" || !res.Truncated || res.PeakOutput != 7 {
+		t.Fatalf("%+v", res)
+	}
+}
+
+// The memory budget measures the process heap, so allocations made outside
+// the program count towards it. This documents the limitation.
+func TestNanoGoMemoryBudgetIsProcessWide(t *testing.T) {
+	sb := &nanoGoSandbox{lim: nanoGoLimits{MaxMemMB: 1}, heapBase: heapBytes()}
+	for i := 0; i < 1023; i++ {
+		if err := sb.tick(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := make([]byte, 8<<20) // allocated by "another request"
+	for i := range other {
+		other[i] = 1
+	}
+	if err := sb.tick(); err == nil || !strings.Contains(err.Error(), "memory limit") {
+		t.Fatalf("heap growth not detected: %v", err)
+	}
+	_ = other[len(other)-1]
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitSentences(t *testing.T) {
+	got := splitSentences("Am 2. Oktober kam z. B. Dr. Meier. Dann ging er! Wirklich?\nJa")
+	want := []string{"Am 2. Oktober kam z. B. Dr. Meier.", "Dann ging er!", "Wirklich?", "Ja"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestExtractiveAnswer(t *testing.T) {
+	filler := strings.Repeat("Die Gemeinde hat eine Kirche, eine Schule und mehrere Vereine. ", 30)
+	chunks := []debugChunk{
+		{Article: "Ettling", ChunkIdx: 0, Score: 0.8, Content: filler + "Ettling war bis 1978 selbständig, z. B. mit eigenem Bürgermeister. Ettling hat 1.234 Einwohner."},
+		{Article: "Ettling", ChunkIdx: 1, Score: -1, IsNeighbor: true, Content: "Der Ort wurde 1100 erstmals erwähnt.\nHeute gehört er zu Pilsting."},
+		{Article: "Landau", ChunkIdx: 4, Score: 0.7, Content: filler + "Landau an der Isar hat rund 13.000 Einwohner."},
+	}
+	ans := extractiveAnswer("Wie viele Einwohner hat Ettling?", chunks, offlineAnswerBudget)
+	if n := utf8.RuneCountInString(ans); n > offlineAnswerBudget {
+		t.Fatalf("answer has %d characters, budget %d", n, offlineAnswerBudget)
+	}
+	if !strings.Contains(ans, "Ettling hat 1.234 Einwohner. [1]") {
+		t.Fatalf("answer sentence missing: %q", ans)
+	}
+	if i := strings.Index(ans, "Gemeinde"); i >= 0 && i < strings.Index(ans, "1.234") {
+		t.Fatalf("filler before the answer: %q", ans)
+	}
+	if small := extractiveAnswer("Einwohner Ettling", chunks, 120); utf8.RuneCountInString(small) > 120 {
+		t.Fatalf("small budget: %d characters", utf8.RuneCountInString(small))
+	}
+	if a := extractiveAnswer("Quantenphysik", chunks[:1], 400); !strings.Contains(a, "[1]") {
+		t.Fatalf("no first-sentence fallback: %q", a)
+	}
+}
+
+func TestOfflineAnswer(t *testing.T) {
+	data, err := os.ReadFile("testdata/offline/ettling.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEnv(t)
+	chunks := chunkText(string(data), 200)
+	vecs := make([][]float64, len(chunks))
+	for i, c := range chunks {
+		vecs[i] = wordVec(c)
+	}
+	if _, err := e.rag.storeChunks(sourceInfo{Name: "Ettling"}, chunks, vecs); err != nil {
+		t.Fatal(err)
+	}
+	// Offline, hits above the relaxed threshold are used without asking
+	// the model; fakeLLM's word counts score lower than real embeddings.
+	e.rag.setCalibrations(map[string]scoreCalibration{"embed": {High: 0.9, Relaxed: 0.3}})
+	question := "Wie viele Einwohner hat Ettling?"
+
+	text := sseText(t, e.ask(t, map[string]any{"question": question, "offline": true}))
+	answer, _, _ := strings.Cut(text, "\n\n---")
+	if n := utf8.RuneCountInString(answer); n > offlineAnswerBudget {
+		t.Fatalf("answer has %d characters, budget %d", n, offlineAnswerBudget)
+	}
+	if !strings.Contains(answer, "Ettling hat 1.234 Einwohner.") || strings.Contains(answer, "Zuckerrüben") {
+		t.Fatalf("answer %q", answer)
+	}
+	if n := e.llm.chatCount(); n != 0 {
+		t.Fatalf("%d chat requests in offline mode", n)
+	}
+
+	raw := sseText(t, e.ask(t, map[string]any{"question": question, "offline": true, "raw": true}))
+	if !strings.Contains(raw, chunks[1]) || raw == text {
+		t.Fatalf("raw answer %q", raw)
+	}
+}
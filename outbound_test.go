@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// endlessServer streams data forever, or redirects in a loop on /loop.
+func endlessServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loop":
+			http.Redirect(w, r, "/loop", 302)
+			return
+		case "/json":
+			w.Write([]byte(`{"a":"`))
+		}
+		buf := []byte(strings.Repeat("<p>aaaa, bbb</p>", 1024))
+		for {
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestEndlessResponsesAreCut(t *testing.T) {
+	noFetchDelay(t)
+	srv := endlessServer(t)
+	ctx := context.Background()
+	allow := []string{"127.0.0.1"}
+
+	start := time.Now()
+	_, _, err := fetchPage(ctx, srv.URL+"/page", allow)
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("page: %v", err)
+	}
+	if err := getJSON(ctx, srv.URL+"/json", &map[string]any{}); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("json: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("took %s", d)
+	}
+
+	if _, _, err := fetchPage(ctx, srv.URL+"/loop", allow); err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Fatalf("redirect loop: %v", err)
+	}
+}
+
+func TestReadLimited(t *testing.T) {
+	if b, err := readLimited(strings.NewReader("12345"), 5); err != nil || string(b) != "12345" {
+		t.Fatalf("at the limit: %q %v", b, err)
+	}
+	if _, err := readLimited(strings.NewReader("123456"), 5); err == nil {
+		t.Fatal("over the limit accepted")
+	}
+}
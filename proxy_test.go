@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOutboundProxy(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	px := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.URL.String())
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/embeddings") {
+			json.NewEncoder(w).Encode(map[string]any{"data": []any{map[string]any{"index": 0, "embedding": []float64{1, 0}}}})
+			return
+		}
+		w.Write([]byte("<p>" + strings.Repeat("proxied text, ", 30) + "</p>"))
+	}))
+	defer px.Close()
+	if err := setOutboundProxy(px.URL); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { setOutboundProxy("") })
+	noFetchDelay(t)
+	ctx := context.Background()
+
+	resp, err := newHTTPClient(5e9).Get("http://example.invalid/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Public names the local resolver doesn't know are left to the proxy.
+	if _, text, err := fetchPage(ctx, "http://example.invalid/page", nil); err != nil || !strings.Contains(text, "proxied") {
+		t.Fatalf("page: %v", err)
+	}
+	if _, err := newLMClient("http://llm.invalid", "embed", "chat", "").embed(ctx, []string{"x"}); err != nil {
+		t.Fatalf("lm client: %v", err)
+	}
+	// Internal addresses stay blocked behind a proxy.
+	if _, _, err := fetchPage(ctx, "http://10.1.2.3/page", nil); err == nil || !strings.Contains(err.Error(), "allowed_hosts") {
+		t.Fatalf("internal: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"http://example.invalid/plain", "http://example.invalid/page", "http://llm.invalid/v1/embeddings"}
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			found = found || g == w
+		}
+		if !found {
+			t.Errorf("%s not proxied, got %v", w, got)
+		}
+	}
+
+	if st := proxyStatus("http://localhost:1234"); st["active"] != true || st["target_proxied"] != false {
+		t.Errorf("localhost: %v", st)
+	}
+	if st := proxyStatus("http://remote.example"); st["target_proxied"] != true || st["source"] != "settings" {
+		t.Errorf("remote: %v", st)
+	}
+	if err := setOutboundProxy("kein proxy"); err == nil {
+		t.Error("invalid proxy accepted")
+	}
+}
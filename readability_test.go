@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExtractMainContentFixtures(t *testing.T) {
+	cases := []struct {
+		file, title string
+		want        []string
+		absent      []string
+	}{
+		{"news.html", "Hochwasser an der Donau: Pegel in Passau sinkt langsam | Tagesblatt",
+			[]string{"Pegel der Donau in Passau", "Altstadt zwischen Donau und Inn", "Oberbürgermeister", "mobile Schutzwände"},
+			[]string{"Cookies", "Wirtschaft", "Meistgelesen", "Newsletter", "Impressum", "Liveticker", "Twittern", "dataLayer"}},
+		{"docs.html", "Configuring retries — fetchkit documentation",
+			[]string{"retries idempotent requests", "MaxAttempts: 5", "io.Seeker", "Retry-After"},
+			[]string{"Table of contents", "Using proxies", "GitHub", "Sphinx", "font-family", "« Quickstart"}},
+	}
+	for _, c := range cases {
+		t.Run(c.file, func(t *testing.T) {
+			doc, err := os.ReadFile("testdata/readability/" + c.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			title, text := extractMainContent(string(doc))
+			if title != c.title {
+				t.Errorf("title %q", title)
+			}
+			if len(text) < minMainContentChars {
+				t.Fatalf("only %d chars: %q", len(text), text)
+			}
+			for _, w := range c.want {
+				if !strings.Contains(text, w) {
+					t.Errorf("missing %q in\n%s", w, text)
+				}
+			}
+			for _, a := range c.absent {
+				if strings.Contains(text, a) {
+					t.Errorf("page chrome %q in\n%s", a, text)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractMainContentTiesAreStable(t *testing.T) {
+	block := `<p>` + strings.Repeat("Gleich lange Absätze, mit Kommas, ergeben gleiche Punkte. ", 4) + `</p>`
+	doc := `<html><body><section id="a"><div>` + block + `</div></section><section id="b"><div>` +
+		strings.Replace(block, "Gleich", "Anders", 1) + `</div></section></body></html>`
+	for i := 0; i < 50; i++ {
+		_, text := extractMainContent(doc)
+		if !strings.HasPrefix(text, "Gleich") {
+			t.Fatalf("run %d picked %q", i, text[:20])
+		}
+	}
+}
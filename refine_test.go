@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestRefineSearchQuery(t *testing.T) {
+	de := compileQueryPatterns(queryPatternsFor(appSettings{Lang: "de"}))
+	cases := []struct{ in, want string }{
+		{"was weißt du über Ettling", "Ettling"},
+		{"Was weißt du über Ettling?", "Ettling"},
+		{"Was weißt du Über Österreich?!", "Österreich"},
+		{"Hallo, wer ist Ärzte ohne Grenzen?", "Ärzte ohne Grenzen"},
+		{"Erkläre mir die Photosynthese.", "die Photosynthese"},
+		{"erklär mir bitte Quantenmechanik", "Quantenmechanik"},
+		{"Definiere Entropie", "Entropie"},
+		{"Wer ist Angela Merkel?", "Angela Merkel"},
+		{"Was ist ein Isotop?", "Isotop"},
+		{"What is the Eiffel Tower?", "Eiffel Tower"},
+		{"what does ubiquitous mean?", "ubiquitous"},
+		{"Who is J.R.R. Tolkien?", "J.R.R. Tolkien"},
+		// The entity keeps words of the patterns and its case.
+		{"Tell me about Who is Who", "Who is Who"},
+		{"Erzähl mir von Wer ist wer", "Wer ist wer"},
+		// ß and SS are not folded.
+		{"WAS WEISST DU ÜBER Köln?", "WAS WEISST DU ÜBER Köln?"},
+		// Not refined.
+		{"Die Power ist weg", "Die Power ist weg"},
+		{"Wie spät ist es?", "Wie spät ist es?"},
+		{"   ", ""},
+	}
+	for _, c := range cases {
+		if got := refineSearchQuery(c.in, de); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestQueryPatternSettings(t *testing.T) {
+	custom := compileQueryPatterns(queryPatternsFor(appSettings{Lang: "en", QueryPatterns: map[string][]string{"de": {`sag mir (.+)`}}}))
+	if got := refineSearchQuery("sag mir Berlin", custom); got != "Berlin" {
+		t.Errorf("custom pattern: %q", got)
+	}
+	// Configured patterns replace the built-ins of their language.
+	if got := refineSearchQuery("wer ist Berlin", custom); got != "wer ist Berlin" {
+		t.Errorf("built-in still applied: %q", got)
+	}
+	if checkQueryPattern("foo") == nil || checkQueryPattern("(") == nil {
+		t.Error("invalid patterns accepted")
+	}
+	if err := checkQueryPattern(`erkläre (.+)`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSearchQueryInDebugInfo(t *testing.T) {
+	e := newTestEnv(t)
+	e.add(t, "Photosynthese", "Die Photosynthese wandelt Licht in chemische Energie um.")
+	_, di, err := e.rag.prepareContextWithK(t.Context(), "Erkläre mir die Photosynthese.", true, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if di.SearchQuery != "die Photosynthese" {
+		t.Fatalf("search query %q", di.SearchQuery)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestRejectedCandidates(t *testing.T) {
+	h := func(a string, i int, s float64) chunkHit {
+		return chunkHit{article: a, chunkIdx: i, score: s, content: strings.Repeat("x", 100)}
+	}
+	opts := retrievalOptions{K: 2, HighThreshold: 0.9, RelaxedThreshold: 0.6}
+	high := []chunkHit{h("A", 1, 0.95), h("A", 2, 0.93), h("B", 0, 0.92), h("C", 5, 0.5)}
+	low := []chunkHit{h("A", 1, 0.7), h("B", 2, 0.65), h("C", 3, 0.3)}
+	direct := func(string) (questionAnalysis, error) { return questionAnalysis{Action: "ANSWER_DIRECT"}, nil }
+	failed := func(string) (questionAnalysis, error) { return questionAnalysis{}, errors.New("kaputt") }
+	strict := func(string) (questionAnalysis, error) {
+		th := 0.68
+		return questionAnalysis{Action: "RETRIEVE_MORE", K: 1, Threshold: &th}, nil
+	}
+
+	for _, c := range []struct {
+		name     string
+		hits     []chunkHit
+		analyze  func(string) (questionAnalysis, error)
+		used     int // selected hits that fit the budget
+		neighbor bool
+		decision string
+		want     map[string]string
+	}{
+		{"high confidence", high, nil, 2, false, "high_confidence", map[string]string{"B0": "k_limit", "C5": "below_threshold"}},
+		{"budget", high, nil, 1, false, "high_confidence", map[string]string{"A2": "budget", "B0": "k_limit", "C5": "below_threshold"}},
+		{"used as neighbor", high, nil, 2, true, "high_confidence", map[string]string{"B0": "k_limit"}},
+		{"answer direct", low, direct, 0, false, "answer_direct", map[string]string{"A1": "answer_direct", "B2": "answer_direct", "C3": "answer_direct"}},
+		{"relaxed fallback", low, failed, 2, false, "relaxed_fallback", map[string]string{"C3": "below_threshold"}},
+		{"model threshold", low, strict, 1, false, "lm_requested_retrieval", map[string]string{"B2": "below_threshold", "C3": "below_threshold"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sel, _, thresh, decision := selectHits(c.hits, opts, c.analyze)
+			if decision != c.decision {
+				t.Fatalf("decision %s", decision)
+			}
+			used := sel[:min(c.used, len(sel))]
+			if c.neighbor {
+				used = append(used, chunkHit{article: "C", chunkIdx: 5, score: -1, neighbor: true})
+			}
+			_, dbg := joinContext(used)
+			got := map[string]string{}
+			last := 2.0
+			for _, r := range rejectedCandidates(c.hits, sel, dbg, thresh, decision) {
+				got[fmt.Sprint(r.Article, r.ChunkIdx)] = r.Reason
+				if r.Score > last {
+					t.Fatal("not sorted by score")
+				}
+				last = r.Score
+			}
+			if !maps.Equal(got, c.want) {
+				t.Fatalf("rejected %v, want %v", got, c.want)
+			}
+		})
+	}
+
+	var many []chunkHit
+	for i := range 50 {
+		many = append(many, h("M", i, 0.1))
+	}
+	if r := rejectedCandidates(many, nil, nil, 0.6, "lm_requested_retrieval"); len(r) != maxRejectedChunks {
+		t.Fatalf("%d rejected, cap %d", len(r), maxRejectedChunks)
+	}
+}
+
+func TestRejectedChunksInDebug(t *testing.T) {
+	e := newTestEnv(t, "Antwort.")
+	e.add(t, "Rhein", "Der Rhein mündet in die Nordsee.")
+	e.add(t, "Kaffee", "Kaffee wird geröstet.")
+	e.llm.aux = func(chatReq) string { return `{"action":"RETRIEVE_MORE","k":1,"threshold":0.5}` }
+
+	frames := e.ask(t, map[string]any{"question": "Der Rhein mündet wohin?", "debug": true})
+	var d struct {
+		Retrieval debugInfo `json:"retrieval"`
+	}
+	if err := json.Unmarshal([]byte(sseEvents(frames, "debug")[0]), &d); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Retrieval.Chunks) != 1 || d.Retrieval.Chunks[0].Article != "Rhein" {
+		t.Fatalf("context %+v", d.Retrieval.Chunks)
+	}
+	rej := d.Retrieval.RejectedChunks
+	if len(rej) != 1 || rej[0].Article != "Kaffee" || rej[0].Reason != "below_threshold" {
+		t.Fatalf("rejected %+v", rej)
+	}
+}
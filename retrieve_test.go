@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	tinysql "github.com/SimonWaldherr/tinySQL"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// retrievalEnv is a testEnv holding the fixture corpus. The planner
+// answers directly for questions containing "direkt", asks for a strict
+// threshold for "streng", replies garbage for "kaputt" and requests
+// the chunks above 0.3 otherwise.
+func retrievalEnv(t *testing.T) *testEnv {
+	e := newTestEnv(t)
+	e.llm.aux = func(req chatReq) string {
+		q := req.Messages[len(req.Messages)-1].Content
+		switch {
+		case strings.Contains(q, "direkt"):
+			return `{"action":"ANSWER_DIRECT"}`
+		case strings.Contains(q, "streng"):
+			return `{"action":"RETRIEVE_MORE","k":2,"threshold":0.999}`
+		case strings.Contains(q, "kaputt"):
+			return `keine Ahnung`
+		}
+		return `{"action":"RETRIEVE_MORE","threshold":0.3}`
+	}
+	b, err := os.ReadFile("testdata/retrieval/corpus.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corpus map[string][]string
+	if err := json.Unmarshal(b, &corpus); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Rhein", "Donau", "Kaffee", "Tee", "Köln"} {
+		if err := e.rag.addChunks(context.Background(), name, corpus[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return e
+}
+
+// goldenRetrieval is the part of a retrieval compared with the golden file.
+type goldenRetrieval struct {
+	Call     string   `json:"call"`
+	Question string   `json:"question"`
+	Decision string   `json:"decision"`
+	UsedK    int      `json:"used_k"`
+	Query    string   `json:"search_query,omitempty"`
+	Top      string   `json:"top,omitempty"`
+	Chunks   []string `json:"chunks,omitempty"`
+	Rejected []string `json:"rejected,omitempty"`
+	Context  string   `json:"context,omitempty"`
+	Err      string   `json:"error,omitempty"`
+}
+
+func summarizeRetrieval(call, q, text string, di *debugInfo, err error) goldenRetrieval {
+	g := goldenRetrieval{Call: call, Question: q, Context: text}
+	if err != nil {
+		g.Err = err.Error()
+		return g
+	}
+	g.Decision, g.UsedK, g.Query = di.Decision, di.UsedK, di.SearchQuery
+	if di.TopScore != 0 {
+		g.Top = fmt.Sprintf("%.4f %s", di.TopScore, strings.Join(di.TopArticles, ", "))
+	}
+	for _, c := range di.Chunks {
+		g.Chunks = append(g.Chunks, fmt.Sprintf("%s#%d %.4f neighbor=%v", c.Article, c.ChunkIdx, c.Score, c.IsNeighbor))
+	}
+	for _, c := range di.RejectedChunks {
+		g.Rejected = append(g.Rejected, fmt.Sprintf("%s#%d %.4f %s", c.Article, c.ChunkIdx, c.Score, c.Reason))
+	}
+	return g
+}
+
+func TestRetrieveGolden(t *testing.T) {
+	e := retrievalEnv(t)
+	ctx := context.Background()
+	questions := []string{
+		"Wo mündet der Rhein?",
+		"Rhein",
+		"Der Kölner Dom wurde 1880 fertiggestellt.",
+		"Welche Städte liegen an der Donau?",
+		"Wie wird Kaffee zubereitet?",
+		"Tee direkt bitte",
+		"Donau streng",
+		"Köln kaputt",
+		"Erzähl mir etwas über Vulkane",
+	}
+	var got []goldenRetrieval
+	for _, q := range questions {
+		text, di, err := e.rag.prepareContext(ctx, q, false)
+		got = append(got, summarizeRetrieval("prepareContext", q, text, di, err))
+		for _, k := range []int{1, 2, 5} {
+			text, di, err := e.rag.prepareContextWithK(ctx, q, false, k)
+			got = append(got, summarizeRetrieval(fmt.Sprintf("prepareContextWithK(%d)", k), q, text, di, err))
+		}
+	}
+	b, _ := json.MarshalIndent(got, "", "  ")
+	const golden = "testdata/retrieval/golden.json"
+	if *updateGolden {
+		if err := os.WriteFile(golden, append(b, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if string(want) != string(b)+"\n" {
+		var w []goldenRetrieval
+		json.Unmarshal(want, &w)
+		for i := range min(len(w), len(got)) {
+			if !reflect.DeepEqual(w[i], got[i]) {
+				t.Errorf("%s %q:\ngot  %+v\nwant %+v", got[i].Call, got[i].Question, got[i], w[i])
+			}
+		}
+		t.Fatalf("retrieval differs from %s", golden)
+	}
+}
+
+func TestParseHits(t *testing.T) {
+	rows := []tinysql.Row{
+		{"article": "a", "chunk_idx": 2, "score": 0.5, "lang": "de"},
+		{"article": "b", "chunk_idx": int64(3), "score": 1, "content": "text"},
+		{"article": "c", "chunk_idx": 4.0, "score": 0.25},
+		{"chunk_idx": 1, "score": 0.9},
+	}
+	want := []chunkHit{
+		{article: "a", chunkIdx: 2, score: 0.5, lang: "de"},
+		{article: "b", chunkIdx: 3, score: 1, content: "text"},
+		{article: "c", chunkIdx: 4, score: 0.25},
+	}
+	if got := parseHits(rows); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func hitsOf(scores ...float64) []chunkHit {
+	var hits []chunkHit
+	for i, s := range scores {
+		hits = append(hits, chunkHit{article: fmt.Sprintf("a%d", i), chunkIdx: i, score: s})
+	}
+	return hits
+}
+
+func TestHitsAbove(t *testing.T) {
+	hits := hitsOf(0.9, 0.7, 0.7, 0.5)
+	if got := hitsAbove(hits, 0.7, false, 5); len(got) != 1 {
+		t.Fatalf("exclusive: %v", got)
+	}
+	if got := hitsAbove(hits, 0.7, true, 5); len(got) != 3 {
+		t.Fatalf("inclusive: %v", got)
+	}
+	if got := hitsAbove(hits, 0, false, 2); len(got) != 2 || got[1].score != 0.7 {
+		t.Fatalf("k: %v", got)
+	}
+}
+
+func TestSelectHits(t *testing.T) {
+	opts := retrievalOptions{K: 2, HighThreshold: 0.9, RelaxedThreshold: 0.6}
+	thr := 0.75
+	never := func(string) (questionAnalysis, error) { t.Fatal("analyzed"); return questionAnalysis{}, nil }
+	cases := []struct {
+		name     string
+		hits     []chunkHit
+		analyze  func(string) (questionAnalysis, error)
+		n, k     int
+		thresh   float64
+		decision string
+	}{
+		{"high confidence", hitsOf(0.95, 0.93, 0.91), never, 2, 2, 0.9, "high_confidence"},
+		{"analysis error", hitsOf(0.8, 0.6, 0.5), func(string) (questionAnalysis, error) { return questionAnalysis{}, errors.New("down") }, 2, 2, 0.6, "relaxed_fallback"},
+		{"answer direct", hitsOf(0.8), func(string) (questionAnalysis, error) { return questionAnalysis{Action: "ANSWER_DIRECT"}, nil }, 0, 0, 0, "answer_direct"},
+		{"requested k and threshold", hitsOf(0.8, 0.78, 0.76, 0.7), func(string) (questionAnalysis, error) {
+			return questionAnalysis{Action: "RETRIEVE_MORE", K: 4, Threshold: &thr}, nil
+		}, 3, 4, 0.75, "lm_requested_retrieval"},
+		{"nothing above the threshold", hitsOf(0.5, 0.4, 0.3), func(string) (questionAnalysis, error) {
+			return questionAnalysis{Action: "RETRIEVE_MORE"}, nil
+		}, 2, 2, 0.6, "lm_requested_retrieval"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sel, k, thresh, decision := selectHits(c.hits, opts, c.analyze)
+			if len(sel) != c.n || k != c.k || thresh != c.thresh || decision != c.decision {
+				t.Fatalf("got %d hits, k=%d, thresh=%v, %s", len(sel), k, thresh, decision)
+			}
+		})
+	}
+}
+
+func TestRetrievalHelpers(t *testing.T) {
+	if got := hitSummary(hitsOf(0.5, 0.25), 5); got != "a0 (score=0.5000); a1 (score=0.2500)" {
+		t.Errorf("hitSummary %q", got)
+	}
+	if candidateLimit(1) != 100 || candidateLimit(50) != 150 || candidateLimit(10000) != 1000 {
+		t.Error("candidateLimit")
+	}
+	if contextChunkBudget(0) != 3 || contextChunkBudget(4) != 12 {
+		t.Error("contextChunkBudget")
+	}
+	hits := hitsOf(0.9, 0.8)
+	hits[1].article = "a0"
+	if top, arts := topCandidates(hits, 3); top != 0.9 || len(arts) != 1 {
+		t.Errorf("topCandidates %v %v", top, arts)
+	}
+}
+
+func TestAssembleContext(t *testing.T) {
+	e := retrievalEnv(t)
+	sel := []chunkHit{{article: "Rhein", chunkIdx: 1, score: 0.8}}
+	text, chunks, omitted, omittedNeighbors, err := e.rag.assembleContext(sel, sel, 0)
+	if err != nil || len(chunks) != 3 || omitted != 0 || omittedNeighbors != 0 {
+		t.Fatalf("chunks %+v", chunks)
+	}
+	if !chunks[0].IsNeighbor || chunks[1].IsNeighbor || !chunks[2].IsNeighbor || strings.Count(text, contextSep) != 2 {
+		t.Fatalf("order: %+v", chunks)
+	}
+	if !strings.Contains(text, "Basel") || !strings.Contains(text, "Rotterdam") {
+		t.Fatalf("text %q", text)
+	}
+	// A small budget keeps the hit and drops the neighbors.
+	text, chunks, _, omittedNeighbors, _ = e.rag.assembleContext(sel, sel, 60)
+	if len(chunks) != 1 || omittedNeighbors != 2 || !strings.Contains(text, "Basel") {
+		t.Fatalf("budget: %q %d", text, omittedNeighbors)
+	}
+}
+
+func TestFetchChunks(t *testing.T) {
+	e := newTestEnv(t)
+	for _, a := range []string{"A", "B", "C"} {
+		texts, vecs := make([]string, 4), make([][]float64, 4)
+		for i := range texts {
+			texts[i] = fmt.Sprintf("%s %d", a, i)
+			vecs[i] = wordVec(texts[i])
+		}
+		if _, err := e.rag.storeChunks(sourceInfo{Name: a}, texts, vecs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := []chunkKey{{"A", 0}, {"A", 3}, {"B", 2}, {"A", 7}, {"C", 1}, {"D", 0}, {"B", -1}}
+	got, err := e.rag.fetchChunks(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[chunkKey]string{{"A", 0}: "A 0", {"A", 3}: "A 3", {"B", 2}: "B 2", {"C", 1}: "C 1"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v", got)
+	}
+	for k, content := range want {
+		if h, ok := got[k]; !ok || h.content != content || h.article != k.article || h.chunkIdx != k.chunkIdx {
+			t.Errorf("%v: %+v", k, h)
+		}
+	}
+}
+
+func TestFetchChunksErrorFailsRetrieval(t *testing.T) {
+	e := newTestEnv(t, "Geraten.")
+	e.add(t, "Rhein", "Der Rhein mündet bei Rotterdam in die Nordsee.")
+	e.add(t, "Kaffee", "Kaffee wird geröstet.")
+	// The table goes away while the planner decides, between the search
+	// and loading the context.
+	e.llm.aux = func(chatReq) string {
+		e.rag.dbMu.Lock()
+		e.rag.execLocked("DROP TABLE chunks")
+		e.rag.dbMu.Unlock()
+		return `{"action":"RETRIEVE_MORE","k":1,"threshold":0.01}`
+	}
+	frames := e.ask(t, map[string]any{"question": "Wie lang ist der Rhein?"})
+	errs := sseEvents(frames, "error")
+	if len(errs) != 1 || !strings.Contains(errs[0], "retrieval_failed") || !strings.Contains(errs[0], "loading chunks") {
+		t.Fatalf("errors %v", errs)
+	}
+	if e.llm.answerCount() != 0 {
+		t.Fatal("the model answered without the context")
+	}
+	if _, err := e.rag.fetchChunks([]chunkKey{{"Rhein", 0}}); err == nil {
+		t.Fatal("fetchChunks without a chunks table")
+	}
+}
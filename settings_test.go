@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// askMeta asks `question` and returns the meta event.
+func askMeta(t *testing.T, e *testEnv, question string) map[string]any {
+	t.Helper()
+	metas := sseEvents(e.ask(t, map[string]any{"question": question}), "meta")
+	if len(metas) == 0 {
+		t.Fatal("no meta event")
+	}
+	var m map[string]any
+	if err := json.Unmarshal([]byte(metas[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSettingsKAppliesAtRuntime(t *testing.T) {
+	e := newTestEnv(t, "Antwort.")
+	e.add(t, "Rhein", "Der Rhein mündet in die Nordsee.")
+	if m := askMeta(t, e, "Wohin fließt der Rhein?"); m["base_k"] != 5.0 || m["chunk_size"] != 800.0 {
+		t.Fatalf("before: %v", m)
+	}
+	if status, out := e.post(t, "/api/settings", map[string]any{"k": 9, "chunk_size": 400}); status != 200 {
+		t.Fatalf("settings: %d %s", status, out)
+	}
+	if e.rag.topK() != 9 {
+		t.Fatalf("rag k %d", e.rag.topK())
+	}
+	if m := askMeta(t, e, "Wohin fließt der Rhein?"); m["base_k"] != 9.0 || m["chunk_size"] != 400.0 {
+		t.Fatalf("after: %v", m)
+	}
+}
+
+func TestSettingsConcurrentUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	ss, err := loadOrCreateSettings(path, defaultSettingsFromFlags("http://127.0.0.1:1", "chat", "embed", "de", 800, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	personas, apis := newPersonaStore(ss), newAPIStore(ss)
+	before := len(ss.get().Personas)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			switch i % 4 {
+			case 0:
+				_, err = personas.add(persona{Name: fmt.Sprintf("p%d", i), Prompt: "x"})
+			case 1:
+				_, err = apis.add(customAPI{Name: fmt.Sprintf("a%d", i), Template: "https://example.com/?q=$q"})
+			case 2:
+				err = ss.update(func(s *appSettings) error { s.K = i; return nil })
+			default:
+				err = ss.update(func(s *appSettings) error { s.HistoryBudget = 1000 + i; return nil })
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			apis.list()
+		}(i)
+	}
+	wg.Wait()
+
+	mem := ss.get()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var disk appSettings
+	if err := json.Unmarshal(b, &disk); err != nil {
+		t.Fatal(err)
+	}
+	if len(mem.Personas) != before+25 || len(mem.CustomAPIs) != 25 {
+		t.Fatalf("%d personas, %d apis", len(mem.Personas)-before, len(mem.CustomAPIs))
+	}
+	if len(disk.Personas) != len(mem.Personas) || len(disk.CustomAPIs) != len(mem.CustomAPIs) || disk.K != mem.K || disk.HistoryBudget != mem.HistoryBudget {
+		t.Fatalf("file differs: personas %d/%d, apis %d/%d, k %d/%d", len(disk.Personas), len(mem.Personas), len(disk.CustomAPIs), len(mem.CustomAPIs), disk.K, mem.K)
+	}
+	ids := map[string]bool{}
+	for _, p := range mem.Personas {
+		ids[p.ID] = true
+	}
+	for _, a := range mem.CustomAPIs {
+		ids[a.ID] = true
+	}
+	if len(ids) != len(mem.Personas)+len(mem.CustomAPIs) {
+		t.Fatal("duplicate ids")
+	}
+
+	// A failing update changes nothing.
+	if err := ss.update(func(s *appSettings) error { s.K = 999; return errors.New("nein") }); err == nil || ss.get().K == 999 {
+		t.Fatal("failed update applied")
+	}
+}
+
+func TestCustomAPIHeaderSecrets(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.json")
+	defaults := defaultSettingsFromFlags("http://127.0.0.1:1", "chat", "embed", "de", 800, 5)
+	ss, err := loadOrCreateSettings(path, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := newAPIStore(ss).add(customAPI{Name: "wetter", Template: "https://example.com/?q=$q", Headers: map[string]string{"Authorization": "Bearer sk-geheim", "X-Api-Key": "k-geheim", "Accept": "application/json"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStored := func(ss *settingsStore) {
+		t.Helper()
+		b, _ := os.ReadFile(path)
+		if strings.Contains(string(b), "geheim") || !strings.Contains(string(b), "application/json") {
+			t.Fatalf("settings.json:\n%s", b)
+		}
+		sec, _ := os.ReadFile(filepath.Join(dir, "secrets.json"))
+		if !strings.Contains(string(sec), "sk-geheim") || !strings.Contains(string(sec), "k-geheim") {
+			t.Fatalf("secrets.json:\n%s", sec)
+		}
+		if fi, err := os.Stat(filepath.Join(dir, "secrets.json")); err != nil || fi.Mode().Perm() != 0o600 {
+			t.Fatalf("secrets.json mode: %v %v", fi, err)
+		}
+		h := ss.get().CustomAPIs[0].Headers
+		if h["Authorization"] != "Bearer sk-geheim" || h["X-Api-Key"] != "k-geheim" || h["Accept"] != "application/json" {
+			t.Fatalf("headers in memory: %v", h)
+		}
+	}
+	assertStored(ss)
+
+	// Restart.
+	ss, err = loadOrCreateSettings(path, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStored(ss)
+
+	// Removing the API removes its secrets.
+	if ok, err := newAPIStore(ss).remove(api.ID); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if sec, _ := os.ReadFile(filepath.Join(dir, "secrets.json")); strings.Contains(string(sec), "geheim") {
+		t.Fatalf("secrets of the removed API kept:\n%s", sec)
+	}
+}
+
+func TestCustomAPIHeaderSecretsMigration(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.json")
+	old := `{"version": 1, "lang": "de", "custom_apis": [{"id": "api-1", "name": "alt", "template": "https://example.com/?q=$q", "headers": {"Authorization": "Bearer sk-alt", "Accept": "text/plain"}}]}`
+	if err := os.WriteFile(path, []byte(old), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ss, err := loadOrCreateSettings(path, defaultSettingsFromFlags("http://127.0.0.1:1", "chat", "embed", "de", 800, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := ss.get().CustomAPIs[0].Headers; h["Authorization"] != "Bearer sk-alt" || h["Accept"] != "text/plain" {
+		t.Fatalf("headers %v", h)
+	}
+	b, _ := os.ReadFile(path)
+	if strings.Contains(string(b), "sk-alt") || !strings.Contains(string(b), `"Authorization": "api_header:api-1:authorization"`) {
+		t.Fatalf("settings.json after migration:\n%s", b)
+	}
+	if sec, _ := os.ReadFile(filepath.Join(dir, "secrets.json")); !strings.Contains(string(sec), "sk-alt") {
+		t.Fatalf("secrets.json:\n%s", sec)
+	}
+}
+
+func TestSettingsChangeDuringAnswer(t *testing.T) {
+	e := newTestEnv(t,
+		`Moment. [TOOL_REQUEST]{"tool":"rag_search","query":"Rhein"}[/TOOL_REQUEST]`,
+		"Der Rhein mündet in die Nordsee.",
+	)
+	e.add(t, "Rhein", "Der Rhein mündet in die Nordsee.")
+	e.llm.mu.Lock()
+	e.llm.firstDelay, e.llm.pieceDelay = 300*time.Millisecond, 5*time.Millisecond
+	e.llm.mu.Unlock()
+	other := newFakeLLM(t, "Antwort des neuen Endpunkts.")
+
+	resp := e.startAsk(t, t.Context(), map[string]any{"question": "Wohin fließt der Rhein?", "debug": true})
+	waitFor(t, "the first answer segment", func() bool { return e.llm.answerCount() == 1 })
+	if status, out := e.post(t, "/api/settings", map[string]any{"base_url": other.URL}); status != 200 {
+		t.Fatalf("settings: %d %s", status, out)
+	}
+	var body strings.Builder
+	if _, err := io.Copy(&body, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	frames := parseSSE(body.String())
+
+	// Planning, the tool search and the second segment all stay on the
+	// client the request started with.
+	if text := sseText(t, frames); !strings.Contains(text, "Nordsee") || strings.Contains(text, "neuen Endpunkts") {
+		t.Fatalf("answer %q", text)
+	}
+	if len(sseEvents(frames, "tool_result")) != 1 || e.llm.answerCount() != 2 {
+		t.Fatalf("%d answer segments on the old endpoint", e.llm.answerCount())
+	}
+	other.mu.Lock()
+	embeds, chats := other.embeds, len(other.chatReqs)
+	other.mu.Unlock()
+	if embeds != 0 || chats != 0 {
+		t.Fatalf("new endpoint got %d embeddings and %d chat requests mid-answer", embeds, chats)
+	}
+	var meta struct {
+		Models debugModels `json:"models"`
+	}
+	var dbg struct {
+		Models debugModels `json:"models"`
+	}
+	json.Unmarshal([]byte(sseEvents(frames, "meta")[0]), &meta)
+	json.Unmarshal([]byte(sseEvents(frames, "debug")[0]), &dbg)
+	if meta.Models.BaseURL != e.llm.URL || dbg.Models.BaseURL != e.llm.URL || dbg.Models.Generation != meta.Models.Generation {
+		t.Fatalf("meta models %+v, debug models %+v", meta.Models, dbg.Models)
+	}
+
+	// The next request uses the new client.
+	next := askMeta(t, e, "Und jetzt?")["models"].(map[string]any)
+	if next["base_url"] != other.URL || int(next["generation"].(float64)) != meta.Models.Generation+1 {
+		t.Fatalf("next request models %v", next)
+	}
+	if other.answerCount() != 1 {
+		t.Fatalf("%d answers from the new endpoint", other.answerCount())
+	}
+}
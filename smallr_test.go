@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSmallRTimeoutDiscardsSession(t *testing.T) {
+	const chatID = "chat-smallr-test"
+	t.Cleanup(func() { smallrSessions.drop(chatID) })
+	stuck := smallrSessions.get(chatID)
+	stuck.mu.Lock() // an evaluation that never returns
+	defer stuck.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := execSmallRContext(ctx, chatID, "x <- 5"); err == nil {
+		t.Fatal("no timeout")
+	}
+	fresh := smallrSessions.get(chatID)
+	if fresh == stuck {
+		t.Fatal("timed-out session kept")
+	}
+	if !fresh.mu.TryLock() {
+		t.Fatal("fresh session is locked")
+	}
+	fresh.mu.Unlock()
+
+	// Discarding a stale session leaves the current one alone.
+	smallrSessions.discard(chatID, stuck)
+	if smallrSessions.get(chatID) != fresh {
+		t.Fatal("current session discarded")
+	}
+}
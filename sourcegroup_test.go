@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// importChapters imports testdata/chapters with small chunks and
+// returns the index of the last chunk of ch1.md.
+func importChapters(t *testing.T, e *testEnv) int {
+	t.Helper()
+	prev := importRoots
+	t.Cleanup(func() { importRoots = prev })
+	if err := setImportRoots([]string{"testdata"}); err != nil {
+		t.Fatal(err)
+	}
+	e.settings.update(func(s *appSettings) error { s.ChunkSize = 100; return nil })
+	status, out := e.post(t, "/api/add-folder", map[string]any{"path": filepath.Join("testdata", "chapters")})
+	if status != 200 {
+		t.Fatalf("add-folder: %d %s", status, out)
+	}
+	var resp struct {
+		Group string `json:"group"`
+	}
+	json.Unmarshal([]byte(out), &resp)
+	if resp.Group == "" {
+		t.Fatalf("no group: %s", out)
+	}
+	src, _ := e.rag.getSource("folder:ch1.md")
+	if src.ChunkCount < 2 || src.Group != resp.Group || src.GroupPos != 1 {
+		t.Fatalf("ch1.md: %+v", src)
+	}
+	return src.ChunkCount - 1
+}
+
+// neighborKeys returns the neighbors withNeighbors adds around `hit`.
+func neighborKeys(t *testing.T, e *testEnv, hit chunkKey) []chunkKey {
+	t.Helper()
+	chunks, err := e.rag.withNeighbors([]chunkHit{{article: hit.article, chunkIdx: hit.chunkIdx, score: 1}}, map[chunkKey]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []chunkKey
+	for _, h := range chunks {
+		if h.neighbor {
+			keys = append(keys, chunkKey{h.article, h.chunkIdx})
+		}
+	}
+	return keys
+}
+
+func TestNeighborsCrossSourceGroup(t *testing.T) {
+	e := newTestEnv(t)
+	last := importChapters(t, e)
+	tail, head := chunkKey{"folder:ch1.md", last}, chunkKey{"folder:ch2.md", 0}
+
+	if got := neighborKeys(t, e, tail); !slices.Contains(got, head) {
+		t.Fatalf("neighbors of the tail of ch1.md: %v", got)
+	}
+	if got := neighborKeys(t, e, head); !slices.Contains(got, tail) {
+		t.Fatalf("neighbors of the head of ch2.md: %v", got)
+	}
+	if got := neighborKeys(t, e, chunkKey{"folder:ch1.md", 0}); slices.Contains(got, head) {
+		t.Fatalf("the head of ch1.md pulls in ch2.md: %v", got)
+	}
+
+	// Without the group the sources stay apart.
+	src, _ := e.rag.getSource("folder:ch1.md")
+	if status, out := e.post(t, "/api/sources/group", map[string]any{"group": src.Group}); status != 200 {
+		t.Fatalf("dissolve: %d %s", status, out)
+	}
+	if got := neighborKeys(t, e, tail); slices.Contains(got, head) {
+		t.Fatalf("neighbors after the group was dissolved: %v", got)
+	}
+}
+
+func TestGroupNeighborInAnswerContext(t *testing.T) {
+	e := newTestEnv(t, "Er schläft in der Hütte.")
+	last := importChapters(t, e)
+	var tail string
+	for _, c := range storedContents(t, e.rag, "folder:ch1.md") {
+		tail = c
+	}
+	// Search hits are never added as neighbors, so push the head of
+	// ch2.md out of the candidates with near copies of the question.
+	for i := range candidateLimit(1) {
+		e.add(t, fmt.Sprint("Notiz ", i), tail+" Notiz")
+	}
+	e.llm.aux = func(chatReq) string { return `{"action":"RETRIEVE_MORE","k":1,"threshold":0.99}` }
+
+	frames := e.ask(t, map[string]any{"question": tail, "debug": true})
+	var d struct {
+		Retrieval debugInfo `json:"retrieval"`
+	}
+	if err := json.Unmarshal([]byte(sseEvents(frames, "debug")[0]), &d); err != nil {
+		t.Fatal(err)
+	}
+	var hit, next bool
+	for _, c := range d.Retrieval.Chunks {
+		switch {
+		case c.Article == "folder:ch1.md" && c.ChunkIdx == last && !c.IsNeighbor:
+			hit = true
+		case c.Article == "folder:ch2.md" && c.ChunkIdx == 0 && c.IsNeighbor:
+			next = true
+		}
+	}
+	if !hit || !next {
+		t.Fatalf("context %+v", d.Retrieval.Chunks)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuerySQL(t *testing.T) {
+	e := newTestEnv(t)
+	e.add(t, "a", "x|y; z")
+	e.add(t, "a2", "z")
+	e.add(t, "b", "w")
+	ctx := context.Background()
+
+	cols, rows, err := e.rag.querySQL(ctx, "SELECT article, COUNT(*) AS n FROM chunks GROUP BY article ORDER BY article;", 0)
+	if err != nil || len(cols) != 2 || len(rows) != 3 || rows[0][0] != "a" {
+		t.Fatalf("group by: %v %v %v", cols, rows, err)
+	}
+	// A LIMIT is added when missing.
+	if _, rows, err := e.rag.querySQL(ctx, "SELECT content FROM chunks", 2); err != nil || len(rows) != 2 {
+		t.Fatalf("limit: %v %v", rows, err)
+	}
+	// Semicolons inside string literals are fine.
+	if _, rows, err := e.rag.querySQL(ctx, "SELECT article FROM chunks WHERE content LIKE '%; z%'", 0); err != nil || len(rows) != 1 {
+		t.Fatalf("semicolon literal: %v %v", rows, err)
+	}
+	if _, rows, err := e.rag.querySQL(ctx, "SELECT article FROM chunks WHERE article IN (SELECT article FROM chunks WHERE content = 'w')", 0); err != nil || len(rows) != 1 {
+		t.Fatalf("subquery: %v %v", rows, err)
+	}
+	if _, rows, err := e.rag.querySQL(ctx, "SELECT UPPER(article), LENGTH(content) FROM chunks c JOIN chunks d ON c.id = d.id", 0); err != nil || len(rows) != 3 {
+		t.Fatalf("self join: %v %v", rows, err)
+	}
+
+	secret := filepath.Join(t.TempDir(), "secrets.json")
+	os.WriteFile(secret, []byte(`{"llm_api_key":"sk-geheim"}`), 0600)
+	for _, q := range []string{
+		"DELETE FROM chunks",
+		"SELECT 1; DELETE FROM chunks",
+		"SELECT FILE('" + secret + "') AS f FROM chunks LIMIT 1",
+		"SELECT file('" + secret + "') FROM chunks",
+		"SELECT article FROM chunks WHERE content = FILE('" + secret + "')",
+		"SELECT HTTP('http://169.254.169.254/latest/meta-data/') FROM chunks",
+		"SELECT (SELECT HTTP('http://127.0.0.1/') FROM chunks LIMIT 1) FROM chunks",
+		"SELECT * FROM TABLE_FROM_JSON('[{\"a\":1}]')",
+		"SELECT REPEAT('x', 1000000000) FROM chunks",
+		"SELECT * FROM sources",
+		"SELECT c.article FROM chunks c JOIN meta m ON c.article = m.key",
+		"SELECT article FROM chunks WHERE article IN (SELECT name FROM sources)",
+		"SELECT * FROM (SELECT * FROM sources) s",
+	} {
+		_, rows, err := e.rag.querySQL(ctx, q, 0)
+		if err == nil {
+			t.Errorf("%s: accepted, rows %v", q, rows)
+		}
+		for _, row := range rows {
+			if strings.Contains(strings.Join(row, " "), "geheim") {
+				t.Fatalf("%s: leaked the secret", q)
+			}
+		}
+	}
+	if n := e.rag.docCount(); n != 3 {
+		t.Fatalf("%d chunks after the rejected statements", n)
+	}
+}
+
+func TestSQLEndpointPolicy(t *testing.T) {
+	e := newTestEnv(t)
+	e.add(t, "a", "x")
+	body := map[string]any{"query": "SELECT article FROM chunks"}
+	if status, out := e.post(t, "/api/sql", body); status != 403 {
+		t.Fatalf("disabled sql tool: %d %s", status, out)
+	}
+	e.settings.update(func(s *appSettings) error {
+		s.ToolPolicy = map[string]toolPolicy{"sql": {Enabled: true}}
+		return nil
+	})
+	if status, out := e.post(t, "/api/sql", body); status != 200 || !strings.Contains(out, `"count":1`) {
+		t.Fatalf("enabled sql tool: %d %s", status, out)
+	}
+	if status, _ := e.post(t, "/api/sql", map[string]any{"query": "SELECT FILE('/etc/hostname') FROM chunks"}); status != 400 {
+		t.Fatalf("FILE through the endpoint: %d", status)
+	}
+}
+
+func TestHasStatementSeparator(t *testing.T) {
+	cases := map[string]bool{
+		"SELECT 1":                             false,
+		"SELECT 1; DELETE FROM chunks":         true,
+		"SELECT 'a;b' FROM chunks":             false,
+		"SELECT 'it''s; fine' FROM chunks":     false,
+		"SELECT 'it''s'; DELETE FROM chunks":   true,
+		`SELECT "a;b" FROM chunks`:             false,
+		"SELECT 1 -- ; kommentar\nFROM chunks": false,
+		"SELECT 1 /* ; */ FROM chunks":         false,
+		"SELECT 1 /* x */; DROP TABLE chunks":  true,
+		"SELECT 'offen;":                       false,
+	}
+	for q, want := range cases {
+		if got := hasStatementSeparator(q); got != want {
+			t.Errorf("%q: got %v, want %v", q, got, want)
+		}
+	}
+}
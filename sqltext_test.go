@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+// storedContents returns the decoded contents of the chunks of `article`.
+func storedContents(t *testing.T, r *ragSystem, article string) []string {
+	t.Helper()
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+	rs, err := r.execLocked("SELECT content FROM chunks WHERE article = " + sqlText(article) + " ORDER BY chunk_idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, row := range rs.Rows {
+		v, _ := row["content"].(string)
+		out = append(out, decodeContent(v))
+	}
+	return out
+}
+
+func TestHostileArticleNameRoundTrips(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	if err := e.rag.addChunks(ctx, "other", []string{"keep"}); err != nil {
+		t.Fatal(err)
+	}
+	name := "x'); DELETE FROM chunks; --"
+	chunks := []string{"Köln\\n'\x00 € \"; DROP TABLE chunks; --", "b\r\n\t\\'"}
+	if err := e.rag.addChunks(ctx, name, chunks); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.rag.docCount(); n != 3 {
+		t.Fatalf("docCount %d, want 3", n)
+	}
+	if got := storedContents(t, e.rag, name); !slices.Equal(got, chunks) {
+		t.Fatalf("contents %q", got)
+	}
+	if _, ok := e.rag.getSource(name); !ok {
+		t.Fatal("source not recorded")
+	}
+	if err := e.rag.deleteSource(name); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.rag.docCount(); n != 1 || len(storedContents(t, e.rag, "other")) != 1 {
+		t.Fatalf("docCount %d after deleting the hostile source", n)
+	}
+}
+
+func FuzzSQLText(f *testing.F) {
+	for _, s := range []string{"", "'", "x'); DELETE FROM chunks; --", "\\'", "\x00", "Grüße €", "\xff\xfe", "''''", "\n\r\t"} {
+		f.Add(s)
+	}
+	e := newTestEnv(f)
+	f.Fuzz(func(t *testing.T, s string) {
+		e.rag.dbMu.RLock()
+		defer e.rag.dbMu.RUnlock()
+		rs, err := e.rag.execLocked("SELECT " + sqlText(s) + " AS v")
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		if len(rs.Rows) != 1 || rs.Rows[0]["v"] != s {
+			t.Fatalf("%q came back as %q", s, rs.Rows)
+		}
+	})
+}
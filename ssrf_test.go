@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsInternalIP(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"192.168.1.1":     true,
+		"169.254.169.254": true,
+		"0.0.0.0":         true,
+		"0.1.2.3":         true,
+		"100.64.0.1":      true,
+		"100.127.255.254": true,
+		"192.0.0.8":       true,
+		"198.18.0.1":      true,
+		"198.19.255.255":  true,
+		"240.0.0.1":       true,
+		"::1":             true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"::ffff:10.0.0.1": true,
+		"8.8.8.8":         false,
+		"100.128.0.1":     false,
+		"192.0.2.1":       false,
+		"198.20.0.1":      false,
+		"2606:4700::1111": false,
+	}
+	for s, want := range cases {
+		if got := isInternalIP(net.ParseIP(s)); got != want {
+			t.Errorf("%s: got %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestGuardedFetch(t *testing.T) {
+	noFetchDelay(t)
+	page := "<p>" + strings.Repeat("hello world, ", 30) + "</p>"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if to := r.URL.Query().Get("to"); to != "" {
+			http.Redirect(w, r, to, 302)
+			return
+		}
+		w.Write([]byte(page))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	blocked := func(err error) bool {
+		var b *errBlockedHost
+		return errors.As(err, &b) && strings.Contains(err.Error(), "allowed_hosts")
+	}
+
+	// The test server itself is loopback.
+	if _, _, err := fetchPage(ctx, srv.URL, nil); !blocked(err) {
+		t.Fatalf("loopback: %v", err)
+	}
+	// A name resolving to loopback.
+	local := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	if _, _, err := fetchPage(ctx, local, nil); !blocked(err) {
+		t.Fatalf("localhost: %v", err)
+	}
+	if _, text, err := fetchPage(ctx, local, []string{"localhost"}); err != nil || !strings.Contains(text, "hello") {
+		t.Fatalf("allowed localhost: %v", err)
+	}
+
+	// Redirects from an allowed host to internal ones are checked again.
+	allow := []string{"127.0.0.1"}
+	for _, to := range []string{"http://169.254.169.254/latest/meta-data/", "http://100.64.0.1/", "http://10.0.0.1/", "http://[::1]:1/"} {
+		if _, _, err := fetchPage(ctx, srv.URL+"/?to="+to, allow); !blocked(err) {
+			t.Errorf("redirect to %s: %v", to, err)
+		}
+	}
+	if _, _, err := fetchPage(ctx, "file:///etc/passwd", nil); err == nil {
+		t.Fatal("file URL fetched")
+	}
+}
+
+func TestWikipediaLangIsValidated(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conns := make(chan struct{}, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- struct{}{}
+			c.Close()
+		}
+	}()
+	lang := ln.Addr().String() + "/x#"
+
+	if _, err := fetchWikipedia(context.Background(), "Rhein", lang); err == nil || !strings.Contains(err.Error(), "invalid Wikipedia language") {
+		t.Fatalf("fetchWikipedia: %v", err)
+	}
+	e := newTestEnv(t)
+	if status, out := e.post(t, "/api/add-wiki", map[string]any{"article": "Rhein", "lang": lang}); status != 400 {
+		t.Fatalf("add-wiki: %d %s", status, out)
+	}
+	select {
+	case <-conns:
+		t.Fatal("the internal host was contacted")
+	default:
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAskStatusEvents(t *testing.T) {
+	e := newTestEnv(t,
+		`[TOOL_REQUEST]{"tool":"rag_search","query":"Kaffee"}[/TOOL_REQUEST]`,
+		"Kaffee wird geröstet.",
+	)
+	e.add(t, "Kaffee", "Kaffee wird vor dem Mahlen geröstet.")
+	e.llm.mu.Lock()
+	e.llm.embedDelay = 20 * time.Millisecond
+	e.llm.firstDelay = 20 * time.Millisecond
+	e.llm.mu.Unlock()
+
+	frames := e.ask(t, map[string]any{"question": "Wie hoch ist die Zugspitze?"})
+	var stages []string
+	var last int64
+	firstToken := -1
+	for i, f := range frames {
+		switch {
+		case f.Event == "status":
+			var s struct {
+				Stage     string `json:"stage"`
+				ElapsedMs int64  `json:"elapsed_ms"`
+			}
+			if err := json.Unmarshal([]byte(f.Data), &s); err != nil {
+				t.Fatalf("status %q: %v", f.Data, err)
+			}
+			if s.ElapsedMs < last {
+				t.Fatalf("elapsed_ms went back from %d to %d at %s", last, s.ElapsedMs, s.Stage)
+			}
+			last = s.ElapsedMs
+			stages = append(stages, s.Stage)
+		case f.Event == "" && firstToken < 0:
+			firstToken = i
+		}
+	}
+	want := []string{"embedding_query", "searching", "planning", "generating", "executing_tool:rag_search", "continuing"}
+	if !slices.Equal(stages, want) {
+		t.Fatalf("stages %v, want %v", stages, want)
+	}
+	if last < 40 {
+		t.Fatalf("elapsed_ms %d does not include the slow backend", last)
+	}
+	if sseEvents(frames[:max(firstToken, 0)], "status") == nil {
+		t.Fatal("no status before the first token")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf8"
+)
+
+// frameRecorder records the SSE data frames written to it.
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames []string
+}
+
+func (f *frameRecorder) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, raw := range strings.Split(string(p), "\n\n") {
+		if d, ok := strings.CutPrefix(raw, "data: "); ok {
+			var s string
+			json.Unmarshal([]byte(d), &s)
+			f.frames = append(f.frames, s)
+		}
+	}
+	return len(p), nil
+}
+
+func (f *frameRecorder) Flush() {}
+
+func (f *frameRecorder) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.frames)
+}
+
+func TestStreamTokensBatches(t *testing.T) {
+	pr, pw := io.Pipe()
+	rec := &frameRecorder{}
+	done := make(chan string)
+	go func() {
+		text, _ := streamTokens(pr, rec, rec)
+		done <- text
+	}()
+
+	// The first token goes out at once.
+	pw.Write([]byte("Hallo"))
+	waitFor(t, "the first token", func() bool { return rec.count() == 1 })
+
+	// Small pieces wait for sseBatchDelay.
+	start := time.Now()
+	pw.Write([]byte(" Welt"))
+	pw.Write([]byte(", wie"))
+	waitFor(t, "the delayed batch", func() bool { return rec.count() == 2 })
+	if d := time.Since(start); d < sseBatchDelay/2 {
+		t.Fatalf("batch sent after %v", d)
+	}
+	if rec.frames[1] != " Welt, wie" {
+		t.Fatalf("batch %q", rec.frames[1])
+	}
+
+	// sseBatchBytes are sent without waiting.
+	for range sseBatchBytes / 8 {
+		pw.Write([]byte(" geht's?"))
+	}
+	waitFor(t, "the full batch", func() bool { return rec.count() == 3 })
+	if want := strings.Repeat(" geht's?", sseBatchBytes/8); rec.frames[2] != want {
+		t.Fatalf("full batch %q", rec.frames[2])
+	}
+
+	// The rest is sent when the reader ends.
+	pw.Write([]byte(" Gut."))
+	pw.Close()
+	text := <-done
+	if rec.count() != 4 || rec.frames[3] != " Gut." {
+		t.Fatalf("frames %q", rec.frames)
+	}
+	if strings.Join(rec.frames, "") != text {
+		t.Fatalf("frames %q, text %q", rec.frames, text)
+	}
+}
+
+func TestStreamTokensSplitRunes(t *testing.T) {
+	in := strings.Repeat("Größe ä€😀 ", 40)
+	rec := &frameRecorder{}
+	text, err := streamTokens(iotest.OneByteReader(strings.NewReader(in)), rec, rec)
+	if err != nil || text != in {
+		t.Fatalf("text %q, %v", text, err)
+	}
+	for _, f := range rec.frames {
+		if !utf8.ValidString(f) || strings.ContainsRune(f, utf8.RuneError) {
+			t.Fatalf("broken frame %q", f)
+		}
+	}
+	if strings.Join(rec.frames, "") != in {
+		t.Fatalf("frames %q", rec.frames)
+	}
+}
+
+func TestOfflineAnswerIsOneFrame(t *testing.T) {
+	e := newTestEnv(t)
+	frames := e.ask(t, map[string]any{"question": "Was ist los?", "offline": true})
+	var tokens int
+	for _, f := range frames {
+		if f.Event == "" && f.Data != "[DONE]" {
+			tokens++
+		}
+	}
+	if text := sseText(t, frames); tokens != 1 || text != emptyKBAnswer {
+		t.Fatalf("%d token frames for %d runes: %q", tokens, utf8.RuneCountInString(text), text)
+	}
+}
+
+// pieceReader returns `s` in pieces of `n` bytes, like a model stream.
+type pieceReader struct {
+	s string
+	n int
+}
+
+func (p *pieceReader) Read(b []byte) (int, error) {
+	if p.s == "" {
+		return 0, io.EOF
+	}
+	n := copy(b, p.s[:min(p.n, len(p.s))])
+	p.s = p.s[n:]
+	return n, nil
+}
+
+// BenchmarkStreamTokens compares one frame per rune, as answers were
+// streamed before, with batched frames over a 20 KB answer.
+func BenchmarkStreamTokens(b *testing.B) {
+	answer := strings.Repeat("Der Rhein mündet bei Rotterdam in die Nordsee. ", 400)
+	b.Run("per-rune", func(b *testing.B) {
+		for b.Loop() {
+			rec := &frameRecorder{}
+			for _, r := range answer {
+				fmt.Fprintf(rec, "data: %s\n\n", mustJSON(string(r)))
+				rec.Flush()
+			}
+			b.ReportMetric(float64(rec.count()), "frames/op")
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for b.Loop() {
+			rec := &frameRecorder{}
+			streamTokens(&pieceReader{answer, 5}, rec, rec)
+			b.ReportMetric(float64(rec.count()), "frames/op")
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestGroundingGap(t *testing.T) {
+	hit := func(score float64) debugChunk { return debugChunk{Score: score, Content: "x", Article: "A"} }
+	for _, c := range []struct {
+		name string
+		di   *debugInfo
+		want string
+	}{
+		{"no retrieval", nil, "no_context"},
+		{"empty context", &debugInfo{}, "no_context"},
+		{"only neighbors", &debugInfo{Chunks: []debugChunk{{Score: -1, Content: "n", IsNeighbor: true}}}, "no_context"},
+		{"low score", &debugInfo{Chunks: []debugChunk{hit(0.3), hit(0.5)}}, "low_score"},
+		{"one relevant hit", &debugInfo{Chunks: []debugChunk{hit(0.3), hit(0.7)}}, ""},
+		{"article match", &debugInfo{Chunks: []debugChunk{hit(-1)}}, ""},
+	} {
+		if got := groundingGap(c.di, 0.6); got != c.want {
+			t.Errorf("%s: %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestNearestMisses(t *testing.T) {
+	di := &debugInfo{
+		Chunks: []debugChunk{
+			{Article: "A", ChunkIdx: 0, Score: 0.5},
+			{Article: "A", ChunkIdx: 1, Score: -1, IsNeighbor: true},
+		},
+		RejectedChunks: []rejectedChunk{
+			{Article: "B", ChunkIdx: 2, Score: 0.55, Reason: "k_limit"},
+			{Article: "A", ChunkIdx: 3, Score: 0.45, Reason: "below_threshold"},
+			{Article: "C", ChunkIdx: 0, Score: 0.2, Reason: "below_threshold"},
+			{Article: "D", ChunkIdx: 0, Score: 0.1, Reason: "below_threshold"},
+		},
+	}
+	want := []rejectedChunk{
+		{Article: "B", ChunkIdx: 2, Score: 0.55, Reason: "k_limit"},
+		{Article: "A", ChunkIdx: 0, Score: 0.5, Reason: "in_context"},
+		{Article: "C", ChunkIdx: 0, Score: 0.2, Reason: "below_threshold"},
+	}
+	if got := nearestMisses(di, 3); !slices.Equal(got, want) {
+		t.Fatalf("%+v, want %+v", got, want)
+	}
+}
+
+// strictAsk asks with `body` and returns the refusal meta event, which
+// is empty if the model was asked, and the answer.
+func strictAsk(t *testing.T, e *testEnv, body map[string]any) (refusal struct {
+	Refused string          `json:"refused"`
+	Nearest []rejectedChunk `json:"nearest"`
+}, text string) {
+	t.Helper()
+	frames := e.ask(t, body)
+	for _, m := range sseEvents(frames, "meta")[1:] {
+		json.Unmarshal([]byte(m), &refusal)
+	}
+	return refusal, sseText(t, frames)
+}
+
+func TestStrictRefusesEmptyContext(t *testing.T) {
+	e := newTestEnv(t, "Geraten.")
+	e.add(t, "Rhein", "Der Rhein mündet in die Nordsee.")
+	e.add(t, "Kaffee", "Kaffee wird geröstet.")
+
+	// The planner answers directly, so the context stays empty.
+	refusal, text := strictAsk(t, e, map[string]any{"question": "Wer erfand das Telefon?", "strict_grounding": true})
+	if refusal.Refused != "no_context" || e.llm.answerCount() != 0 {
+		t.Fatalf("refused %q after %d answers", refusal.Refused, e.llm.answerCount())
+	}
+	if len(refusal.Nearest) != 2 || refusal.Nearest[0].Reason != "answer_direct" {
+		t.Fatalf("nearest %+v", refusal.Nearest)
+	}
+	if text != strictRefusal("de", refusal.Nearest) {
+		t.Fatalf("answer %q", text)
+	}
+	if msg := e.lastAnswer(t); msg.Refused != "no_context" || msg.Content != text {
+		t.Fatalf("stored %+v", msg)
+	}
+
+	// The setting applies to every request, in its language.
+	e.settings.update(func(s *appSettings) error { s.StrictGrounding, s.Lang = true, "en"; return nil })
+	if _, text := strictAsk(t, e, map[string]any{"question": "Wer erfand das Telefon?", "chat_id": e.chats.order[0]}); text != strictRefusal("en", refusal.Nearest) {
+		t.Fatalf("english answer %q", text)
+	}
+}
+
+func TestStrictRefusesLowScore(t *testing.T) {
+	e := newTestEnv(t, "Geraten.")
+	e.add(t, "Rhein", "Der Rhein mündet bei Rotterdam in die Nordsee.")
+	e.add(t, "Kaffee", "Kaffee wird geröstet.")
+	// The planner takes the best hit whatever its score.
+	e.llm.aux = func(chatReq) string { return `{"action":"RETRIEVE_MORE","k":1,"threshold":0.01}` }
+	question := "Wie lang ist der Rhein?"
+
+	refusal, _ := strictAsk(t, e, map[string]any{"question": question, "strict_grounding": true})
+	if refusal.Refused != "low_score" || e.llm.answerCount() != 0 {
+		t.Fatalf("refused %q after %d answers", refusal.Refused, e.llm.answerCount())
+	}
+	if len(refusal.Nearest) == 0 || refusal.Nearest[0].Article != "Rhein" || refusal.Nearest[0].Reason != "in_context" {
+		t.Fatalf("nearest %+v", refusal.Nearest)
+	}
+	if msg := e.lastAnswer(t); msg.Refused != "low_score" {
+		t.Fatalf("stored %+v", msg)
+	}
+
+	// Without strict grounding the model answers from the weak context.
+	refusal, text := strictAsk(t, e, map[string]any{"question": question})
+	if refusal.Refused != "" || text != "Geraten." || e.llm.answerCount() != 1 {
+		t.Fatalf("non-strict: refused %q, answer %q", refusal.Refused, text)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	for _, c := range []struct {
+		in   []string
+		want []string
+		err  bool
+	}{
+		{nil, []string{}, false},
+		{[]string{" Legal ", "legal", "", "2024", "  "}, []string{"legal", "2024"}, false},
+		{[]string{"Projekt-A", "projekt-a"}, []string{"projekt-a"}, false},
+		{[]string{"a,b"}, nil, true},
+		{[]string{strings.Repeat("x", maxTagLen)}, []string{strings.Repeat("x", maxTagLen)}, false},
+		{[]string{strings.Repeat("ä", maxTagLen+1)}, nil, true},
+	} {
+		got, err := normalizeTags(c.in)
+		if (err != nil) != c.err || !slices.Equal(got, c.want) {
+			t.Errorf("%q: %q, %v", c.in, got, err)
+		}
+	}
+	many := make([]string, maxSourceTags+1)
+	for i := range many {
+		many[i] = fmt.Sprint("t", i)
+	}
+	if _, err := normalizeTags(many); err == nil {
+		t.Errorf("%d tags accepted", len(many))
+	}
+}
+
+// tagEnv holds "Rhein" tagged legal and 2024 and untagged "Elbe".
+func tagEnv(t *testing.T, replies ...string) *testEnv {
+	t.Helper()
+	e := newTestEnv(t, replies...)
+	e.add(t, "Rhein", "Der Rhein mündet in die Nordsee.")
+	e.add(t, "Elbe", "Die Elbe mündet in die Nordsee.")
+	if status, out := e.post(t, "/api/sources/tags", map[string]any{"article": "Rhein", "tags": []string{"Legal", "2024"}}); status != 200 {
+		t.Fatalf("tags: %d %s", status, out)
+	}
+	return e
+}
+
+// sourceNames returns the names GET /api/sources lists for `query`.
+func (e *testEnv) sourceNames(t *testing.T, query string) []string {
+	t.Helper()
+	resp, err := http.Get(e.srv.URL + "/api/sources" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var sources []sourceInfo
+	if err := json.NewDecoder(resp.Body).Decode(&sources); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, src := range sources {
+		names = append(names, src.Name)
+	}
+	return names
+}
+
+func TestSourceTags(t *testing.T) {
+	e := tagEnv(t)
+	if src, _ := e.rag.getSource("Rhein"); !slices.Equal(src.Tags, []string{"legal", "2024"}) {
+		t.Fatalf("tags %q", src.Tags)
+	}
+	if got := e.sourceNames(t, "?tag=LEGAL"); !slices.Equal(got, []string{"Rhein"}) {
+		t.Fatalf("?tag=LEGAL: %v", got)
+	}
+	if got := e.sourceNames(t, "?tag=fehlt"); len(got) != 0 {
+		t.Fatalf("?tag=fehlt: %v", got)
+	}
+	if got := e.sourceNames(t, ""); len(got) != 2 {
+		t.Fatalf("all sources: %v", got)
+	}
+
+	for _, body := range []map[string]any{
+		{"article": "Mosel", "tags": []string{"legal"}},
+		{"article": "Rhein", "tags": []string{"a,b"}},
+		{"tags": []string{"legal"}},
+	} {
+		if status, _ := e.post(t, "/api/sources/tags", body); status != 400 {
+			t.Errorf("%v: status %d", body, status)
+		}
+	}
+	// An empty list removes the tags.
+	if status, _ := e.post(t, "/api/sources/tags", map[string]any{"article": "Rhein", "tags": []string{}}); status != 200 {
+		t.Fatalf("clear: %d", status)
+	}
+	if got := e.sourceNames(t, "?tag=legal"); len(got) != 0 {
+		t.Fatalf("after clearing: %v", got)
+	}
+}
+
+func TestAskFilteredByTags(t *testing.T) {
+	e := tagEnv(t, "Nordsee.")
+	e.llm.aux = func(chatReq) string { return `{"action":"RETRIEVE_MORE","k":5,"threshold":0.01}` }
+
+	frames := e.ask(t, map[string]any{"question": "Wohin mündet der Fluss?", "tags": []string{"legal"}, "debug": true})
+	var meta struct {
+		Tags       []string `json:"tags"`
+		TagSources int      `json:"tag_sources"`
+		EmptyKB    bool     `json:"empty_kb"`
+	}
+	json.Unmarshal([]byte(sseEvents(frames, "meta")[0]), &meta)
+	if !slices.Equal(meta.Tags, []string{"legal"}) || meta.TagSources != 1 || meta.EmptyKB {
+		t.Fatalf("meta %+v", meta)
+	}
+	var d struct {
+		Retrieval debugInfo `json:"retrieval"`
+	}
+	json.Unmarshal([]byte(sseEvents(frames, "debug")[0]), &d)
+	if len(d.Retrieval.Chunks) == 0 {
+		t.Fatal("no context")
+	}
+	for _, c := range d.Retrieval.Chunks {
+		if c.Article != "Rhein" {
+			t.Fatalf("untagged chunk in the context: %+v", c)
+		}
+	}
+	query := map[string]any{"query": "Der Rhein mündet in die Nordsee.", "k": 5}
+	if _, out := e.post(t, "/api/search", query); !strings.Contains(out, "Elbe") {
+		t.Fatalf("unfiltered search: %s", out)
+	}
+	query["tags"] = []string{"2024"}
+	status, out := e.post(t, "/api/search", query)
+	if status != 200 || !strings.Contains(out, "Rhein") || strings.Contains(out, "Elbe") {
+		t.Fatalf("search: %d %s", status, out)
+	}
+}
+
+func TestTagMatchingNothing(t *testing.T) {
+	e := tagEnv(t, "Aus dem Gedächtnis.")
+	frames := e.ask(t, map[string]any{"question": "Wohin mündet der Rhein?", "tags": []string{"fehlt"}, "debug": true})
+
+	var meta struct {
+		EmptyKB    bool `json:"empty_kb"`
+		TagSources int  `json:"tag_sources"`
+	}
+	json.Unmarshal([]byte(sseEvents(frames, "meta")[0]), &meta)
+	var d struct {
+		Retrieval debugInfo `json:"retrieval"`
+	}
+	json.Unmarshal([]byte(sseEvents(frames, "debug")[0]), &d)
+	if !meta.EmptyKB || meta.TagSources != 0 || d.Retrieval.Decision != "empty_kb" {
+		t.Fatalf("meta %+v, decision %q", meta, d.Retrieval.Decision)
+	}
+	e.llm.mu.Lock()
+	embeds, reqs := e.llm.embeds, slices.Clone(e.llm.chatReqs)
+	e.llm.mu.Unlock()
+	if embeds != 0 || len(reqs) != 1 {
+		t.Fatalf("%d embeddings and %d chat requests", embeds, len(reqs))
+	}
+	if system := reqs[0].Messages[0].Content; !strings.Contains(system, strings.TrimSpace(fmt.Sprintf(noTaggedNote, "fehlt"))) {
+		t.Fatalf("system prompt %q", system)
+	}
+
+	frames = e.ask(t, map[string]any{"question": "Wohin mündet der Rhein?", "tags": []string{"fehlt"}, "offline": true})
+	if text := sseText(t, frames); text != fmt.Sprintf(noTaggedAnswer, "fehlt") {
+		t.Fatalf("offline answer %q", text)
+	}
+
+	if status, out := e.post(t, "/api/search", map[string]any{"query": "Rhein", "tags": []string{"fehlt"}}); status != 200 || strings.TrimSpace(out) != "[]" {
+		t.Fatalf("search: %d %s", status, out)
+	}
+	e.llm.mu.Lock()
+	defer e.llm.mu.Unlock()
+	if e.llm.embeds != 0 {
+		t.Fatalf("%d embeddings", e.llm.embeds)
+	}
+}
+
+func TestTagsSurviveExportImport(t *testing.T) {
+	src := tagEnv(t)
+	resp, err := http.Get(src.srv.URL + "/api/db/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	dst := newTestEnv(t)
+	resp, err = http.Post(dst.srv.URL+"/api/db/import", "application/x-ndjson", strings.NewReader(string(dump)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("import: %d", resp.StatusCode)
+	}
+	if got := dst.sourceNames(t, "?tag=2024"); !slices.Equal(got, []string{"Rhein"}) {
+		t.Fatalf("imported ?tag=2024: %v", got)
+	}
+	if src, _ := dst.rag.getSource("Elbe"); len(src.Tags) != 0 {
+		t.Fatalf("Elbe tags %q", src.Tags)
+	}
+}
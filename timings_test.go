@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAskTimings(t *testing.T) {
+	reply := "Der Rhein mündet in die Nordsee."
+	e := newTestEnv(t, `[TOOL_REQUEST]{"tool":"rag_search","query":"Rhein"}[/TOOL_REQUEST]`, reply)
+	e.llm.mu.Lock()
+	e.llm.firstDelay = 150 * time.Millisecond
+	e.llm.pieceDelay = 5 * time.Millisecond
+	e.llm.mu.Unlock()
+
+	frames := e.ask(t, map[string]any{"question": "Wohin fließt der Rhein?"})
+	events := sseEvents(frames, "timings")
+	if len(events) != 1 {
+		t.Fatalf("%d timings events", len(events))
+	}
+	var tm llmTimings
+	if err := json.Unmarshal([]byte(events[0]), &tm); err != nil {
+		t.Fatal(err)
+	}
+	if len(tm.Calls) != 2 {
+		t.Fatalf("calls %+v", tm.Calls)
+	}
+	if tm.TTFBMs < 150 || tm.TTFBMs > 1000 || tm.TTFBMs != tm.Calls[0].TTFBMs {
+		t.Fatalf("ttfb %d ms with a 150 ms delay", tm.TTFBMs)
+	}
+	for _, c := range tm.Calls {
+		if c.TTFBMs < 150 || c.TotalMs < c.TTFBMs {
+			t.Fatalf("call %+v", c)
+		}
+	}
+	// fakeLLM streams 5 bytes per delta.
+	if want := (len(reply) + 4) / 5; tm.Calls[1].Tokens != want {
+		t.Fatalf("%d tokens in the answer, want %d", tm.Calls[1].Tokens, want)
+	}
+	if tm.TotalMs != tm.Calls[0].TotalMs+tm.Calls[1].TotalMs || tm.Tokens != tm.Calls[0].Tokens+tm.Calls[1].Tokens || tm.TokensPerS <= 0 {
+		t.Fatalf("totals %+v", tm)
+	}
+	if stored := e.lastAnswer(t).Timings; stored == nil || stored.TTFBMs != tm.TTFBMs || stored.Tokens != tm.Tokens {
+		t.Fatalf("stored timings %+v, streamed %+v", stored, tm)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// lastAnswer returns the last stored assistant message of the only chat.
+func (e *testEnv) lastAnswer(t *testing.T) chatMessage {
+	t.Helper()
+	if len(e.chats.order) != 1 {
+		t.Fatalf("%d chats", len(e.chats.order))
+	}
+	msgs := e.chats.get(e.chats.order[0]).Messages
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == "assistant" {
+			return msgs[i]
+		}
+	}
+	t.Fatal("no assistant message")
+	return chatMessage{}
+}
+
+func TestToolLoopTwoTools(t *testing.T) {
+	e := newTestEnv(t,
+		`Ich suche. [TOOL_REQUEST]{"tool":"rag_search","query":"Rhein"}[/TOOL_REQUEST]`,
+		`Noch etwas. [TOOL_REQUEST]{"tool":"rag_search","query":"Elbe"}[/TOOL_REQUEST]`,
+		"Beide Flüsse münden in die Nordsee.",
+	)
+	e.add(t, "Rhein", "Der Rhein mündet in die Nordsee.")
+	e.add(t, "Elbe", "Die Elbe mündet bei Cuxhaven in die Nordsee.")
+
+	frames := e.ask(t, map[string]any{"question": "Wohin fließen Rhein und Elbe?"})
+	reqs, results := sseEvents(frames, "tool_request"), sseEvents(frames, "tool_result")
+	if len(reqs) != 2 || len(results) != 2 {
+		t.Fatalf("%d tool requests, %d results", len(reqs), len(results))
+	}
+	if !strings.Contains(reqs[0], "Rhein") || !strings.Contains(reqs[1], "Elbe") {
+		t.Fatalf("tool requests out of order: %v", reqs)
+	}
+	if e.llm.answerCount() != 3 {
+		t.Fatalf("%d answer segments, want 3", e.llm.answerCount())
+	}
+	text := sseText(t, frames)
+	if !strings.Contains(text, "Nordsee") || strings.Contains(text, "TOOL_REQUEST") {
+		t.Fatalf("streamed answer %q", text)
+	}
+	stored := e.lastAnswer(t).Content
+	if !strings.Contains(stored, "Beide Flüsse") || strings.Contains(stored, "TOOL_REQUEST") {
+		t.Fatalf("stored answer %q", stored)
+	}
+}
+
+func TestToolLoopLimit(t *testing.T) {
+	e := newTestEnv(t, `Weiter. [TOOL_REQUEST]{"tool":"rag_search","query":"Rhein"}[/TOOL_REQUEST]`)
+	e.add(t, "Rhein", "Der Rhein mündet in die Nordsee.")
+
+	frames := e.ask(t, map[string]any{"question": "Wohin fließt der Rhein?"})
+	limit := e.settings.get().MaxToolIterations
+	if got := len(sseEvents(frames, "tool_result")); got != limit {
+		t.Fatalf("%d tool results, want %d", got, limit)
+	}
+	if e.llm.answerCount() != limit+1 {
+		t.Fatalf("%d answer segments, want %d", e.llm.answerCount(), limit+1)
+	}
+	text := sseText(t, frames)
+	if !strings.Contains(text, "Tool-Iterationen") || strings.Contains(text, "TOOL_REQUEST") {
+		t.Fatalf("answer %q", text)
+	}
+	if stored := e.lastAnswer(t).Content; !strings.Contains(stored, "Tool-Iterationen") {
+		t.Fatalf("stored answer %q", stored)
+	}
+}
+
+func TestParseToolRequests(t *testing.T) {
+	cases := []struct {
+		name  string
+		text  string
+		want  []toolRequest
+		found bool
+		errs  int
+		strip string
+	}{
+		{"brace in string", `Moment. [TOOL_REQUEST]{"tool":"nanogo","query":"func main(){fmt.Println(\"}\")}"}[/TOOL_REQUEST]`,
+			[]toolRequest{{Tool: "nanogo", Query: `func main(){fmt.Println("}")}`}}, true, 0, "Moment."},
+		{"nested object and trailing text", `x [TOOL_REQUEST] {"tool":"api-1","query":{"a":{"b":1}}}  egal [/TOOL_REQUEST] y`,
+			[]toolRequest{{Tool: "api-1", Query: `{"a":{"b":1}}`}}, true, 0, "x  y"},
+		{"two requests and a duplicate", `[TOOL_REQUEST]{"tool":"a","query":"1"}[/TOOL_REQUEST][TOOL_REQUEST]{"tool":"b","query":"2"}[/TOOL_REQUEST][TOOL_REQUEST]{"tool":"a","query":"1"}[/TOOL_REQUEST]`,
+			[]toolRequest{{Tool: "a", Query: "1"}, {Tool: "b", Query: "2"}}, true, 0, ""},
+		{"invalid JSON", `x [TOOL_REQUEST]{"tool":kaputt}[/TOOL_REQUEST] y`, nil, true, 1, "x  y"},
+		{"missing tool", `x [TOOL_REQUEST]{"query":"q"}[/TOOL_REQUEST]`, nil, true, 1, "x"},
+		{"unterminated", `x [TOOL_REQUEST]{"tool":"a"`, nil, true, 1, "x"},
+		{"no marker", `nur Text {"tool":"a"}`, nil, false, 0, `nur Text {"tool":"a"}`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reqs, found, errs := parseToolRequests(c.text)
+			if found != c.found || len(errs) != c.errs || len(reqs) != len(c.want) {
+				t.Fatalf("got %v found=%v errs=%v", reqs, found, errs)
+			}
+			for i := range reqs {
+				if reqs[i] != c.want[i] {
+					t.Fatalf("request %d: got %+v, want %+v", i, reqs[i], c.want[i])
+				}
+			}
+			if got := stripToolRequests(c.text); got != c.strip {
+				t.Fatalf("strip: got %q, want %q", got, c.strip)
+			}
+		})
+	}
+}
+
+func TestUnparseableToolRequestIsHidden(t *testing.T) {
+	e := newTestEnv(t, `Einen Moment. [TOOL_REQUEST]{"tool":kaputt}[/TOOL_REQUEST]`)
+	frames := e.ask(t, map[string]any{"question": "Was ist los?", "debug": true})
+	if text := sseText(t, frames); strings.Contains(text, "TOOL_REQUEST") || strings.Contains(text, "kaputt") {
+		t.Fatalf("marker shown: %q", text)
+	}
+	if stored := e.lastAnswer(t).Content; stored != "Einen Moment." {
+		t.Fatalf("stored answer %q", stored)
+	}
+	if notes := sseEvents(frames, "debug_note"); len(notes) != 1 {
+		t.Fatalf("debug notes: %v", notes)
+	}
+}
+
+func TestToolExecuteDeniedIsRecorded(t *testing.T) {
+	e := newTestEnv(t)
+	status, _ := e.post(t, "/api/tool/execute", map[string]any{"tool": "sql", "query": "SELECT 1", "chat_id": "chat-denied-test"})
+	if status != 403 {
+		t.Fatalf("status %d", status)
+	}
+	for _, entry := range toolHistory.list("sql", time.Time{}, time.Time{}, 1000) {
+		if entry.ChatID == "chat-denied-test" {
+			if entry.Outcome != "not_allowed" || entry.Query != "SELECT 1" {
+				t.Fatalf("entry %+v", entry)
+			}
+			return
+		}
+	}
+	t.Fatal("denied call not in the tool history")
+}
+
+func TestToolRequestFilter(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{`Moment. [TOOL_REQUEST]{"tool":"rag_search","query":"Rhein"}[/TOOL_REQUEST] Fertig.`, "Moment.  Fertig."},
+		{`Liste [TOOLS] und [TOOL_REQ bleibt`, "Liste [TOOLS] und [TOOL_REQ bleibt"},
+		{`a[TOOL_REQUEST]{"tool":"x"}`, "a"},
+		{`Ende [TOOL_REQ`, "Ende [TOOL_REQ"},
+	} {
+		for n := 1; n <= 7; n++ {
+			var f toolRequestFilter
+			var out strings.Builder
+			for i := 0; i < len(c.in); i += n {
+				out.WriteString(f.write(c.in[i:min(i+n, len(c.in))]))
+			}
+			out.WriteString(f.flush())
+			if out.String() != c.want {
+				t.Errorf("%q in %d-byte pieces: %q, want %q", c.in, n, out.String(), c.want)
+			}
+		}
+	}
+}
+
+func TestStreamedAnswerHidesToolMarkers(t *testing.T) {
+	e := newTestEnv(t,
+		`Ich schaue nach. [TOOL_REQUEST]{"tool":"rag_search","query":"Rhein"}[/TOOL_REQUEST]`,
+		"Der Rhein mündet in die Nordsee.",
+	)
+	e.llm.pieceLen = 3
+	e.add(t, "Rhein", "Der Rhein mündet in die Nordsee.")
+
+	frames := e.ask(t, map[string]any{"question": "Wohin fließt der Rhein?"})
+	if len(sseEvents(frames, "tool_result")) != 1 {
+		t.Fatal("the tool was not run")
+	}
+	for _, f := range frames {
+		if f.Event == "" && f.Data != "[DONE]" && strings.ContainsAny(f.Data, "[]{}") {
+			t.Fatalf("marker bytes streamed: %s", f.Data)
+		}
+	}
+	if text := sseText(t, frames); !strings.Contains(text, "Ich schaue nach.") || !strings.Contains(text, "Nordsee") {
+		t.Fatalf("streamed answer %q", text)
+	}
+}
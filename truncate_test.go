@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"Wie ist das Wetter in Köln heute", 20, "Wie ist das Wetter…"},
+		{"Grüße", 5, "Grüße"},
+		{"Grüßeeeee", 5, "Grüß…"},
+		{"abcdefghijklmnop", 8, "abcdefg…"},
+		{"🎉🎉🎉🎉", 3, "🎉🎉…"},
+		{"äöü", 0, ""},
+		{"äöü", -1, ""},
+	} {
+		if got := truncate(c.s, c.n); got != c.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", c.s, c.n, got, c.want)
+		}
+	}
+	if got := truncateTitle(strings.Repeat("Grüße ", 20)); utf8.RuneCountInString(got) > 60 || !strings.HasSuffix(got, "e…") {
+		t.Errorf("title %q", got)
+	}
+}
+
+func FuzzTruncate(f *testing.F) {
+	for _, s := range []string{"", "Grüße aus Köln 🎉🎉", "äöüß äöüß äöüß", "👩‍👩‍👧 Familie", "abc def ghi jkl", "日本語のテキスト"} {
+		for _, n := range []int{0, 1, 5, 13, 60} {
+			f.Add(s, n)
+		}
+	}
+	f.Fuzz(func(t *testing.T, s string, n int) {
+		if !utf8.ValidString(s) {
+			return
+		}
+		n %= 300
+		out := truncate(s, n)
+		if !utf8.ValidString(out) {
+			t.Fatalf("truncate(%q, %d) = %q is not valid UTF-8", s, n, out)
+		}
+		if c := utf8.RuneCountInString(out); c > max(n, 0) {
+			t.Fatalf("truncate(%q, %d) = %q has %d runes", s, n, out, c)
+		}
+		if utf8.RuneCountInString(s) <= n && out != s {
+			t.Fatalf("truncate(%q, %d) = %q changed a short string", s, n, out)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// upload posts `data` as file `name` to /api/upload.
+func (e *testEnv) upload(t *testing.T, name string, data []byte) (int, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write(data)
+	mw.Close()
+	resp, err := http.Post(e.srv.URL+"/api/upload", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(out)
+}
+
+func TestDecodeFileText(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), make([]byte, 100)...)
+	if _, err := decodeFileText(png); err != errBinaryFile {
+		t.Fatalf("PNG: %v", err)
+	}
+	noNUL := make([]byte, 2000)
+	for i := range noNUL {
+		noNUL[i] = byte(i*37%255 + 1)
+	}
+	if _, err := decodeFileText(noNUL); err != errBinaryFile {
+		t.Fatalf("random bytes without NUL: %v", err)
+	}
+	for in, want := range map[string]string{
+		"K\xf6ln liegt am Rhein \x80 \x93Zitat\x94": "Köln liegt am Rhein € “Zitat”",
+		"\xff\xfeH\x00\xe4\x00":                     "Hä",
+		"\xfe\xff\x00H\x00\xe4":                     "Hä",
+		"\xef\xbb\xbfMünchen":                       "München",
+		"Tabs\tund\r\nZeilen":                       "Tabs\tund\r\nZeilen",
+	} {
+		if got, err := decodeFileText([]byte(in)); err != nil || got != want {
+			t.Errorf("%q: %q %v, want %q", in, got, err, want)
+		}
+	}
+	// A multi-byte rune cut by the sniffing window is not binary.
+	long := append(bytes.Repeat([]byte("a"), binarySniffBytes-1), "äöü"...)
+	if _, err := decodeFileText(long); err != nil {
+		t.Fatalf("rune at the end of the sniffed bytes: %v", err)
+	}
+}
+
+func TestUploadZipSkipsBinary(t *testing.T) {
+	data, err := os.ReadFile("testdata/upload/notes.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEnv(t)
+	status, out := e.upload(t, "notes.zip", data)
+	if status != 200 {
+		t.Fatalf("upload: %d %s", status, out)
+	}
+	var res struct {
+		Files         int      `json:"files"`
+		Errors        []string `json:"errors"`
+		SkippedBinary []string `json:"skipped_binary"`
+	}
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != 2 || len(res.Errors) != 0 || !slices.Equal(res.SkippedBinary, []string{"notes.txt"}) {
+		t.Fatalf("result %s", out)
+	}
+	var contents []string
+	for _, src := range []string{"upload:notes.zip:rhein.md", "upload:notes.zip:koeln.txt", "upload:notes.zip:notes.txt"} {
+		contents = append(contents, strings.Join(storedContents(t, e.rag, src), " "))
+	}
+	if !strings.Contains(contents[0], "Nordsee") || contents[1] != "Köln liegt am Rhein und kostet 5 € Eintritt." || contents[2] != "" {
+		t.Fatalf("stored %q", contents)
+	}
+}
+
+func TestUploadBinaryFile(t *testing.T) {
+	e := newTestEnv(t)
+	png := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), make([]byte, 100)...)
+	if status, out := e.upload(t, "notes.txt", png); status != http.StatusUnsupportedMediaType || !strings.Contains(out, "binary") {
+		t.Fatalf("upload: %d %s", status, out)
+	}
+	if n := e.rag.docCount(); n != 0 {
+		t.Fatalf("%d chunks stored", n)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	tinysql "github.com/SimonWaldherr/tinySQL"
+)
+
+const vecQueryTest = "SELECT article, chunk_idx, VEC_COSINE_SIMILARITY(embedding, " + qvecParam + ") AS score FROM chunks ORDER BY score DESC LIMIT 5"
+
+// TestParseVecQueryBinds fails when tinySQL's AST changes so that the
+// query vector can no longer be bound and searches fall back to inlining
+// it as JSON.
+func TestParseVecQueryBinds(t *testing.T) {
+	stmt, err := tinysql.ParseSQL(vecQueryTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vec := []float64{0.5, 0.25}
+	if !bindLiteral(reflect.ValueOf(stmt), "$qvec", vec) {
+		t.Fatal("the query vector literal was not found in the AST")
+	}
+	if bindLiteral(reflect.ValueOf(stmt), "$qvec", vec) {
+		t.Fatal("the literal is still there after binding")
+	}
+}
+
+func TestParseVecQueryMatchesInline(t *testing.T) {
+	e := newTestEnv(t)
+	for _, text := range []string{"Der Rhein fließt in die Nordsee", "Die Donau fließt ins Schwarze Meer", "Kaffee und Tee", "Rhein Rhein Rhein"} {
+		e.add(t, text, text)
+	}
+	qvec := wordVec("Wohin fließt der Rhein")
+	bound, err := parseVecQuery(vecQueryTest, qvec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inline, err := tinysql.ParseSQL(inlineVecQuery(vecQueryTest, qvec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	got, err := tinysql.Execute(ctx, e.rag.db, e.rag.collection, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := tinysql.Execute(ctx, e.rag.db, e.rag.collection, inline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Rows) != 4 || !reflect.DeepEqual(parseHits(got.Rows), parseHits(want.Rows)) {
+		t.Fatalf("bound %v, inline %v", got.Rows, want.Rows)
+	}
+}
+
+// BenchmarkVectorSearch compares the search with the bound query vector
+// to inlining it as JSON, on 50,000 chunks with 768 dimensions:
+//
+//	go test -run XXX -bench VectorSearch -benchmem
+func BenchmarkVectorSearch(b *testing.B) {
+	const chunks, dims = 50000, 768
+	e := newTestEnv(b)
+	rng := rand.New(rand.NewPCG(1, 2))
+	randVec := func() []float64 {
+		v := make([]float64, dims)
+		for i := range v {
+			v[i] = rng.Float64()*2 - 1
+		}
+		return v
+	}
+	for a := 0; a < chunks/1000; a++ {
+		texts, vecs := make([]string, 1000), make([][]float64, 1000)
+		for i := range texts {
+			texts[i], vecs[i] = fmt.Sprintf("Chunk %d/%d", a, i), randVec()
+		}
+		if _, err := e.rag.storeChunks(sourceInfo{Name: fmt.Sprintf("A%d", a)}, texts, vecs); err != nil {
+			b.Fatal(err)
+		}
+	}
+	qvec := randVec()
+	q := fmt.Sprintf("SELECT article, chunk_idx, lang, VEC_COSINE_SIMILARITY(embedding, %s) AS score FROM chunks ORDER BY score DESC LIMIT 100", qvecParam)
+	ctx := context.Background()
+	b.Run("bound", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			stmt, err := parseVecQuery(q, qvec)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := tinysql.Execute(ctx, e.rag.db, e.rag.collection, stmt); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("inline", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			stmt, err := tinysql.ParseSQL(inlineVecQuery(q, qvec))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := tinysql.Execute(ctx, e.rag.db, e.rag.collection, stmt); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkNeighborFetch compares loading the neighbors of 5 hits with
+// one query per neighbor, as it was done before, to the single query of
+// withNeighbors, on 10,000 chunks in 100 sources:
+//
+//	go test -run XXX -bench NeighborFetch -benchmem
+func BenchmarkNeighborFetch(b *testing.B) {
+	const sources, perSource = 100, 100
+	e := newTestEnv(b)
+	text := strings.Repeat("Der Rhein mündet bei Rotterdam in die Nordsee. ", 16)
+	for a := range sources {
+		texts, vecs := make([]string, perSource), make([][]float64, perSource)
+		for i := range texts {
+			texts[i], vecs[i] = fmt.Sprintf("%d/%d %s", a, i, text), wordVec(text)
+		}
+		if _, err := e.rag.storeChunks(sourceInfo{Name: fmt.Sprintf("A%d", a)}, texts, vecs); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var sel []chunkHit
+	for _, a := range []int{3, 17, 42, 42, 99} {
+		sel = append(sel, chunkHit{article: fmt.Sprintf("A%d", a), chunkIdx: 10 + len(sel)*20, score: 0.9, content: text})
+	}
+	b.Run("per-chunk", func(b *testing.B) {
+		for b.Loop() {
+			queries := 0
+			for _, h := range sel {
+				for _, idx := range []int{h.chunkIdx - 1, h.chunkIdx + 1} {
+					e.rag.dbMu.RLock()
+					_, err := e.rag.execLocked(fmt.Sprintf("SELECT content FROM chunks WHERE article = %s AND chunk_idx = %d", sqlText(h.article), idx))
+					e.rag.dbMu.RUnlock()
+					if err != nil {
+						b.Fatal(err)
+					}
+					queries++
+				}
+			}
+			b.ReportMetric(float64(queries), "queries/op")
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for b.Loop() {
+			if got, err := e.rag.withNeighbors(sel, map[chunkKey]bool{}); err != nil || len(got) != 3*len(sel) {
+				b.Fatalf("%d chunks, %v", len(got), err)
+			}
+			// fetchChunks loads all neighbors with one query.
+			b.ReportMetric(1, "queries/op")
+		}
+	})
+}
+
+// BenchmarkCandidateContent compares searching candidates without their
+// content, which withNeighbors then loads for the 5 selected hits in the
+// query for their neighbors, to fetching the content with every
+// candidate, as it was done before, on a disk-mode database with 10,000
+// chunks:
+//
+//	go test -run XXX -bench CandidateContent -benchmem
+//
+// Both take 60-100 ms per search with tinySQL v0.5.6, which builds every
+// row with all its columns for the scan; the difference is smaller than
+// the noise between runs.
+func BenchmarkCandidateContent(b *testing.B) {
+	const sources, perSource, dims = 100, 100, 256
+	rag := openRAG(b, newFakeLLM(b), filepath.Join(b.TempDir(), "db"), tinysql.ModeDisk)
+	b.Cleanup(func() { rag.db.Close() })
+	rng := rand.New(rand.NewPCG(1, 2))
+	randVec := func() []float64 {
+		v := make([]float64, dims)
+		for i := range v {
+			v[i] = rng.Float64()*2 - 1
+		}
+		return v
+	}
+	text := strings.Repeat("Der Rhein mündet bei Rotterdam in die Nordsee. ", 16)
+	for a := range sources {
+		texts, vecs := make([]string, perSource), make([][]float64, perSource)
+		for i := range texts {
+			texts[i], vecs[i] = fmt.Sprintf("%d/%d %s", a, i, text), randVec()
+		}
+		if _, err := rag.storeChunks(sourceInfo{Name: fmt.Sprintf("A%d", a)}, texts, vecs); err != nil {
+			b.Fatal(err)
+		}
+	}
+	qvec := randVec()
+	ctx := context.Background()
+	limit := candidateLimit(5)
+	// loadContext loads the 5 best hits with their neighbors.
+	loadContext := func(b *testing.B, hits []chunkHit) {
+		chunks, err := rag.withNeighbors(hits[:5], map[chunkKey]bool{})
+		if err != nil || len(chunks) < 5 || chunks[1].content == "" {
+			b.Fatalf("%d chunks, %v", len(chunks), err)
+		}
+	}
+	b.Run("full-rows", func(b *testing.B) {
+		b.ReportAllocs()
+		q := fmt.Sprintf("SELECT article, chunk_idx, lang, content, VEC_COSINE_SIMILARITY(embedding, %s) AS score FROM chunks ORDER BY score DESC LIMIT %d", qvecParam, limit)
+		for b.Loop() {
+			stmt, err := parseVecQuery(q, qvec)
+			if err != nil {
+				b.Fatal(err)
+			}
+			rag.dbMu.RLock()
+			rs, err := tinysql.Execute(ctx, rag.db, rag.collection, stmt)
+			rag.dbMu.RUnlock()
+			if err != nil {
+				b.Fatal(err)
+			}
+			loadContext(b, parseHits(rs.Rows))
+		}
+	})
+	b.Run("lazy", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			hits, err := rag.searchHits(ctx, qvec, limit, "")
+			if err != nil {
+				b.Fatal(err)
+			}
+			loadContext(b, hits)
+		}
+	})
+}